@@ -63,6 +63,9 @@ func (cache *httpCache) StoreExtra(target *core.BuildTarget, key []byte, file st
 		response, err := http.Post(cache.URL+"/artifact/"+artifact, "application/octet-stream", file)
 		if err != nil {
 			log.Warning("Failed to send artifact to %s: %s", cache.URL+"/artifact/"+artifact, err)
+		} else if response.StatusCode == http.StatusPreconditionFailed {
+			// The server is read-only at the moment; we just don't store there.
+			log.Debug("Not storing %s, http cache is read-only", artifact)
 		} else if response.StatusCode < 200 || response.StatusCode > 299 {
 			log.Warning("Failed to send artifact to %s: got response %s", cache.URL+"/artifact/"+artifact, response.Status)
 		}
@@ -24,9 +24,9 @@ func init() {
 	target = core.NewBuildTarget(label)
 
 	// Arbitrary large numbers so the cleaner never needs to run.
-	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000)
+	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000, server.ServerOptions{})
 	key, _ = ioutil.ReadFile("src/cache/test_data/testfile")
-	testServer := httptest.NewServer(server.BuildRouter(cache))
+	testServer := httptest.NewServer(server.BuildRouter(cache, server.ServerOptions{}))
 
 	config := core.DefaultConfiguration()
 	config.Cache.HTTPURL.UnmarshalFlag(testServer.URL)
@@ -1,3 +1,4 @@
+//go:build proto
 // +build proto
 
 // RPC-based remote cache. Similar to HTTP but likely higher performance.
@@ -11,11 +12,13 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -23,7 +26,10 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // Registers the gzip compressor
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	pb "cache/proto/rpc_cache"
 	"cache/tools"
@@ -31,7 +37,6 @@ import (
 )
 
 const maxErrors = 5
-const replicas = 2
 
 // We use zeroKey in cases where we need to supply a hash but it actually doesn't matter.
 var zeroKey = []byte{0, 0, 0, 0}
@@ -48,12 +53,66 @@ type rpcCache struct {
 	maxMsgSize int
 	nodes      []cacheNode
 	hostname   string
+	// If true, refuse to serve artifacts that were only found on a fallback replica.
+	strictReads bool
+	// The zone of the cluster we're in, if any; reads prefer nodes in it.
+	zone string
+	// Count of reads that were served while the cluster was degraded.
+	degradedReads int32
+	// Nonzero once we've told the user that the server is read-only.
+	readOnlyLogged int32
+	// The optional features the server supports, or nil if it's too old to tell us.
+	capabilities map[pb.CapabilitiesResponse_Feature]bool
+	// Chooses which replica to read from first when neither is otherwise preferred.
+	balancer readBalancer
 }
 
 type cacheNode struct {
-	cache     *rpcCache
-	hashStart uint32
-	hashEnd   uint32
+	cache       *rpcCache
+	hashStart   uint32
+	hashEnd     uint32
+	maintenance bool
+	role        string
+	zone        string
+	name        string
+	weight      int32
+	// Number of reads sent to this node.
+	reads int64
+}
+
+// A readBalancer chooses which of the two replicas of an artifact to read from first, when
+// they're equally preferred otherwise (i.e. by zone and role).
+type readBalancer interface {
+	// First returns true if a should be read from before b.
+	First(a, b *cacheNode) bool
+}
+
+// ownerFirst is the default readBalancer, which always reads from the artifact's first replica first.
+type ownerFirst struct{}
+
+func (o ownerFirst) First(a, b *cacheNode) bool {
+	return true
+}
+
+// weightedRoundRobin is a readBalancer that spreads reads between replicas in proportion to their
+// advertised weights, by reading first from whichever has received the fewest reads for its weight.
+type weightedRoundRobin struct{}
+
+func (w weightedRoundRobin) First(a, b *cacheNode) bool {
+	return atomic.LoadInt64(&a.reads)*int64(b.readWeight()) <= atomic.LoadInt64(&b.reads)*int64(a.readWeight())
+}
+
+// readWeight returns the weight of this node for balancing reads.
+func (n *cacheNode) readWeight() int32 {
+	if n.weight > 0 {
+		return n.weight
+	}
+	return 1
+}
+
+// available returns true if this node can currently be used.
+func (n *cacheNode) available() bool {
+	return !n.maintenance && n.cache.isConnected()
 }
 
 func (cache *rpcCache) Store(target *core.BuildTarget, key []byte, files ...string) {
@@ -133,10 +192,28 @@ func (cache *rpcCache) sendArtifacts(target *core.BuildTarget, key []byte, artif
 	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
 	defer cancel()
 	cache.runRPC(key, func(cache *rpcCache) (bool, []*pb.Artifact) {
-		_, err := cache.client.Store(ctx, &req)
-		if err != nil {
-			log.Warning("Error communicating with RPC cache server: %s", err)
+		var header metadata.MD
+		_, err := cache.client.Store(ctx, &req, grpc.Header(&header))
+		if reason, readOnly := readOnlyReason(err); readOnly {
+			// Not an error, it's just not accepting stores at the moment.
+			if atomic.CompareAndSwapInt32(&cache.readOnlyLogged, 0, 1) {
+				log.Notice("RPC cache is read-only (%s), not storing artifacts to it", reason)
+			}
+			log.Debug("Not storing %s, RPC cache is read-only: %s", target.Label, reason)
+			return false, nil
+		} else if reason, overloaded := overloadedReason(err); overloaded {
+			// Also not an error; it's shedding load and will accept stores again once it recovers.
+			log.Debug("Not storing %s, RPC cache is overloaded%s: %s", target.Label, servedBy(header), reason)
+			return false, nil
+		} else if reason, tooLarge := tooLargeReason(err); tooLarge {
+			// Nor is this; the connection's fine, the server just won't take these artifacts.
+			log.Warning("Not storing %s, it's too large for the RPC cache%s: %s", target.Label, servedBy(header), reason)
+			return false, nil
+		} else if err != nil {
+			log.Warning("Error communicating with RPC cache server%s: %s", servedBy(header), err)
 			cache.error()
+		} else {
+			log.Debug("Stored %s in RPC cache%s", target.Label, servedBy(header))
 		}
 		return err != nil, nil
 	})
@@ -146,7 +223,7 @@ func (cache *rpcCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 	if !cache.isConnected() {
 		return false
 	}
-	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH}
+	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH, StructuredErrors: true}
 	for out := range cacheArtifacts(target) {
 		artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: out}
 		req.Artifacts = append(req.Artifacts, &artifact)
@@ -166,22 +243,29 @@ func (cache *rpcCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 	}
 	artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: file}
 	artifacts := []*pb.Artifact{&artifact}
-	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH, Artifacts: artifacts}
+	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH, Artifacts: artifacts, StructuredErrors: true}
 	return cache.retrieveArtifacts(target, &req, false)
 }
 
 func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.RetrieveRequest, remove bool) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
 	defer cancel()
-	success, artifacts := cache.runRPC(req.Hash, func(cache *rpcCache) (bool, []*pb.Artifact) {
-		response, err := cache.client.Retrieve(ctx, req)
-		if err != nil {
-			log.Warning("Failed to retrieve artifacts for %s: %s", target.Label, err)
+	success, artifacts, replicas := cache.runReplicatedRPC(req.Hash, true, func(cache *rpcCache) (bool, []*pb.Artifact) {
+		var header metadata.MD
+		response, err := cache.client.Retrieve(ctx, req, grpc.Header(&header))
+		if grpc.Code(err) == codes.NotFound {
+			// A genuine miss. This counts as "success" (see below).
+			log.Debug("Artifacts for %s [key %s] not found in RPC cache%s", target.Label, base64.RawURLEncoding.EncodeToString(req.Hash), servedBy(header))
+			return true, nil
+		} else if err != nil {
+			log.Warning("Failed to retrieve artifacts for %s%s: %s", target.Label, servedBy(header), err)
 			cache.error()
 			return false, nil
 		} else if !response.Success {
-			// Quiet, this is almost certainly just a 'not found'
-			log.Debug("Couldn't retrieve artifacts for %s [key %s] from RPC cache", target.Label, base64.RawURLEncoding.EncodeToString(req.Hash))
+			// Older servers report both misses and failures like this; most likely it's a 'not found'
+			log.Debug("Couldn't retrieve artifacts for %s [key %s] from RPC cache%s", target.Label, base64.RawURLEncoding.EncodeToString(req.Hash), servedBy(header))
+		} else {
+			log.Debug("Retrieved artifacts for %s from RPC cache%s", target.Label, servedBy(header))
 		}
 		// This always counts as "success" in this context, i.e. do not bother retrying on the
 		// alternate if we were told that the artifact is not there.
@@ -189,7 +273,15 @@ func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.Retri
 	})
 	if !success {
 		return false
+	} else if replicas.degraded && len(artifacts) > 0 && !cache.degradedRead(target, replicas.attempted, replicas.failed) {
+		return false
 	}
+	return cache.writeArtifacts(target, artifacts, remove)
+}
+
+// writeArtifacts writes retrieved artifacts into the output directory of the given target,
+// and returns true if there were any and they were all written.
+func (cache *rpcCache) writeArtifacts(target *core.BuildTarget, artifacts []*pb.Artifact, remove bool) bool {
 	// Remove any existing outputs first; this is important for cases where the output is a
 	// directory, because we get back individual artifacts, and we need to make sure that
 	// only the retrieved artifacts are present in the output.
@@ -211,6 +303,173 @@ func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.Retri
 	return len(artifacts) > 0
 }
 
+// Exists returns true if the cache has all the outputs of the given target, without retrieving them.
+// If checkPeers is true, the server will also ask the other replica if it doesn't have them itself.
+func (cache *rpcCache) Exists(target *core.BuildTarget, key []byte, checkPeers bool) bool {
+	if !cache.isConnected() {
+		return false
+	}
+	req := pb.ExistsRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH, CheckPeers: checkPeers}
+	for out := range cacheArtifacts(target) {
+		req.Artifacts = append(req.Artifacts, &pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: out})
+	}
+	if len(req.Artifacts) == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	_, artifacts, _ := cache.runReplicatedRPC(key, true, func(cache *rpcCache) (bool, []*pb.Artifact) {
+		if !cache.supports(pb.CapabilitiesResponse_EXISTS) {
+			return true, nil // Same as below, but we don't need to ask.
+		}
+		response, err := cache.client.Exists(ctx, &req)
+		if grpc.Code(err) == codes.Unimplemented {
+			// Older servers don't support this; treat it like a miss.
+			log.Debug("RPC cache server doesn't support Exists")
+			return true, nil
+		} else if err != nil {
+			log.Warning("Failed to check for artifacts for %s: %s", target.Label, err)
+			cache.error()
+			return false, nil
+		} else if !response.Exists {
+			return true, nil
+		}
+		artifacts := make([]*pb.Artifact, len(response.Artifacts))
+		for i, info := range response.Artifacts {
+			artifacts[i] = &pb.Artifact{Package: info.Package, Target: info.Target, File: info.File}
+		}
+		return true, artifacts
+	})
+	return len(artifacts) > 0
+}
+
+// Prefetch asks the server to make sure it has the outputs of the given targets locally,
+// so they're ready by the time we come to retrieve them. It doesn't wait for them to be fetched.
+// The targets and keys correspond one-to-one.
+func (cache *rpcCache) Prefetch(targets []*core.BuildTarget, keys [][]byte) {
+	if !cache.isConnected() {
+		return
+	}
+	// Group the requests by the node that owns them.
+	requests := map[*rpcCache]*pb.PrefetchRequest{}
+	for i, target := range targets {
+		req := &pb.RetrieveRequest{Hash: keys[i], Os: runtime.GOOS, Arch: runtime.GOARCH, StructuredErrors: true}
+		for out := range cacheArtifacts(target) {
+			req.Artifacts = append(req.Artifacts, &pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: out})
+		}
+		c := cache
+		if len(cache.nodes) > 0 {
+			n := cache.nodeFor(tools.Hash(keys[i]))
+			if n == nil || n.maintenance || !n.cache.isConnected() {
+				continue
+			}
+			c = n.cache
+		}
+		if !c.supports(pb.CapabilitiesResponse_PREFETCH) {
+			continue
+		}
+		if requests[c] == nil {
+			requests[c] = &pb.PrefetchRequest{}
+		}
+		requests[c].Requests = append(requests[c].Requests, req)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	for c, req := range requests {
+		if resp, err := c.client.Prefetch(ctx, req); err != nil {
+			log.Debug("Failed to prefetch artifacts: %s", err)
+		} else {
+			log.Debug("Prefetching %d of %d artifacts", resp.Queued, len(req.Requests))
+		}
+	}
+}
+
+// RetrieveBatch retrieves the outputs of several targets, using one call per node for servers
+// that support it rather than one for each target. The targets and keys correspond one-to-one,
+// as do the returned values, which are true for each target whose outputs were retrieved.
+// Anything the batch couldn't get because of a failure (rather than a miss) is retrieved
+// individually instead, so it's retried on the alternate replica.
+func (cache *rpcCache) RetrieveBatch(targets []*core.BuildTarget, keys [][]byte) []bool {
+	retrieved := make([]bool, len(targets))
+	if !cache.isConnected() {
+		return retrieved
+	}
+	// Group the requests by the node that owns them, remembering which target each is for.
+	requests := map[*rpcCache]*pb.RetrieveBatchRequest{}
+	indices := map[*rpcCache][]int{}
+	retry := make([]bool, len(targets))
+	for i, target := range targets {
+		req := &pb.RetrieveRequest{Hash: keys[i], Os: runtime.GOOS, Arch: runtime.GOARCH, StructuredErrors: true}
+		for out := range cacheArtifacts(target) {
+			req.Artifacts = append(req.Artifacts, &pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: out})
+		}
+		if len(req.Artifacts) == 0 {
+			continue // As in Retrieve, we can't tell if this has been successful.
+		}
+		c := cache
+		if len(cache.nodes) > 0 {
+			n := cache.nodeFor(tools.Hash(keys[i]))
+			if n == nil || !n.available() {
+				retry[i] = true
+				continue
+			}
+			c = n.cache
+		}
+		if !c.supports(pb.CapabilitiesResponse_RETRIEVE_BATCH) {
+			retry[i] = true
+			continue
+		}
+		if requests[c] == nil {
+			requests[c] = &pb.RetrieveBatchRequest{}
+		}
+		requests[c].Requests = append(requests[c].Requests, req)
+		indices[c] = append(indices[c], i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	for c, req := range requests {
+		idx := indices[c]
+		for _, i := range idx {
+			retry[i] = true // Until we hear otherwise.
+		}
+		stream, err := c.client.RetrieveBatch(ctx, req)
+		if err != nil {
+			log.Warning("Failed to retrieve batch of artifacts: %s", err)
+			continue
+		}
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				if grpc.Code(err) == codes.Unimplemented {
+					log.Debug("RPC cache server doesn't support RetrieveBatch")
+				} else if err != io.EOF {
+					log.Warning("Failed to retrieve batch of artifacts: %s", err)
+				}
+				break
+			} else if resp.Index < 0 || int(resp.Index) >= len(idx) {
+				log.Warning("Unexpected index %d in batch of %d artifacts", resp.Index, len(idx))
+				continue
+			}
+			i := idx[resp.Index]
+			target := targets[i]
+			if resp.Success {
+				retry[i] = false
+				log.Debug("Retrieved artifacts for %s from RPC cache in batch", target.Label)
+				retrieved[i] = c.writeArtifacts(target, resp.Artifacts, true)
+			} else if resp.Error == nil || resp.Error.Reason == pb.RetrieveError_NOT_FOUND {
+				retry[i] = false
+				log.Debug("Artifacts for %s [key %s] not found in RPC cache", target.Label, base64.RawURLEncoding.EncodeToString(keys[i]))
+			}
+		}
+	}
+	for i, target := range targets {
+		if retry[i] {
+			retrieved[i] = cache.Retrieve(target, keys[i])
+		}
+	}
+	return retrieved
+}
+
 func (cache *rpcCache) writeFile(target *core.BuildTarget, file string, body []byte) bool {
 	out := path.Join(target.OutDir(), file)
 	if err := os.MkdirAll(path.Dir(out), core.DirPermissions); err != nil {
@@ -259,15 +518,26 @@ func (cache *rpcCache) CleanAll() {
 	}
 }
 
-func (cache *rpcCache) Shutdown() {}
+func (cache *rpcCache) Shutdown() {
+	if n := atomic.LoadInt32(&cache.degradedReads); n > 0 {
+		log.Warning("%d artifacts were retrieved from a degraded RPC cache cluster", n)
+	}
+	for _, n := range cache.nodes {
+		log.Debug("Sent %d reads to RPC cache node %s", atomic.LoadInt64(&n.reads), n.name)
+	}
+}
 
 func (cache *rpcCache) connect(url string, config *core.Configuration, isSubnode bool) {
 	// Change grpc to log using our implementation
 	grpclog.SetLoggerV2(&grpcLogMabob{})
 	log.Info("Connecting to RPC cache at %s", url)
+	callOpts := []grpc.CallOption{grpc.MaxCallRecvMsgSize(cache.maxMsgSize), grpc.MaxCallSendMsgSize(cache.maxMsgSize)}
+	if config.Cache.RPCCompress {
+		callOpts = append(callOpts, grpc.UseCompressor("gzip"))
+	}
 	opts := []grpc.DialOption{
 		grpc.WithTimeout(cache.timeout),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(cache.maxMsgSize), grpc.MaxCallSendMsgSize(cache.maxMsgSize)),
+		grpc.WithDefaultCallOptions(callOpts...),
 	}
 	if config.Cache.RPCPublicKey != "" || config.Cache.RPCCACert != "" || config.Cache.RPCSecure {
 		auth, err := loadAuth(config.Cache.RPCCACert, config.Cache.RPCPublicKey, config.Cache.RPCPrivateKey)
@@ -303,6 +573,7 @@ func (cache *rpcCache) connect(url string, config *core.Configuration, isSubnode
 	} else if isSubnode || resp == nil || len(resp.Nodes) == 0 {
 		// Server is not clustered, just use this one directly.
 		// Or we're one of the sub-nodes and we are meant to connect directly.
+		cache.capabilities = fetchCapabilities(ctx, client)
 		cache.client = client
 		cache.Connected = true
 		cache.Connecting = false
@@ -314,9 +585,14 @@ func (cache *rpcCache) connect(url string, config *core.Configuration, isSubnode
 	for i, n := range resp.Nodes {
 		subCache, _ := newRPCCacheInternal(n.Address, config, true)
 		cache.nodes[i] = cacheNode{
-			cache:     subCache,
-			hashStart: n.HashBegin,
-			hashEnd:   n.HashEnd,
+			cache:       subCache,
+			hashStart:   n.HashBegin,
+			hashEnd:     n.HashEnd,
+			maintenance: n.Maintenance,
+			role:        n.Role,
+			zone:        n.Zone,
+			name:        n.Name,
+			weight:      n.Weight,
 		}
 	}
 	// We are now connected, the children aren't necessarily yet but that won't matter.
@@ -325,6 +601,27 @@ func (cache *rpcCache) connect(url string, config *core.Configuration, isSubnode
 	log.Info("Top-level RPC cache connected after %0.2fs with %d known nodes", time.Since(cache.startTime).Seconds(), len(resp.Nodes))
 }
 
+// fetchCapabilities asks the server which optional features it supports.
+// It returns nil if the server doesn't tell us, in which case we just try to use them.
+func fetchCapabilities(ctx context.Context, client pb.RpcCacheClient) map[pb.CapabilitiesResponse_Feature]bool {
+	resp, err := client.GetCapabilities(ctx, &pb.CapabilitiesRequest{})
+	if err != nil {
+		log.Debug("Failed to get RPC cache server capabilities: %s", err)
+		return nil
+	}
+	capabilities := make(map[pb.CapabilitiesResponse_Feature]bool, len(resp.Features))
+	for _, feature := range resp.Features {
+		capabilities[feature] = true
+	}
+	log.Debug("RPC cache server is version %d, supports %s", resp.Version, resp.Features)
+	return capabilities
+}
+
+// supports returns true if the server supports the given feature, or if it couldn't tell us.
+func (cache *rpcCache) supports(feature pb.CapabilitiesResponse_Feature) bool {
+	return cache.capabilities == nil || cache.capabilities[feature]
+}
+
 // isConnected checks if the cache is connected. If it's still trying to connect it allows a
 // very brief wait to give it a chance to come online.
 func (cache *rpcCache) isConnected() bool {
@@ -344,29 +641,223 @@ func (cache *rpcCache) isConnected() bool {
 // runRPC runs one RPC for a cache, with optional fallback to a replica on RPC failure
 // (but not if the RPC completes unsuccessfully).
 func (cache *rpcCache) runRPC(hash []byte, f func(*rpcCache) (bool, []*pb.Artifact)) (bool, []*pb.Artifact) {
+	success, artifacts, _ := cache.runReplicatedRPC(hash, false, f)
+	return success, artifacts
+}
+
+// A replicatedRead describes which replicas a replicated RPC was sent to.
+type replicatedRead struct {
+	// The number of replicas it was sent to (or would have been, if they were available),
+	// and the number of those that failed.
+	attempted, failed int
+	// True if the result came from fewer replicas than expected, i.e. the initial one
+	// failed and we fell back to the alternate.
+	degraded bool
+}
+
+// runReplicatedRPC is like runRPC but also describes which replicas the result came from.
+// If read is true, a replica in our zone or a read-optimised one is tried first, and the other
+// replica is tried if it doesn't return any artifacts. If neither is in our zone, our zone's own
+// replica (see tools.ZoneReplica) is tried before either of them. Otherwise the balancer chooses
+// which to try first.
+func (cache *rpcCache) runReplicatedRPC(hash []byte, read bool, f func(*rpcCache) (bool, []*pb.Artifact)) (bool, []*pb.Artifact, replicatedRead) {
+	var r replicatedRead
 	if len(cache.nodes) == 0 {
 		// No clustering, just call it directly.
-		return f(cache)
+		success, artifacts := f(cache)
+		return success, artifacts, r
+	}
+	call := func(n *cacheNode) (bool, []*pb.Artifact) {
+		r.attempted++
+		if read {
+			atomic.AddInt64(&n.reads, 1)
+		}
+		success, artifacts := f(n.cache)
+		if !success {
+			r.failed++
+		}
+		return success, artifacts
 	}
 	try := func(hash uint32) (bool, []*pb.Artifact) {
-		for _, n := range cache.nodes {
-			if hash >= n.hashStart && hash < n.hashEnd {
-				if !n.cache.isConnected() {
-					return false, nil
-				}
-				return f(n.cache)
-			}
+		n := cache.nodeFor(hash)
+		if n == nil {
+			log.Warning("No RPC cache client available for %d", hash)
+			r.attempted++
+			r.failed++
+			return false, nil
+		} else if !n.available() {
+			r.attempted++
+			r.failed++
+			return false, nil
 		}
-		log.Warning("No RPC cache client available for %d", hash)
-		return false, nil
+		return call(n)
 	}
 	h := tools.Hash(hash)
+	alternate := tools.AlternateHash(hash)
+	if read && !cache.inZone(h) && !cache.inZone(alternate) {
+		if n := cache.zoneReplica(hash); n != nil && !n.maintenance && n.cache.isConnected() {
+			if success, artifacts := call(n); success && len(artifacts) > 0 {
+				return success, artifacts, r
+			}
+			log.Debug("Replica in our zone doesn't have %d, will try the others", h)
+		}
+	}
+	preferred := read && (cache.prefer(alternate, h) || (!cache.prefer(h, alternate) && cache.balance(alternate, h)))
+	if preferred {
+		h, alternate = alternate, h
+	}
 	success, artifacts := try(h)
-	if success {
-		return success, artifacts
+	if success && (len(artifacts) > 0 || !preferred) {
+		return success, artifacts, r
+	} else if success {
+		log.Debug("Preferred replica doesn't have %d, will retry on the alternate", h)
+		success, artifacts = try(alternate)
+		return success, artifacts, r
 	}
 	log.Info("Initial replica failed for %d, will retry on the alternate", h)
-	return try(tools.AlternateHash(hash))
+	success, artifacts = try(alternate)
+	r.degraded = true
+	return success, artifacts, r
+}
+
+// balance returns true if the balancer chooses the node owning point a in the hash space to be
+// read from before the one owning point b. Nodes that are unavailable are never chosen.
+func (cache *rpcCache) balance(a, b uint32) bool {
+	if cache.balancer == nil {
+		return false
+	}
+	na, nb := cache.nodeFor(a), cache.nodeFor(b)
+	return na != nil && nb != nil && na != nb && na.available() && nb.available() && !cache.balancer.First(nb, na)
+}
+
+// nodeFor returns the node that owns the given point in the hash space, or nil if there isn't one.
+func (cache *rpcCache) nodeFor(hash uint32) *cacheNode {
+	for i, n := range cache.nodes {
+		if hash >= n.hashStart && hash < n.hashEnd {
+			return &cache.nodes[i]
+		}
+	}
+	return nil
+}
+
+// prefer returns true if the node owning point a in the hash space should be read from in
+// preference to the one owning point b. Nodes in our zone come first, then read-optimised ones.
+func (cache *rpcCache) prefer(a, b uint32) bool {
+	if inA, inB := cache.inZone(a), cache.inZone(b); inA != inB {
+		return inA
+	}
+	return cache.isReadOptimised(a) && !cache.isReadOptimised(b)
+}
+
+// inZone returns true if the node owning the given point in the hash space is in our zone.
+func (cache *rpcCache) inZone(hash uint32) bool {
+	n := cache.nodeFor(hash)
+	return n != nil && cache.zone != "" && n.zone == cache.zone
+}
+
+// zoneReplica returns the node in our zone that holds its replica of the given hash, or nil if
+// we aren't in a zone or there are no nodes in it.
+func (cache *rpcCache) zoneReplica(hash []byte) *cacheNode {
+	if cache.zone == "" {
+		return nil
+	}
+	nodes := []*cacheNode{}
+	for i, n := range cache.nodes {
+		if n.zone == cache.zone {
+			nodes = append(nodes, &cache.nodes[i])
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[tools.ZoneReplica(hash, len(nodes))]
+}
+
+// isReadOptimised returns true if the node owning the given point in the hash space is read-optimised.
+func (cache *rpcCache) isReadOptimised(hash uint32) bool {
+	n := cache.nodeFor(hash)
+	return n != nil && n.role == tools.ReadOptimisedRole
+}
+
+// degradedRead records that artifacts for a target were found on only some of their replicas,
+// having been sent to the given number of them of which the given number failed.
+// It returns true if they should be used anyway, or false if we have been configured to refuse them.
+func (cache *rpcCache) degradedRead(target *core.BuildTarget, attempted, failed int) bool {
+	atomic.AddInt32(&cache.degradedReads, 1)
+	if cache.strictReads {
+		log.Warning("Refusing artifacts for %s; only %d of %d replicas were available", target.Label, attempted-failed, attempted)
+		return false
+	}
+	log.Warning("Retrieved %s from %d of %d replicas, RPC cache cluster is degraded", target.Label, attempted-failed, attempted)
+	return true
+}
+
+// Keys of the response headers the server identifies itself with (see ServerOptions in the server).
+var identityHeaders = []struct{ key, name string }{
+	{"plz-cache-node", "node"},
+	{"plz-cache-version", "version"},
+	{"plz-cache-zone", "zone"},
+}
+
+// servedBy describes the server that sent the given response headers, for logging, or returns
+// the empty string if it didn't identify itself (e.g. because it's an older version).
+func servedBy(header metadata.MD) string {
+	parts := []string{}
+	for _, h := range identityHeaders {
+		if v := header[h.key]; len(v) > 0 {
+			parts = append(parts, h.name+" "+v[0])
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " [served by " + strings.Join(parts, ", ") + "]"
+}
+
+// readOnlyReason returns the reason the server gave if the given error from a Store RPC
+// indicates that it's read-only, and true. It returns false for any other error.
+func readOnlyReason(err error) (string, bool) {
+	if grpc.Code(err) != codes.FailedPrecondition {
+		return "", false
+	}
+	s, _ := status.FromError(err)
+	for _, detail := range s.Details() {
+		if e, ok := detail.(*pb.StoreError); ok && e.Reason == pb.StoreError_READ_ONLY {
+			return e.Detail, true
+		}
+	}
+	return "", false
+}
+
+// overloadedReason returns the reason the server gave if the given error from a Store RPC
+// indicates that it's shedding load, and true. It returns false for any other error.
+func overloadedReason(err error) (string, bool) {
+	if grpc.Code(err) != codes.ResourceExhausted {
+		return "", false
+	}
+	s, _ := status.FromError(err)
+	for _, detail := range s.Details() {
+		if e, ok := detail.(*pb.StoreError); ok && e.Reason == pb.StoreError_OVERLOADED {
+			return e.Detail, true
+		}
+	}
+	return "", false
+}
+
+// tooLargeReason returns the reason the server gave if the given error from a Store RPC
+// indicates that one of the artifacts is larger than it accepts, and true. It returns false for
+// any other error.
+func tooLargeReason(err error) (string, bool) {
+	if grpc.Code(err) != codes.InvalidArgument {
+		return "", false
+	}
+	s, _ := status.FromError(err)
+	for _, detail := range s.Details() {
+		if e, ok := detail.(*pb.StoreError); ok && e.Reason == pb.StoreError_TOO_LARGE {
+			return e.Detail, true
+		}
+	}
+	return "", false
 }
 
 // error increments the error counter on the cache, and disables it if it gets too high.
@@ -386,11 +877,17 @@ func newRPCCache(config *core.Configuration) (*rpcCache, error) {
 
 func newRPCCacheInternal(url string, config *core.Configuration, isSubnode bool) (*rpcCache, error) {
 	cache := &rpcCache{
-		Writeable:  config.Cache.RPCWriteable,
-		Connecting: true,
-		timeout:    time.Duration(config.Cache.RPCTimeout),
-		startTime:  time.Now(),
-		maxMsgSize: int(config.Cache.RPCMaxMsgSize),
+		Writeable:   config.Cache.RPCWriteable,
+		Connecting:  true,
+		timeout:     time.Duration(config.Cache.RPCTimeout),
+		startTime:   time.Now(),
+		maxMsgSize:  int(config.Cache.RPCMaxMsgSize),
+		strictReads: config.Cache.RPCStrictReads,
+		zone:        config.Cache.RPCZone,
+		balancer:    ownerFirst{},
+	}
+	if config.Cache.RPCBalanceReads {
+		cache.balancer = weightedRoundRobin{}
 	}
 	go cache.connect(url, config, isSubnode)
 	return cache, nil
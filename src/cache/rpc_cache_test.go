@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"math"
 	"os"
 	"path"
 	"runtime"
@@ -10,7 +11,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
+	pb "cache/proto/rpc_cache"
 	"core"
 	"tools/cache/server"
 )
@@ -36,8 +39,11 @@ func init() {
 
 func startServer(keyFile, certFile, caCertFile string) (*grpc.Server, string) {
 	// Arbitrary large numbers so the cleaner never needs to run.
-	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000)
-	s, lis := server.BuildGrpcServer(0, cache, nil, keyFile, certFile, caCertFile, "", "")
+	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000, server.ServerOptions{})
+	key, _ := server.ReadTLSMaterial(keyFile, "")
+	cert, _ := server.ReadTLSMaterial(certFile, "")
+	caCert, _ := server.ReadTLSMaterial(caCertFile, "")
+	s, lis := server.BuildGrpcServer(0, cache, nil, nil, key, cert, caCert, "", "", server.ServerOptions{})
 	go s.Serve(lis)
 	return s, lis.Addr().String()
 }
@@ -96,6 +102,39 @@ func TestStoreAndRetrieve(t *testing.T) {
 	}
 }
 
+func TestExists(t *testing.T) {
+	target := core.NewBuildTarget(label)
+	target.AddOutput("testfile")
+	assert.True(t, rpccache.Exists(target, []byte("test_key"), false))
+	assert.False(t, rpccache.Exists(target, []byte("other_key"), true))
+}
+
+func TestRetrieveBatch(t *testing.T) {
+	hit := core.NewBuildTarget(label)
+	hit.AddOutput("testfile")
+	miss := core.NewBuildTarget(label)
+	miss.AddOutput("testfile")
+	empty := core.NewBuildTarget(label)
+	assert.True(t, rpccache.supports(pb.CapabilitiesResponse_RETRIEVE_BATCH))
+	retrieved := rpccache.RetrieveBatch([]*core.BuildTarget{hit, miss, empty}, [][]byte{[]byte("test_key"), []byte("other_key"), []byte("test_key")})
+	assert.Equal(t, []bool{true, false, false}, retrieved)
+	assert.True(t, core.PathExists(path.Join(hit.OutDir(), "testfile")))
+}
+
+func TestCapabilities(t *testing.T) {
+	assert.NotNil(t, rpccache.capabilities)
+	assert.True(t, rpccache.supports(pb.CapabilitiesResponse_EXISTS))
+	assert.False(t, rpccache.supports(pb.CapabilitiesResponse_COMPRESSION), "The server hasn't enabled it")
+	// If the server can't tell us, we assume it supports everything and find out when we use it.
+	c := &rpcCache{}
+	assert.True(t, c.supports(pb.CapabilitiesResponse_COMPRESSION))
+}
+
+func TestServedBy(t *testing.T) {
+	assert.Equal(t, "", servedBy(nil), "Older servers don't identify themselves")
+	assert.Equal(t, " [served by node plz-cache-1, version 5.5.0]", servedBy(metadata.Pairs("plz-cache-node", "plz-cache-1", "plz-cache-version", "5.5.0")))
+}
+
 func TestClean(t *testing.T) {
 	target := core.NewBuildTarget(label)
 	rpccache.Clean(target)
@@ -124,6 +163,68 @@ func TestDisconnectAfterEnoughErrors(t *testing.T) {
 	assert.False(t, c.Connected)
 }
 
+func TestStoreReadOnly(t *testing.T) {
+	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000, server.ServerOptions{})
+	cache.SetReadOnly("configured read-only")
+	s, lis := server.BuildGrpcServer(0, cache, nil, nil, nil, nil, nil, "", "", server.ServerOptions{})
+	go s.Serve(lis)
+	defer s.Stop()
+	c := buildClient(lis.Addr().String(), "")
+
+	target := core.NewBuildTarget(label)
+	target.AddOutput("testfile2")
+	// Unlike other failures, these don't count as errors so we stay connected.
+	for i := 0; i < maxErrors; i++ {
+		c.Store(target, []byte("read_only_key"))
+	}
+	assert.True(t, c.Connected)
+	assert.EqualValues(t, 0, c.numErrors)
+	assert.False(t, core.PathExists(path.Join("src/cache/test_data", core.OsArch, "pkg/name/label_name/cmVhZF9vbmx5X2tleQ")))
+}
+
+func TestStoreOverloaded(t *testing.T) {
+	// Anything is slower than this, so it starts shedding after the first window.
+	opts := server.ServerOptions{ShedLatency: time.Nanosecond, ShedWindow: 500 * time.Millisecond}
+	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000, opts)
+	s, lis := server.BuildGrpcServer(0, cache, nil, nil, nil, nil, nil, "", "", opts)
+	go s.Serve(lis)
+	defer s.Stop()
+	c := buildClient(lis.Addr().String(), "")
+
+	target := core.NewBuildTarget(label)
+	target.AddOutput("testfile2")
+	for i := 0; i < 10; i++ {
+		c.Store(target, []byte("before_overload_key"))
+	}
+	time.Sleep(600 * time.Millisecond)
+	// Like read-only, these don't count as errors so we stay connected.
+	for i := 0; i < maxErrors; i++ {
+		c.Store(target, []byte("overloaded_key"))
+	}
+	assert.True(t, c.Connected)
+	assert.EqualValues(t, 0, c.numErrors)
+	assert.False(t, core.PathExists(path.Join("src/cache/test_data", core.OsArch, "pkg/name/label_name/b3ZlcmxvYWRlZF9rZXk")))
+}
+
+func TestStoreTooLarge(t *testing.T) {
+	opts := server.ServerOptions{MaxArtifactSize: 1}
+	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000, opts)
+	s, lis := server.BuildGrpcServer(0, cache, nil, nil, nil, nil, nil, "", "", opts)
+	go s.Serve(lis)
+	defer s.Stop()
+	c := buildClient(lis.Addr().String(), "")
+
+	target := core.NewBuildTarget(label)
+	target.AddOutput("testfile2")
+	// These don't count as errors either; the server's fine, it just won't take them.
+	for i := 0; i < maxErrors; i++ {
+		c.Store(target, []byte("too_large_key"))
+	}
+	assert.True(t, c.Connected)
+	assert.EqualValues(t, 0, c.numErrors)
+	assert.False(t, core.PathExists(path.Join("src/cache/test_data", core.OsArch, "pkg/name/label_name/dG9vX2xhcmdlX2tleQ")))
+}
+
 func TestLoadCertificates(t *testing.T) {
 	_, err := loadAuth("", "src/cache/test_data/cert.pem", "src/cache/test_data/key.pem")
 	assert.NoError(t, err, "Trivial case with PEM files already")
@@ -140,3 +241,158 @@ func TestRetrieveSSL(t *testing.T) {
 	c = buildClient(addr, "src/cache/test_data/ca.pem")
 	assert.True(t, c.Connected, "Connects OK this time")
 }
+
+func TestDegradedRead(t *testing.T) {
+	target := core.NewBuildTarget(label)
+	c := &rpcCache{}
+	assert.True(t, c.degradedRead(target, 2, 1), "Degraded reads are allowed by default")
+	c.strictReads = true
+	assert.False(t, c.degradedRead(target, 2, 1), "Degraded reads are refused in strict mode")
+	assert.EqualValues(t, 2, c.degradedReads)
+}
+
+func TestReplicatedReadCounts(t *testing.T) {
+	primary := &rpcCache{Connected: true}
+	alternate := &rpcCache{Connected: true}
+	local := &rpcCache{Connected: true}
+	c := &rpcCache{nodes: []cacheNode{
+		{cache: primary, hashStart: 0, hashEnd: 1 << 31},
+		{cache: alternate, hashStart: 1 << 31, hashEnd: math.MaxUint32},
+	}}
+	failing := map[*rpcCache]bool{primary: true}
+	f := func(cache *rpcCache) (bool, []*pb.Artifact) {
+		if failing[cache] {
+			return false, nil
+		}
+		return true, []*pb.Artifact{{File: "file"}}
+	}
+	success, _, replicas := c.runReplicatedRPC(zeroKey, true, f)
+	assert.True(t, success)
+	assert.Equal(t, replicatedRead{attempted: 2, failed: 1, degraded: true}, replicas)
+
+	// Our zone's replica counts too if it's tried.
+	c.zone = "onprem"
+	c.nodes = []cacheNode{
+		{cache: primary, hashStart: 0, hashEnd: 1 << 30, zone: "cloud"},
+		{cache: local, hashStart: 1 << 30, hashEnd: 1 << 31, zone: "onprem"},
+		{cache: alternate, hashStart: 1 << 31, hashEnd: math.MaxUint32, zone: "cloud"},
+	}
+	failing[local] = true
+	success, _, replicas = c.runReplicatedRPC(zeroKey, true, f)
+	assert.True(t, success)
+	assert.Equal(t, replicatedRead{attempted: 3, failed: 2, degraded: true}, replicas)
+}
+
+func TestReadPrefersReadOptimisedReplica(t *testing.T) {
+	primary := &rpcCache{Connected: true}
+	standby := &rpcCache{Connected: true}
+	c := &rpcCache{nodes: []cacheNode{
+		{cache: primary, hashStart: 0, hashEnd: 1 << 31},
+		{cache: standby, hashStart: 1 << 31, hashEnd: math.MaxUint32, role: "read"},
+	}}
+	artifacts := map[*rpcCache][]*pb.Artifact{}
+	calls := []*rpcCache{}
+	f := func(cache *rpcCache) (bool, []*pb.Artifact) {
+		calls = append(calls, cache)
+		return true, artifacts[cache]
+	}
+	// Reads go to the standby first, and fall back to the primary if it doesn't have them.
+	success, _, replicas := c.runReplicatedRPC(zeroKey, true, f)
+	assert.True(t, success)
+	assert.False(t, replicas.degraded)
+	assert.Equal(t, []*rpcCache{standby, primary}, calls)
+
+	calls = nil
+	artifacts[standby] = []*pb.Artifact{{File: "file"}}
+	success, a, _ := c.runReplicatedRPC(zeroKey, true, f)
+	assert.True(t, success)
+	assert.Equal(t, 1, len(a))
+	assert.Equal(t, []*rpcCache{standby}, calls)
+
+	// Writes still go to the primary.
+	calls = nil
+	c.runRPC(zeroKey, f)
+	assert.Equal(t, []*rpcCache{primary}, calls)
+}
+
+func TestReadPrefersSameZone(t *testing.T) {
+	primary := &rpcCache{Connected: true}
+	alternate := &rpcCache{Connected: true}
+	local := &rpcCache{Connected: true}
+	c := &rpcCache{zone: "onprem", nodes: []cacheNode{
+		{cache: primary, hashStart: 0, hashEnd: 1 << 30, zone: "cloud"},
+		{cache: local, hashStart: 1 << 30, hashEnd: 1 << 31, zone: "onprem"},
+		{cache: alternate, hashStart: 1 << 31, hashEnd: math.MaxUint32, zone: "cloud", role: "read"},
+	}}
+	artifacts := map[*rpcCache][]*pb.Artifact{}
+	calls := []*rpcCache{}
+	f := func(cache *rpcCache) (bool, []*pb.Artifact) {
+		calls = append(calls, cache)
+		return true, artifacts[cache]
+	}
+	// Neither replica is in our zone, so its own replica is tried first.
+	artifacts[local] = []*pb.Artifact{{File: "file"}}
+	success, a, replicas := c.runReplicatedRPC(zeroKey, true, f)
+	assert.True(t, success)
+	assert.False(t, replicas.degraded)
+	assert.Equal(t, 1, len(a))
+	assert.Equal(t, []*rpcCache{local}, calls)
+	assert.EqualValues(t, 1, c.nodes[1].reads, "Reads from our zone's replica are counted")
+
+	// If it doesn't have them we cross zones as before.
+	calls = nil
+	delete(artifacts, local)
+	c.runReplicatedRPC(zeroKey, true, f)
+	assert.Equal(t, []*rpcCache{local, alternate, primary}, calls)
+	assert.EqualValues(t, 2, c.nodes[1].reads)
+
+	// A replica in our zone is preferred over a read-optimised one.
+	calls = nil
+	c.nodes[0].zone = "onprem"
+	c.runReplicatedRPC(zeroKey, true, f)
+	assert.Equal(t, []*rpcCache{primary}, calls)
+
+	// Writes are unaffected.
+	calls = nil
+	c.nodes[0].zone = "cloud"
+	c.runRPC(zeroKey, f)
+	assert.Equal(t, []*rpcCache{primary}, calls)
+}
+
+func TestReadsBalancedByWeight(t *testing.T) {
+	primary := &rpcCache{Connected: true}
+	alternate := &rpcCache{Connected: true}
+	c := &rpcCache{balancer: weightedRoundRobin{}, nodes: []cacheNode{
+		{cache: primary, hashStart: 0, hashEnd: 1 << 31, weight: 1},
+		{cache: alternate, hashStart: 1 << 31, hashEnd: math.MaxUint32, weight: 3},
+	}}
+	counts := map[*rpcCache]int{}
+	f := func(cache *rpcCache) (bool, []*pb.Artifact) {
+		counts[cache]++
+		return true, []*pb.Artifact{{File: "file"}}
+	}
+	for i := 0; i < 8; i++ {
+		_, _, replicas := c.runReplicatedRPC(zeroKey, true, f)
+		assert.False(t, replicas.degraded)
+	}
+	assert.Equal(t, 2, counts[primary])
+	assert.Equal(t, 6, counts[alternate])
+	assert.EqualValues(t, 2, c.nodes[0].reads)
+	assert.EqualValues(t, 6, c.nodes[1].reads)
+
+	// Unavailable replicas aren't chosen.
+	counts = map[*rpcCache]int{}
+	c.nodes[1].maintenance = true
+	for i := 0; i < 4; i++ {
+		_, _, replicas := c.runReplicatedRPC(zeroKey, true, f)
+		assert.False(t, replicas.degraded)
+	}
+	assert.Equal(t, 4, counts[primary])
+	assert.Equal(t, 0, counts[alternate])
+
+	// Writes are unaffected.
+	counts = map[*rpcCache]int{}
+	c.nodes[1].maintenance = false
+	c.runRPC(zeroKey, f)
+	assert.Equal(t, 1, counts[primary])
+}
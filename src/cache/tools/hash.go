@@ -3,6 +3,7 @@ package tools
 import (
 	"encoding/binary"
 	"math"
+	"math/bits"
 )
 
 // HashPoint returns a point in our hash space for the ith of n nodes.
@@ -27,3 +28,20 @@ func AlternateHash(h []byte) uint32 {
 	}
 	return point + halfway
 }
+
+// ReplicaHash returns the point in our hash space for the ith replica of a given artifact hash.
+// The points are spread as evenly as possible around the hash space whatever the number of
+// replicas: the first is Hash, the second AlternateHash, then the quarter points in between
+// and so on.
+func ReplicaHash(h []byte, i int) uint32 {
+	return Hash(h) + bits.Reverse32(uint32(i))
+}
+
+// ZoneReplica returns which of the n nodes in a zone holds that zone's replica of the artifacts
+// with the given hash. These are stored in addition to the two usual replicas for any zone that
+// neither of them is in, so each zone has its own copy.
+// The nodes are numbered in the order the cluster lists them; as with HashPoint, both client
+// and server must agree about this.
+func ZoneReplica(h []byte, n int) int {
+	return int(Hash(h) % uint32(n))
+}
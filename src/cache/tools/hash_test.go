@@ -30,3 +30,20 @@ func TestAlternateHash(t *testing.T) {
 	assert.EqualValues(t, 1+1<<31, AlternateHash([]byte{1, 0, 0, 0}))
 	assert.EqualValues(t, 1<<31-1, AlternateHash([]byte{255, 255, 255, 255}))
 }
+
+func TestReplicaHash(t *testing.T) {
+	for _, h := range [][]byte{{0, 0, 0, 0}, {1, 0, 0, 0}, {0, 0, 0, 128}, {255, 255, 255, 255}} {
+		assert.Equal(t, Hash(h), ReplicaHash(h, 0))
+		assert.Equal(t, AlternateHash(h), ReplicaHash(h, 1))
+	}
+	assert.EqualValues(t, 1<<30, ReplicaHash([]byte{0, 0, 0, 0}, 2))
+	assert.EqualValues(t, 3<<30, ReplicaHash([]byte{0, 0, 0, 0}, 3))
+	assert.EqualValues(t, 1<<29, ReplicaHash([]byte{0, 0, 0, 0}, 4))
+}
+
+func TestZoneReplica(t *testing.T) {
+	assert.Equal(t, 0, ZoneReplica([]byte{0, 0, 0, 0}, 3))
+	assert.Equal(t, 1, ZoneReplica([]byte{1, 0, 0, 0}, 3))
+	assert.Equal(t, 0, ZoneReplica([]byte{3, 0, 0, 0}, 3))
+	assert.Equal(t, 0, ZoneReplica([]byte{255, 255, 255, 255}, 1))
+}
@@ -0,0 +1,6 @@
+package tools
+
+// ReadOptimisedRole is the role advertised by cluster nodes that are optimised for reads
+// (for example a warm standby on fast local disk). Clients prefer them when choosing which
+// replica of an artifact to read from.
+const ReadOptimisedRole = "read"
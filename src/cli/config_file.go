@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+// configFileFlag is the flag that ConfigFileFlag adds to an app's options.
+const configFileFlag = "config_file"
+
+// ConfigFileFlag can be embedded in an app's options to opt in to reading them from a config
+// file as well as the command line, through ParseFlags (and so ParseFlagsOrDie and
+// ParseFlagsFromArgsOrDie). It adds a --config_file flag naming a YAML (or JSON) file to read
+// options from. Each key in it is the long name of an option (whatever group it's in) and its
+// value is as it would be given on the command line; options that can be given more than once
+// can have a list of values.
+// Values from the file replace the options' defaults, so the order of precedence is
+// defaults < config file < environment variables < command line.
+// It's an error for the file to contain any keys that aren't options.
+// Apps that don't embed it don't get the flag, so it can't clash with their own options.
+type ConfigFileFlag struct {
+	ConfigFile string `long:"config_file" description:"YAML or JSON file to read options from, keyed by their long names without the leading dashes, e.g. port: 7677. Lists can be given for options that can be repeated. Options given on the command line or through their environment variable override those in the file."`
+}
+
+// configFile implements configFileOptions.
+func (f *ConfigFileFlag) configFile() {}
+
+// configFileOptions is implemented by options that embed ConfigFileFlag.
+type configFileOptions interface {
+	configFile()
+}
+
+// findConfigFile returns the value of the --config_file flag in the given arguments, if there is one.
+// We need it before parsing them properly so the file's values can be applied first.
+func findConfigFile(args []string) string {
+	filename := ""
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		} else if arg == "--"+configFileFlag && i+1 < len(args) {
+			filename = args[i+1]
+		} else if strings.HasPrefix(arg, "--"+configFileFlag+"=") {
+			filename = strings.TrimPrefix(arg, "--"+configFileFlag+"=")
+		}
+	}
+	return filename
+}
+
+// loadConfigFile reads the given config file and sets the defaults of the options in it.
+func loadConfigFile(parser *flags.Parser, filename string) error {
+	if ext := path.Ext(filename); ext != ".yaml" && ext != ".yml" && ext != ".json" {
+		return &flags.Error{Type: flags.ErrUnknown, Message: fmt.Sprintf("Unsupported config file %s, must be YAML (.yaml or .yml) or JSON (.json)", filename)}
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return &flags.Error{Type: flags.ErrUnknown, Message: fmt.Sprintf("Failed to read config file: %s", err)}
+	}
+	values := map[string]interface{}{}
+	if err := yaml.UnmarshalStrict(b, &values); err != nil {
+		return &flags.Error{Type: flags.ErrUnknown, Message: fmt.Sprintf("Failed to parse config file %s: %s", filename, err)}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // So any errors are reported consistently.
+	for _, key := range keys {
+		option := parser.FindOptionByLongName(key)
+		if option == nil || key == configFileFlag {
+			return &flags.Error{Type: flags.ErrUnknownFlag, Message: fmt.Sprintf("Unknown option %s in config file %s", key, filename)}
+		}
+		defaults, err := configValues(values[key])
+		if err == nil {
+			err = checkConfigValues(option, defaults)
+		}
+		if err != nil {
+			return &flags.Error{Type: flags.ErrMarshal, Message: fmt.Sprintf("Invalid value for %s in config file %s: %s", key, filename, err)}
+		}
+		option.Default = defaults
+	}
+	return nil
+}
+
+// configValues converts a value from a config file to the strings it would be given as on the command line.
+func configValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, fmt.Errorf("missing value")
+	case []interface{}:
+		ret := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, s)
+		}
+		return ret, nil
+	case map[interface{}]interface{}:
+		ret := make([]string, 0, len(v))
+		for k, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, fmt.Sprintf("%v:%s", k, s))
+		}
+		sort.Strings(ret)
+		return ret, nil
+	}
+	s, err := configValue(value)
+	return []string{s}, err
+}
+
+// configValue converts a single scalar value from a config file to a string.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		// Not %v, which gives large numbers in exponent form.
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("%v isn't a single value", value)
+}
+
+// checkConfigValues checks that the given values from a config file are valid for an option.
+// go-flags silently ignores defaults it can't convert, so we check them ourselves first by
+// parsing them into a struct with just that option.
+func checkConfigValues(option *flags.Option, values []string) error {
+	field := option.Field()
+	if len(values) > 1 && field.Type.Kind() != reflect.Slice && field.Type.Kind() != reflect.Map {
+		return fmt.Errorf("it can only be given once")
+	}
+	tag := fmt.Sprintf(`long:"%s"`, option.LongName)
+	for _, choice := range option.Choices {
+		tag += fmt.Sprintf(` choice:"%s"`, choice)
+	}
+	v := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "Value", Type: field.Type, Tag: reflect.StructTag(tag)}}))
+	args := make([]string, 0, len(values))
+	for _, value := range values {
+		if field.Type.Kind() == reflect.Bool {
+			// These don't take an argument on the command line.
+			if b, err := strconv.ParseBool(value); err != nil {
+				return err
+			} else if b {
+				args = append(args, "--"+option.LongName)
+			}
+		} else {
+			args = append(args, "--"+option.LongName+"="+value)
+		}
+	}
+	_, err := flags.NewParser(v.Interface(), flags.None).ParseArgs(args)
+	return err
+}
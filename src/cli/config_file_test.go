@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type configFileTestOpts struct {
+	ConfigFileFlag
+	Port    int      `short:"p" long:"port" default:"7677"`
+	Dir     string   `long:"dir" env:"CONFIG_FILE_TEST_DIR" default:"plz-cache"`
+	Verbose bool     `long:"verbose"`
+	Size    ByteSize `long:"size" default:"1G"`
+	Keys    []string `long:"key"`
+	Mode    string   `long:"mode" choice:"fast" choice:"slow" default:"slow"`
+	Group   struct {
+		Frequency Duration `long:"frequency" default:"10m"`
+	} `group:"Group options"`
+}
+
+// writeConfigFile writes a config file with the given contents and returns its name.
+func writeConfigFile(t *testing.T, name, contents string) string {
+	require.NoError(t, ioutil.WriteFile(name, []byte(contents), 0644))
+	return name
+}
+
+func TestConfigFile(t *testing.T) {
+	filename := writeConfigFile(t, "test_config_file.yaml", `
+port: 8080
+dir: /tmp/cache
+verbose: true
+size: 20G
+key: [a, b]
+mode: fast
+frequency: 1h
+`)
+	defer os.Remove(filename)
+	opts := configFileTestOpts{}
+	_, extraArgs, err := ParseFlags("test", &opts, []string{"test", "--config_file", filename})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(extraArgs))
+	assert.Equal(t, 8080, opts.Port)
+	assert.Equal(t, "/tmp/cache", opts.Dir)
+	assert.True(t, opts.Verbose)
+	assert.EqualValues(t, 20000000000, opts.Size)
+	assert.Equal(t, []string{"a", "b"}, opts.Keys)
+	assert.Equal(t, "fast", opts.Mode)
+	assert.EqualValues(t, 3600000000000, opts.Group.Frequency)
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	filename := writeConfigFile(t, "test_config_file_precedence.yml", "port: 8080\ndir: /tmp/cache\nkey: [a, b]\n")
+	defer os.Remove(filename)
+	os.Setenv("CONFIG_FILE_TEST_DIR", "/tmp/env")
+	defer os.Unsetenv("CONFIG_FILE_TEST_DIR")
+	opts := configFileTestOpts{}
+	_, _, err := ParseFlags("test", &opts, []string{"test", "-p", "9090", "--key", "c", "--config_file=" + filename})
+	require.NoError(t, err)
+	assert.Equal(t, 9090, opts.Port, "The command line overrides the file")
+	assert.Equal(t, "/tmp/env", opts.Dir, "The environment overrides the file")
+	assert.Equal(t, []string{"c"}, opts.Keys, "The command line replaces lists rather than adding to them")
+	assert.Equal(t, "slow", opts.Mode, "Anything not in the file keeps its default")
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for name, contents := range map[string]string{
+		"unknown key":    "port: 8080\nwibble: 1\n",
+		"invalid value":  "port: eight\n",
+		"invalid choice": "mode: medium\n",
+		"repeated":       "port: [1, 2]\n",
+		"nested":         "port:\n  value: 1\n",
+		"duplicate":      "port: 1\nport: 2\n",
+		"recursive":      "config_file: other.yaml\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			filename := writeConfigFile(t, "test_config_file_errors.yaml", contents)
+			defer os.Remove(filename)
+			_, _, err := ParseFlags("test", &configFileTestOpts{}, []string{"test", "--config_file", filename})
+			assert.Error(t, err)
+		})
+	}
+	_, _, err := ParseFlags("test", &configFileTestOpts{}, []string{"test", "--config_file", "test_config_file.toml"})
+	if assert.Error(t, err, "Only YAML and JSON are supported") {
+		assert.Contains(t, err.Error(), "JSON (.json)")
+	}
+	_, _, err = ParseFlags("test", &configFileTestOpts{}, []string{"test", "--config_file", "nonexistent.yaml"})
+	assert.Error(t, err)
+}
+
+func TestNoConfigFile(t *testing.T) {
+	opts := configFileTestOpts{}
+	_, extraArgs, err := ParseFlags("test", &opts, []string{"test", "--", "--config_file", "x.yaml"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--config_file", "x.yaml"}, extraArgs)
+	assert.Equal(t, 7677, opts.Port)
+}
+
+func TestConfigFileOptIn(t *testing.T) {
+	filename := writeConfigFile(t, "test_config_file_opt_in.yaml", "port: 8080\n")
+	defer os.Remove(filename)
+	opts := struct {
+		Port int `short:"p" long:"port" default:"7677"`
+	}{}
+	_, _, err := ParseFlags("test", &opts, []string{"test", "--config_file", filename})
+	assert.Error(t, err, "Apps that don't embed ConfigFileFlag don't accept it")
+	assert.NotEqual(t, 8080, opts.Port)
+}
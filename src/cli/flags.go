@@ -21,9 +21,17 @@ const GiByte = humanize.GiByte
 
 // ParseFlags parses the app's flags and returns the parser, any extra arguments, and any error encountered.
 // It may exit if certain options are encountered (eg. --help).
+// If the app's options embed ConfigFileFlag, they're read from any --config_file first.
 func ParseFlags(appname string, data interface{}, args []string) (*flags.Parser, []string, error) {
 	parser := flags.NewNamedParser(path.Base(args[0]), flags.HelpFlag|flags.PassDoubleDash)
 	parser.AddGroup(appname+" options", "", data)
+	if _, present := data.(configFileOptions); present {
+		if filename := findConfigFile(args[1:]); filename != "" {
+			if err := loadConfigFile(parser, filename); err != nil {
+				return parser, nil, err
+			}
+		}
+	}
 	extraArgs, err := parser.ParseArgs(args[1:])
 	if err != nil {
 		if err.(*flags.Error).Type == flags.ErrHelp {
@@ -5,6 +5,7 @@ package cli
 import (
 	"bytes"
 	"container/list"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 	"gopkg.in/op/go-logging.v1"
@@ -35,6 +37,13 @@ var LogLevel = logging.WARNING
 var fileLogLevel = logging.WARNING
 var fileBackend *logging.LogBackend
 
+// logJSON is set by SetJSONLogging.
+var logJSON bool
+
+// logFields are the fields added to every log line in JSON, set by SetLogField.
+var logFields = map[string]string{}
+var logFieldsMutex sync.RWMutex
+
 type logFileWriter struct {
 	file io.Writer
 }
@@ -79,7 +88,74 @@ func InitFileLogging(logFile string, logFileLevel int) {
 	}
 }
 
+// SetJSONLogging sets whether to log one JSON object per line, with the time, level, module and
+// message and any fields (see Field and SetLogField), instead of plain text. It applies to the
+// file log too, and must be called before InitLogging and InitFileLogging to take effect.
+func SetJSONLogging(enabled bool) {
+	logJSON = enabled
+}
+
+// SetLogField sets a field to add to every line logged as JSON, e.g. the name of this node.
+// Setting it to the empty string removes it.
+func SetLogField(name, value string) {
+	logFieldsMutex.Lock()
+	defer logFieldsMutex.Unlock()
+	if value == "" {
+		delete(logFields, name)
+	} else {
+		logFields[name] = value
+	}
+}
+
+// A LogField is an argument to a log message that's also logged as a separate field in JSON,
+// so it can be searched for without parsing the message.
+type LogField struct {
+	Name  string
+	Value interface{}
+}
+
+// Field returns a LogField with the given name and value. It's formatted in the message as the value would be.
+func Field(name string, value interface{}) LogField {
+	return LogField{Name: name, Value: value}
+}
+
+// String implements fmt.Stringer.
+func (field LogField) String() string {
+	return fmt.Sprint(field.Value)
+}
+
+// jsonFormatter formats log records as JSON objects.
+type jsonFormatter struct{}
+
+func (f jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	obj := map[string]interface{}{}
+	logFieldsMutex.RLock()
+	for k, v := range logFields {
+		obj[k] = v
+	}
+	logFieldsMutex.RUnlock()
+	for _, arg := range r.Args {
+		if field, ok := arg.(LogField); ok {
+			obj[field.Name] = field.Value
+		}
+	}
+	obj["time"] = r.Time.Format(time.RFC3339Nano)
+	obj["level"] = r.Level.String()
+	obj["module"] = r.Module
+	obj["message"] = r.Message()
+	b, err := json.Marshal(obj)
+	if err != nil {
+		// Most likely one of the fields can't be marshalled; the message always can be.
+		b, _ = json.Marshal(map[string]string{"time": r.Time.Format(time.RFC3339Nano), "level": r.Level.String(), "module": r.Module, "message": r.Message()})
+	}
+	_, err = w.Write(b)
+	return err
+}
+
 func logFormatter() logging.Formatter {
+	if logJSON {
+		return jsonFormatter{}
+	}
 	formatStr := "%{time:15:04:05.000} %{level:7s}: %{message}"
 	if StdErrIsATerminal {
 		formatStr = "%{color}" + formatStr + "%{color:reset}"
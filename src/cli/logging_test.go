@@ -1,10 +1,15 @@
 package cli
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
 )
 
 func TestLineWrap(t *testing.T) {
@@ -21,3 +26,28 @@ func TestLineWrap(t *testing.T) {
 	s = backend.lineWrap(strings.Repeat("a", 80))
 	assert.Equal(t, strings.Repeat("a", 80), strings.Join(s, "\n"))
 }
+
+func TestJSONFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	backend := logging.NewBackendFormatter(logging.NewLogBackend(&buf, "", 0), jsonFormatter{})
+	logger := logging.MustGetLogger("test")
+	logger.SetBackend(logging.AddModuleLevel(backend))
+	SetLogField("node", "node-1")
+	defer SetLogField("node", "")
+
+	logger.Warning("Failed to store %s:\n%s", Field("key", "linux_amd64/aGFzaA"), "disk full")
+	obj := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &obj))
+	assert.Equal(t, "WARNING", obj["level"])
+	assert.Equal(t, "test", obj["module"])
+	assert.Equal(t, "Failed to store linux_amd64/aGFzaA:\ndisk full", obj["message"])
+	assert.Equal(t, "linux_amd64/aGFzaA", obj["key"])
+	assert.Equal(t, "node-1", obj["node"])
+	assert.Contains(t, obj, "time")
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"), "Multi-line messages are still on one line")
+}
+
+func TestFieldFormatsAsItsValue(t *testing.T) {
+	assert.Equal(t, "key 42", fmt.Sprintf("key %s", Field("key", 42)))
+	assert.Equal(t, "key 42", fmt.Sprintf("key %d", Field("key", 42).Value))
+}
@@ -241,6 +241,10 @@ type Configuration struct {
 		RPCPrivateKey         string       `help:"File containing a PEM-encoded certificate which is used to authenticate to the RPC cache." example:"my_cert.pem"`
 		RPCCACert             string       `help:"File containing a PEM-encoded certificate which is used to validate the RPC cache's certificate." example:"ca.pem"`
 		RPCSecure             bool         `help:"Forces SSL on for the RPC cache. It will be activated if any of rpcpublickey, rpcprivatekey or rpccacert are set, but this can be used if none of those are needed and SSL is still in use."`
+		RPCStrictReads        bool         `help:"If True, artifacts that could only be found on a fallback replica of a clustered RPC cache (i.e. because some of the cluster is unavailable) are not used and the target is rebuilt instead.\nBy default they are used with a warning."`
+		RPCBalanceReads       bool         `help:"If True, reads from a clustered RPC cache are spread between the replicas of each artifact in proportion to the weights the nodes advertise (see the server's --read_weight flag), instead of always trying the same one first.\nNodes in our zone and read-optimised ones are still preferred over others."`
+		RPCZone               string       `help:"Zone of a clustered RPC cache that this machine is in, if its nodes are spread across several (see the server's --zone flag).\nReads go to nodes in the same zone in preference to crossing zones."`
+		RPCCompress           bool         `help:"If True, RPCs to the RPC cache are gzip compressed. This can help over slower links but costs CPU on both ends.\nThe server must have compression enabled (via --allow_compression) or requests will fail."`
 		RPCMaxMsgSize         cli.ByteSize `help:"Maximum size of a single message that we'll send to the RPC server.\nThis should agree with the server's limit, if it's higher the artifacts will be rejected.\nThe value is given as a byte size so can be suffixed with M, GB, KiB, etc."`
 	} `help:"Please has several built-in caches that can be configured in its config file.\n\nThe simplest one is the directory cache which by default is written into the .plz-cache directory. This allows for fast retrieval of code that has been built before (for example, when swapping Git branches).\n\nThere is also a remote RPC cache which allows using a centralised server to store artifacts. A typical pattern here is to have your CI system write artifacts into it and give developers read-only access so they can reuse its work.\n\nFinally there's a HTTP cache which is very similar, but a little obsolete now since the RPC cache outperforms it and has some extra features. Otherwise the two have similar semantics and share quite a bit of implementation.\n\nPlease has server implementations for both the RPC and HTTP caches."`
 	Metrics struct {
@@ -0,0 +1,166 @@
+// Package audit implements an audit trail of the artifacts that a cache server evicts.
+//
+// Unlike the metrics, which only describe evictions in aggregate, this records each one along
+// with why it happened, so it's possible to answer later exactly what was removed and when.
+// Entries are written as JSON, one per line, to a file that's only ever appended to.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"tools/cache/logfile"
+)
+
+// A Reason describes why an artifact was evicted.
+type Reason string
+
+const (
+	// Age means it hadn't been read for longer than the maximum artifact age.
+	Age Reason = "age"
+	// WaterMark means it was removed to bring the cache below its low water mark.
+	WaterMark Reason = "water_mark"
+	// Manual means it was explicitly deleted by a client.
+	Manual Reason = "manual"
+	// BuildKey means it was deleted because its build key was invalidated.
+	BuildKey Reason = "build_key"
+	// TTL means it outlived its sliding TTL or maximum lifetime.
+	TTL Reason = "ttl"
+	// Expiry means it was stored with an expiry that has passed.
+	Expiry Reason = "expiry"
+	// Corrupt means it didn't match the checksum it was stored with.
+	Corrupt Reason = "corrupt"
+	// Migrated means it was moved to another directory when the cache's layout changed, so it's still in the cache.
+	Migrated Reason = "migrated"
+)
+
+// AllKeys is the key recorded when the entire cache is deleted at once.
+const AllKeys = "*"
+
+// An Entry is a single record in the audit log.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Key    string    `json:"key"`
+	Size   int64     `json:"size"`
+	Reason Reason    `json:"reason"`
+}
+
+// A Log writes entries to an audit log file. Writes are buffered and flushed periodically so
+// recording an entry is cheap; at most a second's worth are lost if the process dies.
+// All methods are safe to call on a nil Log, which does nothing.
+type Log struct {
+	file *logfile.File
+}
+
+// Open opens the given file for appending audit entries to, creating it if needed.
+func Open(filename string) (*Log, error) {
+	f, err := logfile.Open(filename, "audit log")
+	if err != nil {
+		return nil, err
+	}
+	return &Log{file: f}, nil
+}
+
+// Record records the eviction of an artifact.
+func (l *Log) Record(key string, size int64, reason Reason) {
+	if l == nil {
+		return
+	}
+	l.file.Write(&Entry{Time: time.Now().UTC(), Key: key, Size: size, Reason: reason})
+}
+
+// Flush writes any buffered entries to the file.
+func (l *Log) Flush() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Flush()
+}
+
+// Reopen flushes and closes the log file, then opens it again. This allows it to be rotated by
+// moving the file out of the way and then calling this.
+func (l *Log) Reopen() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Reopen()
+}
+
+// ReopenOn reopens the log whenever the process receives one of the given signals
+// (typically SIGHUP, which is what logrotate and friends send).
+func (l *Log) ReopenOn(signals ...os.Signal) {
+	l.file.ReopenOn(signals...)
+}
+
+// Close flushes and closes the log.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Read reads entries from an audit log, calling f for each one.
+func Read(r io.Reader, f func(*Entry)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		entry := &Entry{}
+		if err := decoder.Decode(entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		f(entry)
+	}
+}
+
+// A Filter selects entries from an audit log. Zero-valued fields match everything.
+type Filter struct {
+	Since, Until time.Time
+	Reason       Reason
+	Prefix       string
+}
+
+// Match returns true if the given entry matches this filter.
+func (f *Filter) Match(entry *Entry) bool {
+	return (f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.Time.Before(f.Until)) &&
+		(f.Reason == "" || entry.Reason == f.Reason) &&
+		strings.HasPrefix(entry.Key, f.Prefix)
+}
+
+// A Total is the number and size of artifacts evicted.
+type Total struct {
+	Count int   `json:"count"`
+	Size  int64 `json:"size"`
+}
+
+// A Summary aggregates a set of entries.
+type Summary struct {
+	Total   Total            `json:"total"`
+	Reasons map[Reason]Total `json:"reasons"`
+	First   time.Time        `json:"first"`
+	Last    time.Time        `json:"last"`
+}
+
+// Add adds an entry to this summary.
+func (s *Summary) Add(entry *Entry) {
+	if s.Reasons == nil {
+		s.Reasons = map[Reason]Total{}
+	}
+	s.Total.Count++
+	s.Total.Size += entry.Size
+	t := s.Reasons[entry.Reason]
+	t.Count++
+	t.Size += entry.Size
+	s.Reasons[entry.Reason] = t
+	if s.First.IsZero() || entry.Time.Before(s.First) {
+		s.First = entry.Time
+	}
+	if entry.Time.After(s.Last) {
+		s.Last = entry.Time
+	}
+}
@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, filename string) []*Entry {
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	entries := []*Entry{}
+	require.NoError(t, Read(f, func(e *Entry) { entries = append(entries, e) }))
+	return entries
+}
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "audit.log")
+	l, err := Open(filename)
+	require.NoError(t, err)
+	l.Record("linux_amd64/src/core/core/abc", 1024, Age)
+	l.Record("linux_amd64/src/core/core/def", 512, WaterMark)
+	require.NoError(t, l.Flush())
+	entries := readAll(t, filename)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, "linux_amd64/src/core/core/abc", entries[0].Key)
+	assert.EqualValues(t, 1024, entries[0].Size)
+	assert.Equal(t, Age, entries[0].Reason)
+	assert.Equal(t, WaterMark, entries[1].Reason)
+
+	// Rotate it; new entries go to a fresh file.
+	require.NoError(t, os.Rename(filename, filename+".1"))
+	require.NoError(t, l.Reopen())
+	l.Record("linux_amd64/src/core/core/ghi", 256, Manual)
+	require.NoError(t, l.Close())
+	assert.Equal(t, 2, len(readAll(t, filename+".1")))
+	entries = readAll(t, filename)
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, Manual, entries[0].Reason)
+
+	// Reopening appends rather than truncating.
+	l, err = Open(filename)
+	require.NoError(t, err)
+	l.Record("linux_amd64/src/core/core/jkl", 128, BuildKey)
+	require.NoError(t, l.Close())
+	assert.Equal(t, 2, len(readAll(t, filename)))
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Record("a", 1, Age)
+	assert.NoError(t, l.Flush())
+	assert.NoError(t, l.Reopen())
+	assert.NoError(t, l.Close())
+}
+
+func TestFilterAndSummary(t *testing.T) {
+	now := time.Now()
+	entries := []*Entry{
+		{Time: now.Add(-3 * time.Hour), Key: "linux_amd64/src/core/abc", Size: 100, Reason: Age},
+		{Time: now.Add(-2 * time.Hour), Key: "linux_amd64/src/cache/def", Size: 200, Reason: WaterMark},
+		{Time: now.Add(-time.Hour), Key: "linux_amd64/src/core/ghi", Size: 300, Reason: WaterMark},
+	}
+	f := Filter{Since: now.Add(-150 * time.Minute), Prefix: "linux_amd64/src/core"}
+	s := Summary{}
+	for _, e := range entries {
+		if f.Match(e) {
+			s.Add(e)
+		}
+	}
+	assert.Equal(t, Total{Count: 1, Size: 300}, s.Total)
+	assert.Equal(t, map[Reason]Total{WaterMark: {Count: 1, Size: 300}}, s.Reasons)
+
+	f = Filter{Reason: WaterMark, Until: now.Add(-90 * time.Minute)}
+	assert.False(t, f.Match(entries[0]))
+	assert.True(t, f.Match(entries[1]))
+	assert.False(t, f.Match(entries[2]))
+
+	s = Summary{}
+	for _, e := range entries {
+		s.Add(e)
+	}
+	assert.Equal(t, Total{Count: 3, Size: 600}, s.Total)
+	assert.Equal(t, Total{Count: 2, Size: 500}, s.Reasons[WaterMark])
+	assert.Equal(t, entries[0].Time, s.First)
+	assert.Equal(t, entries[2].Time, s.Last)
+}
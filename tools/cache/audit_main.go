@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"cli"
+	"tools/cache/audit"
+)
+
+var log = logging.MustGetLogger("cache_audit")
+
+var opts struct {
+	cli.ConfigFileFlag
+	Usage     string       `usage:"cache_audit queries the audit logs written by the cache servers' --audit_log flag.\n\nBy default it prints the matching entries, one JSON object per line; with --summary it prints their totals for each reason instead."`
+	Verbosity int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	Since     string       `long:"since" description:"Only include entries at or after this time (RFC3339, e.g. 2018-01-02T15:04:05Z)"`
+	Until     string       `long:"until" description:"Only include entries before this time (RFC3339)"`
+	Last      cli.Duration `long:"last" description:"Only include entries from within this long ago. Overrides --since."`
+	Reason    string       `short:"r" long:"reason" choice:"age" choice:"water_mark" choice:"manual" choice:"build_key" choice:"ttl" choice:"expiry" choice:"corrupt" choice:"migrated" description:"Only include entries evicted for this reason"`
+	Prefix    string       `long:"prefix" description:"Only include entries whose key starts with this, e.g. linux_amd64/src/core"`
+	Summary   bool         `short:"s" long:"summary" description:"Print a summary of the matching entries instead of the entries themselves"`
+	Args      struct {
+		Files []string `positional-arg-name:"files" description:"Audit log files to read. Reads stdin if none are given."`
+	} `positional-args:"true"`
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Please cache audit log query", "5.5.0", &opts)
+	cli.InitLogging(opts.Verbosity)
+	filter := audit.Filter{
+		Since:  parseTime(opts.Since),
+		Until:  parseTime(opts.Until),
+		Reason: audit.Reason(opts.Reason),
+		Prefix: opts.Prefix,
+	}
+	if opts.Last > 0 {
+		filter.Since = time.Now().Add(-time.Duration(opts.Last))
+	}
+	summary := &audit.Summary{Reasons: map[audit.Reason]audit.Total{}}
+	encoder := json.NewEncoder(os.Stdout)
+	f := func(entry *audit.Entry) {
+		if !filter.Match(entry) {
+			return
+		} else if opts.Summary {
+			summary.Add(entry)
+		} else if err := encoder.Encode(entry); err != nil {
+			log.Fatalf("Failed to write entry: %s", err)
+		}
+	}
+	if len(opts.Args.Files) == 0 {
+		read("stdin", os.Stdin, f)
+	}
+	for _, filename := range opts.Args.Files {
+		file, err := os.Open(filename)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %s", filename, err)
+		}
+		read(filename, file, f)
+		file.Close()
+	}
+	if opts.Summary {
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summary); err != nil {
+			log.Fatalf("Failed to write summary: %s", err)
+		}
+	}
+}
+
+// read reads all the entries from the given audit log.
+func read(name string, r io.Reader, f func(*audit.Entry)) {
+	if err := audit.Read(r, f); err != nil {
+		log.Fatalf("Failed to read %s: %s", name, err)
+	}
+}
+
+// parseTime parses a time given on the command line. The empty string is the zero time.
+func parseTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		log.Fatalf("Invalid time %s: %s", s, err)
+	}
+	return t
+}
@@ -0,0 +1,247 @@
+// Package benchmark implements load generation against an RPC cache server.
+//
+// It drives a configurable mix of stores and retrieves against a server and reports
+// throughput and latency percentiles, which is useful for sizing a cluster and for
+// catching performance regressions between versions.
+package benchmark
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	"gopkg.in/op/go-logging.v1"
+
+	pb "cache/proto/rpc_cache"
+)
+
+var log = logging.MustGetLogger("benchmark")
+
+// A SizeDistribution is a weighted set of artifact sizes to generate.
+type SizeDistribution struct {
+	sizes      []int
+	cumulative []int
+}
+
+// ParseSizeDistribution parses a size distribution from the given reader.
+// Each line contains a size (e.g. 10K, 2M) and optionally an integer weight (default 1).
+// Blank lines and lines beginning with # are ignored.
+func ParseSizeDistribution(r io.Reader) (*SizeDistribution, error) {
+	d := &SizeDistribution{}
+	total := 0
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("Line %d: expected a size and optional weight, got %s", i, line)
+		}
+		size, err := humanize.ParseBytes(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: invalid size %s: %s", i, fields[0], err)
+		}
+		weight := 1
+		if len(fields) == 2 {
+			if weight, err = strconv.Atoi(fields[1]); err != nil || weight <= 0 {
+				return nil, fmt.Errorf("Line %d: invalid weight %s", i, fields[1])
+			}
+		}
+		total += weight
+		d.sizes = append(d.sizes, int(size))
+		d.cumulative = append(d.cumulative, total)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	} else if len(d.sizes) == 0 {
+		return nil, fmt.Errorf("Size distribution is empty")
+	}
+	return d, nil
+}
+
+// LoadSizeDistribution loads a size distribution from the given file.
+func LoadSizeDistribution(filename string) (*SizeDistribution, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSizeDistribution(f)
+}
+
+// FixedSizeDistribution returns a distribution that always generates the same size.
+func FixedSizeDistribution(size int) *SizeDistribution {
+	return &SizeDistribution{sizes: []int{size}, cumulative: []int{1}}
+}
+
+// Sample returns a random size from this distribution.
+func (d *SizeDistribution) Sample(r *rand.Rand) int {
+	n := r.Intn(d.cumulative[len(d.cumulative)-1])
+	return d.sizes[sort.SearchInts(d.cumulative, n+1)]
+}
+
+// Options describes the load to generate.
+type Options struct {
+	// Number of concurrent workers issuing requests.
+	Concurrency int
+	// How long to run for.
+	Duration time.Duration
+	// Fraction of requests that are stores (the remainder are retrieves).
+	StoreRatio float64
+	// Fraction of retrieves that request an artifact we've previously stored.
+	HitRatio float64
+	// Sizes of artifacts to store.
+	Sizes *SizeDistribution
+	// Timeout for each individual request.
+	Timeout time.Duration
+}
+
+// Results contains the results of a single benchmark run.
+type Results struct {
+	Stores, Retrieves, Hits, Errors int
+	Bytes                           int64
+	Elapsed                         time.Duration
+	StoreLatencies                  Latencies
+	RetrieveLatencies               Latencies
+}
+
+// Latencies is a set of request latencies.
+type Latencies []time.Duration
+
+func (l Latencies) Len() int           { return len(l) }
+func (l Latencies) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l Latencies) Less(i, j int) bool { return l[i] < l[j] }
+
+// Percentile returns the given percentile (0-100) of these latencies. They must be sorted.
+func (l Latencies) Percentile(p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	idx := int(float64(len(l))*p/100.0+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	} else if idx >= len(l) {
+		idx = len(l) - 1
+	}
+	return l[idx]
+}
+
+// String returns a human-readable summary of these results.
+func (r *Results) String() string {
+	secs := r.Elapsed.Seconds()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Ran for %s\n", r.Elapsed)
+	fmt.Fprintf(&buf, "Stores:    %d (%0.1f/s)\n", r.Stores, float64(r.Stores)/secs)
+	fmt.Fprintf(&buf, "Retrieves: %d (%0.1f/s), %d hits\n", r.Retrieves, float64(r.Retrieves)/secs, r.Hits)
+	fmt.Fprintf(&buf, "Errors:    %d\n", r.Errors)
+	fmt.Fprintf(&buf, "Transferred %s (%s/s)\n", humanize.Bytes(uint64(r.Bytes)), humanize.Bytes(uint64(float64(r.Bytes)/secs)))
+	for _, l := range []struct {
+		name      string
+		latencies Latencies
+	}{{"Store", r.StoreLatencies}, {"Retrieve", r.RetrieveLatencies}} {
+		fmt.Fprintf(&buf, "%s latency: p50 %s p90 %s p99 %s max %s\n", l.name, l.latencies.Percentile(50),
+			l.latencies.Percentile(90), l.latencies.Percentile(99), l.latencies.Percentile(100))
+	}
+	return buf.String()
+}
+
+// Run runs a benchmark against the given client and returns the results.
+func Run(client pb.RpcCacheClient, opts Options) *Results {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	results := &Results{}
+	stored := [][]byte{}
+	deadline := time.Now().Add(opts.Duration)
+	start := time.Now()
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+			for n := 0; time.Now().Before(deadline); n++ {
+				ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+				if r.Float64() < opts.StoreRatio {
+					hash := key(i, n)
+					size := opts.Sizes.Sample(r)
+					before := time.Now()
+					resp, err := client.Store(ctx, &pb.StoreRequest{
+						Os:   "benchmark",
+						Arch: "benchmark",
+						Hash: hash,
+						Artifacts: []*pb.Artifact{{
+							Package: "benchmark",
+							Target:  "benchmark",
+							File:    "artifact",
+							Body:    make([]byte, size),
+						}},
+					})
+					elapsed := time.Since(before)
+					mutex.Lock()
+					results.Stores++
+					results.StoreLatencies = append(results.StoreLatencies, elapsed)
+					if err != nil || !resp.Success {
+						log.Debug("Store failed: %s", err)
+						results.Errors++
+					} else {
+						results.Bytes += int64(size)
+						stored = append(stored, hash)
+					}
+					mutex.Unlock()
+				} else {
+					mutex.Lock()
+					hash := key(-1-i, n) // Never stored.
+					if len(stored) > 0 && r.Float64() < opts.HitRatio {
+						hash = stored[r.Intn(len(stored))]
+					}
+					mutex.Unlock()
+					before := time.Now()
+					resp, err := client.Retrieve(ctx, &pb.RetrieveRequest{
+						Os:        "benchmark",
+						Arch:      "benchmark",
+						Hash:      hash,
+						Artifacts: []*pb.Artifact{{Package: "benchmark", Target: "benchmark", File: "artifact"}},
+					})
+					elapsed := time.Since(before)
+					mutex.Lock()
+					results.Retrieves++
+					results.RetrieveLatencies = append(results.RetrieveLatencies, elapsed)
+					if err != nil {
+						log.Debug("Retrieve failed: %s", err)
+						results.Errors++
+					} else if resp.Success && len(resp.Artifacts) > 0 {
+						results.Hits++
+						for _, a := range resp.Artifacts {
+							results.Bytes += int64(len(a.Body))
+						}
+					}
+					mutex.Unlock()
+				}
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	results.Elapsed = time.Since(start)
+	sort.Sort(results.StoreLatencies)
+	sort.Sort(results.RetrieveLatencies)
+	return results
+}
+
+// key returns a unique cache key for the n'th request of a worker.
+func key(worker, n int) []byte {
+	h := sha1.Sum([]byte(fmt.Sprintf("%d-%d-%d", worker, n, time.Now().UnixNano())))
+	return h[:]
+}
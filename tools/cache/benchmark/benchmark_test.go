@@ -0,0 +1,48 @@
+package benchmark
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSizeDistribution(t *testing.T) {
+	d, err := ParseSizeDistribution(strings.NewReader(`
+# Mostly small artifacts with the odd big one.
+1K 9
+1M
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1000, 1000000}, d.sizes)
+	r := rand.New(rand.NewSource(42))
+	small := 0
+	for i := 0; i < 1000; i++ {
+		if d.Sample(r) == 1000 {
+			small++
+		}
+	}
+	assert.InDelta(t, 900, small, 50)
+}
+
+func TestParseSizeDistributionErrors(t *testing.T) {
+	_, err := ParseSizeDistribution(strings.NewReader(""))
+	assert.Error(t, err)
+	_, err = ParseSizeDistribution(strings.NewReader("wibble"))
+	assert.Error(t, err)
+	_, err = ParseSizeDistribution(strings.NewReader("1K -1"))
+	assert.Error(t, err)
+}
+
+func TestPercentile(t *testing.T) {
+	l := Latencies{}
+	for i := 1; i <= 100; i++ {
+		l = append(l, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, l.Percentile(50))
+	assert.Equal(t, 99*time.Millisecond, l.Percentile(99))
+	assert.Equal(t, 100*time.Millisecond, l.Percentile(100))
+	assert.Equal(t, time.Duration(0), Latencies{}.Percentile(50))
+}
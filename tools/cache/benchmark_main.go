@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+
+	pb "cache/proto/rpc_cache"
+	"cli"
+	"tools/cache/benchmark"
+	"tools/cache/dial"
+)
+
+var log = logging.MustGetLogger("rpc_cache_benchmark")
+
+var opts struct {
+	cli.ConfigFileFlag
+	Usage       string       `usage:"rpc_cache_benchmark drives a configurable load against a Please RPC cache server and reports throughput and latency."`
+	URL         string       `short:"u" long:"url" required:"true" description:"URL of the cache server to benchmark"`
+	Verbosity   int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	Concurrency int          `short:"c" long:"concurrency" default:"10" description:"Number of concurrent requests to issue"`
+	Duration    cli.Duration `short:"d" long:"duration" default:"1m" description:"Length of time to run the benchmark for"`
+	Timeout     cli.Duration `long:"timeout" default:"30s" description:"Timeout for each individual request"`
+	StoreRatio  float64      `long:"store_ratio" default:"0.2" description:"Fraction of requests that are stores; the remainder are retrieves"`
+	HitRatio    float64      `long:"hit_ratio" default:"0.8" description:"Fraction of retrieves that request a previously stored artifact"`
+	Size        cli.ByteSize `long:"size" default:"100K" description:"Size of artifacts to store, if --size_distribution isn't given"`
+	SizeFile    string       `long:"size_distribution" description:"File describing the distribution of artifact sizes. Each line is a size and an optional weight."`
+	MaxMsgSize  cli.ByteSize `long:"max_msg_size" default:"200M" description:"Maximum message size to send / receive"`
+
+	TLSFlags dial.TLSFlags `group:"Options controlling TLS communication & authentication"`
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Please RPC cache benchmark", "5.5.0", &opts)
+	cli.InitLogging(opts.Verbosity)
+	sizes := benchmark.FixedSizeDistribution(int(opts.Size))
+	if opts.SizeFile != "" {
+		d, err := benchmark.LoadSizeDistribution(opts.SizeFile)
+		if err != nil {
+			log.Fatalf("Failed to load size distribution: %s", err)
+		}
+		sizes = d
+	}
+	conn, err := dial.Dial(opts.URL, time.Duration(opts.Timeout), int(opts.MaxMsgSize), opts.TLSFlags)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	client := pb.NewRpcCacheClient(conn)
+	log.Notice("Running benchmark against %s with %d workers for %s...", opts.URL, opts.Concurrency, opts.Duration)
+	results := benchmark.Run(client, benchmark.Options{
+		Concurrency: opts.Concurrency,
+		Duration:    time.Duration(opts.Duration),
+		StoreRatio:  opts.StoreRatio,
+		HitRatio:    opts.HitRatio,
+		Sizes:       sizes,
+		Timeout:     time.Duration(opts.Timeout),
+	})
+	fmt.Print(results.String())
+}
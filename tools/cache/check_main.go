@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"gopkg.in/op/go-logging.v1"
+
+	pb "cache/proto/rpc_cache"
+	"cli"
+	"tools/cache/consistency"
+	"tools/cache/dial"
+)
+
+var log = logging.MustGetLogger("rpc_cache_check")
+
+var opts struct {
+	cli.ConfigFileFlag
+	Usage     string       `usage:"rpc_cache_check checks that the nodes of an RPC cache cluster agree about the contents of the artifacts they store.\n\nIt prints a JSON report to stdout and exits with a nonzero status if any divergence is found."`
+	URL       string       `short:"u" long:"url" required:"true" description:"URL of any node in the cluster"`
+	Verbosity int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	Keys      []string     `short:"k" long:"key" description:"Artifact to check, as a path relative to the cache directory (e.g. linux_amd64/src/core/core/<hash>). Can be repeated."`
+	Sample    int          `short:"s" long:"sample" description:"Number of files to check, chosen at random from across the cluster"`
+	Timeout   cli.Duration `long:"timeout" default:"30s" description:"Timeout for each request to each node"`
+
+	TLSFlags dial.TLSFlags `group:"Options controlling TLS communication & authentication"`
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Please RPC cache consistency check", "5.5.0", &opts)
+	cli.InitLogging(opts.Verbosity)
+	if len(opts.Keys) == 0 && opts.Sample == 0 {
+		log.Fatalf("Must pass at least one of --key or --sample")
+	}
+	timeout := time.Duration(opts.Timeout)
+	conn := connect(opts.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := pb.NewRpcCacheClient(conn).ListNodes(ctx, &pb.ListRequest{})
+	if err != nil {
+		log.Fatalf("Failed to list cluster nodes: %s", err)
+	}
+	clients := map[string]pb.RpcServerClient{}
+	for _, node := range resp.Nodes {
+		clients[node.Name] = pb.NewRpcServerClient(connect(node.Address))
+	}
+	if len(clients) == 0 {
+		log.Warning("%s isn't part of a cluster, will only check it", opts.URL)
+		clients[opts.URL] = pb.NewRpcServerClient(conn)
+	}
+	log.Notice("Checking %d nodes...", len(clients))
+	report := consistency.Run(clients, opts.Keys, opts.Sample, timeout)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatalf("Failed to write report: %s", err)
+	}
+	if report.Divergent > 0 {
+		os.Exit(1)
+	}
+}
+
+// connect connects to the given address, or dies if it can't.
+func connect(address string) *grpc.ClientConn {
+	conn, err := dial.Dial(address, time.Duration(opts.Timeout), 0, opts.TLSFlags)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return conn
+}
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// StartClean takes a clean lease for this node, unless the given fraction of the cluster already
+// holds one, in which case it returns false. At least one node is always permitted to clean at a time.
+// The lease is advertised to other nodes so they count us while we clean. It's released by
+// FinishClean, when we leave the cluster, or after the given TTL in case we never finish;
+// the expiry is advertised too, so other nodes stop counting us then even if we're stuck.
+// Like RequestRestart this relies on gossip, so after taking a lease we wait briefly to see if
+// other nodes took one at the same time; if too many did, those with the lowest names keep them.
+func (cluster *Cluster) StartClean(maxFraction float64, ttl time.Duration) bool {
+	members := cluster.list.Members()
+	allowed := int(maxFraction * float64(len(members)))
+	if allowed < 1 {
+		allowed = 1
+	}
+	if cleaning := cluster.cleaners(false); len(cleaning) >= allowed {
+		log.Info("%d of %d nodes are currently cleaning", len(cleaning), len(members))
+		return false
+	}
+	atomic.StoreInt64(&cluster.delegate.cleanLeaseExpiry, time.Now().Add(ttl).Unix())
+	cluster.setFlag(&cluster.delegate.cleaning, true)
+	time.Sleep(settleDelay)
+	cleaning := cluster.cleaners(true)
+	name := cluster.list.LocalNode().Name
+	if idx := sort.SearchStrings(cleaning, name); idx >= allowed {
+		log.Info("%d other nodes started cleaning at the same time as us", len(cleaning)-1)
+		cluster.FinishClean()
+		return false
+	}
+	cluster.cleanMutex.Lock()
+	defer cluster.cleanMutex.Unlock()
+	if cluster.cleanTimer != nil {
+		cluster.cleanTimer.Stop()
+	}
+	cluster.cleanTimer = time.AfterFunc(ttl, func() {
+		log.Warning("Clean lease has expired while we're still cleaning, releasing it")
+		cluster.FinishClean()
+	})
+	return true
+}
+
+// FinishClean releases this node's clean lease if it holds one.
+func (cluster *Cluster) FinishClean() {
+	cluster.cleanMutex.Lock()
+	defer cluster.cleanMutex.Unlock()
+	if cluster.cleanTimer != nil {
+		cluster.cleanTimer.Stop()
+		cluster.cleanTimer = nil
+	}
+	cluster.setFlag(&cluster.delegate.cleaning, false)
+}
+
+// cleaners returns the sorted names of the nodes that currently hold a clean lease, optionally including ourselves.
+func (cluster *Cluster) cleaners(includeSelf bool) []string {
+	names := []string{}
+	now := time.Now()
+	for _, m := range cluster.list.Members() {
+		if (includeSelf || m.Name != cluster.list.LocalNode().Name) && cluster.isCleaning(m, now) {
+			names = append(names, m.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isCleaning returns true if the given node holds a clean lease that hasn't expired by the given time.
+func (cluster *Cluster) isCleaning(node *memberlist.Node, now time.Time) bool {
+	if !cluster.hasFlag(node, cleaningFlag) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(cluster.flagValue(node, cleanLeaseFlag), 10, 64)
+	return err != nil || now.Before(time.Unix(expiry, 0))
+}
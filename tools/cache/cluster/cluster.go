@@ -3,9 +3,41 @@
 // Clustering the cache provides redundancy and increased performance
 // for large caches. Right now the functionality is a little limited,
 // there's no online rehashing so the size must be declared and fixed
-// up front, and the replication factor is fixed at 2. There's an
-// assumption that while nodes might restart, they return with the same
-// name which we use to re-identify them.
+// up front. There's an assumption that while nodes might restart, they
+// return with the same name which we use to re-identify them.
+//
+// Each artifact is stored on as many nodes as the replication factor, 2 by default: those
+// owning the points for it that are spread evenly around the hash space (see tools.ReplicaHash),
+// or the next node along if that one's already holding it. Every node must be configured with
+// the same factor. Clients only know about the first two, but any replica asks the others for
+// artifacts it doesn't have.
+//
+// Nodes can optionally advertise a role. Roles don't change the consistent-hash
+// ownership at all; each node still owns its share of the hash space and
+// artifacts are replicated to the same nodes as before. The role only
+// affects which of those replicas clients read from first, so for example a
+// read-optimised node is preferred for reads of artifacts it holds, and clients
+// fall back to the other replica if it doesn't have them.
+//
+// If a node dies and doesn't come back within a configurable delay, the points it owned in the
+// hash space are handed over to stand-ins and the surviving replicas of its artifacts send them
+// on, so they're back to being held twice. The node keeps its slot though, and takes it back
+// from its stand-ins if it returns, and is sent what was stored on them while it was gone.
+//
+// Replications that fail can be queued on disk and retried with backoff, so a peer that's
+// briefly unreachable still ends up with everything stored while it was.
+//
+// Nodes can optionally forward stores and retrieves for artifacts they aren't a replica of to
+// one that is, so clients that don't know the hash space (e.g. behind a load balancer) can send
+// anything to any node. Requests carry the number of times they've been forwarded, and aren't
+// forwarded again after the second, in case the nodes don't agree on who owns what.
+//
+// Nodes can also advertise a zone, for clusters that span several sites. Again the
+// ownership of the hash space is unchanged, but artifacts are additionally replicated
+// to one node in each zone that none of their usual replicas is in, so that every
+// zone has a copy of everything. When fetching from another node we prefer ones in our
+// own zone and only cross zones as a last resort, since that's typically slower and
+// more expensive.
 //
 // The general approach here errs heavily on the side of simplicity and
 // less on zero-downtime reliability since, at the end of the day, this
@@ -19,9 +51,11 @@ import (
 	stdlog "log"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/retry"
@@ -41,16 +75,25 @@ type Cluster struct {
 	// nodes is a list of nodes that is initialised by the original seed
 	// and replicated between any other nodes that join after.
 	nodes []*pb.Node
-	// nodeMutex protects access to nodes
+	// dead is the set of nodes (by name) whose hash space has been handed over to stand-ins.
+	dead map[string]bool
+	// failover is set if we take part in recovering from failed nodes.
+	failover *failover
+	// retries is set if we retry failed replications.
+	retries *retryQueue
+	// nodeMutex protects access to nodes, dead, failover and retries
 	nodeMutex sync.RWMutex
 
-	// clients is a pool of gRPC clients to the other cluster nodes.
-	clients map[string]pb.RpcServerClient
+	// clients is a pool of gRPC connections to the other cluster nodes.
+	clients map[string]*grpc.ClientConn
 	// clientMutex protects concurrent access to clients.
 	clientMutex sync.RWMutex
 
 	// size is the expected number of nodes in the cluster.
 	size int
+	// replicationFactor is the number of nodes each artifact is stored on, not counting zone
+	// replicas. It's protected by nodeMutex.
+	replicationFactor int
 
 	// node is the node corresponding to this instance.
 	node *pb.Node
@@ -59,16 +102,62 @@ type Cluster struct {
 	hostname string
 	// name is the name of this cluster node.
 	name string
+	// zone is the zone this node is in, if any.
+	zone string
+	// delegate is our memberlist delegate, which provides our metadata to other nodes.
+	delegate *delegate
+	// metrics are the metrics describing this node's replication, failover and forwarding.
+	metrics *clusterMetrics
+
+	// inflight is the number of replications currently in progress.
+	inflight int64
+	// failures is the number of replications that have failed.
+	failures int64
+
+	// readOnlyOnPartition is true if we refuse stores while we can only see a minority of the cluster.
+	readOnlyOnPartition bool
+	// forwarding is true if we forward requests for artifacts we don't hold to a node that does.
+	forwarding bool
+	// reachedSize is nonzero once we've seen the cluster at its expected size (see NotReadyReason).
+	reachedSize int32
+
+	// restartTimer releases the restart token if we hold it and don't restart in time.
+	restartTimer *time.Timer
+	// restartMutex protects access to restartTimer.
+	restartMutex sync.Mutex
+
+	// cleanTimer releases the clean lease if we hold it and don't finish cleaning in time.
+	cleanTimer *time.Timer
+	// cleanMutex protects access to cleanTimer.
+	cleanMutex sync.Mutex
 }
 
 // NewCluster creates a new Cluster object and starts listening on the given port.
-func NewCluster(port, rpcPort int, name, advertiseAddr string) *Cluster {
+// The role and zone are advertised to other nodes & clients; either can be empty if this node
+// has no particular role or the cluster doesn't span multiple zones.
+func NewCluster(port, rpcPort int, name, advertiseAddr, role, zone string) *Cluster {
 	c := memberlist.DefaultLANConfig()
 	c.BindPort = port
 	c.AdvertisePort = port
-	c.Delegate = &delegate{name: name, port: rpcPort}
+	d := &delegate{name: name, port: rpcPort, role: role, zone: zone}
+	clu := &Cluster{
+		clients:  map[string]*grpc.ClientConn{},
+		name:     name,
+		zone:     zone,
+		delegate: d,
+		metrics:  newClusterMetrics(),
+	}
+	c.Delegate = d
+	c.Events = &events{cluster: clu}
 	c.Logger = stdlog.New(&logWriter{}, "", 0)
-	c.AdvertiseAddr = advertiseAddr
+	if advertiseAddr != "" {
+		// memberlist wants a bare IP, but we take IPv6 addresses in brackets too to be lenient.
+		ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(advertiseAddr, "["), "]"))
+		if ip == nil {
+			log.Fatalf("Invalid advertise address %s, must be an IP address", advertiseAddr)
+		}
+		c.AdvertiseAddr = ip.String()
+	}
 	if name != "" {
 		c.Name = name
 	}
@@ -76,11 +165,7 @@ func NewCluster(port, rpcPort int, name, advertiseAddr string) *Cluster {
 	if err != nil {
 		log.Fatalf("Failed to create new memberlist: %s", err)
 	}
-	clu := &Cluster{
-		clients: map[string]pb.RpcServerClient{},
-		name:    name,
-		list:    list,
-	}
+	clu.list = list
 	if hostname, err := os.Hostname(); err == nil {
 		clu.hostname = hostname
 	}
@@ -103,7 +188,7 @@ func (cluster *Cluster) Join(members []string) {
 			continue // Don't attempt to join ourselves, we're in the memberlist but can't welcome a new member.
 		}
 		log.Notice("Attempting to join with %s: %s / %s", name, node.Addr, port)
-		if client, err := cluster.getRPCClient(name, node.Addr.String()+port); err != nil {
+		if client, err := cluster.getRPCClient(name, nodeAddress(node.Addr, port)); err != nil {
 			log.Error("Error getting RPC client for %s: %s", node.Addr, err)
 		} else if resp, err := client.Join(ctx, &pb.JoinRequest{
 			Name:    cluster.list.LocalNode().Name,
@@ -122,9 +207,22 @@ func (cluster *Cluster) Join(members []string) {
 	log.Fatalf("Unable to contact any other cluster members")
 }
 
+// Leave leaves the cluster, telling the other nodes we're going and waiting up to the given
+// timeout for them to hear about it. This node can't rejoin it afterwards.
+func (cluster *Cluster) Leave(timeout time.Duration) error {
+	log.Notice("Leaving cluster")
+	if err := cluster.list.Leave(timeout); err != nil {
+		return err
+	}
+	return cluster.list.Shutdown()
+}
+
 // metadata breaks metadata from a node into its name and port (with a leading colon).
 func (cluster *Cluster) metadata(node *memberlist.Node) (string, string) {
 	meta := string(node.Meta)
+	if idx := strings.IndexRune(meta, ','); idx != -1 {
+		meta = meta[:idx] // Strip any flags
+	}
 	idx := strings.IndexRune(meta, ':')
 	if idx == -1 {
 		return "", ""
@@ -132,6 +230,150 @@ func (cluster *Cluster) metadata(node *memberlist.Node) (string, string) {
 	return meta[:idx], meta[idx:]
 }
 
+// nodeAddress returns the address of a node's RPC server given its IP address and the port from
+// its metadata (which starts with a colon). IPv6 addresses are bracketed.
+func nodeAddress(ip net.IP, port string) string {
+	if ip == nil || port == "" {
+		return ip.String() + port
+	}
+	return net.JoinHostPort(ip.String(), port[1:])
+}
+
+// hasFlag returns true if the metadata from the given node contains the given flag.
+func (cluster *Cluster) hasFlag(node *memberlist.Node, flag string) bool {
+	meta := strings.Split(string(node.Meta), ",")
+	for _, f := range meta[1:] {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// role returns the role advertised in the metadata from the given node, or the empty string if it has none.
+func (cluster *Cluster) role(node *memberlist.Node) string {
+	return cluster.flagValue(node, roleFlag)
+}
+
+// zoneOf returns the zone advertised in the metadata from the given node, or the empty string if it has none.
+func (cluster *Cluster) zoneOf(node *memberlist.Node) string {
+	return cluster.flagValue(node, zoneFlag)
+}
+
+// weightOf returns the read weight advertised in the metadata from the given node, or 0 if it has none.
+func (cluster *Cluster) weightOf(node *memberlist.Node) int32 {
+	weight, _ := strconv.Atoi(cluster.flagValue(node, weightFlag))
+	return int32(weight)
+}
+
+// flagValue returns the value of the metadata flag with the given prefix from the given node,
+// or the empty string if it doesn't have it.
+func (cluster *Cluster) flagValue(node *memberlist.Node, prefix string) string {
+	meta := strings.Split(string(node.Meta), ",")
+	for _, f := range meta[1:] {
+		if strings.HasPrefix(f, prefix) {
+			return f[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// SetMaintenance enables or disables maintenance mode for this node.
+// Nodes in maintenance remain members of the cluster, but other nodes won't replicate to them.
+func (cluster *Cluster) SetMaintenance(enabled bool) {
+	cluster.setFlag(&cluster.delegate.maintenance, enabled)
+}
+
+// SetReadWeight sets the relative share of reads that clients balancing them between replicas
+// should send to this node, e.g. to send more to nodes with faster disks. The default is 1.
+func (cluster *Cluster) SetReadWeight(weight int) {
+	atomic.StoreInt32(&cluster.delegate.weight, int32(weight))
+	if err := cluster.list.UpdateNode(10 * time.Second); err != nil {
+		log.Error("Failed to broadcast node metadata: %s", err)
+	}
+}
+
+// SetStarting marks this node as starting up, or not. As for maintenance mode, starting nodes are
+// members of the cluster but aren't used for reads or writes. It should be set before joining
+// so that nobody routes to us before we're ready.
+func (cluster *Cluster) SetStarting(enabled bool) {
+	cluster.setFlag(&cluster.delegate.starting, enabled)
+}
+
+// FinishStarting waits for the given grace period, and then until ready returns true, before
+// marking this node as no longer starting. It blocks until then so is usually called in a goroutine.
+func (cluster *Cluster) FinishStarting(grace time.Duration, ready func() bool) {
+	time.Sleep(grace)
+	for !ready() {
+		log.Warning("Grace period has passed but we're not ready yet, will check again in %s", readyRetryDelay)
+		time.Sleep(readyRetryDelay)
+	}
+	cluster.SetStarting(false)
+	log.Notice("Finished starting, now available to the rest of the cluster")
+}
+
+// SetReadOnlyOnPartition makes this node refuse stores while it can see no more than half of the
+// cluster's expected size (counting itself). Otherwise both sides of a partition keep accepting
+// stores that can't be replicated to the other. It should be set before serving.
+func (cluster *Cluster) SetReadOnlyOnPartition(enabled bool) {
+	cluster.readOnlyOnPartition = enabled
+}
+
+// ReadOnlyReason returns the reason this node shouldn't accept stores because of the state of the
+// cluster, or the empty string if it should.
+func (cluster *Cluster) ReadOnlyReason() string {
+	if !cluster.readOnlyOnPartition || cluster.size <= 1 {
+		return ""
+	} else if n := cluster.list.NumMembers(); 2*n <= cluster.size {
+		return fmt.Sprintf("cluster is partitioned, can only see %d of %d nodes", n, cluster.size)
+	}
+	return ""
+}
+
+// MemberCount returns the number of nodes this one can currently see (counting itself), and the
+// number the cluster is expected to have.
+func (cluster *Cluster) MemberCount() (int, int) {
+	return cluster.list.NumMembers(), cluster.size
+}
+
+// readyRetryDelay is the time we wait between checks of whether we're ready once the grace period is over.
+var readyRetryDelay = 5 * time.Second
+
+// settleDelay is the time we wait after taking the restart token or a clean lease for it to
+// propagate, before checking that nobody else took it at the same time.
+var settleDelay = 2 * time.Second
+
+// setFlag sets one of the flags in our metadata and broadcasts it to the rest of the cluster.
+func (cluster *Cluster) setFlag(flag *int32, enabled bool) {
+	var m int32
+	if enabled {
+		m = 1
+	}
+	atomic.StoreInt32(flag, m)
+	if err := cluster.list.UpdateNode(10 * time.Second); err != nil {
+		log.Error("Failed to broadcast node metadata: %s", err)
+	}
+}
+
+// inMaintenance returns true if the named node is currently in maintenance mode (or starting up).
+func (cluster *Cluster) inMaintenance(name string) bool {
+	if cluster.list == nil {
+		return false // Not gossiping (yet), so we don't know.
+	}
+	for _, m := range cluster.list.Members() {
+		if m.Name == name {
+			return cluster.unavailable(m)
+		}
+	}
+	return false
+}
+
+// unavailable returns true if the given node shouldn't be used for reads or writes.
+// Clients only know about maintenance so starting nodes are presented to them as being in it.
+func (cluster *Cluster) unavailable(node *memberlist.Node) bool {
+	return cluster.hasFlag(node, maintenanceFlag) || cluster.hasFlag(node, startingFlag)
+}
+
 // Init seeds a new plz cache cluster.
 func (cluster *Cluster) Init(size int) {
 	cluster.size = size
@@ -156,10 +398,14 @@ func (cluster *Cluster) newNode(node *memberlist.Node) *pb.Node {
 	newNode := func(i int) *pb.Node {
 		_, port := cluster.metadata(node)
 		return &pb.Node{
-			Name:      node.Name,
-			Address:   node.Addr.String() + port,
-			HashBegin: tools.HashPoint(i, cluster.size),
-			HashEnd:   tools.HashPoint(i+1, cluster.size),
+			Name:        node.Name,
+			Address:     nodeAddress(node.Addr, port),
+			HashBegin:   tools.HashPoint(i, cluster.size),
+			HashEnd:     tools.HashPoint(i+1, cluster.size),
+			Maintenance: cluster.unavailable(node),
+			Role:        cluster.role(node),
+			Zone:        cluster.zoneOf(node),
+			Weight:      cluster.weightOf(node),
 		}
 	}
 	cluster.nodeMutex.Lock()
@@ -191,11 +437,29 @@ func (cluster *Cluster) newNode(node *memberlist.Node) *pb.Node {
 
 // getRPCClient returns an RPC client for the given server.
 func (cluster *Cluster) getRPCClient(name, address string) (pb.RpcServerClient, error) {
+	connection, err := cluster.getConnection(name, address)
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewRpcServerClient(connection), nil
+}
+
+// getCacheClient returns a client for the given server's public cache interface.
+func (cluster *Cluster) getCacheClient(name, address string) (pb.RpcCacheClient, error) {
+	connection, err := cluster.getConnection(name, address)
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewRpcCacheClient(connection), nil
+}
+
+// getConnection returns a gRPC connection to the given server, reusing an existing one if possible.
+func (cluster *Cluster) getConnection(name, address string) (*grpc.ClientConn, error) {
 	cluster.clientMutex.RLock()
-	client, present := cluster.clients[name]
+	connection, present := cluster.clients[name]
 	cluster.clientMutex.RUnlock()
 	if present {
-		return client, nil
+		return connection, nil
 	}
 	// TODO(pebers): add credentials.
 	connection, err := grpc.Dial(address, grpc.WithTimeout(5*time.Second), grpc.WithInsecure(),
@@ -203,43 +467,195 @@ func (cluster *Cluster) getRPCClient(name, address string) (pb.RpcServerClient,
 	if err != nil {
 		return nil, err
 	}
-	client = pb.NewRpcServerClient(connection)
 	if name != "" {
 		cluster.clientMutex.Lock()
-		cluster.clients[name] = client
+		cluster.clients[name] = connection
 		cluster.clientMutex.Unlock()
 	}
-	return client, nil
+	return connection, nil
 }
 
-// getAlternateNode returns the replica node for the given hash (i.e. whichever one is not us,
-// we don't really know for sure when calling this if we are the primary or not).
-func (cluster *Cluster) getAlternateNode(hash []byte) (string, string) {
-	point := tools.Hash(hash)
-	if point >= cluster.node.HashBegin && point < cluster.node.HashEnd {
-		// We've got this point, use the alternate.
-		point = tools.AlternateHash(hash)
-	}
+// replicas returns the nodes that should hold the artifacts for the given hash: those that own
+// its points in the hash space, as many as the replication factor, and one in each zone that none
+// of those is in. They're returned in that order, without duplicates.
+// Dead nodes are replaced by their stand-ins (see failover).
+func (cluster *Cluster) replicas(hash []byte) []*pb.Node {
 	cluster.nodeMutex.RLock()
 	defer cluster.nodeMutex.RUnlock()
+	return cluster.replicasWith(hash, cluster.dead)
+}
+
+// replicasWith is like replicas but treats the given set of nodes as dead.
+// The caller must hold nodeMutex.
+func (cluster *Cluster) replicasWith(hash []byte, dead map[string]bool) []*pb.Node {
+	ret := []*pb.Node{}
+	covered := map[string]bool{}
+	for r := 0; r < cluster.factor(); r++ {
+		point := tools.ReplicaHash(hash, r)
+		for i, n := range cluster.nodes {
+			if point >= n.HashBegin && point < n.HashEnd {
+				if dead[n.Name] || (n.Name != "" && containsNode(ret, n)) {
+					// Either way the next node along takes this point. Live nodes only own
+					// more than one of them when there are more than two replicas.
+					n = cluster.standIn(i, ret, dead)
+				}
+				if n != nil && !containsNode(ret, n) {
+					ret = append(ret, n)
+					covered[n.Zone] = true
+				}
+				break
+			}
+		}
+	}
+	if len(ret) == 0 {
+		log.Warning("No cluster node found for hash point %d", tools.Hash(hash))
+		return nil
+	}
+	zones := map[string][]*pb.Node{}
+	order := []string{}
 	for _, n := range cluster.nodes {
-		if point >= n.HashBegin && point < n.HashEnd {
-			return n.Name, n.Address
+		if n.Name == "" || n.Zone == "" || covered[n.Zone] {
+			continue
+		} else if _, present := zones[n.Zone]; !present {
+			order = append(order, n.Zone)
+		}
+		zones[n.Zone] = append(zones[n.Zone], n)
+	}
+	for _, zone := range order {
+		// If the zone's replica is dead, the next one in the zone stands in for it.
+		nodes := zones[zone]
+		for i, j := tools.ZoneReplica(hash, len(nodes)), 0; j < len(nodes); j++ {
+			if n := nodes[(i+j)%len(nodes)]; !dead[n.Name] {
+				ret = append(ret, n)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// peers returns the other nodes that should hold the artifacts for the given hash (i.e. the replicas
+// that aren't us), excluding any that are in maintenance mode. Those in our zone come first.
+func (cluster *Cluster) peers(hash []byte) []*pb.Node {
+	ret := []*pb.Node{}
+	for _, n := range cluster.replicas(hash) {
+		if n.Name == cluster.node.Name {
+			continue
+		} else if cluster.inMaintenance(n.Name) {
+			log.Info("Node %s is in maintenance mode", n.Name)
+			continue
 		}
+		ret = append(ret, n)
 	}
-	log.Warning("No cluster node found for hash point %d", point)
-	return "", ""
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Zone == cluster.zone && ret[j].Zone != cluster.zone })
+	return ret
+}
+
+// crossZone returns true if the given node is in a different zone to us.
+func (cluster *Cluster) crossZone(node *pb.Node) bool {
+	return node.Zone != cluster.zone && node.Zone != "" && cluster.zone != ""
 }
 
 // ReplicateArtifacts replicates artifacts from this node to another.
 func (cluster *Cluster) ReplicateArtifacts(req *pb.StoreRequest) {
-	name, address := cluster.getAlternateNode(req.Hash)
-	if address == "" {
+	start := time.Now()
+	atomic.AddInt64(&cluster.inflight, 1)
+	cluster.metrics.replicationsInflight.Inc()
+	cluster.metrics.replicationQueuedArtifacts.Add(float64(len(req.Artifacts)))
+	defer func() {
+		atomic.AddInt64(&cluster.inflight, -1)
+		cluster.metrics.replicationsInflight.Dec()
+		cluster.metrics.replicationQueuedArtifacts.Sub(float64(len(req.Artifacts)))
+		cluster.metrics.replicationLatency.Observe(time.Since(start).Seconds())
+	}()
+	peers := cluster.peers(req.Hash)
+	if len(peers) == 0 {
 		log.Warning("Couldn't get alternate address, will not replicate artifact")
 		return
 	}
-	log.Info("Replicating artifact to node %s", address)
-	cluster.replicate(name, address, req.Os, req.Arch, req.Hash, false, req.Artifacts, req.Hostname)
+	r := cluster.replicateRequest(req)
+	for _, node := range peers {
+		log.Info("Replicating artifact to node %s", node.Address)
+		if !cluster.send(node.Name, node.Address, r) {
+			cluster.retryLater(node.Name, r)
+		}
+	}
+}
+
+// replicateRequest returns the request to replicate the artifacts stored by the given one to another node.
+func (cluster *Cluster) replicateRequest(req *pb.StoreRequest) *pb.ReplicateRequest {
+	return &pb.ReplicateRequest{
+		Artifacts:   req.Artifacts,
+		Aliases:     req.Aliases,
+		BuildKey:    req.BuildKey,
+		Os:          req.Os,
+		Arch:        req.Arch,
+		Hash:        req.Hash,
+		Hostname:    req.Hostname,
+		Peer:        cluster.hostname,
+		RebuildCost: req.RebuildCost,
+		ShadowHash:  req.ShadowHash,
+		Expiry:      req.Expiry,
+	}
+}
+
+// Exists asks the other replicas for the given request's hash whether they have the artifacts.
+// They're asked in turn, those in our zone first, until one does.
+// It returns nil if there's no replica available or none can be contacted.
+func (cluster *Cluster) Exists(ctx context.Context, req *pb.ExistsRequest) *pb.ExistsResponse {
+	var ret *pb.ExistsResponse
+	for _, node := range cluster.peers(req.Hash) {
+		client, err := cluster.getCacheClient(node.Name, node.Address)
+		if err != nil {
+			log.Error("Failed to get RPC client for %s %s: %s", node.Name, node.Address, err)
+			continue
+		}
+		resp, err := client.Exists(ctx, &pb.ExistsRequest{
+			Artifacts: req.Artifacts,
+			Os:        req.Os,
+			Arch:      req.Arch,
+			Hash:      req.Hash,
+			// Don't let it ask anyone else, we're already asking all the other replicas.
+			CheckPeers: false,
+		})
+		if err != nil {
+			log.Warning("Error checking for artifact on %s: %s", node.Address, err)
+			continue
+		} else if resp.Exists {
+			return resp
+		}
+		ret = resp
+	}
+	return ret
+}
+
+// RetrieveArtifacts retrieves artifacts from the other replicas for the given request's hash.
+// They're tried in turn, those in our zone first, until one has them.
+// It returns nil if there's no replica available or none can be contacted.
+func (cluster *Cluster) RetrieveArtifacts(ctx context.Context, req *pb.RetrieveRequest) *pb.RetrieveResponse {
+	var ret *pb.RetrieveResponse
+	for _, node := range cluster.peers(req.Hash) {
+		client, err := cluster.getCacheClient(node.Name, node.Address)
+		if err != nil {
+			log.Error("Failed to get RPC client for %s %s: %s", node.Name, node.Address, err)
+			continue
+		}
+		resp, err := client.Retrieve(ctx, req)
+		if err != nil {
+			log.Warning("Error retrieving artifact from %s: %s", node.Address, err)
+			continue
+		} else if resp.Success && len(resp.Artifacts) > 0 {
+			if cluster.crossZone(node) {
+				cluster.metrics.crossZoneFetches.Inc()
+				for _, artifact := range resp.Artifacts {
+					cluster.metrics.crossZoneFetchBytes.Add(float64(len(artifact.Body)))
+				}
+			}
+			return resp
+		}
+		ret = resp
+	}
+	return ret
 }
 
 // DeleteArtifacts deletes artifacts from all other nodes.
@@ -248,32 +664,122 @@ func (cluster *Cluster) DeleteArtifacts(req *pb.DeleteRequest) {
 		// Don't forward request to ourselves...
 		if cluster.node.Name != node.Name {
 			log.Info("Forwarding delete request to node %s", node.Address)
-			cluster.replicate(node.Name, node.Address, req.Os, req.Arch, nil, true, req.Artifacts, "")
+			cluster.replicate(node.Name, node.Address, req.Os, req.Arch, nil, true, req.Artifacts, nil, "", "", 0, 0)
 		}
 	}
 }
 
-func (cluster *Cluster) replicate(name, address, os, arch string, hash []byte, delete bool, artifacts []*pb.Artifact, hostname string) {
+// DeleteEntries deletes the given individual files from all other nodes.
+func (cluster *Cluster) DeleteEntries(paths []string) {
+	for _, node := range cluster.GetMembers() {
+		if cluster.node.Name != node.Name {
+			log.Info("Forwarding delete of %d entries to node %s", len(paths), node.Address)
+			cluster.send(node.Name, node.Address, &pb.ReplicateRequest{Delete: true, Paths: paths})
+		}
+	}
+}
+
+// InvalidateBuildKey deletes all artifacts with the given build key from all other nodes.
+func (cluster *Cluster) InvalidateBuildKey(buildKey string) {
+	for _, node := range cluster.GetMembers() {
+		if cluster.node.Name != node.Name {
+			log.Info("Forwarding invalidation of build key %s to node %s", buildKey, node.Address)
+			cluster.replicate(node.Name, node.Address, "", "", nil, true, nil, nil, buildKey, "", 0, 0)
+		}
+	}
+}
+
+// replicate sends a single replication request to the given node. It returns true if it succeeded.
+func (cluster *Cluster) replicate(name, address, os, arch string, hash []byte, delete bool, artifacts []*pb.Artifact, aliases []*pb.ArtifactAlias, buildKey, hostname string, cost float64, expiry int64) bool {
+	return cluster.send(name, address, &pb.ReplicateRequest{
+		Artifacts:   artifacts,
+		Aliases:     aliases,
+		BuildKey:    buildKey,
+		Os:          os,
+		Arch:        arch,
+		Hash:        hash,
+		Delete:      delete,
+		Hostname:    hostname,
+		Peer:        cluster.hostname,
+		RebuildCost: cost,
+		Expiry:      expiry,
+	})
+}
+
+// send sends the given replication request to the given node. It returns true if it succeeded.
+func (cluster *Cluster) send(name, address string, req *pb.ReplicateRequest) bool {
 	client, err := cluster.getRPCClient(name, address)
 	if err != nil {
 		log.Error("Failed to get RPC client for %s %s: %s", name, address, err)
-		return
+		atomic.AddInt64(&cluster.failures, 1)
+		return false
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	if resp, err := client.Replicate(ctx, &pb.ReplicateRequest{
-		Artifacts: artifacts,
-		Os:        os,
-		Arch:      arch,
-		Hash:      hash,
-		Delete:    delete,
-		Hostname:  hostname,
-		Peer:      cluster.hostname,
-	}); err != nil {
+	if resp, err := client.Replicate(ctx, req); err != nil {
 		log.Error("Error replicating artifact: %s", err)
+		atomic.AddInt64(&cluster.failures, 1)
+		return false
 	} else if !resp.Success {
 		log.Error("Failed to replicate artifact to %s", address)
+		atomic.AddInt64(&cluster.failures, 1)
+		return false
+	}
+	return true
+}
+
+// ReplicationStats returns the number of replications from this node currently in progress,
+// and the number that have failed since it started.
+func (cluster *Cluster) ReplicationStats() (int64, int64) {
+	return atomic.LoadInt64(&cluster.inflight), atomic.LoadInt64(&cluster.failures)
+}
+
+// LocalNode returns the node corresponding to this instance, or nil if it hasn't joined the cluster yet.
+func (cluster *Cluster) LocalNode() *pb.Node {
+	return cluster.node
+}
+
+// Stats requests stats from each of the other nodes in the cluster. Each has the given time to
+// respond; the names of any that don't are returned separately so one slow node doesn't hold
+// up the rest.
+func (cluster *Cluster) Stats(timeout time.Duration) ([]*pb.NodeStats, []string) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	stats := []*pb.NodeStats{}
+	unreachable := []string{}
+	for _, node := range cluster.GetMembers() {
+		if cluster.node != nil && node.Name == cluster.node.Name {
+			continue
+		}
+		wg.Add(1)
+		go func(node *pb.Node) {
+			defer wg.Done()
+			s, err := cluster.nodeStats(node, timeout)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Warning("Failed to get stats from %s: %s", node.Name, err)
+				unreachable = append(unreachable, node.Name)
+			} else {
+				stats = append(stats, s)
+			}
+		}(node)
 	}
+	wg.Wait()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	sort.Strings(unreachable)
+	return stats, unreachable
+}
+
+// nodeStats requests stats from a single node.
+func (cluster *Cluster) nodeStats(node *pb.Node, timeout time.Duration) (*pb.NodeStats, error) {
+	client, err := cluster.getRPCClient(node.Name, node.Address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return client.Stats(ctx, &pb.StatsRequest{})
 }
 
 // AddNode adds a new node that's applying to join the cluster.
@@ -300,10 +806,75 @@ func (cluster *Cluster) AddNode(req *pb.JoinRequest) *pb.JoinResponse {
 type delegate struct {
 	name string
 	port int
+	role string
+	zone string
+	// weight is the relative share of reads we advertise that clients should send us, if positive.
+	weight int32
+	// maintenance is nonzero while this node is in maintenance mode.
+	maintenance int32
+	// cleaning is nonzero while this node holds a clean lease (see StartClean).
+	cleaning int32
+	// cleanLeaseExpiry is the time the clean lease we hold expires, in seconds since the Unix epoch.
+	cleanLeaseExpiry int64
+	// starting is nonzero while this node is starting up (see SetStarting).
+	starting int32
+	// restarting is nonzero while this node holds the restart token (see RequestRestart).
+	restarting int32
 }
 
+// maintenanceFlag is the metadata flag we use to advertise that a node is in maintenance mode.
+const maintenanceFlag = "maintenance"
+
+// cleaningFlag is the metadata flag we use to advertise that a node is currently cleaning.
+const cleaningFlag = "cleaning"
+
+// cleanLeaseFlag is the prefix of the metadata flag we use to advertise when a node's clean lease
+// expires. Older nodes advertise cleaningFlag without it, in which case the lease never expires.
+const cleanLeaseFlag = "clean_lease="
+
+// startingFlag is the metadata flag we use to advertise that a node is still starting up.
+const startingFlag = "starting"
+
+// restartingFlag is the metadata flag we use to advertise that a node holds the restart token,
+// i.e. it's been told it's safe to restart and is about to.
+const restartingFlag = "restarting"
+
+// roleFlag is the prefix of the metadata flag we use to advertise a node's role.
+const roleFlag = "role="
+
+// zoneFlag is the prefix of the metadata flag we use to advertise a node's zone.
+const zoneFlag = "zone="
+
+// weightFlag is the prefix of the metadata flag we use to advertise a node's read weight.
+const weightFlag = "weight="
+
 func (d *delegate) NodeMeta(limit int) []byte {
-	return []byte(d.name + ":" + strconv.Itoa(d.port))
+	meta := d.name + ":" + strconv.Itoa(d.port)
+	if d.role != "" {
+		meta += "," + roleFlag + d.role
+	}
+	if d.zone != "" {
+		meta += "," + zoneFlag + d.zone
+	}
+	if weight := atomic.LoadInt32(&d.weight); weight > 0 {
+		meta += "," + weightFlag + strconv.Itoa(int(weight))
+	}
+	if atomic.LoadInt32(&d.maintenance) != 0 {
+		meta += "," + maintenanceFlag
+	}
+	if atomic.LoadInt32(&d.cleaning) != 0 {
+		meta += "," + cleaningFlag
+		if expiry := atomic.LoadInt64(&d.cleanLeaseExpiry); expiry > 0 {
+			meta += "," + cleanLeaseFlag + strconv.FormatInt(expiry, 10)
+		}
+	}
+	if atomic.LoadInt32(&d.starting) != 0 {
+		meta += "," + startingFlag
+	}
+	if atomic.LoadInt32(&d.restarting) != 0 {
+		meta += "," + restartingFlag
+	}
+	return []byte(meta)
 }
 
 func (d *delegate) NotifyMsg([]byte)                           {}
@@ -2,12 +2,20 @@ package cluster
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	pb "cache/proto/rpc_cache"
 	"cache/tools"
@@ -15,13 +23,13 @@ import (
 
 func TestBringUpCluster(t *testing.T) {
 	lis := openRPCPort(6995)
-	c1 := NewCluster(5995, 6995, "c1", "")
+	c1 := NewCluster(5995, 6995, "c1", "", "", "")
 	m1 := newRPCServer(c1, lis)
 	c1.Init(3)
 	log.Notice("Cluster seeded")
 
 	lis = openRPCPort(6996)
-	c2 := NewCluster(5996, 6996, "c2", "")
+	c2 := NewCluster(5996, 6996, "c2", "", "", "")
 	m2 := newRPCServer(c2, lis)
 	c2.Join([]string{"127.0.0.1:5995"})
 	log.Notice("c2 joined cluster")
@@ -45,7 +53,7 @@ func TestBringUpCluster(t *testing.T) {
 	assert.Equal(t, expected, c2.GetMembers())
 
 	lis = openRPCPort(6997)
-	c3 := NewCluster(5997, 6997, "c3", "")
+	c3 := NewCluster(5997, 6997, "c3", "", "", "")
 	m3 := newRPCServer(c2, lis)
 	c3.Join([]string{"127.0.0.1:5995", "127.0.0.1:5996"})
 
@@ -110,12 +118,588 @@ func TestBringUpCluster(t *testing.T) {
 	assert.Equal(t, 3, m1.Replications)
 	assert.Equal(t, 3, m2.Replications)
 	assert.Equal(t, 2, m3.Replications)
+
+	// Stats are collected from all the other nodes.
+	stats, unreachable := c1.Stats(5 * time.Second)
+	assert.Equal(t, 2, len(stats))
+	assert.Equal(t, 0, len(unreachable))
+	inflight, failures := c1.ReplicationStats()
+	assert.EqualValues(t, 0, inflight)
+	assert.EqualValues(t, 0, failures)
+}
+
+func TestMetadata(t *testing.T) {
+	c := &Cluster{}
+	d := &delegate{name: "c1", port: 7677}
+	node := &memberlist.Node{Meta: d.NodeMeta(512)}
+	name, port := c.metadata(node)
+	assert.Equal(t, "c1", name)
+	assert.Equal(t, ":7677", port)
+	assert.False(t, c.hasFlag(node, maintenanceFlag))
+
+	d.maintenance = 1
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	name, port = c.metadata(node)
+	assert.Equal(t, "c1", name)
+	assert.Equal(t, ":7677", port)
+	assert.True(t, c.hasFlag(node, maintenanceFlag))
+	assert.False(t, c.hasFlag(node, cleaningFlag))
+
+	d.cleaning = 1
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	name, _ = c.metadata(node)
+	assert.Equal(t, "c1", name)
+	assert.True(t, c.hasFlag(node, maintenanceFlag))
+	assert.True(t, c.hasFlag(node, cleaningFlag))
+	assert.True(t, c.isCleaning(node, time.Now()), "Nodes that don't advertise a lease expiry are always cleaning")
+	assert.Equal(t, "", c.role(node))
+
+	d.cleanLeaseExpiry = time.Now().Add(time.Minute).Unix()
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	assert.True(t, c.hasFlag(node, cleaningFlag))
+	assert.True(t, c.isCleaning(node, time.Now()))
+	assert.False(t, c.isCleaning(node, time.Now().Add(time.Minute)), "Expired leases don't count")
+	d.cleaning = 0
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	assert.False(t, c.isCleaning(node, time.Now()))
+	assert.Equal(t, "", c.flagValue(node, cleanLeaseFlag))
+	d.cleaning = 1
+
+	d.role = "read"
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	name, port = c.metadata(node)
+	assert.Equal(t, "c1", name)
+	assert.Equal(t, ":7677", port)
+	assert.True(t, c.hasFlag(node, maintenanceFlag))
+	assert.Equal(t, "read", c.role(node))
+	assert.Equal(t, "", c.zoneOf(node))
+
+	d.zone = "onprem"
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	assert.Equal(t, "read", c.role(node))
+	assert.Equal(t, "onprem", c.zoneOf(node))
+	assert.True(t, c.hasFlag(node, maintenanceFlag))
+	assert.EqualValues(t, 0, c.weightOf(node))
+
+	d.weight = 3
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	assert.EqualValues(t, 3, c.weightOf(node))
+	assert.Equal(t, "onprem", c.zoneOf(node))
+
+	d.maintenance = 0
+	d.starting = 1
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	assert.False(t, c.hasFlag(node, maintenanceFlag))
+	assert.True(t, c.hasFlag(node, startingFlag))
+	assert.True(t, c.unavailable(node), "Starting nodes are unavailable like those in maintenance")
+	assert.False(t, c.hasFlag(node, restartingFlag))
+
+	d.restarting = 1
+	node = &memberlist.Node{Meta: d.NodeMeta(512)}
+	assert.True(t, c.hasFlag(node, restartingFlag))
+	assert.True(t, c.hasFlag(node, startingFlag))
+}
+
+func TestFinishStarting(t *testing.T) {
+	c := NewCluster(5998, 6998, "c4", "", "", "")
+	c.Init(2)
+	c.SetStarting(true)
+	assert.True(t, c.GetMembers()[0].Maintenance, "Presented to clients as being in maintenance")
+	readyRetryDelay = time.Millisecond
+	checks := 0
+	c.FinishStarting(time.Millisecond, func() bool {
+		checks++
+		return checks > 2
+	})
+	assert.Equal(t, 3, checks)
+	assert.False(t, c.GetMembers()[0].Maintenance)
+}
+
+func TestReadOnlyOnPartition(t *testing.T) {
+	c := NewCluster(5999, 6999, "c5", "", "", "")
+	c.Init(3)
+	assert.Equal(t, "", c.ReadOnlyReason(), "Not enabled by default")
+	c.SetReadOnlyOnPartition(true)
+	assert.Equal(t, "cluster is partitioned, can only see 1 of 3 nodes", c.ReadOnlyReason())
+	c.size = 1
+	assert.Equal(t, "", c.ReadOnlyReason(), "A single node can't be partitioned")
+}
+
+func TestNotReadyReason(t *testing.T) {
+	c := NewCluster(5984, 6982, "c12", "", "", "")
+	c.Init(2)
+	assert.Equal(t, "", c.NotReadyReason(false), "Doesn't wait for the cluster to fill up unless asked to")
+	assert.Equal(t, "cluster has 1 of 2 expected nodes", c.NotReadyReason(true))
+	c.size = 1
+	assert.Equal(t, "", c.NotReadyReason(true))
+	c.size = 2
+	assert.Equal(t, "", c.NotReadyReason(true), "Still ready once it's reached its size once")
+	c.SetStarting(true)
+	assert.Equal(t, "still starting up in the cluster", c.NotReadyReason(false))
+	c.SetStarting(false)
+	assert.Equal(t, "", c.NotReadyReason(true))
+}
+
+func TestRequestRestart(t *testing.T) {
+	settleDelay = time.Millisecond
+	lis := openRPCPort(6986)
+	c1 := NewCluster(5986, 6986, "c8", "", "", "")
+	newRPCServer(c1, lis)
+	c1.Init(2)
+	safe, reason := c1.RequestRestart(time.Minute)
+	assert.False(t, safe, "The other node isn't here yet")
+	assert.Equal(t, "only 0 of the other 1 nodes are healthy", reason)
+
+	lis = openRPCPort(6987)
+	c2 := NewCluster(5987, 6987, "c9", "", "", "")
+	newRPCServer(c2, lis)
+	c2.Join([]string{"127.0.0.1:5986"})
+	safe, _ = c1.RequestRestart(time.Minute)
+	assert.True(t, safe)
+	safe, _ = c1.RequestRestart(time.Minute)
+	assert.True(t, safe, "Asking again while we hold the token is fine")
+	waitFor(t, func() bool {
+		safe, reason = c2.RequestRestart(time.Minute)
+		return !safe
+	})
+	assert.Equal(t, "c8 is restarting", reason)
+
+	c1.ReleaseRestart()
+	waitFor(t, func() bool {
+		safe, _ = c2.RequestRestart(time.Millisecond)
+		return safe
+	})
+	// The token expires after its TTL, after which c1 can take it again.
+	waitFor(t, func() bool {
+		safe, _ = c1.RequestRestart(time.Minute)
+		return safe
+	})
+	c1.ReleaseRestart()
+}
+
+func TestStartClean(t *testing.T) {
+	settleDelay = time.Millisecond
+	lis := openRPCPort(6991)
+	c1 := NewCluster(5991, 6991, "c10", "", "", "")
+	newRPCServer(c1, lis)
+	c1.Init(2)
+	lis = openRPCPort(6992)
+	c2 := NewCluster(5992, 6992, "c11", "", "", "")
+	newRPCServer(c2, lis)
+	c2.Join([]string{"127.0.0.1:5991"})
+
+	assert.True(t, c1.StartClean(0.5, time.Minute))
+	waitFor(t, func() bool { return len(c2.cleaners(false)) == 1 })
+	assert.False(t, c2.StartClean(0.5, time.Minute), "Only one of the two nodes may clean at once")
+	assert.True(t, c2.StartClean(1, time.Minute), "Both nodes may clean at once")
+	c2.FinishClean()
+	c1.FinishClean()
+	waitFor(t, func() bool { return len(c2.cleaners(false)) == 0 })
+	assert.True(t, c2.StartClean(0.5, time.Minute))
+	c2.FinishClean()
+	waitFor(t, func() bool { return len(c1.cleaners(false)) == 0 })
+
+	// The lease is released after its TTL even if the clean never finishes.
+	assert.True(t, c1.StartClean(0.5, 100*time.Millisecond))
+	waitFor(t, func() bool { return atomic.LoadInt32(&c1.delegate.cleaning) == 0 })
+	waitFor(t, func() bool { return len(c2.cleaners(false)) == 0 })
+	assert.True(t, c2.StartClean(0.5, time.Minute))
+	c2.FinishClean()
+}
+
+// waitFor waits for the given condition to become true while gossip propagates, failing if it doesn't.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Condition never became true")
+}
+
+// fakeSampler is an ArtifactSampler that always returns the same paths, keyed by their hashes.
+type fakeSampler map[string][]byte
+
+func (s fakeSampler) SampleArtifacts(n int, f func(hash []byte, path string)) {
+	for path, hash := range s {
+		f(hash, path)
+	}
+}
+
+func TestCheckReadiness(t *testing.T) {
+	lis := openRPCPort(6988)
+	c1 := NewCluster(5988, 6988, "c6", "", "", "")
+	newRPCServer(c1, lis)
+	c1.Init(4)
+	c1.SetStarting(true)
+	assert.Error(t, c1.CheckReadiness(nil, 0, time.Second), "Can't reach a quorum of the cluster on our own")
+
+	lis = openRPCPort(6989)
+	c2 := NewCluster(5989, 6989, "c7", "", "", "")
+	m2 := newRPCServer(c2, lis)
+	c2.Join([]string{"127.0.0.1:5988"})
+	err := c1.CheckReadiness(nil, 0, time.Second)
+	assert.Error(t, err, "Two of four nodes isn't a quorum")
+	assert.Contains(t, err.Error(), "can only reach 2 of 4 nodes")
+	assert.True(t, c1.Starting(), "Checking readiness doesn't change whether we're starting")
+
+	c1.size = 3
+	assert.NoError(t, c1.CheckReadiness(nil, 0, time.Second))
+	// c7 holds the other replica of this hash.
+	sampler := fakeSampler{"linux_amd64/pkg/target/AAAAAA/file": {0, 0, 0, 0}}
+	assert.Error(t, c1.CheckReadiness(sampler, 1, time.Second), "The other replica doesn't have it")
+	m2.Held = []string{"linux_amd64/pkg/target/AAAAAA/file"}
+	assert.NoError(t, c1.CheckReadiness(sampler, 1, time.Second))
+}
+
+func TestReplicas(t *testing.T) {
+	node := func(i int, zone string) *pb.Node {
+		return &pb.Node{Name: fmt.Sprintf("n%d", i), HashBegin: tools.HashPoint(i, 6), HashEnd: tools.HashPoint(i+1, 6), Zone: zone}
+	}
+	names := func(nodes []*pb.Node) []string {
+		ret := []string{}
+		for _, n := range nodes {
+			ret = append(ret, n.Name)
+		}
+		return ret
+	}
+	hash := []byte{0, 0, 0, 0} // Owned by n0, and n3 for its alternate.
+	c := &Cluster{nodes: []*pb.Node{node(0, ""), node(1, ""), node(2, ""), node(3, ""), node(4, ""), node(5, "")}}
+	assert.Equal(t, []string{"n0", "n3"}, names(c.replicas(hash)), "Without zones it's just the usual two")
+
+	c.nodes = []*pb.Node{node(0, "a"), node(1, "b"), node(2, "a"), node(3, "b"), node(4, "c"), node(5, "c")}
+	assert.Equal(t, []string{"n0", "n3", "n4"}, names(c.replicas(hash)), "Zone c gets a replica too")
+	assert.Equal(t, []string{"n0", "n3", "n5"}, names(c.replicas([]byte{1, 0, 0, 0})), "Zone replicas are spread across the zone")
+
+	c.nodes = []*pb.Node{node(0, "a"), node(1, "b"), node(2, "b"), node(3, "a"), node(4, "b"), node(5, "a")}
+	assert.Equal(t, []string{"n0", "n3", "n1"}, names(c.replicas(hash)), "Both usual replicas are in zone a so zone b gets one")
+}
+
+func TestReplicasWithDeadNodes(t *testing.T) {
+	c := &Cluster{nodes: testNodes("", "", "", "", "", "")}
+	hash := []byte{0, 0, 0, 0} // Owned by n0, and n3 for its alternate.
+	c.dead = map[string]bool{"n0": true}
+	assert.Equal(t, []string{"n1", "n3"}, nodeNames(c.replicas(hash)), "The next node stands in for n0")
+	c.dead = map[string]bool{"n3": true}
+	assert.Equal(t, []string{"n0", "n4"}, nodeNames(c.replicas(hash)))
+	c.dead = map[string]bool{"n0": true, "n3": true}
+	assert.Equal(t, []string{"n1", "n4"}, nodeNames(c.replicas(hash)))
+	c.dead = map[string]bool{"n0": true, "n1": true}
+	assert.Equal(t, []string{"n2", "n3"}, nodeNames(c.replicas(hash)), "Stand-ins can't be dead either")
+
+	c.nodes = testNodes("a", "b", "a", "b", "c", "c")
+	c.dead = map[string]bool{"n4": true}
+	assert.Equal(t, []string{"n0", "n3", "n5"}, nodeNames(c.replicas(hash)), "The next node in the zone stands in for its replica")
+}
+
+func TestReplicationFactor(t *testing.T) {
+	c := &Cluster{nodes: testNodes("", "", "", "", "", "")}
+	hash := []byte{0, 0, 0, 0} // Owned by n0, n3 for its alternate, then n1 and n4 for the quarter points.
+	c.SetReplicationFactor(3)
+	assert.Equal(t, []string{"n0", "n3", "n1"}, nodeNames(c.replicas(hash)))
+	c.SetReplicationFactor(4)
+	assert.Equal(t, []string{"n0", "n3", "n1", "n4"}, nodeNames(c.replicas(hash)))
+	c.SetReplicationFactor(3)
+	c.dead = map[string]bool{"n1": true}
+	assert.Equal(t, []string{"n0", "n3", "n2"}, nodeNames(c.replicas(hash)), "Stand-ins work the same for the extra replicas")
+
+	c = &Cluster{nodes: testNodes("", "", "")}
+	c.SetReplicationFactor(3)
+	assert.Equal(t, []string{"n0", "n1", "n2"}, nodeNames(c.replicas(hash)), "n0 owns the quarter point too so the next node takes it")
+	c.SetReplicationFactor(4)
+	assert.Equal(t, []string{"n0", "n1", "n2"}, nodeNames(c.replicas(hash)), "There can't be more replicas than nodes")
+	c.SetReplicationFactor(1)
+	assert.Equal(t, []string{"n0"}, nodeNames(c.replicas(hash)))
+}
+
+func TestStandIns(t *testing.T) {
+	c := &Cluster{nodes: testNodes("", "", "", "", "", "")}
+	c.node = c.nodes[3]
+	c.dead = map[string]bool{"n0": true}
+	assert.Equal(t, []string{"n1"}, nodeNames(c.standIns("n0", []byte{0, 0, 0, 0})), "We're the other replica so we send it to the stand-in")
+	assert.Equal(t, 0, len(c.standIns("n0", []byte{0, 0, 0, 0x60})), "n0 never held this")
+	c.node = c.nodes[1]
+	assert.Equal(t, 0, len(c.standIns("n0", []byte{0, 0, 0, 0})), "Only the surviving replica sends it")
+}
+
+// fakeSource is an ArtifactSource that holds sets of artifacts without any contents.
+type fakeSource map[string][]byte
+
+func (s fakeSource) ListArtifacts(f func(os, arch string, hash []byte, key string)) {
+	for key, hash := range s {
+		f("linux", "amd64", hash, key)
+	}
+}
+
+func (s fakeSource) LoadArtifacts(key string) ([]*pb.Artifact, error) {
+	return []*pb.Artifact{{Package: "pkg", Target: key, File: "file", Body: []byte(key)}}, nil
+}
+
+func (s fakeSource) ArtifactExpiry(key string) int64 {
+	return 0
+}
+
+func TestFailover(t *testing.T) {
+	m := newRPCServer(nil, openRPCPort(6993))
+	c := &Cluster{nodes: testNodes("", "", "", "", "", ""), clients: map[string]*grpc.ClientConn{}, metrics: newClusterMetrics()}
+	c.nodes[1].Address = "127.0.0.1:6993"
+	c.node = c.nodes[3]
+	c.EnableFailover(time.Hour, 1<<30, fakeSource{
+		"held":     {0, 0, 0, 0},
+		"not_held": {0, 0, 0, 0x60},
+	})
+	// Nothing happens until it's been gone long enough.
+	c.nodeLeft("n0")
+	assert.False(t, c.isDead("n0"))
+	c.nodeJoined("n0")
+	assert.Equal(t, 0, len(c.failover.timers), "It came back in time")
+
+	c.promote("n0")
+	assert.True(t, c.isDead("n0"))
+	assert.Equal(t, 1, m.Replications, "Only the artifacts n0 held are sent to its stand-in")
+	c.nodeJoined("n0")
+	assert.False(t, c.isDead("n0"))
+}
+
+func TestReturned(t *testing.T) {
+	c := &Cluster{nodes: testNodes("", "", "", "", "", "")}
+	c.node = c.nodes[1]
+	assert.Equal(t, "n0", c.returned("n0", []byte{0, 0, 0, 0}).Name, "We stood in for n0 so we send it what it missed")
+	assert.Nil(t, c.returned("n0", []byte{0, 0, 0, 0x60}), "n0 doesn't hold this")
+	c.node = c.nodes[3]
+	assert.Nil(t, c.returned("n0", []byte{0, 0, 0, 0}), "Only the first replica sends it")
+}
+
+func TestCatchUp(t *testing.T) {
+	m := newRPCServer(nil, openRPCPort(6984))
+	c := &Cluster{nodes: testNodes("", "", "", "", "", ""), clients: map[string]*grpc.ClientConn{}, metrics: newClusterMetrics()}
+	c.nodes[0].Address = "127.0.0.1:6984"
+	c.node = c.nodes[1]
+	c.EnableFailover(time.Hour, 1<<30, fakeSource{
+		"held":     {0, 0, 0, 0},
+		"not_held": {0, 0, 0, 0x60},
+	})
+	c.catchUp(c.failover, "n0")
+	assert.Equal(t, 1, m.Replications, "Only the artifacts n0 should hold are sent back to it")
+}
+
+func TestUnderReplicated(t *testing.T) {
+	c := &Cluster{nodes: testNodes("", "", "", "", "", ""), size: 6}
+	c.node = c.nodes[0]
+	source := fakeSource{
+		"ours":   {0, 0, 0, 0},    // Held by n0 & n3.
+		"theirs": {0, 0, 0, 0x60}, // Held by n2 & n5; we'd never count it.
+	}
+	live := map[string]bool{"n0": true, "n1": true, "n2": true, "n3": true, "n4": true, "n5": true}
+	assert.Equal(t, 0, c.underReplicated(source, live))
+	delete(live, "n3")
+	assert.Equal(t, 1, c.underReplicated(source, live))
+	c.dead = map[string]bool{"n3": true}
+	assert.Equal(t, 0, c.underReplicated(source, live), "n4 has stood in for n3")
+	c.SetReplicationFactor(3)
+	delete(live, "n1")
+	assert.Equal(t, 1, c.underReplicated(source, live))
+
+	c = &Cluster{nodes: testNodes("", ""), size: 2}
+	c.node = c.nodes[0]
+	c.SetReplicationFactor(3)
+	assert.Equal(t, 0, c.underReplicated(source, map[string]bool{"n0": true, "n1": true}), "It can't have more replicas than nodes")
+}
+
+func TestDescribeOwnership(t *testing.T) {
+	c := &Cluster{nodes: testNodes("", "", "")}
+	c.dead = map[string]bool{"n0": true}
+	o := c.describeOwnership(nil, map[string]bool{"n1": true, "n2": true})
+	assert.Equal(t, 2, o.ReplicationFactor)
+	assert.Equal(t, 3, len(o.Nodes))
+	assert.False(t, o.Nodes[0].Live)
+	assert.Equal(t, "n1", o.Nodes[0].StandIn)
+	assert.True(t, o.Nodes[1].Live)
+	assert.Equal(t, "", o.Nodes[1].StandIn)
+	assert.Equal(t, 0, len(o.Replicas))
+
+	o = c.describeOwnership([]byte{0, 0, 0, 0}, nil)
+	assert.Equal(t, "AAAAAA", o.Hash)
+	assert.Equal(t, []uint32{0, 1 << 31}, o.Points)
+	assert.Equal(t, []string{"n1", "n2"}, o.Replicas)
+}
+
+func TestThrottleDelay(t *testing.T) {
+	assert.Equal(t, time.Second, throttleDelay(1000, 1000))
+	assert.Equal(t, 10*time.Millisecond, throttleDelay(1000, 100000))
+	assert.Equal(t, time.Duration(0), throttleDelay(1000, 0), "Zero means no limit")
+}
+
+func TestRetryQueue(t *testing.T) {
+	const dir = "test_retry_queue"
+	defer os.RemoveAll(dir)
+	req := &pb.ReplicateRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte{0, 0, 0, 0},
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "target", File: "file", Body: []byte("test")}},
+	}
+	c := &Cluster{nodes: testNodes("", ""), clients: map[string]*grpc.ClientConn{}, metrics: newClusterMetrics()}
+	c.nodes[1].Address = "127.0.0.1:6994"
+	assert.NoError(t, c.EnableRetries(dir, 2, 3))
+	c.retryLater("n1", req)
+	c.retryLater("n1", req)
+	c.retryLater("n1", req)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 2, len(files), "The third doesn't fit in the queue")
+
+	// A new node (i.e. after a restart) picks them up again and retries them straight away.
+	m := newRPCServer(nil, openRPCPort(6994))
+	c2 := &Cluster{nodes: testNodes("", ""), clients: map[string]*grpc.ClientConn{}, metrics: newClusterMetrics()}
+	c2.nodes[1].Address = "127.0.0.1:6994"
+	assert.NoError(t, c2.EnableRetries(dir, 2, 3))
+	for i := 0; i < 100 && m.Replications < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, 2, m.Replications)
+	files, _ = ioutil.ReadDir(dir)
+	assert.Equal(t, 0, len(files), "They're removed once they've succeeded")
+}
+
+func TestParseRetryEntry(t *testing.T) {
+	e := &retryEntry{seq: 12, attempts: 3, node: "node.example.com"}
+	e2, err := parseRetryEntry(e.filename())
+	assert.NoError(t, err)
+	assert.Equal(t, e, e2)
+	_, err = parseRetryEntry("12.node")
+	assert.Error(t, err)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, retryInitialBackoff, retryBackoff(0))
+	assert.Equal(t, 4*retryInitialBackoff, retryBackoff(2))
+	assert.Equal(t, retryMaxBackoff, retryBackoff(20))
+	assert.Equal(t, retryMaxBackoff, retryBackoff(100))
+}
+
+// testNodes returns a set of nodes in the given zones, dividing the hash space between them.
+func testNodes(zones ...string) []*pb.Node {
+	ret := make([]*pb.Node, len(zones))
+	for i, zone := range zones {
+		ret[i] = &pb.Node{Name: fmt.Sprintf("n%d", i), HashBegin: tools.HashPoint(i, len(zones)), HashEnd: tools.HashPoint(i+1, len(zones)), Zone: zone}
+	}
+	return ret
+}
+
+func TestNodeAddress(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:7677", nodeAddress(net.ParseIP("10.0.0.1"), ":7677"))
+	assert.Equal(t, "[2001:db8::1]:7677", nodeAddress(net.ParseIP("2001:db8::1"), ":7677"))
+}
+
+func TestCrossZone(t *testing.T) {
+	c := &Cluster{zone: "a"}
+	assert.False(t, c.crossZone(&pb.Node{Zone: "a"}))
+	assert.True(t, c.crossZone(&pb.Node{Zone: "b"}))
+	assert.False(t, c.crossZone(&pb.Node{}), "Nodes without a zone aren't counted")
+	c.zone = ""
+	assert.False(t, c.crossZone(&pb.Node{Zone: "b"}))
+}
+
+func TestReplicateVerified(t *testing.T) {
+	const file = "linux_amd64/pkg/target/AAAAAA/file"
+	m := newRPCServer(nil, openRPCPort(6985))
+	c := &Cluster{nodes: testNodes("", ""), clients: map[string]*grpc.ClientConn{}, metrics: newClusterMetrics()}
+	c.nodes[1].Address = "127.0.0.1:6985"
+	peers := c.nodes[1:]
+	req := &pb.ReplicateRequest{Hash: []byte{0, 0, 0, 0}}
+	checksums := map[string]string{file: "abc123"}
+
+	assert.Error(t, c.replicateVerified(peers, req, checksums), "The replica doesn't have the file")
+	assert.Equal(t, 1, m.Replications)
+	m.Held = []string{file}
+	m.Sums = map[string]string{file: "def456"}
+	assert.Error(t, c.replicateVerified(peers, req, checksums), "The replica's copy is different")
+	m.Sums[file] = "abc123"
+	assert.NoError(t, c.replicateVerified(peers, req, checksums))
+	assert.Equal(t, 3, m.Replications)
+}
+
+func TestForwarding(t *testing.T) {
+	m := &mockCacheServer{}
+	s := grpc.NewServer()
+	pb.RegisterRpcCacheServer(s, m)
+	go s.Serve(openRPCPort(6983))
+	c := &Cluster{nodes: testNodes("", "", ""), clients: map[string]*grpc.ClientConn{}, metrics: newClusterMetrics()}
+	for _, n := range c.nodes {
+		n.Address = "127.0.0.1:6983"
+	}
+	hash := []byte{0, 0, 0, 0} // Held by n0 and n1, not n2.
+	c.node = c.nodes[2]
+	ctx := context.Background()
+
+	_, forwarded := c.ForwardStore(ctx, &pb.StoreRequest{Hash: hash})
+	assert.False(t, forwarded, "Forwarding isn't enabled")
+
+	c.SetForwarding(true)
+	resp, forwarded := c.ForwardStore(ctx, &pb.StoreRequest{Hash: hash})
+	assert.True(t, forwarded)
+	assert.True(t, resp.Success)
+	assert.Equal(t, []string{"1"}, m.Hops)
+
+	// Requests that have already been forwarded once go one further, but no more than that.
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(forwardHopsHeader, "1"))
+	_, forwarded = c.ForwardStore(ctx, &pb.StoreRequest{Hash: hash})
+	assert.True(t, forwarded)
+	assert.Equal(t, []string{"1", "2"}, m.Hops)
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(forwardHopsHeader, "2"))
+	_, forwarded = c.ForwardStore(ctx, &pb.StoreRequest{Hash: hash})
+	assert.False(t, forwarded)
+
+	// Retrieves report misses from the replicas.
+	ctx = context.Background()
+	_, forwarded, err := c.ForwardRetrieve(ctx, &pb.RetrieveRequest{Hash: hash})
+	assert.True(t, forwarded)
+	assert.Equal(t, codes.NotFound, grpc.Code(err))
+	m.Found = true
+	r, forwarded, err := c.ForwardRetrieve(ctx, &pb.RetrieveRequest{Hash: hash})
+	assert.True(t, forwarded)
+	assert.NoError(t, err)
+	assert.True(t, r.Success)
+
+	// Nothing is forwarded by the replicas themselves.
+	c.node = c.nodes[0]
+	_, forwarded = c.ForwardStore(ctx, &pb.StoreRequest{Hash: hash})
+	assert.False(t, forwarded)
+	_, forwarded, _ = c.ForwardRetrieve(ctx, &pb.RetrieveRequest{Hash: hash})
+	assert.False(t, forwarded)
+}
+
+// mockCacheServer is a fake cache server that records the hops of the requests forwarded to it.
+// It only implements Store and Retrieve.
+type mockCacheServer struct {
+	pb.RpcCacheServer
+	Hops  []string
+	Found bool
+}
+
+func (m *mockCacheServer) Store(ctx context.Context, req *pb.StoreRequest) (*pb.StoreResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	m.Hops = append(m.Hops, md[forwardHopsHeader]...)
+	return &pb.StoreResponse{Success: true}, nil
+}
+
+func (m *mockCacheServer) Retrieve(ctx context.Context, req *pb.RetrieveRequest) (*pb.RetrieveResponse, error) {
+	if !m.Found {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	return &pb.RetrieveResponse{Success: true}, nil
 }
 
 // mockRPCServer is a fake RPC server we use for this test.
 type mockRPCServer struct {
 	cluster      *Cluster
 	Replications int
+	// Held are the paths of the files it claims to have.
+	Held []string
+	// Sums are the checksums it reports for them, by path.
+	Sums map[string]string
 }
 
 func (r *mockRPCServer) Join(ctx context.Context, req *pb.JoinRequest) (*pb.JoinResponse, error) {
@@ -127,6 +711,26 @@ func (r *mockRPCServer) Replicate(ctx context.Context, req *pb.ReplicateRequest)
 	return &pb.ReplicateResponse{Success: true}, nil
 }
 
+func (r *mockRPCServer) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.NodeStats, error) {
+	return &pb.NodeStats{NumFiles: int64(r.Replications)}, nil
+}
+
+func (r *mockRPCServer) Checksum(ctx context.Context, req *pb.ChecksumRequest) (*pb.ChecksumResponse, error) {
+	resp := &pb.ChecksumResponse{}
+	for _, path := range req.Paths {
+		for _, held := range r.Held {
+			if path == held {
+				resp.Files = append(resp.Files, &pb.FileChecksum{Path: path, Sha256: r.Sums[path]})
+			}
+		}
+	}
+	return resp, nil
+}
+
+func (r *mockRPCServer) Sample(ctx context.Context, req *pb.SampleRequest) (*pb.SampleResponse, error) {
+	return &pb.SampleResponse{}, nil
+}
+
 // openRPCPort opens a port for the gRPC server.
 // This is rather awkwardly split up from below to try to avoid races around the port opening.
 // There's something of a circular dependency between starting the gossip service (which triggers
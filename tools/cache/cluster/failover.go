@@ -0,0 +1,314 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// An ArtifactSource provides the artifacts stored on this node, so they can be re-replicated
+// to other nodes when one fails.
+type ArtifactSource interface {
+	// ListArtifacts calls f with the OS, architecture & hash of each set of artifacts stored
+	// on this node, and a key to load them with.
+	ListArtifacts(f func(os, arch string, hash []byte, key string))
+	// LoadArtifacts loads the set of artifacts with the given key.
+	LoadArtifacts(key string) ([]*pb.Artifact, error)
+	// ArtifactExpiry returns the expiry of the set of artifacts with the given key, in seconds
+	// since the Unix epoch, or zero if they don't have one.
+	ArtifactExpiry(key string) int64
+}
+
+// failover holds the configuration & state for recovering from failed nodes.
+//
+// Once a node has been dead for long enough (memberlist only tells us once it's gone beyond
+// suspect), each of the points it owned in the hash space is taken over by a stand-in: the next
+// live node after it in the cluster's list. The node keeps its slot, and gets it back if it returns.
+// Each artifact it held still has a replica on another node, which sends it on to the stand-in
+// to restore the replication factor. If it does return, whatever it should hold is sent back to it
+// the same way, since it missed anything stored while it was gone.
+type failover struct {
+	// delay is the time a node must have been dead for before we take over its hash space.
+	delay time.Duration
+	// bandwidth is the maximum rate, in bytes per second, we re-replicate artifacts at.
+	bandwidth int64
+	// source provides the artifacts stored on this node.
+	source ArtifactSource
+	// timers are the pending promotions for nodes that have died, keyed by their names.
+	timers map[string]*time.Timer
+	// mutex protects timers.
+	mutex sync.Mutex
+	// running is held while re-replicating, so only one node's artifacts are sent at a time.
+	running sync.Mutex
+}
+
+// EnableFailover makes this node take part in recovering from the failure of other nodes.
+// A node has to have been dead for the given delay before its artifacts are re-replicated,
+// which should be long enough for nodes to restart without triggering it. Artifacts are sent
+// at no more than the given bandwidth, in bytes per second; they're loaded from the given source.
+func (cluster *Cluster) EnableFailover(delay time.Duration, bandwidth int64, source ArtifactSource) {
+	cluster.nodeMutex.Lock()
+	defer cluster.nodeMutex.Unlock()
+	cluster.failover = &failover{
+		delay:     delay,
+		bandwidth: bandwidth,
+		source:    source,
+		timers:    map[string]*time.Timer{},
+	}
+}
+
+// currentFailover returns the failover configuration, or nil if it isn't enabled.
+func (cluster *Cluster) currentFailover() *failover {
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
+	return cluster.failover
+}
+
+// nodeLeft is called when memberlist declares a node dead (or it leaves gracefully).
+func (cluster *Cluster) nodeLeft(name string) {
+	f := cluster.currentFailover()
+	if f == nil || name == cluster.name {
+		return
+	}
+	log.Warning("Node %s has failed, will re-replicate its artifacts in %s if it hasn't returned", name, f.delay)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, present := f.timers[name]; !present {
+		f.timers[name] = time.AfterFunc(f.delay, func() { cluster.promote(name) })
+	}
+}
+
+// nodeJoined is called when memberlist sees a node join, including one returning after failing.
+func (cluster *Cluster) nodeJoined(name string) {
+	f := cluster.currentFailover()
+	if f == nil {
+		return
+	}
+	f.mutex.Lock()
+	if timer, present := f.timers[name]; present {
+		timer.Stop()
+		delete(f.timers, name)
+		log.Notice("Node %s has returned", name)
+	}
+	f.mutex.Unlock()
+	cluster.nodeMutex.Lock()
+	returned := cluster.dead[name]
+	if returned {
+		log.Notice("Node %s has returned, restoring its ownership of its hash space", name)
+		delete(cluster.dead, name)
+		cluster.metrics.failedNodes.Dec()
+	}
+	cluster.nodeMutex.Unlock()
+	if returned {
+		go cluster.catchUp(f, name)
+	}
+}
+
+// promote hands the hash space of a dead node to its stand-ins and re-replicates its artifacts.
+func (cluster *Cluster) promote(name string) {
+	f := cluster.currentFailover()
+	f.mutex.Lock()
+	delete(f.timers, name)
+	f.mutex.Unlock()
+	cluster.nodeMutex.Lock()
+	known := false
+	for _, n := range cluster.nodes {
+		known = known || n.Name == name
+	}
+	if !known || cluster.dead[name] {
+		cluster.nodeMutex.Unlock()
+		return
+	}
+	if cluster.dead == nil {
+		cluster.dead = map[string]bool{}
+	}
+	cluster.dead[name] = true
+	cluster.nodeMutex.Unlock()
+	cluster.metrics.failedNodes.Inc()
+	log.Warning("Node %s hasn't returned, handing over its hash space and re-replicating its artifacts", name)
+	cluster.rereplicate(f, name)
+}
+
+// isDead returns true if the given node's hash space has been handed over to its stand-ins.
+func (cluster *Cluster) isDead(name string) bool {
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
+	return cluster.dead[name]
+}
+
+// pendingReplication is a set of artifacts that we need to re-replicate.
+type pendingReplication struct {
+	os, arch string
+	hash     []byte
+	key      string
+	targets  []*pb.Node
+}
+
+// rereplicate sends the artifacts stored here that the given dead node held to its stand-ins.
+// It stops early if the node returns in the meantime.
+func (cluster *Cluster) rereplicate(f *failover, name string) {
+	f.running.Lock()
+	defer f.running.Unlock()
+	pending := []pendingReplication{}
+	f.source.ListArtifacts(func(os, arch string, hash []byte, key string) {
+		if targets := cluster.standIns(name, hash); len(targets) > 0 {
+			pending = append(pending, pendingReplication{os: os, arch: arch, hash: hash, key: key, targets: targets})
+		}
+	})
+	log.Notice("Re-replicating %d sets of artifacts held by %s", len(pending), name)
+	if cluster.resend(f, pending, func() bool { return !cluster.isDead(name) }) {
+		log.Notice("Finished re-replicating artifacts held by %s", name)
+	} else {
+		log.Notice("Node %s has returned, stopping re-replication of its artifacts", name)
+	}
+}
+
+// catchUp sends the artifacts stored here that the given node should hold now that it's returned
+// after failing, since anything stored while it was gone went to its stand-ins instead.
+// It stops early if the node fails again in the meantime.
+func (cluster *Cluster) catchUp(f *failover, name string) {
+	f.running.Lock()
+	defer f.running.Unlock()
+	pending := []pendingReplication{}
+	f.source.ListArtifacts(func(os, arch string, hash []byte, key string) {
+		if target := cluster.returned(name, hash); target != nil {
+			pending = append(pending, pendingReplication{os: os, arch: arch, hash: hash, key: key, targets: []*pb.Node{target}})
+		}
+	})
+	log.Notice("Sending %d sets of artifacts to %s now it's returned", len(pending), name)
+	if cluster.resend(f, pending, func() bool { return cluster.isDead(name) }) {
+		log.Notice("Finished sending artifacts to %s", name)
+	} else {
+		log.Notice("Node %s has failed again, stopping sending it artifacts", name)
+	}
+}
+
+// resend sends the given sets of artifacts to their targets, within the failover's bandwidth.
+// It checks the given function before each one and stops if it returns true, in which case it
+// returns false.
+func (cluster *Cluster) resend(f *failover, pending []pendingReplication, cancelled func() bool) bool {
+	cluster.metrics.failoverRemaining.Add(float64(len(pending)))
+	for i, p := range pending {
+		if cancelled() {
+			cluster.metrics.failoverRemaining.Sub(float64(len(pending) - i))
+			return false
+		}
+		artifacts, err := f.source.LoadArtifacts(p.key)
+		if err != nil {
+			// Most likely it's been cleaned since we listed it.
+			log.Warning("Failed to load %s for re-replication: %s", p.key, err)
+			cluster.metrics.failoverRemaining.Dec()
+			continue
+		}
+		var size int64
+		for _, artifact := range artifacts {
+			size += int64(len(artifact.Body))
+		}
+		expiry := f.source.ArtifactExpiry(p.key)
+		for _, target := range p.targets {
+			if cluster.replicate(target.Name, target.Address, p.os, p.arch, p.hash, false, artifacts, nil, "", cluster.hostname, 0, expiry) {
+				cluster.metrics.failoverArtifacts.Add(float64(len(artifacts)))
+				cluster.metrics.failoverBytes.Add(float64(size))
+			}
+			time.Sleep(throttleDelay(size, f.bandwidth))
+		}
+		cluster.metrics.failoverRemaining.Dec()
+	}
+	return true
+}
+
+// standIns returns the nodes that we should send the artifacts with the given hash to after
+// the given node died, i.e. those that now hold its replica instead. It's empty unless that node
+// was one of their replicas and we're the first surviving one (so they're only sent once).
+func (cluster *Cluster) standIns(name string, hash []byte) []*pb.Node {
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
+	before := map[string]bool{}
+	for n := range cluster.dead {
+		before[n] = n != name
+	}
+	var sender *pb.Node
+	held := false
+	previous := cluster.replicasWith(hash, before)
+	for _, n := range previous {
+		if n.Name == name {
+			held = true
+		} else if sender == nil && !cluster.dead[n.Name] {
+			sender = n
+		}
+	}
+	if !held || sender == nil || cluster.node == nil || sender.Name != cluster.node.Name {
+		return nil
+	}
+	ret := []*pb.Node{}
+	for _, n := range cluster.replicasWith(hash, cluster.dead) {
+		if !containsNode(previous, n) {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// returned returns the given node if it should hold the artifacts with the given hash now it's
+// returned after failing, and we should send them to it because we're the first of the replicas
+// that held them while it was gone (so they're only sent once). Otherwise it returns nil.
+func (cluster *Cluster) returned(name string, hash []byte) *pb.Node {
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
+	before := map[string]bool{name: true}
+	for n := range cluster.dead {
+		before[n] = true
+	}
+	if previous := cluster.replicasWith(hash, before); len(previous) == 0 || cluster.node == nil || previous[0].Name != cluster.node.Name {
+		return nil
+	}
+	for _, n := range cluster.replicasWith(hash, cluster.dead) {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// standIn returns the node that takes over the hash space of the dead node at the given index.
+// It's the next live one after it that isn't already in the given list, or nil if there isn't one.
+// The caller must hold nodeMutex.
+func (cluster *Cluster) standIn(i int, existing []*pb.Node, dead map[string]bool) *pb.Node {
+	for j := 1; j < len(cluster.nodes); j++ {
+		if n := cluster.nodes[(i+j)%len(cluster.nodes)]; n.Name != "" && !dead[n.Name] && !containsNode(existing, n) {
+			return n
+		}
+	}
+	return nil
+}
+
+// containsNode returns true if the given node is in the given list.
+func containsNode(nodes []*pb.Node, node *pb.Node) bool {
+	for _, n := range nodes {
+		if n.Name == node.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// throttleDelay returns how long to wait after sending the given number of bytes to stay within
+// the given bandwidth, in bytes per second.
+func throttleDelay(size, bandwidth int64) time.Duration {
+	if bandwidth <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(bandwidth) * float64(time.Second))
+}
+
+// events receives notifications from memberlist about nodes joining & leaving the cluster.
+type events struct {
+	cluster *Cluster
+}
+
+func (e *events) NotifyJoin(node *memberlist.Node)   { e.cluster.nodeJoined(node.Name) }
+func (e *events) NotifyLeave(node *memberlist.Node)  { e.cluster.nodeLeft(node.Name) }
+func (e *events) NotifyUpdate(node *memberlist.Node) {}
@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// forwardHopsHeader is the metadata key carrying the number of times a request has been forwarded between nodes.
+const forwardHopsHeader = "x-plz-forward-hops"
+
+// maxForwardHops is the most times a request is forwarded. With every node agreeing on who owns
+// what, one is enough; the second allows for nodes briefly disagreeing while membership changes.
+// Anything beyond that means the nodes are misconfigured (e.g. with different replication
+// factors) and we'd otherwise risk them passing requests round in circles.
+const maxForwardHops = 2
+
+// forwardTimeout is the longest we wait for a node we've forwarded a request to.
+const forwardTimeout = 10 * time.Second
+
+// SetForwarding makes this node forward stores and retrieves for artifacts it isn't a replica of
+// to a node that is, so clients can send any request to any node. It should be set before serving.
+func (cluster *Cluster) SetForwarding(enabled bool) {
+	cluster.forwarding = enabled
+}
+
+// ForwardStore forwards a store to one of the replicas for its hash, if forwarding is enabled and
+// we aren't one of them. It returns true if one of them handled it; otherwise (including if they
+// can't be reached) the caller should store it itself, as it would without forwarding.
+func (cluster *Cluster) ForwardStore(ctx context.Context, req *pb.StoreRequest) (*pb.StoreResponse, bool) {
+	owners, hops := cluster.forwardTo(ctx, req.Hash)
+	for _, node := range owners {
+		client, err := cluster.getCacheClient(node.Name, node.Address)
+		if err != nil {
+			log.Error("Failed to get RPC client for %s %s: %s", node.Name, node.Address, err)
+			continue
+		}
+		fctx, cancel := forwardContext(hops)
+		resp, err := client.Store(fctx, req)
+		cancel()
+		if err != nil {
+			log.Warning("Error forwarding store to %s: %s", node.Address, err)
+			cluster.metrics.forwardedRequests.WithLabelValues("store", "failed").Inc()
+			continue
+		}
+		cluster.metrics.forwardedRequests.WithLabelValues("store", "success").Inc()
+		return resp, true
+	}
+	return nil, false
+}
+
+// ForwardRetrieve forwards a retrieve to the replicas for its hash in turn, as for ForwardStore.
+// It returns true if one of them had the artifacts, or if they all answered that they didn't
+// (with the last one's NotFound error); otherwise the caller should carry on as it would without
+// forwarding. Requests are always sent with structured errors so we can tell misses from failures.
+func (cluster *Cluster) ForwardRetrieve(ctx context.Context, req *pb.RetrieveRequest) (*pb.RetrieveResponse, bool, error) {
+	owners, hops := cluster.forwardTo(ctx, req.Hash)
+	if len(owners) == 0 {
+		return nil, false, nil
+	}
+	freq := &pb.RetrieveRequest{Hash: req.Hash, Os: req.Os, Arch: req.Arch, Artifacts: req.Artifacts, StructuredErrors: true}
+	var missed error
+	for _, node := range owners {
+		client, err := cluster.getCacheClient(node.Name, node.Address)
+		if err != nil {
+			log.Error("Failed to get RPC client for %s %s: %s", node.Name, node.Address, err)
+			continue
+		}
+		fctx, cancel := forwardContext(hops)
+		resp, err := client.Retrieve(fctx, freq)
+		cancel()
+		if grpc.Code(err) == codes.NotFound {
+			cluster.metrics.forwardedRequests.WithLabelValues("retrieve", "miss").Inc()
+			missed = err
+			continue
+		} else if err != nil {
+			log.Warning("Error forwarding retrieve to %s: %s", node.Address, err)
+			cluster.metrics.forwardedRequests.WithLabelValues("retrieve", "failed").Inc()
+			continue
+		}
+		cluster.metrics.forwardedRequests.WithLabelValues("retrieve", "success").Inc()
+		return resp, true, nil
+	}
+	return nil, missed != nil, missed
+}
+
+// forwardTo returns the nodes a request for the given hash should be forwarded to, and the number
+// of times it's been forwarded already. There are none if forwarding is disabled, we're one of
+// the replicas for the hash, or it's been forwarded as many times as it can be.
+func (cluster *Cluster) forwardTo(ctx context.Context, hash []byte) ([]*pb.Node, int) {
+	if !cluster.forwarding || cluster.node == nil {
+		return nil, 0
+	}
+	hops := forwardHops(ctx)
+	if hops > 0 {
+		cluster.metrics.forwardHopCounts.Observe(float64(hops))
+	}
+	for _, node := range cluster.replicas(hash) {
+		if node.Name == cluster.node.Name {
+			return nil, hops
+		}
+	}
+	if hops >= maxForwardHops {
+		log.Warning("Not forwarding request for hash %x again, it's already been forwarded %d times; do the nodes agree on the cluster's membership and replication factor?", hash, hops)
+		cluster.metrics.forwardLoops.Inc()
+		return nil, hops
+	}
+	return cluster.peers(hash), hops
+}
+
+// forwardHops returns the number of times the request with the given context has been forwarded.
+func forwardHops(ctx context.Context) int {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0
+	}
+	for _, v := range md[forwardHopsHeader] {
+		if hops, err := strconv.Atoi(v); err == nil {
+			return hops
+		}
+	}
+	return 0
+}
+
+// forwardContext returns the context to forward a request with, given how many times it's been
+// forwarded already. It's independent of the incoming context since the server shares retrieves
+// between concurrent callers, and one of them giving up shouldn't cut it off for the others.
+func forwardContext(hops int) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	md := metadata.Pairs(forwardHopsHeader, strconv.Itoa(hops+1))
+	return metadata.NewOutgoingContext(ctx, md), cancel
+}
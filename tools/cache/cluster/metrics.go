@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clusterMetrics are the metrics describing a cluster's replication, failover and forwarding.
+type clusterMetrics struct {
+	// replicationsInflight is the number of replication requests currently in progress.
+	replicationsInflight prometheus.Gauge
+	// replicationQueuedArtifacts is the number of artifacts that have been stored but not yet replicated.
+	replicationQueuedArtifacts prometheus.Gauge
+	// replicationLatency measures the time from an artifact being stored to its replication completing.
+	replicationLatency prometheus.Histogram
+	// crossZoneFetches is the number of times we've fetched artifacts from a node in another zone.
+	crossZoneFetches prometheus.Counter
+	// failedNodes is the number of nodes whose hash space has been handed over to stand-ins.
+	failedNodes prometheus.Gauge
+	// failoverRemaining is the number of sets of artifacts waiting to be re-replicated after a node failed.
+	failoverRemaining prometheus.Gauge
+	// failoverArtifacts is the number of artifacts we've re-replicated after nodes failed.
+	failoverArtifacts prometheus.Counter
+	// failoverBytes is the total size of the artifacts we've re-replicated after nodes failed.
+	failoverBytes prometheus.Counter
+	// retryQueued is the number of failed replications waiting to be retried.
+	retryQueued prometheus.Gauge
+	// retryAttempts is the number of times we've retried failed replications.
+	retryAttempts prometheus.Counter
+	// retryDeadLetters is the number of failed replications we've given up on.
+	retryDeadLetters prometheus.Counter
+	// verificationFailures is the number of verified replications that failed.
+	verificationFailures prometheus.Counter
+	// underReplicatedArtifacts is the number of sets of artifacts with fewer live replicas than they should have.
+	underReplicatedArtifacts prometheus.Gauge
+	// crossZoneFetchBytes is the total size of the artifacts we've fetched from nodes in other zones.
+	crossZoneFetchBytes prometheus.Counter
+	// forwardedRequests is the number of requests we've forwarded to the nodes that hold their artifacts.
+	forwardedRequests *prometheus.CounterVec
+	// forwardHopCounts is the number of times the forwarded requests we've received had been forwarded.
+	forwardHopCounts prometheus.Histogram
+	// forwardLoops is the number of requests we didn't forward because they'd been forwarded too many times already.
+	forwardLoops prometheus.Counter
+}
+
+// newClusterMetrics creates a new set of cluster metrics.
+func newClusterMetrics() *clusterMetrics {
+	return &clusterMetrics{
+		replicationsInflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "replications_inflight",
+			Help:      "Number of replication requests to other nodes that are currently in progress.",
+		}),
+		replicationQueuedArtifacts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "replication_queued_artifacts",
+			Help:      "Number of artifacts that have been stored on this node but not yet replicated to another.",
+		}),
+		replicationLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "plz_cache",
+			Name:      "replication_latency_seconds",
+			Help:      "Time taken from an artifact being stored to its replication to another node completing.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		}),
+		crossZoneFetches: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "cross_zone_fetches_total",
+			Help:      "Number of times artifacts were fetched from a node in another zone.",
+		}),
+		failedNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "failover_failed_nodes",
+			Help:      "Number of nodes that have failed and whose hash space has been handed over to others.",
+		}),
+		failoverRemaining: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "failover_remaining_artifacts",
+			Help:      "Number of sets of artifacts still to be re-replicated from this node after another one failed.",
+		}),
+		failoverArtifacts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "failover_artifacts_total",
+			Help:      "Number of artifacts re-replicated from this node after another one failed.",
+		}),
+		failoverBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "failover_bytes_total",
+			Help:      "Total size of the artifacts re-replicated from this node after another one failed.",
+		}),
+		retryQueued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "replication_retry_queued",
+			Help:      "Number of failed replications to other nodes that are queued to be retried.",
+		}),
+		retryAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "replication_retries_total",
+			Help:      "Number of times failed replications to other nodes have been retried.",
+		}),
+		retryDeadLetters: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "replication_dead_letters_total",
+			Help:      "Number of failed replications that were given up on, either because they ran out of retries or the retry queue was full.",
+		}),
+		verificationFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "replication_verification_failures_total",
+			Help:      "Number of stores that asked for their replication to be verified where it couldn't be, because a replica didn't store them or had different contents afterwards.",
+		}),
+		underReplicatedArtifacts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "under_replicated_artifacts",
+			Help:      "Number of sets of artifacts that this node is the first replica of, and that have fewer live replicas than the replication factor.",
+		}),
+		crossZoneFetchBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "cross_zone_fetch_bytes_total",
+			Help:      "Total size of the artifacts fetched from nodes in other zones.",
+		}),
+		forwardedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "forwarded_requests_total",
+			Help:      "Number of stores & retrieves forwarded to a replica of their artifacts because this node isn't one, by method and result.",
+		}, []string{"method", "result"}),
+		forwardHopCounts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "plz_cache",
+			Name:      "forward_hops",
+			Help:      "Number of times each forwarded request this node received had been forwarded. Anything above 1 means nodes disagree on who owns what.",
+			Buckets:   prometheus.LinearBuckets(1, 1, maxForwardHops),
+		}),
+		forwardLoops: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "forward_loops_total",
+			Help:      "Number of requests that weren't forwarded again because they'd reached the maximum number of hops, which means the cluster is misconfigured.",
+		}),
+	}
+}
+
+// collectors returns all the metrics.
+func (m *clusterMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.replicationsInflight,
+		m.replicationQueuedArtifacts,
+		m.replicationLatency,
+		m.crossZoneFetches,
+		m.failedNodes,
+		m.failoverRemaining,
+		m.failoverArtifacts,
+		m.failoverBytes,
+		m.retryQueued,
+		m.retryAttempts,
+		m.retryDeadLetters,
+		m.verificationFailures,
+		m.underReplicatedArtifacts,
+		m.crossZoneFetchBytes,
+		m.forwardedRequests,
+		m.forwardHopCounts,
+		m.forwardLoops,
+	}
+}
+
+// RegisterMetrics registers the cluster's metrics on the given registry.
+func (cluster *Cluster) RegisterMetrics(registry prometheus.Registerer) {
+	registry.MustRegister(cluster.metrics.collectors()...)
+}
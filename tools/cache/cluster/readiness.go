@@ -0,0 +1,108 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// An ArtifactSampler provides a sample of the files stored on this node, so we can check that
+// the other replicas of them are healthy before declaring ourselves ready.
+type ArtifactSampler interface {
+	// SampleArtifacts calls f with the hash and path (relative to the cache directory) of up
+	// to n randomly chosen files stored on this node.
+	SampleArtifacts(n int, f func(hash []byte, path string))
+}
+
+// Starting returns true if this node is still starting up (see SetStarting).
+func (cluster *Cluster) Starting() bool {
+	return atomic.LoadInt32(&cluster.delegate.starting) != 0
+}
+
+// NotReadyReason returns why this node shouldn't receive traffic yet, or the empty string if it
+// should. It isn't ready while it's starting (see SetStarting), nor, if waitForSize is true, until
+// it's seen the cluster at its expected size. Once it has it stays ready if nodes go away, since
+// otherwise losing one would take every node out of service; see ReadOnlyReason for that.
+func (cluster *Cluster) NotReadyReason(waitForSize bool) string {
+	if cluster.Starting() {
+		return "still starting up in the cluster"
+	} else if !waitForSize || atomic.LoadInt32(&cluster.reachedSize) != 0 {
+		return ""
+	} else if n, size := cluster.MemberCount(); n < size {
+		return fmt.Sprintf("cluster has %d of %d expected nodes", n, size)
+	}
+	atomic.StoreInt32(&cluster.reachedSize, 1)
+	return ""
+}
+
+// CheckReadiness returns an error if this node isn't yet safe to accept traffic: if it can't
+// reach a quorum of the cluster's expected size (counting itself) over RPC, or if any of the
+// other replicas of up to the given number of sampled artifacts don't respond. This is stricter
+// than just having joined the gossip group, which says nothing about whether our stores
+// can actually be replicated.
+// Samples that no other replica holds are only logged, since they may have been evicted there, but
+// if none of them are held anywhere else that's an error.
+func (cluster *Cluster) CheckReadiness(sampler ArtifactSampler, samples int, timeout time.Duration) error {
+	stats, unreachable := cluster.Stats(timeout)
+	if reachable := len(stats) + 1; cluster.size > 1 && 2*reachable <= cluster.size {
+		return fmt.Errorf("can only reach %d of %d nodes, unreachable: [%s]", reachable, cluster.size, strings.Join(unreachable, ", "))
+	}
+	if sampler == nil || samples <= 0 {
+		return nil
+	}
+	var err error
+	checked := 0
+	found := 0
+	sampler.SampleArtifacts(samples, func(hash []byte, path string) {
+		if err != nil {
+			return
+		}
+		held, checkErr := cluster.checkReplicas(hash, path, timeout)
+		if checkErr != nil {
+			err = checkErr
+		} else if held >= 0 {
+			checked++
+			if held > 0 {
+				found++
+			} else {
+				log.Warning("No other replica holds %s", path)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	} else if checked > 0 && found == 0 {
+		return fmt.Errorf("none of %d sampled artifacts are held by any other replica", checked)
+	}
+	return nil
+}
+
+// checkReplicas asks the other replicas for the given hash whether they have the given file.
+// It returns the number that do, or -1 if there are no others to ask, and an error if any of
+// them don't respond.
+func (cluster *Cluster) checkReplicas(hash []byte, path string, timeout time.Duration) (int, error) {
+	peers := cluster.peers(hash)
+	if len(peers) == 0 {
+		return -1, nil
+	}
+	held := 0
+	for _, node := range peers {
+		client, err := cluster.getRPCClient(node.Name, node.Address)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get RPC client for %s: %s", node.Name, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp, err := client.Checksum(ctx, &pb.ChecksumRequest{Paths: []string{path}})
+		cancel()
+		if err != nil {
+			return 0, fmt.Errorf("replica %s didn't respond about %s: %s", node.Name, path, err)
+		} else if len(resp.Files) > 0 {
+			held++
+		}
+	}
+	return held, nil
+}
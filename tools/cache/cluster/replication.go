@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	pb "cache/proto/rpc_cache"
+	"cache/tools"
+)
+
+// defaultReplicationFactor is the number of nodes each artifact is stored on unless set otherwise.
+const defaultReplicationFactor = 2
+
+// SetReplicationFactor sets the number of nodes each artifact is stored on (not counting the extra
+// replicas for other zones). It must be the same on every node, and should be set before serving.
+func (cluster *Cluster) SetReplicationFactor(n int) {
+	cluster.nodeMutex.Lock()
+	defer cluster.nodeMutex.Unlock()
+	cluster.replicationFactor = n
+}
+
+// factor returns the replication factor.
+// The caller must hold nodeMutex.
+func (cluster *Cluster) factor() int {
+	if cluster.replicationFactor <= 0 {
+		return defaultReplicationFactor
+	}
+	return cluster.replicationFactor
+}
+
+// MonitorReplication periodically counts the sets of artifacts stored here that have fewer live
+// replicas than they should, and reports them in the under_replicated_artifacts metric. Each set
+// is only counted by the first of its replicas, so the metric can be summed across the cluster.
+// Artifacts sent to stand-ins are counted as replicated once those are live, whether or not
+// they've arrived yet. It never returns so is usually called in a goroutine.
+func (cluster *Cluster) MonitorReplication(interval time.Duration, source ArtifactSource) {
+	for range time.NewTicker(interval).C {
+		live := map[string]bool{}
+		for _, m := range cluster.list.Members() {
+			live[m.Name] = true
+		}
+		cluster.metrics.underReplicatedArtifacts.Set(float64(cluster.underReplicated(source, live)))
+	}
+}
+
+// underReplicated returns the number of sets of artifacts from the given source that we're the
+// first replica of, and that have fewer of the given live nodes among their replicas than they should.
+func (cluster *Cluster) underReplicated(source ArtifactSource, live map[string]bool) int {
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
+	want := cluster.factor()
+	if cluster.size > 0 && cluster.size < want {
+		want = cluster.size
+	}
+	count := 0
+	source.ListArtifacts(func(os, arch string, hash []byte, key string) {
+		replicas := cluster.replicasWith(hash, cluster.dead)
+		if len(replicas) > want {
+			replicas = replicas[:want] // Zone replicas don't count.
+		}
+		n := 0
+		first := ""
+		for _, r := range replicas {
+			if live[r.Name] {
+				if n++; first == "" {
+					first = r.Name
+				}
+			}
+		}
+		if n < want && cluster.node != nil && first == cluster.node.Name {
+			count++
+		}
+	})
+	return count
+}
+
+// An ownership describes which nodes own which parts of the hash space, for debugging.
+type ownership struct {
+	ReplicationFactor int          `json:"replication_factor"`
+	Nodes             []ownedRange `json:"nodes"`
+	// Hash, Points and Replicas are only set when asked about a particular hash.
+	Hash     string   `json:"hash,omitempty"`
+	Points   []uint32 `json:"points,omitempty"`
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// An ownedRange is the part of the hash space owned by one node.
+type ownedRange struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	HashBegin uint32 `json:"hash_begin"`
+	HashEnd   uint32 `json:"hash_end"`
+	Zone      string `json:"zone,omitempty"`
+	Live      bool   `json:"live"`
+	// StandIn is the node that's taken over this one's hash space, if it's been handed over.
+	StandIn string `json:"stand_in,omitempty"`
+}
+
+// OwnershipHandler returns an HTTP handler that describes which nodes own which parts of the hash
+// space, as JSON. Given a hash query parameter (URL-safe base64, as in artifact paths) it also
+// shows that hash's points in the hash space and the nodes that hold its artifacts.
+func (cluster *Cluster) OwnershipHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var hash []byte
+		if h := req.URL.Query().Get("hash"); h != "" {
+			b, err := base64.RawURLEncoding.DecodeString(h)
+			if err != nil || len(b) < 4 {
+				http.Error(w, "Invalid hash, must be URL-safe base64 of at least 4 bytes", http.StatusBadRequest)
+				return
+			}
+			hash = b
+		}
+		live := map[string]bool{}
+		for _, m := range cluster.list.Members() {
+			live[m.Name] = true
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(cluster.describeOwnership(hash, live))
+	})
+}
+
+// describeOwnership returns the current ownership of the hash space given the set of live nodes,
+// and that of the given hash if it's not nil.
+func (cluster *Cluster) describeOwnership(hash []byte, live map[string]bool) *ownership {
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
+	ret := &ownership{ReplicationFactor: cluster.factor(), Nodes: []ownedRange{}}
+	for i, n := range cluster.nodes {
+		r := ownedRange{
+			Name:      n.Name,
+			Address:   n.Address,
+			HashBegin: n.HashBegin,
+			HashEnd:   n.HashEnd,
+			Zone:      n.Zone,
+			Live:      live[n.Name],
+		}
+		if cluster.dead[n.Name] {
+			if standIn := cluster.standIn(i, nil, cluster.dead); standIn != nil {
+				r.StandIn = standIn.Name
+			}
+		}
+		ret.Nodes = append(ret.Nodes, r)
+	}
+	if hash != nil {
+		ret.Hash = base64.RawURLEncoding.EncodeToString(hash)
+		for i := 0; i < ret.ReplicationFactor; i++ {
+			ret.Points = append(ret.Points, tools.ReplicaHash(hash, i))
+		}
+		ret.Replicas = nodeNames(cluster.replicasWith(hash, cluster.dead))
+	}
+	return ret
+}
+
+// nodeNames returns the names of the given nodes.
+func nodeNames(nodes []*pb.Node) []string {
+	ret := make([]string, len(nodes))
+	for i, n := range nodes {
+		ret[i] = n.Name
+	}
+	return ret
+}
@@ -0,0 +1,77 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+)
+
+// RequestRestart returns true if it's safe for this node to restart now, in which case it takes
+// the restart token, or false and the reason if it isn't. It's safe if every other node the
+// cluster is expected to have is a healthy member of it, i.e. none are missing, in maintenance,
+// still starting up (e.g. rejoining after their own restart) or holding the token themselves, so
+// restarting us never leaves both replicas of anything unavailable.
+// The token is advertised to other nodes so they're refused while we hold it. It's released when
+// we leave the cluster (so when we restart), by ReleaseRestart, or after the given TTL in case
+// we don't restart after all.
+// Like StartClean this relies on gossip, so after taking the token we wait briefly to see if
+// another node took it at the same time; if one did, whichever has the lowest name keeps it.
+func (cluster *Cluster) RequestRestart(ttl time.Duration) (bool, string) {
+	if safe, reason := cluster.safeToRestart(); !safe {
+		return false, reason
+	}
+	cluster.setFlag(&cluster.delegate.restarting, true)
+	time.Sleep(settleDelay)
+	for _, m := range cluster.list.Members() {
+		if m.Name < cluster.list.LocalNode().Name && cluster.hasFlag(m, restartingFlag) {
+			cluster.ReleaseRestart()
+			return false, fmt.Sprintf("%s is restarting", m.Name)
+		}
+	}
+	cluster.restartMutex.Lock()
+	defer cluster.restartMutex.Unlock()
+	if cluster.restartTimer != nil {
+		cluster.restartTimer.Stop()
+	}
+	cluster.restartTimer = time.AfterFunc(ttl, func() {
+		log.Warning("Restart token has expired without us restarting, releasing it")
+		cluster.ReleaseRestart()
+	})
+	log.Notice("Took the restart token, safe to restart")
+	return true, ""
+}
+
+// ReleaseRestart releases the restart token if we hold it.
+func (cluster *Cluster) ReleaseRestart() {
+	cluster.restartMutex.Lock()
+	defer cluster.restartMutex.Unlock()
+	if cluster.restartTimer != nil {
+		cluster.restartTimer.Stop()
+		cluster.restartTimer = nil
+	}
+	cluster.setFlag(&cluster.delegate.restarting, false)
+}
+
+// safeToRestart returns true if it's safe for this node to restart now, ignoring any restart
+// token it holds itself, or false and the reason if it isn't (see RequestRestart).
+func (cluster *Cluster) safeToRestart() (bool, string) {
+	if cluster.size <= 1 {
+		return true, ""
+	}
+	healthy := 0
+	for _, m := range cluster.list.Members() {
+		if m.Name == cluster.list.LocalNode().Name {
+			continue
+		} else if cluster.hasFlag(m, restartingFlag) {
+			return false, fmt.Sprintf("%s is restarting", m.Name)
+		} else if cluster.hasFlag(m, startingFlag) {
+			return false, fmt.Sprintf("%s is still starting", m.Name)
+		} else if cluster.hasFlag(m, maintenanceFlag) {
+			return false, fmt.Sprintf("%s is in maintenance", m.Name)
+		}
+		healthy++
+	}
+	if healthy < cluster.size-1 {
+		return false, fmt.Sprintf("only %d of the other %d nodes are healthy", healthy, cluster.size-1)
+	}
+	return true, ""
+}
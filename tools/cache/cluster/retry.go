@@ -0,0 +1,292 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// retryInitialBackoff is how long we wait before retrying a failed replication for the first time.
+// Each further retry waits twice as long as the last, up to retryMaxBackoff.
+const retryInitialBackoff = 5 * time.Second
+
+// retryMaxBackoff is the longest we wait between retries of a failed replication.
+const retryMaxBackoff = 10 * time.Minute
+
+// A retryQueue holds replications that have failed so we can try them again later.
+//
+// Each one is written to a file in its directory, named for its sequence number, the number of
+// times it's been retried and the node it's going to. The files are loaded again at startup so
+// the queue survives restarts; anything loaded is retried straight away.
+type retryQueue struct {
+	// dir is the directory the queue is persisted in.
+	dir string
+	// maxSize is the most replications we'll hold at once. Any more that fail are dropped.
+	maxSize int
+	// maxAttempts is the number of times we retry each one before giving up on it.
+	maxAttempts int
+	// entries are the replications waiting to be retried, not including any currently in progress.
+	entries []*retryEntry
+	// size is the number of replications held, including any currently in progress.
+	size int
+	// next is the sequence number of the next replication to be queued.
+	next int64
+	// mutex protects entries, size and next.
+	mutex sync.Mutex
+	// wake is signalled when a replication is queued.
+	wake chan struct{}
+	// metrics are those of the cluster the queue belongs to.
+	metrics *clusterMetrics
+}
+
+// A retryEntry is a single replication in a retryQueue.
+type retryEntry struct {
+	seq      int64
+	node     string
+	attempts int
+	due      time.Time
+}
+
+// filename returns the name of the file this entry is persisted in.
+func (e *retryEntry) filename() string {
+	return fmt.Sprintf("%d.%d.%s", e.seq, e.attempts, e.node)
+}
+
+// parseRetryEntry parses an entry from the name of the file it's persisted in.
+func parseRetryEntry(filename string) (*retryEntry, error) {
+	parts := strings.SplitN(filename, ".", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return nil, fmt.Errorf("unknown file in replication retry queue: %s", filename)
+	}
+	seq, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &retryEntry{seq: seq, attempts: attempts, node: parts[2]}, nil
+}
+
+// EnableRetries makes this node retry replications to other nodes that fail, instead of leaving
+// them for the other node to find later. Up to maxSize of them are queued in the given directory,
+// and each is retried up to maxAttempts times before being given up on.
+// Any left in the directory from a previous run are loaded and retried immediately.
+func (cluster *Cluster) EnableRetries(dir string, maxSize, maxAttempts int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	q := &retryQueue{dir: dir, maxSize: maxSize, maxAttempts: maxAttempts, wake: make(chan struct{}, 1), metrics: cluster.metrics}
+	now := time.Now()
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			// Left over from being interrupted while writing it.
+			os.Remove(path.Join(dir, info.Name()))
+			continue
+		}
+		e, err := parseRetryEntry(info.Name())
+		if err != nil {
+			log.Warning("%s", err)
+			continue
+		}
+		e.due = now
+		q.entries = append(q.entries, e)
+		if e.seq >= q.next {
+			q.next = e.seq + 1
+		}
+	}
+	sort.Slice(q.entries, func(i, j int) bool { return q.entries[i].seq < q.entries[j].seq })
+	q.size = len(q.entries)
+	cluster.metrics.retryQueued.Add(float64(q.size))
+	if q.size > 0 {
+		log.Notice("Loaded %d failed replications to retry", q.size)
+	}
+	cluster.nodeMutex.Lock()
+	cluster.retries = q
+	cluster.nodeMutex.Unlock()
+	go cluster.retryLoop(q)
+	return nil
+}
+
+// retryLater queues the given replication to the given node to be retried, if retries are enabled.
+func (cluster *Cluster) retryLater(name string, req *pb.ReplicateRequest) {
+	cluster.nodeMutex.RLock()
+	q := cluster.retries
+	cluster.nodeMutex.RUnlock()
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.size >= q.maxSize {
+		log.Warning("Replication retry queue is full, dropping replication to %s", name)
+		cluster.metrics.retryDeadLetters.Inc()
+		return
+	}
+	e := &retryEntry{seq: q.next, node: name, due: time.Now().Add(retryBackoff(0))}
+	q.next++
+	if err := q.write(e, req); err != nil {
+		log.Error("Failed to queue replication to %s for retry: %s", name, err)
+		cluster.metrics.retryDeadLetters.Inc()
+		return
+	}
+	q.entries = append(q.entries, e)
+	q.size++
+	cluster.metrics.retryQueued.Inc()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write persists the given entry & its request to disk.
+func (q *retryQueue) write(e *retryEntry, req *pb.ReplicateRequest) error {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	filename := path.Join(q.dir, e.filename())
+	if err := ioutil.WriteFile(filename+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// nextDue removes & returns the next entry that's due to be retried. If none are, it returns nil
+// and how long to wait before checking again.
+func (q *retryQueue) nextDue() (*retryEntry, time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.entries) == 0 {
+		return nil, retryMaxBackoff
+	}
+	first := 0
+	for i, e := range q.entries {
+		if e.due.Before(q.entries[first].due) {
+			first = i
+		}
+	}
+	if wait := time.Until(q.entries[first].due); wait > 0 {
+		return nil, wait
+	}
+	e := q.entries[first]
+	q.entries = append(q.entries[:first], q.entries[first+1:]...)
+	return e, 0
+}
+
+// requeue puts an entry back in the queue after it's been tried.
+func (q *retryQueue) requeue(e *retryEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.entries = append(q.entries, e)
+}
+
+// remove removes a tried entry from the queue entirely.
+func (q *retryQueue) remove(e *retryEntry) {
+	if err := os.Remove(path.Join(q.dir, e.filename())); err != nil {
+		log.Warning("Failed to remove replication from retry queue: %s", err)
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.size--
+	q.metrics.retryQueued.Dec()
+}
+
+// retryLoop retries the queued replications as they become due. It never returns.
+func (cluster *Cluster) retryLoop(q *retryQueue) {
+	for {
+		if e, wait := q.nextDue(); e != nil {
+			cluster.retry(q, e)
+		} else {
+			select {
+			case <-q.wake:
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// retry makes another attempt at a single queued replication.
+func (cluster *Cluster) retry(q *retryQueue, e *retryEntry) {
+	address := cluster.nodeAddress(e.node)
+	if address == "" {
+		// Most likely we haven't rejoined the cluster yet after restarting. Doesn't count as an attempt.
+		e.due = time.Now().Add(retryBackoff(e.attempts))
+		q.requeue(e)
+		return
+	} else if cluster.isDead(e.node) {
+		log.Info("Not retrying replication to %s, it's failed and been replaced", e.node)
+		q.remove(e)
+		return
+	}
+	b, err := ioutil.ReadFile(path.Join(q.dir, e.filename()))
+	req := &pb.ReplicateRequest{}
+	if err == nil {
+		err = proto.Unmarshal(b, req)
+	}
+	if err != nil {
+		log.Error("Failed to load replication to %s for retry: %s", e.node, err)
+		cluster.metrics.retryDeadLetters.Inc()
+		q.remove(e)
+		return
+	}
+	cluster.metrics.retryAttempts.Inc()
+	if cluster.send(e.node, address, req) {
+		log.Info("Retried replication to %s successfully", e.node)
+		q.remove(e)
+		return
+	}
+	if e.attempts+1 >= q.maxAttempts {
+		log.Warning("Giving up on replication to %s after %d retries", e.node, e.attempts+1)
+		cluster.metrics.retryDeadLetters.Inc()
+		q.remove(e)
+		return
+	}
+	old := path.Join(q.dir, e.filename())
+	e.attempts++
+	if err := os.Rename(old, path.Join(q.dir, e.filename())); err != nil {
+		log.Warning("Failed to update replication in retry queue: %s", err)
+		e.attempts--
+	}
+	e.due = time.Now().Add(retryBackoff(e.attempts))
+	q.requeue(e)
+}
+
+// nodeAddress returns the address of the node with the given name, or the empty string if
+// we don't know of it.
+func (cluster *Cluster) nodeAddress(name string) string {
+	cluster.nodeMutex.RLock()
+	defer cluster.nodeMutex.RUnlock()
+	for _, n := range cluster.nodes {
+		if n.Name == name {
+			return n.Address
+		}
+	}
+	return ""
+}
+
+// retryBackoff returns how long to wait before retrying a replication that's already been
+// retried the given number of times.
+func retryBackoff(attempts int) time.Duration {
+	if attempts >= 16 {
+		return retryMaxBackoff // Don't overflow below.
+	} else if backoff := retryInitialBackoff << uint(attempts); backoff < retryMaxBackoff {
+		return backoff
+	}
+	return retryMaxBackoff
+}
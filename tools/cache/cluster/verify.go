@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// verifyTimeout is the longest we wait for a replica to return the checksums of the artifacts we've sent it.
+const verifyTimeout = 30 * time.Second
+
+// ReplicateVerified is like ReplicateArtifacts, but it doesn't return until the artifacts have been
+// replicated, and it then reads back their checksums from each of the other nodes that should hold
+// them to check the artifacts reached them intact. The given checksums are the hex-encoded sha256
+// checksums of the stored files, keyed by their paths relative to the cache directory (as the
+// Checksum RPC returns them). It returns an error if there are no other nodes to replicate to, or
+// any of them fail to store the artifacts or don't have matching checksums for every file.
+// Any that fail to store them are retried later, as they would be by ReplicateArtifacts.
+func (cluster *Cluster) ReplicateVerified(req *pb.StoreRequest, checksums map[string]string) error {
+	start := time.Now()
+	defer func() { cluster.metrics.replicationLatency.Observe(time.Since(start).Seconds()) }()
+	peers := cluster.peers(req.Hash)
+	if len(peers) == 0 {
+		cluster.metrics.verificationFailures.Inc()
+		return fmt.Errorf("there are no other replicas to verify the artifacts on")
+	}
+	if err := cluster.replicateVerified(peers, cluster.replicateRequest(req), checksums); err != nil {
+		cluster.metrics.verificationFailures.Inc()
+		return err
+	}
+	return nil
+}
+
+// replicateVerified replicates the given request to each of the given nodes and checks their checksums.
+func (cluster *Cluster) replicateVerified(peers []*pb.Node, req *pb.ReplicateRequest, checksums map[string]string) error {
+	paths := make([]string, 0, len(checksums))
+	for p := range checksums {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, node := range peers {
+		log.Info("Replicating artifact to node %s and verifying it", node.Address)
+		if !cluster.send(node.Name, node.Address, req) {
+			cluster.retryLater(node.Name, req)
+			return fmt.Errorf("failed to replicate to %s", node.Name)
+		}
+		client, err := cluster.getRPCClient(node.Name, node.Address)
+		if err != nil {
+			return fmt.Errorf("failed to get RPC client for %s: %s", node.Name, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+		resp, err := client.Checksum(ctx, &pb.ChecksumRequest{Paths: paths})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to read back checksums from %s: %s", node.Name, err)
+		}
+		held := make(map[string]string, len(resp.Files))
+		for _, f := range resp.Files {
+			held[f.Path] = f.Sha256
+		}
+		for _, p := range paths {
+			if sum, present := held[p]; !present {
+				return fmt.Errorf("%s doesn't have %s after replicating it", node.Name, p)
+			} else if sum != checksums[p] {
+				return fmt.Errorf("%s has a different checksum for %s (%s, expected %s)", node.Name, p, sum, checksums[p])
+			}
+		}
+	}
+	return nil
+}
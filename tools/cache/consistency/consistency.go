@@ -0,0 +1,172 @@
+// Package consistency implements checks that the nodes of a cache cluster agree with one another
+// about the contents of the files they store.
+//
+// Each artifact is stored on two nodes; if they have different contents for it then clients get
+// different results depending on which one they ask, which is rather hard to notice otherwise.
+package consistency
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/op/go-logging.v1"
+
+	pb "cache/proto/rpc_cache"
+)
+
+var log = logging.MustGetLogger("consistency")
+
+// A FileVersion describes the contents of a file as stored on one node.
+type FileVersion struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// A FileReport describes what each node has stored for a single file.
+type FileReport struct {
+	Path string `json:"path"`
+	// Nodes maps the name of each node that has the file to what it has stored.
+	Nodes map[string]FileVersion `json:"nodes"`
+	// True if the nodes have stored different contents for it.
+	Divergent bool `json:"divergent"`
+}
+
+// A Report is the result of a consistency check.
+type Report struct {
+	// Number of files checked.
+	Checked int `json:"checked"`
+	// Number of those that the nodes disagreed about.
+	Divergent int `json:"divergent"`
+	// Fraction of the checked files that the nodes disagreed about.
+	DivergenceRate float64 `json:"divergence_rate"`
+	// The files that were explicitly requested, and any others that were divergent.
+	Files []*FileReport `json:"files"`
+	// Names of any nodes that couldn't be contacted. Their contents aren't included above.
+	Unreachable []string `json:"unreachable,omitempty"`
+}
+
+// Run checks the given paths on each of the given nodes, along with a sample of up to sample
+// other files from across the cluster, and reports any that the nodes disagree about.
+// Paths are relative to the cache directory, e.g. linux_amd64/src/core/core/<hash>.
+func Run(clients map[string]pb.RpcServerClient, paths []string, sample int, timeout time.Duration) *Report {
+	report := &Report{Files: []*FileReport{}}
+	unreachable := map[string]bool{}
+	for _, file := range check(clients, paths, timeout, unreachable) {
+		report.add(file, true)
+	}
+	if sample > 0 {
+		for _, file := range check(clients, samplePaths(clients, sample, timeout, unreachable), timeout, unreachable) {
+			report.add(file, false)
+		}
+	}
+	if report.Checked > 0 {
+		report.DivergenceRate = float64(report.Divergent) / float64(report.Checked)
+	}
+	for name := range unreachable {
+		report.Unreachable = append(report.Unreachable, name)
+	}
+	sort.Strings(report.Unreachable)
+	return report
+}
+
+// add adds a file to this report. It's only listed in it if requested or if it's divergent.
+func (report *Report) add(file *FileReport, list bool) {
+	report.Checked++
+	if file.Divergent {
+		report.Divergent++
+	}
+	if list || file.Divergent {
+		report.Files = append(report.Files, file)
+	}
+}
+
+// samplePaths asks each node for a random sample of its files, and returns up to n of them in total.
+func samplePaths(clients map[string]pb.RpcServerClient, n int, timeout time.Duration, unreachable map[string]bool) []string {
+	perNode := n / len(clients)
+	if perNode == 0 {
+		perNode = 1
+	}
+	seen := map[string]bool{}
+	paths := []string{}
+	forEachNode(clients, timeout, unreachable, func(ctx context.Context, name string, client pb.RpcServerClient) (func(), error) {
+		resp, err := client.Sample(ctx, &pb.SampleRequest{Count: int32(perNode)})
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			for _, p := range resp.Paths {
+				if !seen[p] && len(paths) < n {
+					seen[p] = true
+					paths = append(paths, p)
+				}
+			}
+		}, nil
+	})
+	sort.Strings(paths)
+	return paths
+}
+
+// check fetches checksums for the given paths from all nodes and compares them.
+func check(clients map[string]pb.RpcServerClient, paths []string, timeout time.Duration, unreachable map[string]bool) []*FileReport {
+	if len(paths) == 0 {
+		return nil
+	}
+	files := map[string]*FileReport{}
+	forEachNode(clients, timeout, unreachable, func(ctx context.Context, name string, client pb.RpcServerClient) (func(), error) {
+		resp, err := client.Checksum(ctx, &pb.ChecksumRequest{Paths: paths})
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			for _, f := range resp.Files {
+				file, present := files[f.Path]
+				if !present {
+					file = &FileReport{Path: f.Path, Nodes: map[string]FileVersion{}}
+					files[f.Path] = file
+				}
+				file.Nodes[name] = FileVersion{Size: f.Size, Sha256: f.Sha256}
+			}
+		}, nil
+	})
+	ret := make([]*FileReport, 0, len(files))
+	for _, file := range files {
+		for _, version := range file.Nodes {
+			for _, other := range file.Nodes {
+				if version != other {
+					file.Divergent = true
+				}
+			}
+		}
+		ret = append(ret, file)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret
+}
+
+// forEachNode calls f concurrently for each node. f returns a function that's called to merge its
+// results, which is done under a lock so it needn't be threadsafe. Nodes that fail are recorded
+// as unreachable.
+func forEachNode(clients map[string]pb.RpcServerClient, timeout time.Duration, unreachable map[string]bool, f func(context.Context, string, pb.RpcServerClient) (func(), error)) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for name, client := range clients {
+		wg.Add(1)
+		go func(name string, client pb.RpcServerClient) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			merge, err := f(ctx, name, client)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Warning("Failed to contact %s: %s", name, err)
+				unreachable[name] = true
+			} else {
+				merge()
+			}
+		}(name, client)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,87 @@
+package consistency
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// A fakeNode implements the node-to-node RPCs we use, returning a fixed set of checksums.
+type fakeNode struct {
+	pb.RpcServerClient
+	files map[string]*pb.FileChecksum
+	fail  bool
+}
+
+func (n *fakeNode) Checksum(ctx context.Context, req *pb.ChecksumRequest, opts ...grpc.CallOption) (*pb.ChecksumResponse, error) {
+	if n.fail {
+		return nil, fmt.Errorf("unreachable")
+	}
+	resp := &pb.ChecksumResponse{}
+	for _, p := range req.Paths {
+		if f, present := n.files[p]; present {
+			resp.Files = append(resp.Files, f)
+		}
+	}
+	return resp, nil
+}
+
+func (n *fakeNode) Sample(ctx context.Context, req *pb.SampleRequest, opts ...grpc.CallOption) (*pb.SampleResponse, error) {
+	if n.fail {
+		return nil, fmt.Errorf("unreachable")
+	}
+	resp := &pb.SampleResponse{}
+	for p := range n.files {
+		if len(resp.Paths) < int(req.Count) {
+			resp.Paths = append(resp.Paths, p)
+		}
+	}
+	return resp, nil
+}
+
+func newFakeNode(files ...*pb.FileChecksum) *fakeNode {
+	n := &fakeNode{files: map[string]*pb.FileChecksum{}}
+	for _, f := range files {
+		n.files[f.Path] = f
+	}
+	return n
+}
+
+func TestRunConsistent(t *testing.T) {
+	clients := map[string]pb.RpcServerClient{
+		"node1": newFakeNode(&pb.FileChecksum{Path: "a", Size: 4, Sha256: "abc"}),
+		"node2": newFakeNode(&pb.FileChecksum{Path: "a", Size: 4, Sha256: "abc"}),
+		"node3": newFakeNode(),
+	}
+	report := Run(clients, []string{"a"}, 0, time.Second)
+	assert.Equal(t, 1, report.Checked)
+	assert.Equal(t, 0, report.Divergent)
+	if assert.Equal(t, 1, len(report.Files)) {
+		assert.False(t, report.Files[0].Divergent)
+		assert.Equal(t, 2, len(report.Files[0].Nodes), "Nodes that don't have it aren't listed")
+	}
+}
+
+func TestRunDivergent(t *testing.T) {
+	clients := map[string]pb.RpcServerClient{
+		"node1": newFakeNode(&pb.FileChecksum{Path: "a", Size: 4, Sha256: "abc"}, &pb.FileChecksum{Path: "b", Size: 4, Sha256: "def"}),
+		"node2": newFakeNode(&pb.FileChecksum{Path: "a", Size: 4, Sha256: "xyz"}, &pb.FileChecksum{Path: "b", Size: 4, Sha256: "def"}),
+		"node3": &fakeNode{fail: true},
+	}
+	report := Run(clients, nil, 10, time.Second)
+	assert.Equal(t, 2, report.Checked)
+	assert.Equal(t, 1, report.Divergent)
+	assert.Equal(t, 0.5, report.DivergenceRate)
+	// Only the divergent file is listed since neither was explicitly asked for.
+	if assert.Equal(t, 1, len(report.Files)) {
+		assert.Equal(t, "a", report.Files[0].Path)
+		assert.True(t, report.Files[0].Divergent)
+	}
+	assert.Equal(t, []string{"node3"}, report.Unreachable)
+}
@@ -0,0 +1,67 @@
+// Package dial implements connecting to a cache server, for the tools that talk to one as a
+// client (e.g. rpc_cache_benchmark and rpc_cache_check).
+package dial
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSFlags are the options for connecting to a server over TLS, for tools to embed in theirs.
+type TLSFlags struct {
+	KeyFile    string `long:"key_file" description:"File containing PEM-encoded client private key."`
+	CertFile   string `long:"cert_file" description:"File containing PEM-encoded client certificate"`
+	CACertFile string `long:"ca_cert_file" description:"File containing PEM-encoded CA certificate"`
+}
+
+// Dial connects to the server at the given address, using TLS if any of the flags are given.
+// If maxMsgSize is nonzero it's the largest message that can be sent or received.
+func Dial(address string, timeout time.Duration, maxMsgSize int, flags TLSFlags) (*grpc.ClientConn, error) {
+	dialOpts := []grpc.DialOption{grpc.WithTimeout(timeout)}
+	if maxMsgSize != 0 {
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize), grpc.MaxCallSendMsgSize(maxMsgSize)))
+	}
+	if flags.CACertFile == "" && flags.CertFile == "" {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	} else {
+		config, err := TLSConfig(flags)
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	}
+	conn, err := grpc.Dial(address, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s: %s", address, err)
+	}
+	return conn, nil
+}
+
+// TLSConfig returns the TLS configuration described by the given flags.
+func TLSConfig(flags TLSFlags) (*tls.Config, error) {
+	config := &tls.Config{}
+	if flags.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(flags.CertFile, flags.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if flags.CACertFile != "" {
+		cert, err := ioutil.ReadFile(flags.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA cert: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(cert) {
+			return nil, fmt.Errorf("Failed to find any PEM certificates in %s", flags.CACertFile)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,35 @@
+package dial
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialInsecure(t *testing.T) {
+	conn, err := Dial("127.0.0.1:7677", time.Second, 0, TLSFlags{})
+	if assert.NoError(t, err, "Doesn't wait for the connection") {
+		conn.Close()
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	conn, err := Dial("127.0.0.1:7677", time.Second, 1024, TLSFlags{
+		KeyFile:    "src/cache/test_data/key.pem",
+		CertFile:   "src/cache/test_data/cert_signed.pem",
+		CACertFile: "src/cache/test_data/ca.pem",
+	})
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
+func TestDialBadTLSFlags(t *testing.T) {
+	_, err := Dial("127.0.0.1:7677", time.Second, 0, TLSFlags{CertFile: "src/cache/test_data/cert_signed.pem"})
+	assert.Error(t, err, "No key given")
+	_, err = Dial("127.0.0.1:7677", time.Second, 0, TLSFlags{CACertFile: "src/cache/test_data/nonexistent.pem"})
+	assert.Error(t, err)
+	_, err = Dial("127.0.0.1:7677", time.Second, 0, TLSFlags{CACertFile: "src/cache/test_data/key.pem"})
+	assert.Error(t, err, "Not a certificate")
+}
@@ -1,45 +1,125 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
+	"syscall"
 	"time"
 
 	"gopkg.in/op/go-logging.v1"
 
 	"cli"
+	"tools/cache/audit"
 	"tools/cache/server"
 )
 
 var log = logging.MustGetLogger("http_cache_server")
 
 var opts struct {
-	Usage     string `usage:"http_cache_server is a server for Please's remote HTTP cache.\n\nSee https://please.build/cache.html for more information."`
-	Verbosity int    `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
-	Port      int    `short:"p" long:"port" description:"Port to serve on" default:"8080"`
-	Dir       string `short:"d" long:"dir" description:"Directory to write into" default:"plz-http-cache"`
-	LogFile   string `long:"log_file" description:"File to log to (in addition to stdout)"`
+	cli.ConfigFileFlag
+	Usage           string       `usage:"http_cache_server is a server for Please's remote HTTP cache.\n\nSee https://please.build/cache.html for more information."`
+	Verbosity       int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	Port            int          `short:"p" long:"port" description:"Port to serve on" default:"8080"`
+	BindAddr        string       `long:"bind_addr" description:"IP address to serve on, IPv4 or IPv6 (with or without brackets). By default all interfaces are used."`
+	Dir             string       `short:"d" long:"dir" description:"Directory to write into" default:"plz-http-cache"`
+	LogFile         string       `long:"log_file" description:"File to log to (in addition to stdout)"`
+	LogJSON         bool         `long:"log_json" description:"Log one JSON object per line, with the time, level and message and fields such as the artifact key and client, instead of plain text. Applies to --log_file too."`
+	MirrorDir       string       `long:"mirror_dir" description:"Directory to copy every stored artifact to in the background, e.g. a snapshotted network mount. It has the same layout as --dir so can seed a replacement cache. Copies are dropped if they fall too far behind, and the mirror is never cleaned."`
+	ReadOnly        bool         `long:"read_only" description:"Refuse all stores from clients; artifacts can still be retrieved and are cleaned as normal. Stores get a 412 Precondition Failed response."`
+	AuditLog        string       `long:"audit_log" description:"File to append a record of every artifact evicted from the cache to, with its size and why it was removed. Reopened on SIGHUP so it can be rotated. Query it with cache_audit."`
+	NormalizeKeys   []string     `long:"normalize_keys" choice:"separators" choice:"trailing_slash" choice:"lowercase" description:"Normalization to apply to artifact keys on every store and retrieve, so keys that differ only trivially map to the same artifact. Can be repeated. separators converts backslashes to slashes and collapses repeated ones, trailing_slash strips trailing slashes, and lowercase folds keys to lower case (for clients on case-insensitive filesystems). By default keys are used exactly as given."`
+	EncryptionKey   string       `long:"encryption_key" description:"File containing a 32-byte master key (optionally hex or base64 encoded) to encrypt artifacts at rest with. Each artifact is encrypted with its own data key, which is wrapped with this one. Artifacts already stored unencrypted are still served. By default artifacts aren't encrypted."`
+	MaxArtifactSize cli.ByteSize `long:"max_artifact_size" description:"Reject stores of any artifact larger than this with a 413 Request Entity Too Large response, without writing any of it. The request body stops being read as soon as it passes the limit. By default there is no limit."`
+	KMS             string       `long:"kms" description:"Command to run at startup to get the master key for encrypting artifacts at rest, e.g. one that decrypts it with a KMS. It should print the key in the same form as --encryption_key. Alternative to --encryption_key."`
 
 	CleanFlags struct {
-		LowWaterMark   cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"18G"`
-		HighWaterMark  cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"20G"`
-		CleanFrequency cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean cache at" default:"10m"`
-		MaxArtifactAge cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
+		LowWaterMark    cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"18G"`
+		HighWaterMark   cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"20G"`
+		MinFreeSpace    cli.ByteSize `long:"min_free_space" description:"Also clean the cache when the filesystem it's on has less than this much space available, e.g. because it's shared with other data, until there's --target_free_space. Each clean removes as much as the more aggressive of this and the water marks calls for. By default only the water marks are used."`
+		TargetFreeSpace cli.ByteSize `long:"target_free_space" description:"Space to leave available on the filesystem once cleaning for --min_free_space. Defaults to --min_free_space."`
+		CleanFrequency  cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean cache at" default:"10m"`
+		MaxArtifactAge  cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
+		MinRetention    cli.Duration `long:"min_retention" description:"Never clean artifacts to get under the water marks until they've been stored for at least this long. The cache can exceed its high water mark while this is in effect."`
+		SlidingTTL      cli.Duration `long:"sliding_ttl" description:"Remove artifacts that haven't been retrieved in this long. Each retrieve extends it, up to --max_lifetime after the artifact was stored. Unlike --max_artifact_age this doesn't rely on the filesystem recording access times."`
+		MaxLifetime     cli.Duration `long:"max_lifetime" description:"Remove artifacts this long after they were stored, however recently they've been retrieved. Required with --sliding_ttl."`
+		MaxIndexEntries int          `long:"max_index_entries" description:"Maximum number of files to track in memory. Beyond this the least recently read are looked up on disk when needed. By default there is no limit."`
+		ScanParallelism int          `long:"scan_parallelism" default:"8" description:"Number of directories to read at once while scanning the existing cache at startup. Large caches on disks that handle concurrent reads well (e.g. SSDs) scan much faster with more. Progress is logged periodically while it runs."`
 	} `group:"Options controlling when to clean the cache"`
+
+	HeartbeatFlags struct {
+		URL      string       `long:"heartbeat_url" description:"URL to POST a heartbeat to periodically, describing this server's health as JSON, for monitors that alert when they stop receiving it."`
+		Interval cli.Duration `long:"heartbeat_interval" default:"1m" description:"Interval between heartbeats"`
+	} `group:"Options controlling heartbeats to an external monitor"`
+
+	ProfileFlags struct {
+		Dir         string       `long:"profile_dir" description:"Directory to write goroutine, heap and CPU profiles to when the server receives SIGUSR2. For capturing diagnostics without serving pprof over the network."`
+		CPUDuration cli.Duration `long:"profile_cpu_duration" default:"30s" description:"Length of the CPU profile written on SIGUSR2"`
+	} `group:"Options controlling profiling"`
 }
 
 func main() {
 	cli.ParseFlagsOrDie("Please HTTP cache server", "5.5.0", &opts)
+	cli.SetJSONLogging(opts.LogJSON)
 	cli.InitLogging(opts.Verbosity)
 	if opts.LogFile != "" {
 		cli.InitFileLogging(opts.LogFile, opts.Verbosity)
 	}
 	log.Notice("Initialising cache server...")
+	serverOpts := server.ServerOptions{
+		MaxIndexEntries: opts.CleanFlags.MaxIndexEntries,
+		MaxArtifactSize: int64(opts.MaxArtifactSize),
+		ScanParallelism: opts.CleanFlags.ScanParallelism,
+	}
 	cache := server.NewCache(opts.Dir, time.Duration(opts.CleanFlags.CleanFrequency),
 		time.Duration(opts.CleanFlags.MaxArtifactAge),
-		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark))
+		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark), serverOpts)
+	if opts.CleanFlags.MinFreeSpace > 0 {
+		cache.SetFreeSpaceThresholds(int64(opts.CleanFlags.MinFreeSpace), int64(opts.CleanFlags.TargetFreeSpace))
+	}
+	if opts.CleanFlags.MinRetention > 0 {
+		cache.SetMinRetention(time.Duration(opts.CleanFlags.MinRetention))
+	}
+	if err := cache.SetSlidingTTL(time.Duration(opts.CleanFlags.SlidingTTL), time.Duration(opts.CleanFlags.MaxLifetime)); err != nil {
+		log.Fatalf("Invalid --sliding_ttl / --max_lifetime: %s", err)
+	}
+	if opts.MirrorDir != "" {
+		cache.SetMirror(opts.MirrorDir)
+	}
+	if normalize, err := server.KeyNormalizations(opts.NormalizeKeys); err != nil {
+		log.Fatalf("Invalid --normalize_keys: %s", err)
+	} else if normalize != nil {
+		cache.SetKeyNormalizer(normalize)
+	}
+	if key, err := server.ReadEncryptionKey(opts.EncryptionKey, opts.KMS); err != nil {
+		log.Fatalf("Failed to read encryption key: %s", err)
+	} else if key != nil {
+		if err := cache.SetEncryptionKey(key); err != nil {
+			log.Fatalf("Invalid encryption key: %s", err)
+		}
+		log.Notice("Encrypting artifacts at rest")
+	}
+	if opts.ReadOnly {
+		cache.SetReadOnly("configured read-only")
+	}
+	if opts.AuditLog != "" {
+		l, err := audit.Open(opts.AuditLog)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %s", err)
+		}
+		l.ReopenOn(syscall.SIGHUP)
+		cache.SetAuditLog(l)
+	}
+	if opts.ProfileFlags.Dir != "" {
+		server.DumpProfilesOnSignal(opts.ProfileFlags.Dir, time.Duration(opts.ProfileFlags.CPUDuration))
+	}
+	if opts.HeartbeatFlags.URL != "" {
+		server.StartHeartbeat(opts.HeartbeatFlags.URL, time.Duration(opts.HeartbeatFlags.Interval), cache, nil)
+	}
 	log.Notice("Starting up http cache server on port %d...", opts.Port)
-	router := server.BuildRouter(cache)
+	bindAddr, err := server.ParseBindAddress(opts.BindAddr)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	router := server.BuildRouter(cache, serverOpts)
 	http.Handle("/", router)
-	http.ListenAndServe(fmt.Sprintf(":%d", opts.Port), router)
+	http.ListenAndServe(server.ListenAddress(bindAddr, opts.Port), router)
 }
@@ -0,0 +1,126 @@
+// Package logfile implements the files that the cache server's audit and operation logs are
+// written to: one JSON entry per line, only ever appended to, and reopened when rotated.
+package logfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+)
+
+var log = logging.MustGetLogger("logfile")
+
+// flushFrequency is how often buffered entries are written out to the file.
+const flushFrequency = time.Second
+
+// A File is a log file that entries are appended to. Writes are buffered and flushed
+// periodically so writing an entry is cheap; at most flushFrequency's worth are lost if the
+// process dies.
+type File struct {
+	// name describes the log in messages, e.g. "audit log".
+	name     string
+	filename string
+	file     *os.File
+	w        *bufio.Writer
+	mutex    sync.Mutex
+	done     chan struct{}
+}
+
+// Open opens the given file for appending entries to, creating it if needed.
+// The name describes what the log is, for messages about it.
+func Open(filename, name string) (*File, error) {
+	f := &File{name: name, filename: filename, done: make(chan struct{})}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	go f.flushPeriodically()
+	return f, nil
+}
+
+// open opens the log file. The caller must hold the mutex (or be the constructor).
+func (f *File) open() error {
+	file, err := os.OpenFile(f.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.w = bufio.NewWriter(file)
+	return nil
+}
+
+// Write writes a single entry to the log, as JSON.
+func (f *File) Write(entry interface{}) {
+	b, _ := json.Marshal(entry)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, err := f.w.Write(append(b, '\n')); err != nil {
+		log.Errorf("Failed to write %s: %s", f.name, err)
+	}
+}
+
+// Flush writes any buffered entries to the file.
+func (f *File) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.w.Flush()
+}
+
+// flushPeriodically flushes the log until it's closed.
+func (f *File) flushPeriodically() {
+	ticker := time.NewTicker(flushFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.Flush(); err != nil {
+				log.Errorf("Failed to flush %s: %s", f.name, err)
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// Reopen flushes and closes the log file, then opens it again. This allows it to be rotated by
+// moving the file out of the way and then calling this.
+func (f *File) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.w.Flush(); err != nil {
+		log.Errorf("Failed to flush %s: %s", f.name, err)
+	}
+	f.file.Close()
+	return f.open()
+}
+
+// ReopenOn reopens the log whenever the process receives one of the given signals
+// (typically SIGHUP, which is what logrotate and friends send).
+func (f *File) ReopenOn(signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		for range ch {
+			log.Notice("Reopening %s %s", f.name, f.filename)
+			if err := f.Reopen(); err != nil {
+				log.Errorf("Failed to reopen %s: %s", f.name, err)
+			}
+		}
+	}()
+}
+
+// Close flushes and closes the log.
+func (f *File) Close() error {
+	close(f.done)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.w.Flush(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,50 @@
+package logfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	Key string `json:"key"`
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "test.log")
+	f, err := Open(filename, "test log")
+	require.NoError(t, err)
+	f.Write(&entry{Key: "a"})
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(b), "Writes are buffered")
+	require.NoError(t, f.Flush())
+	b, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"key\":\"a\"}\n", string(b))
+
+	// Rotate it; new entries go to a fresh file.
+	require.NoError(t, os.Rename(filename, filename+".1"))
+	require.NoError(t, f.Reopen())
+	f.Write(&entry{Key: "b"})
+	require.NoError(t, f.Close())
+	b, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"key\":\"b\"}\n", string(b))
+
+	// Opening it again appends rather than truncating.
+	f, err = Open(filename, "test log")
+	require.NoError(t, err)
+	f.Write(&entry{Key: "c"})
+	require.NoError(t, f.Close())
+	b, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"key\":\"b\"}\n{\"key\":\"c\"}\n", string(b))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+	"gopkg.in/op/go-logging.v1"
+
+	"cli"
+	"tools/cache/server"
+)
+
+var log = logging.MustGetLogger("cache_migrate")
+
+var opts struct {
+	cli.ConfigFileFlag
+	Usage     string       `usage:"cache_migrate copies the artifacts in one cache directory to another, which can have a different layout, encryption, compression or storage backend.\n\nIt's resumable; anything already in the destination with the same contents is skipped. At the end it checks that the destination has everything in the source, prints a JSON report to stdout and exits with a nonzero status if it doesn't. Neither cache should be being served while it runs.\n\nIf --to is the same directory as --from, the artifacts are moved from --from_layout to --layout in place instead, each being checked before the original is removed; only the layout and compression can change. To do that while the cache is being served, use the server's --migrate_from_layout."`
+	From      string       `long:"from" required:"true" description:"Cache directory to copy artifacts from. It isn't modified, unless it's also --to."`
+	To        string       `long:"to" required:"true" description:"Cache directory to copy artifacts to. It's created if it doesn't exist."`
+	Verbosity int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	Progress  cli.Duration `long:"progress_interval" default:"10s" description:"How often to log progress"`
+
+	SourceFlags struct {
+		Layout        string `long:"from_layout" default:"default" description:"Layout of artifacts in --from, as the server's --layout."`
+		EncryptionKey string `long:"from_encryption_key" description:"File containing the master key that artifacts in --from are encrypted with, as the server's --encryption_key."`
+		KMS           string `long:"from_kms" description:"Command to run to get the master key that artifacts in --from are encrypted with, as the server's --kms."`
+	} `group:"Options describing the source cache"`
+
+	DestFlags struct {
+		Layout         string       `long:"layout" default:"default" description:"Layout of artifacts in --to, as the server's --layout. Artifacts are moved to where it puts them."`
+		EncryptionKey  string       `long:"encryption_key" description:"File containing the master key to encrypt artifacts in --to with, as the server's --encryption_key. By default they aren't encrypted."`
+		KMS            string       `long:"kms" description:"Command to run to get the master key to encrypt artifacts in --to with, as the server's --kms."`
+		Compression    string       `long:"compression" choice:"none" choice:"gzip" default:"none" description:"Compress artifacts in --to with this codec, as the server's --compression."`
+		LowWaterMark   cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of the destination cache to clean down to" default:"18G"`
+		HighWaterMark  cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of the destination cache to clean at. Artifacts are cleaned from it during the migration as the server would, so it should be at least the size of --from to keep everything." default:"20G"`
+		CleanFrequency cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean the destination cache at" default:"10m"`
+		MaxArtifactAge cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact in the destination that's not been read in this long" default:"720h"`
+	} `group:"Options describing the destination cache"`
+
+	StorageFlags struct {
+		Backend  string `long:"storage" choice:"local" choice:"dir" choice:"s3" default:"local" description:"Where the destination keeps artifacts durably, as the server's --storage. Every migrated artifact is also written there."`
+		Dir      string `long:"storage_dir" description:"Directory to keep artifacts in for --storage=dir."`
+		Bucket   string `long:"s3_bucket" description:"S3 bucket to keep artifacts in for --storage=s3. Credentials are read from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN."`
+		Endpoint string `long:"s3_endpoint" description:"URL of the S3 service for --storage=s3. Defaults to AWS's endpoint for --s3_region."`
+		Region   string `long:"s3_region" default:"us-east-1" description:"Region of --s3_bucket."`
+	} `group:"Options controlling durable storage of the destination's artifacts"`
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Please cache migration", "5.5.0", &opts)
+	cli.InitLogging(opts.Verbosity)
+	if opts.From == opts.To {
+		migrateInPlace()
+		return
+	}
+	src := server.OpenCache(opts.From)
+	configure(src, "--from", opts.SourceFlags.Layout, opts.SourceFlags.EncryptionKey, opts.SourceFlags.KMS)
+	dst := server.NewCache(opts.To, time.Duration(opts.DestFlags.CleanFrequency),
+		time.Duration(opts.DestFlags.MaxArtifactAge),
+		uint64(opts.DestFlags.LowWaterMark), uint64(opts.DestFlags.HighWaterMark), server.ServerOptions{})
+	configure(dst, "--to", opts.DestFlags.Layout, opts.DestFlags.EncryptionKey, opts.DestFlags.KMS)
+	if err := dst.SetCompression(opts.DestFlags.Compression, 0); err != nil {
+		log.Fatalf("Invalid --compression: %s", err)
+	}
+	if storage, err := newStorage(); err != nil {
+		log.Fatalf("Invalid --storage: %s", err)
+	} else if storage != nil {
+		dst.SetStorage(storage)
+	}
+
+	log.Notice("Migrating artifacts from %s to %s...", opts.From, opts.To)
+	start := time.Now()
+	last := start
+	report := server.Migrate(src, dst, func(r *server.MigrationReport) {
+		if time.Since(last) >= time.Duration(opts.Progress) {
+			last = time.Now()
+			log.Notice("%d files (%s) so far: %d copied, %d already present, %d failed",
+				r.Files, humanize.Bytes(uint64(r.Bytes)), r.Copied, r.Skipped, len(r.Failed))
+		}
+	})
+	if err := dst.Flush(context.Background()); err != nil {
+		log.Errorf("Failed to finish writing artifacts: %s", err)
+	}
+	log.Notice("Migrated %d files (%s) in %s", report.Files, humanize.Bytes(uint64(report.Bytes)), time.Since(start).Round(time.Second))
+	writeReport(report)
+}
+
+// migrateInPlace moves the artifacts in --from from --from_layout to --layout.
+func migrateInPlace() {
+	if f := opts.DestFlags; f.EncryptionKey != "" || f.KMS != "" || opts.StorageFlags.Backend != "local" {
+		log.Fatalf("Only --layout and --compression can be changed when --from and --to are the same directory")
+	}
+	from, err := server.NewLayout(opts.SourceFlags.Layout)
+	if err != nil {
+		log.Fatalf("Invalid layout for --from: %s", err)
+	}
+	cache := server.OpenCache(opts.From)
+	configure(cache, "--to", opts.DestFlags.Layout, opts.SourceFlags.EncryptionKey, opts.SourceFlags.KMS)
+	if err := cache.SetCompression(opts.DestFlags.Compression, 0); err != nil {
+		log.Fatalf("Invalid --compression: %s", err)
+	}
+
+	log.Notice("Moving artifacts in %s from layout %s to %s...", opts.From, from, cache.Layout())
+	start := time.Now()
+	last := start
+	report := cache.MigrateLayout(from, func(r *server.MigrationReport) {
+		if time.Since(last) >= time.Duration(opts.Progress) {
+			last = time.Now()
+			log.Notice("%d files (%s) so far: %d moved, %d already moved, %d failed; %d sets of artifacts remaining",
+				r.Files, humanize.Bytes(uint64(r.Bytes)), r.Copied, r.Skipped, len(r.Failed), r.Remaining)
+		}
+	})
+	if err := cache.Flush(context.Background()); err != nil {
+		log.Errorf("Failed to finish writing artifacts: %s", err)
+	}
+	log.Notice("Moved %d files (%s) in %s", report.Files, humanize.Bytes(uint64(report.Bytes)), time.Since(start).Round(time.Second))
+	writeReport(report)
+}
+
+// writeReport prints the given report to stdout, and exits with a nonzero status if the migration failed.
+func writeReport(report *server.MigrationReport) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatalf("Failed to write report: %s", err)
+	}
+	if !report.OK() {
+		log.Errorf("Destination doesn't match the source: %d of %d files (%d of %d bytes) verified",
+			report.Verified, report.Files, report.VerifiedBytes, report.Bytes)
+		os.Exit(1)
+	}
+}
+
+// configure sets the layout and encryption key of one of the caches, given by the named flag.
+func configure(cache *server.Cache, flag, layout, keyFile, kms string) {
+	if l, err := server.NewLayout(layout); err != nil {
+		log.Fatalf("Invalid layout for %s: %s", flag, err)
+	} else {
+		cache.SetLayout(l)
+	}
+	if key, err := server.ReadEncryptionKey(keyFile, kms); err != nil {
+		log.Fatalf("Failed to read encryption key for %s: %s", flag, err)
+	} else if key != nil {
+		if err := cache.SetEncryptionKey(key); err != nil {
+			log.Fatalf("Invalid encryption key for %s: %s", flag, err)
+		}
+	}
+}
+
+// newStorage returns the destination's storage backend given by the flags, or nil if it only uses its directory.
+func newStorage() (server.Storage, error) {
+	switch f := opts.StorageFlags; f.Backend {
+	case "dir":
+		return server.NewDiskStorage(f.Dir), nil
+	case "s3":
+		return server.NewS3Storage(server.S3Config{Bucket: f.Bucket, Endpoint: f.Endpoint, Region: f.Region})
+	}
+	return nil, nil
+}
@@ -0,0 +1,209 @@
+// Package oplog implements a log of the operations a cache server handles, which can be replayed
+// against another server (see Replay) to reproduce its behaviour, for example to turn an incident
+// into a test case.
+//
+// The log is written as JSON, one entry per line, to a file that's only ever appended to.
+// Each entry describes a single store, retrieve or delete:
+//
+//	{
+//	  "v": 1,                                // Version of the format, currently always 1.
+//	  "time": "2018-01-02T15:04:05.123456Z", // When the server received the request.
+//	  "op": "store",                         // One of "store", "retrieve" or "delete".
+//	  "os": "linux",
+//	  "arch": "amd64",
+//	  "hash": "aGFzaA==",                    // Base64-encoded hash of the artifacts (absent for deletes).
+//	  "artifacts": [{
+//	    "package": "src/core",
+//	    "target": "core",
+//	    "file": "core.a",                    // Absent for deletes, which apply to the whole target.
+//	    "size": 1234,                        // Size of the contents stored (absent for retrieves & deletes).
+//	    "body": "..."                        // Base64-encoded contents stored, only if bodies are captured.
+//	  }],
+//	  "everything": true,                    // Only present for deletes of the entire cache.
+//	  "size": 1234,                          // Total bytes stored or retrieved.
+//	  "duration": 1500000,                   // Time taken to handle the request, in nanoseconds.
+//	  "success": true,                       // Whether it succeeded (for retrieves, whether it was a hit).
+//	  "code": "OK"                           // The gRPC status code of the response.
+//	}
+//
+// Fields may be added to later versions, but those here won't change meaning; a change that
+// would needs a new version. Readers should ignore fields they don't understand.
+package oplog
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+
+	pb "cache/proto/rpc_cache"
+	"tools/cache/logfile"
+)
+
+var log = logging.MustGetLogger("oplog")
+
+// Version is the version of the log format that's written.
+const Version = 1
+
+// An Op is a kind of operation.
+type Op string
+
+const (
+	// Store is a Store RPC.
+	Store Op = "store"
+	// Retrieve is a Retrieve RPC.
+	Retrieve Op = "retrieve"
+	// Delete is a Delete RPC.
+	Delete Op = "delete"
+)
+
+// An Entry is a single record in the operation log.
+type Entry struct {
+	Version    int           `json:"v"`
+	Time       time.Time     `json:"time"`
+	Op         Op            `json:"op"`
+	OS         string        `json:"os"`
+	Arch       string        `json:"arch"`
+	Hash       []byte        `json:"hash,omitempty"`
+	Artifacts  []Artifact    `json:"artifacts,omitempty"`
+	Everything bool          `json:"everything,omitempty"`
+	Size       int64         `json:"size"`
+	Duration   time.Duration `json:"duration"`
+	Success    bool          `json:"success"`
+	Code       string        `json:"code"`
+}
+
+// An Artifact identifies a single artifact in an Entry.
+type Artifact struct {
+	Package string `json:"package"`
+	Target  string `json:"target"`
+	File    string `json:"file,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Body    []byte `json:"body,omitempty"`
+}
+
+// A Log writes entries to an operation log file. As for the audit log, writes are buffered and
+// flushed periodically so recording an entry is cheap.
+// All methods are safe to call on a nil Log, which does nothing.
+type Log struct {
+	file   *logfile.File
+	bodies bool
+}
+
+// Open opens the given file for appending entries to, creating it if needed.
+// If bodies is true, the contents of stored artifacts are recorded too, so they can be replayed
+// exactly; otherwise only their sizes are. Bear in mind that the log then grows by as much as
+// the cache does.
+func Open(filename string, bodies bool) (*Log, error) {
+	f, err := logfile.Open(filename, "operation log")
+	if err != nil {
+		return nil, err
+	}
+	return &Log{file: f, bodies: bodies}, nil
+}
+
+// RecordStore records a Store RPC that was received at the given time.
+func (l *Log) RecordStore(start time.Time, req *pb.StoreRequest, success bool, code string) {
+	if l == nil {
+		return
+	}
+	e := l.entry(Store, start, req.Os, req.Arch, req.Hash, success, code)
+	for _, a := range req.Artifacts {
+		artifact := Artifact{Package: a.Package, Target: a.Target, File: a.File, Size: int64(len(a.Body))}
+		if l.bodies {
+			artifact.Body = a.Body
+		}
+		e.Artifacts = append(e.Artifacts, artifact)
+		e.Size += artifact.Size
+	}
+	l.file.Write(e)
+}
+
+// RecordRetrieve records a Retrieve RPC that was received at the given time.
+// The response is nil if it failed.
+func (l *Log) RecordRetrieve(start time.Time, req *pb.RetrieveRequest, resp *pb.RetrieveResponse, code string) {
+	if l == nil {
+		return
+	}
+	e := l.entry(Retrieve, start, req.Os, req.Arch, req.Hash, resp.GetSuccess(), code)
+	for _, a := range req.Artifacts {
+		e.Artifacts = append(e.Artifacts, Artifact{Package: a.Package, Target: a.Target, File: a.File})
+	}
+	for _, a := range resp.GetArtifacts() {
+		e.Size += int64(len(a.Body))
+	}
+	l.file.Write(e)
+}
+
+// RecordDelete records a Delete RPC that was received at the given time.
+func (l *Log) RecordDelete(start time.Time, req *pb.DeleteRequest, success bool, code string) {
+	if l == nil {
+		return
+	}
+	e := l.entry(Delete, start, req.Os, req.Arch, nil, success, code)
+	e.Everything = req.Everything
+	for _, a := range req.Artifacts {
+		e.Artifacts = append(e.Artifacts, Artifact{Package: a.Package, Target: a.Target})
+	}
+	l.file.Write(e)
+}
+
+// entry returns a new entry for an operation that started at the given time and has just finished.
+func (l *Log) entry(op Op, start time.Time, os, arch string, hash []byte, success bool, code string) *Entry {
+	return &Entry{
+		Version:  Version,
+		Time:     start.UTC(),
+		Op:       op,
+		OS:       os,
+		Arch:     arch,
+		Hash:     hash,
+		Duration: time.Since(start),
+		Success:  success,
+		Code:     code,
+	}
+}
+
+// Flush writes any buffered entries to the file.
+func (l *Log) Flush() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Flush()
+}
+
+// Reopen flushes and closes the log file, then opens it again, so it can be rotated.
+func (l *Log) Reopen() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Reopen()
+}
+
+// ReopenOn reopens the log whenever the process receives one of the given signals.
+func (l *Log) ReopenOn(signals ...os.Signal) {
+	l.file.ReopenOn(signals...)
+}
+
+// Close flushes and closes the log.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Read reads entries from an operation log, calling f for each one.
+func Read(r io.Reader, f func(*Entry)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		entry := &Entry{}
+		if err := decoder.Decode(entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		f(entry)
+	}
+}
@@ -0,0 +1,146 @@
+package oplog
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func readAll(t *testing.T, filename string) []*Entry {
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	entries := []*Entry{}
+	require.NoError(t, Read(f, func(e *Entry) { entries = append(entries, e) }))
+	return entries
+}
+
+func tempLog(t *testing.T, bodies bool) (*Log, string, func()) {
+	dir, err := ioutil.TempDir("", "oplog")
+	require.NoError(t, err)
+	filename := path.Join(dir, "operations.log")
+	l, err := Open(filename, bodies)
+	require.NoError(t, err)
+	return l, filename, func() { os.RemoveAll(dir) }
+}
+
+func TestRecord(t *testing.T) {
+	l, filename, cleanup := tempLog(t, false)
+	defer cleanup()
+	start := time.Now().Add(-time.Millisecond)
+	l.RecordStore(start, &pb.StoreRequest{
+		Os:   "linux",
+		Arch: "amd64",
+		Hash: []byte("hash"),
+		Artifacts: []*pb.Artifact{
+			{Package: "src/core", Target: "core", File: "core.a", Body: []byte("abcd")},
+			{Package: "src/core", Target: "core", File: "core.h", Body: []byte("ef")},
+		},
+	}, true, "OK")
+	req := &pb.RetrieveRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash"),
+		Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a"}},
+	}
+	l.RecordRetrieve(start, req, &pb.RetrieveResponse{Success: true, Artifacts: []*pb.Artifact{{Body: []byte("abcd")}}}, "OK")
+	l.RecordRetrieve(start, req, nil, "NotFound")
+	l.RecordDelete(start, &pb.DeleteRequest{Os: "linux", Arch: "amd64", Everything: true}, true, "OK")
+	require.NoError(t, l.Close())
+
+	entries := readAll(t, filename)
+	require.Equal(t, 4, len(entries))
+	for _, e := range entries {
+		assert.Equal(t, Version, e.Version)
+		assert.True(t, e.Time.Equal(start), "Entries are timestamped with when the request arrived")
+		assert.True(t, e.Duration >= time.Millisecond)
+		assert.Equal(t, "linux", e.OS)
+	}
+	assert.Equal(t, Store, entries[0].Op)
+	assert.Equal(t, []byte("hash"), entries[0].Hash)
+	assert.EqualValues(t, 6, entries[0].Size)
+	assert.Equal(t, []Artifact{
+		{Package: "src/core", Target: "core", File: "core.a", Size: 4},
+		{Package: "src/core", Target: "core", File: "core.h", Size: 2},
+	}, entries[0].Artifacts, "Bodies aren't recorded unless asked for")
+	assert.True(t, entries[0].Success)
+
+	assert.Equal(t, Retrieve, entries[1].Op)
+	assert.EqualValues(t, 4, entries[1].Size)
+	assert.True(t, entries[1].Success)
+	assert.Equal(t, Retrieve, entries[2].Op)
+	assert.False(t, entries[2].Success)
+	assert.Equal(t, "NotFound", entries[2].Code)
+
+	assert.Equal(t, Delete, entries[3].Op)
+	assert.True(t, entries[3].Everything)
+	assert.Nil(t, entries[3].Hash)
+}
+
+func TestRecordBodies(t *testing.T) {
+	l, filename, cleanup := tempLog(t, true)
+	defer cleanup()
+	l.RecordStore(time.Now(), &pb.StoreRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash"),
+		Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a", Body: []byte("abcd")}},
+	}, true, "OK")
+	require.NoError(t, l.Close())
+	entries := readAll(t, filename)
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, []byte("abcd"), entries[0].Artifacts[0].Body)
+	assert.EqualValues(t, 4, entries[0].Artifacts[0].Size)
+}
+
+func TestReopen(t *testing.T) {
+	l, filename, cleanup := tempLog(t, false)
+	defer cleanup()
+	req := &pb.DeleteRequest{Os: "linux", Arch: "amd64", Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core"}}}
+	l.RecordDelete(time.Now(), req, true, "OK")
+	require.NoError(t, os.Rename(filename, filename+".1"))
+	require.NoError(t, l.Reopen())
+	l.RecordDelete(time.Now(), req, true, "OK")
+	l.RecordDelete(time.Now(), req, false, "Unavailable")
+	require.NoError(t, l.Close())
+	assert.Equal(t, 1, len(readAll(t, filename+".1")))
+	assert.Equal(t, 2, len(readAll(t, filename)))
+}
+
+func TestReadStableFormat(t *testing.T) {
+	// This is the documented format; anything that breaks reading it needs a new version.
+	const entry = `{"v":1,"time":"2018-01-02T15:04:05.123456Z","op":"store","os":"linux","arch":"amd64","hash":"aGFzaA==",` +
+		`"artifacts":[{"package":"src/core","target":"core","file":"core.a","size":1234}],"size":1234,` +
+		`"duration":1500000,"success":true,"code":"OK","unknown_field":"ignored"}`
+	entries := []*Entry{}
+	require.NoError(t, Read(strings.NewReader(entry+"\n"), func(e *Entry) { entries = append(entries, e) }))
+	require.Equal(t, 1, len(entries))
+	e := entries[0]
+	assert.Equal(t, 1, e.Version)
+	assert.Equal(t, time.Date(2018, 1, 2, 15, 4, 5, 123456000, time.UTC), e.Time)
+	assert.Equal(t, Store, e.Op)
+	assert.Equal(t, []byte("hash"), e.Hash)
+	assert.Equal(t, []Artifact{{Package: "src/core", Target: "core", File: "core.a", Size: 1234}}, e.Artifacts)
+	assert.EqualValues(t, 1234, e.Size)
+	assert.Equal(t, 1500*time.Microsecond, e.Duration)
+	assert.True(t, e.Success)
+	assert.Equal(t, "OK", e.Code)
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.RecordStore(time.Now(), &pb.StoreRequest{}, true, "OK")
+	l.RecordRetrieve(time.Now(), &pb.RetrieveRequest{}, nil, "OK")
+	l.RecordDelete(time.Now(), &pb.DeleteRequest{}, true, "OK")
+	assert.NoError(t, l.Flush())
+	assert.NoError(t, l.Reopen())
+	assert.NoError(t, l.Close())
+}
@@ -0,0 +1,175 @@
+package oplog
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "cache/proto/rpc_cache"
+	"tools/cache/benchmark"
+)
+
+// ReplayOptions describes how to replay an operation log.
+type ReplayOptions struct {
+	// How much faster than they originally happened to replay operations, e.g. 1 for the
+	// original timing or 10 for ten times as fast. Zero replays them as fast as possible.
+	Speed float64
+	// Maximum number of operations to have in flight at once.
+	Concurrency int
+	// Timeout for each individual operation.
+	Timeout time.Duration
+}
+
+// ReplayResults contains the results of replaying an operation log.
+type ReplayResults struct {
+	// Results for each kind of operation.
+	Ops map[Op]*OpResults
+	// Number of entries that were skipped because they're of a kind or version we don't know.
+	Skipped int
+	Elapsed time.Duration
+}
+
+// OpResults contains the results of replaying one kind of operation.
+type OpResults struct {
+	Count, Errors int
+	// Number of operations whose outcome differed from the original, e.g. retrieves that
+	// were hits originally but missed when replayed.
+	Mismatches int
+	// Latencies when replayed, and as originally recorded.
+	Latencies, Original benchmark.Latencies
+}
+
+// String returns a human-readable summary of these results.
+func (r *ReplayResults) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Replayed for %s\n", r.Elapsed)
+	for _, op := range []Op{Store, Retrieve, Delete} {
+		if res := r.Ops[op]; res != nil {
+			fmt.Fprintf(&buf, "%s: %d, %d errors, %d with a different outcome\n", op, res.Count, res.Errors, res.Mismatches)
+			fmt.Fprintf(&buf, "  latency: p50 %s p90 %s p99 %s max %s (originally p50 %s p90 %s p99 %s max %s)\n",
+				res.Latencies.Percentile(50), res.Latencies.Percentile(90), res.Latencies.Percentile(99), res.Latencies.Percentile(100),
+				res.Original.Percentile(50), res.Original.Percentile(90), res.Original.Percentile(99), res.Original.Percentile(100))
+		}
+	}
+	if r.Skipped > 0 {
+		fmt.Fprintf(&buf, "Skipped %d entries\n", r.Skipped)
+	}
+	return buf.String()
+}
+
+// Replay reads an operation log and issues each operation in it to the given client, at the
+// same relative times as originally (scaled by the speed) but never with more than the given
+// concurrency in flight. It returns an error only if the log can't be read.
+// Stores whose bodies weren't captured are replayed with generated contents of the same size;
+// they're the same each time for the same artifact, so storing one again isn't a collision.
+func Replay(client pb.RpcCacheClient, r io.Reader, opts ReplayOptions) (*ReplayResults, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	results := &ReplayResults{Ops: map[Op]*OpResults{}}
+	sem := make(chan struct{}, opts.Concurrency)
+	var first time.Time
+	start := time.Now()
+	err := Read(r, func(e *Entry) {
+		if e.Version > Version || (e.Op != Store && e.Op != Retrieve && e.Op != Delete) {
+			log.Warning("Skipping entry with unknown op %s or version %d", e.Op, e.Version)
+			mutex.Lock()
+			results.Skipped++
+			mutex.Unlock()
+			return
+		}
+		if first.IsZero() {
+			first = e.Time
+		}
+		if opts.Speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(e.Time.Sub(first)) / opts.Speed))))
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			before := time.Now()
+			success, err := replay(client, e, opts.Timeout)
+			elapsed := time.Since(before)
+			mutex.Lock()
+			defer mutex.Unlock()
+			res := results.Ops[e.Op]
+			if res == nil {
+				res = &OpResults{}
+				results.Ops[e.Op] = res
+			}
+			res.Count++
+			res.Latencies = append(res.Latencies, elapsed)
+			res.Original = append(res.Original, e.Duration)
+			if err != nil {
+				log.Debug("%s failed: %s", e.Op, err)
+				res.Errors++
+			}
+			if success != e.Success {
+				res.Mismatches++
+			}
+		}()
+	})
+	wg.Wait()
+	results.Elapsed = time.Since(start)
+	for _, res := range results.Ops {
+		sort.Sort(res.Latencies)
+		sort.Sort(res.Original)
+	}
+	return results, err
+}
+
+// replay issues a single operation. It returns true if it succeeded (for a retrieve, if it was a hit).
+func replay(client pb.RpcCacheClient, e *Entry, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	switch e.Op {
+	case Store:
+		req := &pb.StoreRequest{Os: e.OS, Arch: e.Arch, Hash: e.Hash}
+		for _, a := range e.Artifacts {
+			req.Artifacts = append(req.Artifacts, &pb.Artifact{Package: a.Package, Target: a.Target, File: a.File, Body: body(e, a)})
+		}
+		resp, err := client.Store(ctx, req)
+		return err == nil && resp.Success, err
+	case Retrieve:
+		req := &pb.RetrieveRequest{Os: e.OS, Arch: e.Arch, Hash: e.Hash}
+		for _, a := range e.Artifacts {
+			req.Artifacts = append(req.Artifacts, &pb.Artifact{Package: a.Package, Target: a.Target, File: a.File})
+		}
+		resp, err := client.Retrieve(ctx, req)
+		return err == nil && resp.Success, err
+	default:
+		req := &pb.DeleteRequest{Os: e.OS, Arch: e.Arch, Everything: e.Everything}
+		for _, a := range e.Artifacts {
+			req.Artifacts = append(req.Artifacts, &pb.Artifact{Package: a.Package, Target: a.Target})
+		}
+		resp, err := client.Delete(ctx, req)
+		return err == nil && resp.Success, err
+	}
+}
+
+// body returns the contents to store for the given artifact: its captured body if there is one,
+// or otherwise generated contents of the right size, which are always the same for the same artifact.
+func body(e *Entry, a Artifact) []byte {
+	if a.Body != nil || a.Size == 0 {
+		return a.Body
+	}
+	h := fnv.New64a()
+	h.Write(e.Hash)
+	h.Write([]byte(e.OS + "_" + e.Arch + "/" + a.Package + "/" + a.Target + "/" + a.File))
+	b := make([]byte, a.Size)
+	rand.New(rand.NewSource(int64(h.Sum64()))).Read(b)
+	return b
+}
@@ -0,0 +1,148 @@
+package oplog
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// fakeClient is an in-memory cache that records the requests it receives.
+type fakeClient struct {
+	pb.RpcCacheClient
+	mutex     sync.Mutex
+	artifacts map[string][]byte
+	stores    []*pb.StoreRequest
+	deletes   int
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{artifacts: map[string][]byte{}}
+}
+
+func (c *fakeClient) key(hash []byte, a *pb.Artifact) string {
+	return string(hash) + "/" + a.Package + "/" + a.Target + "/" + a.File
+}
+
+func (c *fakeClient) Store(ctx context.Context, req *pb.StoreRequest, opts ...grpc.CallOption) (*pb.StoreResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stores = append(c.stores, req)
+	for _, a := range req.Artifacts {
+		c.artifacts[c.key(req.Hash, a)] = a.Body
+	}
+	return &pb.StoreResponse{Success: true}, nil
+}
+
+func (c *fakeClient) Retrieve(ctx context.Context, req *pb.RetrieveRequest, opts ...grpc.CallOption) (*pb.RetrieveResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	resp := &pb.RetrieveResponse{Success: true}
+	for _, a := range req.Artifacts {
+		body, present := c.artifacts[c.key(req.Hash, a)]
+		if !present {
+			return &pb.RetrieveResponse{Success: false}, nil
+		}
+		resp.Artifacts = append(resp.Artifacts, &pb.Artifact{Package: a.Package, Target: a.Target, File: a.File, Body: body})
+	}
+	return resp, nil
+}
+
+func (c *fakeClient) Delete(ctx context.Context, req *pb.DeleteRequest, opts ...grpc.CallOption) (*pb.DeleteResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deletes++
+	c.artifacts = map[string][]byte{}
+	return &pb.DeleteResponse{Success: true}, nil
+}
+
+func write(t *testing.T, entries ...*Entry) *bytes.Buffer {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, e := range entries {
+		require.NoError(t, encoder.Encode(e))
+	}
+	return &buf
+}
+
+var start = time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC)
+
+var artifact = Artifact{Package: "src/core", Target: "core", File: "core.a"}
+
+func storeEntry(offset time.Duration, size int64) *Entry {
+	a := artifact
+	a.Size = size
+	return &Entry{Version: Version, Time: start.Add(offset), Op: Store, OS: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: []Artifact{a}, Size: size, Success: true}
+}
+
+func retrieveEntry(offset time.Duration, success bool) *Entry {
+	return &Entry{Version: Version, Time: start.Add(offset), Op: Retrieve, OS: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: []Artifact{artifact}, Success: success}
+}
+
+func TestReplay(t *testing.T) {
+	client := newFakeClient()
+	results, err := Replay(client, write(t,
+		retrieveEntry(0, false),
+		storeEntry(time.Millisecond, 100),
+		retrieveEntry(2*time.Millisecond, true),
+		retrieveEntry(3*time.Millisecond, false), // This one will mismatch, since the fake never evicted it.
+		&Entry{Version: Version, Time: start.Add(4 * time.Millisecond), Op: Delete, OS: "linux", Arch: "amd64", Everything: true, Success: true},
+		&Entry{Version: Version, Time: start.Add(5 * time.Millisecond), Op: "wibble"},
+		&Entry{Version: Version + 1, Time: start.Add(6 * time.Millisecond), Op: Store},
+	), ReplayOptions{Speed: 1, Timeout: time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, 2, results.Skipped)
+	assert.Equal(t, 1, results.Ops[Store].Count)
+	assert.Equal(t, 3, results.Ops[Retrieve].Count)
+	assert.Equal(t, 1, results.Ops[Retrieve].Mismatches)
+	assert.Equal(t, 0, results.Ops[Retrieve].Errors)
+	assert.Equal(t, 1, results.Ops[Delete].Count)
+	assert.Equal(t, 1, client.deletes)
+	require.Equal(t, 1, len(client.stores))
+	assert.Equal(t, 100, len(client.stores[0].Artifacts[0].Body), "Stores are replayed with contents of the original size")
+	assert.Contains(t, results.String(), "retrieve: 3, 0 errors, 1 with a different outcome")
+}
+
+func TestReplayGeneratesSameContents(t *testing.T) {
+	client := newFakeClient()
+	_, err := Replay(client, write(t, storeEntry(0, 100), storeEntry(0, 100)), ReplayOptions{Timeout: time.Second})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(client.stores))
+	assert.Equal(t, client.stores[0].Artifacts[0].Body, client.stores[1].Artifacts[0].Body, "Storing the same artifact again shouldn't look like a collision")
+
+	e := storeEntry(0, 100)
+	e.Hash = []byte("hash2")
+	assert.NotEqual(t, client.stores[0].Artifacts[0].Body, body(e, e.Artifacts[0]))
+}
+
+func TestReplayCapturedBodies(t *testing.T) {
+	client := newFakeClient()
+	e := storeEntry(0, 4)
+	e.Artifacts[0].Body = []byte("abcd")
+	_, err := Replay(client, write(t, e), ReplayOptions{Timeout: time.Second})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(client.stores))
+	assert.Equal(t, []byte("abcd"), client.stores[0].Artifacts[0].Body)
+}
+
+func TestReplaySpeed(t *testing.T) {
+	log := func() *bytes.Buffer {
+		return write(t, retrieveEntry(0, false), retrieveEntry(400*time.Millisecond, false))
+	}
+	results, err := Replay(newFakeClient(), log(), ReplayOptions{Speed: 2, Timeout: time.Second})
+	require.NoError(t, err)
+	assert.True(t, results.Elapsed >= 200*time.Millisecond, "Took %s", results.Elapsed)
+	assert.True(t, results.Elapsed < 400*time.Millisecond, "Took %s", results.Elapsed)
+
+	results, err = Replay(newFakeClient(), log(), ReplayOptions{Timeout: time.Second})
+	require.NoError(t, err)
+	assert.True(t, results.Elapsed < 200*time.Millisecond, "Took %s", results.Elapsed)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+
+	pb "cache/proto/rpc_cache"
+	"cli"
+	"tools/cache/dial"
+	"tools/cache/oplog"
+)
+
+var log = logging.MustGetLogger("rpc_cache_replay")
+
+var opts struct {
+	cli.ConfigFileFlag
+	Usage       string       `usage:"rpc_cache_replay replays the operation logs written by the RPC cache servers' --operation_log flag against another server, and reports how its latency and results compare to the original."`
+	URL         string       `short:"u" long:"url" required:"true" description:"URL of the cache server to replay against"`
+	Verbosity   int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	Speed       float64      `short:"s" long:"speed" default:"1" description:"How many times faster than originally to replay operations. 0 replays them as fast as possible, subject to --concurrency."`
+	Concurrency int          `short:"c" long:"concurrency" default:"100" description:"Maximum number of requests to have in flight at once"`
+	Timeout     cli.Duration `long:"timeout" default:"30s" description:"Timeout for each individual request"`
+	MaxMsgSize  cli.ByteSize `long:"max_msg_size" default:"200M" description:"Maximum message size to send / receive"`
+	Args        struct {
+		Files []string `positional-arg-name:"files" description:"Operation log files to replay, in order. Reads stdin if none are given."`
+	} `positional-args:"true"`
+
+	TLSFlags dial.TLSFlags `group:"Options controlling TLS communication & authentication"`
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Please RPC cache replay", "5.5.0", &opts)
+	cli.InitLogging(opts.Verbosity)
+	var r io.Reader = os.Stdin
+	if len(opts.Args.Files) > 0 {
+		// Rotated logs follow on from one another, so replay them as one.
+		readers := make([]io.Reader, len(opts.Args.Files))
+		for i, filename := range opts.Args.Files {
+			file, err := os.Open(filename)
+			if err != nil {
+				log.Fatalf("Failed to open %s: %s", filename, err)
+			}
+			defer file.Close()
+			readers[i] = file
+		}
+		r = io.MultiReader(readers...)
+	}
+	conn, err := dial.Dial(opts.URL, time.Duration(opts.Timeout), int(opts.MaxMsgSize), opts.TLSFlags)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	client := pb.NewRpcCacheClient(conn)
+	log.Notice("Replaying against %s at %gx speed...", opts.URL, opts.Speed)
+	results, err := oplog.Replay(client, r, oplog.ReplayOptions{
+		Speed:       opts.Speed,
+		Concurrency: opts.Concurrency,
+		Timeout:     time.Duration(opts.Timeout),
+	})
+	fmt.Print(results.String())
+	if err != nil {
+		log.Fatalf("Failed to read operation log: %s", err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tools/cache/server"
+)
+
+// A configReport is the result of validating the configuration.
+type configReport struct {
+	// errors are problems that stop the server starting or working properly.
+	errors []string
+	// warnings are things that are probably mistakes, such as options that have no effect.
+	warnings []string
+}
+
+func (r *configReport) errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *configReport) warningf(format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+// A flagValue is the value of a flag, named for reporting problems with it.
+type flagValue struct {
+	flag  string
+	value interface{}
+}
+
+// validateConfig checks the options for mistakes, without binding any ports or scanning the cache.
+// If thorough is true it also checks things that startup otherwise only finds out later (or while
+// running), which can mean touching the filesystem or running the --kms command: that the
+// directories and files we write to are writable, the TLS options, and that the certificates and
+// encryption key can be loaded.
+func validateConfig(thorough bool) *configReport {
+	r := &configReport{}
+	validateTLS(r, thorough)
+
+	if opts.CleanFlags.LowWaterMark > opts.CleanFlags.HighWaterMark {
+		r.errorf("--low_water_mark (%d bytes) must not be above --high_water_mark (%d bytes)", opts.CleanFlags.LowWaterMark, opts.CleanFlags.HighWaterMark)
+	}
+	if opts.CleanFlags.TargetFreeSpace != 0 && opts.CleanFlags.TargetFreeSpace < opts.CleanFlags.MinFreeSpace {
+		r.errorf("--target_free_space (%d bytes) must not be below --min_free_space (%d bytes)", opts.CleanFlags.TargetFreeSpace, opts.CleanFlags.MinFreeSpace)
+	}
+	if err := server.CheckSlidingTTL(time.Duration(opts.CleanFlags.SlidingTTL), time.Duration(opts.CleanFlags.MaxLifetime)); err != nil {
+		r.errorf("Invalid --sliding_ttl / --max_lifetime: %s", err)
+	}
+	if opts.CleanFlags.MaxCleanFraction < 0 || opts.CleanFlags.MaxCleanFraction > 1 {
+		r.errorf("--max_clean_fraction must be between 0 and 1, was %v", opts.CleanFlags.MaxCleanFraction)
+	}
+	if opts.ScrubInterval < 0 {
+		r.errorf("--scrub_frequency must not be negative")
+	}
+	if opts.CleanFlags.AtimeInterval < 0 {
+		r.errorf("--persist_access_times must not be negative")
+	}
+	if opts.CleanFlags.GhostCacheSize < 0 {
+		r.errorf("--ghost_cache_size must not be negative")
+	}
+	if opts.DrainTimeout <= 0 {
+		r.errorf("--shutdown_timeout must be positive")
+	}
+	if opts.TargetStats < 0 {
+		r.errorf("--target_stats must not be negative")
+	}
+	if opts.CleanFlags.MaxCleanFraction > 0 && opts.CleanFlags.CleanLeaseTTL <= 0 {
+		r.errorf("--clean_lease_ttl must be positive")
+	}
+	if f := opts.EvictionFlags; f.Eviction == "cost" && (f.FrequencyWeight < 0 || f.CostWeight < 0 || f.DefaultCost < 0) {
+		r.errorf("--eviction_frequency_weight, --eviction_cost_weight and --eviction_default_cost must not be negative")
+	}
+	if _, err := server.KeyNormalizations(opts.NormalizeKeys); err != nil {
+		r.errorf("Invalid --normalize_keys: %s", err)
+	}
+	if _, err := server.NewLayout(opts.Layout); err != nil {
+		r.errorf("Invalid --layout: %s", err)
+	}
+	if opts.MigrateFrom != "" {
+		if _, err := server.NewLayout(opts.MigrateFrom); err != nil {
+			r.errorf("Invalid --migrate_from_layout: %s", err)
+		}
+	}
+	if opts.EncryptionKey != "" && opts.KMS != "" {
+		r.errorf("Pass only one of --encryption_key and --kms")
+	} else if thorough {
+		if _, err := server.ReadEncryptionKey(opts.EncryptionKey, opts.KMS); err != nil {
+			r.errorf("Failed to read encryption key: %s", err)
+		}
+	}
+	if opts.ConnectionFlags.ShedLatency > 0 && opts.ConnectionFlags.ShedWindow <= 0 {
+		r.errorf("--shed_latency needs a positive --shed_window")
+	}
+	if f := opts.ConnectionFlags; f.MaxStores < 0 || f.ClientStores < 0 || f.MaxRetrieves < 0 || f.ClientReads < 0 {
+		r.errorf("--max_concurrent_stores, --max_client_stores, --max_concurrent_retrieves and --max_client_retrieves must not be negative")
+	} else if f.LimitsFile != "" && thorough {
+		if _, err := server.ReadConcurrencyLimits(f.LimitsFile, server.ConcurrencyLimits{}); err != nil {
+			r.errorf("%s", err)
+		}
+	}
+	if opts.MirrorDir != "" && within(opts.MirrorDir, opts.Dir) {
+		r.errorf("--mirror_dir (%s) must not be inside --dir (%s)", opts.MirrorDir, opts.Dir)
+	}
+	if f := opts.StorageFlags; len(f.Routes) > 0 && f.Backend != "local" {
+		r.errorf("Pass only one of --storage and --storage_route")
+	} else if len(f.Routes) > 0 && thorough {
+		if _, err := newStorage(); err != nil {
+			r.errorf("Invalid --storage_route: %s", err)
+		}
+	} else if f.Backend == "dir" && f.Dir == "" {
+		r.errorf("--storage=dir needs --storage_dir")
+	} else if f.Backend == "dir" && within(f.Dir, opts.Dir) {
+		r.errorf("--storage_dir (%s) must not be inside --dir (%s)", f.Dir, opts.Dir)
+	} else if f.Backend == "s3" && f.Bucket == "" {
+		r.errorf("--storage=s3 needs --s3_bucket")
+	} else if f.Backend == "s3" && thorough {
+		if _, err := newStorage(); err != nil {
+			r.errorf("Invalid S3 storage: %s", err)
+		}
+	} else if f.Backend == "local" && (f.Dir != "" || f.Bucket != "") {
+		r.warningf("--storage_dir and --s3_bucket have no effect with --storage=local")
+	}
+	if opts.StrictSums && !opts.VerifySums {
+		r.warningf("--strict_checksums has no effect without --verify_checksums")
+	}
+	if opts.EnableFaults && opts.GatewayPort == 0 {
+		r.errorf("--enable_fault_injection needs --gateway_port to configure the faults on")
+	}
+	if opts.UpstreamFlags.Addr != "" && opts.UpstreamFlags.Timeout <= 0 {
+		r.errorf("--upstream_timeout must be positive")
+	} else if opts.UpstreamFlags.Addr == "" && opts.UpstreamFlags.ReadOnly {
+		r.warningf("--upstream_readonly has no effect without --upstream_addr")
+	}
+	if (opts.UpstreamFlags.Cert == "") != (opts.UpstreamFlags.Key == "") {
+		r.errorf("--upstream_cert and --upstream_key must be given together")
+	}
+	if opts.UpstreamFlags.Addr == "" && (opts.UpstreamFlags.CACert != "" || opts.UpstreamFlags.Cert != "") {
+		r.warningf("--upstream_ca_cert and --upstream_cert have no effect without --upstream_addr")
+	} else if strings.HasPrefix(opts.UpstreamFlags.Addr, "http://") && (opts.UpstreamFlags.CACert != "" || opts.UpstreamFlags.Cert != "") {
+		r.warningf("--upstream_ca_cert and --upstream_cert have no effect on an http:// --upstream_addr")
+	}
+	validatePorts(r)
+	validateCluster(r)
+
+	if thorough {
+		checkPath(r, "--dir", opts.Dir, true)
+		checkPath(r, "--mirror_dir", opts.MirrorDir, true)
+		if opts.StorageFlags.Backend == "dir" {
+			checkPath(r, "--storage_dir", opts.StorageFlags.Dir, true)
+		}
+		checkPath(r, "--profile_dir", opts.ProfileFlags.Dir, true)
+		checkPath(r, "--log_file", opts.LogFile, false)
+		checkPath(r, "--audit_log", opts.AuditLog, false)
+		checkPath(r, "--operation_log", opts.OperationLog, false)
+		if clustered() && opts.ClusterFlags.RetryQueueSize > 0 {
+			checkPath(r, "--replication_retry_dir", opts.ClusterFlags.RetryDir, true)
+		}
+	}
+	return r
+}
+
+// validateTLS checks the TLS options.
+func validateTLS(r *configReport, thorough bool) {
+	key, keyErr := server.ReadTLSMaterial(opts.TLSFlags.KeyFile, opts.TLSFlags.KeyEnv)
+	cert, certErr := server.ReadTLSMaterial(opts.TLSFlags.CertFile, opts.TLSFlags.CertEnv)
+	caCert, caCertErr := server.ReadTLSMaterial(opts.TLSFlags.CACertFile, opts.TLSFlags.CACertEnv)
+	for _, m := range []struct {
+		name string
+		err  error
+	}{{"key", keyErr}, {"cert", certErr}, {"ca_cert", caCertErr}} {
+		if m.err != nil {
+			r.errorf("Failed to read %s: %s (pass only one of --%s_file and --%s_env)", m.name, m.err, m.name, m.name)
+		}
+	}
+	if (len(key) == 0) != (len(cert) == 0) {
+		r.errorf("Must pass both a key and a cert if you pass one")
+	} else if len(key) == 0 && (opts.TLSFlags.WritableCerts != "" || opts.TLSFlags.ReadonlyCerts != "") {
+		r.errorf("You can only use --writable_certs / --readonly_certs with https (--key_file and --cert_file)")
+	} else if len(key) == 0 && (opts.TLSFlags.MinVersion != "" || opts.TLSFlags.CipherSuites != "") {
+		r.errorf("You can only use --tls_min_version / --tls_cipher_suites with https (--key_file and --cert_file)")
+	} else if len(key) == 0 && len(caCert) != 0 {
+		r.warningf("--ca_cert_file / --ca_cert_env have no effect without a key and cert")
+	}
+	if opts.TLSFlags.CertReload <= 0 {
+		r.errorf("--cert_reload_interval must be positive")
+	}
+	if !thorough {
+		return
+	}
+	var cipherSuites []string
+	if opts.TLSFlags.CipherSuites != "" {
+		cipherSuites = strings.Split(opts.TLSFlags.CipherSuites, ",")
+	}
+	if err := server.SetTLSOptions(opts.TLSFlags.MinVersion, cipherSuites); err != nil {
+		r.errorf("Invalid TLS options: %s", err)
+	} else if len(key) != 0 && len(cert) != 0 {
+		if _, err := server.TLSConfig(key, cert, caCert); err != nil {
+			r.errorf("%s", err)
+		}
+	}
+	for _, certs := range []flagValue{{"--writable_certs", opts.TLSFlags.WritableCerts}, {"--readonly_certs", opts.TLSFlags.ReadonlyCerts}} {
+		if certs.value != "" {
+			if err := server.CheckCertificates(certs.value.(string)); err != nil {
+				r.errorf("Invalid %s: %s", certs.flag, err)
+			}
+		}
+	}
+}
+
+// validatePorts checks the address we serve on, and that none of the ports clash.
+func validatePorts(r *configReport) {
+	if _, err := server.ParseBindAddress(opts.BindAddr); err != nil {
+		r.errorf("%s", err)
+	}
+	ports := []flagValue{
+		{"--port", opts.Port},
+		{"--http_port", opts.HTTPPort},
+		{"--metrics_port", opts.MetricsPort},
+		{"--gateway_port", opts.GatewayPort},
+	}
+	if clustered() {
+		ports = append(ports, flagValue{"--cluster_port", opts.ClusterFlags.ClusterPort})
+	}
+	seen := map[int]string{}
+	for _, p := range ports {
+		port := p.value.(int)
+		if port == 0 {
+			continue
+		} else if port < 0 || port > 65535 {
+			r.errorf("%s must be between 1 and 65535, was %d", p.flag, port)
+		} else if flag, present := seen[port]; present {
+			r.errorf("%s and %s are both %d", flag, p.flag, port)
+		}
+		seen[port] = p.flag
+	}
+}
+
+// validateCluster checks the clustering options.
+func validateCluster(r *configReport) {
+	f := opts.ClusterFlags
+	if f.SeedCluster && f.ClusterSize < 2 {
+		r.errorf("You must pass a cluster size of > 1 when initialising the seed node.")
+	} else if f.SeedIf != "" && f.SeedIf == f.NodeName && f.ClusterSize < 2 {
+		r.warningf("This node seeds the cluster if --cluster_addresses doesn't resolve (--seed_if matches --node_name), which needs a cluster size of > 1")
+	}
+	if f.SeedCluster && f.ClusterAddresses != "" {
+		r.warningf("--cluster_addresses has no effect with --seed_cluster")
+	}
+	if f.AdvertiseAddr != "" && net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(f.AdvertiseAddr, "["), "]")) == nil {
+		r.errorf("--advertise_addr must be an IP address, was %s", f.AdvertiseAddr)
+	}
+	if f.ReplicationFactor < 1 {
+		r.errorf("--replication_factor must be at least 1")
+	} else if f.SeedCluster && f.ClusterSize >= 2 && f.ReplicationFactor > f.ClusterSize {
+		r.warningf("--replication_factor (%d) is more than the cluster size (%d), artifacts will only be stored on every node", f.ReplicationFactor, f.ClusterSize)
+	}
+	if f.ReplicationCheck < 0 {
+		r.errorf("--replication_check_interval must not be negative")
+	}
+	if f.ReadWeight < 0 {
+		r.errorf("--read_weight must not be negative")
+	}
+	if f.ReadinessSamples > 0 && !f.StrictReadiness {
+		r.warningf("--readiness_samples has no effect without --strict_readiness")
+	}
+	if f.RestartTokenTTL <= 0 {
+		r.errorf("--restart_token_ttl must be positive")
+	}
+	if f.RetryQueueSize > 0 && clustered() && within(f.RetryDir, opts.Dir) {
+		r.errorf("--replication_retry_dir (%s) must not be inside --dir (%s)", f.RetryDir, opts.Dir)
+	}
+	if !clustered() {
+		for _, set := range []flagValue{
+			{"--strict_readiness", f.StrictReadiness},
+			{"--join_grace_period", f.JoinGracePeriod > 0},
+			{"--read_only_on_partition", f.ReadOnlyOnPartition},
+			{"--failover_delay", f.FailoverDelay > 0},
+			{"--max_clean_fraction", opts.CleanFlags.MaxCleanFraction > 0},
+			{"--read_weight", f.ReadWeight > 0},
+			{"--replication_factor", f.ReplicationFactor != 2},
+		} {
+			if set.value.(bool) {
+				r.warningf("%s has no effect without clustering (--seed_cluster or --cluster_addresses)", set.flag)
+			}
+		}
+	}
+}
+
+// clustered returns true if we're configured to seed or join a cluster.
+func clustered() bool {
+	return opts.ClusterFlags.SeedCluster || opts.ClusterFlags.ClusterAddresses != "" || opts.ClusterFlags.SeedIf != ""
+}
+
+// within returns true if the given path is the same as, or inside, the given directory.
+func within(p, dir string) bool {
+	p, err1 := filepath.Abs(p)
+	dir, err2 := filepath.Abs(dir)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// newStorage returns the storage backend configured by --storage or --storage_route, or nil if it's local.
+func newStorage() (server.Storage, error) {
+	f := opts.StorageFlags
+	s3 := server.S3Config{Bucket: f.Bucket, Endpoint: f.Endpoint, Region: f.Region}
+	if len(f.Routes) > 0 {
+		routes := make([]server.StorageRoute, len(f.Routes))
+		for i, spec := range f.Routes {
+			route, err := server.ParseStorageRoute(spec, s3)
+			if err != nil {
+				return nil, err
+			}
+			routes[i] = route
+		}
+		return server.NewRoutedStorage(routes)
+	}
+	switch f.Backend {
+	case "dir":
+		return server.NewDiskStorage(f.Dir), nil
+	case "s3":
+		return server.NewS3Storage(s3)
+	}
+	return nil, nil
+}
+
+// checkPath reports an error for the given flag if we can't write to the given directory or file,
+// or create it if it doesn't exist yet. It does nothing if the path is empty.
+func checkPath(r *configReport, flag, p string, dir bool) {
+	if p == "" {
+		return
+	}
+	var err error
+	if dir {
+		err = checkWritableDir(p)
+	} else {
+		err = checkWritableFile(p)
+	}
+	if err != nil {
+		r.errorf("Can't write to %s %s: %s", flag, p, err)
+	}
+}
+
+// checkWritableDir returns an error if we can't create files in the given directory, or if it
+// doesn't exist, create it.
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if parent := filepath.Dir(filepath.Clean(dir)); parent != dir {
+			return checkWritableDir(parent)
+		}
+		return err
+	} else if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".check_config")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkWritableFile returns an error if we can't append to the given file, or if it doesn't
+// exist, create it.
+func checkWritableFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	if os.IsNotExist(err) {
+		return checkWritableDir(filepath.Dir(filename))
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkConfig validates the configuration thoroughly, prints a report of any problems and returns
+// the status to exit with.
+func checkConfig() int {
+	r := validateConfig(true)
+	for _, w := range r.warnings {
+		fmt.Printf("Warning: %s\n", w)
+	}
+	for _, e := range r.errors {
+		fmt.Printf("Error: %s\n", e)
+	}
+	if len(r.errors) > 0 {
+		fmt.Printf("Configuration is invalid: %d errors, %d warnings\n", len(r.errors), len(r.warnings))
+		return 1
+	}
+	fmt.Printf("Configuration is valid (%d warnings)\n", len(r.warnings))
+	return 0
+}
@@ -1,77 +1,436 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/op/go-logging.v1"
 
 	"cli"
+	"tools/cache/audit"
 	"tools/cache/cluster"
+	"tools/cache/dial"
+	"tools/cache/oplog"
 	"tools/cache/server"
 )
 
 var log = logging.MustGetLogger("rpc_cache_server")
 
+// version is the version of the server, which it reports to clients.
+const version = "5.5.0"
+
 var opts struct {
-	Usage       string `usage:"rpc_cache_server is a server for Please's remote RPC cache.\n\nSee https://please.build/cache.html for more information."`
-	Port        int    `short:"p" long:"port" description:"Port to serve on" default:"7677"`
-	HTTPPort    int    `long:"http_port" description:"Port to serve HTTP on (for profiling, metrics etc)"`
-	MetricsPort int    `long:"metrics_port" description:"Port to serve Prometheus metrics on"`
-	Dir         string `short:"d" long:"dir" description:"Directory to write into" default:"plz-rpc-cache"`
-	Verbosity   int    `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
-	LogFile     string `long:"log_file" description:"File to log to (in addition to stdout)"`
+	cli.ConfigFileFlag
+	Usage         string       `usage:"rpc_cache_server is a server for Please's remote RPC cache.\n\nSee https://please.build/cache.html for more information."`
+	Port          int          `short:"p" long:"port" description:"Port to serve on" default:"7677"`
+	BindAddr      string       `long:"bind_addr" description:"IP address to serve on, IPv4 or IPv6 (with or without brackets). Applies to --http_port, --metrics_port and --gateway_port too. By default all interfaces are used."`
+	HTTPPort      int          `long:"http_port" description:"Port to serve HTTP on (for profiling, metrics etc). Serves /healthz and /readyz for liveness and readiness probes; /readyz fails, with the reason, until the cache directory has been scanned and (if clustered) this node has joined the cluster and seen it at its full size, and while in maintenance mode."`
+	MetricsPort   int          `long:"metrics_port" description:"Port to serve Prometheus metrics on"`
+	GatewayPort   int          `long:"gateway_port" description:"Port to serve a REST gateway on, for clients that can't use gRPC. Artifacts are read and written with GET and PUT on /artifact/<path>. GET /entries?prefix=<prefix> lists the files in the cache and DELETE /entry/<path> deletes one, on every node if clustered (pass local=true to only delete it here). POST /clean cleans this node immediately rather than waiting for --clean_frequency, and responds with how much it freed. POST /readonly?enabled=true or false switches this node to refusing stores or back, as for --read_only. POST /maintenance?enabled=true or false puts this node into maintenance mode or takes it out: it fails /readyz, refuses RPCs, stops cleaning and isn't replicated to by other nodes, but stays in the cluster; the current mode is shown by / and /cluster on --http_port. POST /restart responds whether it's safe to restart this node without leaving anything unavailable, taking the cluster's restart token if it is (see --restart_token_ttl), and DELETE /restart releases it. With --enable_fault_injection, /faults configures the faults to inject. Deleting, cleaning, switching modes, restarting and configuring faults need a writable certificate. Uses the same TLS settings and certificates as the RPC server."`
+	Dir           string       `short:"d" long:"dir" description:"Directory to write into" default:"plz-rpc-cache"`
+	Verbosity     int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	LogFile       string       `long:"log_file" description:"File to log to (in addition to stdout)"`
+	LogJSON       bool         `long:"log_json" description:"Log one JSON object per line, with the time, level and message and fields such as the node name, artifact key and client, instead of plain text. Applies to --log_file too."`
+	CheckConfig   bool         `long:"check_config" description:"Validate the configuration, report any problems and exit, without binding any ports or scanning the cache. Exits with a non-zero status if there are errors. As well as the checks made at startup, this checks that the directories and files given can be written to and that the certificates and encryption key can be loaded."`
+	MirrorDir     string       `long:"mirror_dir" description:"Directory to copy every stored artifact to in the background, e.g. a snapshotted network mount. It has the same layout as --dir so can seed a replacement cache. Copies are dropped if they fall too far behind, and the mirror is never cleaned."`
+	AuditLog      string       `long:"audit_log" description:"File to append a record of every artifact evicted from the cache to, with its size and why it was removed. Reopened on SIGHUP so it can be rotated. Query it with cache_audit."`
+	OperationLog  string       `long:"operation_log" description:"File to append a record of every store, retrieve and delete handled to, with the keys and sizes involved and how long each took. Reopened on SIGHUP so it can be rotated. Replay it against another server with rpc_cache_replay."`
+	OpLogBodies   bool         `long:"operation_log_bodies" description:"Record the contents of stored artifacts in the operation log too, so they're replayed exactly. The log then grows as fast as the cache does; by default only their sizes are recorded and replays store generated contents."`
+	Compression   bool         `long:"allow_compression" description:"Allow clients to request gzip compression of RPCs. It's only applied to calls where the client asks for it."`
+	DedupWindow   cli.Duration `long:"store_dedup_window" description:"Stores of identical artifacts within this long of one another are only written (and replicated) once. Absorbs retries from clients that time out while a store is in progress. By default stores are never deduplicated."`
+	ReadOnly      bool         `long:"read_only" description:"Refuse all stores from clients; artifacts can still be retrieved and are cleaned as normal. Clients are told the cache is read-only and skip storing to it. It can also be switched at runtime with POST /readonly?enabled=true (or false) on --gateway_port, e.g. during disk maintenance. The current mode is at /stats/mode on --http_port and in the plz_cache_read_only metric."`
+	StrictStore   bool         `long:"reject_key_collisions" description:"Refuse to store an artifact if a different one is already stored under the same key. Either way these are logged and counted in the plz_cache_key_collisions_total metric."`
+	NormalizeKeys []string     `long:"normalize_keys" choice:"separators" choice:"trailing_slash" choice:"lowercase" description:"Normalization to apply to artifact keys on every store and retrieve, so keys that differ only trivially map to the same artifact. Can be repeated. separators converts backslashes to slashes and collapses repeated ones, trailing_slash strips trailing slashes, and lowercase folds keys to lower case (for clients on case-insensitive filesystems). By default keys are used exactly as given."`
+	Layout        string       `long:"layout" default:"default" description:"Layout of artifacts on disk, to match what other tools expect. One of default (os_arch/package/target/hash), split_arch (os/arch/package/target/hash), by_package (package/target/os_arch/hash) or sharded (os_arch/package/target/first two characters of hash/hash, for targets built very many times), or a template of {os}, {arch}, {package}, {target}, {shard} and {hash} ending in /{hash} or /{shard}/{hash}, e.g. {package}/{target}/{os}-{arch}/{hash}. Changing it on an existing cache leaves the artifacts already stored unreachable until they're cleaned, unless --migrate_from_layout is given."`
+	MigrateFrom   string       `long:"migrate_from_layout" description:"Layout that artifacts already in --dir are stored in, as --layout, to move them into --layout in the background while serving. Until that's finished, artifacts not yet moved are still found in the old layout. Each is checked after it's moved and before the original is removed, so the server can be restarted part way through and it carries on. Progress is logged and at /stats/migration on --http_port; once it's reported finished with nothing failed, this can be dropped."`
+	EncryptionKey string       `long:"encryption_key" description:"File containing a 32-byte master key (optionally hex or base64 encoded) to encrypt artifacts at rest with. Each artifact is encrypted with its own data key, which is wrapped with this one. Artifacts already stored unencrypted are still served. By default artifacts aren't encrypted."`
+	KMS           string       `long:"kms" description:"Command to run at startup to get the master key for encrypting artifacts at rest, e.g. one that decrypts it with a KMS. It should print the key in the same form as --encryption_key. Alternative to --encryption_key."`
+	VerifySums    bool         `long:"verify_checksums" description:"Check every artifact against the checksum stored with it each time it's retrieved. Any that don't match (e.g. after a disk fault) are deleted and treated as a miss, so clients rebuild them instead of getting something corrupt. Costs an extra pass over each file; --scrub_frequency checks them in the background instead. Corruption is counted in the plz_cache_corrupt_artifacts_total metric."`
+	SumAlgorithm  string       `long:"checksum_algorithm" choice:"crc32c" choice:"sha256" default:"crc32c" description:"Algorithm to checksum artifacts with when they're stored and to verify them against. crc32c is the cheapest; sha256 makes undetected corruption vanishingly unlikely. Artifacts already stored with a different one can't be verified after it's changed, and are counted in the plz_cache_unverifiable_artifacts_total metric; see --strict_checksums for whether they're still served."`
+	StrictSums    bool         `long:"strict_checksums" description:"With --verify_checksums, refuse to serve artifacts that can't be verified because their checksums were made with an algorithm other than --checksum_algorithm, treating them as misses. By default they're served unverified, with a warning, so changing the algorithm doesn't turn the whole cache into misses. They're never deleted either way."`
+	ScrubInterval cli.Duration `long:"scrub_frequency" description:"Check every artifact in the cache against its checksum this often, deleting any that don't match and counting them in the plz_cache_corrupt_artifacts_total metric. Works whether or not --verify_checksums is set. By default the cache isn't scrubbed."`
+	StoreCompress string       `long:"compression" choice:"none" choice:"gzip" default:"none" description:"Compress artifacts on disk with this codec. They're decompressed when they're retrieved, so clients aren't affected, and any that wouldn't get smaller are stored as they are. So is anything whose first 16KB barely compresses (e.g. zips, jars and images, which are compressed already), without spending the CPU compressing all of it; these are counted in the plz_cache_compression_skipped_total metric. The cache's size (and so its water marks) counts what they take up on disk. Artifacts already stored uncompressed are still served, so it can be turned on or off on an existing cache."`
+	CompressLevel int          `long:"compression_level" description:"Level to compress artifacts on disk at with --compression, trading CPU for size. For gzip it's from 1 (fastest) to 9 (smallest). On a ~20MB Go test binary, typical of build outputs, levels 1, 3, 5, 6, 8 and 9 shrink it to 58%, 56%, 54%, 54%, 53% and 53% of its size at 100, 96, 79, 60, 36 and 7 MB/s respectively, so level 1 is best on busy nodes and the levels above 5 are rarely worth it. Artifacts can be read whatever level they were stored at, so it can be changed on an existing cache. By default the codec's default level is used."`
+	TargetStats   int          `long:"target_stats" default:"1000" description:"Track the hit ratio of up to this many of the most frequently retrieved targets, reported worst first at /stats/targets on --http_port, e.g. to find nondeterministic rules. Memory use is bounded by this but the counts for less frequently retrieved targets are approximate. Zero disables it."`
+	EnableFaults  bool         `long:"enable_fault_injection" description:"Allow faults (errors, latency and dropped replications) to be injected for chaos testing, configured at runtime through /faults on --gateway_port, which needs a writable certificate. None are injected until they're configured there. Never use this in production."`
+	DrainTimeout  cli.Duration `long:"shutdown_timeout" default:"30s" description:"On SIGTERM or SIGINT, stop accepting RPCs and wait up to this long for those in progress to finish, and for pending writes to reach the disk, before leaving the cluster and exiting. Any still going by then are cut off."`
+
+	ConnectionFlags struct {
+		MaxConnections int          `long:"max_connections" description:"Maximum number of concurrent client connections. Any beyond this are refused. By default there is no limit."`
+		ListenBacklog  int          `long:"listen_backlog" description:"Maximum length of the queue of pending connections. By default the system's limit is used."`
+		MaxConnIdle    cli.Duration `long:"max_connection_idle" description:"Close client connections that haven't had any RPCs in this long. Clients are sent a GOAWAY first and reconnect when they next need to, so this stops long-lived clients leaking idle connections. Exported as the plz_cache_reaped_connections_total and plz_cache_connection_age_seconds metrics. By default idle connections are kept open."`
+		MaxArtifact    cli.ByteSize `long:"max_artifact_size" description:"Reject stores of any artifact larger than this with InvalidArgument, over both the RPC server and REST gateway, without writing any of it. Stores over the gateway stop being read as soon as they pass it. Rejections are counted in the plz_cache_oversized_stores_total metric. By default the only limit is the maximum message size."`
+		MemoryBudget   cli.ByteSize `long:"transfer_memory_budget" description:"Maximum total size of the artifacts being stored & retrieved at once, shared between the RPC server and REST gateway. Transfers beyond it wait for others to finish, and fail if they reach their deadline first. Usage is exported as the plz_cache_transfer_memory_bytes metric. By default there is no limit."`
+		ShedLatency    cli.Duration `long:"shed_latency" description:"Reject stores with ResourceExhausted while the mean latency of stores & retrieves over the last --shed_window is above this, so a saturated disk doesn't make the whole node unresponsive. Exported as the plz_cache_disk_latency_seconds and plz_cache_shed_stores_total metrics. By default stores are never shed."`
+		ShedWindow     cli.Duration `long:"shed_window" default:"30s" description:"Period over which latency is averaged to decide whether to shed stores. It must stay high for a whole window before shedding starts."`
+		ShedMaxCost    float64      `long:"shed_max_cost" description:"Stores of artifacts with a rebuild cost (in seconds) above this are still accepted while shedding, since they're the most expensive to lose. By default all stores are shed."`
+		MaxStores      int          `long:"max_concurrent_stores" description:"Maximum number of Store RPCs to handle at once. Any beyond this are rejected with ResourceExhausted so clients back off. The number in progress is exported as the plz_cache_inflight_requests metric. By default there is no limit."`
+		ClientStores   int          `long:"max_client_stores" description:"Maximum number of Store RPCs to handle at once from any one client, identified by the common name of its certificate or otherwise its IP address, so one misbehaving client can't starve the others. The most from any client is exported as the plz_cache_max_client_inflight_requests metric. By default there is no limit."`
+		MaxRetrieves   int          `long:"max_concurrent_retrieves" description:"Maximum number of Retrieve RPCs to handle at once, as for --max_concurrent_stores. This would usually be higher than that. By default there is no limit."`
+		ClientReads    int          `long:"max_client_retrieves" description:"Maximum number of Retrieve RPCs to handle at once from any one client, as for --max_client_stores. By default there is no limit."`
+		LimitsFile     string       `long:"concurrency_limits_file" description:"JSON file of concurrency limits that override the four flags above, with any of the keys stores, client_stores, retrieves and client_retrieves. It's reread on SIGHUP so they can be changed without restarting."`
+	} `group:"Options controlling client connections"`
 
 	CleanFlags struct {
-		LowWaterMark   cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"18G"`
-		HighWaterMark  cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"20G"`
-		CleanFrequency cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean cache at" default:"10m"`
-		MaxArtifactAge cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
+		LowWaterMark     cli.ByteSize `short:"l" long:"low_water_mark" description:"Size of cache to clean down to" default:"18G"`
+		HighWaterMark    cli.ByteSize `short:"i" long:"high_water_mark" description:"Max size of cache to clean at" default:"20G"`
+		MinFreeSpace     cli.ByteSize `long:"min_free_space" description:"Also clean the cache when the filesystem it's on has less than this much space available, e.g. because it's shared with other data, until there's --target_free_space. Each clean removes as much as the more aggressive of this and the water marks calls for. By default only the water marks are used."`
+		TargetFreeSpace  cli.ByteSize `long:"target_free_space" description:"Space to leave available on the filesystem once cleaning for --min_free_space. Defaults to --min_free_space."`
+		CleanFrequency   cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean cache at" default:"10m"`
+		MaxArtifactAge   cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
+		CleanJitter      cli.Duration `long:"clean_jitter" description:"Staggers the clean schedule by up to this much. The offset is derived from the node name so is consistent for each node."`
+		MaxCleanFraction float64      `long:"max_clean_fraction" description:"If clustered, limits the fraction of the cluster that cleans at once. By default there is no limit."`
+		CleanLeaseTTL    cli.Duration `long:"clean_lease_ttl" default:"1h" description:"Longest a node counts towards --max_clean_fraction for during a single clean. If it hasn't finished by then (e.g. it's hung) other nodes stop waiting for it. Should be comfortably longer than a clean takes."`
+		CleanDryRun      bool         `long:"clean_dry_run" description:"Don't remove anything when cleaning, just log what would be removed and how big the cache would be afterwards. Each artifact is logged at info level (-v 3). The same is always available as JSON at /clean/preview on --http_port. For tuning the water marks before trusting them."`
+		CleanEmptyDirs   bool         `long:"clean_empty_dirs" description:"Remove directories that are left empty once their artifacts are cleaned. Keeps inode usage and startup scan time down on long-running caches."`
+		MinRetention     cli.Duration `long:"min_retention" description:"Never clean artifacts to get under the water marks until they've been stored for at least this long. The cache can exceed its high water mark while this is in effect."`
+		SlidingTTL       cli.Duration `long:"sliding_ttl" description:"Remove artifacts that haven't been retrieved in this long. Each retrieve extends it, up to --max_lifetime after the artifact was stored. Unlike --max_artifact_age this doesn't rely on the filesystem recording access times."`
+		MaxLifetime      cli.Duration `long:"max_lifetime" description:"Remove artifacts this long after they were stored, however recently they've been retrieved. Required with --sliding_ttl."`
+		MaxIndexEntries  int          `long:"max_index_entries" description:"Maximum number of files to track in memory. Beyond this the least recently read are looked up on disk when needed, which bounds memory usage on very large caches. By default there is no limit."`
+		ScanParallelism  int          `long:"scan_parallelism" default:"8" description:"Number of directories to read at once while scanning the existing cache at startup. Large caches on disks that handle concurrent reads well (e.g. SSDs) scan much faster with more. Progress is logged periodically while it runs."`
+		BackgroundScan   bool         `long:"background_scan" description:"Start serving straight away and scan the existing cache in the background, instead of waiting for the scan to finish first, to cut downtime restarting a very large cache. Until it's finished, artifacts it hasn't found yet are looked up directly on disk; the cleaner waits for it, --max_index_entries only applies once it's done, and any expiries, build keys and shadow keys it hasn't found yet don't take effect. Progress is logged and at /stats/scan on --http_port."`
+		GhostCacheSize   int          `long:"ghost_cache_size" description:"Remember this many of the files most recently evicted to get under the high water mark (just their paths and sizes) and count how often they're requested again, in the plz_cache_ghost_hits_total metric and the /stats/ page. Estimates how much a bigger cache would improve the hit ratio. By default they're not remembered."`
+		AtimeInterval    cli.Duration `long:"persist_access_times" default:"5m" description:"How often to write the times files were last read back to disk, so the cleaner still removes the least recently used first after a restart. Needed because most filesystems (e.g. those mounted noatime or relatime) don't record every read themselves. They're also written on a clean shutdown. Zero disables it."`
+		MaxSessionTTL    cli.Duration `long:"max_session_ttl" default:"1h" description:"Maximum time a build session can protect artifacts from being cleaned for without being renewed. Sessions expire after this long if the client that started them goes away."`
 	} `group:"Options controlling when to clean the cache"`
 
+	EvictionFlags struct {
+		Eviction        string       `long:"eviction" choice:"lru" choice:"cost" default:"lru" description:"Policy used to choose which artifacts to remove when cleaning. lru removes the least recently used; cost scores them on recency, read frequency, size and rebuild cost."`
+		HalfLife        cli.Duration `long:"eviction_half_life" default:"24h" description:"For cost eviction, time after which an artifact's score halves if it isn't read"`
+		FrequencyWeight float64      `long:"eviction_frequency_weight" default:"1" description:"For cost eviction, weight applied to the number of times an artifact has been read"`
+		CostWeight      float64      `long:"eviction_cost_weight" default:"1" description:"For cost eviction, weight applied to an artifact's rebuild cost (in seconds)"`
+		DefaultCost     float64      `long:"eviction_default_cost" default:"1" description:"For cost eviction, rebuild cost assumed for artifacts that weren't stored with one"`
+	} `group:"Options controlling which artifacts are removed when cleaning"`
+
 	TLSFlags struct {
-		KeyFile       string `long:"key_file" description:"File containing PEM-encoded private key."`
-		CertFile      string `long:"cert_file" description:"File containing PEM-encoded certificate"`
-		CACertFile    string `long:"ca_cert_file" description:"File containing PEM-encoded CA certificate"`
-		WritableCerts string `long:"writable_certs" description:"File or directory containing certificates that are allowed to write to the cache"`
-		ReadonlyCerts string `long:"readonly_certs" description:"File or directory containing certificates that are allowed to read from the cache"`
+		KeyFile       string       `long:"key_file" description:"File containing PEM-encoded private key. It's reloaded along with --cert_file and --ca_cert_file on SIGHUP and when they change, so they can be rotated without a restart; new connections use the new ones."`
+		CertFile      string       `long:"cert_file" description:"File containing PEM-encoded certificate"`
+		CACertFile    string       `long:"ca_cert_file" description:"File containing PEM-encoded CA certificate"`
+		KeyEnv        string       `long:"key_env" description:"Environment variable containing PEM-encoded private key. Alternative to --key_file."`
+		CertEnv       string       `long:"cert_env" description:"Environment variable containing PEM-encoded certificate. Alternative to --cert_file."`
+		CACertEnv     string       `long:"ca_cert_env" description:"Environment variable containing PEM-encoded CA certificate. Alternative to --ca_cert_file."`
+		WritableCerts string       `long:"writable_certs" description:"File or directory containing certificates that are allowed to write to the cache. Changes are picked up automatically, or immediately on SIGHUP."`
+		ReadonlyCerts string       `long:"readonly_certs" description:"File or directory containing certificates that are allowed to read from the cache. Changes are picked up automatically, or immediately on SIGHUP."`
+		MinVersion    string       `long:"tls_min_version" choice:"1.0" choice:"1.1" choice:"1.2" choice:"1.3" description:"Minimum TLS version to accept, for both the RPC server and HTTPS. Defaults to Go's default."`
+		CipherSuites  string       `long:"tls_cipher_suites" description:"Comma-separated list of TLS cipher suites to allow, by their standard names (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), for both the RPC server and HTTPS. They can't be configured for TLS 1.3. Defaults to Go's default."`
+		CertReload    cli.Duration `long:"cert_reload_interval" default:"30s" description:"How often to check --key_file, --cert_file and --ca_cert_file for changes"`
 	} `group:"Options controlling TLS communication & authentication"`
 
+	HeartbeatFlags struct {
+		URL      string       `long:"heartbeat_url" description:"URL to POST a heartbeat to periodically, describing this node's health as JSON, for monitors that alert when they stop receiving it."`
+		Interval cli.Duration `long:"heartbeat_interval" default:"1m" description:"Interval between heartbeats"`
+	} `group:"Options controlling heartbeats to an external monitor"`
+
+	ProfileFlags struct {
+		Dir         string       `long:"profile_dir" description:"Directory to write goroutine, heap and CPU profiles to when the server receives SIGUSR2. For capturing diagnostics without serving pprof over the network."`
+		CPUDuration cli.Duration `long:"profile_cpu_duration" default:"30s" description:"Length of the CPU profile written on SIGUSR2"`
+	} `group:"Options controlling profiling"`
+
+	MetricsFlags struct {
+		Timeout cli.Duration `long:"metrics_timeout" default:"10s" description:"Maximum time to spend gathering metrics for a request to --metrics_port. Requests that take longer get an error instead of waiting."`
+	} `group:"Options controlling Prometheus metrics"`
+
+	UpstreamFlags struct {
+		Addr       string       `long:"upstream_addr" description:"Address of another cache to retrieve artifacts from when they're missing from this one, which are then stored here too (in the background, so clients get them without waiting for that). Either the host:port of another rpc_cache_server or the URL of an HTTP cache (e.g. http://cache:8080). Stores are forwarded to it too, unless --upstream_readonly is passed. Results are counted in the plz_cache_upstream_requests_total metric."`
+		ReadOnly   bool         `long:"upstream_readonly" description:"Only retrieve artifacts from --upstream_addr; don't forward stores to it."`
+		Timeout    cli.Duration `long:"upstream_timeout" default:"10s" description:"Maximum time to spend on each request to --upstream_addr. Retrieves that miss here are held up by at most this much if it's unavailable."`
+		Freshness  cli.Duration `long:"upstream_freshness" description:"Revalidate artifacts against --upstream_addr once they've been stored here for this long: they're retrieved from it again when they're next retrieved here, so changes to it are picked up. If it doesn't have them they're served from here as normal. By default they're never revalidated."`
+		ServeStale bool         `long:"serve_stale_on_upstream_error" description:"Serve artifacts that are due to be revalidated (see --upstream_freshness) from here if --upstream_addr is unavailable, rather than treating them as missing and making clients rebuild them. Each time this happens is logged."`
+		CACert     string       `long:"upstream_ca_cert" description:"File containing the PEM-encoded CA certificate to verify --upstream_addr with, connecting to it over TLS. Without this or --upstream_cert an RPC upstream is connected to insecurely."`
+		Cert       string       `long:"upstream_cert" description:"File containing the PEM-encoded client certificate to present to --upstream_addr, connecting to it over TLS. Needs --upstream_key."`
+		Key        string       `long:"upstream_key" description:"File containing the PEM-encoded private key for --upstream_cert."`
+	} `group:"Options controlling an upstream cache"`
+
+	StorageFlags struct {
+		Backend  string   `long:"storage" choice:"local" choice:"dir" choice:"s3" default:"local" description:"Where to keep artifacts durably, besides --dir. With 'dir' or 's3' every stored artifact is also written to --storage_dir or --s3_bucket in the background, and artifacts missing from --dir are fetched back from there, so the cache survives losing its disk. --dir still serves reads and is cleaned as usual; the backend is cleaned to the same water marks, dropping the least recently stored artifacts first. Only artifacts are kept there, not their metadata. Requests are counted in the plz_cache_storage_requests_total metric."`
+		Dir      string   `long:"storage_dir" description:"Directory to keep artifacts in for --storage=dir, e.g. a persistent volume or network mount. Must not be inside --dir."`
+		Bucket   string   `long:"s3_bucket" description:"S3 bucket to keep artifacts in for --storage=s3. Credentials are read from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN."`
+		Endpoint string   `long:"s3_endpoint" description:"URL of the S3 service for --storage=s3, e.g. for an S3-compatible store like MinIO. Defaults to AWS's endpoint for --s3_region."`
+		Region   string   `long:"s3_region" default:"us-east-1" description:"Region of --s3_bucket."`
+		Routes   []string `long:"storage_route" description:"Keep artifacts in one of several backends depending on their size or file name, e.g. small ones on fast local disks and large ones in cheaper bulk storage. Alternative to --storage; each is name:kind:location[:options], where kind is dir or s3 and location the directory or bucket (the other S3 settings come from --s3_endpoint and --s3_region). options is a comma-separated list of min_size and max_size (of artifacts as they're stored), pattern (a glob their file name must match, e.g. *.jar) and low_water_mark and high_water_mark (to clean that backend to instead of the cache's). Can be repeated; each artifact goes to the first route that matches it, so the last must have no conditions. It's looked for in every backend it could be in. E.g. --storage_route fast:dir:/mnt/ssd:max_size=1M --storage_route bulk:s3:my-bucket. The size of each is in the plz_cache_storage_size_bytes metric."`
+	} `group:"Options controlling durable storage of artifacts"`
+
 	ClusterFlags struct {
-		ClusterPort      int    `long:"cluster_port" default:"7946" description:"Port to gossip among cluster nodes on"`
-		ClusterAddresses string `short:"c" long:"cluster_addresses" description:"Comma-separated addresses of one or more nodes to join a cluster"`
-		SeedCluster      bool   `long:"seed_cluster" description:"Seeds a new cache cluster."`
-		ClusterSize      int    `long:"cluster_size" description:"Number of nodes to expect in the cluster.\nMust be passed if --seed_cluster is, has no effect otherwise."`
-		NodeName         string `long:"node_name" env:"NODE_NAME" description:"Name of this node in the cluster. Only usually needs to be passed if running multiple nodes on the same machine, when it should be unique."`
-		SeedIf           string `long:"seed_if" description:"Makes us the seed (overriding seed_cluster) if node_name matches this value and we can't resolve any cluster addresses. This makes it a lot easier to set up in automated deployments like Kubernetes."`
-		AdvertiseAddr    string `long:"advertise_addr" env:"NODE_IP" description:"IP address to advertise to other cluster nodes"`
+		ClusterPort         int          `long:"cluster_port" default:"7946" description:"Port to gossip among cluster nodes on"`
+		ClusterAddresses    string       `short:"c" long:"cluster_addresses" description:"Comma-separated addresses of one or more nodes to join a cluster"`
+		SeedCluster         bool         `long:"seed_cluster" description:"Seeds a new cache cluster."`
+		ClusterSize         int          `long:"cluster_size" description:"Number of nodes to expect in the cluster.\nMust be passed if --seed_cluster is, has no effect otherwise."`
+		NodeName            string       `long:"node_name" env:"NODE_NAME" description:"Name of this node in the cluster. Only usually needs to be passed if running multiple nodes on the same machine, when it should be unique."`
+		SeedIf              string       `long:"seed_if" description:"Makes us the seed (overriding seed_cluster) if node_name matches this value and we can't resolve any cluster addresses. This makes it a lot easier to set up in automated deployments like Kubernetes."`
+		AdvertiseAddr       string       `long:"advertise_addr" env:"NODE_IP" description:"IP address to advertise to other cluster nodes, IPv4 or IPv6 (with or without brackets)"`
+		JoinGracePeriod     cli.Duration `long:"join_grace_period" description:"After joining a cluster, wait this long and until we're serving healthily before other nodes and clients use us. Smooths restarts since we're not sent traffic before we're ready for it."`
+		Role                string       `long:"role" description:"Role of this node in the cluster. Currently the only recognised role is 'read', which marks a node as optimised for reads so clients prefer it over the other replica. It does not change which artifacts the node owns."`
+		ReadWeight          int          `long:"read_weight" description:"Relative share of reads that clients balancing them between replicas (see rpcbalancereads in their config) should send to this node, e.g. to send more to nodes with faster disks. Defaults to 1."`
+		Zone                string       `long:"zone" env:"NODE_ZONE" description:"Zone (e.g. site or region) of this node, for clusters spanning several. Each zone gets its own replica of every artifact, and nodes fetch from others in the same zone in preference to crossing zones."`
+		StrictReadiness     bool         `long:"strict_readiness" description:"Don't declare this node ready (to the rest of the cluster, and on /readyz on --http_port) until it can reach a quorum of the cluster over RPC, and the other replicas of a sample of its artifacts respond. Implies the starting behaviour of --join_grace_period, even if that isn't set."`
+		ReadinessSamples    int          `long:"readiness_samples" description:"Number of this node's artifacts to check the other replicas of for --strict_readiness. By default only quorum is checked."`
+		ReadyBeforeFull     bool         `long:"ready_before_full" description:"Report this node as ready on /readyz without waiting to see the cluster at --cluster_size. Needed if nodes find each other through an address that only includes ready nodes, such as a Kubernetes headless service, since otherwise none would ever become ready."`
+		Forward             bool         `long:"forward_requests" description:"Forward stores and retrieves for artifacts this node isn't a replica of to one that is, so clients can send any request to any node (e.g. through a load balancer). Retrieves are only forwarded if this node doesn't have the artifacts itself. Requests are forwarded at most twice, in case nodes disagree on who owns what; results are counted in the plz_cache_forwarded_requests_total metric and hops in plz_cache_forward_hops. If the replicas can't be reached the request is handled here as normal."`
+		ReadOnlyOnPartition bool         `long:"read_only_on_partition" description:"Refuse stores from clients while this node can see no more than half of the cluster, so both sides of a network partition don't accept writes that can't be replicated."`
+		ReplicationFactor   int          `long:"replication_factor" default:"2" description:"Number of nodes to store each artifact on, chosen by consistent hashing of its hash. Artifacts can be read from any of them. Must be the same on every node. Clients only send to the first two; nodes replicate to the rest."`
+		ReplicationCheck    cli.Duration `long:"replication_check_interval" default:"10m" description:"How often to count the artifacts this node is the first replica of that have fewer live replicas than --replication_factor, for the plz_cache_under_replicated_artifacts metric. Zero disables it."`
+		FailoverDelay       cli.Duration `long:"failover_delay" description:"Once another node has been dead for this long, hand its share of the hash space over to other nodes and re-replicate the artifacts it held to them. If it then returns, it's sent the artifacts it missed. It should be long enough for nodes to restart without triggering it. By default this never happens."`
+		FailoverBandwidth   cli.ByteSize `long:"failover_bandwidth" default:"20M" description:"Maximum rate, in bytes per second, at which this node re-replicates artifacts after another fails."`
+		RetryDir            string       `long:"replication_retry_dir" default:"plz-rpc-cache-retries" description:"Directory to queue failed replications to other nodes in, so they're retried even if this node restarts. Must not be inside --dir."`
+		RetryQueueSize      int          `long:"replication_retry_queue_size" default:"1000" description:"Maximum number of failed replications to queue for retrying. Any more are dropped and counted in the plz_cache_replication_dead_letters_total metric. Zero disables retries."`
+		RetryAttempts       int          `long:"replication_retries" default:"10" description:"Number of times to retry each failed replication, with exponential backoff, before giving up on it."`
+		RestartTokenTTL     cli.Duration `long:"restart_token_ttl" default:"10m" description:"How long this node holds the restart token for after POST /restart on --gateway_port says it's safe to restart, if it doesn't restart in that time. Other nodes are told it isn't safe while we hold it."`
 	} `group:"Options controlling clustering behaviour"`
 }
 
+var snapshotOpts struct {
+	cli.ConfigFileFlag
+	Usage     string `usage:"Exports or imports a snapshot of an RPC cache directory.\n\nThese operate directly on the directory so the server should not be running against it at the time."`
+	Dir       string `short:"d" long:"dir" description:"Cache directory to export from or import into" default:"plz-rpc-cache"`
+	Verbosity int    `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	Export    struct {
+		Out string `short:"o" long:"out" required:"true" description:"File to write the snapshot to"`
+	} `command:"export" description:"Exports the cache directory to a snapshot archive"`
+	Import struct {
+		In    string   `short:"i" long:"in" required:"true" description:"Snapshot archive to import"`
+		Match []string `short:"m" long:"match" description:"Only import files matching this pattern (as path.Match), e.g. linux_amd64/src/core or linux_*/third_party. A pattern matches a file if it matches its path or any of its parent directories. Can be given multiple times; by default everything is imported."`
+	} `command:"import" description:"Imports a snapshot archive into the cache directory"`
+}
+
 func main() {
-	cli.ParseFlagsOrDie("Please RPC cache server", "5.5.0", &opts)
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		parser := cli.ParseFlagsOrDie("Please RPC cache server", version, &snapshotOpts)
+		cli.InitLogging(snapshotOpts.Verbosity)
+		if parser.Active.Name == "export" {
+			exportSnapshot(snapshotOpts.Dir, snapshotOpts.Export.Out)
+		} else {
+			importSnapshot(snapshotOpts.Dir, snapshotOpts.Import.In, snapshotOpts.Import.Match)
+		}
+		return
+	}
+	cli.ParseFlagsOrDie("Please RPC cache server", version, &opts)
+	cli.SetJSONLogging(opts.LogJSON)
 	cli.InitLogging(opts.Verbosity)
 	if opts.LogFile != "" {
 		cli.InitFileLogging(opts.LogFile, opts.Verbosity)
 	}
-	if (opts.TLSFlags.KeyFile == "") != (opts.TLSFlags.CertFile == "") {
-		log.Fatalf("Must pass both --key_file and --cert_file if you pass one")
-	} else if opts.TLSFlags.KeyFile == "" && (opts.TLSFlags.WritableCerts != "" || opts.TLSFlags.ReadonlyCerts != "") {
-		log.Fatalf("You can only use --writable_certs / --readonly_certs with https (--key_file and --cert_file)")
+	if opts.CheckConfig {
+		os.Exit(checkConfig())
+	}
+	report := validateConfig(false)
+	for _, w := range report.warnings {
+		log.Warning("%s", w)
+	}
+	if len(report.errors) > 0 {
+		log.Fatalf("Invalid configuration: %s", strings.Join(report.errors, "; "))
+	}
+	key := mustReadTLSMaterial("key", opts.TLSFlags.KeyFile, opts.TLSFlags.KeyEnv)
+	cert := mustReadTLSMaterial("cert", opts.TLSFlags.CertFile, opts.TLSFlags.CertEnv)
+	caCert := mustReadTLSMaterial("ca_cert", opts.TLSFlags.CACertFile, opts.TLSFlags.CACertEnv)
+	var cipherSuites []string
+	if opts.TLSFlags.CipherSuites != "" {
+		cipherSuites = strings.Split(opts.TLSFlags.CipherSuites, ",")
+	}
+	if err := server.SetTLSOptions(opts.TLSFlags.MinVersion, cipherSuites); err != nil {
+		log.Fatalf("Invalid TLS options: %s", err)
+	}
+	bindAddr, err := server.ParseBindAddress(opts.BindAddr)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	var tlsConfig *tls.Config
+	var reloader *server.CertReloader
+	if len(key) != 0 {
+		reloader, err = server.NewCertReloader(readTLSMaterial)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		reloader.Watch(time.Duration(opts.TLSFlags.CertReload), syscall.SIGHUP)
+		tlsConfig = reloader.Config()
+	}
+
+	// The HTTP server starts before we scan the cache directory, so probes can tell we're alive but not ready yet.
+	readiness := &server.Readiness{}
+	scanned := readiness.Pending("scanning cache directory")
+	joined := func() {}
+	if opts.ClusterFlags.SeedCluster || opts.ClusterFlags.ClusterAddresses != "" {
+		joined = readiness.Pending("joining cluster")
+	}
+	if opts.HTTPPort != 0 {
+		probes := readiness.Handler()
+		http.Handle("/healthz", probes)
+		http.Handle("/readyz", probes)
+		go serveHTTP(server.ListenAddress(bindAddr, opts.HTTPPort), nil, tlsConfig)
+		log.Notice("Serving HTTP stats on port %d", opts.HTTPPort)
 	}
 
-	log.Notice("Scanning existing cache directory %s...", opts.Dir)
+	if opts.CleanFlags.BackgroundScan {
+		log.Notice("Scanning existing cache directory %s in the background...", opts.Dir)
+	} else {
+		log.Notice("Scanning existing cache directory %s...", opts.Dir)
+	}
+	serverOpts := server.ServerOptions{
+		MaxIndexEntries:  opts.CleanFlags.MaxIndexEntries,
+		BackgroundScan:   opts.CleanFlags.BackgroundScan,
+		ScanParallelism:  opts.CleanFlags.ScanParallelism,
+		BindAddr:         bindAddr,
+		CertReloader:     reloader,
+		KeyReloadSignals: []os.Signal{syscall.SIGHUP},
+		Servers:          server.NewServerGroup(),
+	}
 	cache := server.NewCache(opts.Dir, time.Duration(opts.CleanFlags.CleanFrequency),
 		time.Duration(opts.CleanFlags.MaxArtifactAge),
-		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark))
+		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark), serverOpts)
+	readiness.AddCheck(cache.NotReadyReason)
+	scanned()
+
+	if opts.EvictionFlags.Eviction == "cost" {
+		cache.SetCostEviction(server.CostWeights{
+			HalfLife:    time.Duration(opts.EvictionFlags.HalfLife),
+			Frequency:   opts.EvictionFlags.FrequencyWeight,
+			Cost:        opts.EvictionFlags.CostWeight,
+			DefaultCost: opts.EvictionFlags.DefaultCost,
+		})
+	}
+	if opts.StrictStore {
+		cache.SetRejectCollisions(true)
+	}
+	if normalize, err := server.KeyNormalizations(opts.NormalizeKeys); err != nil {
+		log.Fatalf("Invalid --normalize_keys: %s", err)
+	} else if normalize != nil {
+		cache.SetKeyNormalizer(normalize)
+	}
+	if layout, err := server.NewLayout(opts.Layout); err != nil {
+		log.Fatalf("Invalid --layout: %s", err)
+	} else {
+		cache.SetLayout(layout)
+	}
+	var migrateFrom *server.Layout
+	if opts.MigrateFrom != "" {
+		l, err := server.NewLayout(opts.MigrateFrom)
+		if err != nil {
+			log.Fatalf("Invalid --migrate_from_layout: %s", err)
+		}
+		migrateFrom = l
+	}
+	if key, err := server.ReadEncryptionKey(opts.EncryptionKey, opts.KMS); err != nil {
+		log.Fatalf("Failed to read encryption key: %s", err)
+	} else if key != nil {
+		if err := cache.SetEncryptionKey(key); err != nil {
+			log.Fatalf("Invalid encryption key: %s", err)
+		}
+		log.Notice("Encrypting artifacts at rest")
+	}
+	cache.SetVerifyChecksums(opts.VerifySums)
+	if err := cache.SetChecksumAlgorithm(opts.SumAlgorithm); err != nil {
+		log.Fatalf("Invalid --checksum_algorithm: %s", err)
+	}
+	cache.SetStrictChecksums(opts.StrictSums)
+	if opts.ScrubInterval > 0 {
+		cache.ScrubEvery(time.Duration(opts.ScrubInterval))
+	}
+	if err := cache.SetCompression(opts.StoreCompress, opts.CompressLevel); err != nil {
+		log.Fatalf("Invalid --compression: %s", err)
+	} else if opts.StoreCompress != "none" {
+		log.Notice("Compressing artifacts at rest with %s", opts.StoreCompress)
+	}
+	if opts.ReadOnly {
+		cache.SetReadOnly("configured read-only")
+	}
+	if opts.MirrorDir != "" {
+		cache.SetMirror(opts.MirrorDir)
+	}
+	if opts.UpstreamFlags.Addr != "" {
+		upstream, err := server.NewUpstream(opts.UpstreamFlags.Addr, opts.UpstreamFlags.ReadOnly, time.Duration(opts.UpstreamFlags.Timeout), dial.TLSFlags{
+			KeyFile:    opts.UpstreamFlags.Key,
+			CertFile:   opts.UpstreamFlags.Cert,
+			CACertFile: opts.UpstreamFlags.CACert,
+		})
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		upstream.SetFreshness(time.Duration(opts.UpstreamFlags.Freshness), opts.UpstreamFlags.ServeStale)
+		cache.SetUpstream(upstream)
+		log.Notice("Retrieving missing artifacts from upstream %s", opts.UpstreamFlags.Addr)
+	}
+	if storage, err := newStorage(); err != nil {
+		log.Fatalf("Invalid --storage: %s", err)
+	} else if storage != nil {
+		cache.SetStorage(storage)
+		if len(opts.StorageFlags.Routes) > 0 {
+			log.Notice("Keeping artifacts in %d storage backends, routed by --storage_route", len(opts.StorageFlags.Routes))
+		} else {
+			log.Notice("Keeping artifacts in %s storage", opts.StorageFlags.Backend)
+		}
+	}
+	if opts.AuditLog != "" {
+		l, err := audit.Open(opts.AuditLog)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %s", err)
+		}
+		l.ReopenOn(syscall.SIGHUP)
+		cache.SetAuditLog(l)
+	}
+	if opts.CleanFlags.GhostCacheSize > 0 {
+		cache.SetGhostCacheSize(opts.CleanFlags.GhostCacheSize)
+	}
+	if opts.TargetStats > 0 {
+		cache.SetTargetStatsSize(opts.TargetStats)
+	}
+	if opts.CleanFlags.MinFreeSpace > 0 {
+		cache.SetFreeSpaceThresholds(int64(opts.CleanFlags.MinFreeSpace), int64(opts.CleanFlags.TargetFreeSpace))
+	}
+	if opts.CleanFlags.MinRetention > 0 {
+		cache.SetMinRetention(time.Duration(opts.CleanFlags.MinRetention))
+	}
+	if err := cache.SetSlidingTTL(time.Duration(opts.CleanFlags.SlidingTTL), time.Duration(opts.CleanFlags.MaxLifetime)); err != nil {
+		log.Fatalf("Invalid --sliding_ttl / --max_lifetime: %s", err)
+	}
+	if opts.CleanFlags.AtimeInterval > 0 {
+		cache.PersistAccessTimes(time.Duration(opts.CleanFlags.AtimeInterval))
+	}
+	if opts.CleanFlags.CleanEmptyDirs {
+		cache.SetCleanEmptyDirs(true)
+	}
+	if opts.CleanFlags.CleanDryRun {
+		log.Warning("Clean dry run enabled; nothing will be removed from the cache")
+		cache.SetCleanDryRun(true)
+	}
+	cache.SetMaxSessionTTL(time.Duration(opts.CleanFlags.MaxSessionTTL))
+	node := opts.ClusterFlags.NodeName
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	cli.SetLogField("node", node)
+	if opts.CleanFlags.CleanJitter > 0 {
+		cache.SetCleanJitter(node, time.Duration(opts.CleanFlags.CleanJitter))
+	}
 
 	var clusta *cluster.Cluster
+	// finishStarting marks us as starting until the given grace period has passed and we're ready to serve.
+	finishStarting := func(clusta *cluster.Cluster, grace time.Duration) {
+		healthAddr := fmt.Sprintf("localhost:%d", opts.Port)
+		if opts.BindAddr != "" {
+			healthAddr = server.ListenAddress(bindAddr, opts.Port) // We may not be listening on localhost.
+		}
+		clusta.SetStarting(true)
+		go clusta.FinishStarting(grace, func() bool {
+			if !server.CheckHealth(healthAddr, len(key) != 0, 5*time.Second) {
+				return false
+			} else if !opts.ClusterFlags.StrictReadiness {
+				return true
+			} else if err := clusta.CheckReadiness(cache, opts.ClusterFlags.ReadinessSamples, 5*time.Second); err != nil {
+				log.Warning("Not ready yet: %s", err)
+				return false
+			}
+			return true
+		})
+	}
 	if opts.ClusterFlags.SeedIf != "" && opts.ClusterFlags.SeedIf == opts.ClusterFlags.NodeName {
 		ips, err := net.LookupIP(opts.ClusterFlags.ClusterAddresses)
 		opts.ClusterFlags.SeedCluster = err != nil || len(ips) == 0
@@ -80,41 +439,265 @@ func main() {
 		if opts.ClusterFlags.ClusterSize < 2 {
 			log.Fatalf("You must pass a cluster size of > 1 when initialising the seed node.")
 		}
-		clusta = cluster.NewCluster(opts.ClusterFlags.ClusterPort, opts.Port, opts.ClusterFlags.NodeName, opts.ClusterFlags.AdvertiseAddr)
+		clusta = cluster.NewCluster(opts.ClusterFlags.ClusterPort, opts.Port, opts.ClusterFlags.NodeName, opts.ClusterFlags.AdvertiseAddr, opts.ClusterFlags.Role, opts.ClusterFlags.Zone)
 		clusta.Init(opts.ClusterFlags.ClusterSize)
+		if opts.ClusterFlags.StrictReadiness {
+			finishStarting(clusta, 0)
+		}
 	} else if opts.ClusterFlags.ClusterAddresses != "" {
-		clusta = cluster.NewCluster(opts.ClusterFlags.ClusterPort, opts.Port, opts.ClusterFlags.NodeName, opts.ClusterFlags.AdvertiseAddr)
+		clusta = cluster.NewCluster(opts.ClusterFlags.ClusterPort, opts.Port, opts.ClusterFlags.NodeName, opts.ClusterFlags.AdvertiseAddr, opts.ClusterFlags.Role, opts.ClusterFlags.Zone)
+		if opts.ClusterFlags.JoinGracePeriod > 0 || opts.ClusterFlags.StrictReadiness {
+			finishStarting(clusta, time.Duration(opts.ClusterFlags.JoinGracePeriod))
+		}
 		clusta.Join(strings.Split(opts.ClusterFlags.ClusterAddresses, ","))
 	}
+	if clusta != nil {
+		readiness.AddCheck(func() string { return clusta.NotReadyReason(!opts.ClusterFlags.ReadyBeforeFull) })
+	}
+	joined()
+	if clusta != nil && opts.ClusterFlags.ReadWeight > 0 {
+		clusta.SetReadWeight(opts.ClusterFlags.ReadWeight)
+	}
+	if clusta != nil && opts.ClusterFlags.ReadOnlyOnPartition {
+		clusta.SetReadOnlyOnPartition(true)
+	}
+	if clusta != nil && opts.ClusterFlags.Forward {
+		clusta.SetForwarding(true)
+	}
+	if clusta != nil {
+		clusta.SetReplicationFactor(opts.ClusterFlags.ReplicationFactor)
+		if opts.ClusterFlags.ReplicationCheck > 0 {
+			go clusta.MonitorReplication(time.Duration(opts.ClusterFlags.ReplicationCheck), cache)
+		}
+	}
+	if clusta != nil && opts.ClusterFlags.FailoverDelay > 0 {
+		clusta.EnableFailover(time.Duration(opts.ClusterFlags.FailoverDelay), int64(opts.ClusterFlags.FailoverBandwidth), cache)
+	}
+	if clusta != nil && opts.ClusterFlags.RetryQueueSize > 0 {
+		if err := clusta.EnableRetries(opts.ClusterFlags.RetryDir, opts.ClusterFlags.RetryQueueSize, opts.ClusterFlags.RetryAttempts); err != nil {
+			log.Fatalf("Failed to set up replication retry queue: %s", err)
+		}
+	}
+	if opts.ProfileFlags.Dir != "" {
+		server.DumpProfilesOnSignal(opts.ProfileFlags.Dir, time.Duration(opts.ProfileFlags.CPUDuration))
+	}
+	if opts.HeartbeatFlags.URL != "" {
+		server.StartHeartbeat(opts.HeartbeatFlags.URL, time.Duration(opts.HeartbeatFlags.Interval), cache, clusta)
+	}
+	if clusta != nil && opts.CleanFlags.MaxCleanFraction > 0 {
+		cache.SetCleanCoordinator(clusta, opts.CleanFlags.MaxCleanFraction, time.Duration(opts.CleanFlags.CleanLeaseTTL))
+	}
 
 	if opts.HTTPPort != 0 {
 		http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Content-Type", "text/plain")
-			w.Write([]byte(fmt.Sprintf("Total size: %d bytes\nNum files: %d\n", cache.TotalSize(), cache.NumFiles())))
+			w.Write([]byte(fmt.Sprintf("Total size: %d bytes\nNum files: %d\nMaintenance: %v\n", cache.TotalSize(), cache.NumFiles(), cache.InMaintenance())))
 		})
-		go func() {
-			port := fmt.Sprintf(":%d", opts.HTTPPort)
-			if opts.TLSFlags.KeyFile != "" {
-				log.Fatalf("%s\n", http.ListenAndServeTLS(port, opts.TLSFlags.CertFile, opts.TLSFlags.KeyFile, nil))
-			} else {
-				log.Fatalf("%s\n", http.ListenAndServe(port, nil))
+		http.HandleFunc("/cluster", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if clusta == nil {
+				w.Write([]byte("Not clustered\n"))
+				return
 			}
-		}()
-		log.Notice("Serving HTTP stats on port %d", opts.HTTPPort)
+			for _, node := range clusta.GetMembers() {
+				fmt.Fprintf(w, "%s %s [%d, %d) maintenance: %v\n", node.Name, node.Address, node.HashBegin, node.HashEnd, node.Maintenance)
+			}
+		})
+		http.HandleFunc("/cluster/ownership", func(w http.ResponseWriter, req *http.Request) {
+			if clusta == nil {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("Not clustered\n"))
+				return
+			}
+			clusta.OwnershipHandler().ServeHTTP(w, req)
+		})
+		http.Handle("/stats/", cache.StatsHandler())
+		http.Handle("/clean/preview", cache.CleanPreviewHandler())
+	}
+	if opts.EnableFaults {
+		serverOpts.Faults = server.NewFaultInjector()
+	}
+	serverOpts.TransferBudget = server.NewMemoryBudget(int64(opts.ConnectionFlags.MemoryBudget))
+	serverOpts.MaxArtifactSize = int64(opts.ConnectionFlags.MaxArtifact)
+	serverOpts.RestartTokenTTL = time.Duration(opts.ClusterFlags.RestartTokenTTL)
+	serverOpts.ShedLatency = time.Duration(opts.ConnectionFlags.ShedLatency)
+	serverOpts.ShedWindow = time.Duration(opts.ConnectionFlags.ShedWindow)
+	serverOpts.ShedMaxCost = opts.ConnectionFlags.ShedMaxCost
+	limits := server.ConcurrencyLimits{
+		Stores:          opts.ConnectionFlags.MaxStores,
+		ClientStores:    opts.ConnectionFlags.ClientStores,
+		Retrieves:       opts.ConnectionFlags.MaxRetrieves,
+		ClientRetrieves: opts.ConnectionFlags.ClientReads,
+	}
+	if f := opts.ConnectionFlags.LimitsFile; f != "" {
+		l, err := server.ReadConcurrencyLimits(f, limits)
+		if err != nil {
+			log.Fatalf("Failed to read concurrency limits: %s", err)
+		}
+		serverOpts.Limits = server.NewConcurrencyLimiter(l)
+		serverOpts.Limits.ReloadOn(f, limits, syscall.SIGHUP)
+	} else {
+		serverOpts.Limits = server.NewConcurrencyLimiter(limits)
+	}
+	if opts.GatewayPort != 0 {
+		gateway := server.BuildGateway(cache, clusta, opts.TLSFlags.ReadonlyCerts, opts.TLSFlags.WritableCerts, serverOpts)
+		go serveHTTP(server.ListenAddress(bindAddr, opts.GatewayPort), gateway, tlsConfig)
+		log.Notice("Serving REST gateway on port %d", opts.GatewayPort)
 	}
 
+	serverOpts.AllowCompression = opts.Compression
+	serverOpts.ListenBacklog = opts.ConnectionFlags.ListenBacklog
+	serverOpts.MaxConnections = opts.ConnectionFlags.MaxConnections
+	serverOpts.MaxConnectionIdle = time.Duration(opts.ConnectionFlags.MaxConnIdle)
+	serverOpts.StoreDedupWindow = time.Duration(opts.DedupWindow)
+	serverOpts.Node, serverOpts.Version, serverOpts.Zone = node, version, opts.ClusterFlags.Zone
+	if opts.OperationLog != "" {
+		l, err := oplog.Open(opts.OperationLog, opts.OpLogBodies)
+		if err != nil {
+			log.Fatalf("Failed to open operation log: %s", err)
+		}
+		l.ReopenOn(syscall.SIGHUP)
+		serverOpts.OperationLog = l
+	}
 	log.Notice("Starting up RPC cache server on port %d...", opts.Port)
-	s, lis := server.BuildGrpcServer(opts.Port, cache, clusta, opts.TLSFlags.KeyFile, opts.TLSFlags.CertFile,
-		opts.TLSFlags.CACertFile, opts.TLSFlags.ReadonlyCerts, opts.TLSFlags.WritableCerts)
+	registry := server.NewRegistry()
+	s, lis := server.BuildGrpcServer(opts.Port, cache, clusta, registry, key, cert, caCert,
+		opts.TLSFlags.ReadonlyCerts, opts.TLSFlags.WritableCerts, serverOpts)
 
 	if opts.MetricsPort != 0 {
-		grpc_prometheus.Register(s)
-		grpc_prometheus.EnableHandlingTimeHistogram()
+		cache.RegisterMetrics(registry)
+		if clusta != nil {
+			clusta.RegisterMetrics(registry)
+		}
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "maintenance",
+			Help:      "1 if the server is in maintenance mode, 0 otherwise.",
+		}, func() float64 {
+			if cache.InMaintenance() {
+				return 1
+			}
+			return 0
+		}))
 		mux := http.NewServeMux()
-		mux.Handle("/metrics", prometheus.Handler())
+		mux.Handle("/metrics", server.MetricsHandler(registry, time.Duration(opts.MetricsFlags.Timeout)))
 		log.Notice("Serving Prometheus metrics on port %d /metrics", opts.MetricsPort)
-		go http.ListenAndServe(fmt.Sprintf(":%d", opts.MetricsPort), mux)
+		go http.ListenAndServe(server.ListenAddress(bindAddr, opts.MetricsPort), mux)
 	}
 
-	server.ServeGrpcForever(s, lis)
+	if migrateFrom != nil {
+		// This waits until everything else is set up, since moving artifacts reads (and decrypts) them.
+		go migrateLayout(cache, migrateFrom)
+	}
+	go server.ServeGrpcForever(s, lis)
+	waitForShutdown(serverOpts.Servers, time.Duration(opts.DrainTimeout))
+}
+
+// migrateLayout moves the artifacts stored in the given layout into the cache's, logging progress
+// every so often.
+func migrateLayout(cache *server.Cache, from *server.Layout) {
+	last := time.Now()
+	report := cache.MigrateLayout(from, func(r *server.MigrationReport) {
+		if time.Since(last) >= time.Minute {
+			last = time.Now()
+			log.Notice("Layout migration: %d files moved, %d already moved, %d failed; %d sets of artifacts remaining",
+				r.Copied, r.Skipped, len(r.Failed), r.Remaining)
+		}
+	})
+	if len(report.Failed) > 0 {
+		log.Errorf("Failed to move %d files to the new layout, they're still served from the old one: %s",
+			len(report.Failed), strings.Join(report.Failed, ", "))
+	} else {
+		log.Notice("Finished moving %d files (%d bytes) to the new layout, --migrate_from_layout can be removed",
+			report.Copied+report.Skipped, report.VerifiedBytes)
+	}
+}
+
+// waitForShutdown waits for SIGTERM or SIGINT, then shuts the given servers down gracefully,
+// giving up after the given timeout.
+func waitForShutdown(servers *server.ServerGroup, timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	log.Notice("Received %s, shutting down...", sig)
+	// A second signal means whoever sent it really doesn't want to wait.
+	go func() {
+		<-ch
+		log.Fatalf("Received a second signal, exiting immediately")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := servers.Shutdown(ctx); err != nil {
+		log.Error("Failed to shut down cleanly: %s", err)
+		return
+	}
+	log.Notice("Shut down cleanly")
+}
+
+// serveHTTP serves HTTP on the given address until it fails, using TLS if a config is given.
+func serveHTTP(addr string, handler http.Handler, config *tls.Config) {
+	if config != nil {
+		s := &http.Server{Addr: addr, Handler: handler, TLSConfig: config}
+		log.Fatalf("%s\n", s.ListenAndServeTLS("", ""))
+	} else {
+		log.Fatalf("%s\n", http.ListenAndServe(addr, handler))
+	}
+}
+
+// mustReadTLSMaterial reads a piece of TLS material from either a file or an env var, and dies if it can't.
+func mustReadTLSMaterial(name, filename, envVar string) []byte {
+	b, err := server.ReadTLSMaterial(filename, envVar)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %s (pass only one of --%s_file and --%s_env)", name, err, name, name)
+	}
+	return b
+}
+
+// readTLSMaterial reads the key, certificate and CA certificate given by the flags, for the CertReloader.
+func readTLSMaterial() (key, cert, caCert []byte, err error) {
+	if key, err = server.ReadTLSMaterial(opts.TLSFlags.KeyFile, opts.TLSFlags.KeyEnv); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to read key: %s", err)
+	} else if cert, err = server.ReadTLSMaterial(opts.TLSFlags.CertFile, opts.TLSFlags.CertEnv); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to read cert: %s", err)
+	} else if caCert, err = server.ReadTLSMaterial(opts.TLSFlags.CACertFile, opts.TLSFlags.CACertEnv); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to read ca_cert: %s", err)
+	}
+	return key, cert, caCert, nil
+}
+
+// exportSnapshot writes a snapshot of the given cache directory to a file.
+func exportSnapshot(dir, out string) {
+	f, err := os.Create(out)
+	if err != nil {
+		log.Fatalf("Failed to create snapshot: %s", err)
+	}
+	n, err := server.ExportSnapshot(dir, f)
+	if err != nil {
+		log.Fatalf("Failed to export snapshot: %s", err)
+	} else if err := f.Close(); err != nil {
+		log.Fatalf("Failed to write snapshot: %s", err)
+	}
+	log.Notice("Exported %d files from %s to %s", n, dir, out)
+}
+
+// importSnapshot restores a snapshot from a file into the given cache directory.
+// If any patterns are given only the files matching them are restored.
+func importSnapshot(dir, in string, patterns []string) {
+	f, err := os.Open(in)
+	if err != nil {
+		log.Fatalf("Failed to open snapshot: %s", err)
+	}
+	defer f.Close()
+	matched, imported, skipped, err := server.ImportPartialSnapshot(dir, f, patterns)
+	if err != nil {
+		log.Fatalf("Failed to import snapshot: %s", err)
+	} else if len(patterns) > 0 && skipped > 0 {
+		log.Warning("%d files matched %s; imported %d into %s, skipped %d invalid files", matched, strings.Join(patterns, ", "), imported, dir, skipped)
+	} else if len(patterns) > 0 {
+		log.Notice("%d files matched %s; imported %d into %s", matched, strings.Join(patterns, ", "), imported, dir)
+	} else if skipped > 0 {
+		log.Warning("Imported %d files into %s, skipped %d invalid files", imported, dir, skipped)
+	} else {
+		log.Notice("Imported %d files into %s", imported, dir)
+	}
 }
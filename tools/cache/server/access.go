@@ -0,0 +1,40 @@
+package server
+
+import (
+	"time"
+)
+
+// PersistAccessTimes starts writing the last read times of files back to disk (as their access
+// times) every interval, for any that have been read since they were last written.
+//
+// The cleaner evicts the least recently read files first, using times it tracks in memory. When
+// the cache starts they're loaded from the files' access times, which on a filesystem mounted
+// noatime (or relatime, which updates them at most once a day) don't reflect when they were
+// really read; without this a restart loses most of the ordering. They're also written when the
+// server shuts down (see ServerGroup.Shutdown), so this only matters if it doesn't get the chance to.
+func (cache *Cache) PersistAccessTimes(interval time.Duration) {
+	go func() {
+		for range time.NewTicker(interval).C {
+			if n := cache.persistAccessTimes(); n > 0 {
+				log.Debug("Wrote access times of %d files", n)
+			}
+		}
+	}()
+}
+
+// persistAccessTimes writes the last read time of every file read since it was last written back to disk.
+// It returns the number of files written.
+func (cache *Cache) persistAccessTimes() int {
+	written := 0
+	for t := range cache.cachedFiles.IterBuffered() {
+		f := t.Val.(*cachedFile)
+		f.Lock()
+		if !f.deleted && !f.lastReadTime.Equal(f.persistedReadTime) {
+			cache.writeAccessTime(t.Key, f.lastReadTime)
+			f.persistedReadTime = f.lastReadTime
+			written++
+		}
+		f.Unlock()
+	}
+	return written
+}
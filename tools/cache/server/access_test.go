@@ -0,0 +1,43 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/djherbis/atime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistAccessTimes(t *testing.T) {
+	const old, recent = "linux_amd64/pkg/target/hash1/file", "linux_amd64/pkg/target/hash2/file"
+	cache := newCache("test_persist_access_times")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact(old, []byte("contents")))
+	require.NoError(t, cache.StoreArtifact(recent, []byte("contents")))
+	assert.Equal(t, 0, cache.persistAccessTimes(), "Nothing's been read since it was stored")
+
+	// Make it look as though both were last read a day ago, as they would be on a noatime filesystem.
+	then := time.Now().Add(-24 * time.Hour)
+	for _, p := range []string{old, recent} {
+		require.NoError(t, os.Chtimes(path.Join(cache.rootPath, p), then, then))
+	}
+	cache = newCache(cache.rootPath)
+	_, err := cache.RetrieveArtifact(recent)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cache.persistAccessTimes())
+	assert.Equal(t, 0, cache.persistAccessTimes(), "It's only written again once it's read again")
+	info, err := os.Stat(path.Join(cache.rootPath, recent))
+	require.NoError(t, err)
+	assert.True(t, atime.Get(info).After(then.Add(time.Hour)))
+	assert.True(t, info.ModTime().Equal(then), "Its modification time is unchanged")
+
+	// So after a restart the one that was read is still the last to be evicted.
+	cache = newCache(cache.rootPath)
+	files := cache.filesToClean(0)
+	require.Equal(t, 2, len(files))
+	assert.Equal(t, old, files[0].path)
+	assert.Equal(t, recent, files[1].path)
+}
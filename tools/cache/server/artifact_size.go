@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// storeLimit returns the largest artifact that can be stored given the configured limit (see ServerOptions).
+func storeLimit(limit int64) int64 {
+	if limit > 0 && limit < maxMsgSize {
+		return limit
+	}
+	return maxMsgSize
+}
+
+// checkArtifactSizes returns an InvalidArgument error if any of the given artifacts is larger than
+// the limit, and counts it in the given counter.
+func checkArtifactSizes(artifacts []*pb.Artifact, limit int64, oversized prometheus.Counter) error {
+	if limit <= 0 {
+		return nil
+	}
+	for _, artifact := range artifacts {
+		if size := int64(len(artifact.Body)); size > limit {
+			oversized.Inc()
+			return tooLargeError(artifact.File, size, limit)
+		}
+	}
+	return nil
+}
+
+// tooLargeError returns the error for a store of an artifact that's over the size limit.
+func tooLargeError(file string, size, limit int64) error {
+	detail := fmt.Sprintf("%s is %d bytes, the maximum is %d", file, size, limit)
+	log.Warning("Rejecting store of oversized artifact: %s", detail)
+	s := status.New(codes.InvalidArgument, "Artifact too large: "+detail)
+	if detailed, err := s.WithDetails(&pb.StoreError{Reason: pb.StoreError_TOO_LARGE, Detail: detail}); err == nil {
+		return detailed.Err()
+	}
+	return s.Err()
+}
+
+// readArtifact reads the body of an artifact stored over HTTP, up to the given limit (if it's
+// positive). It stops as soon as it's read past it, so we never buffer much more than that,
+// and returns false if so.
+func readArtifact(r io.Reader, limit int64) ([]byte, bool, error) {
+	if limit <= 0 {
+		body, err := ioutil.ReadAll(r)
+		return body, true, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	return body, int64(len(body)) <= limit, err
+}
+
+// tooLarge writes the response to an HTTP store of an artifact that's over the size limit, and
+// counts it in the given counter.
+func tooLarge(w http.ResponseWriter, oversized prometheus.Counter, key string, limit int64) {
+	oversized.Inc()
+	log.Warning("Rejecting store of oversized artifact: %s is larger than the maximum of %d bytes", key, limit)
+	http.Error(w, fmt.Sprintf("Artifact too large, the maximum is %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
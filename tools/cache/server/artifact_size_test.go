@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+	"core"
+)
+
+// oversizedCount returns the current value of the given cache's oversized stores counter.
+func oversizedCount(t *testing.T, cache *Cache) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, cache.metrics.oversizedStores.Write(m))
+	return m.Counter.GetValue()
+}
+
+func TestStoreTooLarge(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_store_too_large"), maxArtifactSize: 4}
+	defer os.RemoveAll(r.cache.rootPath)
+	before := oversizedCount(t, r.cache)
+	_, err := r.Store(context.Background(), &pb.StoreRequest{
+		Os:   "linux",
+		Arch: "amd64",
+		Hash: []byte("hash"),
+		Artifacts: []*pb.Artifact{
+			{Package: "pkg", Target: "target", File: "small", Body: []byte("test")},
+			{Package: "pkg", Target: "target", File: "large", Body: []byte("too large")},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+	s, _ := status.FromError(err)
+	require.Equal(t, 1, len(s.Details()))
+	assert.Equal(t, pb.StoreError_TOO_LARGE, s.Details()[0].(*pb.StoreError).Reason)
+	assert.False(t, core.PathExists(path.Join(r.cache.rootPath, "linux_amd64/pkg/target/aGFzaA")), "Nothing is written")
+	assert.Equal(t, before+1, oversizedCount(t, r.cache))
+
+	resp, err := r.Store(context.Background(), &pb.StoreRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash"),
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "target", File: "small", Body: []byte("test")}},
+	})
+	require.NoError(t, err)
+	assert.True(t, resp.Success, "Artifacts of exactly the maximum size are fine")
+}
+
+func TestGatewayPutTooLarge(t *testing.T) {
+	c := newCache("test_gateway_too_large")
+	defer os.RemoveAll(c.rootPath)
+	h := BuildGateway(c, nil, "", "", ServerOptions{MaxArtifactSize: 4})
+	before := oversizedCount(t, c)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file", bytes.NewReader([]byte("too large"))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Without a Content-Length we only find out once we've read past the limit.
+	req := httptest.NewRequest(http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file", bytes.NewReader([]byte("too large")))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.False(t, c.Contains("linux_amd64/pkg/target/hash/file"))
+	assert.Equal(t, before+2, oversizedCount(t, c))
+}
+
+func TestReadArtifact(t *testing.T) {
+	body, ok, err := readArtifact(bytes.NewReader([]byte("test")), 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "test", string(body))
+	_, ok, err = readArtifact(bytes.NewReader([]byte("tests")), 4)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, ok, _ = readArtifact(bytes.NewReader([]byte("tests")), 0)
+	assert.True(t, ok, "Zero means no limit")
+}
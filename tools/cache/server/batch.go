@@ -0,0 +1,75 @@
+package server
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+	"cli"
+)
+
+// maxBatchSize is the largest number of requests RetrieveBatch accepts in one batch.
+const maxBatchSize = 1000
+
+// RetrieveBatch implements the RetrieveBatch RPC to retrieve several sets of artifacts in one call.
+// Each request is handled as a Retrieve would be, one at a time so we don't hold more than one
+// set of artifacts in memory, and its result is sent as soon as it's read.
+func (r *RPCCacheServer) RetrieveBatch(req *pb.RetrieveBatchRequest, stream pb.RpcCache_RetrieveBatchServer) error {
+	ctx := stream.Context()
+	r.sendIdentity(ctx)
+	if err := r.authenticateClient(ctx, readonly); err != nil {
+		return err
+	} else if r.cache.InMaintenance() {
+		return retrieveError(codes.Unavailable, pb.RetrieveError_UNAVAILABLE, "", "Server is in maintenance mode")
+	} else if len(req.Requests) > maxBatchSize {
+		return status.Errorf(codes.InvalidArgument, "Batch of %d requests is larger than the maximum of %d", len(req.Requests), maxBatchSize)
+	}
+	log.Debug("Batch retrieve of %d sets of artifacts from %s", len(req.Requests), cli.Field("client", clientIdentity(ctx)))
+	for i, sub := range req.Requests {
+		if err := ctx.Err(); err == context.Canceled {
+			return status.Error(codes.Canceled, err.Error())
+		} else if err != nil {
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		sub.StructuredErrors = true // So we can tell misses from failures.
+		resp, err := r.Retrieve(ctx, sub)
+		if err := stream.Send(batchResponse(i, resp, err)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchResponse returns the response to the request at the given index in a batch, given the
+// response and error from retrieving it.
+func batchResponse(index int, resp *pb.RetrieveResponse, err error) *pb.RetrieveBatchResponse {
+	ret := &pb.RetrieveBatchResponse{Index: int32(index)}
+	if err == nil && resp.Success {
+		ret.Success = true
+		ret.Artifacts = resp.Artifacts
+		ret.Expiry = resp.Expiry
+		return ret
+	} else if err == nil {
+		ret.Error = &pb.RetrieveError{Reason: pb.RetrieveError_NOT_FOUND}
+		return ret
+	}
+	s, _ := status.FromError(err)
+	for _, detail := range s.Details() {
+		if e, ok := detail.(*pb.RetrieveError); ok {
+			ret.Error = e
+			return ret
+		}
+	}
+	// Errors from before we tried to read anything (e.g. load shedding) don't have details.
+	switch grpc.Code(err) {
+	case codes.NotFound:
+		ret.Error = &pb.RetrieveError{Reason: pb.RetrieveError_NOT_FOUND}
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Canceled:
+		ret.Error = &pb.RetrieveError{Reason: pb.RetrieveError_UNAVAILABLE}
+	default:
+		ret.Error = &pb.RetrieveError{Reason: pb.RetrieveError_INTERNAL}
+	}
+	return ret
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// testBatchStream collects the responses sent on a RetrieveBatch stream.
+type testBatchStream struct {
+	grpc.ServerStream
+	responses []*pb.RetrieveBatchResponse
+}
+
+func (s *testBatchStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *testBatchStream) Send(resp *pb.RetrieveBatchResponse) error {
+	s.responses = append(s.responses, resp)
+	return nil
+}
+
+func TestRetrieveBatch(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_retrieve_batch")}
+	defer os.RemoveAll(r.cache.rootPath)
+	require.NoError(t, r.cache.StoreArtifact("linux_amd64/pkg/target/aGFzaA/file", []byte("test")))
+	request := func(hash string) *pb.RetrieveRequest {
+		return &pb.RetrieveRequest{
+			Os:        "linux",
+			Arch:      "amd64",
+			Hash:      []byte(hash),
+			Artifacts: []*pb.Artifact{{Package: "pkg", Target: "target", File: "file"}},
+		}
+	}
+	stream := &testBatchStream{}
+	require.NoError(t, r.RetrieveBatch(&pb.RetrieveBatchRequest{
+		Requests: []*pb.RetrieveRequest{request("hash"), request("miss"), request("hash")},
+	}, stream))
+	require.Equal(t, 3, len(stream.responses))
+	for i, resp := range stream.responses {
+		assert.EqualValues(t, i, resp.Index)
+	}
+	assert.True(t, stream.responses[0].Success)
+	assert.Equal(t, "test", string(stream.responses[0].Artifacts[0].Body))
+	assert.False(t, stream.responses[1].Success)
+	assert.Equal(t, pb.RetrieveError_NOT_FOUND, stream.responses[1].Error.Reason)
+	assert.True(t, stream.responses[2].Success)
+}
+
+func TestRetrieveBatchTooLarge(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_retrieve_batch_too_large")}
+	defer os.RemoveAll(r.cache.rootPath)
+	err := r.RetrieveBatch(&pb.RetrieveBatchRequest{Requests: make([]*pb.RetrieveRequest, maxBatchSize+1)}, &testBatchStream{})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+}
+
+func TestBatchResponse(t *testing.T) {
+	resp := batchResponse(1, nil, retrieveError(codes.Internal, pb.RetrieveError_INTERNAL, "file", "failed to read"))
+	assert.EqualValues(t, 1, resp.Index)
+	assert.Equal(t, pb.RetrieveError_INTERNAL, resp.Error.Reason)
+	assert.Equal(t, "file", resp.Error.Artifact, "Structured errors are passed through")
+	resp = batchResponse(2, nil, status.Errorf(codes.ResourceExhausted, "too busy"))
+	assert.Equal(t, pb.RetrieveError_UNAVAILABLE, resp.Error.Reason)
+	resp = batchResponse(3, nil, fmt.Errorf("wibble"))
+	assert.Equal(t, pb.RetrieveError_INTERNAL, resp.Error.Reason)
+	resp = batchResponse(4, &pb.RetrieveResponse{}, nil)
+	assert.Equal(t, pb.RetrieveError_NOT_FOUND, resp.Error.Reason)
+}
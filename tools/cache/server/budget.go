@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/base64"
+	"path"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// A MemoryBudget limits the total memory buffered by the stores & retrieves in progress on the
+// servers it's given to (see ServerOptions). It's also a Prometheus collector reporting how much
+// is in use, and how often transfers have had to wait for it.
+// A nil budget has no limit.
+type MemoryBudget struct {
+	limit int64
+	used  int64
+	// waiting is closed (and replaced) whenever memory is released.
+	waiting         chan struct{}
+	mutex           sync.Mutex
+	inUse           prometheus.Gauge
+	waits, timeouts prometheus.Counter
+}
+
+// NewMemoryBudget returns a new budget of the given number of bytes. Transfers that would exceed
+// it wait until enough of the others have finished, or until their deadline.
+// It returns nil if the budget isn't positive, i.e. there's no limit.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &MemoryBudget{
+		limit: limit,
+		inUse: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "transfer_memory_bytes",
+			Help:      "Memory currently held by in-flight transfers, as counted against the transfer memory budget.",
+		}),
+		waits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "transfer_memory_waits_total",
+			Help:      "Number of transfers that had to wait for the transfer memory budget.",
+		}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "transfer_memory_timeouts_total",
+			Help:      "Number of transfers that reached their deadline while waiting for the transfer memory budget.",
+		}),
+	}
+}
+
+// Acquire waits until the given number of bytes are available, or the context is done.
+// It returns a function to release them again once they're no longer in use.
+// Anything larger than the whole budget is allowed once nothing else is using it, so it
+// can still proceed (alone).
+func (b *MemoryBudget) Acquire(ctx context.Context, size int64) (func(), error) {
+	if b == nil {
+		return func() {}, nil
+	} else if size > b.limit {
+		size = b.limit
+	}
+	waited := false
+	for {
+		b.mutex.Lock()
+		if b.used+size <= b.limit {
+			b.used += size
+			b.mutex.Unlock()
+			b.inUse.Add(float64(size))
+			var once sync.Once
+			return func() { once.Do(func() { b.release(size) }) }, nil
+		}
+		if b.waiting == nil {
+			b.waiting = make(chan struct{})
+		}
+		ch := b.waiting
+		b.mutex.Unlock()
+		if !waited {
+			waited = true
+			b.waits.Inc()
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			b.timeouts.Inc()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release returns the given number of bytes to the budget and wakes anyone waiting for them.
+func (b *MemoryBudget) release(size int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used -= size
+	b.inUse.Sub(float64(size))
+	if b.waiting != nil {
+		close(b.waiting)
+		b.waiting = nil
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (b *MemoryBudget) Describe(ch chan<- *prometheus.Desc) {
+	b.inUse.Describe(ch)
+	b.waits.Describe(ch)
+	b.timeouts.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (b *MemoryBudget) Collect(ch chan<- prometheus.Metric) {
+	b.inUse.Collect(ch)
+	b.waits.Collect(ch)
+	b.timeouts.Collect(ch)
+}
+
+// acquire reserves memory from the server's budget for a transfer of the given size.
+// It returns a ResourceExhausted error if it can't get it before the request's deadline.
+func (r *RPCCacheServer) acquire(ctx context.Context, size int64) (func(), error) {
+	release, err := r.budget.Acquire(ctx, size)
+	if err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "Timed out waiting for %d bytes of transfer memory: %s", size, err)
+	}
+	return release, nil
+}
+
+// retrieveSize estimates the memory needed to retrieve the artifacts in the given request.
+func (r *RPCCacheServer) retrieveSize(req *pb.RetrieveRequest) int64 {
+	if r.budget == nil {
+		return 0 // Don't bother looking.
+	}
+	var size int64
+	layout := r.cache.Layout()
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	for _, artifact := range req.Artifacts {
+		size += r.cache.approximateSize(path.Join(layout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash), artifact.File))
+	}
+	return size
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestBudgetWaitsForRelease(t *testing.T) {
+	b := NewMemoryBudget(10)
+	release1, err := b.Acquire(context.Background(), 6)
+	assert.NoError(t, err)
+	acquired := make(chan struct{})
+	go func() {
+		release2, err := b.Acquire(context.Background(), 6)
+		assert.NoError(t, err)
+		close(acquired)
+		release2()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Shouldn't have been admitted while the first is held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release1()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Should have been admitted once the first was released")
+	}
+}
+
+func TestBudgetDeadline(t *testing.T) {
+	b := NewMemoryBudget(10)
+	release, err := b.Acquire(context.Background(), 10)
+	assert.NoError(t, err)
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = b.Acquire(ctx, 1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestBudgetOversized(t *testing.T) {
+	b := NewMemoryBudget(10)
+	release, err := b.Acquire(context.Background(), 100)
+	assert.NoError(t, err, "Larger than the whole budget is admitted when nothing else is using it")
+	assert.EqualValues(t, 10, b.used)
+	release()
+	release()
+	assert.EqualValues(t, 0, b.used, "Releasing twice only counts once")
+}
+
+func TestBudgetUnlimited(t *testing.T) {
+	var b *MemoryBudget
+	release, err := b.Acquire(context.Background(), 1<<40)
+	assert.NoError(t, err)
+	release()
+}
+
+func TestStoreOverBudget(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_store_over_budget"), budget: NewMemoryBudget(10)}
+	release, err := r.budget.Acquire(context.Background(), 10)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := &pb.StoreRequest{
+		Os:   "linux",
+		Arch: "amd64",
+		Hash: []byte("1234"),
+		Artifacts: []*pb.Artifact{{
+			Package: "pkg",
+			Target:  "target",
+			File:    "file",
+			Body:    []byte("contents"),
+		}},
+	}
+	_, err = r.Store(ctx, req)
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err))
+	release()
+	resp, err := r.Store(context.Background(), req)
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.EqualValues(t, 0, r.budget.used, "Memory is released once the store is done")
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"tools/cache/audit"
+)
+
+// buildKeyFileName is the filename we store an artifact's build key in, if it has one.
+// It's separate from the metadata so the scan only has to read it for artifacts that have one.
+const buildKeyFileName = ".plz_build_key"
+
+// A buildKeyIndex maps build keys to the directories of the artifacts stored with them.
+// It's rebuilt from the build key files when the cache is scanned.
+type buildKeyIndex struct {
+	dirs  map[string]map[string]struct{}
+	mutex sync.Mutex
+}
+
+// add records that the artifact in the given directory has the given build key.
+func (idx *buildKeyIndex) add(buildKey, dir string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if idx.dirs == nil {
+		idx.dirs = map[string]map[string]struct{}{}
+	}
+	dirs, present := idx.dirs[buildKey]
+	if !present {
+		dirs = map[string]struct{}{}
+		idx.dirs[buildKey] = dirs
+	}
+	dirs[dir] = struct{}{}
+}
+
+// take removes the given build key from the index and returns its directories.
+func (idx *buildKeyIndex) take(buildKey string) map[string]struct{} {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	dirs := idx.dirs[buildKey]
+	delete(idx.dirs, buildKey)
+	return dirs
+}
+
+// reset removes everything from the index.
+func (idx *buildKeyIndex) reset() {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.dirs = nil
+}
+
+// StoreBuildKey records the build key of the artifact in the given directory
+// (i.e. os_arch/package/target/hash), so it can later be deleted by InvalidateBuildKey.
+func (cache *Cache) StoreBuildKey(artPath, buildKey string) error {
+	artPath = cache.normalize(artPath)
+	lock := cache.lockFile(artPath, true, 0)
+	defer lock.Unlock()
+	fullPath := path.Join(cache.rootPath, artPath, buildKeyFileName)
+	if err := ioutil.WriteFile(fullPath, []byte(buildKey), 0644); err != nil {
+		log.Error("Could not write build key file: %s", err)
+		return err
+	}
+	cache.buildKeys.add(buildKey, artPath)
+	return nil
+}
+
+// readBuildKey returns the build key stored in the given directory, or the empty string if there isn't one.
+func (cache *Cache) readBuildKey(artPath string) string {
+	b, _ := ioutil.ReadFile(path.Join(cache.rootPath, artPath, buildKeyFileName))
+	return string(b)
+}
+
+// InvalidateBuildKey deletes all artifacts stored with the given build key.
+// It returns the number of artifacts that were deleted.
+func (cache *Cache) InvalidateBuildKey(buildKey string) (int, error) {
+	dirs := cache.buildKeys.take(buildKey)
+	for dir := range dirs {
+		if cache.readBuildKey(dir) != buildKey {
+			// Either it's already gone, or it's been stored again since with a different build key.
+			delete(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return 0, nil
+	} else if err := cache.deleteDirs(dirs, audit.BuildKey); err != nil {
+		return 0, err
+	}
+	log.Notice("Invalidated %d artifacts with build key %s", len(dirs), buildKey)
+	return len(dirs), nil
+}
+
+// deleteDirs deletes all the artifacts in the given directories, recording them in the audit log
+// with the given reason. This is the same as calling DeleteArtifact for each one, but only makes
+// one pass over the index.
+func (cache *Cache) deleteDirs(dirs map[string]struct{}, reason audit.Reason) error {
+	if cache.hasUnindexed() {
+		for dir := range dirs {
+			cache.admitAll(dir)
+		}
+	}
+	paths := cachedFilePaths{}
+	for t := range cache.cachedFiles.IterBuffered() {
+		for dir := t.Key; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, present := dirs[dir]; present {
+				paths = append(paths, cachedFilePath{file: t.Val.(*cachedFile), path: t.Key})
+				break
+			}
+		}
+	}
+	for _, p := range paths {
+		cache.deleteFile(p.path, p.file, reason)
+	}
+	for dir := range dirs {
+		if err := os.RemoveAll(path.Join(cache.rootPath, dir)); err != nil {
+			return err
+		}
+		cache.removeEmptyDirs(dir)
+		if err := cache.unpersist(dir + "/"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidateBuildKey(t *testing.T) {
+	const dir = "test_invalidate_build_key"
+	c := newCache(dir)
+	store := func(artPath, buildKey string) {
+		assert.NoError(t, c.StoreArtifact(artPath+"/file1", []byte("test")))
+		assert.NoError(t, c.StoreArtifact(artPath+"/out/file2", []byte("test")))
+		if buildKey != "" {
+			assert.NoError(t, c.StoreBuildKey(artPath, buildKey))
+		}
+	}
+	store("linux_amd64/pkg/target1/hash1", "toolchain1")
+	store("linux_amd64/pkg/target2/hash2", "toolchain1")
+	store("linux_amd64/pkg/target1/hash3", "toolchain2")
+	store("linux_amd64/pkg/target3/hash4", "")
+	// This one's been stored again with a different key since.
+	store("linux_amd64/pkg/target4/hash5", "toolchain1")
+	store("linux_amd64/pkg/target4/hash5", "toolchain2")
+
+	n, err := c.InvalidateBuildKey("toolchain1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.False(t, c.Contains("linux_amd64/pkg/target1/hash1"))
+	assert.False(t, c.cachedFiles.Has("linux_amd64/pkg/target1/hash1/out/file2"))
+	assert.False(t, c.Contains("linux_amd64/pkg/target2/hash2"))
+	assert.True(t, c.Contains("linux_amd64/pkg/target1/hash3"))
+	assert.True(t, c.Contains("linux_amd64/pkg/target3/hash4"))
+	assert.True(t, c.Contains("linux_amd64/pkg/target4/hash5/file1"))
+	assert.EqualValues(t, 3*8, c.TotalSize())
+
+	n, err = c.InvalidateBuildKey("toolchain1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "Nothing left to invalidate")
+
+	// The index is rebuilt when the cache restarts.
+	c = newCache(dir)
+	assert.EqualValues(t, 3*8, c.TotalSize(), "Build key files aren't counted")
+	n, err = c.InvalidateBuildKey("toolchain2")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.False(t, c.Contains("linux_amd64/pkg/target1/hash3"))
+	assert.False(t, c.Contains("linux_amd64/pkg/target4/hash5/file1"))
+	assert.True(t, c.Contains("linux_amd64/pkg/target3/hash4/file1"))
+}
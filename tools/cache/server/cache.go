@@ -2,9 +2,13 @@
 package server
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
@@ -18,12 +22,17 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/streamrail/concurrent-map"
 
+	"cli"
 	"core"
+	"tools/cache/audit"
 )
 
 // metadataFileName is the filename we store metadata in.
 const metadataFileName = ".plz_metadata"
 
+// errKeyCollision is returned when rejecting a store because of a key collision.
+var errKeyCollision = errors.New("a different artifact is already stored with this key")
+
 // metadataTemplate is the template for writing the metadata files
 const metadataTemplate = `Address:    %s
 Hostname:   %s
@@ -35,12 +44,23 @@ Peer:       %s
 type cachedFile struct {
 	// Arbitrates single access to this file
 	sync.RWMutex
-	// Time the file was last read
+	// Time the file was last read. When set by us this has a monotonic clock reading,
+	// so it's unaffected by the system clock changing; only times loaded from disk at
+	// startup are subject to clock skew.
 	lastReadTime time.Time
+	// Last read time most recently written to disk, or loaded from it (see PersistAccessTimes).
+	persistedReadTime time.Time
+	// Time the file was last written. For files found at startup this is their modification time.
+	storedTime time.Time
 	// Number of times the file has been read
 	readCount int
 	// Size of the file
 	size int64
+	// Rebuild cost of the file, in seconds, if it was given when stored.
+	cost float64
+	// True once the file has been removed from the cache. Anyone who finds it
+	// after that (i.e. while waiting for the lock) should treat it as missing.
+	deleted bool
 }
 
 // A Cache is the underlying implementation of our HTTP and RPC caches that handles storing & retrieving artifacts.
@@ -48,26 +68,186 @@ type Cache struct {
 	cachedFiles cmap.ConcurrentMap
 	totalSize   int64
 	rootPath    string
+	// maintenance is nonzero while the cache is in maintenance mode.
+	maintenance int32
+	// highWaterMark is the size at which the cleaner starts removing artifacts (zero if there's no cleaner).
+	highWaterMark int64
+	// lowWaterMark is the size the cleaner removes artifacts down to once it's started.
+	lowWaterMark int64
+	// maxArtifactAge is the time since last being read after which the cleaner removes files.
+	maxArtifactAge time.Duration
+	// aliases maps artifact keys to other keys they can also be retrieved as.
+	aliases cmap.ConcurrentMap
+	// maxIndexEntries is the most files we track in cachedFiles; zero means there's no limit.
+	maxIndexEntries int64
+	// unindexed is the number of files on disk that we've left out of cachedFiles to stay under that limit.
+	unindexed int64
+	// indexKeyBytes is the total length of the keys in cachedFiles.
+	indexKeyBytes int64
+	// spilling is nonzero while we're dropping entries from cachedFiles to get back under the limit.
+	spilling int32
+	// writes is the number of artifacts currently being written.
+	writes int64
+	// scanning is nonzero while the index is being built in the background (see
+	// ServerOptions.BackgroundScan). Until it's finished, files that aren't in it yet are looked up on disk.
+	scanning int32
+	// scanMutex is held for reading while a file is admitted to the index, so the background scan
+	// can't finish part way through and change how it has to be accounted for.
+	scanMutex sync.RWMutex
+	// scanned, if set, is closed once the background scan has finished.
+	scanned chan struct{}
+	// progress is how far the scan has got.
+	progress *scanProgress
+	// scanParallelism is the number of directories the scan reads at once.
+	scanParallelism int
+
+	// cleanMutex is held while cleaning (see cleanOnce).
+	cleanMutex sync.Mutex
+	// scheduleMutex protects the following fields which control when & how we clean.
+	scheduleMutex sync.Mutex
+	// cleanNode is the name used to derive our offset in the clean schedule.
+	cleanNode string
+	// cleanJitter is the maximum offset applied to our clean schedule.
+	cleanJitter time.Duration
+	// coordinator, if set, limits how many nodes may clean at once.
+	coordinator CleanCoordinator
+	// maxCleanFraction is the fraction of nodes that coordinator allows to clean at once.
+	maxCleanFraction float64
+	// cleanLeaseTTL is the longest that coordinator counts us as cleaning for without us finishing.
+	cleanLeaseTTL time.Duration
+	// costWeights, if set, enables cost-aware eviction instead of LRU.
+	costWeights *CostWeights
+	// cleanEmptyDirs is true if we remove directories left empty after deleting artifacts.
+	cleanEmptyDirs bool
+	// cleanDryRun is true if the cleaner only logs what it would remove (see SetCleanDryRun).
+	cleanDryRun bool
+	// minRetention is the time after being stored during which files aren't removed to get under the water marks.
+	minRetention time.Duration
+	// minFreeSpace and targetFreeSpace control cleaning based on the free space of the filesystem (see SetFreeSpaceThresholds).
+	minFreeSpace, targetFreeSpace int64
+	// slidingTTL is the time since last being retrieved after which files expire, if positive.
+	slidingTTL time.Duration
+	// maxLifetime is the time since being stored after which files expire regardless of slidingTTL, if positive.
+	maxLifetime time.Duration
+	// maxSessionTTL caps how long a build session lasts without being renewed, if positive.
+	maxSessionTTL time.Duration
+	// buildKeys indexes artifacts by the build key they were stored with.
+	buildKeys buildKeyIndex
+	// shadowKeys indexes artifacts by the shadow key they were stored with.
+	shadowKeys shadowKeyIndex
+	// expiries indexes artifacts by the expiry they were stored with.
+	expiries expiryIndex
+	// sessions are the build sessions protecting artifacts from being cleaned.
+	sessions sessionIndex
+	// stats counts what the cache has done, for comparing between snapshots.
+	stats statsRecorder
+	// rejectCollisions is true if we refuse stores that collide with an existing artifact.
+	rejectCollisions bool
+	// auditLog, if set, records each artifact we evict.
+	auditLog *audit.Log
+	// ghosts, if set, remembers files recently evicted to make space (see SetGhostCacheSize).
+	ghosts *ghostCache
+	// targets, if set, tracks the hit ratios of the most frequently retrieved targets (see SetTargetStatsSize).
+	targets *targetTracker
+	// mirror, if set, receives a copy of every artifact we store.
+	mirror *mirror
+	// upstream, if set, is another cache we retrieve artifacts from that we don't have (see SetUpstream).
+	upstream *Upstream
+	// readOnly, if set, is the reason we've been configured not to accept stores.
+	readOnly string
+	// keyNormalizer, if set, rewrites every artifact path we're given into its canonical form.
+	keyNormalizer KeyNormalizer
+	// layout, if set, is the layout of artifacts on disk; otherwise it's defaultLayout.
+	layout *Layout
+	// previousLayout, if set, is the layout that MigrateLayout is moving artifacts out of.
+	previousLayout *Layout
+	// layoutMigration, if set, is the progress of MigrateLayout.
+	layoutMigration *MigrationReport
+	// clock, if set, is what the cache gets the time from; otherwise it's the real time.
+	clock Clock
+	// encryption, if set, encrypts artifacts at rest.
+	encryption *envelope
+	// compression, if set, compresses artifacts at rest.
+	compression *atRestCodec
+	// verifyChecksums is true if artifacts are checked against their checksums when they're retrieved.
+	verifyChecksums bool
+	// checksumAlgorithm, if set, is what artifacts are checksummed with; otherwise it's the default.
+	checksumAlgorithm *checksumAlgorithm
+	// strictChecksums is true if artifacts that can't be verified are refused when they're retrieved.
+	strictChecksums bool
+	// storage, if set, is where artifacts are kept beyond the cache directory.
+	storage Storage
+	// metrics are the cache's metrics (see RegisterMetrics).
+	metrics *cacheMetrics
+}
+
+// A CleanCoordinator is used to limit how many nodes in a cluster clean simultaneously.
+type CleanCoordinator interface {
+	// StartClean returns true if this node may begin cleaning, i.e. no more than the given
+	// fraction of the cluster is already cleaning. If so it holds a lease for up to the
+	// given TTL, after which it stops being counted as cleaning even if it hasn't finished.
+	StartClean(maxFraction float64, ttl time.Duration) bool
+	// FinishClean indicates that this node has finished cleaning, releasing its lease.
+	FinishClean()
 }
 
+// cleanRetryDelay is the time we wait before asking the coordinator again if we can clean.
+const cleanRetryDelay = 30 * time.Second
+
+// maxCleanRetries is the number of times we ask the coordinator before giving up on a clean cycle.
+const maxCleanRetries = 10
+
+// maxWriteAttempts is the number of times we try to write an artifact if its directory is removed from under us.
+const maxWriteAttempts = 3
+
 // NewCache initialises the cache and fires off a background cleaner goroutine which runs every
 // cleanFrequency seconds. The high and low water marks control a (soft) max size and a (harder)
-// minimum size.
-func NewCache(path string, cleanFrequency, maxArtifactAge time.Duration, lowWaterMark, highWaterMark uint64) *Cache {
+// minimum size. Of the options, only the maximum number of index entries and whether to scan in the
+// background apply to the cache.
+func NewCache(path string, cleanFrequency, maxArtifactAge time.Duration, lowWaterMark, highWaterMark uint64, opts ServerOptions) *Cache {
 	log.Notice("Initialising cache with settings:\n  Path: %s\n  Clean frequency: %s\n  Max artifact age: %s\n  Low water mark: %s\n  High water mark: %s",
 		path, cleanFrequency, maxArtifactAge, humanize.Bytes(lowWaterMark), humanize.Bytes(highWaterMark))
-	cache := newCache(path)
+	cache := newUnscannedCache(path, opts.MaxIndexEntries)
+	if opts.ScanParallelism > 0 {
+		cache.scanParallelism = opts.ScanParallelism
+	}
+	if opts.BackgroundScan {
+		cache.scanInBackground()
+	} else {
+		cache.scan()
+	}
+	cache.highWaterMark = int64(highWaterMark)
+	cache.lowWaterMark = int64(lowWaterMark)
+	cache.maxArtifactAge = maxArtifactAge
 	go cache.clean(cleanFrequency, maxArtifactAge, int64(lowWaterMark), int64(highWaterMark))
 	return cache
 }
 
 // newCache is an internal constructor intended mostly for testing. It doesn't start the cleaner goroutine.
 func newCache(path string) *Cache {
-	cache := &Cache{rootPath: path}
+	return newCacheWithIndexLimit(path, 0)
+}
+
+// newCacheWithIndexLimit is like newCache but tracks at most the given number of files in the index.
+func newCacheWithIndexLimit(path string, maxIndexEntries int) *Cache {
+	cache := newUnscannedCache(path, maxIndexEntries)
 	cache.scan()
 	return cache
 }
 
+// newUnscannedCache is like newCacheWithIndexLimit but leaves the index empty until it's scanned.
+func newUnscannedCache(path string, maxIndexEntries int) *Cache {
+	return &Cache{
+		rootPath:        path,
+		cachedFiles:     cmap.New(),
+		aliases:         cmap.New(),
+		maxIndexEntries: int64(maxIndexEntries),
+		progress:        &scanProgress{start: time.Now()},
+		scanParallelism: defaultScanParallelism,
+		metrics:         newCacheMetrics(),
+	}
+}
+
 // TotalSize returns the current total size monitored by the cache, in bytes.
 func (cache *Cache) TotalSize() int64 {
 	return cache.totalSize
@@ -75,14 +255,187 @@ func (cache *Cache) TotalSize() int64 {
 
 // NumFiles returns the number of files currently monitored by the cache.
 func (cache *Cache) NumFiles() int {
-	return cache.cachedFiles.Count()
+	return cache.cachedFiles.Count() + int(atomic.LoadInt64(&cache.unindexed))
 }
 
-// scan scans the directory tree for files.
-func (cache *Cache) scan() {
-	cache.cachedFiles = cmap.New()
-	cache.totalSize = 0
+// AboveHighWaterMark returns true if the cache is currently bigger than its high water mark,
+// i.e. it's due to be cleaned.
+func (cache *Cache) AboveHighWaterMark() bool {
+	return cache.highWaterMark > 0 && atomic.LoadInt64(&cache.totalSize) > cache.highWaterMark
+}
+
+// Contains returns true if the cache has anything stored at the given path.
+// Unlike RetrieveArtifact it doesn't read it, or count as a read. Like it, anything that's
+// passed its expiry is treated as missing.
+func (cache *Cache) Contains(artPath string) bool {
+	artPath = cache.normalize(artPath)
+	if cache.expiries.expired(artPath, cache.now()) {
+		return false
+	} else if cache.cachedFiles.Has(artPath) {
+		return true
+	}
+	info, err := os.Stat(path.Join(cache.rootPath, artPath))
+	return err == nil && (info.IsDir() || cache.hasUnindexed())
+}
+
+// SetMaintenance enables or disables maintenance mode. While in maintenance the cache keeps
+// all its data, but reports itself as not serving and the cleaner is paused.
+func (cache *Cache) SetMaintenance(enabled bool) {
+	if enabled {
+		log.Warning("Entering maintenance mode")
+		atomic.StoreInt32(&cache.maintenance, 1)
+	} else {
+		log.Notice("Leaving maintenance mode")
+		atomic.StoreInt32(&cache.maintenance, 0)
+	}
+}
+
+// InMaintenance returns true if the cache is currently in maintenance mode.
+func (cache *Cache) InMaintenance() bool {
+	return atomic.LoadInt32(&cache.maintenance) != 0
+}
+
+// SetReadOnly makes the cache refuse stores from clients, for the given reason. An empty reason
+// makes it accept them again. Cleaning carries on as normal.
+func (cache *Cache) SetReadOnly(reason string) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.readOnly = reason
+}
+
+// ReadOnlyReason returns the reason the cache isn't currently accepting stores from clients,
+// or the empty string if it is. Being in maintenance mode implies being read-only.
+func (cache *Cache) ReadOnlyReason() string {
+	if cache.InMaintenance() {
+		return "maintenance mode"
+	}
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.readOnly
+}
+
+// SetCleanJitter staggers the clean schedule by an offset of up to the given duration.
+// The offset is derived from the given node name, so it's stable across restarts but
+// differs between nodes in a cluster.
+func (cache *Cache) SetCleanJitter(node string, jitter time.Duration) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.cleanNode = node
+	cache.cleanJitter = jitter
+}
+
+// SetCleanCoordinator sets a coordinator which is consulted before each clean, so that no
+// more than the given fraction of a cluster cleans at once. Each clean holds a lease for at
+// most the given TTL, so a node that never finishes can't stop the others cleaning.
+func (cache *Cache) SetCleanCoordinator(coordinator CleanCoordinator, maxFraction float64, leaseTTL time.Duration) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.coordinator = coordinator
+	cache.maxCleanFraction = maxFraction
+	cache.cleanLeaseTTL = leaseTTL
+}
+
+// SetCostEviction enables cost-aware eviction using the given weights.
+func (cache *Cache) SetCostEviction(weights CostWeights) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.costWeights = &weights
+}
+
+// SetCleanEmptyDirs sets whether we remove directories that are left empty once their artifacts are deleted.
+// Over time these accumulate and slow down the initial scan, as well as using up inodes.
+func (cache *Cache) SetCleanEmptyDirs(enabled bool) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.cleanEmptyDirs = enabled
+}
+
+// SetMinRetention sets a minimum time for which artifacts are kept after being stored, regardless
+// of the water marks. Without it a burst of writes can push the cache over the high water mark and
+// cause artifacts to be cleaned moments after they're stored, while the build that wrote them still
+// expects to find them. The cache may exceed its high water mark while this is in effect.
+func (cache *Cache) SetMinRetention(retention time.Duration) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.minRetention = retention
+}
+
+// SetRejectCollisions sets whether we refuse to store an artifact if there's already a different one
+// stored under the same key. Either way the collision is logged; by default the new one replaces it.
+func (cache *Cache) SetRejectCollisions(reject bool) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.rejectCollisions = reject
+}
+
+// SetAuditLog sets a log that records every artifact evicted from the cache, and why.
+func (cache *Cache) SetAuditLog(l *audit.Log) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.auditLog = l
+}
+
+// currentAuditLog returns the current audit log, which may be nil.
+func (cache *Cache) currentAuditLog() *audit.Log {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.auditLog
+}
+
+// SetMirror sets a directory that every artifact stored from now on is copied to.
+// The copies are made in the background and dropped if they fall too far behind, so the
+// mirror is only a best-effort backup; it's never cleaned.
+func (cache *Cache) SetMirror(dir string) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.mirror = newMirror(dir, cache.metrics)
+}
+
+// currentMirror returns the current mirror, which may be nil.
+func (cache *Cache) currentMirror() *mirror {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.mirror
+}
+
+// SetRebuildCost records the cost (in seconds) of rebuilding the given artifact, which is used
+// to prioritise eviction if cost-aware eviction is enabled.
+func (cache *Cache) SetRebuildCost(artPath string, cost float64) {
+	artPath = cache.normalize(artPath)
+	if filei, present := cache.cachedFiles.Get(artPath); present {
+		file := filei.(*cachedFile)
+		file.Lock()
+		file.cost = cost
+		file.Unlock()
+	}
+}
+
+// AddAlias registers an alias between two artifact keys (i.e. os_arch/package/target/hash),
+// so artifacts stored under either one can be retrieved using the other.
+// Aliases are only held in memory.
+func (cache *Cache) AddAlias(key, alias string) {
+	key, alias = cache.normalize(key), cache.normalize(alias)
+	if key != alias {
+		log.Info("Adding alias %s -> %s", key, alias)
+		cache.aliases.Set(key, alias)
+		cache.aliases.Set(alias, key)
+	}
+}
 
+// ResolveAlias returns the key that the given one is an alias of, if there is one.
+func (cache *Cache) ResolveAlias(key string) (string, bool) {
+	key = cache.normalize(key)
+	if alias, present := cache.aliases.Get(key); present {
+		return alias.(string), true
+	}
+	return "", false
+}
+
+// scan scans the directory tree for files. If it's running in the background (see
+// scanInBackground) the cache is already in use, so anything it finds that's been looked up,
+// stored or deleted since it started is left alone.
+func (cache *Cache) scan() {
+	defer cache.progress.finish()
 	if !core.PathExists(cache.rootPath) {
 		if err := os.MkdirAll(cache.rootPath, core.DirPermissions); err != nil {
 			log.Fatalf("Failed to create cache directory %s: %s", cache.rootPath, err)
@@ -90,33 +443,115 @@ func (cache *Cache) scan() {
 		return
 	}
 
-	log.Info("Scanning cache directory %s...", cache.rootPath)
-	filepath.Walk(cache.rootPath, func(name string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatalf("%s", err)
-		} else if !info.IsDir() { // We don't have directory entries.
-			name = name[len(cache.rootPath)+1:]
-			log.Debug("Found file %s", name)
-			size := info.Size()
-			cache.cachedFiles.Set(name, &cachedFile{
-				lastReadTime: atime.Get(info),
-				readCount:    0,
-				size:         size,
-			})
-			cache.totalSize += size
+	log.Info("Scanning cache directory %s with %d workers...", cache.rootPath, cache.scanParallelism)
+	now := cache.now()
+	var future, interrupted, indexed int64
+	background := cache.scanningInBackground()
+	progress := cache.progress
+	done := make(chan struct{})
+	go progress.report(done)
+	walkParallel(cache.rootPath, cache.scanParallelism, func(name string, info os.FileInfo) {
+		log.Debug("Found file %s", name)
+		if path.Base(name) == buildKeyFileName {
+			// These aren't cache entries themselves, they just go into the index.
+			cache.buildKeys.add(cache.readBuildKey(path.Dir(name)), path.Dir(name))
+			return
+		} else if path.Base(name) == shadowKeyFileName {
+			cache.shadowKeys.add(cache.readShadowKey(path.Dir(name)), path.Dir(name))
+			return
+		} else if path.Base(name) == expiryFileName {
+			cache.expiries.set(path.Dir(name), cache.readExpiry(path.Dir(name)))
+			return
+		} else if fullName := path.Join(cache.rootPath, name); isPartial(name) {
+			// We were interrupted while writing this one, so it may be incomplete.
+			log.Debug("Removing %s, it's left from an interrupted store", name)
+			os.Remove(fullName)
+			atomic.AddInt64(&interrupted, 1)
+			return
+		} else if isEmptyMarker(name) {
+			// Nor are these; if the artifact it marks isn't there, we were interrupted storing it.
+			if !core.PathExists(strings.TrimSuffix(fullName, emptyMarkerSuffix)) {
+				os.Remove(fullName)
+			}
+			return
+		} else if isChecksum(name) {
+			// As for empty markers.
+			if !core.PathExists(strings.TrimSuffix(fullName, checksumSuffix)) {
+				os.Remove(fullName)
+			}
+			return
+		} else if info.Size() == 0 && !isLegitimatelyEmpty(fullName) {
+			log.Debug("Removing %s, it's empty but not marked as such", name)
+			os.Remove(fullName)
+			atomic.AddInt64(&interrupted, 1)
+			return
 		}
-		return nil
+		size := info.Size()
+		progress.add(size)
+		if !background {
+			atomic.AddInt64(&cache.totalSize, size)
+			if cache.maxIndexEntries > 0 && atomic.AddInt64(&indexed, 1) > cache.maxIndexEntries {
+				// Leave it on disk only; we'll look it up again if we need it.
+				if path.Base(name) != metadataFileName {
+					atomic.AddInt64(&cache.unindexed, 1)
+				}
+				return
+			}
+		}
+		lastRead := atime.Get(info)
+		if lastRead.After(now) {
+			// Treat it as if it's just been read; it can't really be any newer than that.
+			atomic.AddInt64(&future, 1)
+			lastRead = now
+		}
+		file := &cachedFile{
+			lastReadTime:      lastRead,
+			persistedReadTime: lastRead,
+			storedTime:        info.ModTime(),
+			readCount:         0,
+			size:              size,
+		}
+		if !background {
+			cache.cachedFiles.Set(name, file)
+		} else if !cache.indexScanned(name, file) {
+			return
+		}
+		atomic.AddInt64(&cache.indexKeyBytes, int64(len(name)))
 	})
-	log.Info("Scan complete, found %d entries", cache.cachedFiles.Count())
+	close(done)
+	if future > 0 {
+		log.Warning("Found %d files with access times in the future; the system clock may be wrong", future)
+	}
+	if interrupted > 0 {
+		log.Warning("Removed %d empty or partial files that were left by interrupted stores", interrupted)
+	}
+	if cache.unindexed > 0 {
+		log.Warning("Index is limited to %d entries, %d files will only be looked up on disk", cache.maxIndexEntries, cache.unindexed)
+	}
+	log.Info("Scan complete, found %d entries (%s)", cache.cachedFiles.Count(), humanize.Bytes(uint64(cache.totalSize)))
+}
+
+// accessAge returns the time since a file was last read. It's never negative; a file whose
+// last read time is in the future (because the clock has gone backwards) is as new as it gets.
+func accessAge(lastRead, now time.Time) time.Duration {
+	if age := now.Sub(lastRead); age > 0 {
+		return age
+	}
+	return 0
 }
 
 // lockFile locks a file for reading or writing.
-// It returns a locked mutex corresponding to that file or nil if there is none.
+// It returns a locked mutex corresponding to that file or nil if there is none
+// (including if it was deleted while we were waiting for the lock).
 // The caller should .Unlock() the mutex once they're done with it.
 func (cache *Cache) lockFile(path string, write bool, size int64) *cachedFile {
 	filei, present := cache.cachedFiles.Get(path)
 	var file *cachedFile
 	if !present {
+		if cache.hasUnindexed() && cache.admitFile(path) {
+			// It was on disk but had been dropped from the index; now it's back.
+			return cache.lockFile(path, write, size)
+		}
 		// If we're writing we insert a new one, if we're reading we don't.
 		if !write {
 			return nil
@@ -126,35 +561,130 @@ func (cache *Cache) lockFile(path string, write bool, size int64) *cachedFile {
 			size:      size,
 		}
 		file.Lock()
-		cache.cachedFiles.Set(path, file)
+		if !cache.cachedFiles.SetIfAbsent(path, file) {
+			// Someone else stored it at the same time; wait for them instead.
+			file.Unlock()
+			return cache.lockFile(path, write, size)
+		}
+		cache.indexed(path)
 		atomic.AddInt64(&cache.totalSize, size)
 	} else {
 		file = filei.(*cachedFile)
 		if write {
 			file.Lock()
+			if file.deleted {
+				// It's gone from the map now, start again with a new one.
+				file.Unlock()
+				return cache.lockFile(path, write, size)
+			}
 		} else {
 			file.RLock()
+			if file.deleted || cache.expiries.expired(path, cache.now()) || !cache.checkTTL(path, file) {
+				file.RUnlock()
+				return nil
+			}
 			file.readCount++
 		}
 	}
-	file.lastReadTime = time.Now()
+	file.lastReadTime = cache.now()
+	if write {
+		// It's about to be written, which sets its access time anyway.
+		file.storedTime = file.lastReadTime
+		file.persistedReadTime = file.lastReadTime
+	}
 	return file
 }
 
 // removeFile deletes a file from the cache map. It does not remove the on-disk file.
+// The caller must hold the write lock on the file.
 func (cache *Cache) removeFile(path string, file *cachedFile) {
+	file.deleted = true
 	cache.cachedFiles.Remove(path)
+	atomic.AddInt64(&cache.indexKeyBytes, -int64(len(path)))
 	atomic.AddInt64(&cache.totalSize, -file.size)
 	log.Debug("Removing file %s, saves %d, new size will be %d", path, file.size, cache.totalSize)
 }
 
 // removeAndDeleteFile deletes a file from the cache map and on-disk.
+// It's removed from disk first, so anyone who doesn't find it in the map won't find it on disk either.
 func (cache *Cache) removeAndDeleteFile(p string, file *cachedFile) {
+	fullPath := path.Join(cache.rootPath, p)
+	if err := os.RemoveAll(fullPath); err != nil {
+		log.Error("Failed to delete file: %s", fullPath)
+	}
+	if file.size == 0 {
+		if err := unmarkEmpty(fullPath); err != nil {
+			log.Error("Failed to delete marker for empty file %s: %s", fullPath, err)
+		}
+	} else if err := removeChecksum(fullPath); err != nil {
+		log.Error("Failed to delete checksum for %s: %s", fullPath, err)
+	}
 	cache.removeFile(p, file)
-	p = path.Join(cache.rootPath, p)
-	if err := os.RemoveAll(p); err != nil {
-		log.Error("Failed to delete file: %s", p)
+	cache.removeEmptyDirs(p)
+}
+
+// removeEmptyDirs removes the parent directories of the given artifact path if they're empty,
+// if we've been configured to do so. It stops at the first one that isn't empty.
+// This is safe against a concurrent store since removing a directory fails if there's anything
+// in it, and StoreArtifact recreates any directories that disappear before it writes the file.
+func (cache *Cache) removeEmptyDirs(artPath string) {
+	cache.scheduleMutex.Lock()
+	enabled := cache.cleanEmptyDirs
+	cache.scheduleMutex.Unlock()
+	if !enabled {
+		return
 	}
+	for dir := path.Dir(path.Clean(artPath)); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if err := os.Remove(path.Join(cache.rootPath, dir)); err != nil {
+			return // Most likely not empty, which is fine.
+		}
+		log.Debug("Removed empty directory %s", dir)
+	}
+}
+
+// deleteFile locks the given file and deletes it from the cache map and on-disk.
+// It returns false if it had already been deleted by someone else.
+// Readers that have already opened the file are unaffected (see readFiles);
+// any that arrive after this has begun will get a miss.
+// The deletion is recorded in the audit log, if there is one, with the given reason.
+func (cache *Cache) deleteFile(p string, file *cachedFile, reason audit.Reason) bool {
+	file.Lock()
+	defer file.Unlock()
+	if file.deleted {
+		return false
+	}
+	cache.removeAndDeleteFile(p, file)
+	cache.currentAuditLog().Record(p, file.size, reason)
+	return true
+}
+
+// evictFile is like deleteFile but is used by the cleaner, which chooses what to evict without
+// holding the files' locks. It doesn't delete the file if it's been stored again since the cleaner
+// chose it (i.e. its stored time is no longer the given one), since that would throw away
+// the contents that were just written, or if it's protected by a build session.
+func (cache *Cache) evictFile(p string, file *cachedFile, storedTime time.Time, reason audit.Reason) bool {
+	file.Lock()
+	defer file.Unlock()
+	if file.deleted {
+		return false
+	} else if !file.storedTime.Equal(storedTime) {
+		log.Debug("Not evicting %s, it's been stored again since we chose it", p)
+		return false
+	} else if cache.protected(p) {
+		log.Debug("Not evicting %s, it's protected by a build session", p)
+		return false
+	}
+	cache.stats.record(p, func(s *cacheStats) {
+		s.Evictions++
+		s.EvictedBytes += file.size
+	})
+	cache.metrics.recordEviction(file.size, reason)
+	cache.removeAndDeleteFile(p, file)
+	cache.currentAuditLog().Record(p, file.size, reason)
+	if reason == audit.WaterMark {
+		cache.currentGhosts().add(p, file.size)
+	}
+	return true
 }
 
 // RetrieveArtifact takes in the artifact path as a parameter and checks in the base server
@@ -162,19 +692,18 @@ func (cache *Cache) removeAndDeleteFile(p string, file *cachedFile) {
 // return whatever's been stored there, which might be a directory and therefore contain
 // multiple files to be returned.
 func (cache *Cache) RetrieveArtifact(artPath string) (map[string][]byte, error) {
+	artPath = cache.normalize(artPath)
 	ret := map[string][]byte{}
 	if core.IsGlob(artPath) {
 		for _, art := range core.Glob(cache.rootPath, []string{artPath}, nil, nil, true) {
-			fullPath := path.Join(cache.rootPath, art)
-			lock := cache.lockFile(fullPath, false, 0)
-			body, err := ioutil.ReadFile(fullPath)
-			if lock != nil {
-				lock.RUnlock()
+			if cache.expiries.expired(art, cache.now()) {
+				continue
 			}
-			if err != nil {
+			lock := cache.lockFile(art, false, 0)
+			if err := cache.readFiles(path.Join(cache.rootPath, art), lock, ret); err != nil && !os.IsNotExist(err) {
+				// If it doesn't exist, the cleaner got to it after we globbed; just skip it.
 				return nil, err
 			}
-			ret[art] = body
 		}
 		return ret, nil
 	}
@@ -186,20 +715,181 @@ func (cache *Cache) RetrieveArtifact(artPath string) (map[string][]byte, error)
 		// (This is a debatable choice; it's a bit crap either way).
 		if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
 			return cache.retrieveDir(artPath)
+		} else if cache.restore(artPath) {
+			lock = cache.lockFile(artPath, false, 0)
 		}
-		return nil, os.ErrNotExist
+		if lock == nil {
+			cache.recordMiss(artPath)
+			return nil, os.ErrNotExist
+		}
+	}
+	if err := cache.readFiles(fullPath, lock, ret); err != nil {
+		return nil, err
 	}
-	defer lock.RUnlock()
+	return ret, nil
+}
 
+// readFiles reads the file or directory at the given path into the given map.
+// The caller must hold a read lock on the corresponding cachedFile, if there is one; it's
+// released by the time this returns.
+// All the files are opened while the lock is held. On platforms that allow reading a file
+// after it's been unlinked we then release it, so the cleaner doesn't wait on us but can't
+// remove anything from under us either; elsewhere we hold it until we're done reading.
+func (cache *Cache) readFiles(fullPath string, lock *cachedFile, ret map[string][]byte) error {
+	unlock := func() {
+		if lock != nil {
+			lock.RUnlock()
+			lock = nil
+		}
+	}
+	defer unlock()
+	files := map[string]*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
 	if err := filepath.Walk(fullPath, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
-		} else if !info.IsDir() {
-			body, err := ioutil.ReadFile(name)
+		} else if !info.IsDir() && !isEmptyMarker(name) && !isPartial(name) && !isChecksum(name) {
+			f, err := os.Open(name)
 			if err != nil {
 				return err
 			}
-			ret[name[len(cache.rootPath)+1:]] = body
+			files[name[len(cache.rootPath)+1:]] = f
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if canReadAfterUnlink {
+		unlock()
+	}
+	for name, f := range files {
+		body, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		} else if err := cache.verifyRetrieved(name, body); err != nil {
+			return err
+		} else if body, err = cache.unseal(name, body); err != nil {
+			return err
+		}
+		ret[name] = body
+		cache.stats.record(name, func(s *cacheStats) {
+			s.Retrieves++
+			s.RetrievedBytes += int64(len(body))
+		})
+		cache.metrics.hits.Inc()
+	}
+	return nil
+}
+
+// OpenArtifact opens a single file in the cache for reading. Unlike RetrieveArtifact it doesn't
+// read it into memory (unless it's encrypted), so callers can serve just part of it. It counts as
+// a read of the file.
+// The caller must call the returned function once they're done with it, which closes the file and
+// releases it so it can be cleaned again (as in readFiles, the latter happens immediately on
+// platforms that allow reading after unlinking).
+func (cache *Cache) OpenArtifact(artPath string) (ArtifactFile, func(), error) {
+	artPath = cache.normalize(artPath)
+	lock := cache.lockFile(artPath, false, 0)
+	if lock == nil && cache.restore(artPath) {
+		lock = cache.lockFile(artPath, false, 0)
+	}
+	if lock == nil {
+		cache.recordMiss(artPath)
+		return nil, nil, os.ErrNotExist
+	}
+	fullPath := path.Join(cache.rootPath, artPath)
+	if cache.verifyingChecksums() {
+		// This means reading it twice, but it is opt-in.
+		if b, err := ioutil.ReadFile(fullPath); err == nil {
+			if err := cache.verifyRetrieved(artPath, b); err != nil {
+				lock.RUnlock()
+				return nil, nil, err
+			}
+		}
+	}
+	f, err := cache.openArtifactFile(fullPath)
+	if err != nil {
+		lock.RUnlock()
+		return nil, nil, err
+	}
+	size := lock.size
+	cache.stats.record(artPath, func(s *cacheStats) {
+		s.Retrieves++
+		s.RetrievedBytes += size
+	})
+	cache.metrics.hits.Inc()
+	if canReadAfterUnlink {
+		lock.RUnlock()
+		return f, func() { f.Close() }, nil
+	}
+	return f, func() {
+		f.Close()
+		lock.RUnlock()
+	}, nil
+}
+
+// approximateSize returns roughly how many bytes retrieving the given artifact would read.
+// It's cheap, using the index where possible, and returns zero for globs & anything it can't find.
+func (cache *Cache) approximateSize(artPath string) int64 {
+	if filei, present := cache.cachedFiles.Get(artPath); present {
+		file := filei.(*cachedFile)
+		file.RLock()
+		defer file.RUnlock()
+		return file.size
+	} else if core.IsGlob(artPath) {
+		return 0
+	}
+	var size int64
+	filepath.Walk(path.Join(cache.rootPath, artPath), func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// An ArtifactStat describes a single file stored in the cache.
+type ArtifactStat struct {
+	Size int64
+	// Hex-encoded sha256 checksum of the file's contents.
+	Hash string
+}
+
+// StatArtifact is like RetrieveArtifact but returns the size and checksum of each file rather
+// than its contents. Unlike RetrieveArtifact it doesn't count as a read of the file, so it
+// doesn't affect when it's cleaned. Like it, anything that's passed its expiry is treated as missing.
+func (cache *Cache) StatArtifact(artPath string) (map[string]ArtifactStat, error) {
+	artPath = cache.normalize(artPath)
+	fullPath := path.Join(cache.rootPath, artPath)
+	if cache.expiries.expired(artPath, cache.now()) {
+		return nil, os.ErrNotExist
+	} else if filei, present := cache.cachedFiles.Get(artPath); present {
+		file := filei.(*cachedFile)
+		file.RLock()
+		defer file.RUnlock()
+		if file.deleted {
+			return nil, os.ErrNotExist
+		}
+	} else if info, err := os.Stat(fullPath); err != nil || (!info.IsDir() && !cache.hasUnindexed()) {
+		// As in RetrieveArtifact, we only allow directories that aren't tracked
+		// (or files that have been dropped from the index).
+		return nil, os.ErrNotExist
+	}
+	ret := map[string]ArtifactStat{}
+	if err := filepath.Walk(fullPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.IsDir() && !isEmptyMarker(name) && !isPartial(name) && !isChecksum(name) {
+			hash, size, err := cache.hashArtifact(name)
+			if err != nil {
+				return err
+			}
+			ret[name[len(cache.rootPath)+1:]] = ArtifactStat{Size: size, Hash: hash}
 		}
 		return nil
 	}); err != nil {
@@ -208,6 +898,29 @@ func (cache *Cache) RetrieveArtifact(artPath string) (map[string][]byte, error)
 	return ret, nil
 }
 
+// SamplePaths returns the paths of up to n files chosen at random from the cache.
+func (cache *Cache) SamplePaths(n int) []string {
+	ret := make([]string, 0, n)
+	i := 0
+	for t := range cache.cachedFiles.IterBuffered() {
+		// Reservoir sampling, so we don't have to hold all the paths at once.
+		if len(ret) < n {
+			ret = append(ret, t.Key)
+		} else if j := rand.Intn(i + 1); j < n {
+			ret[j] = t.Key
+		}
+		i++
+	}
+	// Directories can be in the map too (if we've stored metadata for them); we only want files.
+	files := ret[:0]
+	for _, p := range ret {
+		if info, err := os.Stat(path.Join(cache.rootPath, p)); err == nil && !info.IsDir() {
+			files = append(files, p)
+		}
+	}
+	return files
+}
+
 // retrieveDir retrieves a directory of artifacts. We don't track the directory itself
 // but allow its traversal to retrieve them.
 func (cache *Cache) retrieveDir(artPath string) (map[string][]byte, error) {
@@ -217,7 +930,7 @@ func (cache *Cache) retrieveDir(artPath string) (map[string][]byte, error) {
 	err := filepath.Walk(fullPath, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
-		} else if !info.IsDir() {
+		} else if !info.IsDir() && !isEmptyMarker(name) && !isPartial(name) && !isChecksum(name) {
 			// Must strip cache path off the front of this.
 			m, err := cache.RetrieveArtifact(name[len(cache.rootPath)+1:])
 			if err != nil {
@@ -236,31 +949,114 @@ func (cache *Cache) retrieveDir(artPath string) (map[string][]byte, error) {
 // the given content in the given path.
 // The function will return the first error found in the process, or nil if the process is successful.
 func (cache *Cache) StoreArtifact(artPath string, key []byte) error {
-	log.Info("Storing artifact %s", artPath)
-	lock := cache.lockFile(artPath, true, int64(len(key)))
+	artPath = cache.normalize(artPath)
+	log.Info("Storing artifact %s", cli.Field("key", artPath))
+	return cache.store(artPath, key, false)
+}
+
+// store implements StoreArtifact. If restored is true the artifact has just been copied back
+// from the storage backend, so it isn't counted as a store or written anywhere else.
+func (cache *Cache) store(artPath string, key []byte, restored bool) error {
+	contents, err := cache.seal(key)
+	if err != nil {
+		return err
+	}
+	size := int64(len(contents))
+	lock := cache.lockFile(artPath, true, size)
 	defer lock.Unlock()
 
 	fullPath := path.Join(cache.rootPath, artPath)
-	dirPath := path.Dir(fullPath)
-	if err := os.MkdirAll(dirPath, core.DirPermissions); err != nil {
-		log.Warning("Couldn't create path %s in http cache: %s", dirPath, err)
-		cache.removeAndDeleteFile(artPath, lock)
-		os.RemoveAll(dirPath)
-		return err
+	if lock.size != size {
+		// Only possible if it was already stored. Artifacts are keyed by the hash of their
+		// inputs so they should always be the same; if not, it's either a collision or a
+		// nondeterministic build, both of which are worth knowing about.
+		if err := cache.keyCollision(artPath, fullPath, lock, key); err != nil {
+			return err
+		}
+		atomic.AddInt64(&cache.totalSize, size-lock.size)
+		lock.size = size
 	}
 	log.Debug("Writing artifact to %s", fullPath)
-	if err := core.WriteFile(bytes.NewReader(key), fullPath, 0); err != nil {
+	atomic.AddInt64(&cache.writes, 1)
+	defer atomic.AddInt64(&cache.writes, -1)
+	algorithm := cache.currentChecksumAlgorithm()
+	if err := writeArtifact(fullPath, contents, algorithm); err != nil {
 		log.Errorf("Could not create %s artifact: %s", fullPath, err)
 		cache.removeAndDeleteFile(artPath, lock)
 		return err
+	} else if err := verifyArtifact(fullPath, size); err != nil {
+		log.Errorf("Failed to verify %s artifact: %s", fullPath, err)
+		cache.removeAndDeleteFile(artPath, lock)
+		return err
+	}
+	if restored {
+		return nil
 	}
+	cache.stats.record(artPath, func(s *cacheStats) {
+		s.Stores++
+		s.StoredBytes += int64(len(key))
+	})
+	cache.metrics.stores.Inc()
+	cache.metrics.storedBytes.Add(float64(len(key)))
+	if m := cache.currentMirror(); m != nil && !m.Enqueue(artPath, contents, algorithm) {
+		log.Debug("Mirror backlog is full, not mirroring %s", artPath)
+	}
+	cache.persist(artPath, contents)
 	return nil
 }
 
+// keyCollision handles a store to an existing artifact whose size on disk differs from it.
+// It returns an error if the store should be rejected.
+func (cache *Cache) keyCollision(artPath, fullPath string, file *cachedFile, contents []byte) error {
+	existing, _, err := cache.hashArtifact(fullPath)
+	if err != nil {
+		existing = err.Error()
+	}
+	sum := sha256.Sum256(contents)
+	if existing == hex.EncodeToString(sum[:]) {
+		// Same contents, just stored differently (e.g. one of them is encrypted).
+		return nil
+	}
+	cache.metrics.keyCollisions.Inc()
+	log.Warning("Key collision storing %s: already have %d bytes (sha256 %s), now storing %d bytes (sha256 %s)",
+		artPath, file.size, existing, len(contents), hex.EncodeToString(sum[:]))
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	if cache.rejectCollisions {
+		return errKeyCollision
+	}
+	return nil
+}
+
+// writeArtifact writes the contents of an artifact to the given path, creating its directory as needed.
+// The cleaner may be concurrently removing empty directories, so if one disappears from under us
+// we simply create it again.
+// Empty artifacts are marked as such first (see emptyMarkerSuffix), and any previous checksum is
+// removed until the new one is written afterwards with the given algorithm (see checksumSuffix).
+func writeArtifact(fullPath string, contents []byte, algorithm *checksumAlgorithm) error {
+	for i := 1; ; i++ {
+		err := prepareArtifact(fullPath, int64(len(contents)))
+		if err == nil {
+			err = removeChecksum(fullPath)
+		}
+		if err == nil {
+			err = writeFileAtomically(fullPath, contents)
+		}
+		if err == nil {
+			err = writeChecksum(fullPath, contents, algorithm)
+		}
+		if err == nil || !os.IsNotExist(err) || i >= maxWriteAttempts {
+			return err
+		}
+		log.Debug("Directory for %s was removed while writing it, retrying", fullPath)
+	}
+}
+
 // StoreMetadata stores some metadata about the given artifact in a simple format.
 // This mostly just identifies where it came from.
 func (cache *Cache) StoreMetadata(artPath, hostname, address, peer string) error {
-	log.Info("Storing metadata for %s", artPath)
+	artPath = cache.normalize(artPath)
+	log.Info("Storing metadata for %s", cli.Field("key", artPath))
 	lock := cache.lockFile(artPath, true, 0)
 	defer lock.Unlock()
 	fullPath := path.Join(cache.rootPath, artPath, metadataFileName)
@@ -275,7 +1071,12 @@ func (cache *Cache) StoreMetadata(artPath, hostname, address, peer string) error
 // DeleteArtifact takes in the artifact path as a parameter and removes the artifact from disk.
 // The function will return the first error found in the process, or nil if the process is successful.
 func (cache *Cache) DeleteArtifact(artPath string) error {
-	log.Info("Deleting artifact %s", artPath)
+	artPath = cache.normalize(artPath)
+	log.Info("Deleting artifact %s", cli.Field("key", artPath))
+	if cache.hasUnindexed() {
+		// Bring back anything that's been dropped from the index so it's accounted for below.
+		cache.admitAll(artPath)
+	}
 	// We need to search the entire map for prefixes. Pessimism follows...
 	paths := cachedFilePaths{}
 	for t := range cache.cachedFiles.IterBuffered() {
@@ -287,11 +1088,13 @@ func (cache *Cache) DeleteArtifact(artPath string) error {
 	//     We create the temporary slice in preference to calling .Items() and duplicating
 	//     the entire map.
 	for _, p := range paths {
-		p.file.Lock()
-		cache.removeFile(p.path, p.file)
-		p.file.Unlock()
+		cache.deleteFile(p.path, p.file, audit.Manual)
+	}
+	if err := os.RemoveAll(path.Join(cache.rootPath, artPath)); err != nil {
+		return err
 	}
-	return os.RemoveAll(path.Join(cache.rootPath, artPath))
+	cache.removeEmptyDirs(artPath)
+	return cache.unpersist(artPath)
 }
 
 // DeleteAllArtifacts will remove all files in the cache directory.
@@ -299,48 +1102,181 @@ func (cache *Cache) DeleteArtifact(artPath string) error {
 func (cache *Cache) DeleteAllArtifacts() error {
 	// Empty entire cache now.
 	log.Warning("Deleting entire cache")
+	cache.currentAuditLog().Record(audit.AllKeys, atomic.LoadInt64(&cache.totalSize), audit.Manual)
 	cache.cachedFiles = cmap.New()
 	cache.totalSize = 0
+	cache.unindexed = 0
+	cache.indexKeyBytes = 0
+	cache.buildKeys.reset()
+	cache.shadowKeys.reset()
+	cache.expiries.reset()
+	if cache.currentStorage() != nil {
+		go func() {
+			if err := cache.unpersist(""); err != nil {
+				log.Error("Failed to delete artifacts from storage: %s", err)
+			}
+		}()
+	}
 	return core.AsyncDeleteDir(cache.rootPath)
 }
 
 // clean implements a periodic clean of the cache to remove old artifacts.
 func (cache *Cache) clean(cleanFrequency, maxArtifactAge time.Duration, lowWaterMark, highWaterMark int64) {
-	for range time.NewTicker(cleanFrequency).C {
+	for {
+		time.Sleep(cache.untilNextClean(time.Now(), cleanFrequency))
+		if cache.InMaintenance() {
+			log.Info("Not cleaning cache, in maintenance mode")
+			continue
+		}
+		if cache.dryRun() {
+			cache.previewClean(maxArtifactAge, lowWaterMark, highWaterMark).logCandidates()
+			continue
+		}
+		if _, ok := cache.cleanOnce(true, maxArtifactAge, lowWaterMark, highWaterMark); !ok {
+			log.Warning("Too many other nodes are cleaning, will not clean until next cycle")
+		}
+	}
+}
+
+// cleanOnce takes a clean lease from the coordinator, if there is one, then cleans the cache once
+// and returns what it removed. If wait is true it retries for a while if the lease is refused
+// (see startClean), otherwise it only asks once. It returns false if it didn't get the lease.
+// Only one runs at a time, so the scheduled clean and CleanNow never overlap or release each
+// other's lease; if one is already in progress this waits for it to finish.
+func (cache *Cache) cleanOnce(wait bool, maxArtifactAge time.Duration, lowWaterMark, highWaterMark int64) (cacheStats, bool) {
+	cache.waitForScan()
+	cache.cleanMutex.Lock()
+	defer cache.cleanMutex.Unlock()
+	coordinator, maxFraction, leaseTTL := cache.cleanCoordinator()
+	if wait && !cache.startClean(coordinator, maxFraction, leaseTTL, cleanRetryDelay) {
+		return cacheStats{}, false
+	} else if !wait && coordinator != nil && !coordinator.StartClean(maxFraction, leaseTTL) {
+		return cacheStats{}, false
+	}
+	if coordinator != nil {
+		defer coordinator.FinishClean()
+	}
+	return cache.observeClean(func() {
+		cache.cleanExpiredArtifacts()
 		cache.cleanOldFiles(maxArtifactAge)
-		cache.singleClean(lowWaterMark, highWaterMark)
+		cache.cleanExpiredFiles()
+		cache.singleClean(cache.waterMarks(lowWaterMark, highWaterMark))
+		cache.cleanStorage(lowWaterMark, highWaterMark)
+	}), true
+}
+
+// untilNextClean returns the time to wait from now until the next clean should begin.
+// Without any jitter that's simply the clean frequency; with it, cleans are aligned to a
+// fixed offset within each period so different nodes are staggered from one another.
+func (cache *Cache) untilNextClean(now time.Time, cleanFrequency time.Duration) time.Duration {
+	cache.scheduleMutex.Lock()
+	node, jitter := cache.cleanNode, cache.cleanJitter
+	cache.scheduleMutex.Unlock()
+	if jitter <= 0 {
+		return cleanFrequency
+	}
+	next := now.Truncate(cleanFrequency).Add(cleanOffset(node, jitter) % cleanFrequency)
+	for !next.After(now) {
+		next = next.Add(cleanFrequency)
+	}
+	return next.Sub(now)
+}
+
+// cleanOffset returns the offset in the clean schedule for the given node.
+func cleanOffset(node string, jitter time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(node))
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
+
+// cleanCoordinator returns the current clean coordinator, the fraction of nodes it permits & the TTL of its leases.
+func (cache *Cache) cleanCoordinator() (CleanCoordinator, float64, time.Duration) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.coordinator, cache.maxCleanFraction, cache.cleanLeaseTTL
+}
+
+// retention returns the minimum retention time for newly stored files.
+func (cache *Cache) retention() time.Duration {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.minRetention
+}
+
+// startClean asks the coordinator (if there is one) for permission to clean, retrying a
+// limited number of times if it's refused. It returns true if we may clean.
+func (cache *Cache) startClean(coordinator CleanCoordinator, maxFraction float64, leaseTTL, retryDelay time.Duration) bool {
+	if coordinator == nil {
+		return true
+	}
+	for i := 0; i < maxCleanRetries; i++ {
+		if coordinator.StartClean(maxFraction, leaseTTL) {
+			return true
+		}
+		log.Info("Waiting for other nodes to finish cleaning...")
+		time.Sleep(retryDelay)
 	}
+	return false
 }
 
 // cleanOldFiles cleans any files whose last access time is older than the given duration.
 func (cache *Cache) cleanOldFiles(maxArtifactAge time.Duration) bool {
 	log.Debug("Searching for old files...")
-	oldestTime := time.Now().Add(-maxArtifactAge)
+	now := cache.now()
 	cleaned := 0
-	for t := range cache.cachedFiles.IterBuffered() {
-		f := t.Val.(*cachedFile)
-		if f.lastReadTime.Before(oldestTime) {
-			lock := cache.lockFile(t.Key, true, f.size)
-			cache.removeAndDeleteFile(t.Key, f)
-			lock.Unlock()
+	files, future := cache.oldFiles(now, maxArtifactAge)
+	for _, file := range files {
+		if cache.evictFile(file.path, file.file, file.storedTime, audit.Age) {
 			cleaned++
 		}
 	}
+	if future > 0 {
+		log.Warning("Found %d files last read in the future; the system clock may have gone backwards", future)
+	}
+	if cache.hasUnindexed() {
+		cleaned += cache.cleanUnindexed(now.Add(-maxArtifactAge), 0, audit.Age)
+	}
 	log.Notice("Removed %d old files, new size: %d, %d files", cleaned, cache.totalSize, cache.cachedFiles.Count())
 	return cleaned > 0
 }
 
+// oldFiles returns the files whose last access time was longer than the given duration before the
+// given time, and the number that were last accessed after it.
+func (cache *Cache) oldFiles(now time.Time, maxArtifactAge time.Duration) (cachedFilePaths, int) {
+	ret := cachedFilePaths{}
+	future := 0
+	for t := range cache.cachedFiles.IterBuffered() {
+		if f := t.Val.(*cachedFile); f.lastReadTime.After(now) {
+			future++
+		} else if accessAge(f.lastReadTime, now) > maxArtifactAge {
+			ret = append(ret, cachedFilePath{file: f, path: t.Key, storedTime: f.storedTime})
+		}
+	}
+	return ret, future
+}
+
 // singleClean runs a single clean of the cache. It's split out for testing purposes.
 func (cache *Cache) singleClean(lowWaterMark, highWaterMark int64) bool {
 	log.Debug("Total size: %d High water mark: %d", cache.totalSize, highWaterMark)
 	if cache.totalSize > highWaterMark {
 		log.Info("Cleaning cache...")
+		if cache.hasUnindexed() {
+			// Files older than anything in the index go first, without bringing them all back into it.
+			// A file can't have been stored after it was last read, so these are never within the retention time.
+			olderThan := cache.oldestIndexed()
+			if retainFrom := cache.now().Add(-cache.retention()); retainFrom.Before(olderThan) {
+				olderThan = retainFrom
+			}
+			log.Info("Removed %d files that weren't indexed", cache.cleanUnindexed(olderThan, lowWaterMark, audit.WaterMark))
+		}
 		files := cache.filesToClean(lowWaterMark)
 		log.Info("Identified %d files to clean...", len(files))
 		for _, file := range files {
-			lock := cache.lockFile(file.path, true, file.file.size)
-			cache.removeAndDeleteFile(file.path, file.file)
-			lock.Unlock()
+			cache.evictFile(file.path, file.file, file.storedTime, audit.WaterMark)
+		}
+		if size := atomic.LoadInt64(&cache.totalSize); size > highWaterMark && cache.retention() > 0 {
+			log.Warning("Cache is still above its high water mark after cleaning (%s > %s); recently stored files are being retained",
+				humanize.Bytes(uint64(size)), humanize.Bytes(uint64(highWaterMark)))
 		}
 		return true
 	}
@@ -351,6 +1287,8 @@ func (cache *Cache) singleClean(lowWaterMark, highWaterMark int64) bool {
 type cachedFilePath struct {
 	file *cachedFile
 	path string
+	// storedTime is the file's stored time when it was chosen by filesToClean.
+	storedTime time.Time
 }
 
 type cachedFilePaths []cachedFilePath
@@ -362,16 +1300,45 @@ func (c cachedFilePaths) Less(i, j int) bool {
 }
 
 // filesToClean returns a list of files that should be cleaned, ie. the least interesting
-// artifacts in the cache according to some heuristic. Removing all of them will be
-// sufficient to reduce the cache size below lowWaterMark.
+// artifacts in the cache according to some heuristic (either LRU or cost-aware eviction).
+// Removing all of them will be sufficient to reduce the cache size below lowWaterMark.
+// Files stored within the minimum retention time, or protected by a build session, are never included.
 func (cache *Cache) filesToClean(lowWaterMark int64) cachedFilePaths {
+	return cache.chooseFilesToClean(atomic.LoadInt64(&cache.totalSize), lowWaterMark, nil)
+}
+
+// chooseFilesToClean is like filesToClean, but as if the cache were the given size and didn't
+// contain any of the given set of files.
+func (cache *Cache) chooseFilesToClean(size, lowWaterMark int64, without map[string]bool) cachedFilePaths {
+	cache.scheduleMutex.Lock()
+	weights, retention := cache.costWeights, cache.minRetention
+	cache.scheduleMutex.Unlock()
+	now := cache.now()
 	ret := make(cachedFilePaths, 0, len(cache.cachedFiles))
+	retained := 0
+	protected := 0
 	for t := range cache.cachedFiles.IterBuffered() {
-		ret = append(ret, cachedFilePath{file: t.Val.(*cachedFile), path: t.Key})
+		if f := t.Val.(*cachedFile); retention > 0 && now.Sub(f.storedTime) < retention {
+			retained++
+		} else if cache.protected(t.Key) {
+			protected++
+		} else if !without[t.Key] {
+			ret = append(ret, cachedFilePath{file: f, path: t.Key, storedTime: f.storedTime})
+		}
+	}
+	if retained > 0 {
+		log.Info("Retaining %d files stored in the last %s", retained, retention)
+	}
+	if protected > 0 {
+		log.Info("Retaining %d files protected by build sessions", protected)
+	}
+	if weights != nil {
+		sort.Sort(newScoredFiles(ret, weights, now))
+	} else {
+		sort.Sort(&ret)
 	}
-	sort.Sort(&ret)
 
-	sizeToDelete := cache.totalSize - lowWaterMark
+	sizeToDelete := size - lowWaterMark
 	var sizeDeleted int64
 	for i, file := range ret {
 		if sizeDeleted >= sizeToDelete {
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"tools/cache/audit"
+)
+
+// cacheMetrics are the metrics of a single cache, and of the servers built on it.
+// Each cache has its own, so several in one process (e.g. in tests) don't share counts;
+// they're registered by RegisterMetrics.
+type cacheMetrics struct {
+	hits, misses, stores, storedBytes                prometheus.Counter
+	evictions, evictedBytes                          *prometheus.CounterVec
+	cleanDuration, cleanFreedBytes, cleanFreedFiles  prometheus.Histogram
+	ghostHits, ghostHitBytes                         prometheus.Counter
+	ghostEntries                                     prometheus.Gauge
+	mirrorWrites, mirrorDropped, mirrorFailures      prometheus.Counter
+	mirrorBacklog                                    prometheus.Gauge
+	shadowRetrieves                                  prometheus.Counter
+	shadowHits                                       *prometheus.CounterVec
+	keyCollisions, decryptionFailures, scrubbedFiles prometheus.Counter
+	compressionSkipped                               prometheus.Counter
+	corruptArtifacts                                 *prometheus.CounterVec
+	unverifiableArtifacts                            *prometheus.CounterVec
+	upstreamRequests, storageRequests                *prometheus.CounterVec
+	storageSize                                      *prometheus.GaugeVec
+	oversizedStores, duplicateStores, shedStores     prometheus.Counter
+	heartbeatFailures                                prometheus.Counter
+}
+
+// newCacheMetrics returns a new set of cache metrics.
+func newCacheMetrics() *cacheMetrics {
+	return &cacheMetrics{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "hits_total",
+			Help:      "Number of files retrieved from the cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "misses_total",
+			Help:      "Number of retrieves of artifacts that weren't in the cache.",
+		}),
+		stores: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "stores_total",
+			Help:      "Number of files stored in the cache.",
+		}),
+		storedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "stored_bytes_total",
+			Help:      "Total size of the files stored in the cache, before they're compressed or encrypted.",
+		}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "evictions_total",
+			Help:      "Number of files removed from the cache by the cleaner, by why they were removed.",
+		}, []string{"reason"}),
+		evictedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "evicted_bytes_total",
+			Help:      "Total size on disk of the files removed from the cache by the cleaner, by why they were removed.",
+		}, []string{"reason"}),
+		cleanDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "plz_cache",
+			Name:      "clean_duration_seconds",
+			Help:      "How long each clean of the cache took.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		}),
+		cleanFreedBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "plz_cache",
+			Name:      "clean_freed_bytes",
+			Help:      "Total size on disk of the files removed by each clean of the cache.",
+			Buckets:   prometheus.ExponentialBuckets(1024*1024, 4, 10),
+		}),
+		cleanFreedFiles: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "plz_cache",
+			Name:      "clean_freed_files",
+			Help:      "Number of files removed by each clean of the cache.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		}),
+		ghostHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "ghost_hits_total",
+			Help:      "Number of retrieves that missed for a file we'd recently evicted to get under the high water mark, i.e. that a bigger cache would have hit.",
+		}),
+		ghostHitBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "ghost_hit_bytes_total",
+			Help:      "Total size of the files counted by plz_cache_ghost_hits_total.",
+		}),
+		ghostEntries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "ghost_entries",
+			Help:      "Number of recently evicted files remembered in the ghost cache.",
+		}),
+		mirrorWrites: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "mirror_writes_total",
+			Help:      "Number of artifacts successfully written to the mirror.",
+		}),
+		mirrorDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "mirror_dropped_total",
+			Help:      "Number of artifacts not written to the mirror because its backlog was full.",
+		}),
+		mirrorFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "mirror_failures_total",
+			Help:      "Number of artifacts that failed to be written to the mirror.",
+		}),
+		mirrorBacklog: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "mirror_backlog_bytes",
+			Help:      "Total size of the artifacts waiting to be written to the mirror.",
+		}),
+		shadowRetrieves: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "shadow_retrieves_total",
+			Help:      "Number of retrieves that carried a shadow hash.",
+		}),
+		shadowHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "shadow_hits_total",
+			Help:      "Number of retrieves carrying a shadow hash that were hits, under the real hash (key=real) and the shadow one (key=shadow). Divide by plz_cache_shadow_retrieves_total for the hit ratios.",
+		}, []string{"key"}),
+		keyCollisions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "key_collisions_total",
+			Help:      "Number of stores of an artifact that differed in size from what was already stored for it.",
+		}),
+		decryptionFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "decryption_failures_total",
+			Help:      "Number of artifacts that couldn't be decrypted when read, e.g. because they're corrupt or were encrypted with a different master key.",
+		}),
+		compressionSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "compression_skipped_total",
+			Help:      "Number of artifacts stored uncompressed, despite compression at rest, because a sample of them barely compressed (e.g. as they're compressed already).",
+		}),
+		corruptArtifacts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "corrupt_artifacts_total",
+			Help:      "Number of files found not to match their checksums, and so deleted, by what found them (retrieve or scrub).",
+		}, []string{"source"}),
+		unverifiableArtifacts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "unverifiable_artifacts_total",
+			Help:      "Number of times files were found with checksums made with an algorithm other than the one enabled, and so couldn't be verified, by what found them (retrieve or scrub).",
+		}, []string{"source"}),
+		scrubbedFiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "scrubbed_files_total",
+			Help:      "Number of files whose checksums have been verified by the scrubber.",
+		}),
+		upstreamRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "upstream_requests_total",
+			Help:      "Number of requests made to the upstream cache, by operation (retrieve, revalidate or store) and result (hit, miss or error for retrieves and revalidations, success or error for stores).",
+		}, []string{"operation", "result"}),
+		storageRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "storage_requests_total",
+			Help:      "Number of requests made to the storage backend, by operation and result (hit, miss, success or error).",
+		}, []string{"operation", "result"}),
+		storageSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "storage_size_bytes",
+			Help:      "Total size of the artifacts in each storage backend (the storage route's name, or default if they're not routed), as of the last clean.",
+		}, []string{"backend"}),
+		oversizedStores: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "oversized_stores_total",
+			Help:      "Number of stores rejected because an artifact in them was larger than the maximum artifact size.",
+		}),
+		duplicateStores: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "duplicate_stores_total",
+			Help:      "Number of stores that weren't written because they duplicated another recent store.",
+		}),
+		shedStores: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "shed_stores_total",
+			Help:      "Number of stores rejected because disk latency was over the load shedding threshold.",
+		}),
+		heartbeatFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "heartbeat_failures_total",
+			Help:      "Number of heartbeats that couldn't be sent to the monitor, after retrying.",
+		}),
+	}
+}
+
+// collectors returns all the metrics' collectors.
+func (m *cacheMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.hits, m.misses, m.stores, m.storedBytes, m.evictions, m.evictedBytes,
+		m.cleanDuration, m.cleanFreedBytes, m.cleanFreedFiles,
+		m.ghostHits, m.ghostHitBytes, m.ghostEntries,
+		m.mirrorWrites, m.mirrorDropped, m.mirrorFailures, m.mirrorBacklog,
+		m.shadowRetrieves, m.shadowHits,
+		m.keyCollisions, m.decryptionFailures, m.compressionSkipped, m.corruptArtifacts, m.unverifiableArtifacts, m.scrubbedFiles,
+		m.upstreamRequests, m.storageRequests, m.storageSize,
+		m.oversizedStores, m.duplicateStores, m.shedStores, m.heartbeatFailures,
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (m *cacheMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (m *cacheMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// recordEviction records the given file being removed by the cleaner.
+func (m *cacheMetrics) recordEviction(size int64, reason audit.Reason) {
+	m.evictions.WithLabelValues(string(reason)).Inc()
+	m.evictedBytes.WithLabelValues(string(reason)).Add(float64(size))
+}
+
+// observeClean runs the given function, which cleans the cache, and records how long it took
+// and how much it removed. It returns the stats of what was done meanwhile.
+func (cache *Cache) observeClean(clean func()) cacheStats {
+	start := time.Now()
+	before := cache.stats.totals()
+	clean()
+	freed := cache.stats.totals().sub(before)
+	cache.metrics.cleanDuration.Observe(time.Since(start).Seconds())
+	cache.metrics.cleanFreedBytes.Observe(float64(freed.EvictedBytes))
+	cache.metrics.cleanFreedFiles.Observe(float64(freed.Evictions))
+	return freed
+}
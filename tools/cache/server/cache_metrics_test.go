@@ -0,0 +1,95 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHitAndMissMetrics(t *testing.T) {
+	const key = "linux_amd64/pkg/target/hash/file"
+	cache := newCache("test_hit_miss_metrics")
+	defer os.RemoveAll(cache.rootPath)
+	hits, misses, stores, storedBytes := metricValue(t, cache.metrics.hits), metricValue(t, cache.metrics.misses), metricValue(t, cache.metrics.stores), metricValue(t, cache.metrics.storedBytes)
+
+	_, err := cache.RetrieveArtifact(key)
+	assert.Error(t, err)
+	assert.Equal(t, misses+1, metricValue(t, cache.metrics.misses))
+
+	require.NoError(t, cache.StoreArtifact(key, []byte("contents")))
+	assert.Equal(t, stores+1, metricValue(t, cache.metrics.stores))
+	assert.Equal(t, storedBytes+8, metricValue(t, cache.metrics.storedBytes))
+
+	_, err = cache.RetrieveArtifact(key)
+	assert.NoError(t, err)
+	f, done, err := cache.OpenArtifact(key)
+	require.NoError(t, err)
+	f.Close()
+	done()
+	assert.Equal(t, hits+2, metricValue(t, cache.metrics.hits))
+	assert.Equal(t, misses+1, metricValue(t, cache.metrics.misses))
+}
+
+func TestCleanMetrics(t *testing.T) {
+	cache := newCache("test_clean_metrics")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash1/file", []byte("contents")))
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash2/file", []byte("contents")))
+	evictions := metricValue(t, cache.metrics.evictions.WithLabelValues("water_mark"))
+	evictedBytes := metricValue(t, cache.metrics.evictedBytes.WithLabelValues("water_mark"))
+	before := histogram(t, cache.metrics.cleanFreedFiles)
+
+	cache.observeClean(func() { cache.singleClean(0, 1) })
+	assert.Equal(t, 0, cache.NumFiles())
+	assert.Equal(t, evictions+2, metricValue(t, cache.metrics.evictions.WithLabelValues("water_mark")))
+	assert.Equal(t, evictedBytes+16, metricValue(t, cache.metrics.evictedBytes.WithLabelValues("water_mark")))
+	after := histogram(t, cache.metrics.cleanFreedFiles)
+	assert.EqualValues(t, before.GetSampleCount()+1, after.GetSampleCount())
+	assert.Equal(t, before.GetSampleSum()+2, after.GetSampleSum())
+	assert.EqualValues(t, before.GetSampleCount()+1, histogram(t, cache.metrics.cleanDuration).GetSampleCount())
+}
+
+func TestSeparateCacheMetrics(t *testing.T) {
+	// Each cache counts its own hits, stores etc., so several in one process don't add up.
+	c1 := newCache("test_separate_metrics_1")
+	defer os.RemoveAll(c1.rootPath)
+	c2 := newCache("test_separate_metrics_2")
+	defer os.RemoveAll(c2.rootPath)
+	require.NoError(t, c1.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("contents")))
+	assert.EqualValues(t, 1, metricValue(t, c1.metrics.stores))
+	assert.EqualValues(t, 0, metricValue(t, c2.metrics.stores))
+}
+
+func TestSizeMetrics(t *testing.T) {
+	cache := newCache("test_size_metrics")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("contents")))
+	registry := prometheus.NewRegistry()
+	cache.RegisterMetrics(registry)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	values := map[string]float64{}
+	for _, family := range families {
+		values[family.GetName()] = family.Metric[0].Gauge.GetValue()
+	}
+	assert.EqualValues(t, 8, values["plz_cache_size_bytes"])
+	assert.EqualValues(t, 1, values["plz_cache_files"])
+}
+
+// metricValue returns the current value of the given counter.
+func metricValue(t *testing.T, counter prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, counter.Write(m))
+	return m.Counter.GetValue()
+}
+
+// histogram returns the current state of the given histogram.
+func histogram(t *testing.T, h prometheus.Histogram) *dto.Histogram {
+	m := &dto.Metric{}
+	require.NoError(t, h.Write(m))
+	return m.Histogram
+}
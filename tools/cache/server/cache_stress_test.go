@@ -2,10 +2,12 @@
 package server
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
@@ -118,6 +120,107 @@ func TestInParallelWithCleaning(t *testing.T) {
 	wg.Wait()
 }
 
+func TestRetrieveWhileCleaning(t *testing.T) {
+	// Hammer retrieves while the cleaner repeatedly empties the cache. Every read must either
+	// get the complete contents or a clean miss, never a partial or corrupt one.
+	const numFiles = 100
+	c := newCache("cache_clean")
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 16*1024) // Big enough that reads take a little while.
+	size := int64(len(contents))
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				path := fmt.Sprintf("src/clean/%d.dat", r.Intn(numFiles))
+				art, err := c.RetrieveArtifact(path)
+				if os.IsNotExist(err) {
+					continue
+				}
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(contents, art[path]), "Corrupt read of %s (got %d bytes)", path, len(art[path]))
+			}
+		}(i)
+	}
+	for round := 0; round < 10; round++ {
+		for i := 0; i < numFiles; i++ {
+			assert.NoError(t, c.StoreArtifact(fmt.Sprintf("src/clean/%d.dat", i), contents))
+		}
+		// Clean it down a tenth at a time so reads keep racing with deletions.
+		for i := numFiles - 10; i >= 0; i -= 10 {
+			c.singleClean(int64(i)*size, int64(i)*size)
+		}
+		assert.Equal(t, 0, c.NumFiles())
+		assert.EqualValues(t, 0, c.TotalSize())
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestStoreWhileCleaning(t *testing.T) {
+	// Store a handful of keys over and over from several goroutines while the cleaner repeatedly
+	// evicts them. Once everything's stopped the index has to agree exactly with what's on disk.
+	const numFiles = 10
+	c := newCache("cache_store_clean")
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < 200; j++ {
+				path := fmt.Sprintf("src/store_clean/%d.dat", r.Intn(numFiles))
+				// Vary the size so the total size accounting gets exercised too.
+				assert.NoError(t, c.StoreArtifact(path, bytes.Repeat([]byte{byte(i)}, 1+r.Intn(1024))))
+			}
+		}(i)
+	}
+	cleaned := make(chan struct{})
+	go func() {
+		defer close(cleaned)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			c.singleClean(0, 0)
+			c.cleanOldFiles(0)
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-cleaned
+
+	var indexed int64
+	for t := range c.cachedFiles.IterBuffered() {
+		indexed += t.Val.(*cachedFile).size
+	}
+	var onDisk int64
+	files := 0
+	filepath.Walk(c.rootPath, func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !isChecksum(name) {
+			p := name[len(c.rootPath)+1:]
+			assert.True(t, c.cachedFiles.Has(p), "%s is on disk but not in the index", p)
+			onDisk += info.Size()
+			files++
+		}
+		return nil
+	})
+	assert.Equal(t, files, c.NumFiles())
+	assert.Equal(t, onDisk, indexed)
+	assert.Equal(t, onDisk, c.TotalSize())
+}
+
 func artifact(i int) (string, []byte) {
 	path := fmt.Sprintf("src/%d/%d/%d.dat", i/100, i/10, i)
 	contents := sha1.Sum([]byte(strconv.Itoa(i)))
@@ -2,6 +2,7 @@
 package server
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"core"
+	"tools/cache/audit"
 )
 
 var cache *Cache
@@ -68,6 +70,43 @@ func TestCleanOldFiles(t *testing.T) {
 	assert.Equal(t, 2, c.cachedFiles.Count())
 }
 
+func TestCleanOldFilesClockSkew(t *testing.T) {
+	c := newCache("test_clean_old_files_skew")
+	c.cachedFiles.Set("test/artifact/1", &cachedFile{
+		lastReadTime: time.Now().AddDate(0, 0, 5), // Somehow in the future
+		size:         1000,
+	})
+	c.cachedFiles.Set("test/artifact/2", &cachedFile{
+		lastReadTime: time.Now().AddDate(0, 0, -5),
+		size:         1000,
+	})
+	c.totalSize = 2000
+	assert.True(t, c.cleanOldFiles(72*time.Hour))
+	assert.Equal(t, 1, c.cachedFiles.Count())
+	assert.True(t, c.cachedFiles.Has("test/artifact/1"), "Files from the future aren't treated as old")
+}
+
+func TestScanClampsFutureTimes(t *testing.T) {
+	const dir = "test_scan_future_times"
+	assert.NoError(t, os.MkdirAll(dir+"/test/artifact", core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(dir+"/test/artifact/1", []byte("test"), 0644))
+	future := time.Now().AddDate(1, 0, 0)
+	assert.NoError(t, os.Chtimes(dir+"/test/artifact/1", future, future))
+	before := time.Now()
+	c := newCache(dir)
+	f, present := c.cachedFiles.Get("test/artifact/1")
+	assert.True(t, present)
+	lastRead := f.(*cachedFile).lastReadTime
+	assert.False(t, lastRead.After(time.Now()))
+	assert.False(t, lastRead.Before(before))
+}
+
+func TestAccessAge(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, time.Hour, accessAge(now.Add(-time.Hour), now))
+	assert.Equal(t, time.Duration(0), accessAge(now.Add(time.Hour), now))
+}
+
 func TestRetrieve(t *testing.T) {
 	artifact, err := cache.RetrieveArtifact("darwin_amd64/pack/label/hash/label.ext")
 	assert.NoError(t, err)
@@ -104,6 +143,96 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestKeyCollision(t *testing.T) {
+	c := newCache("test_key_collision")
+	const key = "linux_amd64/pkg/target/hash/file"
+	assert.NoError(t, c.StoreArtifact(key, []byte("hello")))
+	// Storing the same thing again is fine.
+	assert.NoError(t, c.StoreArtifact(key, []byte("hello")))
+	assert.EqualValues(t, 5, c.TotalSize())
+	// Something different replaces it, and the size is updated to match.
+	assert.NoError(t, c.StoreArtifact(key, []byte("hello world")))
+	assert.EqualValues(t, 11, c.TotalSize())
+	c.SetRejectCollisions(true)
+	assert.Equal(t, errKeyCollision, c.StoreArtifact(key, []byte("goodbye")))
+	assert.EqualValues(t, 11, c.TotalSize())
+	ret, err := c.RetrieveArtifact(key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), ret[key], "The original is kept")
+}
+
+func TestEmptyArtifact(t *testing.T) {
+	const dir = "test_empty_artifact"
+	const key = "linux_amd64/pkg/target/hash/file"
+	c := newCache(dir)
+	assert.NoError(t, c.StoreArtifact(key, []byte{}))
+	assert.True(t, core.PathExists(dir+"/"+key+emptyMarkerSuffix))
+	assert.EqualValues(t, 0, c.TotalSize())
+	ret, err := c.RetrieveArtifact(key)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{key: {}}, ret, "The marker isn't returned")
+	ret, err = c.RetrieveArtifact("linux_amd64/pkg/target/hash")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+
+	// It survives a restart.
+	c = newCache(dir)
+	assert.True(t, c.cachedFiles.Has(key))
+	assert.False(t, c.cachedFiles.Has(key+emptyMarkerSuffix))
+	ret, err = c.RetrieveArtifact(key)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+
+	// Overwriting it with something nonempty removes the marker.
+	assert.NoError(t, c.StoreArtifact(key, []byte("test")))
+	assert.False(t, core.PathExists(dir+"/"+key+emptyMarkerSuffix))
+	assert.EqualValues(t, 4, c.TotalSize())
+	assert.NoError(t, c.StoreArtifact(key, []byte{}))
+	assert.EqualValues(t, 0, c.TotalSize())
+	assert.False(t, c.singleClean(0, 0), "Empty files never take the cache over its high water mark")
+	assert.NoError(t, c.DeleteArtifact(key))
+	assert.False(t, core.PathExists(dir+"/"+key+emptyMarkerSuffix))
+	assert.EqualValues(t, 0, c.TotalSize())
+}
+
+func TestInterruptedStore(t *testing.T) {
+	const dir = "test_interrupted_store"
+	c := newCache(dir)
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/empty", []byte{}))
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/full", []byte("test")))
+	// Simulate a store that was interrupted before its contents reached the disk.
+	assert.NoError(t, ioutil.WriteFile(dir+"/linux_amd64/pkg/target/hash/full", nil, 0644))
+	// And one that was interrupted after marking it empty, but before writing it.
+	assert.NoError(t, ioutil.WriteFile(dir+"/linux_amd64/pkg/target/hash/missing"+emptyMarkerSuffix, nil, 0644))
+	// And one that was killed partway through writing its contents.
+	assert.NoError(t, ioutil.WriteFile(dir+"/linux_amd64/pkg/target/hash/partial"+partialSuffix, []byte("te"), 0644))
+	ret, err := c.RetrieveArtifact("linux_amd64/pkg/target/hash")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(ret), "Partial files are never served")
+
+	c = newCache(dir)
+	ret, err = c.RetrieveArtifact("linux_amd64/pkg/target/hash/empty")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret), "Legitimately empty artifacts are kept")
+	_, err = c.RetrieveArtifact("linux_amd64/pkg/target/hash/full")
+	assert.True(t, os.IsNotExist(err), "The interrupted store isn't mistaken for a valid empty one")
+	assert.False(t, core.PathExists(dir+"/linux_amd64/pkg/target/hash/full"))
+	assert.False(t, core.PathExists(dir+"/linux_amd64/pkg/target/hash/missing"+emptyMarkerSuffix))
+	assert.False(t, core.PathExists(dir+"/linux_amd64/pkg/target/hash/partial"+partialSuffix))
+	assert.Equal(t, 1, c.cachedFiles.Count())
+}
+
+func TestVerifyArtifact(t *testing.T) {
+	const dir = "test_verify_artifact"
+	assert.NoError(t, writeArtifact(dir+"/empty", []byte{}, defaultChecksumAlgorithm))
+	assert.NoError(t, verifyArtifact(dir+"/empty", 0))
+	assert.NoError(t, writeArtifact(dir+"/full", []byte("test"), defaultChecksumAlgorithm))
+	assert.NoError(t, verifyArtifact(dir+"/full", 4))
+	assert.Error(t, verifyArtifact(dir+"/full", 5))
+	assert.NoError(t, ioutil.WriteFile(dir+"/unmarked", nil, 0644))
+	assert.Error(t, verifyArtifact(dir+"/unmarked", 0))
+}
+
 func TestDeleteArtifact(t *testing.T) {
 	err := cache.DeleteArtifact("/linux_amd64/otherpack/label")
 	assert.NoError(t, err)
@@ -123,3 +252,144 @@ func TestDeleteAll(t *testing.T) {
 		t.Error("The cache was not cleaned.")
 	}
 }
+
+func TestCleanEmptyDirs(t *testing.T) {
+	const dir = "test_clean_empty_dirs"
+	c := newCache(dir)
+	c.SetCleanEmptyDirs(true)
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target1/hash/file", []byte("test")))
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target2/hash/file", []byte("test")))
+	file, present := c.cachedFiles.Get("linux_amd64/pkg/target1/hash/file")
+	assert.True(t, present)
+	assert.True(t, c.deleteFile("linux_amd64/pkg/target1/hash/file", file.(*cachedFile), audit.Manual))
+	// Everything up to the first non-empty directory should be gone.
+	assert.False(t, core.PathExists(dir+"/linux_amd64/pkg/target1"))
+	assert.True(t, core.PathExists(dir+"/linux_amd64/pkg/target2/hash/file"))
+	// Storing into a directory that's been removed recreates it.
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target1/hash/file", []byte("test")))
+	assert.True(t, core.PathExists(dir+"/linux_amd64/pkg/target1/hash/file"))
+	// Deleting the rest empties it out, but the cache directory itself stays.
+	assert.NoError(t, c.DeleteArtifact("linux_amd64/pkg"))
+	assert.False(t, core.PathExists(dir+"/linux_amd64"))
+	assert.True(t, core.PathExists(dir))
+}
+
+func TestMinRetention(t *testing.T) {
+	c := newCache("test_min_retention")
+	c.SetMinRetention(time.Hour)
+	for i := 0; i < 5; i++ {
+		c.cachedFiles.Set(fmt.Sprintf("old/artifact/%d", i), &cachedFile{
+			lastReadTime: time.Now().Add(-time.Minute),
+			storedTime:   time.Now().AddDate(0, 0, -1),
+			size:         10,
+		})
+		c.totalSize += 10
+	}
+	// A burst of writes takes it well past the high water mark.
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, c.StoreArtifact(fmt.Sprintf("young/artifact/%d", i), []byte("0123456789")))
+	}
+	assert.EqualValues(t, 250, c.TotalSize())
+	assert.True(t, c.singleClean(50, 100))
+	// Only the old artifacts can go; we stay above the high water mark rather than lose the young ones.
+	assert.EqualValues(t, 200, c.TotalSize())
+	for i := 0; i < 5; i++ {
+		assert.False(t, c.cachedFiles.Has(fmt.Sprintf("old/artifact/%d", i)))
+	}
+	for i := 0; i < 20; i++ {
+		assert.True(t, c.cachedFiles.Has(fmt.Sprintf("young/artifact/%d", i)))
+	}
+	// Once they're past the retention time they're eligible again.
+	c.SetMinRetention(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	assert.True(t, c.singleClean(50, 100))
+	assert.True(t, c.TotalSize() <= 50)
+}
+
+func TestEvictAfterStore(t *testing.T) {
+	c := newCache("test_evict_after_store")
+	assert.NoError(t, c.StoreArtifact("store/artifact", []byte("0123456789")))
+	files := c.filesToClean(0)
+	assert.Equal(t, 1, len(files))
+	// It's stored again after the cleaner chose it but before it got round to evicting it.
+	assert.NoError(t, c.StoreArtifact("store/artifact", []byte("9876543210")))
+	assert.False(t, c.evictFile(files[0].path, files[0].file, files[0].storedTime, audit.WaterMark))
+	art, err := c.RetrieveArtifact("store/artifact")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("9876543210"), art["store/artifact"])
+	// Once it's been chosen again it can go.
+	files = c.filesToClean(0)
+	assert.True(t, c.evictFile(files[0].path, files[0].file, files[0].storedTime, audit.WaterMark))
+	assert.EqualValues(t, 0, c.TotalSize())
+}
+
+func TestAuditLog(t *testing.T) {
+	const dir = "test_audit_log"
+	c := newCache(dir)
+	l, err := audit.Open(dir + ".log")
+	assert.NoError(t, err)
+	defer os.Remove(dir + ".log")
+	c.SetAuditLog(l)
+	c.cachedFiles.Set("old/artifact", &cachedFile{lastReadTime: time.Now().AddDate(0, 0, -2), size: 10})
+	c.totalSize += 10
+	assert.NoError(t, c.StoreArtifact("manual/artifact", []byte("0123456789")))
+	assert.NoError(t, c.StoreArtifact("large/artifact", []byte("01234567890123456789")))
+	assert.True(t, c.cleanOldFiles(24*time.Hour))
+	assert.NoError(t, c.DeleteArtifact("manual"))
+	assert.True(t, c.singleClean(5, 10))
+	assert.NoError(t, l.Close())
+
+	f, err := os.Open(dir + ".log")
+	assert.NoError(t, err)
+	defer f.Close()
+	entries := []*audit.Entry{}
+	assert.NoError(t, audit.Read(f, func(e *audit.Entry) { entries = append(entries, e) }))
+	if assert.Equal(t, 3, len(entries)) {
+		assert.Equal(t, audit.Entry{Time: entries[0].Time, Key: "old/artifact", Size: 10, Reason: audit.Age}, *entries[0])
+		assert.Equal(t, audit.Entry{Time: entries[1].Time, Key: "manual/artifact", Size: 10, Reason: audit.Manual}, *entries[1])
+		assert.Equal(t, audit.Entry{Time: entries[2].Time, Key: "large/artifact", Size: 20, Reason: audit.WaterMark}, *entries[2])
+	}
+}
+
+func TestUntilNextClean(t *testing.T) {
+	c := &Cache{}
+	now := time.Date(2017, time.October, 1, 12, 3, 0, 0, time.UTC)
+	assert.Equal(t, 10*time.Minute, c.untilNextClean(now, 10*time.Minute))
+
+	c.SetCleanJitter("node1", 5*time.Minute)
+	d1 := c.untilNextClean(now, 10*time.Minute)
+	assert.True(t, d1 > 0 && d1 <= 10*time.Minute)
+	assert.Equal(t, d1, c.untilNextClean(now, 10*time.Minute), "Schedule should be deterministic")
+	// The phase within each period stays the same.
+	assert.Equal(t, d1, c.untilNextClean(now.Add(10*time.Minute), 10*time.Minute))
+}
+
+func TestCleanOffset(t *testing.T) {
+	assert.Equal(t, cleanOffset("node1", time.Hour), cleanOffset("node1", time.Hour))
+	assert.NotEqual(t, cleanOffset("node1", time.Hour), cleanOffset("node2", time.Hour))
+	assert.True(t, cleanOffset("node1", time.Hour) < time.Hour)
+}
+
+func TestStartClean(t *testing.T) {
+	c := &Cache{}
+	assert.True(t, c.startClean(nil, 0, 0, 0), "Always allowed without a coordinator")
+	coordinator := &mockCoordinator{refusals: 2}
+	assert.True(t, c.startClean(coordinator, 0.5, time.Hour, time.Millisecond))
+	assert.Equal(t, 3, coordinator.calls)
+	assert.Equal(t, time.Hour, coordinator.ttl)
+	coordinator = &mockCoordinator{refusals: maxCleanRetries}
+	assert.False(t, c.startClean(coordinator, 0.5, time.Hour, time.Millisecond))
+}
+
+type mockCoordinator struct {
+	refusals, calls int
+	ttl             time.Duration
+}
+
+func (m *mockCoordinator) StartClean(maxFraction float64, ttl time.Duration) bool {
+	m.calls++
+	m.ttl = ttl
+	return m.calls > m.refusals
+}
+
+func (m *mockCoordinator) FinishClean() {}
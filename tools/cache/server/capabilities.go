@@ -0,0 +1,38 @@
+package server
+
+import (
+	"golang.org/x/net/context"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// protocolVersion is the version of the protocol we implement, as reported by GetCapabilities.
+// It should be incremented whenever a feature is added.
+const protocolVersion = 4
+
+// GetCapabilities implements the RPC to describe which features we support.
+func (r *RPCCacheServer) GetCapabilities(ctx context.Context, req *pb.CapabilitiesRequest) (*pb.CapabilitiesResponse, error) {
+	if err := r.authenticateClient(ctx, readonly); err != nil {
+		return nil, err
+	}
+	resp := &pb.CapabilitiesResponse{
+		Version: protocolVersion,
+		Features: []pb.CapabilitiesResponse_Feature{
+			pb.CapabilitiesResponse_EXISTS,
+			pb.CapabilitiesResponse_CLUSTER_STATS,
+			pb.CapabilitiesResponse_PREFETCH,
+			pb.CapabilitiesResponse_ALIASES,
+			pb.CapabilitiesResponse_BUILD_KEYS,
+			pb.CapabilitiesResponse_STRUCTURED_ERRORS,
+			pb.CapabilitiesResponse_SHADOW_HASHES,
+			pb.CapabilitiesResponse_SESSIONS,
+			pb.CapabilitiesResponse_RETRIEVE_BATCH,
+			pb.CapabilitiesResponse_CLEAN,
+		},
+		ReadOnly: r.readOnlyReason(),
+	}
+	if r.compression {
+		resp.Features = append(resp.Features, pb.CapabilitiesResponse_COMPRESSION)
+	}
+	return resp, nil
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestGetCapabilities(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_get_capabilities")}
+	resp, err := r.GetCapabilities(context.Background(), &pb.CapabilitiesRequest{})
+	require.NoError(t, err)
+	assert.EqualValues(t, protocolVersion, resp.Version)
+	assert.Contains(t, resp.Features, pb.CapabilitiesResponse_EXISTS)
+	assert.Contains(t, resp.Features, pb.CapabilitiesResponse_STRUCTURED_ERRORS)
+	assert.NotContains(t, resp.Features, pb.CapabilitiesResponse_UNKNOWN)
+	assert.NotContains(t, resp.Features, pb.CapabilitiesResponse_COMPRESSION, "Not enabled yet")
+	assert.Equal(t, "", resp.ReadOnly)
+
+	r.compression = true
+	r.cache.SetReadOnly("testing")
+	resp, err = r.GetCapabilities(context.Background(), &pb.CapabilitiesRequest{})
+	require.NoError(t, err)
+	assert.Contains(t, resp.Features, pb.CapabilitiesResponse_COMPRESSION)
+	assert.Equal(t, "testing", resp.ReadOnly)
+}
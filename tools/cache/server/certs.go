@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// alpnProtocols are the application protocols offered on connections using a CertReloader's
+// config. The config it returns for each connection replaces the one the server set them on,
+// so they have to be given again; these cover both gRPC and the REST gateway.
+var alpnProtocols = []string{"h2", "http/1.1"}
+
+// A CertReloader holds the server's TLS key, certificate and CA certificate, and reloads them
+// while it's serving so they can be rotated without a restart. New connections use whatever was
+// loaded most recently; existing ones carry on with what they negotiated.
+type CertReloader struct {
+	load   func() (key, cert, caCert []byte, err error)
+	mutex  sync.RWMutex
+	key    []byte
+	cert   []byte
+	caCert []byte
+	config *tls.Config
+}
+
+// NewCertReloader returns a CertReloader that gets the PEM-encoded key, certificate and CA
+// certificate from the given function (typically reading them with ReadTLSMaterial), once now
+// and again each time it's reloaded. It returns an error if they can't be loaded now.
+func NewCertReloader(load func() (key, cert, caCert []byte, err error)) (*CertReloader, error) {
+	r := &CertReloader{load: load}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the key and certificates again, and swaps them in if they've changed.
+// It returns true if they have. If they can't be loaded the existing ones are retained.
+func (r *CertReloader) Reload() (bool, error) {
+	key, cert, caCert, err := r.load()
+	if err != nil {
+		return false, err
+	}
+	r.mutex.RLock()
+	unchanged := r.config != nil && bytes.Equal(key, r.key) && bytes.Equal(cert, r.cert) && bytes.Equal(caCert, r.caCert)
+	r.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	config, err := TLSConfig(key, cert, caCert)
+	if err != nil {
+		return false, err
+	}
+	config.NextProtos = alpnProtocols
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.key, r.cert, r.caCert, r.config = key, cert, caCert, config
+	return true, nil
+}
+
+// Config returns a TLS config for a server that uses the most recently loaded key and
+// certificates for each new connection.
+func (r *CertReloader) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+			return r.config, nil
+		},
+	}
+}
+
+// Watch reloads the key and certificates whenever the process receives one of the given signals,
+// and checks them for changes every frequency, so rotated ones are picked up either way.
+func (r *CertReloader) Watch(frequency time.Duration, signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	if len(signals) > 0 {
+		signal.Notify(ch, signals...)
+	}
+	go r.watch(time.NewTicker(frequency).C, ch)
+}
+
+// watch reloads the key and certificates each time either of the given channels receives.
+func (r *CertReloader) watch(ticks <-chan time.Time, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ticks:
+		case <-signals:
+			log.Notice("Reloading TLS key and certificates")
+		}
+		if changed, err := r.Reload(); err != nil {
+			log.Error("Failed to reload TLS key and certificates, will keep existing ones: %s", err)
+		} else if changed {
+			log.Notice("Loaded new TLS key and certificates")
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	certsTestKey   = "src/cache/test_data/key.pem"
+	certsTestCert  = "src/cache/test_data/cert_signed.pem"
+	certsTestCert2 = "src/cache/test_data/cert.pem"
+	certsTestCa    = "src/cache/test_data/ca.pem"
+)
+
+// testCertLoader returns the test key and one of the test certificates, whichever is set.
+type testCertLoader struct {
+	mutex sync.Mutex
+	cert  string
+	err   error
+}
+
+func (l *testCertLoader) set(cert string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.cert = cert
+	l.err = err
+}
+
+func (l *testCertLoader) load() ([]byte, []byte, []byte, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.err != nil {
+		return nil, nil, nil, l.err
+	}
+	key, _ := ioutil.ReadFile(certsTestKey)
+	cert, _ := ioutil.ReadFile(l.cert)
+	ca, _ := ioutil.ReadFile(certsTestCa)
+	return key, cert, ca, nil
+}
+
+// servedCert returns the raw certificate served by a listener using the given config on a new connection.
+func servedCert(t *testing.T, config *tls.Config) []byte {
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		if conn, err := lis.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Raw
+}
+
+// rawCert returns the raw certificate from the given file.
+func rawCert(t *testing.T, filename string) []byte {
+	cert, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	key, err := ioutil.ReadFile(certsTestKey)
+	require.NoError(t, err)
+	pair, err := tls.X509KeyPair(cert, key)
+	require.NoError(t, err)
+	return pair.Certificate[0]
+}
+
+func TestCertReloader(t *testing.T) {
+	loader := &testCertLoader{cert: certsTestCert}
+	r, err := NewCertReloader(loader.load)
+	require.NoError(t, err)
+	config := r.Config()
+	assert.Equal(t, rawCert(t, certsTestCert), servedCert(t, config))
+
+	changed, err := r.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed, "Nothing has changed yet")
+
+	loader.set(certsTestCert2, nil)
+	changed, err = r.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, rawCert(t, certsTestCert2), servedCert(t, config), "New connections get the new certificate")
+
+	loader.set(certsTestCert, fmt.Errorf("partially written"))
+	_, err = r.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, rawCert(t, certsTestCert2), servedCert(t, config), "The existing certificate is kept if reloading fails")
+}
+
+func TestCertReloaderInvalid(t *testing.T) {
+	_, err := NewCertReloader(func() ([]byte, []byte, []byte, error) {
+		return []byte("wibble"), []byte("wibble"), nil, nil
+	})
+	assert.Error(t, err)
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	loader := &testCertLoader{cert: certsTestCert}
+	r, err := NewCertReloader(loader.load)
+	require.NoError(t, err)
+	ticks := make(chan time.Time)
+	signals := make(chan os.Signal)
+	go r.watch(ticks, signals)
+	loader.set(certsTestCert2, nil)
+	signals <- os.Interrupt
+	ticks <- time.Now() // Can't be received until the signal's been handled.
+	assert.Equal(t, rawCert(t, certsTestCert2), servedCert(t, r.Config()))
+}
+
+func TestWatchKeysOnSignal(t *testing.T) {
+	r := &RPCCacheServer{}
+	require.NoError(t, r.loadAllKeys(certsTestCert, certsTestCert2))
+	signals := make(chan os.Signal)
+	go r.watchKeys(certsTestCert, certsTestCert2, nil, signals)
+	r.keyMutex.Lock()
+	r.writableKeys = nil
+	r.keyMutex.Unlock()
+	signals <- os.Interrupt
+	signals <- os.Interrupt
+	r.keyMutex.RLock()
+	defer r.keyMutex.RUnlock()
+	assert.Equal(t, 1, len(r.writableKeys), "They're reloaded on a signal even though the files haven't changed")
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tools/cache/audit"
+)
+
+// checksumSuffix is appended to the name of an artifact to get the name of the file holding its checksum.
+//
+// The checksum is of the file's contents on disk (i.e. after compression and encryption), written
+// alongside it when it's stored. It's hex-encoded and prefixed with the name of the algorithm and
+// a colon, e.g. sha256:0123..., except for CRC-32C which is the default and is written bare, as
+// it was before the algorithm could be chosen. It's removed before the artifact is overwritten
+// and written again afterwards, so it never describes different contents; artifacts without one
+// (e.g. stored before checksums existed, or empty ones, which have nothing to check) are assumed
+// to be fine.
+const checksumSuffix = ".plz_crc32c"
+
+// crc32c is the table for the Castagnoli polynomial, which most CPUs accelerate.
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// A checksumAlgorithm is a way of checksumming artifacts.
+type checksumAlgorithm struct {
+	name string
+	sum  func(contents []byte) string
+}
+
+// checksumAlgorithms are the algorithms that can be chosen with SetChecksumAlgorithm.
+var checksumAlgorithms = map[string]*checksumAlgorithm{
+	"crc32c": {name: "crc32c", sum: func(contents []byte) string {
+		sum := crc32.Checksum(contents, crc32c)
+		return hex.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+	}},
+	"sha256": {name: "sha256", sum: func(contents []byte) string {
+		sum := sha256.Sum256(contents)
+		return hex.EncodeToString(sum[:])
+	}},
+}
+
+// defaultChecksumAlgorithm is the algorithm artifacts are checksummed with unless another is chosen.
+var defaultChecksumAlgorithm = checksumAlgorithms["crc32c"]
+
+// errUnverifiable is returned by verifyChecksum for an artifact checksummed with an algorithm
+// other than the one that's enabled, which it can't be checked against.
+var errUnverifiable = errors.New("checksum was made with an algorithm that isn't enabled")
+
+// isChecksum returns true if the given file holds the checksum for an artifact.
+// These aren't artifacts themselves and are never returned to clients.
+func isChecksum(name string) bool {
+	return strings.HasSuffix(name, checksumSuffix)
+}
+
+// checksum returns the checksum of the given file contents, as it's written to its checksum file.
+func (a *checksumAlgorithm) checksum(contents []byte) string {
+	if a == defaultChecksumAlgorithm {
+		return a.sum(contents)
+	}
+	return a.name + ":" + a.sum(contents)
+}
+
+// checksum returns the checksum of the given file contents with the default algorithm.
+func checksum(contents []byte) string {
+	return defaultChecksumAlgorithm.checksum(contents)
+}
+
+// parseChecksum returns the name of the algorithm and the checksum from the contents of a checksum file.
+func parseChecksum(s string) (string, string) {
+	if idx := strings.IndexByte(s, ':'); idx != -1 {
+		return s[:idx], s[idx+1:]
+	}
+	return defaultChecksumAlgorithm.name, s
+}
+
+// writeChecksum writes the checksum for the artifact at the given path, which has the given contents.
+func writeChecksum(fullPath string, contents []byte, algorithm *checksumAlgorithm) error {
+	if len(contents) == 0 {
+		return nil
+	}
+	return writeFileAtomically(fullPath+checksumSuffix, []byte(algorithm.checksum(contents)))
+}
+
+// removeChecksum removes the checksum for the artifact at the given path, if there is one.
+func removeChecksum(fullPath string) error {
+	if err := os.Remove(fullPath + checksumSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// verifyChecksum returns an error if the given contents read from the artifact at the given path
+// don't match its checksum, or errUnverifiable if its checksum wasn't made with the given algorithm.
+func verifyChecksum(fullPath string, contents []byte, algorithm *checksumAlgorithm) error {
+	b, err := ioutil.ReadFile(fullPath + checksumSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	name, expected := parseChecksum(string(b))
+	if name != algorithm.name {
+		return errUnverifiable
+	} else if actual := algorithm.sum(contents); actual != expected {
+		return fmt.Errorf("%s is corrupt: its %s checksum is %s, expected %s", fullPath, name, actual, expected)
+	}
+	return nil
+}
+
+// SetChecksumAlgorithm sets the algorithm that artifacts are checksummed with when they're stored,
+// and checked against when they're verified; it's crc32c by default, or can be sha256. Artifacts
+// already stored with a different one can't be verified afterwards; see SetStrictChecksums for
+// what happens to them.
+func (cache *Cache) SetChecksumAlgorithm(name string) error {
+	algorithm, present := checksumAlgorithms[name]
+	if !present {
+		return fmt.Errorf("unknown checksum algorithm %s", name)
+	}
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.checksumAlgorithm = algorithm
+	return nil
+}
+
+// currentChecksumAlgorithm returns the algorithm that artifacts are checksummed with.
+func (cache *Cache) currentChecksumAlgorithm() *checksumAlgorithm {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	if cache.checksumAlgorithm == nil {
+		return defaultChecksumAlgorithm
+	}
+	return cache.checksumAlgorithm
+}
+
+// SetStrictChecksums sets whether artifacts that can't be verified when they're retrieved, because
+// their checksums were made with a different algorithm to the one that's enabled (or one this
+// server doesn't know), are refused. By default they're served unverified, with a warning, so
+// changing the algorithm doesn't turn the whole cache into misses; in strict mode they're treated
+// as missing, but not deleted. Either way they're counted in the unverifiable artifacts metric.
+// It only has any effect when checksums are verified on retrieval (see SetVerifyChecksums).
+func (cache *Cache) SetStrictChecksums(strict bool) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.strictChecksums = strict
+}
+
+// strictlyChecksumming returns true if artifacts that can't be verified are refused.
+func (cache *Cache) strictlyChecksumming() bool {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.strictChecksums
+}
+
+// SetVerifyChecksums sets whether artifacts are checked against their checksums every time they're
+// retrieved. Any that don't match are deleted and treated as missing, so clients rebuild them
+// rather than getting something corrupt. It costs a pass over each file, so it's off by default;
+// Scrub checks them in the background instead.
+func (cache *Cache) SetVerifyChecksums(verify bool) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.verifyChecksums = verify
+}
+
+// verifyingChecksums returns true if artifacts are checked against their checksums when they're retrieved.
+func (cache *Cache) verifyingChecksums() bool {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.verifyChecksums
+}
+
+// verifyRetrieved checks an artifact that's being retrieved against its checksum, if we're doing
+// so. If it's corrupt it's deleted in the background (since the caller has it locked) and this
+// returns an error satisfying os.IsNotExist; so does one that can't be verified, in strict mode.
+func (cache *Cache) verifyRetrieved(p string, contents []byte) error {
+	if !cache.verifyingChecksums() {
+		return nil
+	}
+	err := verifyChecksum(path.Join(cache.rootPath, p), contents, cache.currentChecksumAlgorithm())
+	if err == errUnverifiable {
+		cache.metrics.unverifiableArtifacts.WithLabelValues("retrieve").Inc()
+		if cache.strictlyChecksumming() {
+			log.Warning("Not serving %s: %s", p, err)
+			return os.ErrNotExist
+		}
+		log.Warning("Serving %s without verifying it: %s", p, err)
+		return nil
+	} else if err != nil {
+		log.Error("%s", err)
+		cache.metrics.corruptArtifacts.WithLabelValues("retrieve").Inc()
+		go cache.removeCorrupt(p)
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// removeCorrupt deletes the given file, which doesn't match its checksum.
+func (cache *Cache) removeCorrupt(p string) {
+	if filei, present := cache.cachedFiles.Get(p); present {
+		cache.deleteFile(p, filei.(*cachedFile), audit.Corrupt)
+	} else if cache.admitFile(p) {
+		// It had been dropped from the index; deleting it has to go through it.
+		cache.removeCorrupt(p)
+	}
+}
+
+// ScrubEvery starts checking every artifact in the cache against its checksum with the given frequency.
+func (cache *Cache) ScrubEvery(frequency time.Duration) {
+	go func() {
+		for range time.NewTicker(frequency).C {
+			cache.Scrub()
+		}
+	}()
+}
+
+// Scrub checks every artifact in the cache against its checksum, deleting any that don't match.
+// It returns the number that didn't.
+func (cache *Cache) Scrub() int {
+	log.Info("Scrubbing cache...")
+	checked, corrupt := 0, 0
+	filepath.Walk(cache.rootPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // Most likely it's been removed from under us, which is fine.
+		} else if !isChecksum(name) {
+			return nil
+		}
+		p := strings.TrimSuffix(name, checksumSuffix)[len(cache.rootPath)+1:]
+		if cache.scrub(p) {
+			corrupt++
+		}
+		checked++
+		return nil
+	})
+	cache.metrics.scrubbedFiles.Add(float64(checked))
+	if corrupt > 0 {
+		log.Error("Scrubbed %d files, %d were corrupt and have been deleted", checked, corrupt)
+	} else {
+		log.Info("Scrubbed %d files, none were corrupt", checked)
+	}
+	return corrupt
+}
+
+// scrub checks a single file against its checksum, deleting it if it doesn't match.
+// It returns true if it didn't.
+func (cache *Cache) scrub(p string) bool {
+	filei, present := cache.cachedFiles.Get(p)
+	if !present {
+		// It's been dropped from the index. Reading it without a lock is fine if it's intact, but
+		// if not we have to check again with one in case it was being stored at the time.
+		if cache.checkFile(p) == nil || !cache.admitFile(p) {
+			return false
+		}
+		return cache.scrub(p)
+	}
+	file := filei.(*cachedFile)
+	// Hold it so it isn't stored again while we're reading it, which would look corrupt.
+	file.RLock()
+	corrupt := !file.deleted && cache.checkFile(p) != nil
+	file.RUnlock()
+	if corrupt {
+		cache.metrics.corruptArtifacts.WithLabelValues("scrub").Inc()
+		cache.deleteFile(p, file, audit.Corrupt)
+	}
+	return corrupt
+}
+
+// checkFile checks a single file against its checksum.
+func (cache *Cache) checkFile(p string) error {
+	fullPath := path.Join(cache.rootPath, p)
+	contents, err := ioutil.ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return nil // It's gone since we found it.
+	} else if err != nil {
+		log.Warning("Failed to scrub %s: %s", p, err)
+		return nil
+	}
+	err = verifyChecksum(fullPath, contents, cache.currentChecksumAlgorithm())
+	if err == errUnverifiable {
+		// It's not corrupt as far as we know; it's up to retrieval whether it's still served.
+		log.Debug("Can't scrub %s: %s", p, err)
+		cache.metrics.unverifiableArtifacts.WithLabelValues("scrub").Inc()
+		return nil
+	} else if err != nil {
+		log.Error("%s", err)
+		return err
+	}
+	return nil
+}
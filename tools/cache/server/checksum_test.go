@@ -0,0 +1,150 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const checksumKey = "linux_amd64/pkg/target/hash/file"
+
+func TestStoreWritesChecksum(t *testing.T) {
+	cache := newCache("test_store_writes_checksum")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("contents")))
+	sum, err := ioutil.ReadFile(path.Join(cache.rootPath, checksumKey+checksumSuffix))
+	require.NoError(t, err)
+	assert.Equal(t, checksum([]byte("contents")), string(sum))
+	assert.EqualValues(t, 8, cache.TotalSize(), "The checksum doesn't count towards the cache's size")
+
+	// It's updated when the artifact is stored again.
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("different contents")))
+	sum, err = ioutil.ReadFile(path.Join(cache.rootPath, checksumKey+checksumSuffix))
+	require.NoError(t, err)
+	assert.Equal(t, checksum([]byte("different contents")), string(sum))
+
+	// It isn't returned as an artifact itself.
+	arts, err := cache.RetrieveArtifact("linux_amd64/pkg/target/hash")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{checksumKey: []byte("different contents")}, arts)
+
+	// And it goes when the artifact does.
+	require.NoError(t, cache.DeleteEntry(checksumKey))
+	_, err = os.Stat(path.Join(cache.rootPath, checksumKey+checksumSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestVerifyChecksumsOnRetrieve(t *testing.T) {
+	cache := newCache("test_verify_checksums")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("contents")))
+	corrupt(t, cache, checksumKey)
+
+	arts, err := cache.RetrieveArtifact(checksumKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("CONTENTS"), arts[checksumKey], "It's not checked unless we ask")
+
+	cache.SetVerifyChecksums(true)
+	_, err = cache.RetrieveArtifact(checksumKey)
+	assert.True(t, os.IsNotExist(err), "A corrupt artifact is a miss")
+	for i := 0; i < 100 && cache.Contains(checksumKey); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, cache.Contains(checksumKey), "It's deleted")
+	assert.EqualValues(t, 0, cache.TotalSize())
+
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("contents")))
+	corrupt(t, cache, checksumKey)
+	_, _, err = cache.OpenArtifact(checksumKey)
+	assert.True(t, os.IsNotExist(err), "It's checked when opened too")
+}
+
+func TestScrub(t *testing.T) {
+	const good, legacy = "linux_amd64/pkg/target/hash2/file", "linux_amd64/pkg/target/hash3/file"
+	cache := newCache("test_scrub")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("contents")))
+	require.NoError(t, cache.StoreArtifact(good, []byte("contents")))
+	require.NoError(t, cache.StoreArtifact(legacy, []byte("contents")))
+	require.NoError(t, os.Remove(path.Join(cache.rootPath, legacy+checksumSuffix)))
+	corrupt(t, cache, checksumKey)
+	corrupt(t, cache, legacy)
+
+	assert.Equal(t, 1, cache.Scrub())
+	assert.False(t, cache.Contains(checksumKey))
+	assert.True(t, cache.Contains(good))
+	assert.True(t, cache.Contains(legacy), "We can't tell if it's corrupt without a checksum")
+	assert.Equal(t, 0, cache.Scrub())
+}
+
+func TestScanRemovesOrphanedChecksums(t *testing.T) {
+	cache := newCache("test_orphaned_checksums")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("contents")))
+	require.NoError(t, os.Remove(path.Join(cache.rootPath, checksumKey)))
+	cache = newCache(cache.rootPath)
+	assert.Equal(t, 0, cache.NumFiles())
+	_, err := os.Stat(path.Join(cache.rootPath, checksumKey+checksumSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestChecksumAlgorithm(t *testing.T) {
+	cache := newCache("test_checksum_algorithm")
+	defer os.RemoveAll(cache.rootPath)
+	assert.Error(t, cache.SetChecksumAlgorithm("md5"))
+	require.NoError(t, cache.SetChecksumAlgorithm("sha256"))
+	cache.SetVerifyChecksums(true)
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("contents")))
+	sum, err := ioutil.ReadFile(path.Join(cache.rootPath, checksumKey+checksumSuffix))
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:d1b2a59fbea7e20077af9f91b27e95e865061b270be03ff539ab3b73587882e8", string(sum))
+	arts, err := cache.RetrieveArtifact(checksumKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("contents"), arts[checksumKey])
+
+	corrupt(t, cache, checksumKey)
+	_, err = cache.RetrieveArtifact(checksumKey)
+	assert.True(t, os.IsNotExist(err), "Corruption is detected with it too")
+}
+
+func TestUnverifiableChecksums(t *testing.T) {
+	cache := newCache("test_unverifiable_checksums")
+	defer os.RemoveAll(cache.rootPath)
+	cache.SetVerifyChecksums(true)
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("contents")))
+	require.NoError(t, ioutil.WriteFile(path.Join(cache.rootPath, checksumKey+checksumSuffix), []byte("md5:98bf7d8c15784f0a3d63204441e1e2aa"), 0644))
+
+	arts, err := cache.RetrieveArtifact(checksumKey)
+	require.NoError(t, err, "By default it's served unverified")
+	assert.Equal(t, []byte("contents"), arts[checksumKey])
+	assert.Equal(t, 0, cache.Scrub(), "It isn't treated as corrupt")
+	assert.True(t, cache.Contains(checksumKey))
+
+	cache.SetStrictChecksums(true)
+	_, err = cache.RetrieveArtifact(checksumKey)
+	assert.True(t, os.IsNotExist(err), "In strict mode it's a miss")
+	_, _, err = cache.OpenArtifact(checksumKey)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 0, cache.Scrub())
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, cache.Contains(checksumKey), "But it isn't deleted")
+
+	// Nor are ones stored with an algorithm that's known, but not enabled.
+	cache.SetStrictChecksums(false)
+	require.NoError(t, cache.SetChecksumAlgorithm("sha256"))
+	require.NoError(t, cache.StoreArtifact(checksumKey, []byte("contents")))
+	require.NoError(t, cache.SetChecksumAlgorithm("crc32c"))
+	arts, err = cache.RetrieveArtifact(checksumKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("contents"), arts[checksumKey])
+}
+
+// corrupt overwrites the given artifact with its contents in upper case, as if the disk had corrupted it.
+func corrupt(t *testing.T, cache *Cache, p string) {
+	require.NoError(t, ioutil.WriteFile(path.Join(cache.rootPath, p), []byte("CONTENTS"), 0644))
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// A CleanResult describes what a clean requested by CleanNow removed.
+type CleanResult struct {
+	FreedBytes int64 `json:"freed_bytes"`
+	FreedFiles int64 `json:"freed_files"`
+	// TotalSize and NumFiles describe the cache after the clean.
+	TotalSize int64   `json:"total_size"`
+	NumFiles  int     `json:"num_files"`
+	Seconds   float64 `json:"seconds"`
+}
+
+// errCleanDryRun and errCleanRefused are returned by CleanNow if it can't clean right now.
+var (
+	errCleanDryRun  = fmt.Errorf("cleaning is in dry run mode, see /clean/preview for what it would remove")
+	errCleanRefused = fmt.Errorf("too many other nodes are cleaning")
+)
+
+// CleanNow cleans the cache immediately, rather than waiting for the next scheduled clean,
+// and returns what it removed. It's the same as the scheduled clean, using the water marks and
+// maximum artifact age the cache was created with, and never runs at the same time as it; if
+// one is in progress this waits for it to finish then cleans again, which is cheap if it's done
+// everything already. It fails if the cache is in maintenance or dry run mode, or if it's
+// clustered and too many other nodes are cleaning (it only asks once, rather than waiting for them).
+func (cache *Cache) CleanNow() (*CleanResult, error) {
+	if cache.InMaintenance() {
+		return nil, fmt.Errorf("cache is in maintenance mode")
+	} else if cache.dryRun() {
+		return nil, errCleanDryRun
+	}
+	log.Notice("Cleaning cache on demand...")
+	start := time.Now()
+	freed, ok := cache.cleanOnce(false, cache.maxArtifactAge, cache.lowWaterMark, cache.highWaterMark)
+	if !ok {
+		return nil, errCleanRefused
+	}
+	result := &CleanResult{
+		FreedBytes: freed.EvictedBytes,
+		FreedFiles: freed.Evictions,
+		TotalSize:  atomic.LoadInt64(&cache.totalSize),
+		NumFiles:   cache.NumFiles(),
+		Seconds:    time.Since(start).Seconds(),
+	}
+	log.Notice("Cleaned cache on demand, removed %d files (%d bytes)", result.FreedFiles, result.FreedBytes)
+	return result, nil
+}
+
+// Clean implements the Clean RPC to clean the cache immediately.
+func (r *RPCCacheServer) Clean(ctx context.Context, req *pb.CleanRequest) (*pb.CleanResponse, error) {
+	if err := r.authenticateClient(ctx, writable); err != nil {
+		return nil, err
+	} else if err := r.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	result, err := r.cache.CleanNow()
+	if err == errCleanDryRun {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.CleanResponse{
+		FreedBytes: result.FreedBytes,
+		FreedFiles: result.FreedFiles,
+		TotalSize:  result.TotalSize,
+		NumFiles:   int64(result.NumFiles),
+	}, nil
+}
+
+// cleanHandler handles a request to clean the cache immediately.
+func (g *gateway) cleanHandler(w http.ResponseWriter, r *http.Request) {
+	if !g.authorize(w, r, writable) {
+		return
+	}
+	result, err := g.server.cache.CleanNow()
+	if err == errCleanDryRun {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, result)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// newCleanNowCache returns a cache of 30 bytes of artifacts that's above its high water mark.
+func newCleanNowCache(t *testing.T, name string) *Cache {
+	c := newCache(name)
+	for _, file := range []string{"a", "b", "c"} {
+		require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/aGFzaA/"+file, []byte("0123456789")))
+	}
+	c.lowWaterMark = 10
+	c.highWaterMark = 20
+	c.maxArtifactAge = time.Hour
+	return c
+}
+
+// refusingCoordinator is a CleanCoordinator that never lets us clean.
+type refusingCoordinator struct {
+	calls int
+}
+
+func (r *refusingCoordinator) StartClean(maxFraction float64, ttl time.Duration) bool {
+	r.calls++
+	return false
+}
+
+func (r *refusingCoordinator) FinishClean() {}
+
+func TestCleanNow(t *testing.T) {
+	c := newCleanNowCache(t, "test_clean_now")
+	defer os.RemoveAll(c.rootPath)
+	result, err := c.CleanNow()
+	require.NoError(t, err)
+	assert.EqualValues(t, 20, result.FreedBytes)
+	assert.EqualValues(t, 2, result.FreedFiles)
+	assert.EqualValues(t, 10, result.TotalSize)
+	assert.Equal(t, 1, result.NumFiles)
+
+	result, err = c.CleanNow()
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, result.FreedFiles, "It's below the high water mark now")
+}
+
+func TestCleanNowRefused(t *testing.T) {
+	c := newCleanNowCache(t, "test_clean_now_refused")
+	defer os.RemoveAll(c.rootPath)
+	c.SetCleanDryRun(true)
+	_, err := c.CleanNow()
+	assert.Equal(t, errCleanDryRun, err)
+	c.SetCleanDryRun(false)
+
+	coordinator := &refusingCoordinator{}
+	c.SetCleanCoordinator(coordinator, 0.5, time.Hour)
+	_, err = c.CleanNow()
+	assert.Equal(t, errCleanRefused, err)
+	assert.Equal(t, 1, coordinator.calls, "It doesn't wait for the others to finish")
+	assert.EqualValues(t, 30, c.TotalSize())
+
+	c.SetMaintenance(true)
+	_, err = c.CleanNow()
+	assert.Error(t, err)
+}
+
+func TestCleanRPC(t *testing.T) {
+	r := &RPCCacheServer{cache: newCleanNowCache(t, "test_clean_rpc")}
+	defer os.RemoveAll(r.cache.rootPath)
+	resp, err := r.Clean(context.Background(), &pb.CleanRequest{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 20, resp.FreedBytes)
+	assert.EqualValues(t, 1, resp.NumFiles)
+
+	r.cache.SetCleanDryRun(true)
+	_, err = r.Clean(context.Background(), &pb.CleanRequest{})
+	assert.Equal(t, codes.FailedPrecondition, grpc.Code(err))
+}
+
+func TestGatewayClean(t *testing.T) {
+	c := newCleanNowCache(t, "test_gateway_clean")
+	defer os.RemoveAll(c.rootPath)
+	h := BuildGateway(c, nil, "", "", ServerOptions{})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/clean", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	result := &CleanResult{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), result))
+	assert.EqualValues(t, 2, result.FreedFiles)
+
+	c.SetCleanDryRun(true)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/clean", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"tools/cache/audit"
+)
+
+// A CleanPreview describes what a clean would remove from the cache if it ran now.
+type CleanPreview struct {
+	Time          time.Time `json:"time"`
+	TotalSize     int64     `json:"total_size"`
+	LowWaterMark  int64     `json:"low_water_mark"`
+	HighWaterMark int64     `json:"high_water_mark"`
+	// ReclaimedSize is the total size of the candidates, and ProjectedSize what the cache would be without them.
+	ReclaimedSize int64 `json:"reclaimed_size"`
+	ProjectedSize int64 `json:"projected_size"`
+	// Unindexed is the number of files left out of the index (see ServerOptions.MaxIndexEntries).
+	// A clean would remove some of them too, but they aren't included in the candidates.
+	Unindexed  int64            `json:"unindexed"`
+	Candidates []CleanCandidate `json:"candidates"`
+}
+
+// A CleanCandidate is a file that a clean would remove, in the order it would remove them.
+type CleanCandidate struct {
+	Path     string       `json:"path"`
+	Size     int64        `json:"size"`
+	Stored   time.Time    `json:"stored"`
+	LastRead time.Time    `json:"last_read"`
+	Age      float64      `json:"age_seconds"`
+	Reason   audit.Reason `json:"reason"`
+}
+
+// SetCleanDryRun sets whether the periodic clean only logs what it would remove, rather than removing it.
+// Nothing is evicted locally or from any storage backend while it's set.
+func (cache *Cache) SetCleanDryRun(enabled bool) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.cleanDryRun = enabled
+}
+
+// dryRun returns true if the cleaner should only log what it would remove.
+func (cache *Cache) dryRun() bool {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.cleanDryRun
+}
+
+// PreviewClean returns what a clean would remove from the cache if it ran now, without removing
+// anything. It uses the water marks and maximum artifact age the cache was created with.
+func (cache *Cache) PreviewClean() *CleanPreview {
+	return cache.previewClean(cache.maxArtifactAge, cache.lowWaterMark, cache.highWaterMark)
+}
+
+// CleanPreviewHandler returns an HTTP handler that serves PreviewClean as JSON.
+func (cache *Cache) CleanPreviewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, cache.PreviewClean())
+	})
+}
+
+// previewClean returns what a clean with the given settings would remove if it ran now.
+// It chooses files the same way as the clean itself, in the same order: those that have passed
+// their expiry, then their TTL, then the maximum artifact age, then enough of the rest to get down
+// to the low water mark if what's left is still above the high one. The water marks are lowered
+// if the filesystem is short of free space, as for the clean (see SetFreeSpaceThresholds).
+func (cache *Cache) previewClean(maxArtifactAge time.Duration, lowWaterMark, highWaterMark int64) *CleanPreview {
+	lowWaterMark, highWaterMark = cache.waterMarks(lowWaterMark, highWaterMark)
+	now := cache.now()
+	preview := &CleanPreview{
+		Time:          now,
+		TotalSize:     atomic.LoadInt64(&cache.totalSize),
+		LowWaterMark:  lowWaterMark,
+		HighWaterMark: highWaterMark,
+		Unindexed:     atomic.LoadInt64(&cache.unindexed),
+		Candidates:    []CleanCandidate{},
+	}
+	chosen := map[string]bool{}
+	add := func(files cachedFilePaths, reason audit.Reason) {
+		for _, file := range files {
+			if chosen[file.path] {
+				continue
+			}
+			chosen[file.path] = true
+			preview.Candidates = append(preview.Candidates, CleanCandidate{
+				Path:     file.path,
+				Size:     file.file.size,
+				Stored:   file.storedTime,
+				LastRead: file.file.lastReadTime,
+				Age:      accessAge(file.file.lastReadTime, now).Seconds(),
+				Reason:   reason,
+			})
+			preview.ReclaimedSize += file.file.size
+		}
+	}
+	add(cache.pastExpiry(now), audit.Expiry)
+	ttl, maxLifetime := cache.ttl()
+	add(cache.expiredFiles(now, ttl, maxLifetime), audit.TTL)
+	old, _ := cache.oldFiles(now, maxArtifactAge)
+	add(old, audit.Age)
+	if size := preview.TotalSize - preview.ReclaimedSize; size > highWaterMark {
+		add(cache.chooseFilesToClean(size, lowWaterMark, chosen), audit.WaterMark)
+	}
+	preview.ProjectedSize = preview.TotalSize - preview.ReclaimedSize
+	return preview
+}
+
+// pastExpiry returns the files in artifacts whose expiry has passed by the given time.
+func (cache *Cache) pastExpiry(now time.Time) cachedFilePaths {
+	ret := cachedFilePaths{}
+	for t := range cache.cachedFiles.IterBuffered() {
+		if f := t.Val.(*cachedFile); cache.expiries.expired(t.Key, now) {
+			ret = append(ret, cachedFilePath{file: f, path: t.Key, storedTime: f.storedTime})
+		}
+	}
+	return ret
+}
+
+// logCandidates logs a summary of the preview, and each of its candidates at info level.
+func (preview *CleanPreview) logCandidates() {
+	log.Notice("Clean dry run: would remove %d files totalling %s, new size would be %s (water marks %s / %s)",
+		len(preview.Candidates), humanize.Bytes(uint64(preview.ReclaimedSize)), humanize.Bytes(uint64(preview.ProjectedSize)),
+		humanize.Bytes(uint64(preview.LowWaterMark)), humanize.Bytes(uint64(preview.HighWaterMark)))
+	for _, c := range preview.Candidates {
+		log.Info("Clean dry run: would remove %s (%s, last read %s ago, reason: %s)",
+			c.Path, humanize.Bytes(uint64(c.Size)), time.Duration(c.Age*float64(time.Second)), c.Reason)
+	}
+}
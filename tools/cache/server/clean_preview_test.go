@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tools/cache/audit"
+)
+
+func TestPreviewClean(t *testing.T) {
+	c := newCache("test_preview_clean")
+	defer os.RemoveAll(c.rootPath)
+	now := time.Now()
+	for i, age := range []int{10, 2, 5, 1} {
+		c.cachedFiles.Set("test/artifact/"+string('a'+rune(i)), &cachedFile{
+			lastReadTime: now.AddDate(0, 0, -age),
+			storedTime:   now.AddDate(0, 0, -age),
+			size:         1000,
+		})
+	}
+	c.totalSize = 4000
+
+	preview := c.previewClean(7*24*time.Hour, 1500, 2500)
+	require.Equal(t, 3, len(preview.Candidates))
+	assert.Equal(t, "test/artifact/a", preview.Candidates[0].Path, "It's past the maximum age")
+	assert.Equal(t, audit.Age, preview.Candidates[0].Reason)
+	assert.InDelta(t, 10*24*60*60, preview.Candidates[0].Age, 60)
+	assert.Equal(t, "test/artifact/c", preview.Candidates[1].Path, "Then the least recently read go to get under the water mark")
+	assert.Equal(t, audit.WaterMark, preview.Candidates[1].Reason)
+	assert.Equal(t, "test/artifact/b", preview.Candidates[2].Path)
+	assert.EqualValues(t, 3000, preview.ReclaimedSize)
+	assert.EqualValues(t, 1000, preview.ProjectedSize)
+	assert.Equal(t, 4, c.cachedFiles.Count(), "Nothing is actually removed")
+	assert.EqualValues(t, 4000, c.totalSize)
+
+	preview = c.previewClean(7*24*time.Hour, 1500, 3500)
+	assert.Equal(t, 1, len(preview.Candidates), "Once the old file's gone it's under the high water mark")
+	assert.EqualValues(t, 3000, preview.ProjectedSize)
+}
+
+func TestPreviewCleanTTL(t *testing.T) {
+	c := newCache("test_preview_clean_ttl")
+	defer os.RemoveAll(c.rootPath)
+	require.NoError(t, c.SetSlidingTTL(time.Hour, 24*time.Hour))
+	c.cachedFiles.Set("test/artifact/1", &cachedFile{lastReadTime: time.Now().Add(-2 * time.Hour), storedTime: time.Now(), size: 10})
+	c.cachedFiles.Set("test/artifact/2", &cachedFile{lastReadTime: time.Now(), storedTime: time.Now(), size: 10})
+	c.totalSize = 20
+	preview := c.previewClean(7*24*time.Hour, 100, 200)
+	require.Equal(t, 1, len(preview.Candidates))
+	assert.Equal(t, "test/artifact/1", preview.Candidates[0].Path)
+	assert.Equal(t, audit.TTL, preview.Candidates[0].Reason)
+}
+
+func TestCleanDryRun(t *testing.T) {
+	c := newCache("test_clean_dry_run")
+	defer os.RemoveAll(c.rootPath)
+	c.cachedFiles.Set("test/artifact/1", &cachedFile{lastReadTime: time.Now().AddDate(0, 0, -10), size: 1000})
+	c.totalSize = 1000
+	c.SetCleanDryRun(true)
+	go c.clean(10*time.Millisecond, time.Hour, 0, 2000)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, c.cachedFiles.Count(), "Nothing is removed in a dry run")
+}
+
+func TestCleanPreviewHandler(t *testing.T) {
+	c := newCache("test_clean_preview_handler")
+	defer os.RemoveAll(c.rootPath)
+	c.cachedFiles.Set("test/artifact/1", &cachedFile{lastReadTime: time.Now(), size: 1000})
+	c.totalSize = 1000
+	c.lowWaterMark = 100
+	c.highWaterMark = 500
+	c.maxArtifactAge = time.Hour
+	w := httptest.NewRecorder()
+	c.CleanPreviewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/clean/preview", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	preview := CleanPreview{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preview))
+	require.Equal(t, 1, len(preview.Candidates))
+	assert.Equal(t, "test/artifact/1", preview.Candidates[0].Path)
+	assert.EqualValues(t, 0, preview.ProjectedSize)
+}
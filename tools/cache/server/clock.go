@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the cache what the time is. Everything the cache decides based on the time
+// (cleaning old files, sliding TTLs, expiries and build sessions) asks its clock, so tests can
+// control it rather than having to sleep or rewrite the times of files on disk.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// realClock is the default clock, which tells the real time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// SetClock sets the clock the cache uses. It should be set before the cache is in use;
+// by default it uses the real time.
+func (cache *Cache) SetClock(clock Clock) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.clock = clock
+}
+
+// now returns the current time according to the cache's clock.
+func (cache *Cache) now() time.Time {
+	cache.scheduleMutex.Lock()
+	clock := cache.clock
+	cache.scheduleMutex.Unlock()
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
+
+// A fakeClock is a Clock for tests, which only moves when it's told to.
+type fakeClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+// newFakeClock returns a new fakeClock starting at the given time.
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by the given duration.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultClockIsRealTime(t *testing.T) {
+	c := &Cache{}
+	before := time.Now()
+	now := c.now()
+	assert.False(t, now.Before(before))
+	assert.False(t, now.After(time.Now()))
+}
+
+func TestCleanOldFilesWithClock(t *testing.T) {
+	c := newCache("test_clean_old_files_with_clock")
+	clock := newFakeClock(time.Now())
+	c.SetClock(clock)
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/read/hash/file", []byte("test")))
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/unread/hash/file", []byte("test")))
+	clock.Advance(12 * time.Hour)
+	_, err := c.RetrieveArtifact("linux_amd64/pkg/read/hash/file")
+	require.NoError(t, err)
+
+	clock.Advance(12 * time.Hour)
+	assert.False(t, c.cleanOldFiles(24*time.Hour), "Nothing is older than a day yet")
+	clock.Advance(time.Second)
+	assert.True(t, c.cleanOldFiles(24*time.Hour))
+	assert.False(t, c.Contains("linux_amd64/pkg/unread/hash/file"))
+	assert.True(t, c.Contains("linux_amd64/pkg/read/hash/file"), "It was read 12 hours ago")
+}
+
+func TestMinRetentionWithClock(t *testing.T) {
+	c := newCache("test_min_retention_with_clock")
+	clock := newFakeClock(time.Now())
+	c.SetClock(clock)
+	c.SetMinRetention(time.Hour)
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("0123456789")))
+	clock.Advance(time.Hour - time.Second)
+	c.singleClean(0, 5)
+	assert.True(t, c.Contains("linux_amd64/pkg/target/hash/file"), "Still within the retention time")
+	clock.Advance(time.Second)
+	assert.True(t, c.singleClean(0, 5))
+	assert.False(t, c.Contains("linux_amd64/pkg/target/hash/file"))
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// A retrieveGroup coalesces concurrent identical retrievals so they share a single read.
+// This is a very minimal version of singleflight; results are never cached beyond the
+// lifetime of the call, so a failed read doesn't affect any subsequent requests.
+type retrieveGroup struct {
+	calls map[string]*retrieveCall
+	mutex sync.Mutex
+}
+
+// A retrieveCall represents a single in-flight retrieval that may have many waiters.
+type retrieveCall struct {
+	done     chan struct{}
+	response *pb.RetrieveResponse
+	err      error
+}
+
+// Do runs f for the given key, or waits on an existing call for the same key if there is one.
+// The call itself runs independently of any single caller's context so one waiter giving up
+// doesn't cancel it for the others; each waiter only waits as long as its own deadline allows.
+func (g *retrieveGroup) Do(ctx context.Context, key string, f func() (*pb.RetrieveResponse, error)) (*pb.RetrieveResponse, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*retrieveCall{}
+	}
+	call, present := g.calls[key]
+	if !present {
+		call = &retrieveCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			call.response, call.err = f()
+			g.mutex.Lock()
+			delete(g.calls, key)
+			g.mutex.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mutex.Unlock()
+	select {
+	case <-call.done:
+		return call.response, call.err
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	}
+}
+
+// contextError returns the gRPC error for a waiter whose context is done.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.Canceled {
+		return status.Error(codes.Canceled, ctx.Err().Error())
+	}
+	return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+}
+
+// A storeGroup collapses identical stores into a single write. Unlike retrieveGroup it remembers
+// successful results for a short while afterwards, since retries typically arrive just after the
+// original store has finished.
+type storeGroup struct {
+	window time.Duration
+	calls  map[string]*storeCall
+	mutex  sync.Mutex
+}
+
+// A storeCall represents a single store, which may be in progress or recently finished.
+type storeCall struct {
+	done    chan struct{}
+	success bool
+}
+
+// Do runs f for the given key, unless there's already an identical store in progress or one has
+// recently succeeded, in which case it returns its result. The second return value is true if
+// the store was a duplicate of another. A duplicate only waits for the original as long as its
+// own context allows, and gets an error if that runs out first.
+func (g *storeGroup) Do(ctx context.Context, key string, f func() bool) (bool, bool, error) {
+	if g.window <= 0 {
+		return f(), false, nil
+	}
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*storeCall{}
+	}
+	if call, present := g.calls[key]; present {
+		g.mutex.Unlock()
+		select {
+		case <-call.done:
+			return call.success, true, nil
+		case <-ctx.Done():
+			return false, true, contextError(ctx)
+		}
+	}
+	call := &storeCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+	call.success = f()
+	close(call.done)
+	if !call.success {
+		// Don't remember failures; the next attempt should try again.
+		g.forget(key, call)
+	} else {
+		time.AfterFunc(g.window, func() { g.forget(key, call) })
+	}
+	return call.success, false, nil
+}
+
+// forget removes the given call from this group, if it's still the current one for its key.
+func (g *storeGroup) forget(key string, call *storeCall) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// storeKey returns a key identifying the artifacts and their contents in a StoreRequest, along with
+// everything else that affects how they're stored; otherwise a retry that changed any of it (e.g.
+// to give a longer TTL) would be treated as a duplicate and its changes silently dropped.
+func storeKey(req *pb.StoreRequest) string {
+	h := sha256.New()
+	for _, artifact := range req.Artifacts {
+		h.Write([]byte(path.Join(artifact.Package, artifact.Target, artifact.File)))
+		h.Write([]byte{0})
+		h.Write(artifact.Body)
+		h.Write([]byte{0})
+	}
+	fmt.Fprintf(h, "%d\x00%d\x00%s\x00%g", req.Expiry, req.TtlSeconds, req.BuildKey, req.RebuildCost)
+	return req.Os + "_" + req.Arch + "/" + base64.RawURLEncoding.EncodeToString(req.Hash) + "/" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// registerCompressorOnce guards registration of our compressor.
+var registerCompressorOnce sync.Once
+
+// registerCompressor enables gzip compression for RPCs that request it, for servers whose options
+// allow it (see ServerOptions.AllowCompression).
+// Compression is entirely driven by the client; a call is only compressed if the client sent it
+// compressed, so clients that don't ask for it don't pay anything for it.
+// gRPC's compressors are registered for the whole process, so once one server allows it any
+// others in the same process accept compressed calls too; only those that allow it advertise it.
+// This must be called before the server starts serving.
+func registerCompressor() {
+	registerCompressorOnce.Do(func() {
+		log.Notice("Allowing gzip compression")
+		encoding.RegisterCompressor(gzipCompressor{})
+	})
+}
+
+// gzipCompressor implements grpc's encoding.Compressor interface using gzip.
+type gzipCompressor struct{}
+
+func (c gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (c gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+func (c gzipCompressor) Name() string {
+	return "gzip"
+}
+
+// compressionMagic starts every file stored while compression is on, followed by a byte identifying
+// the codec it was compressed with (storedCodec if it wasn't). Files without it (including everything
+// stored before compression was enabled) are read as they are; so that's unambiguous, artifacts
+// that happen to start with it are also given the header when compression is off. With the codec
+// byte it's the same length as encryptionMagic, so either can be recognised from the start of a file.
+const compressionMagic = "PLZCMP\x00"
+
+// storedCodec is the codec id of files that follow compressionMagic uncompressed.
+const storedCodec = 0
+
+// compressionSampleSize is how much of the start of an artifact is compressed first, to decide
+// whether it's worth compressing the whole thing. Artifacts no bigger than it are just compressed.
+const compressionSampleSize = 16 * 1024
+
+// maxSampleRatio is the most the sample can compress to, as a fraction of its size, for the
+// artifact to be compressed. Artifacts that are compressed already (zips, jars, images) rarely
+// get more than a few percent smaller, which isn't worth the CPU of compressing them again.
+const maxSampleRatio = 0.9
+
+// An atRestCodec compresses artifacts before they're written to disk.
+type atRestCodec struct {
+	// id is written after compressionMagic to identify the codec.
+	id         byte
+	compress   func(contents []byte, level int) ([]byte, error)
+	decompress func([]byte) ([]byte, error)
+	// minLevel and maxLevel are the range of levels the codec can compress at, from fastest to
+	// smallest, and defaultLevel the one it uses if none is given.
+	minLevel, maxLevel, defaultLevel int
+	// level is the level artifacts are compressed at, once it's been configured by SetCompression.
+	level int
+}
+
+// atRestCodecs are the codecs artifacts can be compressed with at rest, by name.
+// Files record which they were compressed with but not the level, so they can be read whichever
+// codec and level are configured now; new codecs must have ids that have never been used before
+// (nor storedCodec).
+//
+// BenchmarkCompressionLevels measures each level. On a compiled Go binary (a ~20MB test binary,
+// typical of build outputs) gzip gives:
+//
+//	level  ratio  MB/s
+//	1      0.58   100
+//	3      0.56    96
+//	5      0.54    79
+//	6      0.54    60
+//	8      0.53    36
+//	9      0.53     7
+//
+// so the higher levels cost a lot of CPU for little gain; 1 suits busy nodes.
+var atRestCodecs = map[string]*atRestCodec{
+	"gzip": {
+		id:           1,
+		compress:     gzipCompress,
+		decompress:   gzipDecompress,
+		minLevel:     gzip.BestSpeed,
+		maxLevel:     gzip.BestCompression,
+		defaultLevel: gzip.DefaultCompression,
+	},
+}
+
+// Compressions returns the names of the modes that can be passed to SetCompression.
+func Compressions() []string {
+	ret := []string{"none"}
+	for name := range atRestCodecs {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret[1:])
+	return ret
+}
+
+// SetCompression sets how artifacts stored from now on are compressed on disk; one of Compressions.
+// The default is none. Artifacts already stored are read correctly whatever they were stored with,
+// and any that wouldn't get any smaller are stored uncompressed, as are any whose first
+// compressionSampleSize bytes barely compress. The cache's size is what they take
+// up on disk, so compression lets it hold more before it's cleaned.
+// The level trades CPU for size, within the range of the codec (for gzip, 1 is fastest and 9
+// smallest); zero means the codec's default. It's ignored if the mode is none.
+func (cache *Cache) SetCompression(mode string, level int) error {
+	codec, present := atRestCodecs[mode]
+	if !present && mode != "none" {
+		return fmt.Errorf("unknown compression %s, must be one of %s", mode, Compressions())
+	}
+	if present {
+		if level == 0 {
+			level = codec.defaultLevel
+		} else if level < codec.minLevel || level > codec.maxLevel {
+			return fmt.Errorf("invalid level %d for %s compression, must be between %d and %d", level, mode, codec.minLevel, codec.maxLevel)
+		}
+		c := *codec
+		c.level = level
+		codec = &c
+	}
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.compression = codec
+	return nil
+}
+
+// currentCompression returns the codec used to compress artifacts, or nil if they aren't.
+func (cache *Cache) currentCompression() *atRestCodec {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.compression
+}
+
+// seal compresses the given artifact contents, or stores them uncompressed if that doesn't make them
+// smaller. It returns true if it didn't try because a sample of them barely compressed.
+func (c *atRestCodec) seal(contents []byte) ([]byte, bool, error) {
+	if len(contents) > compressionSampleSize {
+		sample, err := c.compress(contents[:compressionSampleSize], c.level)
+		if err != nil {
+			return nil, false, err
+		} else if float64(len(sample)) > maxSampleRatio*compressionSampleSize {
+			return storeUncompressed(contents), true, nil
+		}
+	}
+	compressed, err := c.compress(contents, c.level)
+	if err != nil {
+		return nil, false, err
+	} else if len(compressed) >= len(contents) {
+		return storeUncompressed(contents), false, nil
+	}
+	return append(append([]byte(compressionMagic), c.id), compressed...), false, nil
+}
+
+// storeUncompressed returns the given artifact contents with a header saying they aren't compressed.
+func storeUncompressed(contents []byte) []byte {
+	out := make([]byte, 0, len(compressionMagic)+1+len(contents))
+	out = append(append(out, compressionMagic...), storedCodec)
+	return append(out, contents...)
+}
+
+// isCompressed returns true if the given file contents are compressed.
+func isCompressed(contents []byte) bool {
+	return len(contents) > len(compressionMagic) && bytes.HasPrefix(contents, []byte(compressionMagic))
+}
+
+// isSealed returns true if the given file contents (or the start of them) need unsealing before they can be read.
+func isSealed(contents []byte) bool {
+	return isEncrypted(contents) || isCompressed(contents)
+}
+
+// decompress returns the contents of the compressed file with the given name.
+func decompress(name string, contents []byte) ([]byte, error) {
+	id := contents[len(compressionMagic)]
+	if id == storedCodec {
+		return contents[len(compressionMagic)+1:], nil
+	}
+	for _, codec := range atRestCodecs {
+		if codec.id == id {
+			b, err := codec.decompress(contents[len(compressionMagic)+1:])
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress %s: %s", name, err)
+			}
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is compressed with an unknown codec (%d)", name, id)
+}
+
+func gzipCompress(contents []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	} else if _, err := w.Write(contents); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(contents []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
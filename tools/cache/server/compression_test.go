@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const compressionKey = "linux_amd64/pkg/target/hash/file"
+
+// compressible is an artifact that gets a lot smaller when it's compressed.
+var compressible = bytes.Repeat([]byte("please build "), 1000)
+
+func TestCacheCompressesAtRest(t *testing.T) {
+	c := newCache("test_compresses_at_rest")
+	defer os.RemoveAll(c.rootPath)
+	require.NoError(t, c.SetCompression("gzip", 0))
+	require.NoError(t, c.StoreArtifact(compressionKey, compressible))
+
+	onDisk, err := ioutil.ReadFile(path.Join(c.rootPath, compressionKey))
+	require.NoError(t, err)
+	assert.True(t, isCompressed(onDisk))
+	assert.True(t, len(onDisk) < len(compressible)/10)
+	assert.EqualValues(t, len(onDisk), c.TotalSize(), "The cache counts the size on disk")
+
+	arts, err := c.RetrieveArtifact(compressionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{compressionKey: compressible}, arts)
+
+	// Checksums are of the decompressed contents.
+	stats, err := c.StatArtifact(compressionKey)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(compressible)
+	assert.Equal(t, map[string]ArtifactStat{compressionKey: {Size: int64(len(compressible)), Hash: hex.EncodeToString(sum[:])}}, stats)
+
+	f, done, err := c.OpenArtifact(compressionKey)
+	require.NoError(t, err)
+	defer done()
+	b, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, compressible, b)
+	info, err := f.Stat()
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(compressible), info.Size())
+}
+
+func TestIncompressibleArtifactsStoredUncompressed(t *testing.T) {
+	c := newCache("test_incompressible")
+	defer os.RemoveAll(c.rootPath)
+	require.NoError(t, c.SetCompression("gzip", 0))
+	require.NoError(t, c.StoreArtifact(compressionKey, []byte("tiny")))
+	onDisk, err := ioutil.ReadFile(path.Join(c.rootPath, compressionKey))
+	require.NoError(t, err)
+	assert.Equal(t, []byte(compressionMagic+"\x00tiny"), onDisk)
+	arts, err := c.RetrieveArtifact(compressionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{compressionKey: []byte("tiny")}, arts)
+}
+
+func TestAlreadyCompressedArtifactsSkipped(t *testing.T) {
+	c := newCache("test_already_compressed")
+	defer os.RemoveAll(c.rootPath)
+	require.NoError(t, c.SetCompression("gzip", 0))
+	// Random data doesn't compress, just like an artifact that's been compressed already.
+	contents := make([]byte, 4*compressionSampleSize)
+	rand.New(rand.NewSource(42)).Read(contents)
+	require.NoError(t, c.StoreArtifact(compressionKey, contents))
+	onDisk, err := ioutil.ReadFile(path.Join(c.rootPath, compressionKey))
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte(compressionMagic+"\x00"), contents...), onDisk)
+	assert.EqualValues(t, 1, compressionSkipped(t, c))
+	arts, err := c.RetrieveArtifact(compressionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{compressionKey: contents}, arts)
+
+	// Large artifacts that do compress still are.
+	large := bytes.Repeat(compressible, 5)
+	require.NoError(t, c.StoreArtifact(compressionKey, large))
+	onDisk, err = ioutil.ReadFile(path.Join(c.rootPath, compressionKey))
+	require.NoError(t, err)
+	assert.True(t, len(onDisk) < len(large)/10)
+	assert.EqualValues(t, 1, compressionSkipped(t, c))
+	arts, err = c.RetrieveArtifact(compressionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{compressionKey: large}, arts)
+}
+
+// compressionSkipped returns the current value of the given cache's skipped compression counter.
+func compressionSkipped(t *testing.T, cache *Cache) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, cache.metrics.compressionSkipped.Write(m))
+	return m.Counter.GetValue()
+}
+
+func TestArtifactsThatLookCompressed(t *testing.T) {
+	gzipped, err := gzipCompress(compressible, gzip.DefaultCompression)
+	require.NoError(t, err)
+	for _, contents := range [][]byte{
+		[]byte("\x1f\x8btiny"),
+		gzipped,
+		[]byte(compressionMagic + "\x01tiny"),
+		append([]byte(compressionMagic+"\x00"), compressible...),
+	} {
+		for _, mode := range []string{"none", "gzip"} {
+			c := newCache("test_look_compressed")
+			require.NoError(t, c.SetCompression(mode, 0))
+			require.NoError(t, c.StoreArtifact(compressionKey, contents))
+			arts, err := c.RetrieveArtifact(compressionKey)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]byte{compressionKey: contents}, arts, "Compression %s", mode)
+
+			f, done, err := c.OpenArtifact(compressionKey)
+			require.NoError(t, err)
+			b, err := ioutil.ReadAll(f)
+			assert.NoError(t, err)
+			assert.Equal(t, contents, b)
+			done()
+			os.RemoveAll(c.rootPath)
+		}
+	}
+}
+
+func TestCacheReadsUncompressedFiles(t *testing.T) {
+	c := newCache("test_reads_uncompressed")
+	defer os.RemoveAll(c.rootPath)
+	require.NoError(t, c.StoreArtifact(compressionKey, compressible))
+	require.NoError(t, c.SetCompression("gzip", 0))
+	arts, err := c.RetrieveArtifact(compressionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{compressionKey: compressible}, arts)
+
+	// And compressed ones once it's turned off again.
+	const key2 = "linux_amd64/pkg/target/hash/file2"
+	require.NoError(t, c.StoreArtifact(key2, compressible))
+	require.NoError(t, c.SetCompression("none", 0))
+	arts, err = c.RetrieveArtifact(key2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{key2: compressible}, arts)
+}
+
+func TestCompressedAndEncrypted(t *testing.T) {
+	c := newCache("test_compressed_and_encrypted")
+	defer os.RemoveAll(c.rootPath)
+	require.NoError(t, c.SetCompression("gzip", 0))
+	require.NoError(t, c.SetEncryptionKey(bytes.Repeat([]byte{42}, encryptionKeySize)))
+	require.NoError(t, c.StoreArtifact(compressionKey, compressible))
+
+	onDisk, err := ioutil.ReadFile(path.Join(c.rootPath, compressionKey))
+	require.NoError(t, err)
+	assert.True(t, isEncrypted(onDisk))
+	assert.True(t, len(onDisk) < len(compressible)/10, "It's compressed before it's encrypted")
+
+	arts, err := c.RetrieveArtifact(compressionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{compressionKey: compressible}, arts)
+}
+
+func TestSetCompression(t *testing.T) {
+	c := newCache("test_set_compression")
+	defer os.RemoveAll(c.rootPath)
+	assert.Equal(t, []string{"none", "gzip"}, Compressions())
+	assert.NoError(t, c.SetCompression("none", 0))
+	assert.Nil(t, c.currentCompression())
+	assert.Error(t, c.SetCompression("lzma", 0))
+	assert.Error(t, c.SetCompression("gzip", 10))
+	assert.NoError(t, c.SetCompression("none", 10), "The level's ignored without compression")
+}
+
+func TestCompressionLevels(t *testing.T) {
+	c := newCache("test_compression_levels")
+	defer os.RemoveAll(c.rootPath)
+	// Artifacts stored at any level can be read back whatever level is configured now.
+	for _, level := range []int{1, 9, 0} {
+		require.NoError(t, c.SetCompression("gzip", level))
+		key := fmt.Sprintf("linux_amd64/pkg/target/hash/level%d", level)
+		require.NoError(t, c.StoreArtifact(key, compressible))
+	}
+	require.NoError(t, c.SetCompression("gzip", 5))
+	for _, level := range []int{1, 9, 0} {
+		key := fmt.Sprintf("linux_amd64/pkg/target/hash/level%d", level)
+		arts, err := c.RetrieveArtifact(key)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]byte{key: compressible}, arts)
+	}
+}
+
+func TestUnknownCodecIsError(t *testing.T) {
+	_, err := decompress("file", append([]byte(compressionMagic), 200, 1, 2, 3))
+	assert.Error(t, err)
+}
+
+// BenchmarkCompressionLevels measures how well and how fast each gzip level compresses a
+// representative artifact, for which we use this test binary since it's a typical build output.
+func BenchmarkCompressionLevels(b *testing.B) {
+	artifact, err := ioutil.ReadFile(os.Args[0])
+	require.NoError(b, err)
+	codec := atRestCodecs["gzip"]
+	for level := codec.minLevel; level <= codec.maxLevel; level++ {
+		b.Run(fmt.Sprintf("level%d", level), func(b *testing.B) {
+			b.SetBytes(int64(len(artifact)))
+			var compressed []byte
+			for i := 0; i < b.N; i++ {
+				if compressed, err = codec.compress(artifact, level); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(compressed))/float64(len(artifact)), "ratio")
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"core"
+)
+
+// emptyMarkerSuffix is appended to the name of an empty artifact to get the name of its marker.
+//
+// Some rules legitimately produce empty files, but an empty file is also what's left behind if
+// we're interrupted while storing one (for example if the machine goes down before the contents
+// reach the disk). The marker is written before an empty artifact is, and removed before a
+// nonempty one is, so an empty file with no marker next to it can only be an interrupted store.
+// Those are removed when the cache is scanned at startup (which also removes any empty artifacts
+// stored before markers existed; they're just rebuilt).
+const emptyMarkerSuffix = ".plz_empty"
+
+// isEmptyMarker returns true if the given file is the marker for an empty artifact.
+// These aren't artifacts themselves and are never returned to clients.
+func isEmptyMarker(name string) bool {
+	return strings.HasSuffix(name, emptyMarkerSuffix)
+}
+
+// markEmpty writes the marker for the empty artifact at the given path, creating its directory as needed.
+func markEmpty(fullPath string) error {
+	if err := os.MkdirAll(path.Dir(fullPath), core.DirPermissions); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fullPath+emptyMarkerSuffix, nil, 0644)
+}
+
+// unmarkEmpty removes the marker for the artifact at the given path, if there is one.
+func unmarkEmpty(fullPath string) error {
+	if err := os.Remove(fullPath + emptyMarkerSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isLegitimatelyEmpty returns true if the empty artifact at the given path has a marker.
+func isLegitimatelyEmpty(fullPath string) bool {
+	_, err := os.Stat(fullPath + emptyMarkerSuffix)
+	return err == nil
+}
+
+// prepareArtifact is called before writing an artifact of the given size to the given path.
+// It marks it as empty, or removes any marker it had if it's being overwritten with something
+// that isn't, so the marker is never present for an incomplete write.
+func prepareArtifact(fullPath string, size int64) error {
+	if size == 0 {
+		return markEmpty(fullPath)
+	}
+	return unmarkEmpty(fullPath)
+}
+
+// verifyArtifact checks that the artifact at the given path was completely written.
+func verifyArtifact(fullPath string, size int64) error {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	} else if info.Size() != size {
+		return fmt.Errorf("wrote %d bytes but %d are on disk", size, info.Size())
+	} else if size == 0 && !isLegitimatelyEmpty(fullPath) {
+		return fmt.Errorf("marker for empty artifact is missing")
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// encryptionMagic starts every file that's encrypted at rest, so we can tell them apart from
+// ones stored before encryption was enabled (which are still read as they are). Artifacts stored
+// unencrypted that happen to start with it are given a header so they aren't mistaken for them.
+const encryptionMagic = "PLZENC\x00\x01"
+
+const (
+	// encryptionKeySize is the size of both the master key and the data keys, for AES-256.
+	encryptionKeySize = 32
+	// nonceSize and tagSize are the sizes of the nonce and authentication tag that GCM adds.
+	nonceSize = 12
+	tagSize   = 16
+	// wrappedKeySize is the size of a data key once it's encrypted with the master key.
+	wrappedKeySize = nonceSize + encryptionKeySize + tagSize
+	// encryptionOverhead is the number of bytes encryption adds to each file: the magic, the
+	// wrapped data key, and the nonce & tag for the contents.
+	encryptionOverhead = len(encryptionMagic) + wrappedKeySize + nonceSize + tagSize
+)
+
+// An envelope implements envelope encryption: each artifact is encrypted with a fresh data key,
+// which is itself encrypted (wrapped) with the master key and stored at the start of the file.
+// Files are laid out as the magic, the wrapped data key, then the nonce and encrypted contents;
+// the magic and wrapped key are authenticated along with the contents, so tampering with any
+// part of the file makes it fail to decrypt.
+type envelope struct {
+	master cipher.AEAD
+}
+
+// newEnvelope returns a new envelope using the given master key.
+func newEnvelope(masterKey []byte) (*envelope, error) {
+	if len(masterKey) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, was %d", encryptionKeySize, len(masterKey))
+	}
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{master: master}, nil
+}
+
+// newAEAD returns an AES-GCM cipher using the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the given artifact contents with a new data key.
+func (e *envelope) seal(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(plaintext)+encryptionOverhead)
+	out = append(out, encryptionMagic...)
+	if out, err = sealWith(e.master, out, dataKey, []byte(encryptionMagic)); err != nil {
+		return nil, err
+	}
+	return sealWith(data, out, plaintext, out)
+}
+
+// open decrypts the contents of a file written by seal.
+func (e *envelope) open(contents []byte) ([]byte, error) {
+	if len(contents) < encryptionOverhead {
+		return nil, fmt.Errorf("truncated, only %d bytes", len(contents))
+	}
+	header := contents[:len(encryptionMagic)+wrappedKeySize]
+	dataKey, err := openWith(e.master, header[len(encryptionMagic):], []byte(encryptionMagic))
+	if err != nil {
+		return nil, fmt.Errorf("can't unwrap data key: %s", err)
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return openWith(data, contents[len(header):], header)
+}
+
+// sealWith encrypts the given plaintext with a random nonce and appends the nonce & result to dst.
+func sealWith(aead cipher.AEAD, dst, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(append(dst, nonce...), nonce, plaintext, additionalData), nil
+}
+
+// openWith decrypts a nonce & ciphertext written by sealWith.
+func openWith(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+}
+
+// isEncrypted returns true if the given file contents are encrypted at rest.
+func isEncrypted(contents []byte) bool {
+	return bytes.HasPrefix(contents, []byte(encryptionMagic))
+}
+
+// ReadEncryptionKey reads the master key for encryption at rest, either from a file or from the
+// output of a command (for example one that fetches or decrypts it using a KMS). The command is
+// split on whitespace and run once, without a shell. At most one of the two can be given; if
+// neither is then it returns nil.
+// The key is 32 bytes, given either as they are or hex or base64 encoded.
+func ReadEncryptionKey(filename, command string) ([]byte, error) {
+	if filename != "" && command != "" {
+		return nil, fmt.Errorf("Can't read encryption key from both file %s and command %s", filename, command)
+	} else if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return parseEncryptionKey(b)
+	} else if command != "" {
+		args := strings.Fields(command)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to run %s: %s", args[0], err)
+		}
+		return parseEncryptionKey(b)
+	}
+	return nil, nil
+}
+
+// parseEncryptionKey decodes a master key in any of the forms ReadEncryptionKey accepts.
+func parseEncryptionKey(b []byte) ([]byte, error) {
+	if len(b) == encryptionKeySize {
+		return b, nil
+	}
+	s := strings.TrimSpace(string(b))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	} else if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be %d bytes, optionally hex or base64 encoded", encryptionKeySize)
+}
+
+// SetEncryptionKey enables encryption at rest with the given master key. Artifacts stored after
+// this is called are encrypted on disk (as are copies sent to the mirror), and decrypted again
+// when they're retrieved; files stored before are still read as they are.
+// Checksums, key collisions and the stats are all based on the decrypted contents, so they're
+// the same as they would be without encryption and agree between nodes. The sizes used to
+// decide when to clean are what's on disk, as are snapshots, which are taken of the files as
+// they are and so can only be restored by a server with the same key.
+// Files that can't be decrypted are reported as errors rather than returned.
+func (cache *Cache) SetEncryptionKey(masterKey []byte) error {
+	e, err := newEnvelope(masterKey)
+	if err != nil {
+		return err
+	}
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.encryption = e
+	return nil
+}
+
+// currentEncryption returns the envelope used to encrypt artifacts, or nil if encryption is disabled.
+func (cache *Cache) currentEncryption() *envelope {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.encryption
+}
+
+// seal returns the given artifact contents as they should be written to disk.
+// They're compressed before they're encrypted, since encrypted data doesn't compress.
+func (cache *Cache) seal(contents []byte) ([]byte, error) {
+	if c := cache.currentCompression(); c != nil {
+		var err error
+		var skipped bool
+		if contents, skipped, err = c.seal(contents); err != nil {
+			return nil, err
+		} else if skipped {
+			cache.metrics.compressionSkipped.Inc()
+		}
+	} else if isSealed(contents) {
+		// Otherwise it'd be decrypted or decompressed when it's read.
+		contents = storeUncompressed(contents)
+	}
+	if e := cache.currentEncryption(); e != nil {
+		return e.seal(contents)
+	}
+	return contents, nil
+}
+
+// unseal returns the contents of an artifact given what was read from the file with the given name.
+func (cache *Cache) unseal(name string, contents []byte) ([]byte, error) {
+	contents, err := cache.decrypt(name, contents)
+	if err != nil {
+		return nil, err
+	} else if isCompressed(contents) {
+		return decompress(name, contents)
+	}
+	return contents, nil
+}
+
+// decrypt returns the decrypted contents of the file with the given name, or the contents as
+// they are if it isn't encrypted.
+func (cache *Cache) decrypt(name string, contents []byte) ([]byte, error) {
+	if !isEncrypted(contents) {
+		return contents, nil
+	}
+	e := cache.currentEncryption()
+	if e == nil {
+		cache.metrics.decryptionFailures.Inc()
+		return nil, fmt.Errorf("%s is encrypted but no encryption key is configured", name)
+	}
+	plaintext, err := e.open(contents)
+	if err != nil {
+		cache.metrics.decryptionFailures.Inc()
+		return nil, fmt.Errorf("failed to decrypt %s: %s", name, err)
+	}
+	return plaintext, nil
+}
+
+// readArtifact reads the artifact in the given file, decrypting and decompressing it if needed.
+func (cache *Cache) readArtifact(name string) ([]byte, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return cache.unseal(name, b)
+}
+
+// hashArtifact returns the hex-encoded sha256 hash and size of the unsealed contents of the
+// given file. Files stored as they are are streamed through the hash rather than read into memory.
+func (cache *Cache) hashArtifact(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(encryptionMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", 0, err
+	}
+	var r io.Reader = io.MultiReader(bytes.NewReader(magic[:n]), f)
+	if isSealed(magic[:n]) {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", 0, err
+		} else if b, err = cache.unseal(name, b); err != nil {
+			return "", 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// An ArtifactFile is a single artifact opened for reading by OpenArtifact.
+// It's the file itself, unless it's encrypted or compressed, in which case it's the unsealed contents.
+type ArtifactFile interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// openArtifactFile opens the given file as an ArtifactFile, decrypting and decompressing it if needed.
+func (cache *Cache) openArtifactFile(name string) (ArtifactFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(encryptionMagic))
+	if n, _ := io.ReadFull(f, magic); !isSealed(magic[:n]) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(io.MultiReader(bytes.NewReader(magic), f))
+	if err != nil {
+		return nil, err
+	} else if b, err = cache.unseal(name, b); err != nil {
+		return nil, err
+	}
+	return &decryptedFile{Reader: bytes.NewReader(b), info: decryptedFileInfo{FileInfo: info, size: int64(len(b))}}, nil
+}
+
+// A decryptedFile is an ArtifactFile holding the unsealed contents of an encrypted or compressed one.
+type decryptedFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *decryptedFile) Close() error               { return nil }
+func (f *decryptedFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+// A decryptedFileInfo describes a sealed file, but with the size of its unsealed contents.
+type decryptedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (info decryptedFileInfo) Size() int64 { return info.size }
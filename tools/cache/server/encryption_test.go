@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEncryptionKey = bytes.Repeat([]byte{42}, encryptionKeySize)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	e, err := newEnvelope(testEncryptionKey)
+	require.NoError(t, err)
+	sealed1, err := e.seal([]byte("secret"))
+	require.NoError(t, err)
+	sealed2, err := e.seal([]byte("secret"))
+	require.NoError(t, err)
+	assert.Equal(t, len("secret")+encryptionOverhead, len(sealed1))
+	assert.NotEqual(t, sealed1, sealed2, "Each gets its own data key")
+	assert.False(t, bytes.Contains(sealed1, []byte("secret")))
+	plaintext, err := e.open(sealed1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), plaintext)
+}
+
+func TestEnvelopeDetectsTampering(t *testing.T) {
+	e, err := newEnvelope(testEncryptionKey)
+	require.NoError(t, err)
+	sealed, err := e.seal([]byte("secret"))
+	require.NoError(t, err)
+	for _, i := range []int{len(encryptionMagic), len(encryptionMagic) + wrappedKeySize, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[i]++
+		_, err := e.open(tampered)
+		assert.Error(t, err, "Changing byte %d should be detected", i)
+	}
+	_, err = e.open(sealed[:encryptionOverhead-1])
+	assert.Error(t, err)
+}
+
+func TestEnvelopeWrongKey(t *testing.T) {
+	e1, _ := newEnvelope(testEncryptionKey)
+	e2, _ := newEnvelope(bytes.Repeat([]byte{7}, encryptionKeySize))
+	sealed, err := e1.seal([]byte("secret"))
+	require.NoError(t, err)
+	_, err = e2.open(sealed)
+	assert.Error(t, err)
+}
+
+func TestReadEncryptionKey(t *testing.T) {
+	const hexKey = "2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a"
+	filename := "test_encryption_key"
+	require.NoError(t, ioutil.WriteFile(filename, []byte(hexKey+"\n"), 0600))
+	defer os.Remove(filename)
+	key, err := ReadEncryptionKey(filename, "")
+	assert.NoError(t, err)
+	assert.Equal(t, testEncryptionKey, key)
+	key, err = ReadEncryptionKey("", "echo KioqKioqKioqKioqKioqKioqKioqKioqKioqKioqKio=")
+	assert.NoError(t, err)
+	assert.Equal(t, testEncryptionKey, key)
+	_, err = ReadEncryptionKey(filename, "echo")
+	assert.Error(t, err, "Can't give both")
+	_, err = ReadEncryptionKey("", "echo too short")
+	assert.Error(t, err)
+	key, err = ReadEncryptionKey("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+}
+
+func TestCacheEncryptsAtRest(t *testing.T) {
+	const key = "linux_amd64/pkg/target/hash/file"
+	c := newCache("test_encrypts_at_rest")
+	require.NoError(t, c.SetEncryptionKey(testEncryptionKey))
+	require.NoError(t, c.StoreArtifact(key, []byte("secret")))
+
+	onDisk, err := ioutil.ReadFile(path.Join(c.rootPath, key))
+	require.NoError(t, err)
+	assert.True(t, isEncrypted(onDisk))
+	assert.False(t, bytes.Contains(onDisk, []byte("secret")))
+
+	arts, err := c.RetrieveArtifact(key)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{key: []byte("secret")}, arts)
+
+	// Checksums are of the decrypted contents.
+	stats, err := c.StatArtifact(key)
+	assert.NoError(t, err)
+	sum := sha256.Sum256([]byte("secret"))
+	assert.Equal(t, map[string]ArtifactStat{key: {Size: 6, Hash: hex.EncodeToString(sum[:])}}, stats)
+
+	f, done, err := c.OpenArtifact(key)
+	require.NoError(t, err)
+	defer done()
+	b, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), b)
+	info, err := f.Stat()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 6, info.Size())
+
+	artifacts, err := c.LoadArtifacts("linux_amd64/pkg/target/hash")
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(artifacts)) {
+		assert.Equal(t, []byte("secret"), artifacts[0].Body)
+	}
+}
+
+func TestCacheReadsUnencryptedFiles(t *testing.T) {
+	const key = "linux_amd64/pkg/target/hash/file"
+	c := newCache("test_reads_unencrypted")
+	require.NoError(t, c.StoreArtifact(key, []byte("stored before")))
+	require.NoError(t, c.SetEncryptionKey(testEncryptionKey))
+	arts, err := c.RetrieveArtifact(key)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{key: []byte("stored before")}, arts)
+	// Storing it again encrypts it, but as it's the same contents it's not a collision.
+	c.SetRejectCollisions(true)
+	assert.NoError(t, c.StoreArtifact(key, []byte("stored before")))
+	onDisk, err := ioutil.ReadFile(path.Join(c.rootPath, key))
+	require.NoError(t, err)
+	assert.True(t, isEncrypted(onDisk))
+}
+
+func TestArtifactsThatLookEncrypted(t *testing.T) {
+	const key = "linux_amd64/pkg/target/hash/file"
+	contents := []byte(encryptionMagic + "not really")
+	sum := sha256.Sum256(contents)
+	c := newCache("test_look_encrypted")
+	defer os.RemoveAll(c.rootPath)
+	check := func(key string) {
+		arts, err := c.RetrieveArtifact(key)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]byte{key: contents}, arts)
+		stats, err := c.StatArtifact(key)
+		assert.NoError(t, err)
+		assert.Equal(t, hex.EncodeToString(sum[:]), stats[key].Hash)
+	}
+	require.NoError(t, c.StoreArtifact(key, contents))
+	check(key)
+	// It's still read as it is once encryption is turned on, and stored encrypted it round-trips.
+	require.NoError(t, c.SetEncryptionKey(testEncryptionKey))
+	check(key)
+	require.NoError(t, c.StoreArtifact(key+"2", contents))
+	check(key + "2")
+}
+
+func TestDecryptionFailureIsError(t *testing.T) {
+	const key = "linux_amd64/pkg/target/hash/file"
+	c := newCache("test_decryption_failure")
+	require.NoError(t, c.SetEncryptionKey(testEncryptionKey))
+	require.NoError(t, c.StoreArtifact(key, []byte("secret")))
+
+	// Another key can't read it.
+	require.NoError(t, c.SetEncryptionKey(bytes.Repeat([]byte{7}, encryptionKeySize)))
+	_, err := c.RetrieveArtifact(key)
+	assert.Error(t, err)
+	_, _, err = c.OpenArtifact(key)
+	assert.Error(t, err)
+	_, err = c.StatArtifact(key)
+	assert.Error(t, err)
+
+	// Nor can a server with no key; it mustn't just return what's on disk.
+	c.encryption = nil
+	_, err = c.RetrieveArtifact(key)
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/djherbis/atime"
+
+	"tools/cache/audit"
+)
+
+// An Entry describes a single file in the cache, as listed by ListEntries.
+type Entry struct {
+	// Key is the file's path relative to the cache directory.
+	Key string `json:"key"`
+	// Size is the size of the file on disk.
+	Size int64 `json:"size"`
+	// LastRead is when the file was last retrieved (or stored, if it's never been retrieved).
+	LastRead time.Time `json:"last_read"`
+}
+
+// isUntracked returns true if the file with the given base name isn't an artifact in its own right,
+// but holds information about the others in its directory.
+func isUntracked(base string) bool {
+	return base == metadataFileName || base == buildKeyFileName || base == shadowKeyFileName || base == expiryFileName || isEmptyMarker(base) || isPartial(base) || isChecksum(base)
+}
+
+// ListEntries returns the files in the cache whose keys start with the given prefix, sorted by key.
+// If limit is positive it returns at most that many. Files that have been dropped from the index
+// (see ServerOptions.MaxIndexEntries) are found on disk, so are listed too; their last read time
+// is taken from the filesystem.
+// It walks the directory given by the prefix, so the longer it is the cheaper this is.
+func (cache *Cache) ListEntries(prefix string, limit int) ([]Entry, error) {
+	prefix = cache.normalize(prefix)
+	dir := path.Join(cache.rootPath, prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(dir) // It could be part of a name, so we have to look at everything alongside it.
+	}
+	ret := []Entry{}
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil // Either there's nothing with this prefix, or it's been removed from under us.
+		} else if err != nil {
+			return err
+		} else if info.IsDir() || isUntracked(info.Name()) {
+			return nil
+		}
+		key := name[len(cache.rootPath)+1:]
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		entry := Entry{Key: key, Size: info.Size(), LastRead: atime.Get(info)}
+		if filei, present := cache.cachedFiles.Get(key); present {
+			file := filei.(*cachedFile)
+			file.RLock()
+			entry.Size = file.size
+			entry.LastRead = file.lastReadTime
+			file.RUnlock()
+		}
+		ret = append(ret, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+// DeleteEntry deletes the single file in the cache with the given key, as listed by ListEntries.
+// Unlike DeleteArtifact it doesn't delete anything else that happens to share it as a prefix.
+// It returns an error satisfying os.IsNotExist if there's no such file. If there's a storage
+// backend it's deleted from there too, in which case it's only missing if it isn't in either.
+func (cache *Cache) DeleteEntry(key string) error {
+	key = cache.normalize(key)
+	if base := path.Base(key); key == "" || isUntracked(base) {
+		return os.ErrNotExist
+	} else if cache.hasUnindexed() && !cache.cachedFiles.Has(key) {
+		cache.admitFile(key)
+	}
+	stored, err := cache.unpersistEntry(key)
+	if err != nil {
+		return err
+	}
+	filei, present := cache.cachedFiles.Get(key)
+	if !present {
+		return missingUnless(stored)
+	} else if info, err := os.Stat(path.Join(cache.rootPath, key)); err != nil || info.IsDir() {
+		return missingUnless(stored) // Directories can be in the map, but can't be deleted this way.
+	}
+	log.Info("Deleting entry %s", key)
+	if !cache.deleteFile(key, filei.(*cachedFile), audit.Manual) {
+		return missingUnless(stored) // Someone beat us to it.
+	}
+	return nil
+}
+
+// unpersistEntry deletes the single artifact with the given key from the storage backend.
+// It returns true if it was there.
+func (cache *Cache) unpersistEntry(key string) (bool, error) {
+	s := cache.currentStorage()
+	if s == nil {
+		return false, nil
+	}
+	entries, err := s.List(key)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Key == key {
+			return true, s.Delete(key)
+		}
+	}
+	return false, nil
+}
+
+// missingUnless returns os.ErrNotExist unless the given condition is true.
+func missingUnless(found bool) error {
+	if found {
+		return nil
+	}
+	return os.ErrNotExist
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestListEntries(t *testing.T) {
+	cache := newCache("test_list_entries")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash/file2", []byte("contents")))
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash/file1", []byte("more contents")))
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target2/hash/file", []byte("contents")))
+	require.NoError(t, cache.StoreMetadata("linux_amd64/pkg/target/hash", "host", "127.0.0.1", ""))
+
+	entries, err := cache.ListEntries("linux_amd64/pkg/target/", 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(entries), "Metadata isn't listed, nor the other target")
+	assert.Equal(t, "linux_amd64/pkg/target/hash/file1", entries[0].Key)
+	assert.EqualValues(t, 13, entries[0].Size)
+	assert.False(t, entries[0].LastRead.IsZero())
+	assert.Equal(t, "linux_amd64/pkg/target/hash/file2", entries[1].Key)
+
+	entries, err = cache.ListEntries("linux_amd64/pkg/target", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(entries), "A prefix doesn't have to end on a directory")
+	entries, err = cache.ListEntries("", 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	entries, err = cache.ListEntries("darwin_amd64/", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestDeleteEntry(t *testing.T) {
+	cache := newCache("test_delete_entry")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("contents")))
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash/file2", []byte("contents")))
+	assert.EqualValues(t, 16, cache.TotalSize())
+
+	require.NoError(t, cache.DeleteEntry("linux_amd64/pkg/target/hash/file"))
+	assert.False(t, cache.Contains("linux_amd64/pkg/target/hash/file"))
+	assert.True(t, cache.Contains("linux_amd64/pkg/target/hash/file2"), "It's not deleted just because it shares a prefix")
+	assert.EqualValues(t, 8, cache.TotalSize())
+	assert.Equal(t, 1, cache.NumFiles())
+	_, err := os.Stat(path.Join(cache.rootPath, "linux_amd64/pkg/target/hash/file"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.True(t, os.IsNotExist(cache.DeleteEntry("linux_amd64/pkg/target/hash/file")))
+	assert.True(t, os.IsNotExist(cache.DeleteEntry("linux_amd64/pkg/target/hash")), "Directories can't be deleted")
+}
+
+func TestReplicateDeleteEntries(t *testing.T) {
+	cache := newCache("test_replicate_delete_entries")
+	defer os.RemoveAll(cache.rootPath)
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("contents")))
+	require.NoError(t, cache.StoreArtifact("linux_amd64/pkg/target/hash/file2", []byte("contents")))
+	r := &RPCServer{cache: cache}
+	resp, err := r.Replicate(context.Background(), &pb.ReplicateRequest{
+		Delete: true,
+		Paths:  []string{"linux_amd64/pkg/target/hash/file", "linux_amd64/pkg/target/hash/nope"},
+	})
+	require.NoError(t, err)
+	assert.True(t, resp.Success, "It's fine if this node didn't have one of them")
+	assert.False(t, cache.Contains("linux_amd64/pkg/target/hash/file"))
+	assert.True(t, cache.Contains("linux_amd64/pkg/target/hash/file2"))
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+// CostWeights configure cost-aware eviction, which scores each file on how recently and how
+// often it's been read and how expensive it is to rebuild. The cleaner then removes the files
+// with the lowest score per byte first, rather than simply the least recently used ones.
+type CostWeights struct {
+	// HalfLife is the time it takes for a file's score to halve after it was last read.
+	HalfLife time.Duration
+	// Frequency weights the number of times the file has been read.
+	Frequency float64
+	// Cost weights the rebuild cost (in seconds) that was supplied when the file was stored.
+	Cost float64
+	// DefaultCost is the rebuild cost assumed for files that weren't given one.
+	DefaultCost float64
+}
+
+// score returns the score of a file at the given time. Higher scores are more valuable.
+func (w *CostWeights) score(file *cachedFile, now time.Time) float64 {
+	cost := file.cost
+	if cost <= 0 {
+		cost = w.DefaultCost
+	}
+	score := (1.0 + w.Frequency*float64(file.readCount)) * (1.0 + w.Cost*cost)
+	if w.HalfLife > 0 {
+		score *= math.Exp2(-float64(accessAge(file.lastReadTime, now)) / float64(w.HalfLife))
+	}
+	if file.size > 0 {
+		return score / float64(file.size)
+	}
+	return score
+}
+
+// scoredFiles sorts a set of files by their score, lowest first.
+type scoredFiles struct {
+	files  cachedFilePaths
+	scores []float64
+}
+
+// newScoredFiles scores the given files at the given time.
+func newScoredFiles(files cachedFilePaths, weights *CostWeights, now time.Time) *scoredFiles {
+	s := &scoredFiles{files: files, scores: make([]float64, len(files))}
+	for i, f := range files {
+		s.scores[i] = weights.score(f.file, now)
+	}
+	return s
+}
+
+func (s *scoredFiles) Len() int           { return len(s.files) }
+func (s *scoredFiles) Less(i, j int) bool { return s.scores[i] < s.scores[j] }
+func (s *scoredFiles) Swap(i, j int) {
+	s.files[i], s.files[j] = s.files[j], s.files[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
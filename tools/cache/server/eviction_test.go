@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScoreDecays(t *testing.T) {
+	w := &CostWeights{HalfLife: time.Hour, Frequency: 1, Cost: 1, DefaultCost: 1}
+	now := time.Now()
+	file := &cachedFile{lastReadTime: now, size: 100}
+	fresh := w.score(file, now)
+	assert.InDelta(t, fresh/2, w.score(file, now.Add(time.Hour)), 1e-9)
+	file.readCount = 3
+	assert.True(t, w.score(file, now) > fresh, "Frequently read files score higher")
+	file.cost = 100
+	assert.True(t, w.score(file, now) > fresh, "Expensive files score higher")
+}
+
+func TestScoreClampsFutureTimes(t *testing.T) {
+	w := &CostWeights{HalfLife: time.Hour, Frequency: 1, Cost: 1, DefaultCost: 1}
+	now := time.Now()
+	fresh := w.score(&cachedFile{lastReadTime: now, size: 100}, now)
+	// A file read "in the future" doesn't get an ever-growing score; it's just treated as fresh.
+	assert.InDelta(t, fresh, w.score(&cachedFile{lastReadTime: now.Add(24 * time.Hour), size: 100}, now), 1e-9)
+}
+
+// TestCostEvictionSimulation simulates a cache under pressure, containing a mix of cheap
+// artifacts that are read often and expensive ones that are read rarely, and compares how
+// many of the expensive ones survive under LRU versus cost-aware eviction.
+func TestCostEvictionSimulation(t *testing.T) {
+	lru := simulateEviction(nil)
+	cost := simulateEviction(&CostWeights{HalfLife: 24 * time.Hour, Frequency: 1, Cost: 1, DefaultCost: 1})
+	assert.Equal(t, 0, lru, "LRU evicts the expensive artifacts since they are read least recently")
+	assert.Equal(t, 10, cost, "Cost-aware eviction keeps all the expensive artifacts")
+}
+
+// simulateEviction fills a cache with artifacts, cleans it and returns the number of
+// expensive artifacts that remain.
+func simulateEviction(weights *CostWeights) int {
+	c := newCache("test_eviction_simulation")
+	c.costWeights = weights
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		// Cheap artifacts: one second to rebuild, last read within the last hour.
+		c.cachedFiles.Set(fmt.Sprintf("cheap/%d", i), &cachedFile{
+			lastReadTime: now.Add(-time.Duration(i) * time.Minute / 2),
+			readCount:    1,
+			size:         1000,
+			cost:         1,
+		})
+	}
+	for i := 0; i < 10; i++ {
+		// Expensive artifacts: ten minutes to rebuild, last read a couple of hours ago.
+		c.cachedFiles.Set(fmt.Sprintf("expensive/%d", i), &cachedFile{
+			lastReadTime: now.Add(-2*time.Hour - time.Duration(i)*time.Minute),
+			readCount:    1,
+			size:         1000,
+			cost:         600,
+		})
+	}
+	c.totalSize = 110 * 1000
+	// Clean down to half the size.
+	for _, f := range c.filesToClean(55 * 1000) {
+		c.removeFile(f.path, f.file)
+	}
+	remaining := 0
+	for i := 0; i < 10; i++ {
+		if _, present := c.cachedFiles.Get(fmt.Sprintf("expensive/%d", i)); present {
+			remaining++
+		}
+	}
+	return remaining
+}
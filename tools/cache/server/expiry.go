@@ -0,0 +1,174 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"core"
+	"tools/cache/audit"
+)
+
+// expiryFileName is the filename we store an artifact's expiry in, if it has one.
+//
+// Expiries are hard limits on how long artifacts can be served for, e.g. for compliance, as
+// opposed to the TTLs and ages that decide what to evict when we need space. They're given
+// by the client when storing artifacts, either as a time or as a TTL from when we receive them
+// (see storeExpiry); once one has passed, the artifacts are treated as
+// missing whatever the state of the cache, and the next clean removes them before anything else.
+const expiryFileName = ".plz_expiry"
+
+// An expiryIndex maps the directories of artifacts that have an expiry to that expiry.
+// It's rebuilt from the expiry files when the cache is scanned.
+type expiryIndex struct {
+	times map[string]time.Time
+	mutex sync.RWMutex
+}
+
+// set records that the artifact in the given directory expires at the given time.
+func (idx *expiryIndex) set(dir string, expiry time.Time) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if idx.times == nil {
+		idx.times = map[string]time.Time{}
+	}
+	idx.times[dir] = expiry
+}
+
+// get returns the expiry of the artifact in the given directory.
+func (idx *expiryIndex) get(dir string) (time.Time, bool) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	expiry, present := idx.times[dir]
+	return expiry, present
+}
+
+// remove removes the given directory from the index.
+func (idx *expiryIndex) remove(dir string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	delete(idx.times, dir)
+}
+
+// expired returns true if the given path, or any directory above it, has expired by the given time.
+// Artifacts can't be served from the moment they expire.
+func (idx *expiryIndex) expired(p string, now time.Time) bool {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	if len(idx.times) == 0 {
+		return false
+	}
+	for dir := path.Clean(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if expiry, present := idx.times[dir]; present {
+			return !now.Before(expiry)
+		}
+	}
+	return false
+}
+
+// takeExpired removes all the directories that have expired by the given time from the index and returns them.
+func (idx *expiryIndex) takeExpired(now time.Time) map[string]struct{} {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	dirs := map[string]struct{}{}
+	for dir, expiry := range idx.times {
+		if !now.Before(expiry) {
+			dirs[dir] = struct{}{}
+			delete(idx.times, dir)
+		}
+	}
+	return dirs
+}
+
+// reset removes everything from the index.
+func (idx *expiryIndex) reset() {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.times = nil
+}
+
+// StoreExpiry records the time after which the artifact in the given directory
+// (i.e. os_arch/package/target/hash) must no longer be served. A zero time removes any expiry
+// it had, so it's always the one given the last time the artifact was stored.
+// It should be called before storing the artifact, so there's no time it's served without it.
+func (cache *Cache) StoreExpiry(artPath string, expiry time.Time) error {
+	artPath = cache.normalize(artPath)
+	fullPath := path.Join(cache.rootPath, artPath, expiryFileName)
+	if expiry.IsZero() {
+		if _, present := cache.expiries.get(artPath); !present {
+			return nil
+		}
+		lock := cache.lockFile(artPath, true, 0)
+		defer lock.Unlock()
+		cache.expiries.remove(artPath)
+		if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+			log.Error("Could not remove expiry file: %s", err)
+			return err
+		}
+		return nil
+	}
+	lock := cache.lockFile(artPath, true, 0)
+	defer lock.Unlock()
+	if err := os.MkdirAll(path.Dir(fullPath), core.DirPermissions); err != nil {
+		log.Error("Could not create directory for expiry file: %s", err)
+		return err
+	} else if err := ioutil.WriteFile(fullPath, []byte(strconv.FormatInt(expiry.Unix(), 10)), 0644); err != nil {
+		log.Error("Could not write expiry file: %s", err)
+		return err
+	}
+	cache.expiries.set(artPath, expiry)
+	return nil
+}
+
+// storeExpiry returns the expiry to store artifacts with, in seconds since the Unix epoch, given
+// the expiry and TTL from a store of them received at the given time. That's whichever of the
+// two is earlier, or zero if neither is set.
+func storeExpiry(expiry int64, ttlSeconds int32, now time.Time) int64 {
+	if ttlSeconds <= 0 {
+		return expiry
+	} else if ttl := now.Add(time.Duration(ttlSeconds) * time.Second).Unix(); expiry <= 0 || ttl < expiry {
+		return ttl
+	}
+	return expiry
+}
+
+// readExpiry returns the expiry stored in the given directory, or the zero time if there isn't one.
+func (cache *Cache) readExpiry(artPath string) time.Time {
+	b, err := ioutil.ReadFile(path.Join(cache.rootPath, artPath, expiryFileName))
+	if err != nil {
+		return time.Time{}
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		log.Warning("Invalid expiry for %s, treating it as expired: %s", artPath, err)
+		return time.Unix(0, 0)
+	}
+	return time.Unix(secs, 0)
+}
+
+// ArtifactExpiry implements cluster.ArtifactSource to return the expiry of a set of artifacts
+// listed by ListArtifacts, in seconds since the Unix epoch, or zero if they don't have one.
+func (cache *Cache) ArtifactExpiry(key string) int64 {
+	if expiry, present := cache.expiries.get(key); present {
+		return expiry.Unix()
+	}
+	return 0
+}
+
+// cleanExpiredArtifacts removes any artifacts whose expiry has passed.
+// It returns the number of artifacts (i.e. directories) removed.
+func (cache *Cache) cleanExpiredArtifacts() int {
+	dirs := cache.expiries.takeExpired(cache.now())
+	if len(dirs) == 0 {
+		return 0
+	}
+	if err := cache.deleteDirs(dirs, audit.Expiry); err != nil {
+		log.Error("Failed to remove expired artifacts: %s", err)
+	}
+	log.Notice("Removed %d artifacts that had passed their expiry", len(dirs))
+	return len(dirs)
+}
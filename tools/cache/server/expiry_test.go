@@ -0,0 +1,181 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "cache/proto/rpc_cache"
+	"core"
+)
+
+func TestExpiryIndex(t *testing.T) {
+	idx := expiryIndex{}
+	expiry := time.Now().Add(time.Hour)
+	assert.False(t, idx.expired("linux_amd64/pkg/target/hash/file", expiry))
+	idx.set("linux_amd64/pkg/target/hash", expiry)
+	assert.False(t, idx.expired("linux_amd64/pkg/target/hash/file", expiry.Add(-time.Nanosecond)))
+	assert.True(t, idx.expired("linux_amd64/pkg/target/hash/file", expiry), "Expires exactly at its expiry")
+	assert.True(t, idx.expired("linux_amd64/pkg/target/hash/nested/file", expiry))
+	assert.True(t, idx.expired("linux_amd64/pkg/target/hash", expiry))
+	assert.False(t, idx.expired("linux_amd64/pkg/target/hash2/file", expiry))
+	assert.Equal(t, map[string]struct{}{}, idx.takeExpired(expiry.Add(-time.Nanosecond)))
+	assert.Equal(t, map[string]struct{}{"linux_amd64/pkg/target/hash": {}}, idx.takeExpired(expiry))
+	assert.False(t, idx.expired("linux_amd64/pkg/target/hash/file", expiry))
+}
+
+func TestRetrieveFailsAtExpiry(t *testing.T) {
+	const dir = "linux_amd64/pkg/target/hash"
+	const key = dir + "/file"
+	// There's plenty of space, so nothing would be evicted.
+	c := newCache("test_retrieve_fails_at_expiry")
+	c.highWaterMark = 1 << 30
+	clock := newFakeClock(time.Now())
+	c.SetClock(clock)
+	expiry := clock.Now().Add(time.Hour)
+	require.NoError(t, c.StoreExpiry(dir, expiry))
+	require.NoError(t, c.StoreArtifact(key, []byte("test")))
+	require.NoError(t, c.StoreMetadata(dir, "", "", ""))
+	_, err := c.RetrieveArtifact(key)
+	assert.NoError(t, err)
+	assert.True(t, c.Contains(key))
+
+	clock.Advance(time.Hour)
+	_, err = c.RetrieveArtifact(key)
+	assert.True(t, os.IsNotExist(err), "Expired artifacts are treated as missing")
+	_, err = c.RetrieveArtifact(dir)
+	assert.True(t, os.IsNotExist(err))
+	arts, err := c.RetrieveArtifact(dir + "/*")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(arts))
+	_, _, err = c.OpenArtifact(key)
+	assert.True(t, os.IsNotExist(err))
+	_, err = c.StatArtifact(key)
+	assert.True(t, os.IsNotExist(err))
+	_, err = c.LoadArtifacts(dir)
+	assert.True(t, os.IsNotExist(err))
+	assert.False(t, c.Contains(key))
+	assert.False(t, c.AboveHighWaterMark())
+
+	// It's still on disk until the cleaner gets to it, which it does regardless of the water marks.
+	assert.True(t, core.PathExists(path.Join(c.rootPath, key)))
+	assert.Equal(t, 1, c.cleanExpiredArtifacts())
+	assert.False(t, core.PathExists(path.Join(c.rootPath, key)))
+	assert.EqualValues(t, 0, c.TotalSize())
+	assert.Equal(t, 0, c.cleanExpiredArtifacts())
+}
+
+func TestExpirySurvivesRestart(t *testing.T) {
+	const dir = "linux_amd64/pkg/target/hash"
+	c := newCache("test_expiry_survives_restart")
+	expiry := time.Now().Add(time.Hour)
+	require.NoError(t, c.StoreExpiry(dir, expiry))
+	require.NoError(t, c.StoreArtifact(dir+"/file", []byte("test")))
+	c = newCache("test_expiry_survives_restart")
+	assert.Equal(t, expiry.Unix(), c.ArtifactExpiry(dir))
+	assert.True(t, c.Contains(dir+"/file"))
+	assert.True(t, c.expiries.expired(dir+"/file", time.Unix(expiry.Unix(), 0)))
+	assert.False(t, c.cachedFiles.Has(path.Join(dir, expiryFileName)), "The expiry file isn't itself an artifact")
+}
+
+func TestStoringAgainReplacesExpiry(t *testing.T) {
+	const dir = "linux_amd64/pkg/target/hash"
+	const key = dir + "/file"
+	c := newCache("test_storing_again_replaces_expiry")
+	require.NoError(t, c.StoreExpiry(dir, time.Now().Add(-time.Second)))
+	require.NoError(t, c.StoreArtifact(key, []byte("test")))
+	assert.False(t, c.Contains(key))
+	require.NoError(t, c.StoreExpiry(dir, time.Time{}))
+	assert.True(t, c.Contains(key))
+	assert.EqualValues(t, 0, c.ArtifactExpiry(dir))
+	assert.False(t, core.PathExists(path.Join(c.rootPath, dir, expiryFileName)))
+	assert.Equal(t, 0, c.cleanExpiredArtifacts())
+}
+
+func TestStoreWithExpiry(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_store_with_expiry")}
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour).Unix()
+	_, err := r.Store(ctx, &pb.StoreRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash"),
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "target", File: "file", Body: []byte("test")}},
+		Expiry:    expiry,
+	})
+	require.NoError(t, err)
+	req := &pb.RetrieveRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash"),
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "target", File: "file"}},
+	}
+	resp, err := r.Retrieve(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.Equal(t, expiry, resp.Expiry)
+
+	r.cache.expiries.set("linux_amd64/pkg/target/aGFzaA", time.Now())
+	resp, err = r.Retrieve(ctx, req)
+	assert.NoError(t, err)
+	assert.False(t, resp.Success)
+}
+
+func TestStoreWithTTL(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_store_with_ttl")}
+	defer os.RemoveAll(r.cache.rootPath)
+	ctx := context.Background()
+	req := &pb.StoreRequest{
+		Os:         "linux",
+		Arch:       "amd64",
+		Hash:       []byte("hash"),
+		Artifacts:  []*pb.Artifact{{Package: "pkg", Target: "target", File: "file", Body: []byte("test")}},
+		TtlSeconds: 60,
+	}
+	before := time.Now()
+	_, err := r.Store(ctx, req)
+	require.NoError(t, err)
+	expiry := r.cache.ArtifactExpiry("linux_amd64/pkg/target/aGFzaA")
+	assert.True(t, expiry >= before.Add(time.Minute).Unix() && expiry <= time.Now().Add(time.Minute).Unix())
+
+	req.TtlSeconds = -1
+	_, err = r.Store(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+}
+
+func TestStoreRetryWithDifferentTTL(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_store_retry_ttl"), stores: storeGroup{window: time.Minute}}
+	defer os.RemoveAll(r.cache.rootPath)
+	ctx := context.Background()
+	req := func(ttl int32) *pb.StoreRequest {
+		return &pb.StoreRequest{
+			Os:         "linux",
+			Arch:       "amd64",
+			Hash:       []byte("hash"),
+			Artifacts:  []*pb.Artifact{{Package: "pkg", Target: "target", File: "file", Body: []byte("test")}},
+			TtlSeconds: ttl,
+		}
+	}
+	_, err := r.Store(ctx, req(60))
+	require.NoError(t, err)
+	before := time.Now()
+	_, err = r.Store(ctx, req(3600))
+	require.NoError(t, err)
+	assert.True(t, r.cache.ArtifactExpiry("linux_amd64/pkg/target/aGFzaA") >= before.Add(time.Hour).Unix(), "The retry isn't merged into the first store")
+}
+
+func TestStoreExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	assert.EqualValues(t, 0, storeExpiry(0, 0, now), "Neither is set")
+	assert.EqualValues(t, 2000, storeExpiry(2000, 0, now))
+	assert.EqualValues(t, 1060, storeExpiry(0, 60, now))
+	assert.EqualValues(t, 1060, storeExpiry(2000, 60, now), "The TTL is earlier")
+	assert.EqualValues(t, 1030, storeExpiry(1030, 60, now), "The expiry is earlier")
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/base64"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// ListArtifacts implements cluster.ArtifactSource to list the sets of artifacts in the cache.
+// Each is found by the metadata file we write alongside them when they're stored; any that
+// don't have one (which should only be the case briefly after storing them) are skipped.
+func (cache *Cache) ListArtifacts(f func(os, arch string, hash []byte, key string)) {
+	layout := cache.Layout()
+	filepath.Walk(cache.rootPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != metadataFileName {
+			return nil
+		}
+		dir := path.Dir(name[len(cache.rootPath)+1:])
+		system, arch, _, _, hashStr, ok := layout.Parse(dir)
+		if !ok {
+			return nil
+		}
+		hash, err := base64.RawURLEncoding.DecodeString(hashStr)
+		if err != nil {
+			log.Warning("Invalid hash in artifact directory %s: %s", dir, err)
+			return nil
+		}
+		f(system, arch, hash, dir)
+		return nil
+	})
+}
+
+// SampleArtifacts implements cluster.ArtifactSampler to sample the files stored in the cache.
+// Each file's hash is found from the nearest directory above it with a metadata file; any
+// without one are skipped, like in ListArtifacts.
+func (cache *Cache) SampleArtifacts(n int, f func(hash []byte, path string)) {
+	for _, p := range cache.SamplePaths(n) {
+		// The file can be nested within the artifacts' directory, so work up until we find it.
+		for dir := path.Dir(p); strings.Count(dir, "/") >= 2; dir = path.Dir(dir) {
+			if _, err := os.Stat(path.Join(cache.rootPath, dir, metadataFileName)); err == nil {
+				if hash, err := base64.RawURLEncoding.DecodeString(path.Base(dir)); err == nil {
+					f(hash, p)
+				}
+				break
+			}
+		}
+	}
+}
+
+// LoadArtifacts implements cluster.ArtifactSource to load a set of artifacts listed by ListArtifacts.
+// They're read directly from disk so this doesn't count as them being read. Any that have passed
+// their expiry are treated as missing, so they're never re-replicated.
+func (cache *Cache) LoadArtifacts(key string) ([]*pb.Artifact, error) {
+	_, _, pkg, target, _, ok := cache.Layout().Parse(key)
+	if !ok || cache.expiries.expired(key, cache.now()) {
+		return nil, os.ErrNotExist
+	}
+	fullPath := path.Join(cache.rootPath, key)
+	ret := []*pb.Artifact{}
+	err := filepath.Walk(fullPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || isUntracked(info.Name()) {
+			return nil
+		}
+		body, err := cache.readArtifact(name)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, &pb.Artifact{Package: pkg, Target: target, File: name[len(fullPath)+1:], Body: body})
+		return nil
+	})
+	return ret, err
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/base64"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestListAndLoadArtifacts(t *testing.T) {
+	c := newCache("test_list_artifacts")
+	hash := []byte("hash")
+	dir := "linux_amd64/src/core/core/" + base64.RawURLEncoding.EncodeToString(hash)
+	assert.NoError(t, c.StoreArtifact(dir+"/core.a", []byte("archive")))
+	assert.NoError(t, c.StoreArtifact(dir+"/out/file.txt", []byte("file")))
+	assert.NoError(t, c.StoreMetadata(dir, "host", "127.0.0.1", ""))
+	// This one doesn't have metadata yet so isn't listed.
+	assert.NoError(t, c.StoreArtifact("linux_amd64/src/other/other/aGFzaA/other.a", []byte("other")))
+
+	listed := []string{}
+	c.ListArtifacts(func(os, arch string, h []byte, key string) {
+		assert.Equal(t, "linux", os)
+		assert.Equal(t, "amd64", arch)
+		assert.Equal(t, hash, h)
+		listed = append(listed, key)
+	})
+	assert.Equal(t, []string{dir}, listed)
+
+	artifacts, err := c.LoadArtifacts(dir)
+	assert.NoError(t, err)
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].File < artifacts[j].File })
+	assert.Equal(t, []*pb.Artifact{
+		{Package: "src/core", Target: "core", File: "core.a", Body: []byte("archive")},
+		{Package: "src/core", Target: "core", File: "out/file.txt", Body: []byte("file")},
+	}, artifacts)
+}
+
+func TestSampleArtifacts(t *testing.T) {
+	c := newCache("test_sample_artifacts")
+	hash := []byte("hash")
+	dir := "linux_amd64/src/core/core/" + base64.RawURLEncoding.EncodeToString(hash)
+	assert.NoError(t, c.StoreArtifact(dir+"/out/file.txt", []byte("file")))
+	assert.NoError(t, c.StoreMetadata(dir, "host", "127.0.0.1", ""))
+	assert.NoError(t, c.StoreArtifact("linux_amd64/src/other/other/aGFzaA/other.a", []byte("other")))
+
+	sampled := map[string][]byte{}
+	c.SampleArtifacts(10, func(h []byte, path string) {
+		sampled[path] = h
+	})
+	assert.Equal(t, map[string][]byte{dir + "/out/file.txt": hash}, sampled, "Files without metadata are skipped")
+}
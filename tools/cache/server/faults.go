@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A faultConfig describes the faults to inject into the RPC server for chaos testing.
+type faultConfig struct {
+	// ErrorFraction is the fraction of stores, retrieves & deletes that fail with Unavailable.
+	ErrorFraction float64
+	// Latency is added to every store, retrieve & delete.
+	Latency time.Duration
+	// DropReplicationFraction is the fraction of stores that aren't replicated to other nodes.
+	DropReplicationFraction float64
+}
+
+// String returns a human-readable description of the faults.
+func (f faultConfig) String() string {
+	return fmt.Sprintf("error_fraction=%v latency=%s drop_replication_fraction=%v", f.ErrorFraction, f.Latency, f.DropReplicationFraction)
+}
+
+// A FaultInjector injects faults into the RPC servers it's given to (see ServerOptions), for chaos
+// testing. It's also an HTTP handler to configure them, and a Prometheus collector counting those
+// it's injected.
+// Its methods are all safe to call on a nil FaultInjector, which never injects any.
+type FaultInjector struct {
+	faults   faultConfig
+	mutex    sync.Mutex
+	injected *prometheus.CounterVec
+}
+
+// NewFaultInjector returns a new FaultInjector. None are injected until they're configured through
+// its handler, which should only be served to admins: GET describes the current faults, POST sets
+// them from the error_fraction, latency and drop_replication_fraction query parameters (any not
+// given are turned off) and DELETE turns them all off again. This shouldn't be called unless
+// explicitly asked for, so faults can't be injected into a production server by accident.
+func NewFaultInjector() *FaultInjector {
+	log.Warning("Fault injection is enabled; this server can be made to fail deliberately")
+	return &FaultInjector{
+		injected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "injected_faults_total",
+			Help:      "Number of faults deliberately injected for chaos testing, by kind (error, latency or dropped_replication).",
+		}, []string{"kind"}),
+	}
+}
+
+// get returns the current faults.
+func (f *FaultInjector) get() faultConfig {
+	if f == nil {
+		return faultConfig{}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.faults
+}
+
+// set sets the current faults.
+func (f *FaultInjector) set(faults faultConfig) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = faults
+}
+
+// inject injects any latency and errors into an RPC. It returns the error the RPC should fail with, if any.
+func (f *FaultInjector) inject() error {
+	faults := f.get()
+	if faults.Latency > 0 {
+		f.injected.WithLabelValues("latency").Inc()
+		time.Sleep(faults.Latency)
+	}
+	if faults.ErrorFraction > 0 && rand.Float64() < faults.ErrorFraction {
+		f.injected.WithLabelValues("error").Inc()
+		return status.Errorf(codes.Unavailable, "Injected fault")
+	}
+	return nil
+}
+
+// dropReplication returns true if a store shouldn't be replicated to other nodes.
+func (f *FaultInjector) dropReplication() bool {
+	if faults := f.get(); faults.DropReplicationFraction > 0 && rand.Float64() < faults.DropReplicationFraction {
+		f.injected.WithLabelValues("dropped_replication").Inc()
+		return true
+	}
+	return false
+}
+
+// Describe implements the prometheus.Collector interface.
+func (f *FaultInjector) Describe(ch chan<- *prometheus.Desc) {
+	f.injected.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (f *FaultInjector) Collect(ch chan<- prometheus.Metric) {
+	f.injected.Collect(ch)
+}
+
+// ServeHTTP implements http.Handler to configure the faults.
+func (f *FaultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		f.set(faultConfig{})
+		log.Warning("Stopped injecting faults")
+	case http.MethodPost:
+		faults, err := parseFaults(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.set(faults)
+		log.Warning("Injecting faults: %s", faults)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "Faults: %s\n", f.get())
+}
+
+// faultsHandler handles a request to the gateway to describe or configure the faults, as for
+// ServeHTTP. Since they can take the whole cluster down, it needs a writable certificate.
+func (g *gateway) faultsHandler(w http.ResponseWriter, r *http.Request) {
+	if g.authorize(w, r, writable) {
+		g.faults.ServeHTTP(w, r)
+	}
+}
+
+// parseFaults parses the faults given in the query parameters of a request.
+func parseFaults(r *http.Request) (faultConfig, error) {
+	faults := faultConfig{}
+	q := r.URL.Query()
+	for _, param := range []struct {
+		name  string
+		value *float64
+	}{{"error_fraction", &faults.ErrorFraction}, {"drop_replication_fraction", &faults.DropReplicationFraction}} {
+		if s := q.Get(param.name); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil || f < 0 || f > 1 {
+				return faults, fmt.Errorf("%s must be between 0 and 1, was %s", param.name, s)
+			}
+			*param.value = f
+		}
+	}
+	if s := q.Get("latency"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return faults, fmt.Errorf("latency must be a non-negative duration (e.g. 200ms), was %s", s)
+		}
+		faults.Latency = d
+	}
+	return faults, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestNoFaultsByDefault(t *testing.T) {
+	var f *FaultInjector
+	assert.NoError(t, f.inject())
+	assert.False(t, f.dropReplication())
+	assert.NoError(t, NewFaultInjector().inject())
+	assert.False(t, NewFaultInjector().dropReplication())
+}
+
+func TestInjectErrors(t *testing.T) {
+	ctx := context.Background()
+	f := injectFaults(faultConfig{ErrorFraction: 1})
+	r := &RPCCacheServer{cache: newCache("test_inject_errors"), faults: f}
+	artifacts := []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a", Body: []byte("archive")}}
+	_, err := r.Store(ctx, &pb.StoreRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+	assert.Equal(t, codes.Unavailable, grpc.Code(err))
+	_, err = r.Retrieve(ctx, &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+	assert.Equal(t, codes.Unavailable, grpc.Code(err))
+	_, err = r.Delete(ctx, &pb.DeleteRequest{Os: "linux", Arch: "amd64", Artifacts: artifacts})
+	assert.Equal(t, codes.Unavailable, grpc.Code(err))
+
+	f.set(faultConfig{})
+	resp, err := r.Store(ctx, &pb.StoreRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+	require.NoError(t, err)
+	assert.True(t, resp.Success)
+}
+
+func TestInjectLatency(t *testing.T) {
+	f := injectFaults(faultConfig{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	assert.NoError(t, f.inject())
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestDropReplication(t *testing.T) {
+	f := injectFaults(faultConfig{DropReplicationFraction: 1})
+	assert.True(t, f.dropReplication())
+	assert.NoError(t, f.inject(), "Dropping replications doesn't fail anything")
+}
+
+func TestFaultsHandler(t *testing.T) {
+	f := NewFaultInjector()
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+	w := serve(http.MethodPost, "/faults?error_fraction=0.25&latency=200ms&drop_replication_fraction=0.5")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, faultConfig{ErrorFraction: 0.25, Latency: 200 * time.Millisecond, DropReplicationFraction: 0.5}, f.get())
+	w = serve(http.MethodGet, "/faults")
+	assert.Equal(t, "Faults: error_fraction=0.25 latency=200ms drop_replication_fraction=0.5\n", w.Body.String())
+
+	// Anything not given is turned off.
+	serve(http.MethodPost, "/faults?latency=1s")
+	assert.Equal(t, faultConfig{Latency: time.Second}, f.get())
+
+	for _, url := range []string{"/faults?error_fraction=2", "/faults?drop_replication_fraction=-1", "/faults?latency=wibble", "/faults?latency=-1s"} {
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, url).Code, url)
+	}
+	assert.Equal(t, faultConfig{Latency: time.Second}, f.get(), "Invalid requests don't change anything")
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/faults").Code)
+	assert.Equal(t, faultConfig{}, f.get())
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodPut, "/faults").Code)
+}
+
+// injectFaults returns a new FaultInjector injecting the given faults.
+func injectFaults(faults faultConfig) *FaultInjector {
+	f := NewFaultInjector()
+	f.set(faults)
+	return f
+}
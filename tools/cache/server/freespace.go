@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+)
+
+// freeSpace returns the number of bytes available on the filesystem containing the given path.
+// It's a variable so tests can replace it.
+var freeSpace = diskFreeSpace
+
+// SetFreeSpaceThresholds makes the cleaner keep the filesystem the cache is on from filling up,
+// for when it's shared with other data so the water marks alone don't reflect how full it is.
+// Once there are fewer than minFree bytes available it removes artifacts until there are
+// targetFree, the same way it does to get under the water marks. The two combine: each clean
+// removes as much as the more aggressive of them calls for. Zero minFree (the default) disables
+// this; targetFree is raised to minFree if it's smaller.
+func (cache *Cache) SetFreeSpaceThresholds(minFree, targetFree int64) {
+	if targetFree < minFree {
+		targetFree = minFree
+	}
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.minFreeSpace = minFree
+	cache.targetFreeSpace = targetFree
+}
+
+// waterMarks returns the low and high water marks to clean the cache to now. They're the given
+// ones, lowered to the cache sizes at which the filesystem would have the target and minimum free
+// space (see SetFreeSpaceThresholds) if those are smaller.
+func (cache *Cache) waterMarks(lowWaterMark, highWaterMark int64) (int64, int64) {
+	cache.scheduleMutex.Lock()
+	minFree, targetFree := cache.minFreeSpace, cache.targetFreeSpace
+	cache.scheduleMutex.Unlock()
+	if minFree <= 0 {
+		return lowWaterMark, highWaterMark
+	}
+	free, err := freeSpace(cache.rootPath)
+	if err != nil {
+		log.Warning("Failed to check free space on %s, cleaning to the water marks alone: %s", cache.rootPath, err)
+		return lowWaterMark, highWaterMark
+	}
+	size := atomic.LoadInt64(&cache.totalSize)
+	if high := size + free - minFree; high < highWaterMark {
+		highWaterMark = max64(high, 0)
+	}
+	if low := size + free - targetFree; low < lowWaterMark {
+		lowWaterMark = max64(low, 0)
+	}
+	if free < minFree {
+		log.Warning("Only %s free on %s, cleaning the cache down to %s to leave %s", humanize.Bytes(uint64(free)),
+			cache.rootPath, humanize.Bytes(uint64(lowWaterMark)), humanize.Bytes(uint64(targetFree)))
+	}
+	return lowWaterMark, highWaterMark
+}
+
+// max64 returns the larger of two integers.
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFreeSpaceCache returns a cache of 30 bytes of artifacts on a filesystem with the given free space.
+func newFreeSpaceCache(t *testing.T, name string, free int64) *Cache {
+	c := newCache(name)
+	for _, file := range []string{"a", "b", "c"} {
+		require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/aGFzaA/"+file, []byte("0123456789")))
+	}
+	freeSpace = func(path string) (int64, error) { return free, nil }
+	return c
+}
+
+func TestWaterMarks(t *testing.T) {
+	defer func() { freeSpace = diskFreeSpace }()
+	c := newFreeSpaceCache(t, "test_water_marks", 100)
+	defer os.RemoveAll(c.rootPath)
+	low, high := c.waterMarks(50, 100)
+	assert.EqualValues(t, 50, low, "Unchanged if there are no free space thresholds")
+	assert.EqualValues(t, 100, high)
+
+	c.SetFreeSpaceThresholds(50, 90)
+	low, high = c.waterMarks(50, 100)
+	assert.EqualValues(t, 40, low, "30 bytes of cache and 100 free leaves 90 free at 40 bytes")
+	assert.EqualValues(t, 80, high, "Whichever is lower wins")
+	low, high = c.waterMarks(20, 60)
+	assert.EqualValues(t, 20, low)
+	assert.EqualValues(t, 60, high)
+
+	c.SetFreeSpaceThresholds(200, 0)
+	low, high = c.waterMarks(50, 100)
+	assert.EqualValues(t, 0, low, "Never below zero, even if emptying the cache won't free enough")
+	assert.EqualValues(t, 0, high)
+
+	freeSpace = func(path string) (int64, error) { return 0, fmt.Errorf("no such filesystem") }
+	low, high = c.waterMarks(50, 100)
+	assert.EqualValues(t, 50, low, "Falls back to the water marks if it can't check")
+	assert.EqualValues(t, 100, high)
+}
+
+func TestFreeSpaceClean(t *testing.T) {
+	defer func() { freeSpace = diskFreeSpace }()
+	c := newFreeSpaceCache(t, "test_free_space_clean", 5)
+	defer os.RemoveAll(c.rootPath)
+	c.lowWaterMark = 100
+	c.highWaterMark = 200
+	c.maxArtifactAge = time.Hour
+	result, err := c.CleanNow()
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, result.FreedFiles, "Well under the water marks")
+
+	c.SetFreeSpaceThresholds(10, 20)
+	preview := c.PreviewClean()
+	assert.EqualValues(t, 15, preview.LowWaterMark)
+	assert.EqualValues(t, 25, preview.HighWaterMark)
+	assert.EqualValues(t, 20, preview.ReclaimedSize)
+	result, err = c.CleanNow()
+	require.NoError(t, err)
+	assert.EqualValues(t, 20, result.FreedBytes, "Cleans until there'd be 20 bytes free")
+	assert.EqualValues(t, 10, result.TotalSize)
+}
+
+func TestDiskFreeSpace(t *testing.T) {
+	free, err := diskFreeSpace(".")
+	assert.NoError(t, err)
+	assert.True(t, free > 0)
+	_, err = diskFreeSpace("/nonexistent/path")
+	assert.Error(t, err)
+}
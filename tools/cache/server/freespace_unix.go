@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import "syscall"
+
+// diskFreeSpace returns the number of bytes available to us on the filesystem containing the given path.
+func diskFreeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), nil
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getDiskFreeSpaceEx reports the free space of a filesystem; syscall doesn't wrap it.
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskFreeSpace returns the number of bytes available to us on the filesystem containing the given path.
+func diskFreeSpace(path string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free int64
+	if ret, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); ret == 0 {
+		return 0, err
+	}
+	return free, nil
+}
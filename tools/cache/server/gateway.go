@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+
+	"tools/cache/cluster"
+)
+
+// A gateway serves artifacts over plain HTTP, for clients that can't speak gRPC.
+// Artifacts are addressed by their path relative to the cache directory, e.g.
+// /artifact/linux_amd64/src/core/core/<hash>/core.a, and each request reads or writes one file.
+// Clients are authenticated against the same certificates as the gRPC server.
+type gateway struct {
+	server *RPCCacheServer
+	// faults, if set, are configured through /faults.
+	faults *FaultInjector
+	// restartTokenTTL is how long /restart holds the restart token for.
+	restartTokenTTL time.Duration
+}
+
+// BuildGateway returns an HTTP handler implementing a REST gateway to the given cache.
+// GET (and HEAD) retrieve a single artifact file, supporting Range requests and conditional
+// requests via its ETag (derived from its size and when it was stored) and Last-Modified time.
+// PUT stores one. Note that, unlike the gRPC Store RPC, stores aren't replicated to other nodes
+// since the path alone doesn't tell us which artifact the file belongs to.
+//
+// For debugging, GET /entries?prefix=<prefix>&limit=<n> lists the files whose keys start with the
+// prefix as JSON, with their sizes & last read times, and DELETE /entry/<key> deletes a single one
+// (e.g. a poisoned artifact). If the cluster is non-nil the delete is forwarded to the other nodes
+// too, unless local=true is passed. POST /clean cleans the cache immediately (see CleanNow) and
+// responds with what it removed as JSON. POST /readonly?enabled=true makes the cache refuse stores
+// until POST /readonly?enabled=false, optionally with a reason to give clients, and responds with
+// its mode as for /stats/mode. POST /maintenance?enabled=true or false puts the cache (and this
+// node of the cluster) into maintenance mode or takes it out, responding likewise. POST /restart
+// takes the cluster's restart token if it's safe for this node to restart, and DELETE /restart
+// releases it (see cluster.RequestRestart). If the options have a fault injector, /faults
+// configures it (see NewFaultInjector). Deleting, cleaning, changing the mode, restarting and
+// configuring faults need a writable certificate. The readonly and writable keys are as for
+// BuildGrpcServer; of the options, only the transfer budget, maximum artifact size, fault injector,
+// restart token TTL and key reload signals apply to the gateway.
+func BuildGateway(cache *Cache, cluster *cluster.Cluster, readonlyKeys, writableKeys string, opts ServerOptions) http.Handler {
+	r := &RPCCacheServer{cache: cache, cluster: cluster, budget: opts.TransferBudget, maxArtifactSize: opts.MaxArtifactSize}
+	r.initKeys(readonlyKeys, writableKeys, opts.KeyReloadSignals)
+	g := &gateway{server: r, faults: opts.Faults, restartTokenTTL: opts.RestartTokenTTL}
+	router := mux.NewRouter()
+	router.HandleFunc("/artifact/{key:.+}", g.getHandler).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/artifact/{key:.+}", g.putHandler).Methods(http.MethodPut)
+	router.HandleFunc("/entries", g.listHandler).Methods(http.MethodGet)
+	router.HandleFunc("/entry/{key:.+}", g.deleteHandler).Methods(http.MethodDelete)
+	router.HandleFunc("/clean", g.cleanHandler).Methods(http.MethodPost)
+	router.HandleFunc("/readonly", g.readOnlyHandler).Methods(http.MethodPost)
+	router.HandleFunc("/maintenance", g.maintenanceHandler).Methods(http.MethodPost)
+	router.HandleFunc("/restart", g.restartHandler).Methods(http.MethodPost, http.MethodDelete)
+	if opts.Faults != nil {
+		router.HandleFunc("/faults", g.faultsHandler)
+	}
+	return router
+}
+
+// getHandler handles retrieving a single artifact.
+func (g *gateway) getHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := g.authenticate(w, r, readonly)
+	if !ok {
+		return
+	} else if g.server.cache.InMaintenance() {
+		http.Error(w, "Server is in maintenance mode", http.StatusServiceUnavailable)
+		return
+	}
+	f, done, err := g.server.cache.OpenArtifact(key)
+	if os.IsNotExist(err) {
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Warning("Failed to retrieve artifact %s: %s", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer done()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag(info.Size(), info.ModTime()))
+	// Otherwise ServeContent guesses one from the file name, which isn't meaningful here.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// This handles Range, If-Range, If-None-Match etc. for us, and rewinds the file itself.
+	http.ServeContent(w, r, path.Base(key), info.ModTime(), f)
+}
+
+// putHandler handles storing a single artifact.
+func (g *gateway) putHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := g.authenticate(w, r, writable)
+	if !ok {
+		return
+	} else if reason := g.server.readOnlyReason(); reason != "" {
+		http.Error(w, readOnlyPrefix+reason, http.StatusPreconditionFailed)
+		return
+	}
+	limit := storeLimit(g.server.maxArtifactSize)
+	if r.ContentLength > limit {
+		tooLarge(w, g.server.cache.metrics.oversizedStores, key, limit)
+		return
+	}
+	// If the client doesn't say how big it is we have to assume the worst.
+	size := r.ContentLength
+	if size < 0 {
+		size = limit
+	}
+	release, err := g.server.budget.Acquire(r.Context(), size)
+	if err != nil {
+		http.Error(w, "Timed out waiting for memory to store artifact", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	body, ok, err := readArtifact(r.Body, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		tooLarge(w, g.server.cache.metrics.oversizedStores, key, limit)
+		return
+	} else if err := g.server.cache.StoreArtifact(key, body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info, err := os.Stat(path.Join(g.server.cache.rootPath, g.server.cache.normalize(key))); err == nil {
+		w.Header().Set("ETag", etag(int64(len(body)), info.ModTime()))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// etag returns the ETag of an artifact with the given size (once it's unsealed) that was stored
+// at the given time. Artifacts only change by being stored again, which changes the time, so
+// this identifies their contents without having to read them all to hash them on every request.
+func etag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, size, modTime.UnixNano())
+}
+
+// listHandler handles listing the entries in the cache.
+func (g *gateway) listHandler(w http.ResponseWriter, r *http.Request) {
+	if !g.authorize(w, r, readonly) {
+		return
+	}
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	// As for keys, cleaning it as an absolute path ensures it can't escape the cache directory.
+	prefix := r.URL.Query().Get("prefix")
+	if cleaned := path.Clean("/" + prefix)[1:]; strings.HasSuffix(prefix, "/") && cleaned != "" {
+		prefix = cleaned + "/"
+	} else {
+		prefix = cleaned
+	}
+	entries, err := g.server.cache.ListEntries(prefix, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// deleteHandler handles deleting a single entry from the cache.
+func (g *gateway) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := g.authenticate(w, r, writable)
+	if !ok {
+		return
+	} else if g.server.cache.InMaintenance() {
+		http.Error(w, "Server is in maintenance mode", http.StatusServiceUnavailable)
+		return
+	}
+	if err := g.server.cache.DeleteEntry(key); os.IsNotExist(err) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if local, _ := strconv.ParseBool(r.URL.Query().Get("local")); !local && g.server.cluster != nil {
+		// As for the Delete RPC this doesn't have to be done synchronously.
+		go g.server.cluster.DeleteEntries([]string{key})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticate checks the client's certificate and returns the artifact key from the request.
+// If either is invalid it writes an error response and returns false.
+func (g *gateway) authenticate(w http.ResponseWriter, r *http.Request, write bool) (string, bool) {
+	if !g.authorize(w, r, write) {
+		return "", false
+	}
+	// Cleaning it as an absolute path ensures it can't escape the cache directory.
+	key := path.Clean("/" + mux.Vars(r)["key"])[1:]
+	if key == "" || isUntracked(path.Base(key)) {
+		http.Error(w, "Invalid artifact key", http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+// authorize checks the client's certificate, if one is needed. If it's missing or invalid it
+// writes an error response and returns false.
+func (g *gateway) authorize(w http.ResponseWriter, r *http.Request, write bool) bool {
+	if g.server.authRequired(write) {
+		if r.TLS == nil {
+			http.Error(w, "Missing client certificate", http.StatusUnauthorized)
+			return false
+		} else if err := g.server.authenticateCerts(r.TLS.PeerCertificates, write); err != nil {
+			http.Error(w, grpc.ErrorDesc(err), http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
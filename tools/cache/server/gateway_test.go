@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	gatewayKey  = "src/cache/test_data/key.pem"
+	gatewayCert = "src/cache/test_data/cert_signed.pem"
+	otherCert   = "src/cache/test_data/cert.pem"
+)
+
+func gatewayRequest(h http.Handler, method, url string, body []byte, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, bytes.NewReader(body))
+	for i := 0; i < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestGatewayGetAndPut(t *testing.T) {
+	h := BuildGateway(newCache("test_gateway"), nil, "", "", ServerOptions{})
+	content := []byte("0123456789abcdefghij")
+	w := gatewayRequest(h, http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file.txt", content)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEqual(t, "", etag)
+
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Equal(t, "20", w.Header().Get("Content-Length"))
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.NotEqual(t, "", w.Header().Get("Last-Modified"))
+
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil, "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// Storing it again changes it, even if it's the same size.
+	time.Sleep(10 * time.Millisecond)
+	w = gatewayRequest(h, http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file.txt", []byte("abcdefghij0123456789"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil, "If-None-Match", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/nope.txt", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code, "Directories can't be retrieved")
+}
+
+func TestGatewayRange(t *testing.T) {
+	h := BuildGateway(newCache("test_gateway_range"), nil, "", "", ServerOptions{})
+	content := []byte("0123456789abcdefghij")
+	w := gatewayRequest(h, http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file.txt", content)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil, "Range", "bytes=10-14")
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "abcde", w.Body.String())
+	assert.Equal(t, "bytes 10-14/20", w.Header().Get("Content-Range"))
+
+	// Resuming from an offset, conditional on it not having changed.
+	etag := w.Header().Get("ETag")
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil, "Range", "bytes=15-", "If-Range", etag)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "fghij", w.Body.String())
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil, "Range", "bytes=15-", "If-Range", `"stale"`)
+	assert.Equal(t, http.StatusOK, w.Code, "Returns the whole thing if it's changed")
+	assert.Equal(t, content, w.Body.Bytes())
+
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil, "Range", "bytes=30-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
+
+func TestGatewayInvalidKey(t *testing.T) {
+	h := BuildGateway(newCache("test_gateway_invalid"), nil, "", "", ServerOptions{})
+	w := gatewayRequest(h, http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/.plz_metadata", []byte("hello"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGatewayAuth(t *testing.T) {
+	keyPair, err := tls.LoadX509KeyPair(gatewayCert, gatewayKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	require.NoError(t, err)
+	h := BuildGateway(newCache("test_gateway_auth"), nil, gatewayCert, otherCert, ServerOptions{})
+	request := func(method string, certs ...*x509.Certificate) int {
+		r := httptest.NewRequest(method, "/artifact/linux_amd64/pkg/target/hash/file.txt", bytes.NewReader([]byte("hello")))
+		if certs != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: certs}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet), "Fails because the client doesn't use TLS")
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPut, cert), "Fails because the client isn't allowed to write")
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, cert), "Authenticated, but it doesn't exist")
+}
+
+func TestGatewayMaintenance(t *testing.T) {
+	c := newCache("test_gateway_maintenance")
+	h := BuildGateway(c, nil, "", "", ServerOptions{})
+	c.SetMaintenance(true)
+	w := gatewayRequest(h, http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file.txt", []byte("hello"))
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, "cache read-only: maintenance mode\n", string(body))
+}
+
+func TestGatewayReadOnly(t *testing.T) {
+	c := newCache("test_gateway_read_only")
+	h := BuildGateway(c, nil, "", "", ServerOptions{})
+	c.SetReadOnly("configured read-only")
+	w := gatewayRequest(h, http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file.txt", []byte("hello"))
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, "cache read-only: configured read-only\n", string(body))
+	// It can still be read from, although it's not there of course.
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGatewayEntries(t *testing.T) {
+	c := newCache("test_gateway_entries")
+	h := BuildGateway(c, nil, "", "", ServerOptions{})
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file.txt", []byte("hello")))
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file2.txt", []byte("hello")))
+
+	w := gatewayRequest(h, http.MethodGet, "/entries?prefix=linux_amd64/pkg/target/hash/file.", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	entries := []Entry{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, "linux_amd64/pkg/target/hash/file.txt", entries[0].Key)
+	assert.EqualValues(t, 5, entries[0].Size)
+
+	w = gatewayRequest(h, http.MethodGet, "/entries?limit=wibble", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = gatewayRequest(h, http.MethodDelete, "/entry/linux_amd64/pkg/target/hash/file.txt", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.False(t, c.Contains("linux_amd64/pkg/target/hash/file.txt"))
+	assert.True(t, c.Contains("linux_amd64/pkg/target/hash/file2.txt"))
+	w = gatewayRequest(h, http.MethodDelete, "/entry/linux_amd64/pkg/target/hash/file.txt", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGatewayDeleteAuth(t *testing.T) {
+	keyPair, err := tls.LoadX509KeyPair(gatewayCert, gatewayKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	require.NoError(t, err)
+	c := newCache("test_gateway_delete_auth")
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file.txt", []byte("hello")))
+	h := BuildGateway(c, nil, gatewayCert, otherCert, ServerOptions{})
+	request := func(method, url string) int {
+		r := httptest.NewRequest(method, url, nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/entries"), "Listing only needs a readonly certificate")
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodDelete, "/entry/linux_amd64/pkg/target/hash/file.txt"), "Deleting needs a writable one")
+	assert.True(t, c.Contains("linux_amd64/pkg/target/hash/file.txt"))
+}
+
+func TestGatewayFaultsAuth(t *testing.T) {
+	keyPair, err := tls.LoadX509KeyPair(gatewayCert, gatewayKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	require.NoError(t, err)
+	f := NewFaultInjector()
+	h := BuildGateway(newCache("test_gateway_faults_auth"), nil, gatewayCert, otherCert, ServerOptions{Faults: f})
+	request := func(method string, certs ...*x509.Certificate) int {
+		r := httptest.NewRequest(method, "/faults?error_fraction=1", nil)
+		if certs != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: certs}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost), "Fails because the client doesn't use TLS")
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, cert), "Fails because the client isn't allowed to write")
+	assert.Equal(t, faultConfig{}, f.get(), "Neither should have injected any faults")
+
+	h = BuildGateway(newCache("test_gateway_no_faults"), nil, "", "", ServerOptions{})
+	assert.Equal(t, http.StatusNotFound, gatewayRequest(h, http.MethodPost, "/faults?error_fraction=1", nil).Code, "Isn't served unless fault injection is enabled")
+}
+
+func TestGatewayMaintenanceAuth(t *testing.T) {
+	keyPair, err := tls.LoadX509KeyPair(gatewayCert, gatewayKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	require.NoError(t, err)
+	c := newCache("test_gateway_maintenance_auth")
+	h := BuildGateway(c, nil, gatewayCert, otherCert, ServerOptions{})
+	request := func(certs ...*x509.Certificate) int {
+		r := httptest.NewRequest(http.MethodPost, "/maintenance?enabled=true", nil)
+		if certs != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: certs}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, request(), "Fails because the client doesn't use TLS")
+	assert.Equal(t, http.StatusUnauthorized, request(cert), "Fails because the client isn't allowed to write")
+	assert.False(t, c.InMaintenance())
+}
+
+func TestGatewayRestart(t *testing.T) {
+	keyPair, err := tls.LoadX509KeyPair(gatewayCert, gatewayKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	require.NoError(t, err)
+	h := BuildGateway(newCache("test_gateway_restart"), nil, gatewayCert, otherCert, ServerOptions{RestartTokenTTL: time.Minute})
+	request := func(method string, certs ...*x509.Certificate) int {
+		r := httptest.NewRequest(method, "/restart", nil)
+		if certs != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: certs}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost), "Fails because the client doesn't use TLS")
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, cert), "Fails because the client isn't allowed to write")
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodDelete, cert), "Releasing the token needs a writable certificate too")
+
+	h = BuildGateway(newCache("test_gateway_restart_unclustered"), nil, "", "", ServerOptions{})
+	w := gatewayRequest(h, http.MethodPost, "/restart", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Always safe when not clustered")
+	assert.Equal(t, "Safe to restart\n", w.Body.String())
+	assert.Equal(t, http.StatusOK, gatewayRequest(h, http.MethodDelete, "/restart", nil).Code)
+}
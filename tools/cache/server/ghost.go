@@ -0,0 +1,118 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A ghostCache remembers the paths and sizes (but not the contents) of the files most recently
+// evicted to make space, so we can tell how often a miss would have been a hit if we hadn't had
+// to evict them, i.e. how much a bigger cache would help.
+// Its methods are all safe to call on a nil ghostCache, which remembers nothing.
+type ghostCache struct {
+	max     int
+	entries map[string]*list.Element
+	// order has the most recently evicted files at the front.
+	order *list.List
+	// gauge reports the number of files remembered.
+	gauge prometheus.Gauge
+	mutex sync.Mutex
+}
+
+// A ghostEntry is a single evicted file.
+type ghostEntry struct {
+	path string
+	size int64
+}
+
+// newGhostCache returns a new ghost cache remembering up to the given number of files,
+// which reports how many it has in the given gauge.
+func newGhostCache(max int, gauge prometheus.Gauge) *ghostCache {
+	return &ghostCache{max: max, entries: map[string]*list.Element{}, order: list.New(), gauge: gauge}
+}
+
+// add records that the given file has been evicted, forgetting the oldest if we're full.
+func (g *ghostCache) add(p string, size int64) {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if e, present := g.entries[p]; present {
+		e.Value.(*ghostEntry).size = size
+		g.order.MoveToFront(e)
+		return
+	}
+	g.entries[p] = g.order.PushFront(&ghostEntry{path: p, size: size})
+	for g.order.Len() > g.max {
+		oldest := g.order.Back()
+		g.order.Remove(oldest)
+		delete(g.entries, oldest.Value.(*ghostEntry).path)
+	}
+	g.gauge.Set(float64(g.order.Len()))
+}
+
+// take removes the given file, returning its size and true if it was there.
+// Each eviction is only counted once, however many times the file is missed afterwards.
+func (g *ghostCache) take(p string) (int64, bool) {
+	if g == nil {
+		return 0, false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	e, present := g.entries[p]
+	if !present {
+		return 0, false
+	}
+	g.order.Remove(e)
+	delete(g.entries, p)
+	g.gauge.Set(float64(g.order.Len()))
+	return e.Value.(*ghostEntry).size, true
+}
+
+// len returns the number of files currently remembered.
+func (g *ghostCache) len() int {
+	if g == nil {
+		return 0
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.order.Len()
+}
+
+// SetGhostCacheSize enables a ghost cache of the given number of the most recently evicted
+// files, which counts retrieves that miss for them in the plz_cache_ghost_hits_total metric and
+// as ghost_hits in the stats. Only files evicted to get under the high water mark are remembered,
+// so it estimates how many more hits a bigger cache would get. Zero disables it, which is the default.
+func (cache *Cache) SetGhostCacheSize(size int) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	if size <= 0 {
+		cache.ghosts = nil
+	} else {
+		cache.ghosts = newGhostCache(size, cache.metrics.ghostEntries)
+	}
+}
+
+// currentGhosts returns the current ghost cache, which is nil if there isn't one.
+func (cache *Cache) currentGhosts() *ghostCache {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.ghosts
+}
+
+// recordMiss records a retrieve that missed, and checks it against the ghost cache.
+func (cache *Cache) recordMiss(p string) {
+	cache.metrics.misses.Inc()
+	if size, present := cache.currentGhosts().take(p); present {
+		log.Debug("Miss for %s, which we evicted to make space", p)
+		cache.metrics.ghostHits.Inc()
+		cache.metrics.ghostHitBytes.Add(float64(size))
+		cache.stats.record(p, func(s *cacheStats) {
+			s.GhostHits++
+			s.GhostHitBytes += size
+		})
+	}
+}
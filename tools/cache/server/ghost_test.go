@@ -0,0 +1,65 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tools/cache/audit"
+)
+
+func TestGhostCache(t *testing.T) {
+	g := newGhostCache(2, newCacheMetrics().ghostEntries)
+	g.add("a", 1)
+	g.add("b", 2)
+	g.add("a", 3) // Evicting it again makes it the most recent.
+	g.add("c", 4)
+	assert.Equal(t, 2, g.len())
+	_, present := g.take("b")
+	assert.False(t, present, "b was the oldest so should have been forgotten")
+	size, present := g.take("a")
+	assert.True(t, present)
+	assert.EqualValues(t, 3, size)
+	_, present = g.take("a")
+	assert.False(t, present, "Each eviction is only counted once")
+	assert.Equal(t, 1, g.len())
+}
+
+func TestNilGhostCache(t *testing.T) {
+	var g *ghostCache
+	g.add("a", 1)
+	_, present := g.take("a")
+	assert.False(t, present)
+	assert.Equal(t, 0, g.len())
+}
+
+func TestGhostHits(t *testing.T) {
+	const key = "linux_amd64/pkg/target/hash/file"
+	c := newCache("test_ghost_hits")
+	c.SetGhostCacheSize(10)
+	require.NoError(t, c.StoreArtifact(key, []byte("test")))
+	require.NoError(t, c.StoreArtifact(key+"2", []byte("test2")))
+	require.NoError(t, c.StoreArtifact(key+"3", []byte("test3")))
+	assert.True(t, c.singleClean(0, 1))
+	assert.Equal(t, 3, c.ghosts.len())
+
+	_, err := c.RetrieveArtifact(key)
+	assert.True(t, os.IsNotExist(err))
+	_, err = c.RetrieveArtifact(key)
+	assert.True(t, os.IsNotExist(err))
+	_, err = c.RetrieveArtifact("linux_amd64/pkg/target/hash/never_stored")
+	assert.True(t, os.IsNotExist(err))
+	assert.EqualValues(t, 1, c.stats.total.GhostHits)
+	assert.EqualValues(t, 4, c.stats.total.GhostHitBytes)
+	assert.EqualValues(t, 1, c.stats.namespaces["linux_amd64/pkg"].GhostHits)
+
+	// Files removed for other reasons aren't remembered, since more space wouldn't have kept them.
+	require.NoError(t, c.StoreArtifact(key, []byte("test")))
+	f, _ := c.cachedFiles.Get(key)
+	assert.True(t, c.evictFile(key, f.(*cachedFile), f.(*cachedFile).storedTime, audit.Age))
+	_, err = c.RetrieveArtifact(key)
+	assert.True(t, os.IsNotExist(err))
+	assert.EqualValues(t, 1, c.stats.total.GhostHits)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+)
+
+// A Readiness decides whether the server is ready to receive traffic, for liveness and readiness
+// probes (e.g. from Kubernetes). It's ready once all of its checks pass; the zero value has none,
+// so is ready immediately. It's safe to add checks while it's being served.
+type Readiness struct {
+	checks []func() string
+	mutex  sync.RWMutex
+}
+
+// AddCheck adds a check to the readiness, which returns why the server isn't ready yet or the
+// empty string if it is. Checks are run in the order they were added, on every readiness probe,
+// so they should be cheap.
+func (r *Readiness) AddCheck(check func() string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.checks = append(r.checks, check)
+}
+
+// Pending adds a check that fails with the given reason until the returned function is called,
+// for things that happen once at startup (e.g. scanning the cache directory).
+func (r *Readiness) Pending(reason string) func() {
+	var mutex sync.Mutex
+	done := false
+	r.AddCheck(func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if done {
+			return ""
+		}
+		return reason
+	})
+	return func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		done = true
+	}
+}
+
+// NotReadyReason returns the reason given by the first failing check, or the empty string if
+// they all pass.
+func (r *Readiness) NotReadyReason() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, check := range r.checks {
+		if reason := check(); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// Handler returns an HTTP handler for probes of the server's health.
+// GET /healthz (for liveness) always succeeds, since being able to answer it means the process
+// is up. GET /readyz (for readiness) only succeeds once all the checks pass; otherwise it
+// returns 503 with the reason, so it shows up in the probe's logs.
+func (r *Readiness) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if reason := r.NotReadyReason(); reason != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Not ready: " + reason + "\n"))
+			return
+		}
+		w.Write([]byte("Ready\n"))
+	})
+	return mux
+}
+
+// NotReadyReason returns why the cache isn't ready to receive traffic, or the empty string if
+// it is, for use as a check of a Readiness.
+func (cache *Cache) NotReadyReason() string {
+	if cache.InMaintenance() {
+		return "in maintenance mode"
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// probe sends a GET request to a health handler and returns its response.
+func probe(h http.Handler, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	return w
+}
+
+func TestReadiness(t *testing.T) {
+	r := &Readiness{}
+	h := r.Handler()
+	assert.Equal(t, http.StatusOK, probe(h, "/readyz").Code, "Ready with no checks")
+
+	scanned := r.Pending("scanning cache directory")
+	joined := r.Pending("joining cluster")
+	w := probe(h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Not ready: scanning cache directory\n", w.Body.String())
+	assert.Equal(t, http.StatusOK, probe(h, "/healthz").Code, "Live even when not ready")
+
+	scanned()
+	w = probe(h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Not ready: joining cluster\n", w.Body.String())
+
+	joined()
+	w = probe(h, "/readyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Ready\n", w.Body.String())
+	assert.Equal(t, "", r.NotReadyReason())
+}
+
+func TestReadinessInMaintenance(t *testing.T) {
+	c := newCache("test_readiness_in_maintenance")
+	defer os.RemoveAll(c.rootPath)
+	r := &Readiness{}
+	r.AddCheck(c.NotReadyReason)
+	h := r.Handler()
+	assert.Equal(t, http.StatusOK, probe(h, "/readyz").Code)
+	c.SetMaintenance(true)
+	w := probe(h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Not ready: in maintenance mode\n", w.Body.String())
+	assert.Equal(t, http.StatusOK, probe(h, "/healthz").Code)
+	c.SetMaintenance(false)
+	assert.Equal(t, http.StatusOK, probe(h, "/readyz").Code)
+}
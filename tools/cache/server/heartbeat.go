@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"tools/cache/cluster"
+)
+
+// heartbeatAttempts is the number of times we try to send each heartbeat.
+const heartbeatAttempts = 3
+
+// heartbeatRetryDelay is how long we wait before the first retry of a heartbeat; it doubles for each one after.
+var heartbeatRetryDelay = time.Second
+
+// A heartbeat is the payload we send to the monitor.
+type heartbeat struct {
+	Node        string            `json:"node"`
+	Uptime      float64           `json:"uptime_seconds"`
+	Size        int64             `json:"cache_size_bytes"`
+	NumFiles    int               `json:"num_files"`
+	Maintenance bool              `json:"maintenance"`
+	ReadOnly    string            `json:"read_only,omitempty"`
+	Cluster     *heartbeatCluster `json:"cluster,omitempty"`
+}
+
+// A heartbeatCluster describes the state of the cluster, if we're in one.
+type heartbeatCluster struct {
+	Members  int    `json:"members"`
+	Expected int    `json:"expected"`
+	ReadOnly string `json:"read_only,omitempty"`
+}
+
+// A heartbeater sends heartbeats to an external monitor.
+type heartbeater struct {
+	url     string
+	cache   *Cache
+	cluster *cluster.Cluster
+	client  *http.Client
+	node    string
+	start   time.Time
+}
+
+// StartHeartbeat starts POSTing a small JSON description of this server's health to the given
+// URL at the given interval, for monitors that alert when they stop hearing from it.
+// Failures are retried a few times, but it's all done in the background so it never holds up
+// serving; a heartbeat that's still being sent when the next is due means that one's skipped.
+// The cluster can be nil if the server isn't in one.
+func StartHeartbeat(url string, interval time.Duration, cache *Cache, clu *cluster.Cluster) {
+	h := newHeartbeater(url, interval, cache, clu)
+	log.Notice("Sending heartbeats to %s every %s", url, interval)
+	go h.run(interval)
+}
+
+// newHeartbeater creates a new heartbeater. Each request is given the interval to complete in.
+func newHeartbeater(url string, interval time.Duration, cache *Cache, clu *cluster.Cluster) *heartbeater {
+	h := &heartbeater{
+		url:     url,
+		cache:   cache,
+		cluster: clu,
+		client:  &http.Client{Timeout: interval},
+		start:   time.Now(),
+	}
+	if clu != nil && clu.LocalNode() != nil {
+		h.node = clu.LocalNode().Name
+	} else if hostname, err := os.Hostname(); err == nil {
+		h.node = hostname
+	}
+	return h
+}
+
+// run sends heartbeats forever.
+func (h *heartbeater) run(interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		h.send()
+	}
+}
+
+// send sends a single heartbeat, retrying it if that fails. It returns true if it was sent.
+func (h *heartbeater) send() bool {
+	b, err := json.Marshal(h.payload())
+	if err != nil {
+		log.Error("Failed to encode heartbeat: %s", err)
+		return false
+	}
+	delay := heartbeatRetryDelay
+	for i := 1; ; i++ {
+		err := h.post(b)
+		if err == nil {
+			return true
+		} else if i >= heartbeatAttempts {
+			log.Warning("Failed to send heartbeat to %s: %s", h.url, err)
+			h.cache.metrics.heartbeatFailures.Inc()
+			return false
+		}
+		log.Debug("Failed to send heartbeat to %s, will retry: %s", h.url, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes a single attempt to send a heartbeat.
+func (h *heartbeater) post(body []byte) error {
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+// payload returns the current heartbeat payload.
+func (h *heartbeater) payload() *heartbeat {
+	hb := &heartbeat{
+		Node:        h.node,
+		Uptime:      time.Since(h.start).Seconds(),
+		Size:        h.cache.TotalSize(),
+		NumFiles:    h.cache.NumFiles(),
+		Maintenance: h.cache.InMaintenance(),
+		ReadOnly:    h.cache.ReadOnlyReason(),
+	}
+	if h.cluster != nil {
+		members, expected := h.cluster.MemberCount()
+		hb.Cluster = &heartbeatCluster{
+			Members:  members,
+			Expected: expected,
+			ReadOnly: h.cluster.ReadOnlyReason(),
+		}
+	}
+	return hb
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	heartbeatRetryDelay = time.Millisecond
+	c := newCache("test_heartbeat")
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("test")))
+	requests := 0
+	var received heartbeat
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer s.Close()
+	h := newHeartbeater(s.URL, time.Second, c, nil)
+	assert.True(t, h.send())
+	assert.Equal(t, 2, requests, "The first attempt fails and is retried")
+	assert.NotEqual(t, "", received.Node)
+	assert.EqualValues(t, 4, received.Size)
+	assert.Equal(t, 1, received.NumFiles)
+	assert.Nil(t, received.Cluster)
+}
+
+func TestHeartbeatGivesUp(t *testing.T) {
+	heartbeatRetryDelay = time.Millisecond
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer s.Close()
+	h := newHeartbeater(s.URL, time.Second, newCache("test_heartbeat_gives_up"), nil)
+	assert.False(t, h.send())
+	assert.Equal(t, heartbeatAttempts, requests)
+}
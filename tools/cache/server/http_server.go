@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -14,12 +14,20 @@ import (
 
 	"github.com/gorilla/mux"
 	"gopkg.in/op/go-logging.v1"
+
+	"cli"
 )
 
 var log = logging.MustGetLogger("server")
 
+// readOnlyPrefix prefixes the message sent to clients for stores refused because we're read-only.
+// Over RPC they're FailedPrecondition errors; over HTTP they're 412 Precondition Failed.
+const readOnlyPrefix = "cache read-only: "
+
 type httpServer struct {
 	cache *Cache
+	// maxArtifactSize is the largest artifact we store (see ServerOptions), or zero for no limit.
+	maxArtifactSize int64
 }
 
 // The pingHandler will return a 200 Accepted status
@@ -32,16 +40,16 @@ func (s *httpServer) pingHandler(w http.ResponseWriter, r *http.Request) {
 // It calls the RetrieveArtifact function, and then either returns the found artifact, or logs the error
 // returned by RetrieveArtifact.
 func (s *httpServer) getHandler(w http.ResponseWriter, r *http.Request) {
-	log.Debug("GET %s", r.URL.Path)
 	artifactPath := strings.TrimPrefix(r.URL.Path, "/artifact/")
+	log.Debug("GET %s from %s", cli.Field("key", artifactPath), cli.Field("client", httpClientIdentity(r)))
 
 	art, err := s.cache.RetrieveArtifact(artifactPath)
 	if err != nil && os.IsNotExist(err) {
 		w.WriteHeader(http.StatusNotFound)
-		log.Debug("%s doesn't exist in http cache", artifactPath)
+		log.Debug("%s doesn't exist in http cache", cli.Field("key", artifactPath))
 		return
 	} else if err != nil {
-		log.Errorf("Failed to retrieve artifact %s: %s", artifactPath, err)
+		log.Errorf("Failed to retrieve artifact %s: %s", cli.Field("key", artifactPath), err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -70,10 +78,20 @@ func (s *httpServer) getHandler(w http.ResponseWriter, r *http.Request) {
 // be stored.
 // The handler will either return an error or display a message confirming the file has been created.
 func (s *httpServer) postHandler(w http.ResponseWriter, r *http.Request) {
-	log.Debug("POST %s", r.URL.Path)
-	artifact, err := ioutil.ReadAll(r.Body)
+	key := strings.TrimPrefix(r.URL.Path, "/artifact/")
+	log.Debug("POST %s from %s", cli.Field("key", key), cli.Field("client", httpClientIdentity(r)))
+	if reason := s.cache.ReadOnlyReason(); reason != "" {
+		http.Error(w, readOnlyPrefix+reason, http.StatusPreconditionFailed)
+		return
+	} else if limit := s.maxArtifactSize; limit > 0 && r.ContentLength > limit {
+		tooLarge(w, s.cache.metrics.oversizedStores, key, limit)
+		return
+	}
+	artifact, ok, err := readArtifact(r.Body, s.maxArtifactSize)
 	filePath, fileName := path.Split(strings.TrimPrefix(r.URL.Path, "/artifact"))
-	if err == nil {
+	if err == nil && !ok {
+		tooLarge(w, s.cache.metrics.oversizedStores, key, s.maxArtifactSize)
+	} else if err == nil {
 		if err := s.cache.StoreArtifact(strings.TrimPrefix(r.URL.Path, "/artifact"), artifact); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Errorf("Failed to store artifact %s: %s", fileName, err)
@@ -115,10 +133,20 @@ func (s *httpServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s artifact was removed from cache.", artifactPath)
 }
 
+// httpClientIdentity returns the identity of the client making the given request, for logging:
+// its IP address.
+func httpClientIdentity(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 // BuildRouter creates a router, sets the base FileServer directory and the Handler Functions
-// for each endpoint, and then returns the router.
-func BuildRouter(cache *Cache) *mux.Router {
-	s := &httpServer{cache: cache}
+// for each endpoint, and then returns the router. Of the options, only the maximum artifact size
+// applies to it.
+func BuildRouter(cache *Cache, opts ServerOptions) *mux.Router {
+	s := &httpServer{cache: cache, maxArtifactSize: opts.MaxArtifactSize}
 	r := mux.NewRouter()
 	r.HandleFunc("/ping", s.pingHandler).Methods("GET")
 	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", s.getHandler).Methods("GET")
@@ -24,7 +24,7 @@ const cachePath = "tools/cache/server/test_data"
 
 func init() {
 	c := newCache(cachePath)
-	server = httptest.NewServer(BuildRouter(c))
+	server = httptest.NewServer(BuildRouter(c, ServerOptions{}))
 	realURL = fmt.Sprintf("%s/artifact/darwin_amd64/pack/label/hash/label.ext", server.URL)
 	otherRealURL = fmt.Sprintf("%s/artifact/linux_amd64/otherpack/label/hash/label.ext", server.URL)
 	extraRealURL = fmt.Sprintf("%s/artifact/extrapack/label", server.URL)
@@ -72,6 +72,20 @@ func TestPostHandler(t *testing.T) {
 	}
 }
 
+func TestPostHandlerReadOnly(t *testing.T) {
+	c := newCache("test_post_read_only")
+	c.SetReadOnly("configured read-only")
+	s := httptest.NewServer(BuildRouter(c, ServerOptions{}))
+	defer s.Close()
+	res, err := http.Post(s.URL+"/artifact/darwin_amd64/somepack/somelabel/somehash/somelabel.ext", "application/octet-stream", strings.NewReader("contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Error("Expected response Status Precondition Failed, got:", res.Status)
+	}
+}
+
 func TestDeleteHandler(t *testing.T) {
 	request, _ := http.NewRequest("DELETE", extraRealURL, reader)
 	res, err := http.DefaultClient.Do(request)
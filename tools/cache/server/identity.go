@@ -0,0 +1,34 @@
+package server
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Keys of the response headers that identify the server that handled a request.
+const (
+	nodeHeader    = "plz-cache-node"
+	versionHeader = "plz-cache-version"
+	zoneHeader    = "plz-cache-zone"
+)
+
+// identityHeaders returns the headers identifying the server with the given node name, version
+// and zone. Any of them can be empty, in which case it's left out.
+func identityHeaders(node, version, zone string) metadata.MD {
+	md := metadata.MD{}
+	for k, v := range map[string]string{nodeHeader: node, versionHeader: version, zoneHeader: zone} {
+		if v != "" {
+			md[k] = []string{v}
+		}
+	}
+	return md
+}
+
+// sendIdentity sends our identity in the response headers of the call with the given context.
+func (r *RPCCacheServer) sendIdentity(ctx context.Context) {
+	if r.identity.Len() > 0 {
+		// This only fails if there's no call to send headers on (e.g. from the REST gateway).
+		grpc.SetHeader(ctx, r.identity)
+	}
+}
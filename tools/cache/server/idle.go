@@ -0,0 +1,140 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/stats"
+)
+
+var (
+	// connectionAgeDesc describes the ages of the connections that are currently open.
+	connectionAgeDesc = prometheus.NewDesc("plz_cache_connection_age_seconds", "Ages of the client connections currently open.", nil, nil)
+	// connectionAgeBuckets are the buckets of the connection age histogram; they go up to a week
+	// since connections from long-lived clients can last about that long.
+	connectionAgeBuckets = []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 3 * 24 * 3600, 7 * 24 * 3600}
+)
+
+// A connectionTracker is a gRPC stats handler that tracks the open connections and when they
+// last had any RPCs, so we can report their ages and spot the ones closed for being idle.
+// It's also a Prometheus collector reporting the ages of the connections open at the time, and
+// how many have been closed for being idle.
+type connectionTracker struct {
+	conns map[*trackedConn]struct{}
+	mutex sync.Mutex
+	// reaped is the number of connections we've closed because they were idle.
+	reaped prometheus.Counter
+	// maxIdle is how long connections can be idle before the server closes them; zero means never.
+	maxIdle time.Duration
+}
+
+// A trackedConn is a single connection tracked by a connectionTracker.
+type trackedConn struct {
+	start, lastActive time.Time
+	// active is the number of RPCs in progress on it.
+	active int
+}
+
+// trackedConnKey is the context key of a trackedConn.
+type trackedConnKey struct{}
+
+// newConnectionTracker returns a new connectionTracker for a server that closes connections
+// after they've been idle for the given duration (see ServerOptions.MaxConnectionIdle).
+func newConnectionTracker(maxIdle time.Duration) *connectionTracker {
+	return &connectionTracker{
+		conns:   map[*trackedConn]struct{}{},
+		maxIdle: maxIdle,
+		reaped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "reaped_connections_total",
+			Help:      "Number of client connections closed by the server because they had no RPCs for --max_connection_idle.",
+		}),
+	}
+}
+
+// TagConn implements the stats.Handler interface.
+func (t *connectionTracker) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, trackedConnKey{}, &trackedConn{})
+}
+
+// HandleConn implements the stats.Handler interface.
+func (t *connectionTracker) HandleConn(ctx context.Context, s stats.ConnStats) {
+	conn, ok := ctx.Value(trackedConnKey{}).(*trackedConn)
+	if !ok {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	switch s.(type) {
+	case *stats.ConnBegin:
+		conn.start = now
+		conn.lastActive = now
+		t.conns[conn] = struct{}{}
+	case *stats.ConnEnd:
+		delete(t.conns, conn)
+		if conn.idle(now, t.maxIdle) {
+			t.reaped.Inc()
+		}
+	}
+}
+
+// idle returns true if this connection has been idle for at least the given duration.
+// If that's zero, connections are never considered idle.
+func (conn *trackedConn) idle(now time.Time, max time.Duration) bool {
+	return max > 0 && conn.active == 0 && now.Sub(conn.lastActive) >= max
+}
+
+// TagRPC implements the stats.Handler interface.
+func (t *connectionTracker) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+// HandleRPC implements the stats.Handler interface.
+func (t *connectionTracker) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	conn, ok := ctx.Value(trackedConnKey{}).(*trackedConn)
+	if !ok {
+		return
+	}
+	switch s.(type) {
+	case *stats.Begin:
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		conn.active++
+		conn.lastActive = time.Now()
+	case *stats.End:
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		conn.active--
+		conn.lastActive = time.Now()
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (t *connectionTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectionAgeDesc
+	t.reaped.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (t *connectionTracker) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	t.mutex.Lock()
+	buckets := make(map[float64]uint64, len(connectionAgeBuckets))
+	var sum float64
+	for conn := range t.conns {
+		age := now.Sub(conn.start).Seconds()
+		sum += age
+		for _, b := range connectionAgeBuckets {
+			if age <= b {
+				buckets[b]++
+			}
+		}
+	}
+	count := uint64(len(t.conns))
+	t.mutex.Unlock()
+	ch <- prometheus.MustNewConstHistogram(connectionAgeDesc, count, sum, buckets)
+	t.reaped.Collect(ch)
+}
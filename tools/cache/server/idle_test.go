@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/stats"
+)
+
+func TestConnectionTracker(t *testing.T) {
+	tracker := newConnectionTracker(0)
+	ctx := tracker.TagConn(context.Background(), &stats.ConnTagInfo{})
+	tracker.HandleConn(ctx, &stats.ConnBegin{})
+	conn := ctx.Value(trackedConnKey{}).(*trackedConn)
+	assert.EqualValues(t, 1, connectionAges(t, tracker).GetSampleCount())
+
+	tracker.HandleRPC(ctx, &stats.Begin{})
+	assert.False(t, conn.idle(time.Now().Add(time.Hour), time.Minute), "It's got an RPC in progress")
+	tracker.HandleRPC(ctx, &stats.End{})
+	assert.False(t, conn.idle(time.Now(), time.Minute))
+	assert.True(t, conn.idle(time.Now().Add(time.Hour), time.Minute))
+	assert.False(t, conn.idle(time.Now().Add(time.Hour), 0), "Connections are never idle if there's no limit")
+
+	tracker.HandleConn(ctx, &stats.ConnEnd{})
+	assert.EqualValues(t, 0, connectionAges(t, tracker).GetSampleCount())
+}
+
+func TestIdleConnectionsReaped(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s, lis := BuildGrpcServer(0, newCache("test_idle_connections"), nil, registry, nil, nil, nil, "", "", ServerOptions{MaxConnectionIdle: 200 * time.Millisecond})
+	go s.Serve(lis)
+	defer s.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	req := &healthpb.HealthCheckRequest{Service: healthService}
+
+	before := reapedCount(t, registry)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = client.Check(ctx, req)
+	require.NoError(t, err)
+	for i := 0; i < 100 && reapedCount(t, registry) == before; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, before+1, reapedCount(t, registry))
+
+	// The client reconnects when it next needs to.
+	_, err = client.Check(ctx, req)
+	assert.NoError(t, err)
+}
+
+// connectionAges returns the connection age histogram collected from the given tracker.
+func connectionAges(t *testing.T, tracker *connectionTracker) *dto.Histogram {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(tracker)
+	return gatherMetric(t, registry, "plz_cache_connection_age_seconds").Histogram
+}
+
+// reapedCount returns the number of connections reaped so far by the server whose metrics are
+// registered on the given registry.
+func reapedCount(t *testing.T, registry *prometheus.Registry) float64 {
+	return gatherMetric(t, registry, "plz_cache_reaped_connections_total").Counter.GetValue()
+}
+
+// gatherMetric returns the single metric with the given name from the given registry.
+func gatherMetric(t *testing.T, registry *prometheus.Registry, name string) *dto.Metric {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			require.Equal(t, 1, len(family.Metric))
+			return family.Metric[0]
+		}
+	}
+	require.Fail(t, "metric not found", name)
+	return nil
+}
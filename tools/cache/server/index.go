@@ -0,0 +1,235 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/djherbis/atime"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"tools/cache/audit"
+)
+
+// indexEntryOverhead is the approximate memory used by each entry in the index, excluding its key.
+// This is measured by BenchmarkIndexMemory; it covers the cachedFile itself and the map's own overhead.
+const indexEntryOverhead = 184
+
+// errStopWalk is used to stop a filepath.Walk early.
+var errStopWalk = errors.New("stop walking")
+
+// hasUnindexed returns true if there are files on disk that aren't in the index.
+func (cache *Cache) hasUnindexed() bool {
+	return atomic.LoadInt64(&cache.unindexed) > 0 || cache.scanningInBackground()
+}
+
+// indexed is called whenever a new entry is added to the index.
+// If that takes it over its limit, we start dropping entries from it in the background, unless
+// it's still being scanned in the background; that applies the limit once it's finished.
+func (cache *Cache) indexed(p string) {
+	atomic.AddInt64(&cache.indexKeyBytes, int64(len(p)))
+	if max := cache.maxIndexEntries; max > 0 && int64(cache.cachedFiles.Count()) > max && !cache.scanningInBackground() && atomic.CompareAndSwapInt32(&cache.spilling, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&cache.spilling, 0)
+			// Leave some headroom so we don't have to do this again immediately.
+			cache.spill(max - max/10)
+		}()
+	}
+}
+
+// spill drops the least recently read entries from the index until it has no more than the given number.
+// Their last read times are written back to disk so we can pick them up again later.
+func (cache *Cache) spill(target int64) {
+	files := make(cachedFilePaths, 0, cache.cachedFiles.Count())
+	for t := range cache.cachedFiles.IterBuffered() {
+		files = append(files, cachedFilePath{file: t.Val.(*cachedFile), path: t.Key})
+	}
+	if int64(len(files)) <= target {
+		return
+	}
+	sort.Sort(&files)
+	spilled := 0
+	for _, f := range files[:int64(len(files))-target] {
+		f.file.Lock()
+		if !f.file.deleted {
+			// Anyone waiting on it will find it's gone and look it up on disk again.
+			cache.writeAccessTime(f.path, f.file.lastReadTime)
+			f.file.deleted = true
+			cache.cachedFiles.Remove(f.path)
+			atomic.AddInt64(&cache.indexKeyBytes, -int64(len(f.path)))
+			atomic.AddInt64(&cache.unindexed, 1)
+			spilled++
+		}
+		f.file.Unlock()
+	}
+	log.Info("Dropped %d files from the index, %d are now only on disk", spilled, atomic.LoadInt64(&cache.unindexed))
+}
+
+// writeAccessTime sets the access time of a file on disk, preserving its modification time.
+func (cache *Cache) writeAccessTime(p string, t time.Time) {
+	fullPath := path.Join(cache.rootPath, p)
+	if info, err := os.Stat(fullPath); err != nil {
+		log.Warning("Failed to stat %s: %s", fullPath, err)
+	} else if err := os.Chtimes(fullPath, t, info.ModTime()); err != nil {
+		log.Warning("Failed to set access time of %s: %s", fullPath, err)
+	}
+}
+
+// admitFile adds a file that's on disk but not in the index back into it (or into it for the first
+// time, if the scan hasn't got to it yet).
+// It returns true if the file is now in the index (possibly because someone else beat us to it),
+// or false if there's no such file.
+func (cache *Cache) admitFile(p string) bool {
+	if isUntracked(path.Base(p)) {
+		return false // These aren't tracked individually.
+	}
+	cache.scanMutex.RLock()
+	defer cache.scanMutex.RUnlock()
+	fullPath := path.Join(cache.rootPath, p)
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	lastRead := atime.Get(info)
+	if now := cache.now(); lastRead.After(now) {
+		lastRead = now // As in scan()
+	}
+	file := &cachedFile{lastReadTime: lastRead, persistedReadTime: lastRead, storedTime: info.ModTime(), size: info.Size()}
+	file.Lock()
+	defer file.Unlock()
+	if !cache.cachedFiles.SetIfAbsent(p, file) {
+		return true
+	}
+	// Check it's still there now we've got an entry for it; anyone deleting it from here on has to go through us.
+	if _, err := os.Stat(fullPath); err != nil {
+		file.deleted = true
+		cache.cachedFiles.Remove(p)
+		return false
+	}
+	if cache.scanningInBackground() {
+		// The scan hasn't got to it yet (or it'd be in the index), and won't count it now it is.
+		atomic.AddInt64(&cache.totalSize, file.size)
+	} else {
+		atomic.AddInt64(&cache.unindexed, -1)
+	}
+	cache.indexed(p)
+	return true
+}
+
+// admitAll adds any files under the given path that aren't in the index back into it.
+func (cache *Cache) admitAll(artPath string) {
+	filepath.Walk(path.Join(cache.rootPath, artPath), func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			if p := name[len(cache.rootPath)+1:]; !cache.cachedFiles.Has(p) {
+				cache.admitFile(p)
+			}
+		}
+		return nil
+	})
+}
+
+// cleanUnindexed deletes any files that aren't in the index and were last read before the given time,
+// until the cache is no larger than target (if it's positive). It returns the number of files deleted.
+func (cache *Cache) cleanUnindexed(olderThan time.Time, target int64, reason audit.Reason) int {
+	return cache.cleanUnindexedWhere(func(info os.FileInfo) bool {
+		return atime.Get(info).Before(olderThan)
+	}, target, reason)
+}
+
+// cleanUnindexedWhere is like cleanUnindexed but deletes files for which the given function returns true.
+func (cache *Cache) cleanUnindexedWhere(shouldClean func(info os.FileInfo) bool, target int64, reason audit.Reason) int {
+	cleaned := 0
+	filepath.Walk(cache.rootPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // Most likely it's been removed from under us, which is fine.
+		} else if target > 0 && atomic.LoadInt64(&cache.totalSize) <= target {
+			return errStopWalk
+		} else if info.IsDir() || !shouldClean(info) {
+			return nil
+		}
+		p := name[len(cache.rootPath)+1:]
+		if cache.cachedFiles.Has(p) || !cache.admitFile(p) {
+			return nil
+		}
+		if filei, present := cache.cachedFiles.Get(p); present && cache.evictFile(p, filei.(*cachedFile), info.ModTime(), reason) {
+			cleaned++
+		}
+		return nil
+	})
+	return cleaned
+}
+
+// oldestIndexed returns the last read time of the least recently read file in the index.
+func (cache *Cache) oldestIndexed() time.Time {
+	oldest := cache.now()
+	for t := range cache.cachedFiles.IterBuffered() {
+		if f := t.Val.(*cachedFile); f.lastReadTime.Before(oldest) {
+			oldest = f.lastReadTime
+		}
+	}
+	return oldest
+}
+
+// IndexMemory returns an estimate of the memory used by the index, in bytes.
+func (cache *Cache) IndexMemory() int64 {
+	return int64(cache.cachedFiles.Count())*indexEntryOverhead + atomic.LoadInt64(&cache.indexKeyBytes)
+}
+
+// RegisterMetrics registers metrics describing the cache's size, index and mode on the given
+// registry, along with its counts of hits, stores etc. and those of its storage backend, if it
+// has any, so SetStorage should be called first.
+func (cache *Cache) RegisterMetrics(registry prometheus.Registerer) {
+	registry.MustRegister(cache.metrics)
+	if c, ok := cache.currentStorage().(prometheus.Collector); ok {
+		registry.MustRegister(c)
+	}
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "plz_cache",
+		Name:      "size_bytes",
+		Help:      "Total size of the files in the cache on disk, as reported by TotalSize.",
+	}, func() float64 {
+		return float64(cache.TotalSize())
+	}))
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "plz_cache",
+		Name:      "files",
+		Help:      "Number of files in the cache, as reported by NumFiles.",
+	}, func() float64 {
+		return float64(cache.NumFiles())
+	}))
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "plz_cache",
+		Name:      "index_entries",
+		Help:      "Number of files tracked in the in-memory index.",
+	}, func() float64 {
+		return float64(cache.cachedFiles.Count())
+	}))
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "plz_cache",
+		Name:      "unindexed_files",
+		Help:      "Approximate number of files on disk that have been dropped from the in-memory index.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&cache.unindexed))
+	}))
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "plz_cache",
+		Name:      "index_memory_bytes",
+		Help:      "Estimated memory used by the in-memory index.",
+	}, func() float64 {
+		return float64(cache.IndexMemory())
+	}))
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "plz_cache",
+		Name:      "read_only",
+		Help:      "1 while the cache is refusing stores from clients (including while in maintenance mode), otherwise 0.",
+	}, func() float64 {
+		if cache.ReadOnlyReason() != "" {
+			return 1
+		}
+		return 0
+	}))
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/djherbis/atime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newIndexTestCache creates a new cache in the given directory, containing ten files, with its index
+// limited to the given number of entries.
+func newIndexTestCache(t *testing.T, dir string, max int) *Cache {
+	require.NoError(t, os.RemoveAll(dir))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, writeArtifact(path.Join(dir, fmt.Sprintf("linux_amd64/pkg/target/hash/%d", i)), []byte("test"), defaultChecksumAlgorithm))
+	}
+	return newCacheWithIndexLimit(dir, max)
+}
+
+func TestIndexLimitAtScan(t *testing.T) {
+	c := newIndexTestCache(t, "test_index_limit_scan", 5)
+	assert.Equal(t, 5, c.cachedFiles.Count())
+	assert.Equal(t, 10, c.NumFiles())
+	assert.EqualValues(t, 40, c.TotalSize())
+	// Everything can still be retrieved, and those that weren't indexed are brought back into it.
+	for i := 0; i < 10; i++ {
+		art, err := c.RetrieveArtifact(fmt.Sprintf("linux_amd64/pkg/target/hash/%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(art))
+	}
+	assert.Equal(t, 10, c.NumFiles())
+	assert.EqualValues(t, 40, c.TotalSize())
+	assert.False(t, c.hasUnindexed())
+}
+
+func TestSpill(t *testing.T) {
+	c := newIndexTestCache(t, "test_index_spill", 0)
+	// Read one so it's the most recently read.
+	_, err := c.RetrieveArtifact("linux_amd64/pkg/target/hash/3")
+	assert.NoError(t, err)
+	c.spill(1)
+	assert.Equal(t, 1, c.cachedFiles.Count())
+	assert.True(t, c.cachedFiles.Has("linux_amd64/pkg/target/hash/3"))
+	assert.Equal(t, 10, c.NumFiles())
+	assert.EqualValues(t, 40, c.TotalSize())
+	assert.EqualValues(t, len("linux_amd64/pkg/target/hash/3"), c.indexKeyBytes)
+	// Storing over one that's been dropped from the index doesn't count it twice.
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/5", []byte("test")))
+	assert.Equal(t, 10, c.NumFiles())
+	assert.EqualValues(t, 40, c.TotalSize())
+}
+
+func TestSpillPreservesReadTime(t *testing.T) {
+	c := newIndexTestCache(t, "test_index_spill_read_time", 0)
+	lastRead := time.Now().Add(-time.Hour).Truncate(time.Second)
+	f, _ := c.cachedFiles.Get("linux_amd64/pkg/target/hash/1")
+	f.(*cachedFile).lastReadTime = lastRead
+	c.spill(0)
+	info, err := os.Stat("test_index_spill_read_time/linux_amd64/pkg/target/hash/1")
+	require.NoError(t, err)
+	assert.Equal(t, lastRead.Unix(), atime.Get(info).Unix())
+	assert.True(t, c.admitFile("linux_amd64/pkg/target/hash/1"))
+	f, _ = c.cachedFiles.Get("linux_amd64/pkg/target/hash/1")
+	assert.Equal(t, lastRead.Unix(), f.(*cachedFile).lastReadTime.Unix())
+}
+
+func TestCleanUnindexed(t *testing.T) {
+	c := newIndexTestCache(t, "test_index_clean", 5)
+	// High water mark is below the total size, so this has to clean some unindexed files.
+	assert.True(t, c.singleClean(20, 30))
+	assert.EqualValues(t, 20, c.TotalSize())
+	assert.Equal(t, 5, c.NumFiles())
+	// Now clean everything by age; the remaining files on disk go too.
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, c.cleanOldFiles(time.Nanosecond))
+	assert.EqualValues(t, 0, c.TotalSize())
+	assert.Equal(t, 0, c.NumFiles())
+}
+
+func TestDeleteUnindexed(t *testing.T) {
+	c := newIndexTestCache(t, "test_index_delete", 5)
+	assert.NoError(t, c.DeleteArtifact("linux_amd64/pkg/target"))
+	assert.EqualValues(t, 0, c.TotalSize())
+	assert.Equal(t, 0, c.NumFiles())
+}
+
+// BenchmarkIndexMemory measures the memory used by each entry in the index.
+// Run with e.g. -benchtime 10000000x to check it at 10M entries.
+func BenchmarkIndexMemory(b *testing.B) {
+	c := newUnscannedCache("test_index_memory", 0)
+	c.scan() // Creates the directory.
+	defer os.RemoveAll(c.rootPath)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	keyBytes := 0
+	for i := 0; i < b.N; i++ {
+		// Keys are about as long as real ones, which are typically around 100 bytes.
+		key := fmt.Sprintf("linux_amd64/src/some/package/target_%d/dGhpcyBpcyBhIGhhc2ggb2YgdGhlIHJ1bGU/output_file.txt", i)
+		keyBytes += len(key)
+		c.cachedFiles.Set(key, &cachedFile{lastReadTime: time.Now(), size: 4096})
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc-uint64(keyBytes))/float64(b.N), "overhead-bytes/entry")
+	runtime.KeepAlive(c)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A Layout maps the artifacts for each target onto a directory in the cache, so the cache's
+// on-disk layout can match what other tools (e.g. for backups or monitoring) expect.
+// It's given as a template of the placeholders {os}, {arch}, {package}, {target} and {hash}
+// (the artifacts' base64-encoded hash), which must end with /{hash}: each target's artifacts
+// have to share a directory so they can be deleted together. That can be split up by ending it
+// with /{shard}/{hash} instead, where {shard} is the first two characters of the hash, so targets
+// that are built many times don't end up with huge directories. The files within the directory
+// are laid out the same whatever the layout.
+type Layout struct {
+	template string
+	// target is the part of the template naming the directory for a target, i.e. without /{hash}
+	// (or /{shard}/{hash}).
+	target string
+	// re matches directories in this layout, capturing the value of each of fields.
+	re     *regexp.Regexp
+	fields []string
+}
+
+// layouts are the layouts that can be chosen by name rather than with a template.
+var layouts = map[string]string{
+	// default is the layout the cache has always used.
+	"default": "{os}_{arch}/{package}/{target}/{hash}",
+	// split_arch gives the OS and architecture a directory each.
+	"split_arch": "{os}/{arch}/{package}/{target}/{hash}",
+	// by_package groups each package's artifacts together, whatever they were built for.
+	"by_package": "{package}/{target}/{os}_{arch}/{hash}",
+	// sharded is the default layout with each target's artifacts split up by their hash.
+	"sharded": "{os}_{arch}/{package}/{target}/{shard}/{hash}",
+}
+
+// shardLength is the number of characters of the hash that {shard} expands to. Two characters of
+// base64 gives 4096 shards, enough for a target with millions of artifacts.
+const shardLength = 2
+
+// layoutPlaceholder matches the placeholders in a layout template.
+var layoutPlaceholder = regexp.MustCompile(`\{[a-z]+\}`)
+
+// NewLayout returns the layout with the given name (one of default, split_arch, by_package or sharded),
+// or the one described by the given template if it isn't one of those names.
+// It returns an error if the template is invalid, including if it's ambiguous, i.e. different
+// artifacts could end up in the same directory.
+func NewLayout(nameOrTemplate string) (*Layout, error) {
+	template := nameOrTemplate
+	if t, present := layouts[nameOrTemplate]; present {
+		template = t
+	}
+	if !strings.HasSuffix(template, "/{hash}") {
+		return nil, fmt.Errorf("layout %s must end with /{hash}", template)
+	}
+	target := strings.TrimSuffix(template, "/{hash}")
+	if strings.Contains(target, "{shard}") {
+		if !strings.HasSuffix(target, "/{shard}") {
+			return nil, fmt.Errorf("{shard} must be the directory just above {hash} in layout %s", template)
+		}
+		target = strings.TrimSuffix(target, "/{shard}")
+	}
+	l := &Layout{template: template, target: target}
+	seen := map[string]bool{}
+	var re bytes.Buffer
+	re.WriteString("^")
+	separate := false
+	for _, segment := range strings.Split(template, "/") {
+		if segment == "{package}" && !seen["package"] {
+			// Packages can be empty (for the root package), in which case the whole segment is.
+			if separate {
+				re.WriteString("(?:/(.+))?")
+			} else {
+				re.WriteString("(?:(.+)/)?")
+			}
+			l.fields = append(l.fields, "package")
+			seen["package"] = true
+			continue
+		} else if separate {
+			re.WriteString("/")
+		}
+		separate = true
+		last := 0
+		for _, idx := range layoutPlaceholder.FindAllStringIndex(segment, -1) {
+			re.WriteString(regexp.QuoteMeta(segment[last:idx[0]]))
+			field := segment[idx[0]+1 : idx[1]-1]
+			switch field {
+			case "os":
+				re.WriteString("([^/_]+)")
+			case "package":
+				re.WriteString("(.*)")
+			case "arch", "target", "shard", "hash":
+				re.WriteString("([^/]+)")
+			default:
+				return nil, fmt.Errorf("unknown placeholder {%s} in layout %s", field, template)
+			}
+			if seen[field] {
+				return nil, fmt.Errorf("placeholder {%s} appears more than once in layout %s", field, template)
+			}
+			seen[field] = true
+			l.fields = append(l.fields, field)
+			last = idx[1]
+		}
+		re.WriteString(regexp.QuoteMeta(segment[last:]))
+	}
+	re.WriteString("$")
+	for _, field := range []string{"os", "arch", "package", "target"} {
+		if !seen[field] {
+			return nil, fmt.Errorf("layout %s must contain {%s}", template, field)
+		}
+	}
+	l.re = regexp.MustCompile(re.String())
+	// Check a few awkward examples come back out the same, to catch any ambiguous templates.
+	for _, pkg := range []string{"", "src", "src/core/x_y"} {
+		dir := l.ArtifactDir("linux", "amd64_v2", pkg, "target_1", "aGFzaA")
+		if os, arch, p, target, hash, ok := l.Parse(dir); !ok || os != "linux" || arch != "amd64_v2" || p != pkg || target != "target_1" || hash != "aGFzaA" {
+			return nil, fmt.Errorf("layout %s is ambiguous, can't tell the fields of %s apart", template, dir)
+		}
+	}
+	return l, nil
+}
+
+// String returns the template describing this layout.
+func (l *Layout) String() string {
+	return l.template
+}
+
+// ArtifactDir returns the directory for the artifacts with the given hash (base64-encoded) for a target.
+func (l *Layout) ArtifactDir(os, arch, pkg, target, hash string) string {
+	return l.expand(l.template, os, arch, pkg, target, hash)
+}
+
+// TargetDir returns the directory containing all the artifacts for a target.
+func (l *Layout) TargetDir(os, arch, pkg, target string) string {
+	return l.expand(l.target, os, arch, pkg, target, "")
+}
+
+// expand expands the placeholders in the given template.
+func (l *Layout) expand(template, os, arch, pkg, target, hash string) string {
+	segments := strings.Split(template, "/")
+	for i, segment := range segments {
+		segments[i] = strings.NewReplacer("{os}", os, "{arch}", arch, "{package}", pkg, "{target}", target, "{shard}", shard(hash), "{hash}", hash).Replace(segment)
+	}
+	// This drops the segment of an empty package, the same as the default layout always has.
+	return path.Join(segments...)
+}
+
+// Parse returns the fields of a directory returned by ArtifactDir, or false if it isn't one.
+func (l *Layout) Parse(dir string) (os, arch, pkg, target, hash string, ok bool) {
+	m := l.re.FindStringSubmatch(dir)
+	if m == nil {
+		return "", "", "", "", "", false
+	}
+	values := map[string]string{}
+	for i, field := range l.fields {
+		values[field] = m[i+1]
+	}
+	if s, present := values["shard"]; present && s != shard(values["hash"]) {
+		return "", "", "", "", "", false
+	}
+	return values["os"], values["arch"], values["package"], values["target"], values["hash"], true
+}
+
+// shard returns the shard that the artifacts with the given hash are in, for the {shard} placeholder.
+func shard(hash string) string {
+	if len(hash) > shardLength {
+		return hash[:shardLength]
+	}
+	return hash
+}
+
+// defaultLayout is the layout used unless another is set.
+var defaultLayout, _ = NewLayout("default")
+
+// SetLayout sets the layout of artifacts on disk. It should be set before serving, since
+// artifacts already stored in a different layout won't be found unless they're moved with MigrateLayout.
+func (cache *Cache) SetLayout(layout *Layout) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.layout = layout
+}
+
+// Layout returns the layout of artifacts on disk.
+func (cache *Cache) Layout() *Layout {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	if cache.layout == nil {
+		return defaultLayout
+	}
+	return cache.layout
+}
+
+// currentPreviousLayout returns the layout that MigrateLayout is moving artifacts out of, or nil if it isn't running.
+func (cache *Cache) currentPreviousLayout() *Layout {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.previousLayout
+}
+
+// previousArtifactDir returns the directory the given artifacts were in before the layout changed,
+// or false if artifacts aren't being moved from another layout.
+func (cache *Cache) previousArtifactDir(os, arch, pkg, target, hash string) (string, bool) {
+	if l := cache.currentPreviousLayout(); l != nil {
+		return l.ArtifactDir(os, arch, pkg, target, hash), true
+	}
+	return "", false
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	pb "cache/proto/rpc_cache"
+	"core"
+)
+
+// layoutTests are the directories we expect each layout to give for the same artifacts.
+var layoutTests = []struct {
+	layout, dir, rootDir string
+}{
+	{"default", "linux_amd64/src/core/core/aGFzaA", "linux_amd64/core/aGFzaA"},
+	{"split_arch", "linux/amd64/src/core/core/aGFzaA", "linux/amd64/core/aGFzaA"},
+	{"by_package", "src/core/core/linux_amd64/aGFzaA", "core/linux_amd64/aGFzaA"},
+	{"{package}/{target}/{os}-{arch}/{hash}", "src/core/core/linux-amd64/aGFzaA", "core/linux-amd64/aGFzaA"},
+	{"artifacts/{os}_{arch}/pkg-{package}/{target}/{hash}", "artifacts/linux_amd64/pkg-src/core/core/aGFzaA", "artifacts/linux_amd64/pkg-/core/aGFzaA"},
+}
+
+func TestLayouts(t *testing.T) {
+	for _, test := range layoutTests {
+		l, err := NewLayout(test.layout)
+		require.NoError(t, err, test.layout)
+		assert.Equal(t, test.dir, l.ArtifactDir("linux", "amd64", "src/core", "core", "aGFzaA"), test.layout)
+		assert.Equal(t, path.Dir(test.dir), l.TargetDir("linux", "amd64", "src/core", "core"), test.layout)
+		system, arch, pkg, target, hash, ok := l.Parse(test.dir)
+		assert.True(t, ok, test.layout)
+		assert.Equal(t, []string{"linux", "amd64", "src/core", "core", "aGFzaA"}, []string{system, arch, pkg, target, hash}, test.layout)
+
+		// The root package is empty.
+		assert.Equal(t, test.rootDir, l.ArtifactDir("linux", "amd64", "", "core", "aGFzaA"), test.layout)
+		system, arch, pkg, target, hash, ok = l.Parse(test.rootDir)
+		assert.True(t, ok, test.layout)
+		assert.Equal(t, []string{"linux", "amd64", "", "core", "aGFzaA"}, []string{system, arch, pkg, target, hash}, test.layout)
+
+		_, _, _, _, _, ok = l.Parse("linux_amd64")
+		assert.False(t, ok, test.layout)
+	}
+}
+
+func TestDefaultLayoutIsUnchanged(t *testing.T) {
+	c := &Cache{}
+	assert.Equal(t, "{os}_{arch}/{package}/{target}/{hash}", c.Layout().String())
+	assert.Equal(t, path.Join("linux_amd64", "src/core", "core", "aGFzaA"), c.Layout().ArtifactDir("linux", "amd64", "src/core", "core", "aGFzaA"))
+}
+
+func TestInvalidLayouts(t *testing.T) {
+	for _, layout := range []string{
+		"wibble",
+		"{os}_{arch}/{package}/{target}/{hash}/files", // Must end with the hash
+		"{hash}/{os}_{arch}/{package}/{target}/{hash}",
+		"{os}_{arch}/{package}/{hash}",        // No target
+		"{os}_{arch}/{package}/{name}/{hash}", // Unknown placeholder
+		"{os}{arch}/{package}/{target}/{hash}",
+		"{os}_{arch}/{package}{target}/{hash}",
+		"{os}_{arch}/{package}/{shard}/{target}/{hash}", // The shard must be just above the hash
+		"{os}_{arch}/{package}/{target}/{shard}{hash}",
+	} {
+		_, err := NewLayout(layout)
+		assert.Error(t, err, layout)
+	}
+}
+
+func TestShardedLayout(t *testing.T) {
+	l, err := NewLayout("sharded")
+	require.NoError(t, err)
+	dir := "linux_amd64/src/core/core/aG/aGFzaA"
+	assert.Equal(t, dir, l.ArtifactDir("linux", "amd64", "src/core", "core", "aGFzaA"))
+	assert.Equal(t, "linux_amd64/src/core/core", l.TargetDir("linux", "amd64", "src/core", "core"), "A target's directory has all its shards in")
+	system, arch, pkg, target, hash, ok := l.Parse(dir)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"linux", "amd64", "src/core", "core", "aGFzaA"}, []string{system, arch, pkg, target, hash})
+	_, _, _, _, _, ok = l.Parse("linux_amd64/src/core/core/xx/aGFzaA")
+	assert.False(t, ok, "The shard has to match the hash")
+	_, _, _, _, _, ok = l.Parse("linux_amd64/src/core/core/aGFzaA")
+	assert.False(t, ok, "The default layout's directories aren't in this one")
+
+	ctx := context.Background()
+	c := newCache("test_sharded_layout")
+	defer os.RemoveAll(c.rootPath)
+	c.SetLayout(l)
+	r := &RPCCacheServer{cache: c}
+	for _, h := range []string{"hash", "other"} {
+		_, err = r.Store(ctx, &pb.StoreRequest{Os: "linux", Arch: "amd64", Hash: []byte(h), Artifacts: []*pb.Artifact{
+			{Package: "src/core", Target: "core", File: "core.a", Body: []byte(h)},
+		}})
+		require.NoError(t, err)
+	}
+	assert.True(t, core.PathExists(path.Join(c.rootPath, dir, "core.a")))
+	assert.True(t, core.PathExists(path.Join(c.rootPath, "linux_amd64/src/core/core/b3/b3RoZXI/core.a")))
+	resp, err := r.Retrieve(ctx, &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "hash", string(resp.Artifacts[0].Body))
+
+	_, err = r.Delete(ctx, &pb.DeleteRequest{Os: "linux", Arch: "amd64", Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core"}}})
+	require.NoError(t, err)
+	assert.False(t, core.PathExists(path.Join(c.rootPath, "linux_amd64/src/core/core")))
+	assert.EqualValues(t, 0, c.TotalSize())
+}
+
+func TestStoreRetrieveDeleteWithLayout(t *testing.T) {
+	ctx := context.Background()
+	for i, test := range layoutTests {
+		l, err := NewLayout(test.layout)
+		require.NoError(t, err)
+		c := newCache(fmt.Sprintf("test_store_with_layout_%d", i))
+		c.SetLayout(l)
+		r := &RPCCacheServer{cache: c}
+		artifacts := []*pb.Artifact{
+			{Package: "src/core", Target: "core", File: "core.a", Body: []byte("archive")},
+			{Package: "src/core", Target: "core", File: "out/file.txt", Body: []byte("file")},
+		}
+		_, err = r.Store(ctx, &pb.StoreRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+		require.NoError(t, err)
+		assert.True(t, core.PathExists(path.Join(c.rootPath, test.dir, "core.a")), test.layout)
+		assert.True(t, core.PathExists(path.Join(c.rootPath, test.dir, "out/file.txt")), test.layout)
+
+		resp, err := r.Retrieve(ctx, &pb.RetrieveRequest{
+			Os:        "linux",
+			Arch:      "amd64",
+			Hash:      []byte("hash"),
+			Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core", File: "out/file.txt"}},
+		})
+		require.NoError(t, err)
+		assert.True(t, resp.Success, test.layout)
+		assert.Equal(t, []*pb.Artifact{artifacts[1]}, resp.Artifacts, test.layout)
+
+		// Replication lists and loads them by the layout too.
+		require.NoError(t, c.StoreMetadata(test.dir, "", "", ""))
+		listed := 0
+		c.ListArtifacts(func(system, arch string, hash []byte, key string) {
+			assert.Equal(t, "linux", system)
+			assert.Equal(t, "amd64", arch)
+			assert.Equal(t, []byte("hash"), hash)
+			assert.Equal(t, test.dir, key)
+			listed++
+		})
+		assert.Equal(t, 1, listed, test.layout)
+		loaded, err := c.LoadArtifacts(test.dir)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(loaded))
+		for _, a := range loaded {
+			assert.Equal(t, "src/core", a.Package)
+			assert.Equal(t, "core", a.Target)
+		}
+
+		_, err = r.Delete(ctx, &pb.DeleteRequest{Os: "linux", Arch: "amd64", Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core"}}})
+		require.NoError(t, err)
+		assert.False(t, core.PathExists(path.Join(c.rootPath, test.dir)), test.layout)
+		assert.EqualValues(t, 0, c.TotalSize(), test.layout)
+
+		// Cleaning finds them where they are too.
+		_, err = r.Store(ctx, &pb.StoreRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+		require.NoError(t, err)
+		assert.True(t, c.singleClean(0, 1), test.layout)
+		assert.False(t, core.PathExists(path.Join(c.rootPath, test.dir, "core.a")), test.layout)
+		assert.EqualValues(t, 0, c.TotalSize(), test.layout)
+		os.RemoveAll(c.rootPath)
+	}
+}
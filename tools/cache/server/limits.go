@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// ConcurrencyLimits limits the number of stores & retrieves that the RPC server handles at once,
+// in total and from each client. Zero means no limit.
+type ConcurrencyLimits struct {
+	Stores          int `json:"stores"`
+	ClientStores    int `json:"client_stores"`
+	Retrieves       int `json:"retrieves"`
+	ClientRetrieves int `json:"client_retrieves"`
+}
+
+// ReadConcurrencyLimits reads concurrency limits from the given JSON file, on top of the given ones,
+// so any it doesn't mention keep their values.
+func ReadConcurrencyLimits(filename string, limits ConcurrencyLimits) (ConcurrencyLimits, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return limits, err
+	} else if err := json.Unmarshal(b, &limits); err != nil {
+		return limits, fmt.Errorf("invalid concurrency limits in %s: %s", filename, err)
+	}
+	return limits, nil
+}
+
+// A ConcurrencyLimiter counts the stores & retrieves in progress on the RPC servers it's given to
+// (see ServerOptions) against the limits on them. Requests over them are rejected immediately
+// with ResourceExhausted, so clients back off rather than queueing up behind one another. Clients
+// are identified by the common name of their certificate if they present one, otherwise by their
+// IP address. Only Store and Retrieve RPCs count towards them; replication from other nodes never does.
+// It's a counting semaphore rather than a channel so the limits can change while it's in use.
+// It's also a Prometheus collector reporting the requests in progress and those it's rejected.
+// A nil limiter has no limits.
+type ConcurrencyLimiter struct {
+	mutex                       sync.Mutex
+	limits                      ConcurrencyLimits
+	stores, retrieves           inflight
+	inflightGauge, clientsGauge *prometheus.GaugeVec
+	limited                     *prometheus.CounterVec
+}
+
+// inflight counts the requests of one type in progress, in total and by client.
+type inflight struct {
+	total   int
+	clients map[string]int
+}
+
+// NewConcurrencyLimiter returns a new ConcurrencyLimiter with the given limits.
+func NewConcurrencyLimiter(limits ConcurrencyLimits) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		limits:    limits,
+		stores:    inflight{clients: map[string]int{}},
+		retrieves: inflight{clients: map[string]int{}},
+		inflightGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "inflight_requests",
+			Help:      "Number of stores & retrieves currently in progress, as counted against the concurrency limits.",
+		}, []string{"operation"}),
+		clientsGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "max_client_inflight_requests",
+			Help:      "Largest number of stores or retrieves currently in progress from any single client.",
+		}, []string{"operation"}),
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "limited_requests_total",
+			Help:      "Number of stores & retrieves rejected because they were over a concurrency limit.",
+		}, []string{"operation"}),
+	}
+}
+
+// SetLimits changes the limits, including for the servers already using them.
+func (l *ConcurrencyLimiter) SetLimits(limits ConcurrencyLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limits = limits
+}
+
+// ReloadOn rereads the limits from the given file (on top of the given ones) whenever the process
+// receives one of the given signals. It keeps the current ones if the file can't be read.
+func (l *ConcurrencyLimiter) ReloadOn(filename string, limits ConcurrencyLimits, signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		for range ch {
+			reloaded, err := ReadConcurrencyLimits(filename, limits)
+			if err != nil {
+				log.Errorf("Failed to reload concurrency limits: %s", err)
+				continue
+			}
+			log.Notice("Reloaded concurrency limits from %s: %+v", filename, reloaded)
+			l.SetLimits(reloaded)
+		}
+	}()
+}
+
+// acquire counts a request from the given client, if it's within the limits.
+// If so it returns a function to call once the request has finished; otherwise it returns a
+// description of the limit it's over.
+func (l *ConcurrencyLimiter) acquire(store bool, client string) (func(), string) {
+	if l == nil {
+		return func() {}, ""
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	op, counts, limit, clientLimit := "retrieve", &l.retrieves, l.limits.Retrieves, l.limits.ClientRetrieves
+	if store {
+		op, counts, limit, clientLimit = "store", &l.stores, l.limits.Stores, l.limits.ClientStores
+	}
+	if limit > 0 && counts.total >= limit {
+		l.limited.WithLabelValues(op).Inc()
+		return nil, fmt.Sprintf("%d %ss already in progress", counts.total, op)
+	} else if n := counts.clients[client]; clientLimit > 0 && n >= clientLimit {
+		l.limited.WithLabelValues(op).Inc()
+		return nil, fmt.Sprintf("%d %ss already in progress from %s", n, op, client)
+	}
+	l.add(op, counts, client, 1)
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.add(op, counts, client, -1)
+	}, ""
+}
+
+// add adds the given number to the requests of the given type in progress from the given client,
+// and updates the metrics. The caller must hold the mutex.
+func (l *ConcurrencyLimiter) add(op string, i *inflight, client string, n int) {
+	i.total += n
+	i.clients[client] += n
+	if i.clients[client] <= 0 {
+		delete(i.clients, client)
+	}
+	max := 0
+	for _, count := range i.clients {
+		if count > max {
+			max = count
+		}
+	}
+	l.inflightGauge.WithLabelValues(op).Set(float64(i.total))
+	l.clientsGauge.WithLabelValues(op).Set(float64(max))
+}
+
+// Describe implements the prometheus.Collector interface.
+func (l *ConcurrencyLimiter) Describe(ch chan<- *prometheus.Desc) {
+	l.inflightGauge.Describe(ch)
+	l.clientsGauge.Describe(ch)
+	l.limited.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (l *ConcurrencyLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.inflightGauge.Collect(ch)
+	l.clientsGauge.Collect(ch)
+	l.limited.Collect(ch)
+}
+
+// limitConcurrency counts a store or retrieve from the client of the given context against the
+// concurrency limits. It returns a function to call once it's finished, or a ResourceExhausted
+// error if it's over a limit.
+func (r *RPCCacheServer) limitConcurrency(ctx context.Context, store bool) (func(), error) {
+	release, over := r.limiter.acquire(store, clientIdentity(ctx))
+	if release != nil {
+		return release, nil
+	}
+	log.Debug("Rejecting request: %s", over)
+	msg := "Too many concurrent requests: " + over
+	if !store {
+		return nil, retrieveError(codes.ResourceExhausted, pb.RetrieveError_UNAVAILABLE, "", msg)
+	}
+	s := status.New(codes.ResourceExhausted, msg)
+	if detailed, err := s.WithDetails(&pb.StoreError{Reason: pb.StoreError_OVERLOADED, Detail: over}); err == nil {
+		return nil, detailed.Err()
+	}
+	return nil, s.Err()
+}
+
+// clientIdentity returns the identity of the client of the given context for the per-client limits:
+// the common name of its certificate if it presented one, otherwise its IP address.
+func clientIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	} else if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+		if cn := info.State.PeerCertificates[0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyLimits{Stores: 2})
+	release1, over := l.acquire(true, "a")
+	require.NotNil(t, release1, over)
+	release2, over := l.acquire(true, "b")
+	require.NotNil(t, release2, over)
+	release3, over := l.acquire(true, "c")
+	assert.Nil(t, release3)
+	assert.Equal(t, "2 stores already in progress", over)
+
+	release4, over := l.acquire(false, "c")
+	require.NotNil(t, release4, "Retrieves are limited separately")
+	release4()
+
+	release1()
+	release3, over = l.acquire(true, "c")
+	require.NotNil(t, release3, over)
+	release2()
+	release3()
+	assert.Equal(t, 0, l.stores.total)
+	assert.Equal(t, 0, len(l.stores.clients))
+}
+
+func TestClientConcurrencyLimit(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyLimits{Retrieves: 10, ClientRetrieves: 1})
+	release1, over := l.acquire(false, "a")
+	require.NotNil(t, release1, over)
+	release2, over := l.acquire(false, "a")
+	assert.Nil(t, release2)
+	assert.Equal(t, "1 retrieves already in progress from a", over)
+	release3, over := l.acquire(false, "b")
+	require.NotNil(t, release3, "Other clients aren't affected")
+	release1()
+	release3()
+}
+
+func TestConcurrencyLimitsChange(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyLimits{})
+	release1, _ := l.acquire(true, "a")
+	require.NotNil(t, release1, "No limits by default")
+	l.SetLimits(ConcurrencyLimits{Stores: 1})
+	release2, _ := l.acquire(true, "a")
+	assert.Nil(t, release2, "The new limit applies to what's already in progress")
+	release1()
+	release2, _ = l.acquire(true, "a")
+	assert.NotNil(t, release2)
+}
+
+func TestNilConcurrencyLimiter(t *testing.T) {
+	var l *ConcurrencyLimiter
+	release, _ := l.acquire(true, "a")
+	require.NotNil(t, release)
+	release()
+}
+
+func TestReadConcurrencyLimits(t *testing.T) {
+	f, err := ioutil.TempFile("", "limits")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"stores": 5, "client_stores": 2}`)
+	require.NoError(t, err)
+	f.Close()
+	limits, err := ReadConcurrencyLimits(f.Name(), ConcurrencyLimits{Stores: 10, Retrieves: 20})
+	require.NoError(t, err)
+	assert.Equal(t, ConcurrencyLimits{Stores: 5, ClientStores: 2, Retrieves: 20}, limits, "Anything not in the file keeps its value")
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("stores: 5"), 0644))
+	_, err = ReadConcurrencyLimits(f.Name(), ConcurrencyLimits{})
+	assert.Error(t, err)
+}
+
+func TestClientIdentity(t *testing.T) {
+	assert.Equal(t, "", clientIdentity(context.Background()))
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}})
+	assert.Equal(t, "10.1.2.3", clientIdentity(ctx), "The port isn't part of it")
+}
+
+func TestStoreOverConcurrencyLimit(t *testing.T) {
+	cache := newCache("test_store_concurrency_limit")
+	defer os.RemoveAll(cache.rootPath)
+	r := &RPCCacheServer{cache: cache, limiter: NewConcurrencyLimiter(ConcurrencyLimits{ClientStores: 1, ClientRetrieves: 1})}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}})
+	release, _ := r.limiter.acquire(true, "10.1.2.3")
+	defer release()
+	_, err := r.Store(ctx, &pb.StoreRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash")})
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err))
+
+	release, _ = r.limiter.acquire(false, "10.1.2.3")
+	defer release()
+	_, err = r.Retrieve(ctx, &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash")})
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err))
+
+	other := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.1.2.4"), Port: 1234}})
+	_, err = r.Retrieve(other, &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash")})
+	assert.NotEqual(t, codes.ResourceExhausted, grpc.Code(err), "Other clients aren't limited")
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenWithBacklog opens a TCP listener on the given IP address and port with the given backlog.
+// If the address is nil it listens on all interfaces.
+// Go doesn't provide a way of setting that so we have to create the socket ourselves.
+func listenWithBacklog(ip net.IP, port, backlog int) (net.Listener, error) {
+	family := syscall.AF_INET6
+	addr6 := &syscall.SockaddrInet6{Port: port}
+	var addr syscall.Sockaddr = addr6
+	if ip4 := ip.To4(); ip4 != nil {
+		family = syscall.AF_INET
+		addr4 := &syscall.SockaddrInet4{Port: port}
+		copy(addr4.Addr[:], ip4)
+		addr = addr4
+	} else if ip != nil {
+		copy(addr6.Addr[:], ip.To16())
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("tcp:%d", port))
+	defer f.Close() // FileListener dups it, so this is always safe.
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if family == syscall.AF_INET6 && ip == nil {
+		// Accept IPv4 connections as well, like net.Listen does.
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	} else if err := syscall.Listen(fd, backlog); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(f)
+}
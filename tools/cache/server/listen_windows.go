@@ -0,0 +1,17 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// listenWithBacklog opens a TCP listener on the given IP address (or all interfaces, if it's nil) and port.
+// We can't set the backlog on Windows so it's ignored.
+func listenWithBacklog(ip net.IP, port, backlog int) (net.Listener, error) {
+	log.Warning("Setting the listen backlog isn't supported on this platform, using the default")
+	if ip == nil {
+		return net.Listen("tcp", fmt.Sprintf(":%d", port))
+	}
+	return net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ParseBindAddress parses an IP address to listen on (see ServerOptions.BindAddr and
+// ListenAddress). It can be IPv4 or IPv6, and IPv6 addresses can be given with or without
+// brackets. The empty string means all interfaces, and gives nil.
+// It returns an error if the address isn't a valid IP address.
+func ParseBindAddress(addr string) (net.IP, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid bind address %s, must be an IP address", addr)
+	}
+	return ip, nil
+}
+
+// ListenAddress returns the address to listen on for the given port, on the given IP address
+// (all interfaces if it's nil). IPv6 addresses are bracketed, so it's suitable for net.Listen or
+// http.Server.
+func ListenAddress(ip net.IP, port int) string {
+	if ip == nil {
+		return fmt.Sprintf(":%d", port)
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// listen opens a TCP listener on the given port, applying the options' bind address and limits.
+func listen(port int, opts ServerOptions) (*limitListener, error) {
+	var lis net.Listener
+	var err error
+	if opts.ListenBacklog > 0 {
+		lis, err = listenWithBacklog(opts.BindAddr, port, opts.ListenBacklog)
+	} else {
+		lis, err = net.Listen("tcp", ListenAddress(opts.BindAddr, port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newLimitListener(lis, opts.MaxConnections), nil
+}
+
+// A limitListener wraps a net.Listener to count the connections it accepts and refuse any beyond
+// a limit. Refusing them promptly is much better than running out of file descriptors, which is
+// a fine way of making the whole server fall over.
+// It's also a Prometheus collector reporting the connections it has open and has refused.
+type limitListener struct {
+	net.Listener
+	max    int64
+	active int64
+	// limited is nonzero once we've warned about hitting the limit; it resets once we accept another.
+	limited     int32
+	connections prometheus.Gauge
+	rejected    prometheus.Counter
+}
+
+// newLimitListener returns a new limitListener wrapping the given one. If max is zero there is no limit.
+func newLimitListener(lis net.Listener, max int) *limitListener {
+	return &limitListener{
+		Listener: lis,
+		max:      int64(max),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "connections",
+			Help:      "Number of client connections currently open.",
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "plz_cache",
+			Name:      "rejected_connections_total",
+			Help:      "Number of client connections refused because the server was at its connection limit.",
+		}),
+	}
+}
+
+// Accept implements the net.Listener interface.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if n := atomic.AddInt64(&l.active, 1); l.max > 0 && n > l.max {
+			atomic.AddInt64(&l.active, -1)
+			conn.Close()
+			l.rejected.Inc()
+			if atomic.CompareAndSwapInt32(&l.limited, 0, 1) {
+				log.Warning("Reached limit of %d connections, refusing new ones", l.max)
+			}
+			continue
+		}
+		atomic.StoreInt32(&l.limited, 0)
+		l.connections.Inc()
+		return &limitConn{Conn: conn, listener: l}, nil
+	}
+}
+
+// Active returns the number of connections accepted by this listener that are currently open.
+func (l *limitListener) Active() int {
+	return int(atomic.LoadInt64(&l.active))
+}
+
+// Describe implements the prometheus.Collector interface.
+func (l *limitListener) Describe(ch chan<- *prometheus.Desc) {
+	l.connections.Describe(ch)
+	l.rejected.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (l *limitListener) Collect(ch chan<- prometheus.Metric) {
+	l.connections.Collect(ch)
+	l.rejected.Collect(ch)
+}
+
+// A limitConn is a connection accepted by a limitListener, which releases its slot when closed.
+type limitConn struct {
+	net.Conn
+	listener *limitListener
+	once     sync.Once
+}
+
+// Close implements the net.Conn interface.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		atomic.AddInt64(&c.listener.active, -1)
+		c.listener.connections.Dec()
+	})
+	return err
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := newLimitListener(lis, 1)
+	defer l.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	c1, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer c1.Close()
+	s1 := <-conns
+	assert.Equal(t, 1, l.Active())
+
+	// The second connection is over the limit so should be closed on us.
+	c2, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c2.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Equal(t, 1, l.Active())
+
+	// Once the first one's closed, we should accept another.
+	s1.Close()
+	assert.Equal(t, 0, l.Active())
+	c3, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer c3.Close()
+	select {
+	case s3 := <-conns:
+		assert.Equal(t, 1, l.Active())
+		s3.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection not accepted after one was closed")
+	}
+}
+
+func TestListenWithBacklog(t *testing.T) {
+	lis, err := listenWithBacklog(nil, 0, 16)
+	require.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		if conn, err := lis.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestParseBindAddress(t *testing.T) {
+	listenAddress := func(addr string) string {
+		ip, err := ParseBindAddress(addr)
+		require.NoError(t, err)
+		return ListenAddress(ip, 7677)
+	}
+	assert.Equal(t, ":7677", listenAddress(""))
+	assert.Equal(t, "10.0.0.1:7677", listenAddress("10.0.0.1"))
+	assert.Equal(t, "[2001:db8::1]:7677", listenAddress("2001:db8::1"))
+	assert.Equal(t, "[2001:db8::1]:7677", listenAddress("[2001:db8::1]"))
+	_, err := ParseBindAddress("cache.example.com")
+	assert.Error(t, err)
+	_, err = ParseBindAddress("10.0.0.1:7677")
+	assert.Error(t, err)
+}
+
+func TestListenOnBindAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		t.Run(addr, func(t *testing.T) {
+			ip := net.ParseIP(addr)
+			for _, backlog := range []int{0, 16} {
+				var lis net.Listener
+				var err error
+				if backlog > 0 {
+					lis, err = listenWithBacklog(ip, 0, backlog)
+				} else {
+					lis, err = listen(0, ServerOptions{BindAddr: ip})
+				}
+				require.NoError(t, err)
+				host, _, err := net.SplitHostPort(lis.Addr().String())
+				assert.NoError(t, err)
+				assert.Equal(t, addr, host)
+				go func() {
+					if conn, err := lis.Accept(); err == nil {
+						conn.Close()
+					}
+				}()
+				conn, err := net.Dial("tcp", lis.Addr().String())
+				require.NoError(t, err)
+				conn.Close()
+				lis.Close()
+			}
+		})
+	}
+}
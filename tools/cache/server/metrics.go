@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// NewRegistry returns a new Prometheus registry with the standard Go runtime and process metrics
+// registered on it. The server's own are registered on it by whatever creates them (e.g.
+// BuildGrpcServer and Cache.RegisterMetrics), since each server has its own.
+// We deliberately don't use the global default registry so the server can be embedded in another
+// process, or several started in one test, without their metrics colliding. Embedders that want
+// to serve everything from one place can merge it with their own using prometheus.Gatherers.
+func NewRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return registry
+}
+
+// MetricsHandler returns an HTTP handler serving the metrics from the given registry, which gives
+// up on gathering them after the given timeout and responds with an error instead. It registers
+// a count of the times it's done so on the registry too.
+// The gathering is done on a separate goroutine so a slow collector can't hold up anything else,
+// and only one runs at a time; requests that arrive while one is in progress wait for its result
+// rather than starting another, so they can't pile up behind a collector that's stuck.
+func MetricsHandler(registry *prometheus.Registry, timeout time.Duration) http.Handler {
+	timeouts := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "plz_cache",
+		Name:      "metrics_timeouts_total",
+		Help:      "Number of requests for metrics that timed out waiting for them to be gathered.",
+	})
+	registry.MustRegister(timeouts)
+	return promhttp.HandlerFor(&timeoutGatherer{gatherer: registry, timeout: timeout, timeouts: timeouts}, promhttp.HandlerOpts{
+		ErrorLog:      promLogger{},
+		ErrorHandling: promhttp.HTTPErrorOnError,
+	})
+}
+
+// A timeoutGatherer wraps a gatherer and bounds how long each call to it can take.
+type timeoutGatherer struct {
+	gatherer prometheus.Gatherer
+	timeout  time.Duration
+	timeouts prometheus.Counter
+	// inflight is the result of the gather currently in progress, if there is one.
+	inflight *gatherResult
+	mutex    sync.Mutex
+}
+
+// A gatherResult is the result of a single gather, available once done is closed.
+type gatherResult struct {
+	families []*dto.MetricFamily
+	err      error
+	done     chan struct{}
+}
+
+// Gather implements the prometheus.Gatherer interface.
+func (g *timeoutGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mutex.Lock()
+	result := g.inflight
+	if result == nil {
+		result = &gatherResult{done: make(chan struct{})}
+		g.inflight = result
+		go func() {
+			result.families, result.err = g.gatherer.Gather()
+			g.mutex.Lock()
+			g.inflight = nil
+			g.mutex.Unlock()
+			close(result.done)
+		}()
+	}
+	g.mutex.Unlock()
+	select {
+	case <-result.done:
+		return result.families, result.err
+	case <-time.After(g.timeout):
+		g.timeouts.Inc()
+		return nil, fmt.Errorf("timed out gathering metrics after %s", g.timeout)
+	}
+}
+
+// promLogger adapts our logger for promhttp to log errors to.
+type promLogger struct{}
+
+func (l promLogger) Println(v ...interface{}) {
+	log.Warning("%s", fmt.Sprintln(v...))
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A slowCollector blocks collecting until it's released.
+type slowCollector struct {
+	release chan struct{}
+	desc    *prometheus.Desc
+}
+
+func (c *slowCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *slowCollector) Collect(ch chan<- prometheus.Metric) {
+	<-c.release
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1)
+}
+
+func TestMetricsHandlerTimesOut(t *testing.T) {
+	registry := NewRegistry()
+	slow := &slowCollector{
+		release: make(chan struct{}),
+		desc:    prometheus.NewDesc("plz_cache_test_slow", "A slow metric", nil, nil),
+	}
+	registry.MustRegister(slow)
+	s := httptest.NewServer(MetricsHandler(registry, 50*time.Millisecond))
+	defer s.Close()
+
+	start := time.Now()
+	resp, err := http.Get(s.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.True(t, time.Since(start) < 5*time.Second, "Should not have waited for the collector")
+
+	// Serving carries on as normal while the collector is stuck.
+	c := newCache("test_metrics_timeout")
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("test")))
+	_, err = c.RetrieveArtifact("linux_amd64/pkg/target/hash/file")
+	assert.NoError(t, err)
+
+	// Once it's released, metrics are served again.
+	close(slow.release)
+	time.Sleep(10 * time.Millisecond)
+	resp, err = http.Get(s.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestMetricsHandlerSharesGather(t *testing.T) {
+	gatherer := &countingGatherer{release: make(chan struct{})}
+	g := &timeoutGatherer{gatherer: gatherer, timeout: 10 * time.Millisecond, timeouts: prometheus.NewCounter(prometheus.CounterOpts{Name: "timeouts"})}
+	for i := 0; i < 5; i++ {
+		_, err := g.Gather()
+		assert.Error(t, err)
+	}
+	close(gatherer.release)
+	assert.Equal(t, 1, gatherer.calls, "Only one gather should have been started while it was stuck")
+}
+
+// A countingGatherer counts how many times it's called, and blocks until released.
+type countingGatherer struct {
+	release chan struct{}
+	calls   int
+}
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.calls++
+	<-g.release
+	return nil, nil
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/djherbis/atime"
+
+	"core"
+	"tools/cache/audit"
+)
+
+// A MigrationReport describes the progress of migrating the artifacts in one cache to another.
+type MigrationReport struct {
+	// Files is the number of files found in the source, and Bytes their total (unsealed) size.
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Copied is the number of files stored in the destination, and Skipped the number that were
+	// already there with the same contents (e.g. from an earlier, interrupted, migration).
+	Copied  int64 `json:"copied"`
+	Skipped int64 `json:"skipped"`
+	// Verified is the number of files the destination has with the same contents as the source,
+	// and VerifiedBytes their total size. They match Files and Bytes if the migration succeeded.
+	Verified      int64 `json:"verified"`
+	VerifiedBytes int64 `json:"verified_bytes"`
+	// Expired is the number of sets of artifacts that weren't migrated because they've passed their expiry.
+	Expired int64 `json:"expired"`
+	// Failed describes each file that couldn't be migrated.
+	Failed []string `json:"failed,omitempty"`
+	// Remaining is the number of sets of artifacts that MigrateLayout still has to move.
+	Remaining int64 `json:"remaining"`
+}
+
+// OK returns true if everything in the source was found in the destination at the end of the migration.
+func (report *MigrationReport) OK() bool {
+	return len(report.Failed) == 0 && report.Verified == report.Files && report.VerifiedBytes == report.Bytes
+}
+
+// OpenCache opens the cache in the given directory without starting the cleaner, for tools that
+// work on a cache that isn't being served.
+func OpenCache(path string) *Cache {
+	return newCache(path)
+}
+
+// Migrate stores every artifact in the source cache into the destination, which can have a different
+// layout, encryption, compression or storage backend, and checks that its contents match afterwards.
+// The artifacts' build keys, shadow keys, expiries and metadata go with them, as do the times they
+// were last read, so the destination cleans them in the same order the source would have.
+// Anything the destination already has with the same contents is skipped, so an interrupted
+// migration can be run again to finish it. progress, if given, is called after each file.
+// Nothing is removed from the source.
+func Migrate(src, dst *Cache, progress func(*MigrationReport)) *MigrationReport {
+	report := &MigrationReport{}
+	srcLayout, dstLayout := src.Layout(), dst.Layout()
+	var srcDir, dstDir string // The artifact directory we're currently in, and where it goes.
+	filepath.Walk(src.rootPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", name, err))
+			}
+			return nil
+		} else if name == src.rootPath {
+			return nil
+		}
+		key := name[len(src.rootPath)+1:]
+		if info.IsDir() {
+			if !core.PathExists(path.Join(name, metadataFileName)) {
+				return nil
+			} else if src.expiries.expired(key, src.now()) {
+				report.Expired++
+				return filepath.SkipDir
+			}
+			srcDir, dstDir = key, relayout(srcLayout, dstLayout, key)
+			if err := src.migrateDir(dst, srcLayout, dstLayout, srcDir, dstDir); err != nil {
+				report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", key, err))
+				return filepath.SkipDir
+			}
+			return nil
+		} else if isUntracked(info.Name()) {
+			return nil
+		}
+		dstKey := key
+		if srcDir != "" && strings.HasPrefix(key, srcDir+"/") {
+			dstKey = dstDir + key[len(srcDir):]
+		}
+		src.migrateFile(dst, key, dstKey, report)
+		if progress != nil {
+			progress(report)
+		}
+		return nil
+	})
+	return report
+}
+
+// relayout returns the directory that the artifacts in the given directory of one layout go in
+// in another. Directories that aren't in the first layout stay where they are.
+func relayout(from, to *Layout, dir string) string {
+	if from.String() != to.String() {
+		if system, arch, pkg, target, hash, ok := from.Parse(dir); ok {
+			return to.ArtifactDir(system, arch, pkg, target, hash)
+		}
+	}
+	return dir
+}
+
+// migrateDir stores the information about the artifacts in the given directory in the
+// destination cache's directory for them, before the artifacts themselves are.
+// The layouts are the source's and destination's, which the shadow key is translated between.
+func (cache *Cache) migrateDir(dst *Cache, from, to *Layout, srcDir, dstDir string) error {
+	if expiry, present := cache.expiries.get(srcDir); present {
+		if err := dst.StoreExpiry(dstDir, expiry); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(path.Join(dst.rootPath, dstDir), core.DirPermissions); err != nil {
+		return err
+	} else if buildKey := cache.readBuildKey(srcDir); buildKey != "" {
+		if err := dst.StoreBuildKey(dstDir, buildKey); err != nil {
+			return err
+		}
+	}
+	if shadowKey := cache.readShadowKey(srcDir); shadowKey != "" {
+		if err := dst.StoreShadowKey(dstDir, relayout(from, to, shadowKey)); err != nil {
+			return err
+		}
+	}
+	b, err := ioutil.ReadFile(path.Join(cache.rootPath, srcDir, metadataFileName))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dst.rootPath, dstDir, metadataFileName), b, 0644)
+}
+
+// migrateFile stores the file with the given key in the destination cache under the given key,
+// unless it already has it, and records the outcome in the given report.
+func (cache *Cache) migrateFile(dst *Cache, key, dstKey string, report *MigrationReport) {
+	fail := func(err error) {
+		report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", key, err))
+	}
+	report.Files++
+	dstKey = dst.normalize(dstKey)
+	srcPath, dstPath := path.Join(cache.rootPath, key), path.Join(dst.rootPath, dstKey)
+	if dst.Contains(dstKey) {
+		hash, size, err := cache.hashArtifact(srcPath)
+		if err != nil {
+			fail(err)
+			return
+		}
+		report.Bytes += size
+		if dstHash, dstSize, err := dst.hashArtifact(dstPath); err == nil && dstHash == hash && dstSize == size {
+			report.Skipped++
+			report.Verified++
+			report.VerifiedBytes += size
+			return
+		}
+		log.Warning("%s is already in the destination with different contents, replacing it", dstKey)
+		report.Bytes -= size
+	}
+	body, err := cache.readArtifact(srcPath)
+	if err != nil {
+		fail(err)
+		return
+	}
+	report.Bytes += int64(len(body))
+	if err := dst.StoreArtifact(dstKey, body); err != nil {
+		fail(err)
+		return
+	}
+	report.Copied++
+	lastRead, cost := cache.lastRead(key)
+	dst.setLastRead(dstKey, lastRead, cost)
+	sum := sha256.Sum256(body)
+	if dstHash, dstSize, err := dst.hashArtifact(dstPath); err != nil {
+		fail(err)
+	} else if dstHash != hex.EncodeToString(sum[:]) || dstSize != int64(len(body)) {
+		fail(fmt.Errorf("contents differ after storing it as %s", dstKey))
+	} else {
+		report.Verified++
+		report.VerifiedBytes += dstSize
+	}
+}
+
+// MigrateLayout moves the artifacts stored in the given layout into the cache's own, in place and
+// while it's being served. Until it's finished, artifacts that aren't in the cache's layout are
+// looked for in the old one too, so they can still be retrieved before they've been moved.
+// Each set of artifacts is copied and checked against the original before that's removed, so an
+// interrupted migration can be run again to finish it; anything already moved is left alone.
+// progress, if given, is called after each set. If any fail, the old layout is still read from
+// afterwards, so they're not lost and can be moved by running it again.
+func (cache *Cache) MigrateLayout(from *Layout, progress func(*MigrationReport)) *MigrationReport {
+	report := &MigrationReport{}
+	to := cache.Layout()
+	if from.String() == to.String() {
+		return report
+	}
+	cache.scheduleMutex.Lock()
+	cache.previousLayout = from
+	cache.scheduleMutex.Unlock()
+	dirs := cache.layoutDirs(from, to, report)
+	report.Remaining = int64(len(dirs))
+	log.Notice("Moving %d sets of artifacts from layout %s to %s", len(dirs), from, to)
+	cache.setLayoutMigration(report)
+	for _, dir := range dirs {
+		cache.moveDir(from, to, dir, report)
+		report.Remaining--
+		cache.setLayoutMigration(report)
+		if progress != nil {
+			progress(report)
+		}
+	}
+	if len(report.Failed) == 0 {
+		cache.scheduleMutex.Lock()
+		cache.previousLayout = nil
+		cache.scheduleMutex.Unlock()
+	}
+	return report
+}
+
+// layoutDirs returns the artifact directories that are in the given layout and not yet in the
+// cache's own. Ones that have passed their expiry are left for the cleaner.
+func (cache *Cache) layoutDirs(from, to *Layout, report *MigrationReport) []string {
+	dirs := []string{}
+	now := cache.now()
+	filepath.Walk(cache.rootPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || name == cache.rootPath || !core.PathExists(path.Join(name, metadataFileName)) {
+			return nil
+		}
+		key := name[len(cache.rootPath)+1:]
+		inFrom, inTo := inLayout(from, key), inLayout(to, key)
+		if inFrom && inTo {
+			// Some directories fit both, e.g. the default layout's for a target called "aG" looks
+			// like the sharded one's for its parent. The sharded layout's check that the shard matches
+			// the hash makes it much less likely to be a coincidence, so that one wins.
+			inFrom = strings.Contains(from.String(), "{shard}") && !strings.Contains(to.String(), "{shard}")
+		}
+		if inFrom {
+			if cache.expiries.expired(key, now) {
+				report.Expired++
+			} else {
+				dirs = append(dirs, key)
+			}
+			return filepath.SkipDir
+		} else if inTo {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs
+}
+
+// inLayout returns true if the given directory is one that the given layout puts artifacts in.
+func inLayout(l *Layout, dir string) bool {
+	system, arch, pkg, target, hash, ok := l.Parse(dir)
+	return ok && l.ArtifactDir(system, arch, pkg, target, hash) == dir
+}
+
+// moveDir moves the artifacts in the given directory from one layout to the other, and removes
+// the originals once they've all been verified where they've moved to.
+func (cache *Cache) moveDir(from, to *Layout, dir string, report *MigrationReport) {
+	dstDir := relayout(from, to, dir)
+	if err := cache.migrateDir(cache, from, to, dir, dstDir); err != nil {
+		report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", dir, err))
+		return
+	}
+	failed := len(report.Failed)
+	filepath.Walk(path.Join(cache.rootPath, dir), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", name, err))
+			}
+			return nil
+		} else if info.IsDir() || isUntracked(info.Name()) {
+			return nil
+		}
+		key := name[len(cache.rootPath)+1:]
+		cache.migrateFile(cache, key, dstDir+key[len(dir):], report)
+		return nil
+	})
+	if len(report.Failed) != failed {
+		log.Warning("Failed to move %s to %s, leaving it where it is", dir, dstDir)
+	} else if err := cache.deleteDirs(map[string]struct{}{dir: {}}, audit.Migrated); err != nil {
+		report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", dir, err))
+	}
+}
+
+// setLayoutMigration records the progress of MigrateLayout.
+func (cache *Cache) setLayoutMigration(report *MigrationReport) {
+	r := *report
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.layoutMigration = &r
+}
+
+// LayoutMigration returns the progress of MigrateLayout, or nil if it's not been run.
+func (cache *Cache) LayoutMigration() *MigrationReport {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.layoutMigration
+}
+
+// lastRead returns the time the file with the given key was last read, and its rebuild cost.
+func (cache *Cache) lastRead(key string) (time.Time, float64) {
+	if filei, present := cache.cachedFiles.Get(key); present {
+		file := filei.(*cachedFile)
+		file.RLock()
+		defer file.RUnlock()
+		return file.lastReadTime, file.cost
+	} else if info, err := os.Stat(path.Join(cache.rootPath, key)); err == nil {
+		return atime.Get(info), 0
+	}
+	return cache.now(), 0
+}
+
+// setLastRead sets the time the file with the given key was last read, on disk as well as in
+// the index, and its rebuild cost.
+func (cache *Cache) setLastRead(key string, lastRead time.Time, cost float64) {
+	filei, present := cache.cachedFiles.Get(key)
+	if !present {
+		return
+	}
+	file := filei.(*cachedFile)
+	file.Lock()
+	defer file.Unlock()
+	file.lastReadTime = lastRead
+	file.persistedReadTime = lastRead
+	file.cost = cost
+	cache.writeAccessTime(key, lastRead)
+}
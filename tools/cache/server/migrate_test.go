@@ -0,0 +1,176 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "cache/proto/rpc_cache"
+	"core"
+)
+
+// newMigrationSource returns a cache with two sets of artifacts in it, one of them expired.
+func newMigrationSource(t *testing.T) *Cache {
+	c := newCache("test_migrate_src")
+	dir := "linux_amd64/src/core/core/aGFzaA"
+	require.NoError(t, c.StoreArtifact(dir+"/core.a", []byte("archive")))
+	require.NoError(t, c.StoreArtifact(dir+"/sub/core.h", []byte("header")))
+	require.NoError(t, c.StoreMetadata(dir, "host", "127.0.0.1", "peer"))
+	require.NoError(t, c.StoreBuildKey(dir, "bk1"))
+	require.NoError(t, c.StoreExpiry(dir, time.Now().Add(time.Hour)))
+	old := "linux_amd64/src/core/old/b2xk"
+	require.NoError(t, c.StoreArtifact(old+"/old.a", []byte("old")))
+	require.NoError(t, c.StoreMetadata(old, "host", "127.0.0.1", "peer"))
+	require.NoError(t, c.StoreExpiry(old, time.Now().Add(-time.Hour)))
+	return c
+}
+
+func TestMigrate(t *testing.T) {
+	src := newMigrationSource(t)
+	defer os.RemoveAll(src.rootPath)
+	lastRead := time.Now().AddDate(0, 0, -3).Truncate(time.Second)
+	src.setLastRead("linux_amd64/src/core/core/aGFzaA/core.a", lastRead, 2.5)
+	dst := newCache("test_migrate_dst")
+	defer os.RemoveAll(dst.rootPath)
+	require.NoError(t, dst.SetCompression("gzip", 0))
+	layout, err := NewLayout("by_package")
+	require.NoError(t, err)
+	dst.SetLayout(layout)
+
+	calls := 0
+	report := Migrate(src, dst, func(*MigrationReport) { calls++ })
+	assert.True(t, report.OK(), "%v", report.Failed)
+	assert.EqualValues(t, 2, report.Files)
+	assert.EqualValues(t, len("archive")+len("header"), report.Bytes)
+	assert.EqualValues(t, 2, report.Copied)
+	assert.EqualValues(t, 0, report.Skipped)
+	assert.EqualValues(t, 1, report.Expired)
+	assert.Equal(t, 2, calls)
+
+	dir := "src/core/core/linux_amd64/aGFzaA"
+	b, err := dst.readArtifact(path.Join(dst.rootPath, dir, "sub/core.h"))
+	require.NoError(t, err)
+	assert.Equal(t, "header", string(b))
+	assert.Equal(t, "bk1", dst.readBuildKey(dir))
+	_, present := dst.expiries.get(dir)
+	assert.True(t, present)
+	assert.True(t, core.PathExists(path.Join(dst.rootPath, dir, metadataFileName)))
+	assert.False(t, dst.Contains("src/core/old/linux_amd64/b2xk/old.a"), "Expired artifacts aren't migrated")
+
+	read, cost := dst.lastRead(dir + "/core.a")
+	assert.Equal(t, lastRead, read, "The last read time goes with it")
+	assert.Equal(t, 2.5, cost)
+}
+
+func TestMigrateResumes(t *testing.T) {
+	src := newMigrationSource(t)
+	defer os.RemoveAll(src.rootPath)
+	dst := newCache("test_migrate_resume")
+	defer os.RemoveAll(dst.rootPath)
+	require.NoError(t, dst.StoreArtifact("linux_amd64/src/core/core/aGFzaA/core.a", []byte("archive")))
+	require.NoError(t, dst.StoreArtifact("linux_amd64/src/core/core/aGFzaA/sub/core.h", []byte("wrong")))
+
+	report := Migrate(src, dst, nil)
+	assert.True(t, report.OK(), "%v", report.Failed)
+	assert.EqualValues(t, 1, report.Skipped, "The archive was already there")
+	assert.EqualValues(t, 1, report.Copied, "The header is replaced since it differs")
+	assert.EqualValues(t, 2, report.Verified)
+
+	report = Migrate(src, dst, nil)
+	assert.True(t, report.OK(), "%v", report.Failed)
+	assert.EqualValues(t, 2, report.Skipped, "Running it again has nothing left to do")
+	assert.EqualValues(t, 0, report.Copied)
+}
+
+func TestMigrateLayout(t *testing.T) {
+	c := newMigrationSource(t)
+	defer os.RemoveAll(c.rootPath)
+	oldDir, dir := "linux_amd64/src/core/core/aGFzaA", "linux_amd64/src/core/core/aG/aGFzaA"
+	require.NoError(t, c.StoreShadowKey(oldDir, "linux_amd64/src/core/core/c2hhZG93"))
+	sharded, err := NewLayout("sharded")
+	require.NoError(t, err)
+	c.SetLayout(sharded)
+
+	calls := 0
+	report := c.MigrateLayout(defaultLayout, func(r *MigrationReport) {
+		calls++
+		assert.NotNil(t, c.currentPreviousLayout(), "The old layout is read from until it's finished")
+	})
+	assert.True(t, report.OK(), "%v", report.Failed)
+	assert.EqualValues(t, 2, report.Files)
+	assert.EqualValues(t, 2, report.Copied)
+	assert.EqualValues(t, 1, report.Expired)
+	assert.EqualValues(t, 0, report.Remaining)
+	assert.Equal(t, 1, calls)
+	assert.Nil(t, c.currentPreviousLayout())
+	assert.Equal(t, report, c.LayoutMigration())
+
+	b, err := c.readArtifact(path.Join(c.rootPath, dir, "sub/core.h"))
+	require.NoError(t, err)
+	assert.Equal(t, "header", string(b))
+	assert.Equal(t, "bk1", c.readBuildKey(dir))
+	assert.Equal(t, "linux_amd64/src/core/core/c2/c2hhZG93", c.readShadowKey(dir), "The shadow key is in the new layout too")
+	_, present := c.expiries.get(dir)
+	assert.True(t, present)
+	assert.True(t, core.PathExists(path.Join(c.rootPath, dir, metadataFileName)))
+	assert.False(t, core.PathExists(path.Join(c.rootPath, oldDir)), "The original is removed")
+	assert.False(t, c.Contains(oldDir+"/core.a"))
+	assert.EqualValues(t, len("archive")+len("header")+len("old"), c.TotalSize())
+
+	report = c.MigrateLayout(defaultLayout, nil)
+	assert.True(t, report.OK(), "%v", report.Failed)
+	assert.EqualValues(t, 0, report.Files, "Running it again has nothing left to do")
+}
+
+func TestMigrateLayoutResumes(t *testing.T) {
+	c := newMigrationSource(t)
+	defer os.RemoveAll(c.rootPath)
+	sharded, err := NewLayout("sharded")
+	require.NoError(t, err)
+	c.SetLayout(sharded)
+	// As if it had been interrupted after moving the first file.
+	require.NoError(t, c.StoreArtifact("linux_amd64/src/core/core/aG/aGFzaA/core.a", []byte("archive")))
+
+	report := c.MigrateLayout(defaultLayout, nil)
+	assert.True(t, report.OK(), "%v", report.Failed)
+	assert.EqualValues(t, 1, report.Skipped)
+	assert.EqualValues(t, 1, report.Copied)
+	assert.False(t, core.PathExists(path.Join(c.rootPath, "linux_amd64/src/core/core/aGFzaA")))
+}
+
+func TestReadsCheckPreviousLayout(t *testing.T) {
+	c := newMigrationSource(t)
+	defer os.RemoveAll(c.rootPath)
+	sharded, err := NewLayout("sharded")
+	require.NoError(t, err)
+	c.SetLayout(sharded)
+	r := &RPCCacheServer{cache: c}
+	artifacts := []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a"}}
+	_, err = r.retrieve(&pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+	assert.Equal(t, codes.NotFound, grpc.Code(err), "Artifacts in another layout aren't found unless they're being migrated")
+
+	// As MigrateLayout does while it's running.
+	c.previousLayout = defaultLayout
+	resp, err := r.retrieve(&pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+	require.NoError(t, err)
+	assert.Equal(t, []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a", Body: []byte("archive")}}, resp.Artifacts)
+	exists, err := r.exists(&pb.ExistsRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+	require.NoError(t, err)
+	assert.True(t, exists.Exists)
+	assert.Equal(t, "core.a", exists.Artifacts[0].File)
+
+	assert.True(t, deleteArtifact(c, "linux", "amd64", artifacts))
+	assert.False(t, core.PathExists(path.Join(c.rootPath, "linux_amd64/src/core/core")), "Deleting a target deletes it from both layouts")
+}
+
+func TestMigrationReportOK(t *testing.T) {
+	assert.True(t, (&MigrationReport{Files: 1, Bytes: 10, Verified: 1, VerifiedBytes: 10}).OK())
+	assert.False(t, (&MigrationReport{Files: 2, Bytes: 10, Verified: 1, VerifiedBytes: 10}).OK())
+	assert.False(t, (&MigrationReport{Files: 1, Bytes: 10, Verified: 1, VerifiedBytes: 10, Failed: []string{"x"}}).OK())
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"path"
+	"sync/atomic"
+)
+
+// mirrorQueueSize is the maximum number of writes we queue up for the mirror.
+const mirrorQueueSize = 10000
+
+// mirrorMaxBacklog is the maximum total size of the writes queued for the mirror, in bytes.
+// Beyond either limit further writes are dropped rather than holding up the clients storing them.
+const mirrorMaxBacklog = 512 * 1024 * 1024
+
+// A mirrorWrite is a single artifact waiting to be written to the mirror.
+type mirrorWrite struct {
+	path      string
+	contents  []byte
+	algorithm *checksumAlgorithm
+}
+
+// A mirror copies every artifact we store to a second directory in the background.
+// It has the same layout as the cache directory, so it can be used to seed a new cache if this
+// one is lost. Nothing is ever removed from it; it's up to whatever manages it to do so.
+type mirror struct {
+	root    string
+	writes  chan mirrorWrite
+	backlog int64
+	metrics *cacheMetrics
+}
+
+// newMirror creates a new mirror writing into the given directory and starts its worker.
+// It's counted in the given metrics.
+func newMirror(root string, metrics *cacheMetrics) *mirror {
+	m := &mirror{
+		root:    root,
+		writes:  make(chan mirrorWrite, mirrorQueueSize),
+		metrics: metrics,
+	}
+	go m.run()
+	return m
+}
+
+// Enqueue adds an artifact to be written to the mirror. It returns false if it was dropped
+// because the backlog is full. Its checksum is written with the given algorithm.
+// The contents must not be modified afterwards.
+func (m *mirror) Enqueue(artPath string, contents []byte, algorithm *checksumAlgorithm) bool {
+	size := int64(len(contents))
+	if atomic.AddInt64(&m.backlog, size) > mirrorMaxBacklog {
+		atomic.AddInt64(&m.backlog, -size)
+		m.metrics.mirrorDropped.Inc()
+		return false
+	}
+	select {
+	case m.writes <- mirrorWrite{path: artPath, contents: contents, algorithm: algorithm}:
+		m.metrics.mirrorBacklog.Add(float64(size))
+		return true
+	default:
+		atomic.AddInt64(&m.backlog, -size)
+		m.metrics.mirrorDropped.Inc()
+		return false
+	}
+}
+
+// idle returns true if there are no writes waiting for the mirror. It's always true for a nil mirror.
+func (m *mirror) idle() bool {
+	return m == nil || (atomic.LoadInt64(&m.backlog) == 0 && len(m.writes) == 0)
+}
+
+// run runs the mirror's worker, forever.
+// There's only one so writes to the same artifact land in the order they were stored.
+func (m *mirror) run() {
+	for w := range m.writes {
+		m.write(w)
+	}
+}
+
+// write writes a single artifact to the mirror.
+func (m *mirror) write(w mirrorWrite) {
+	size := int64(len(w.contents))
+	defer func() {
+		atomic.AddInt64(&m.backlog, -size)
+		m.metrics.mirrorBacklog.Sub(float64(size))
+	}()
+	fullPath := path.Join(m.root, w.path)
+	if err := writeArtifact(fullPath, w.contents, w.algorithm); err != nil {
+		log.Warning("Failed to write %s to mirror: %s", fullPath, err)
+		m.metrics.mirrorFailures.Inc()
+		return
+	}
+	m.metrics.mirrorWrites.Inc()
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirror(t *testing.T) {
+	const dir = "test_mirror"
+	c := newCache("test_mirror_cache")
+	c.SetMirror(dir)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("test")))
+	var contents []byte
+	for i := 0; i < 50 && contents == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		contents, _ = ioutil.ReadFile(dir + "/linux_amd64/pkg/target/hash/file")
+	}
+	assert.Equal(t, "test", string(contents))
+}
+
+func TestMirrorBacklogFull(t *testing.T) {
+	// No worker, so nothing is taken off the queue.
+	m := &mirror{writes: make(chan mirrorWrite, 2), metrics: newCacheMetrics()}
+	assert.True(t, m.Enqueue("a", []byte("test"), defaultChecksumAlgorithm))
+	assert.True(t, m.Enqueue("b", []byte("test"), defaultChecksumAlgorithm))
+	assert.False(t, m.Enqueue("c", []byte("test"), defaultChecksumAlgorithm), "Queue is full")
+	<-m.writes
+	assert.False(t, m.Enqueue("d", make([]byte, mirrorMaxBacklog), defaultChecksumAlgorithm), "Too large for the backlog")
+	assert.True(t, m.Enqueue("e", []byte("test"), defaultChecksumAlgorithm))
+	assert.EqualValues(t, 12, m.backlog, "Nothing has been written so the first two are still counted")
+}
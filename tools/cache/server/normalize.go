@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A KeyNormalizer rewrites an artifact path into a canonical form, so paths that differ only in
+// trivial ways map onto the same artifact. It must be idempotent, since a path can be normalized
+// more than once on its way through the cache.
+type KeyNormalizer func(artPath string) string
+
+// keyNormalizations are the normalizers that can be enabled by name. They're always applied in
+// this order, since some aren't idempotent after the others (e.g. separators can leave a trailing slash).
+var keyNormalizations = []struct {
+	name      string
+	normalize KeyNormalizer
+}{
+	// separators converts backslashes to slashes and collapses repeated ones.
+	{"separators", normalizeSeparators},
+	// trailing_slash removes any slashes at the end of the path.
+	{"trailing_slash", func(artPath string) string { return strings.TrimRight(artPath, "/") }},
+	// lowercase folds the whole path to lower case. This includes the hash, so it makes
+	// collisions between artifacts slightly more likely.
+	{"lowercase", strings.ToLower},
+}
+
+// normalizeSeparators converts backslashes in the given path to slashes and collapses runs of them.
+func normalizeSeparators(artPath string) string {
+	artPath = strings.Replace(artPath, `\`, "/", -1)
+	for strings.Contains(artPath, "//") {
+		artPath = strings.Replace(artPath, "//", "/", -1)
+	}
+	return artPath
+}
+
+// KeyNormalizations returns a normalizer that applies each of the named normalizations.
+// The names recognised are separators, trailing_slash and lowercase; they're applied in that
+// order whatever order they're given in. It returns nil if none are given.
+func KeyNormalizations(names []string) (KeyNormalizer, error) {
+	enabled := map[string]bool{}
+	for _, name := range names {
+		enabled[name] = true
+	}
+	normalizers := []KeyNormalizer{}
+	for _, n := range keyNormalizations {
+		if enabled[n.name] {
+			normalizers = append(normalizers, n.normalize)
+			delete(enabled, n.name)
+		}
+	}
+	for name := range enabled {
+		return nil, fmt.Errorf("unknown key normalization %s", name)
+	}
+	if len(normalizers) == 0 {
+		return nil, nil
+	}
+	return func(artPath string) string {
+		for _, n := range normalizers {
+			artPath = n(artPath)
+		}
+		return artPath
+	}, nil
+}
+
+// SetKeyNormalizer sets a normalizer that's applied to every artifact path given to the cache,
+// when storing, retrieving, deleting or otherwise looking up artifacts. By default paths are used
+// as given. It should be set before serving; artifacts already stored under a path that doesn't
+// normalize to itself can't be found once it's set.
+func (cache *Cache) SetKeyNormalizer(normalize KeyNormalizer) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.keyNormalizer = normalize
+}
+
+// normalize returns the canonical form of the given artifact path.
+func (cache *Cache) normalize(artPath string) string {
+	cache.scheduleMutex.Lock()
+	normalize := cache.keyNormalizer
+	cache.scheduleMutex.Unlock()
+	if normalize == nil {
+		return artPath
+	}
+	return normalize(artPath)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyNormalizationsAreIdempotent(t *testing.T) {
+	paths := []string{
+		"linux_amd64/pkg/target/hash/file",
+		`linux_amd64\pkg\\target/hash//file\`,
+		"Linux_AMD64/Pkg/Target/HASH/File///",
+		`/\/`,
+		"",
+	}
+	names := []string{"separators", "trailing_slash", "lowercase"}
+	// Try every combination, in both orders.
+	for i := 0; i < 1<<uint(len(names)); i++ {
+		enabled := []string{}
+		for j, name := range names {
+			if i&(1<<uint(j)) != 0 {
+				enabled = append(enabled, name)
+			}
+		}
+		for _, order := range [][]string{enabled, reversed(enabled)} {
+			normalize, err := KeyNormalizations(order)
+			require.NoError(t, err)
+			if normalize == nil {
+				assert.Equal(t, 0, len(order))
+				continue
+			}
+			for _, p := range paths {
+				once := normalize(p)
+				assert.Equal(t, once, normalize(once), "normalizing %q with %v", p, order)
+			}
+		}
+	}
+}
+
+func TestKeyNormalizations(t *testing.T) {
+	normalize, err := KeyNormalizations([]string{"trailing_slash", "separators"})
+	require.NoError(t, err)
+	assert.Equal(t, "linux_amd64/pkg/target/hash", normalize(`linux_amd64\pkg//target\hash\`))
+	assert.Equal(t, "Hash", normalize("Hash"), "Case isn't changed unless asked")
+	_, err = KeyNormalizations([]string{"separators", "wibble"})
+	assert.Error(t, err)
+}
+
+func TestKeyNormalizerDefaultsToNoOp(t *testing.T) {
+	c := newCache("test_key_normalizer_default")
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("test")))
+	assert.False(t, c.Contains("linux_amd64/pkg//target/hash/file"))
+	_, err := c.RetrieveArtifact("linux_amd64/pkg//target/hash/file")
+	assert.Error(t, err)
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	c := newCache("test_key_normalizer")
+	normalize, err := KeyNormalizations([]string{"separators", "trailing_slash"})
+	require.NoError(t, err)
+	c.SetKeyNormalizer(normalize)
+
+	require.NoError(t, c.StoreArtifact(`linux_amd64\pkg\target\hash\file`, []byte("test")))
+	require.NoError(t, c.StoreMetadata("linux_amd64/pkg/target//hash/", "host", "127.0.0.1", ""))
+	assert.True(t, c.Contains("linux_amd64/pkg/target/hash/file"))
+	assert.True(t, c.Contains("linux_amd64//pkg/target/hash/"))
+	arts, err := c.RetrieveArtifact("linux_amd64/pkg//target/hash/file")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"linux_amd64/pkg/target/hash/file": []byte("test")}, arts)
+	stats, err := c.StatArtifact(`linux_amd64\pkg\target\hash\file`)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(stats))
+	f, done, err := c.OpenArtifact("linux_amd64/pkg/target/hash//file")
+	require.NoError(t, err)
+	f.Close()
+	done()
+
+	c.AddAlias(`linux_amd64\pkg\target\hash`, "linux_amd64/pkg/target/alias/")
+	alias, present := c.ResolveAlias("linux_amd64/pkg/target/hash/")
+	assert.True(t, present)
+	assert.Equal(t, "linux_amd64/pkg/target/alias", alias)
+
+	require.NoError(t, c.DeleteArtifact(`linux_amd64\pkg\target\hash\`))
+	assert.False(t, c.Contains("linux_amd64/pkg/target/hash/file"))
+}
+
+// reversed returns a reversed copy of the given slice.
+func reversed(s []string) []string {
+	ret := make([]string, len(s))
+	for i, x := range s {
+		ret[len(s)-1-i] = x
+	}
+	return ret
+}
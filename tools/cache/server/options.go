@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"tools/cache/oplog"
+)
+
+// ServerOptions configure a cache and the servers that serve it: the RPC server (see
+// BuildGrpcServer), the REST gateway (see BuildGateway) and the HTTP cache (see BuildRouter).
+// Each takes the ones that apply to it. The zero value turns them all off.
+type ServerOptions struct {
+	// MaxIndexEntries is the maximum number of files NewCache tracks in memory. Beyond that, the
+	// least recently read files are dropped from the index and their metadata looked up from disk
+	// again if they're needed. Note that files dropped from the index lose their read count and
+	// rebuild cost. Zero means no limit.
+	MaxIndexEntries int
+	// BackgroundScan makes NewCache return straight away and scan the cache directory in the
+	// background, instead of building the index first, so a very large cache can serve as soon as
+	// it starts. Until the scan's finished, files that aren't in the index yet are looked up on
+	// disk, the cleaner waits, MaxIndexEntries isn't applied, and expiries, build keys and shadow
+	// keys that haven't been found yet don't take effect.
+	BackgroundScan bool
+	// ScanParallelism is the number of directories NewCache reads at once while scanning the
+	// cache directory. Very large caches on disks that handle concurrent reads well scan much
+	// faster with more. Zero means the default of 8.
+	ScanParallelism int
+	// MaxArtifactSize limits the size in bytes of any single artifact that's stored, over gRPC, the
+	// REST gateway or the HTTP cache. Stores of anything larger are rejected before any of it is
+	// written. Zero means no limit beyond the maximum message size.
+	MaxArtifactSize int64
+	// TransferBudget limits the memory buffered by the stores & retrieves in progress over gRPC and
+	// the REST gateway (see NewMemoryBudget). Servers given the same one share it. If it's nil
+	// there's no limit.
+	TransferBudget *MemoryBudget
+	// StoreDedupWindow enables deduplication of identical stores over gRPC. Stores of the same
+	// artifacts with the same contents that arrive while one is in progress, or within this window
+	// after it succeeds, are treated as successful without being written again. This is intended
+	// to absorb clients retrying stores, so it should be short.
+	StoreDedupWindow time.Duration
+	// Node, Version and Zone are sent in the headers of each Store and Retrieve response over gRPC,
+	// so clients can report which node they talked to without another round trip. Any of them can
+	// be empty, in which case it's left out.
+	Node, Version, Zone string
+	// ShedLatency enables rejecting stores over gRPC while the disk is saturated, i.e. while the
+	// mean latency of the stores & retrieves handled over the last ShedWindow was above it. Stores
+	// with a rebuild cost above ShedMaxCost are still accepted, since they're the most valuable to
+	// keep; zero means all stores are shed. Retrieves and replication from other nodes are never
+	// shed. Load shedding is disabled if either duration is zero.
+	ShedLatency, ShedWindow time.Duration
+	ShedMaxCost             float64
+	// OperationLog, if set, records every Store, Retrieve & Delete RPC handled, so the traffic can
+	// be replayed later.
+	OperationLog *oplog.Log
+	// Faults, if set, injects faults into the RPC server for chaos testing (see NewFaultInjector).
+	Faults *FaultInjector
+	// Limits, if set, limits the number of stores & retrieves handled over gRPC at once (see
+	// NewConcurrencyLimiter).
+	Limits *ConcurrencyLimiter
+	// RestartTokenTTL is how long the REST gateway's POST /restart holds the cluster's restart token
+	// for if this node doesn't restart in that time (see cluster.RequestRestart).
+	RestartTokenTTL time.Duration
+	// BindAddr is the IP address the RPC server listens on (see ParseBindAddress). Nil means all
+	// interfaces.
+	BindAddr net.IP
+	// ListenBacklog and MaxConnections are the RPC server's listen backlog and maximum number of
+	// concurrent client connections. Zero means to use the system's default backlog, or to not
+	// limit connections, respectively.
+	ListenBacklog, MaxConnections int
+	// MaxConnectionIdle makes the RPC server close client connections that haven't had any RPCs
+	// for this long. gRPC sends them a GOAWAY first, so well-behaved clients don't fail any calls
+	// and just reconnect when they next need to. Zero means they're never closed.
+	MaxConnectionIdle time.Duration
+	// AllowCompression enables gzip compression for RPCs that request it (see registerCompressor)
+	// and advertises it to clients.
+	AllowCompression bool
+	// CertReloader, if set, gives the RPC server its TLS key and certificates instead of the ones
+	// passed to BuildGrpcServer, so they can change while it's serving (see NewCertReloader).
+	CertReloader *CertReloader
+	// KeyReloadSignals make the RPC server and REST gateway reload their readonly and writable
+	// certificates whenever the process receives one of them, as well as when they notice them
+	// change.
+	KeyReloadSignals []os.Signal
+	// Servers, if set, has the RPC server added to it so it can be shut down gracefully along
+	// with any others in it (see ServerGroup).
+	Servers *ServerGroup
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"core"
+)
+
+// partialSuffix is appended to the name of an artifact to get the name of the file it's written
+// to before being moved into place.
+//
+// Writing to a separate file first means an artifact is never seen half-written, but if we're
+// killed partway through (or before the rename), that file is left behind. The suffix lets us
+// recognise those: they're never served, and are removed when the cache is scanned at startup.
+const partialSuffix = ".plz_partial"
+
+// isPartial returns true if the given file is an artifact that's being (or was being) written.
+func isPartial(name string) bool {
+	return strings.HasSuffix(name, partialSuffix)
+}
+
+// writeFileAtomically writes the given contents to the given path, via a partial file so that
+// nothing else sees it until it's complete.
+func writeFileAtomically(fullPath string, contents []byte) error {
+	if err := os.MkdirAll(path.Dir(fullPath), core.DirPermissions); err != nil {
+		return err
+	}
+	// The caller holds the lock for this artifact, so nothing else is writing the same partial file.
+	partial := fullPath + partialSuffix
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		os.Remove(partial)
+		return err
+	} else if err := f.Close(); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	// If there's a directory in the way (e.g. the artifact used to be one), it has to go first.
+	if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+		if err := os.RemoveAll(fullPath); err != nil {
+			os.Remove(partial)
+			return err
+		}
+	}
+	if err := os.Rename(partial, fullPath); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return nil
+}
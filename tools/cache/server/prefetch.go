@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/base64"
+	"path"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// prefetchConcurrency is the number of prefetches we run at once.
+const prefetchConcurrency = 4
+
+// prefetchQueueSize is the maximum number of prefetches we queue up; any beyond that are dropped.
+const prefetchQueueSize = 1000
+
+// prefetchTimeout is the time we allow to fetch each set of artifacts from another node.
+const prefetchTimeout = 30 * time.Second
+
+// A fetchFunc retrieves a set of artifacts from elsewhere, typically another node in the cluster.
+// It returns nil if they couldn't be retrieved.
+type fetchFunc func(ctx context.Context, req *pb.RetrieveRequest) *pb.RetrieveResponse
+
+// A prefetcher fetches artifacts in the background so they're already stored locally
+// by the time a client asks for them.
+type prefetcher struct {
+	cache    *Cache
+	fetch    fetchFunc
+	requests chan *pb.RetrieveRequest
+}
+
+// newPrefetcher creates a new prefetcher and starts the given number of workers for it.
+func newPrefetcher(cache *Cache, fetch fetchFunc, concurrency int) *prefetcher {
+	p := &prefetcher{
+		cache:    cache,
+		fetch:    fetch,
+		requests: make(chan *pb.RetrieveRequest, prefetchQueueSize),
+	}
+	for i := 0; i < concurrency; i++ {
+		go p.run()
+	}
+	return p
+}
+
+// Enqueue adds a request to be prefetched. It returns false if the queue is full.
+func (p *prefetcher) Enqueue(req *pb.RetrieveRequest) bool {
+	select {
+	case p.requests <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// run runs a single prefetch worker, forever.
+func (p *prefetcher) run() {
+	for req := range p.requests {
+		p.prefetch(req)
+	}
+}
+
+// prefetch fetches a single set of artifacts, if we don't already have them.
+func (p *prefetcher) prefetch(req *pb.RetrieveRequest) {
+	if p.cache.AboveHighWaterMark() {
+		// No point fetching things just for the cleaner to remove them again.
+		log.Debug("Not prefetching, cache is above its high water mark")
+		return
+	} else if p.haveAll(req) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+	resp := p.fetch(ctx, req)
+	if resp == nil || !resp.Success || len(resp.Artifacts) == 0 {
+		log.Debug("Failed to prefetch artifacts for %s", base64.RawURLEncoding.EncodeToString(req.Hash))
+		return
+	}
+	// Retrieve responses don't say what build key the artifacts were stored with, so these
+	// copies won't have one and so aren't removed by InvalidateByBuildKey. They do keep their expiry.
+	storeArtifact(p.cache, req.Os, req.Arch, req.Hash, resp.Artifacts, "", "", "", 0, "", resp.Expiry)
+}
+
+// haveAll returns true if we already have all the artifacts for the given request.
+func (p *prefetcher) haveAll(req *pb.RetrieveRequest) bool {
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	layout := p.cache.Layout()
+	for _, artifact := range req.Artifacts {
+		if !p.cache.Contains(path.Join(layout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash), artifact.File)) {
+			return false
+		}
+	}
+	return true
+}
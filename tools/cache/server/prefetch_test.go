@@ -0,0 +1,60 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestPrefetch(t *testing.T) {
+	c := newCache("test_prefetch")
+	fetched := make(chan *pb.RetrieveRequest, 10)
+	p := newPrefetcher(c, func(ctx context.Context, req *pb.RetrieveRequest) *pb.RetrieveResponse {
+		fetched <- req
+		return &pb.RetrieveResponse{
+			Success:   true,
+			Artifacts: []*pb.Artifact{{Package: "pkg", Target: "target", File: "file", Body: []byte("test")}},
+		}
+	}, 1)
+	req := &pb.RetrieveRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash"),
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "target", File: "file"}},
+	}
+	assert.True(t, p.Enqueue(req))
+	waitForFetch(t, fetched)
+	for i := 0; i < 50 && !c.Contains("linux_amd64/pkg/target/aGFzaA/file"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, c.Contains("linux_amd64/pkg/target/aGFzaA/file"))
+
+	// We have it now, so it shouldn't get fetched again.
+	p.prefetch(req)
+	assert.Equal(t, 0, len(fetched))
+
+	// Nor should anything be fetched while we're above the high water mark.
+	c.highWaterMark = 1
+	req.Hash = []byte("hash2")
+	p.prefetch(req)
+	assert.Equal(t, 0, len(fetched))
+	assert.False(t, c.Contains("linux_amd64/pkg/target/aGFzaDI/file"))
+}
+
+func TestPrefetchQueueFull(t *testing.T) {
+	p := &prefetcher{requests: make(chan *pb.RetrieveRequest, 1)}
+	assert.True(t, p.Enqueue(&pb.RetrieveRequest{}))
+	assert.False(t, p.Enqueue(&pb.RetrieveRequest{}))
+}
+
+func waitForFetch(t *testing.T, fetched <-chan *pb.RetrieveRequest) {
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Artifacts were not fetched")
+	}
+}
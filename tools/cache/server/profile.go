@@ -0,0 +1,74 @@
+package server
+
+import (
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// DumpProfilesOnSignal writes goroutine, heap and CPU profiles to the given directory whenever the
+// process receives SIGUSR2, so they can be captured without exposing pprof over the network.
+// The goroutine and heap profiles are written straight away; the CPU profile covers the given
+// duration from then. Each file is named for the type of profile and the time it was taken.
+// It isn't supported on Windows, which doesn't have the signal.
+func DumpProfilesOnSignal(dir string, cpuDuration time.Duration) {
+	if len(profileSignals) == 0 {
+		log.Warning("Dumping profiles on a signal isn't supported on this platform")
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, profileSignals...)
+	log.Notice("Will write profiles to %s on %s", dir, profileSignals[0])
+	go func() {
+		for range ch {
+			dumpProfiles(dir, cpuDuration, time.Now())
+		}
+	}()
+}
+
+// dumpProfiles writes a set of profiles to the given directory, using the given time in their names.
+// It returns once the goroutine & heap profiles are written; the CPU profile is written in the background.
+func dumpProfiles(dir string, cpuDuration time.Duration, now time.Time) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error("Failed to create profile directory: %s", err)
+		return
+	}
+	suffix := now.Format("20060102-150405") + ".pprof"
+	writeProfile(path.Join(dir, "goroutine-"+suffix), func(f *os.File) error {
+		return pprof.Lookup("goroutine").WriteTo(f, 0)
+	})
+	writeProfile(path.Join(dir, "heap-"+suffix), func(f *os.File) error {
+		runtime.GC() // Gets up-to-date statistics.
+		return pprof.WriteHeapProfile(f)
+	})
+	go writeProfile(path.Join(dir, "cpu-"+suffix), func(f *os.File) error {
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err // Most likely there's already one in progress.
+		}
+		time.Sleep(cpuDuration)
+		pprof.StopCPUProfile()
+		return nil
+	})
+}
+
+// writeProfile creates the given file and writes a profile to it with the given function.
+func writeProfile(filename string, write func(f *os.File) error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Error("Failed to create profile: %s", err)
+		return
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Error("Failed to write profile %s: %s", filename, err)
+		os.Remove(filename)
+		return
+	}
+	log.Notice("Wrote profile to %s", filename)
+}
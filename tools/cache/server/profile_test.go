@@ -0,0 +1,30 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpProfiles(t *testing.T) {
+	const dir = "test_dump_profiles"
+	now := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	dumpProfiles(dir, 10*time.Millisecond, now)
+	for _, name := range []string{"goroutine", "heap"} {
+		info, err := os.Stat(path.Join(dir, name+"-20200304-050607.pprof"))
+		if assert.NoError(t, err) {
+			assert.NotEqual(t, 0, info.Size())
+		}
+	}
+	// The CPU profile is written in the background.
+	for i := 0; i < 100; i++ {
+		if info, err := os.Stat(path.Join(dir, "cpu-20200304-050607.pprof")); err == nil && info.Size() > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("CPU profile was not written")
+}
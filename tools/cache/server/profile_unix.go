@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// profileSignals are the signals that trigger writing profiles.
+var profileSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,6 @@
+package server
+
+import "os"
+
+// profileSignals are the signals that trigger writing profiles. Windows doesn't have SIGUSR2.
+var profileSignals []os.Signal
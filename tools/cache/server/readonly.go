@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// runtimeReadOnlyReason is the reason given to clients for stores refused because we've been made
+// read-only by a request to the REST gateway, unless that gave its own.
+const runtimeReadOnlyReason = "set read-only at runtime"
+
+// A cacheMode describes whether the cache is currently serving reads & writes.
+type cacheMode struct {
+	Maintenance bool   `json:"maintenance"`
+	ReadOnly    bool   `json:"read_only"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// mode returns the cache's current mode.
+func (cache *Cache) mode() cacheMode {
+	reason := cache.ReadOnlyReason()
+	return cacheMode{Maintenance: cache.InMaintenance(), ReadOnly: reason != "", Reason: reason}
+}
+
+// readOnlyHandler handles a request to make the cache read-only, or writable again, at runtime.
+// Everything else carries on as normal, so it keeps serving retrieves.
+func (g *gateway) readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if !g.authorize(w, r, writable) {
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "Must pass enabled=true or enabled=false", http.StatusBadRequest)
+		return
+	}
+	if enabled {
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = runtimeReadOnlyReason
+		}
+		log.Warning("Refusing stores from now on: %s", reason)
+		g.server.cache.SetReadOnly(reason)
+	} else {
+		log.Notice("Accepting stores again")
+		g.server.cache.SetReadOnly("")
+	}
+	writeJSON(w, g.server.cache.mode())
+}
+
+// maintenanceHandler handles a request to put the cache into maintenance mode, or take it out
+// again, at runtime. If clustered, other nodes also stop replicating to this one while it's in it.
+func (g *gateway) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !g.authorize(w, r, writable) {
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "Must pass enabled=true or enabled=false", http.StatusBadRequest)
+		return
+	}
+	g.server.cache.SetMaintenance(enabled)
+	if g.server.cluster != nil {
+		g.server.cluster.SetMaintenance(enabled)
+	}
+	writeJSON(w, g.server.cache.mode())
+}
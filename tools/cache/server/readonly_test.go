@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatewayRequest sends a request to a handler and returns its response.
+func gatewayRequest(h http.Handler, method, url string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(string(body))))
+	return w
+}
+
+// modeRequest sends a request to a handler and returns the mode in its response.
+func modeRequest(t *testing.T, h http.Handler, method, url string) cacheMode {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	mode := cacheMode{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &mode))
+	return mode
+}
+
+func TestReadOnlyToggle(t *testing.T) {
+	c := newCache("test_read_only_toggle")
+	defer os.RemoveAll(c.rootPath)
+	h := BuildGateway(c, nil, "", "", ServerOptions{})
+	stats := c.StatsHandler()
+	assert.Equal(t, cacheMode{}, modeRequest(t, stats, http.MethodGet, "/stats/mode"))
+
+	mode := modeRequest(t, h, http.MethodPost, "/readonly?enabled=true")
+	assert.Equal(t, cacheMode{ReadOnly: true, Reason: runtimeReadOnlyReason}, mode)
+	assert.Equal(t, mode, modeRequest(t, stats, http.MethodGet, "/stats/mode"))
+	w := gatewayRequest(h, http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file.txt", []byte("hello"))
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code, "Stores are refused")
+
+	mode = modeRequest(t, h, http.MethodPost, "/readonly?enabled=true&reason=disk+maintenance")
+	assert.Equal(t, "disk maintenance", mode.Reason)
+
+	assert.Equal(t, cacheMode{}, modeRequest(t, h, http.MethodPost, "/readonly?enabled=false"))
+	w = gatewayRequest(h, http.MethodPut, "/artifact/linux_amd64/pkg/target/hash/file.txt", []byte("hello"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = gatewayRequest(h, http.MethodPost, "/readonly?enabled=wibble", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	c := newCache("test_maintenance_toggle")
+	defer os.RemoveAll(c.rootPath)
+	h := BuildGateway(c, nil, "", "", ServerOptions{})
+
+	mode := modeRequest(t, h, http.MethodPost, "/maintenance?enabled=true")
+	assert.Equal(t, cacheMode{Maintenance: true, ReadOnly: true, Reason: "maintenance mode"}, mode)
+	assert.True(t, c.InMaintenance())
+	w := gatewayRequest(h, http.MethodGet, "/artifact/linux_amd64/pkg/target/hash/file.txt", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "Retrieves are refused too")
+
+	assert.Equal(t, cacheMode{}, modeRequest(t, h, http.MethodPost, "/maintenance?enabled=false"))
+	assert.False(t, c.InMaintenance())
+
+	w = gatewayRequest(h, http.MethodPost, "/maintenance?enabled=wibble", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = gatewayRequest(h, http.MethodGet, "/maintenance", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code, "It can only be changed with POST")
+}
+
+func TestModeInMaintenance(t *testing.T) {
+	c := newCache("test_mode_in_maintenance")
+	defer os.RemoveAll(c.rootPath)
+	c.SetMaintenance(true)
+	assert.Equal(t, cacheMode{Maintenance: true, ReadOnly: true, Reason: "maintenance mode"}, c.mode())
+}
@@ -0,0 +1,28 @@
+package server
+
+import "net/http"
+
+// restartHandler handles a request from a deploy script to find out whether it's safe to restart
+// this node (see cluster.RequestRestart). POST takes the restart token if it is, and responds with
+// a conflict and the reason if it isn't; DELETE releases it again if we don't restart after all.
+// It's always safe when we're not clustered.
+func (g *gateway) restartHandler(w http.ResponseWriter, r *http.Request) {
+	if !g.authorize(w, r, writable) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method == http.MethodDelete {
+		if g.server.cluster != nil {
+			g.server.cluster.ReleaseRestart()
+		}
+		w.Write([]byte("Released restart token\n"))
+		return
+	}
+	if g.server.cluster != nil {
+		if safe, reason := g.server.cluster.RequestRestart(g.restartTokenTTL); !safe {
+			http.Error(w, "Not safe to restart: "+reason, http.StatusConflict)
+			return
+		}
+	}
+	w.Write([]byte("Safe to restart\n"))
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A StorageRoute says which artifacts a routed storage (see NewRoutedStorage) keeps in one of its backends.
+type StorageRoute struct {
+	// Name identifies the backend in logs and metrics.
+	Name string
+	// Storage is the backend the artifacts are kept in.
+	Storage Storage
+	// MinSize and MaxSize, if nonzero, are the smallest and largest artifacts (in bytes, as
+	// they're stored) that the route applies to.
+	MinSize, MaxSize int64
+	// Pattern, if set, is a glob that an artifact's file name has to match for the route to
+	// apply to it, e.g. *.jar. It's how a request hints at what type of artifact it has.
+	Pattern string
+	// LowWaterMark and HighWaterMark, if set, are what the backend is cleaned down to and at,
+	// instead of the cache's water marks.
+	LowWaterMark, HighWaterMark int64
+}
+
+// matches returns true if the route applies to the artifact with the given key and size.
+func (route *StorageRoute) matches(key string, size int64) bool {
+	return route.mayMatch(key) && size >= route.MinSize && (route.MaxSize == 0 || size <= route.MaxSize)
+}
+
+// mayMatch returns true if the route applies to the artifact with the given key at some size.
+func (route *StorageRoute) mayMatch(key string) bool {
+	if route.Pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(route.Pattern, path.Base(key))
+	return matched
+}
+
+// waterMarks returns the water marks to clean the route's backend to, given the cache's.
+func (route *StorageRoute) waterMarks(lowWaterMark, highWaterMark int64) (int64, int64) {
+	if route.HighWaterMark != 0 {
+		return route.LowWaterMark, route.HighWaterMark
+	}
+	return lowWaterMark, highWaterMark
+}
+
+// ParseStorageRoute parses a route given as name:kind:location[:options], where kind is dir or s3
+// and location is the directory or bucket to keep artifacts in; the rest of the S3 settings are
+// taken from the given config. options is a comma-separated list of min_size, max_size, pattern,
+// low_water_mark and high_water_mark, e.g. fast:dir:/mnt/ssd:max_size=1M,high_water_mark=100G.
+func ParseStorageRoute(spec string, s3 S3Config) (StorageRoute, error) {
+	parts := strings.SplitN(spec, ":", 4)
+	if len(parts) < 3 || parts[0] == "" || parts[2] == "" {
+		return StorageRoute{}, fmt.Errorf("storage route %s should be name:kind:location[:options]", spec)
+	}
+	route := StorageRoute{Name: parts[0]}
+	switch parts[1] {
+	case "dir":
+		route.Storage = NewDiskStorage(parts[2])
+	case "s3":
+		s3.Bucket = parts[2]
+		s3.Backend = route.Name
+		storage, err := NewS3Storage(s3)
+		if err != nil {
+			return StorageRoute{}, err
+		}
+		route.Storage = storage
+	default:
+		return StorageRoute{}, fmt.Errorf("unknown kind of storage %s in route %s, should be dir or s3", parts[1], spec)
+	}
+	if len(parts) < 4 {
+		return route, nil
+	}
+	for _, option := range strings.Split(parts[3], ",") {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return StorageRoute{}, fmt.Errorf("option %s in storage route %s should be name=value", option, spec)
+		} else if kv[0] == "pattern" {
+			route.Pattern = kv[1]
+			continue
+		}
+		var size *int64
+		switch kv[0] {
+		case "min_size":
+			size = &route.MinSize
+		case "max_size":
+			size = &route.MaxSize
+		case "low_water_mark":
+			size = &route.LowWaterMark
+		case "high_water_mark":
+			size = &route.HighWaterMark
+		default:
+			return StorageRoute{}, fmt.Errorf("unknown option %s in storage route %s", kv[0], spec)
+		}
+		b, err := humanize.ParseBytes(kv[1])
+		if err != nil {
+			return StorageRoute{}, fmt.Errorf("invalid %s in storage route %s: %s", kv[0], spec, err)
+		}
+		*size = int64(b)
+	}
+	return route, nil
+}
+
+// A routedStorage is a Storage that keeps each artifact in one of several backends.
+type routedStorage struct {
+	routes []StorageRoute
+}
+
+// NewRoutedStorage returns a Storage that keeps each artifact in the backend of the first of the
+// given routes that applies to it, so e.g. small artifacts can be kept on fast local disks and
+// large ones in cheaper bulk storage. The last route must apply to everything, so that every
+// artifact has somewhere to go. Artifacts are looked for in each backend they could be in, in
+// the order of the routes; since one that's stored again can be a different size, it's deleted
+// from the others then. Each backend is cleaned to its own route's water marks, if it has them.
+func NewRoutedStorage(routes []StorageRoute) (Storage, error) {
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no storage routes given")
+	}
+	names := map[string]bool{}
+	for _, route := range routes {
+		if route.Name == "" {
+			return nil, fmt.Errorf("storage routes must have names")
+		} else if names[route.Name] {
+			return nil, fmt.Errorf("storage route %s is given more than once", route.Name)
+		} else if _, err := path.Match(route.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s in storage route %s: %s", route.Pattern, route.Name, err)
+		} else if route.MaxSize != 0 && route.MaxSize < route.MinSize {
+			return nil, fmt.Errorf("storage route %s has a max size less than its min size", route.Name)
+		} else if route.LowWaterMark > route.HighWaterMark {
+			return nil, fmt.Errorf("storage route %s needs a high water mark at least as big as its low water mark", route.Name)
+		}
+		names[route.Name] = true
+	}
+	if last := routes[len(routes)-1]; last.Pattern != "" || last.MinSize != 0 || last.MaxSize != 0 {
+		return nil, fmt.Errorf("the last storage route (%s) must apply to every artifact", last.Name)
+	}
+	return &routedStorage{routes: routes}, nil
+}
+
+func (s *routedStorage) Get(key string) ([]byte, error) {
+	var lastErr error
+	for _, route := range s.candidates(key) {
+		contents, err := route.Storage.Get(key)
+		if err == nil {
+			return contents, nil
+		} else if !os.IsNotExist(err) {
+			// It might still be in one of the others.
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, os.ErrNotExist
+}
+
+func (s *routedStorage) Put(key string, contents []byte) error {
+	route := s.route(key, int64(len(contents)))
+	if err := route.Storage.Put(key, contents); err != nil {
+		return err
+	}
+	for _, other := range s.candidates(key) {
+		if other.Storage != route.Storage {
+			if err := other.Storage.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *routedStorage) Delete(key string) error {
+	for _, route := range s.candidates(key) {
+		if err := route.Storage.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *routedStorage) List(prefix string) ([]StorageEntry, error) {
+	ret := []StorageEntry{}
+	for _, route := range s.backends() {
+		entries, err := route.Storage.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entries...)
+	}
+	return ret, nil
+}
+
+func (s *routedStorage) Size() (int64, error) {
+	var total int64
+	for _, route := range s.backends() {
+		size, err := route.Storage.Size()
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// route returns the route for the artifact with the given key and size.
+func (s *routedStorage) route(key string, size int64) *StorageRoute {
+	for i := range s.routes {
+		if s.routes[i].matches(key, size) {
+			return &s.routes[i]
+		}
+	}
+	return &s.routes[len(s.routes)-1]
+}
+
+// candidates returns the routes for each of the backends that the artifact with the given key could be in.
+func (s *routedStorage) candidates(key string) []*StorageRoute {
+	ret := []*StorageRoute{}
+	seen := map[Storage]bool{}
+	for i := range s.routes {
+		if route := &s.routes[i]; !seen[route.Storage] && route.mayMatch(key) {
+			seen[route.Storage] = true
+			ret = append(ret, route)
+		}
+	}
+	return ret
+}
+
+// backends returns the first route for each of the distinct backends; more than one route can
+// send artifacts to the same one.
+func (s *routedStorage) backends() []*StorageRoute {
+	ret := []*StorageRoute{}
+	seen := map[Storage]bool{}
+	for i := range s.routes {
+		if route := &s.routes[i]; !seen[route.Storage] {
+			seen[route.Storage] = true
+			ret = append(ret, route)
+		}
+	}
+	return ret
+}
+
+// Describe implements the prometheus.Collector interface.
+func (s *routedStorage) Describe(ch chan<- *prometheus.Desc) {
+	for _, route := range s.backends() {
+		if c, ok := route.Storage.(prometheus.Collector); ok {
+			c.Describe(ch)
+		}
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (s *routedStorage) Collect(ch chan<- prometheus.Metric) {
+	for _, route := range s.backends() {
+		if c, ok := route.Storage.(prometheus.Collector); ok {
+			c.Collect(ch)
+		}
+	}
+}
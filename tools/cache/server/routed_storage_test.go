@@ -0,0 +1,129 @@
+package server
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTieredStorage returns a routed storage with a fast backend for small artifacts and a bulk
+// one for jars and everything else, and the two backends.
+func newTieredStorage(t *testing.T, dir string) (Storage, Storage, Storage) {
+	fast, bulk := NewDiskStorage(dir+"_fast"), NewDiskStorage(dir+"_bulk")
+	s, err := NewRoutedStorage([]StorageRoute{
+		{Name: "jars", Storage: bulk, Pattern: "*.jar"},
+		{Name: "fast", Storage: fast, MaxSize: 4, LowWaterMark: 4, HighWaterMark: 8},
+		{Name: "bulk", Storage: bulk},
+	})
+	require.NoError(t, err)
+	return s, fast, bulk
+}
+
+func TestRoutedStorage(t *testing.T) {
+	s, fast, bulk := newTieredStorage(t, "test_routed_storage")
+	defer os.RemoveAll("test_routed_storage_fast")
+	defer os.RemoveAll("test_routed_storage_bulk")
+	require.NoError(t, s.Put("a/small", []byte("abc")))
+	require.NoError(t, s.Put("a/big", []byte("0123456789")))
+	require.NoError(t, s.Put("a/x.jar", []byte("j")))
+
+	_, err := fast.Get("a/small")
+	assert.NoError(t, err, "Small artifacts go to the fast backend")
+	_, err = bulk.Get("a/big")
+	assert.NoError(t, err, "Large ones go to the bulk one")
+	_, err = bulk.Get("a/x.jar")
+	assert.NoError(t, err, "As do jars, however small they are")
+	for key, contents := range map[string]string{"a/small": "abc", "a/big": "0123456789", "a/x.jar": "j"} {
+		b, err := s.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, contents, string(b))
+	}
+	_, err = s.Get("a/missing")
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := s.List("a/")
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(entries), "Each backend is only listed once")
+	size, err := s.Size()
+	require.NoError(t, err)
+	assert.EqualValues(t, 14, size)
+
+	// Storing it again at a different size moves it.
+	require.NoError(t, s.Put("a/small", []byte("not so small")))
+	_, err = fast.Get("a/small")
+	assert.True(t, os.IsNotExist(err))
+	b, err := s.Get("a/small")
+	require.NoError(t, err)
+	assert.Equal(t, "not so small", string(b))
+
+	require.NoError(t, s.Delete("a/small"))
+	_, err = s.Get("a/small")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInvalidStorageRoutes(t *testing.T) {
+	fast, bulk := NewDiskStorage("fast"), NewDiskStorage("bulk")
+	for _, routes := range [][]StorageRoute{
+		{},
+		{{Name: "fast", Storage: fast, MaxSize: 4}},
+		{{Name: "fast", Storage: fast}, {Name: "fast", Storage: bulk}},
+		{{Name: "fast", Storage: fast, Pattern: "["}, {Name: "bulk", Storage: bulk}},
+		{{Name: "fast", Storage: fast, MinSize: 10, MaxSize: 4}, {Name: "bulk", Storage: bulk}},
+		{{Name: "fast", Storage: fast, LowWaterMark: 10}, {Name: "bulk", Storage: bulk}},
+		{{Storage: bulk}},
+	} {
+		_, err := NewRoutedStorage(routes)
+		assert.Error(t, err, "%v", routes)
+	}
+}
+
+func TestParseStorageRoute(t *testing.T) {
+	route, err := ParseStorageRoute("fast:dir:/mnt/ssd:max_size=1M,pattern=*.o,low_water_mark=90G,high_water_mark=100G", S3Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "fast", route.Name)
+	assert.Equal(t, "/mnt/ssd", route.Storage.(*diskStorage).root)
+	assert.EqualValues(t, 0, route.MinSize)
+	assert.EqualValues(t, 1000000, route.MaxSize)
+	assert.Equal(t, "*.o", route.Pattern)
+	assert.EqualValues(t, 90000000000, route.LowWaterMark)
+	assert.EqualValues(t, 100000000000, route.HighWaterMark)
+
+	route, err = ParseStorageRoute("bulk:s3:my-bucket", S3Config{Bucket: "other", AccessKeyID: "id", SecretAccessKey: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "my-bucket", route.Storage.(*s3Storage).config.Bucket)
+	assert.Equal(t, "bulk", route.Storage.(*s3Storage).config.Backend)
+
+	for _, spec := range []string{"fast", "fast:dir", "fast:dir:", ":dir:/mnt/ssd", "fast:tape:/dev/st0", "fast:dir:/mnt/ssd:colour=red", "fast:dir:/mnt/ssd:max_size=lots", "fast:dir:/mnt/ssd:max_size"} {
+		_, err := ParseStorageRoute(spec, S3Config{})
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCleanRoutedStorage(t *testing.T) {
+	s, fast, bulk := newTieredStorage(t, "test_clean_routed_storage")
+	defer os.RemoveAll("test_clean_routed_storage_fast")
+	defer os.RemoveAll("test_clean_routed_storage_bulk")
+	cache := newCache("test_clean_routed_storage")
+	defer os.RemoveAll(cache.rootPath)
+	cache.SetStorage(s)
+	now := time.Now()
+	for i, key := range []string{"a", "b", "c"} {
+		require.NoError(t, s.Put(key, []byte("123")))
+		modified := now.Add(time.Duration(i-10) * time.Minute)
+		require.NoError(t, os.Chtimes(path.Join(fast.(*diskStorage).root, key), modified, modified))
+	}
+	require.NoError(t, s.Put("d", []byte("0123456789")))
+
+	cache.cleanStorage(100, 200)
+	entries, err := fast.List("")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entries), "The fast backend is cleaned to its own water marks")
+	assert.Equal(t, "c", entries[0].Key)
+	size, err := bulk.Size()
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, size, "The bulk one is under the cache's")
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -9,21 +10,30 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
 	pb "cache/proto/rpc_cache"
+	"cli"
 	"tools/cache/cluster"
+	"tools/cache/oplog"
 )
 
 // maxMsgSize is the maximum message size our gRPC server accepts.
@@ -37,36 +47,180 @@ func init() {
 	grpc.EnableTracing = false
 }
 
+// keyReloadFrequency is how often we check the authorised certificates for changes.
+const keyReloadFrequency = 30 * time.Second
+
+// statsTimeout is how long we give each node to respond when collecting stats for the cluster.
+const statsTimeout = 5 * time.Second
+
 // A RPCCacheServer implements our RPC cache, including communication in a cluster.
 type RPCCacheServer struct {
 	cache        *Cache
 	readonlyKeys map[string]*x509.Certificate
 	writableKeys map[string]*x509.Certificate
-	cluster      *cluster.Cluster
+	// keyMutex protects readonlyKeys and writableKeys, which can be reloaded while we're running.
+	keyMutex  sync.RWMutex
+	cluster   *cluster.Cluster
+	retrieves retrieveGroup
+	stores    storeGroup
+	// hits and misses count the results of Retrieve RPCs.
+	hits, misses int64
+	// prefetcher is created on the first Prefetch RPC.
+	prefetcher   *prefetcher
+	prefetchOnce sync.Once
+	// budget limits the memory held by in-flight stores & retrieves. It's nil if there's no limit.
+	budget *MemoryBudget
+	// identity is sent in the headers of Store & Retrieve responses (see ServerOptions).
+	identity metadata.MD
+	// shedder tracks disk latency to decide when to shed stores. It's nil if we never do.
+	shedder *latencyMonitor
+	// oplog records the Store, Retrieve & Delete RPCs we handle (see ServerOptions). It's nil if we don't.
+	oplog *oplog.Log
+	// faults injects faults for chaos testing (see NewFaultInjector). It's nil if we never do.
+	faults *FaultInjector
+	// limiter limits the stores & retrieves in progress (see NewConcurrencyLimiter). It's nil if there are no limits.
+	limiter *ConcurrencyLimiter
+	// maxArtifactSize is the largest artifact we store (see ServerOptions), or zero for no limit.
+	maxArtifactSize int64
+	// compression is true if we allow compressed RPCs, so we advertise it to clients.
+	compression bool
 }
 
 // Store implements the Store RPC to store an artifact in the cache.
-func (r *RPCCacheServer) Store(ctx context.Context, req *pb.StoreRequest) (*pb.StoreResponse, error) {
-	if err := r.authenticateClient(ctx, r.writableKeys); err != nil {
+func (r *RPCCacheServer) Store(ctx context.Context, req *pb.StoreRequest) (resp *pb.StoreResponse, err error) {
+	if l := r.oplog; l != nil {
+		start := time.Now()
+		defer func() { l.RecordStore(start, req, resp.GetSuccess(), grpc.Code(err).String()) }()
+	}
+	r.sendIdentity(ctx)
+	if err := r.authenticateClient(ctx, writable); err != nil {
+		return nil, err
+	} else if err := r.faults.inject(); err != nil {
+		return nil, err
+	} else if err := r.checkWritable(); err != nil {
 		return nil, err
+	} else if err := r.checkLoad(req.RebuildCost); err != nil {
+		return nil, err
+	} else if err := checkArtifactSizes(req.Artifacts, r.maxArtifactSize, r.cache.metrics.oversizedStores); err != nil {
+		return nil, err
+	} else if req.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "TTL can't be negative")
 	}
-	success := storeArtifact(r.cache, req.Os, req.Arch, req.Hash, req.Artifacts, req.Hostname, extractAddress(ctx), "")
-	if success && r.cluster != nil {
-		// Replicate this artifact to another node. Doesn't have to be done synchronously.
-		go r.cluster.ReplicateArtifacts(req)
+	// Retries of this store are identified by what the client sent, before we change it.
+	key := storeKey(req)
+	// The TTL is relative to now, so it's turned into an expiry here; that's what we store and
+	// replicate, so the artifacts expire at the same time on every replica.
+	req.Expiry = storeExpiry(req.Expiry, req.TtlSeconds, r.cache.now())
+	req.TtlSeconds = 0
+	log.Debug("Store of %s from %s", requestKey(req.Os, req.Arch, req.Hash), cli.Field("client", clientIdentity(ctx)))
+	if r.cluster != nil {
+		if resp, forwarded := r.cluster.ForwardStore(ctx, req); forwarded {
+			return resp, nil
+		}
+	}
+	done, err := r.limitConcurrency(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var size int64
+	for _, artifact := range req.Artifacts {
+		size += int64(len(artifact.Body))
+	}
+	release, err := r.acquire(ctx, size)
+	if err != nil {
+		return nil, err
+	}
+	addAliases(r.cache, req.Os, req.Arch, req.Aliases)
+	success, duplicate, err := r.stores.Do(ctx, key, func() bool {
+		defer r.observeLatency(time.Now())
+		return storeArtifact(r.cache, req.Os, req.Arch, req.Hash, req.Artifacts, req.Hostname, extractAddress(ctx), "", req.RebuildCost, req.BuildKey, req.Expiry)
+	})
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if duplicate {
+		r.cache.metrics.duplicateStores.Inc()
+	}
+	if success {
+		storeShadowKeys(r.cache, req.Os, req.Arch, req.Hash, req.ShadowHash, req.Artifacts)
+		if !duplicate {
+			r.cache.currentUpstream().forward(r.cache, req)
+		}
+	}
+	if success && req.Verify && r.cluster != nil {
+		// The client wants to know the artifacts reached the other replicas, so we must wait for them.
+		defer release()
+		if err := r.replicateVerified(req); err != nil {
+			return nil, unverifiedError(err)
+		}
+	} else if success && !duplicate && r.cluster != nil && !r.faults.dropReplication() {
+		// Replicate this artifact to another node. Doesn't have to be done synchronously,
+		// but we're still holding onto the request until it's done.
+		go func() {
+			defer release()
+			r.cluster.ReplicateArtifacts(req)
+		}()
+	} else {
+		release()
 	}
 	return &pb.StoreResponse{Success: success}, nil
 }
 
+// replicateVerified replicates the artifacts from a store to the other replicas and checks that
+// they have the same checksums for them as we do.
+func (r *RPCCacheServer) replicateVerified(req *pb.StoreRequest) error {
+	if r.faults.dropReplication() {
+		return fmt.Errorf("injected fault")
+	}
+	layout := r.cache.Layout()
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	checksums := map[string]string{}
+	for _, artifact := range req.Artifacts {
+		stats, err := r.cache.StatArtifact(path.Join(layout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash), artifact.File))
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %s", artifact.File, err)
+		}
+		for name, stat := range stats {
+			if path.Base(name) != metadataFileName { // The replicas don't report these (see Checksum)
+				checksums[name] = stat.Hash
+			}
+		}
+	}
+	return r.cluster.ReplicateVerified(req, checksums)
+}
+
+// unverifiedError returns the error for a store whose artifacts couldn't be verified on the other replicas.
+func unverifiedError(err error) error {
+	log.Warning("Failed to verify stored artifacts: %s", err)
+	s := status.New(codes.Unavailable, "Failed to verify artifacts on other replicas: "+err.Error())
+	if detailed, derr := s.WithDetails(&pb.StoreError{Reason: pb.StoreError_UNVERIFIED, Detail: err.Error()}); derr == nil {
+		return detailed.Err()
+	}
+	return s.Err()
+}
+
 // storeArtifact stores a series of artifacts in the cache.
 // Broken out of above to share with Replicate below.
-func storeArtifact(cache *Cache, os, arch string, hash []byte, artifacts []*pb.Artifact, hostname, address, peer string) bool {
-	arch = os + "_" + arch
+func storeArtifact(cache *Cache, os, arch string, hash []byte, artifacts []*pb.Artifact, hostname, address, peer string, cost float64, buildKey string, expiry int64) bool {
+	layout := cache.Layout()
 	hashStr := base64.RawURLEncoding.EncodeToString(hash)
+	var expiryTime time.Time
+	if expiry > 0 {
+		expiryTime = time.Unix(expiry, 0)
+	}
 	for _, artifact := range artifacts {
-		dir := path.Join(arch, artifact.Package, artifact.Target, hashStr)
+		dir := layout.ArtifactDir(os, arch, artifact.Package, artifact.Target, hashStr)
 		file := path.Join(dir, artifact.File)
-		if err := cache.StoreArtifact(file, artifact.Body); err != nil {
+		if err := cache.StoreExpiry(dir, expiryTime); err != nil {
+			return false
+		} else if err := cache.StoreArtifact(file, artifact.Body); err != nil {
+			return false
+		} else if cost > 0 {
+			cache.SetRebuildCost(file, cost)
+		}
+		if buildKey != "" && cache.StoreBuildKey(dir, buildKey) != nil {
 			return false
 		}
 		go cache.StoreMetadata(dir, hostname, address, peer)
@@ -74,21 +228,128 @@ func storeArtifact(cache *Cache, os, arch string, hash []byte, artifacts []*pb.A
 	return true
 }
 
+// addAliases registers a series of aliases in the cache.
+func addAliases(cache *Cache, os, arch string, aliases []*pb.ArtifactAlias) {
+	layout := cache.Layout()
+	for _, alias := range aliases {
+		cache.AddAlias(
+			layout.ArtifactDir(os, arch, alias.Package, alias.Target, base64.RawURLEncoding.EncodeToString(alias.Hash)),
+			layout.ArtifactDir(os, arch, alias.AliasPackage, alias.AliasTarget, base64.RawURLEncoding.EncodeToString(alias.AliasHash)),
+		)
+	}
+}
+
 // Retrieve implements the Retrieve RPC to retrieve artifacts from the cache.
-func (r *RPCCacheServer) Retrieve(ctx context.Context, req *pb.RetrieveRequest) (*pb.RetrieveResponse, error) {
-	if err := r.authenticateClient(ctx, r.readonlyKeys); err != nil {
+func (r *RPCCacheServer) Retrieve(ctx context.Context, req *pb.RetrieveRequest) (resp *pb.RetrieveResponse, err error) {
+	if l := r.oplog; l != nil {
+		start := time.Now()
+		defer func() { l.RecordRetrieve(start, req, resp, grpc.Code(err).String()) }()
+	}
+	r.sendIdentity(ctx)
+	if err := r.authenticateClient(ctx, readonly); err != nil {
+		return nil, err
+	} else if err := r.faults.inject(); err != nil {
+		return nil, err
+	} else if r.cache.InMaintenance() {
+		return nil, retrieveError(codes.Unavailable, pb.RetrieveError_UNAVAILABLE, "", "Server is in maintenance mode")
+	}
+	log.Debug("Retrieve of %s from %s", requestKey(req.Os, req.Arch, req.Hash), cli.Field("client", clientIdentity(ctx)))
+	done, err := r.limitConcurrency(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	release, err := r.acquire(ctx, r.retrieveSize(req))
+	if err != nil {
 		return nil, err
 	}
+	defer release()
+	// Concurrent requests for exactly the same artifacts share a single read.
+	resp, err = r.retrieves.Do(ctx, retrieveKey(req), func() (*pb.RetrieveResponse, error) {
+		start := time.Now()
+		resp, err := r.retrieve(req)
+		r.observeLatency(start)
+		if grpc.Code(err) == codes.NotFound {
+			// Neither of these are counted towards the latency since they aren't from our disk.
+			if r.cluster != nil {
+				if resp, forwarded, err := r.cluster.ForwardRetrieve(ctx, req); forwarded {
+					return resp, err
+				}
+			}
+			return r.cache.currentUpstream().retrieve(r.cache, req, err)
+		} else if err == nil {
+			return r.cache.currentUpstream().revalidate(r.cache, req, resp)
+		}
+		return resp, err
+	})
+	r.recordShadow(req, err == nil && resp.Success)
+	if err == nil && resp.Success {
+		atomic.AddInt64(&r.hits, 1)
+		r.cache.recordTargetRetrieve(req.Artifacts, true)
+	} else if grpc.Code(err) == codes.NotFound {
+		atomic.AddInt64(&r.misses, 1)
+		r.cache.recordTargetRetrieve(req.Artifacts, false)
+	}
+	if err != nil && !req.StructuredErrors {
+		// Older clients don't understand these errors and expect an unsuccessful response instead.
+		if code := grpc.Code(err); code == codes.NotFound || code == codes.Internal {
+			return &pb.RetrieveResponse{Success: false}, nil
+		}
+	}
+	return resp, err
+}
+
+// requestKey returns a field identifying the set of artifacts with the given OS, architecture
+// and hash, for logging.
+func requestKey(os, arch string, hash []byte) cli.LogField {
+	return cli.Field("key", os+"_"+arch+"/"+base64.RawURLEncoding.EncodeToString(hash))
+}
+
+// retrieveKey returns a key identifying the artifacts requested by a RetrieveRequest.
+func retrieveKey(req *pb.RetrieveRequest) string {
+	var buf bytes.Buffer
+	buf.WriteString(req.Os + "_" + req.Arch + "/")
+	buf.WriteString(base64.RawURLEncoding.EncodeToString(req.Hash))
+	for _, artifact := range req.Artifacts {
+		buf.WriteString("\x00" + path.Join(artifact.Package, artifact.Target, artifact.File))
+	}
+	return buf.String()
+}
+
+// retrieve handles the actual retrieval of artifacts from the cache.
+// It returns a NotFound error if any of them don't exist, or Internal if they can't be read.
+func (r *RPCCacheServer) retrieve(req *pb.RetrieveRequest) (*pb.RetrieveResponse, error) {
 	response := pb.RetrieveResponse{Success: true}
-	arch := req.Os + "_" + req.Arch
+	layout := r.cache.Layout()
 	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
 	for _, artifact := range req.Artifacts {
-		root := path.Join(arch, artifact.Package, artifact.Target, hash)
+		root := layout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash)
 		fileRoot := path.Join(root, artifact.File)
 		art, err := r.cache.RetrieveArtifact(fileRoot)
-		if err != nil {
-			log.Debug("Failed to retrieve artifact %s: %s", fileRoot, err)
-			return &pb.RetrieveResponse{Success: false}, nil
+		if os.IsNotExist(err) {
+			// We only follow one level of aliasing, so there's no danger of going round in circles.
+			if alias, present := r.cache.ResolveAlias(root); present {
+				log.Debug("Artifact %s not found, trying alias %s", cli.Field("key", fileRoot), alias)
+				root = alias
+				art, err = r.cache.RetrieveArtifact(path.Join(root, artifact.File))
+			}
+		}
+		if os.IsNotExist(err) {
+			// It might not have been moved yet by a migration from another layout.
+			if previous, present := r.cache.previousArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash); present {
+				root = previous
+				art, err = r.cache.RetrieveArtifact(path.Join(root, artifact.File))
+			}
+		}
+		if os.IsNotExist(err) {
+			log.Debug("Artifact %s not found", cli.Field("key", fileRoot))
+			return nil, retrieveError(codes.NotFound, pb.RetrieveError_NOT_FOUND, fileRoot, "Artifact not found")
+		} else if err != nil {
+			log.Warning("Failed to retrieve artifact %s: %s", cli.Field("key", fileRoot), err)
+			return nil, retrieveError(codes.Internal, pb.RetrieveError_INTERNAL, fileRoot, err.Error())
+		}
+		if expiry := r.cache.ArtifactExpiry(root); expiry > 0 && (response.Expiry == 0 || expiry < response.Expiry) {
+			response.Expiry = expiry
 		}
 		for name, body := range art {
 			response.Artifacts = append(response.Artifacts, &pb.Artifact{
@@ -102,9 +363,77 @@ func (r *RPCCacheServer) Retrieve(ctx context.Context, req *pb.RetrieveRequest)
 	return &response, nil
 }
 
+// retrieveError returns an error with the given code and a RetrieveError detail attached to it.
+func retrieveError(code codes.Code, reason pb.RetrieveError_Reason, artifact, message string) error {
+	s := status.New(code, message)
+	if detailed, err := s.WithDetails(&pb.RetrieveError{Reason: reason, Artifact: artifact}); err == nil {
+		return detailed.Err()
+	}
+	return s.Err()
+}
+
+// Exists implements the Exists RPC to check whether artifacts are in the cache.
+func (r *RPCCacheServer) Exists(ctx context.Context, req *pb.ExistsRequest) (*pb.ExistsResponse, error) {
+	if err := r.authenticateClient(ctx, readonly); err != nil {
+		return nil, err
+	} else if err := r.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	resp, err := r.exists(req)
+	if err == nil && !resp.Exists && req.CheckPeers && r.cluster != nil {
+		if peerResp := r.cluster.Exists(ctx, req); peerResp != nil {
+			return peerResp, nil
+		}
+	}
+	return resp, err
+}
+
+// exists checks whether all the requested artifacts are in our local cache.
+func (r *RPCCacheServer) exists(req *pb.ExistsRequest) (*pb.ExistsResponse, error) {
+	response := pb.ExistsResponse{Exists: true}
+	layout := r.cache.Layout()
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	for _, artifact := range req.Artifacts {
+		root := layout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash)
+		fileRoot := path.Join(root, artifact.File)
+		stats, err := r.cache.StatArtifact(fileRoot)
+		if os.IsNotExist(err) {
+			if previous, present := r.cache.previousArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash); present {
+				root = previous
+				stats, err = r.cache.StatArtifact(path.Join(root, artifact.File))
+			}
+		}
+		if os.IsNotExist(err) {
+			log.Debug("Artifact %s not found", cli.Field("key", fileRoot))
+			return &pb.ExistsResponse{}, nil
+		} else if err != nil {
+			log.Warning("Failed to check artifact %s: %s", cli.Field("key", fileRoot), err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		for name, stat := range stats {
+			response.Artifacts = append(response.Artifacts, &pb.ArtifactInfo{
+				Package: artifact.Package,
+				Target:  artifact.Target,
+				File:    name[len(root)+1:],
+				Size:    stat.Size,
+				Sha256:  stat.Hash,
+			})
+		}
+	}
+	return &response, nil
+}
+
 // Delete implements the Delete RPC to delete an artifact from the cache.
-func (r *RPCCacheServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
-	if err := r.authenticateClient(ctx, r.writableKeys); err != nil {
+func (r *RPCCacheServer) Delete(ctx context.Context, req *pb.DeleteRequest) (resp *pb.DeleteResponse, err error) {
+	if l := r.oplog; l != nil {
+		start := time.Now()
+		defer func() { l.RecordDelete(start, req, resp.GetSuccess(), grpc.Code(err).String()) }()
+	}
+	if err := r.authenticateClient(ctx, writable); err != nil {
+		return nil, err
+	} else if err := r.faults.inject(); err != nil {
+		return nil, err
+	} else if err := r.checkMaintenance(); err != nil {
 		return nil, err
 	}
 	if req.Everything {
@@ -122,17 +451,50 @@ func (r *RPCCacheServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb
 // It's split out from Delete to share with replication RPCs below.
 func deleteArtifact(cache *Cache, os, arch string, artifacts []*pb.Artifact) bool {
 	success := true
+	layout, previous := cache.Layout(), cache.currentPreviousLayout()
 	for _, artifact := range artifacts {
-		if cache.DeleteArtifact(path.Join(os+"_"+arch, artifact.Package, artifact.Target)) != nil {
+		if cache.DeleteArtifact(layout.TargetDir(os, arch, artifact.Package, artifact.Target)) != nil {
+			success = false
+		}
+		if previous != nil && cache.DeleteArtifact(previous.TargetDir(os, arch, artifact.Package, artifact.Target)) != nil {
 			success = false
 		}
 	}
 	return success
 }
 
+// Alias implements the Alias RPC to register aliases between artifact keys.
+func (r *RPCCacheServer) Alias(ctx context.Context, req *pb.AliasRequest) (*pb.AliasResponse, error) {
+	if err := r.authenticateClient(ctx, writable); err != nil {
+		return nil, err
+	}
+	addAliases(r.cache, req.Os, req.Arch, req.Aliases)
+	return &pb.AliasResponse{Success: true}, nil
+}
+
+// InvalidateByBuildKey implements the InvalidateByBuildKey RPC to delete all artifacts with a build key.
+func (r *RPCCacheServer) InvalidateByBuildKey(ctx context.Context, req *pb.InvalidateRequest) (*pb.InvalidateResponse, error) {
+	if err := r.authenticateClient(ctx, writable); err != nil {
+		return nil, err
+	} else if err := r.checkMaintenance(); err != nil {
+		return nil, err
+	} else if req.BuildKey == "" {
+		return nil, status.Error(codes.InvalidArgument, "Must pass a build key")
+	}
+	n, err := r.cache.InvalidateBuildKey(req.BuildKey)
+	if err != nil {
+		log.Error("Failed to invalidate build key %s: %s", req.BuildKey, err)
+		return &pb.InvalidateResponse{Success: false, Artifacts: int32(n)}, nil
+	} else if r.cluster != nil {
+		// As for Delete, the other nodes do this in the background.
+		go r.cluster.InvalidateBuildKey(req.BuildKey)
+	}
+	return &pb.InvalidateResponse{Success: true, Artifacts: int32(n)}, nil
+}
+
 // ListNodes implements the RPC for clustered servers.
 func (r *RPCCacheServer) ListNodes(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
-	if err := r.authenticateClient(ctx, r.readonlyKeys); err != nil {
+	if err := r.authenticateClient(ctx, readonly); err != nil {
 		return nil, err
 	}
 	if r.cluster == nil {
@@ -141,8 +503,94 @@ func (r *RPCCacheServer) ListNodes(ctx context.Context, req *pb.ListRequest) (*p
 	return &pb.ListResponse{Nodes: r.cluster.GetMembers()}, nil
 }
 
-func (r *RPCCacheServer) authenticateClient(ctx context.Context, certs map[string]*x509.Certificate) error {
-	if len(certs) == 0 {
+// Prefetch implements the Prefetch RPC to fetch artifacts from other nodes ahead of time.
+func (r *RPCCacheServer) Prefetch(ctx context.Context, req *pb.PrefetchRequest) (*pb.PrefetchResponse, error) {
+	if err := r.authenticateClient(ctx, readonly); err != nil {
+		return nil, err
+	} else if err := r.checkMaintenance(); err != nil {
+		return nil, err
+	} else if r.cluster == nil {
+		return &pb.PrefetchResponse{}, nil // Nowhere to fetch anything from.
+	}
+	r.prefetchOnce.Do(func() {
+		r.prefetcher = newPrefetcher(r.cache, r.cluster.RetrieveArtifacts, prefetchConcurrency)
+	})
+	return &pb.PrefetchResponse{Queued: r.prefetchAll(req)}, nil
+}
+
+// prefetchAll queues up all the requests in a PrefetchRequest and returns the number accepted.
+func (r *RPCCacheServer) prefetchAll(req *pb.PrefetchRequest) int32 {
+	var queued int32
+	for _, request := range req.Requests {
+		if !r.prefetcher.Enqueue(request) {
+			log.Warning("Prefetch queue is full, dropping %d requests", len(req.Requests)-int(queued))
+			break
+		}
+		queued++
+	}
+	return queued
+}
+
+// ClusterStats implements the RPC to collect stats for the whole cluster.
+func (r *RPCCacheServer) ClusterStats(ctx context.Context, req *pb.ClusterStatsRequest) (*pb.ClusterStatsResponse, error) {
+	if err := r.authenticateClient(ctx, readonly); err != nil {
+		return nil, err
+	}
+	nodes := []*pb.NodeStats{r.nodeStats()}
+	var unreachable []string
+	if r.cluster != nil {
+		others, u := r.cluster.Stats(statsTimeout)
+		nodes = append(nodes, others...)
+		unreachable = u
+	}
+	return aggregateStats(nodes, unreachable), nil
+}
+
+// nodeStats returns the stats for this node.
+func (r *RPCCacheServer) nodeStats() *pb.NodeStats {
+	stats := &pb.NodeStats{
+		TotalSize:   r.cache.TotalSize(),
+		NumFiles:    int64(r.cache.NumFiles()),
+		Hits:        atomic.LoadInt64(&r.hits),
+		Misses:      atomic.LoadInt64(&r.misses),
+		Maintenance: r.cache.InMaintenance(),
+	}
+	if r.cluster != nil {
+		stats.ReplicationsInflight, stats.ReplicationFailures = r.cluster.ReplicationStats()
+		if node := r.cluster.LocalNode(); node != nil {
+			stats.Name = node.Name
+			stats.Address = node.Address
+		}
+	}
+	return stats
+}
+
+// aggregateStats sums the stats for a set of nodes.
+func aggregateStats(nodes []*pb.NodeStats, unreachable []string) *pb.ClusterStatsResponse {
+	resp := &pb.ClusterStatsResponse{Nodes: nodes, Unreachable: unreachable}
+	var hits, misses int64
+	for _, node := range nodes {
+		resp.TotalSize += node.TotalSize
+		resp.NumFiles += node.NumFiles
+		resp.ReplicationsInflight += node.ReplicationsInflight
+		resp.ReplicationFailures += node.ReplicationFailures
+		hits += node.Hits
+		misses += node.Misses
+	}
+	if hits+misses > 0 {
+		resp.HitRatio = float64(hits) / float64(hits+misses)
+	}
+	return resp
+}
+
+// readonly and writable are used to select the set of keys to authenticate against.
+const (
+	readonly = false
+	writable = true
+)
+
+func (r *RPCCacheServer) authenticateClient(ctx context.Context, write bool) error {
+	if !r.authRequired(write) {
 		return nil // Open to anyone.
 	}
 	p, ok := peer.FromContext(ctx)
@@ -153,10 +601,34 @@ func (r *RPCCacheServer) authenticateClient(ctx context.Context, certs map[strin
 	if !ok {
 		return status.Error(codes.Unauthenticated, "Could not extract auth info")
 	}
-	if len(info.State.PeerCertificates) == 0 {
+	return r.authenticateCerts(info.State.PeerCertificates, write)
+}
+
+// authRequired returns true if clients must present a known certificate to read (or write).
+func (r *RPCCacheServer) authRequired(write bool) bool {
+	r.keyMutex.RLock()
+	defer r.keyMutex.RUnlock()
+	if write {
+		return len(r.writableKeys) > 0
+	}
+	return len(r.readonlyKeys) > 0
+}
+
+// authenticateCerts checks the certificates a client has presented against the known ones.
+// It's shared between gRPC and the REST gateway, which get them from different places.
+func (r *RPCCacheServer) authenticateCerts(peerCerts []*x509.Certificate, write bool) error {
+	r.keyMutex.RLock()
+	certs := r.readonlyKeys
+	if write {
+		certs = r.writableKeys
+	}
+	r.keyMutex.RUnlock()
+	if len(certs) == 0 {
+		return nil // Open to anyone.
+	} else if len(peerCerts) == 0 {
 		return status.Error(codes.Unauthenticated, "No peer certificate available")
 	}
-	cert := info.State.PeerCertificates[0]
+	cert := peerCerts[0]
 	okCert := certs[string(cert.RawSubject)]
 	if okCert == nil || !okCert.Equal(cert) {
 		return status.Error(codes.Unauthenticated, "Invalid or unknown certificate")
@@ -164,6 +636,40 @@ func (r *RPCCacheServer) authenticateClient(ctx context.Context, certs map[strin
 	return nil
 }
 
+// checkMaintenance returns an error if the server is currently in maintenance mode.
+// Clients treat this like any other unavailable server and fall back to a replica.
+func (r *RPCCacheServer) checkMaintenance() error {
+	if r.cache.InMaintenance() {
+		return status.Error(codes.Unavailable, "Server is in maintenance mode")
+	}
+	return nil
+}
+
+// readOnlyReason returns the reason we aren't accepting stores from clients at the moment,
+// or the empty string if we are.
+func (r *RPCCacheServer) readOnlyReason() string {
+	if reason := r.cache.ReadOnlyReason(); reason != "" {
+		return reason
+	} else if r.cluster != nil {
+		return r.cluster.ReadOnlyReason()
+	}
+	return ""
+}
+
+// checkWritable returns an error if we aren't accepting stores from clients at the moment.
+// It's a FailedPrecondition with a StoreError detail attached, which clients recognise and
+// skip storing rather than treating it as a failure.
+func (r *RPCCacheServer) checkWritable() error {
+	if reason := r.readOnlyReason(); reason != "" {
+		s := status.New(codes.FailedPrecondition, readOnlyPrefix+reason)
+		if detailed, err := s.WithDetails(&pb.StoreError{Reason: pb.StoreError_READ_ONLY, Detail: reason}); err == nil {
+			return detailed.Err()
+		}
+		return s.Err()
+	}
+	return nil
+}
+
 func extractAddress(ctx context.Context) string {
 	p, ok := peer.FromContext(ctx)
 	if !ok {
@@ -172,37 +678,145 @@ func extractAddress(ctx context.Context) string {
 	return p.Addr.String()
 }
 
-func loadKeys(filename string) map[string]*x509.Certificate {
+// CheckCertificates returns an error if the certificates in the given file or directory (as
+// passed to BuildGrpcServer) can't be loaded, or if there aren't any.
+func CheckCertificates(filename string) error {
+	certs, err := loadKeys(filename)
+	if err != nil {
+		return err
+	} else if len(certs) == 0 {
+		return fmt.Errorf("No certificates found in %s", filename)
+	}
+	return nil
+}
+
+// loadKeys loads a set of certificates from the given file or directory.
+func loadKeys(filename string) (map[string]*x509.Certificate, error) {
 	ret := map[string]*x509.Certificate{}
-	if err := filepath.Walk(filename, func(name string, info os.FileInfo, err error) error {
+	return ret, filepath.Walk(filename, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		} else if !info.IsDir() {
 			data, err := ioutil.ReadFile(name)
 			if err != nil {
-				log.Fatalf("Failed to read cert from %s: %s", name, err)
+				return fmt.Errorf("Failed to read cert from %s: %s", name, err)
 			}
 			p, _ := pem.Decode(data)
 			if p == nil {
-				log.Fatalf("Couldn't decode PEM data from %s: %s", name, err)
+				return fmt.Errorf("Couldn't decode PEM data from %s", name)
 			}
 			cert, err := x509.ParseCertificate(p.Bytes)
 			if err != nil {
-				log.Fatalf("Couldn't parse certificate from %s: %s", name, err)
+				return fmt.Errorf("Couldn't parse certificate from %s: %s", name, err)
 			}
 			ret[string(cert.RawSubject)] = cert
 		}
 		return nil
-	}); err != nil {
-		log.Fatalf("%s", err)
+	})
+}
+
+// loadAllKeys loads the readonly & writable keys from the given files or directories and
+// swaps them in. If anything fails to load the existing keys are retained.
+func (r *RPCCacheServer) loadAllKeys(readonlyKeys, writableKeys string) error {
+	var readonly, writable map[string]*x509.Certificate
+	var err error
+	if writableKeys != "" {
+		if writable, err = loadKeys(writableKeys); err != nil {
+			return err
+		}
+	}
+	if readonlyKeys != "" {
+		if readonly, err = loadKeys(readonlyKeys); err != nil {
+			return err
+		}
+		if len(readonly) > 0 {
+			// This saves duplication when checking later; writable keys are implicitly readable too.
+			for k, v := range writable {
+				if _, present := readonly[k]; !present {
+					readonly[k] = v
+				}
+			}
+		}
+	}
+	r.keyMutex.Lock()
+	defer r.keyMutex.Unlock()
+	// An empty set leaves the cache open to anyone, which is unlikely to be intended if it wasn't before.
+	if (len(readonly) == 0 && len(r.readonlyKeys) > 0) || (len(writable) == 0 && len(r.writableKeys) > 0) {
+		return fmt.Errorf("No certificates found, refusing to open access to the cache")
+	}
+	r.readonlyKeys = readonly
+	r.writableKeys = writable
+	log.Notice("Loaded authorised certificates: %d readable, %d writable", len(readonly), len(writable))
+	return nil
+}
+
+// watchKeys checks the given key files or directories for changes each time ticks receives and
+// reloads them if needed, and reloads them regardless each time signals does.
+func (r *RPCCacheServer) watchKeys(readonlyKeys, writableKeys string, ticks <-chan time.Time, signals <-chan os.Signal) {
+	last := keyFingerprint(readonlyKeys, writableKeys)
+	for {
+		fingerprint := ""
+		select {
+		case <-ticks:
+			if fingerprint = keyFingerprint(readonlyKeys, writableKeys); fingerprint == last {
+				continue
+			}
+			log.Notice("Authorised certificates have changed, reloading")
+		case <-signals:
+			fingerprint = keyFingerprint(readonlyKeys, writableKeys)
+			log.Notice("Reloading authorised certificates")
+		}
+		if err := r.loadAllKeys(readonlyKeys, writableKeys); err != nil {
+			// Don't update the fingerprint so we try again next time; it might be partially written.
+			log.Error("Failed to reload authorised certificates, will keep existing ones: %s", err)
+		} else {
+			last = fingerprint
+		}
 	}
-	return ret
+}
+
+// initKeys loads the given sets of keys, if any, and watches them for changes, reloading them
+// whenever the process receives one of the given signals too (see ServerOptions.KeyReloadSignals).
+// It dies if they can't be loaded.
+func (r *RPCCacheServer) initKeys(readonlyKeys, writableKeys string, signals []os.Signal) {
+	if readonlyKeys != "" || writableKeys != "" {
+		if err := r.loadAllKeys(readonlyKeys, writableKeys); err != nil {
+			log.Fatalf("%s", err)
+		}
+		ch := make(chan os.Signal, 1)
+		if len(signals) > 0 {
+			signal.Notify(ch, signals...)
+		}
+		go r.watchKeys(readonlyKeys, writableKeys, time.NewTicker(keyReloadFrequency).C, ch)
+	}
+}
+
+// keyFingerprint returns a string identifying the current state of the given key files or directories.
+// It doesn't read their contents, only the names, sizes and modification times of the files.
+func keyFingerprint(filenames ...string) string {
+	var buf bytes.Buffer
+	for _, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+		filepath.Walk(filename, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(&buf, "%s: %s\n", name, err)
+			} else if !info.IsDir() {
+				fmt.Fprintf(&buf, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+			}
+			return nil
+		})
+	}
+	return buf.String()
 }
 
 // RPCServer implements the gRPC server for communication between cache nodes.
 type RPCServer struct {
 	cache   *Cache
 	cluster *cluster.Cluster
+	// server is the public-facing server, which we use to report stats.
+	server *RPCCacheServer
 }
 
 // Join implements the Join RPC for a new server joining the cluster.
@@ -214,84 +828,306 @@ func (r *RPCServer) Join(ctx context.Context, req *pb.JoinRequest) (*pb.JoinResp
 // Replicate implements the Replicate RPC for replicating an artifact from another node.
 func (r *RPCServer) Replicate(ctx context.Context, req *pb.ReplicateRequest) (*pb.ReplicateResponse, error) {
 	// TODO(pebers): Authentication.
-	if req.Delete {
+	if req.Delete && req.BuildKey != "" {
+		_, err := r.cache.InvalidateBuildKey(req.BuildKey)
+		return &pb.ReplicateResponse{Success: err == nil}, nil
+	} else if req.Delete && len(req.Paths) > 0 {
+		for _, p := range req.Paths {
+			if err := r.cache.DeleteEntry(p); err != nil && !os.IsNotExist(err) {
+				return &pb.ReplicateResponse{Success: false}, nil
+			}
+		}
+		return &pb.ReplicateResponse{Success: true}, nil
+	} else if req.Delete {
 		return &pb.ReplicateResponse{
 			Success: deleteArtifact(r.cache, req.Os, req.Arch, req.Artifacts),
 		}, nil
 	}
-	return &pb.ReplicateResponse{
-		Success: storeArtifact(r.cache, req.Os, req.Arch, req.Hash, req.Artifacts, req.Hostname, extractAddress(ctx), req.Peer),
-	}, nil
+	addAliases(r.cache, req.Os, req.Arch, req.Aliases)
+	success := storeArtifact(r.cache, req.Os, req.Arch, req.Hash, req.Artifacts, req.Hostname, extractAddress(ctx), req.Peer, req.RebuildCost, req.BuildKey, req.Expiry)
+	if success {
+		storeShadowKeys(r.cache, req.Os, req.Arch, req.Hash, req.ShadowHash, req.Artifacts)
+	}
+	return &pb.ReplicateResponse{Success: success}, nil
+}
+
+// Stats implements the Stats RPC to report this node's stats to another.
+func (r *RPCServer) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.NodeStats, error) {
+	return r.server.nodeStats(), nil
+}
+
+// Checksum implements the Checksum RPC to report the checksums of files on this node.
+func (r *RPCServer) Checksum(ctx context.Context, req *pb.ChecksumRequest) (*pb.ChecksumResponse, error) {
+	resp := &pb.ChecksumResponse{}
+	for _, p := range req.Paths {
+		stats, err := r.cache.StatArtifact(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to checksum %s: %s", p, err)
+		}
+		for name, stat := range stats {
+			if path.Base(name) == metadataFileName {
+				continue // This legitimately differs between nodes.
+			}
+			resp.Files = append(resp.Files, &pb.FileChecksum{Path: name, Size: stat.Size, Sha256: stat.Hash})
+		}
+	}
+	return resp, nil
+}
+
+// Sample implements the Sample RPC to return a random sample of the files on this node.
+func (r *RPCServer) Sample(ctx context.Context, req *pb.SampleRequest) (*pb.SampleResponse, error) {
+	return &pb.SampleResponse{Paths: r.cache.SamplePaths(int(req.Count))}, nil
 }
 
 // BuildGrpcServer creates a new, unstarted grpc.Server and returns it.
 // It also returns a net.Listener to start it on.
-func BuildGrpcServer(port int, cache *Cache, cluster *cluster.Cluster, keyFile, certFile, caCertFile, readonlyKeys, writableKeys string) (*grpc.Server, net.Listener) {
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// The key, cert and CA cert are PEM-encoded material (see ReadTLSMaterial); if key is empty the
+// server does not use TLS. They're ignored if the options have a CertReloader, in which case they
+// come from it and can change while it's serving.
+// The options that apply to the RPC server are taken from the given ones.
+// Its metrics are registered on the given registry (see NewRegistry), which should be one not
+// used by any other server; it can be nil if they're not needed. That includes those of the
+// options' budget, fault injector and limiter, if it has them, so servers sharing them should
+// share a registry too.
+func BuildGrpcServer(port int, cache *Cache, cluster *cluster.Cluster, registry *prometheus.Registry, key, cert, caCert []byte, readonlyKeys, writableKeys string, opts ServerOptions) (*grpc.Server, net.Listener) {
+	lis, err := listen(port, opts)
 	if err != nil {
 		log.Fatalf("Failed to listen on port %d: %v", port, err)
 	}
-	s := serverWithAuth(keyFile, certFile, caCertFile)
-	r := &RPCCacheServer{cache: cache, cluster: cluster}
-	if writableKeys != "" {
-		r.writableKeys = loadKeys(writableKeys)
+	metrics := grpc_prometheus.NewServerMetrics()
+	tracker := newConnectionTracker(opts.MaxConnectionIdle)
+	r := &RPCCacheServer{
+		cache:           cache,
+		cluster:         cluster,
+		stores:          storeGroup{window: opts.StoreDedupWindow},
+		budget:          opts.TransferBudget,
+		identity:        identityHeaders(opts.Node, opts.Version, opts.Zone),
+		shedder:         newLatencyMonitor(opts.ShedLatency, opts.ShedWindow, opts.ShedMaxCost),
+		oplog:           opts.OperationLog,
+		faults:          opts.Faults,
+		limiter:         opts.Limits,
+		maxArtifactSize: opts.MaxArtifactSize,
+		compression:     opts.AllowCompression,
 	}
-	if readonlyKeys != "" {
-		r.readonlyKeys = loadKeys(readonlyKeys)
-		if len(r.readonlyKeys) > 0 {
-			// This saves duplication when checking later; writable keys are implicitly readable too.
-			for k, v := range r.writableKeys {
-				if _, present := r.readonlyKeys[k]; !present {
-					r.readonlyKeys[k] = v
-				}
-			}
+	if r.compression {
+		registerCompressor()
+	}
+	if registry != nil {
+		metrics.EnableHandlingTimeHistogram()
+		registry.MustRegister(metrics, lis, tracker)
+		if r.budget != nil {
+			registry.MustRegister(r.budget)
+		}
+		if r.shedder != nil {
+			registry.MustRegister(r.shedder)
+		}
+		if r.faults != nil {
+			registry.MustRegister(r.faults)
+		}
+		if r.limiter != nil {
+			registry.MustRegister(r.limiter)
 		}
 	}
-	r2 := &RPCServer{cache: cache, cluster: cluster}
+	d := &drainer{}
+	s := serverWithAuth(key, cert, caCert, opts, metrics, tracker, d)
+	r.initKeys(readonlyKeys, writableKeys, opts.KeyReloadSignals)
+	r2 := &RPCServer{cache: cache, cluster: cluster, server: r}
 	pb.RegisterRpcCacheServer(s, r)
 	pb.RegisterRpcServerServer(s, r2)
-	healthserver := health.NewServer()
-	healthserver.SetServingStatus("plz-rpc-cache", healthpb.HealthCheckResponse_SERVING)
+	healthserver := &healthServer{Server: health.NewServer(), cache: cache}
+	healthserver.SetServingStatus(healthService, healthpb.HealthCheckResponse_SERVING)
 	healthpb.RegisterHealthServer(s, healthserver)
+	metrics.InitializeMetrics(s)
+	if opts.Servers != nil {
+		opts.Servers.add(builtServer{server: s, drainer: d, cache: cache, cluster: cluster})
+	}
 	return s, lis
 }
 
-// ServeGrpcForever serves gRPC until killed using the given server.
+// healthService is the name of the service we report health for.
+const healthService = "plz-rpc-cache"
+
+// A healthServer wraps the standard gRPC health server to report the service as not serving
+// while the cache is in maintenance mode.
+type healthServer struct {
+	*health.Server
+	cache *Cache
+}
+
+// Check implements the Check RPC of the health service.
+func (h *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if h.cache.InMaintenance() {
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+	return h.Server.Check(ctx, req)
+}
+
+// CheckHealth returns true if the server at the given address reports itself as serving.
+// If useTLS is true it connects over TLS, but doesn't verify the server's certificate; this is
+// intended for a server to check itself, not for checking anyone else.
+func CheckHealth(address string, useTLS bool, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	opt := grpc.WithInsecure()
+	if useTLS {
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}))
+	}
+	conn, err := grpc.DialContext(ctx, address, opt)
+	if err != nil {
+		log.Warning("Failed to connect to %s: %s", address, err)
+		return false
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: healthService})
+	if err != nil {
+		log.Warning("Health check of %s failed: %s", address, err)
+		return false
+	}
+	return resp.Status == healthpb.HealthCheckResponse_SERVING
+}
+
+// ServeGrpcForever serves gRPC using the given server until it's stopped (see ServerGroup.Shutdown).
 // It's very simple and provided as a convenience so callers don't have to import grpc themselves.
 func ServeGrpcForever(server *grpc.Server, lis net.Listener) {
 	log.Notice("Serving RPC cache on %s", lis.Addr())
-	server.Serve(lis)
+	if err := server.Serve(lis); err != nil {
+		log.Fatalf("Failed to serve RPC cache: %s", err)
+	}
+}
+
+// serverWithAuth builds a gRPC server, possibly with authentication if key / cert material is given
+// or the options have a CertReloader.
+func serverWithAuth(key, cert, caCert []byte, serverOpts ServerOptions, metrics *grpc_prometheus.ServerMetrics, tracker *connectionTracker, d *drainer) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxMsgSize),
+		grpc.MaxSendMsgSize(maxMsgSize),
+		grpc.UnaryInterceptor(d.unary(metrics.UnaryServerInterceptor())),
+		grpc.StreamInterceptor(d.stream(metrics.StreamServerInterceptor())),
+		grpc.StatsHandler(tracker),
+	}
+	if idle := serverOpts.MaxConnectionIdle; idle > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: idle}))
+	}
+	if reloader := serverOpts.CertReloader; reloader != nil {
+		return grpc.NewServer(append(opts, grpc.Creds(credentials.NewTLS(reloader.Config())))...)
+	} else if len(key) == 0 {
+		return grpc.NewServer(opts...) // No auth.
+	}
+	config, err := TLSConfig(key, cert, caCert)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return grpc.NewServer(append(opts, grpc.Creds(credentials.NewTLS(config)))...)
+}
+
+// tlsMinVersion and tlsCipherSuites are set by SetTLSOptions.
+var (
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+)
+
+// tlsVersions are the TLS versions that can be passed to SetTLSOptions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// SetTLSOptions constrains the TLS parameters negotiated by servers using configs built by
+// TLSConfig after this is called. The minimum version is one of "1.0" to "1.3", and cipher
+// suites are given by their standard names (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+// Either can be empty to use Go's defaults.
+// It returns an error if any are unknown, or if a cipher suite can't be used with the minimum
+// version; since TLS 1.3's suites aren't configurable, that includes requesting any with 1.3.
+func SetTLSOptions(minVersion string, cipherSuites []string) error {
+	var version uint16
+	if minVersion != "" {
+		v, present := tlsVersions[minVersion]
+		if !present {
+			return fmt.Errorf("Unknown TLS version %s", minVersion)
+		}
+		version = v
+	}
+	if len(cipherSuites) > 0 && version == tls.VersionTLS13 {
+		return fmt.Errorf("Cipher suites can't be configured for TLS 1.3")
+	}
+	suites := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.Name] = suite
+	}
+	var ids []uint16
+	for _, name := range cipherSuites {
+		suite, present := suites[name]
+		if !present {
+			return fmt.Errorf("Unknown TLS cipher suite %s", name)
+		} else if !supportsVersion(suite, 0) {
+			return fmt.Errorf("TLS cipher suite %s is only used by TLS 1.3, whose suites can't be configured", name)
+		} else if !supportsVersion(suite, version) {
+			return fmt.Errorf("TLS cipher suite %s can't be used with TLS %s or later", name, minVersion)
+		} else if suite.Insecure {
+			log.Warning("TLS cipher suite %s is considered insecure", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	tlsMinVersion = version
+	tlsCipherSuites = ids
+	return nil
 }
 
-// serverWithAuth builds a gRPC server, possibly with authentication if key / cert files are given.
-func serverWithAuth(keyFile, certFile, caCertFile string) *grpc.Server {
-	if keyFile == "" {
-		return grpc.NewServer(grpc.MaxRecvMsgSize(maxMsgSize), grpc.MaxSendMsgSize(maxMsgSize)) // No auth.
+// supportsVersion returns true if the given cipher suite can be used with the given TLS version or
+// any later one that's configurable (i.e. before 1.3). Zero allows any version.
+func supportsVersion(suite *tls.CipherSuite, minVersion uint16) bool {
+	for _, v := range suite.SupportedVersions {
+		if v >= minVersion && v < tls.VersionTLS13 {
+			return true
+		}
 	}
-	log.Debug("Loading x509 key pair from key: %s cert: %s", keyFile, certFile)
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	return false
+}
+
+// TLSConfig builds a server TLS config from the given PEM-encoded key, certificate and (optional) CA certificate.
+// It applies any options set by SetTLSOptions.
+func TLSConfig(key, cert, caCert []byte) (*tls.Config, error) {
+	log.Debug("Loading x509 key pair")
+	keyPair, err := tls.X509KeyPair(cert, key)
 	if err != nil {
-		log.Fatalf("Failed to load x509 key pair: %s", err)
+		return nil, fmt.Errorf("Failed to load x509 key pair: %s", err)
 	}
-	config := tls.Config{
-		Certificates: []tls.Certificate{cert},
+	config := &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
 		ClientAuth:   tls.RequestClientCert,
+		MinVersion:   tlsMinVersion,
+		CipherSuites: tlsCipherSuites,
 	}
-	if caCertFile != "" {
-		cert, err := ioutil.ReadFile(caCertFile)
-		if err != nil {
-			log.Fatalf("Failed to read CA cert file: %s", err)
-		}
+	if len(caCert) != 0 {
 		config.ClientCAs = x509.NewCertPool()
-		if !config.ClientCAs.AppendCertsFromPEM(cert) {
-			log.Fatalf("Failed to find any PEM certificates in CA cert")
+		if !config.ClientCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("Failed to find any PEM certificates in CA cert")
 		}
 	}
-	return grpc.NewServer(
-		grpc.Creds(credentials.NewTLS(&config)),
-		grpc.MaxRecvMsgSize(maxMsgSize),
-		grpc.MaxSendMsgSize(maxMsgSize),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-	)
+	return config, nil
+}
+
+// ReadTLSMaterial reads a piece of PEM-encoded TLS material (a key or certificate) from either
+// a file or the named environment variable. At most one of the two can be given; if neither
+// is then it returns nil.
+func ReadTLSMaterial(filename, envVar string) ([]byte, error) {
+	if filename != "" && envVar != "" {
+		return nil, fmt.Errorf("Can't read TLS material from both file %s and environment variable %s", filename, envVar)
+	} else if filename != "" {
+		return ioutil.ReadFile(filename)
+	} else if envVar == "" {
+		return nil, nil
+	}
+	value, present := os.LookupEnv(envVar)
+	if !present || value == "" {
+		return nil, fmt.Errorf("Environment variable %s is not set", envVar)
+	}
+	return []byte(value), nil
 }
@@ -7,16 +7,25 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	pb "cache/proto/rpc_cache"
+	"tools/cache/cluster"
 )
 
 const (
@@ -28,13 +37,20 @@ const (
 )
 
 func startServer(port int, auth bool, readonlyCerts, writableCerts string) *grpc.Server {
-	cache := NewCache(testDir, 20*time.Hour, 100, 1000000, 1000000)
+	return startServerWithOptions(port, auth, readonlyCerts, writableCerts, ServerOptions{})
+}
+
+func startServerWithOptions(port int, auth bool, readonlyCerts, writableCerts string, opts ServerOptions) *grpc.Server {
+	cache := NewCache(testDir, 20*time.Hour, 100, 1000000, 1000000, opts)
 	if !auth {
-		s, lis := BuildGrpcServer(port, cache, nil, "", "", "", readonlyCerts, writableCerts)
+		s, lis := BuildGrpcServer(port, cache, nil, nil, nil, nil, nil, readonlyCerts, writableCerts, opts)
 		go s.Serve(lis)
 		return s
 	}
-	s, lis := BuildGrpcServer(port, cache, nil, testKey, testCert, testCa, readonlyCerts, writableCerts)
+	key, _ := ioutil.ReadFile(testKey)
+	cert, _ := ioutil.ReadFile(testCert)
+	ca, _ := ioutil.ReadFile(testCa)
+	s, lis := BuildGrpcServer(port, cache, nil, nil, key, cert, ca, readonlyCerts, writableCerts, opts)
 	go s.Serve(lis)
 	return s
 }
@@ -76,6 +92,13 @@ func TestNoAuth(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCheckHealth(t *testing.T) {
+	assert.False(t, CheckHealth("localhost:7684", false, 100*time.Millisecond), "Fails because nothing is listening")
+	s := startServer(7684, false, "", "")
+	defer s.Stop()
+	assert.True(t, CheckHealth("localhost:7684", false, 5*time.Second))
+}
+
 func TestAuthRequired(t *testing.T) {
 	s := startServer(7678, true, "", "")
 	defer s.Stop()
@@ -155,3 +178,575 @@ func TestMaxMessageSize(t *testing.T) {
 	})
 	assert.NoError(t, err)
 }
+
+func TestRetrieveCoalescing(t *testing.T) {
+	var g retrieveGroup
+	var calls int32
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	f := func() (*pb.RetrieveResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &pb.RetrieveResponse{Success: true}, nil
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := ctx()
+			defer cancel()
+			resp, err := g.Do(ctx, "key", f)
+			assert.NoError(t, err)
+			assert.True(t, resp.Success)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // Give the waiters a chance to pile up.
+	close(release)
+	wg.Wait()
+	assert.EqualValues(t, 1, calls)
+	// Once complete, a subsequent request should trigger a new call.
+	resp, err := g.Do(context.Background(), "key", f)
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.EqualValues(t, 2, calls)
+}
+
+func TestRetrieveCoalescingDeadline(t *testing.T) {
+	var g retrieveGroup
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := g.Do(ctx, "key", func() (*pb.RetrieveResponse, error) {
+		<-release
+		return &pb.RetrieveResponse{Success: true}, nil
+	})
+	assert.Error(t, err, "Fails because the deadline expires before the read completes")
+}
+
+func TestStoreDedup(t *testing.T) {
+	g := storeGroup{window: 100 * time.Millisecond}
+	var calls int32
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	f := func() bool {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return true
+	}
+	var duplicates int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			success, duplicate, err := g.Do(context.Background(), "key", f)
+			assert.NoError(t, err)
+			assert.True(t, success)
+			if duplicate {
+				atomic.AddInt32(&duplicates, 1)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // Give the waiters a chance to pile up.
+	close(release)
+	wg.Wait()
+	assert.EqualValues(t, 1, calls)
+	assert.EqualValues(t, 9, duplicates)
+	// A retry within the window is still a duplicate.
+	success, duplicate, err := g.Do(context.Background(), "key", f)
+	assert.NoError(t, err)
+	assert.True(t, success)
+	assert.True(t, duplicate)
+	assert.EqualValues(t, 1, calls)
+	// Once the window has passed, it's stored again.
+	time.Sleep(150 * time.Millisecond)
+	success, duplicate, err = g.Do(context.Background(), "key", f)
+	assert.NoError(t, err)
+	assert.True(t, success)
+	assert.False(t, duplicate)
+	assert.EqualValues(t, 2, calls)
+}
+
+func TestStoreDedupDeadline(t *testing.T) {
+	g := storeGroup{window: time.Minute}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go g.Do(context.Background(), "key", func() bool {
+		close(started)
+		<-release
+		return true
+	})
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, duplicate, err := g.Do(ctx, "key", func() bool { return true })
+	assert.Error(t, err, "Fails because the deadline expires before the original store completes")
+	assert.Equal(t, codes.DeadlineExceeded, grpc.Code(err))
+	assert.True(t, duplicate)
+	close(release)
+}
+
+func TestStoreDedupFailure(t *testing.T) {
+	g := storeGroup{window: time.Minute}
+	success, duplicate, err := g.Do(context.Background(), "key", func() bool { return false })
+	assert.NoError(t, err)
+	assert.False(t, success)
+	assert.False(t, duplicate)
+	// Failures aren't remembered so the retry gets another go.
+	success, duplicate, err = g.Do(context.Background(), "key", func() bool { return true })
+	assert.NoError(t, err)
+	assert.True(t, success)
+	assert.False(t, duplicate)
+}
+
+func TestStoreDedupDisabled(t *testing.T) {
+	var g storeGroup
+	var calls int32
+	for i := 0; i < 3; i++ {
+		_, duplicate, _ := g.Do(context.Background(), "key", func() bool {
+			atomic.AddInt32(&calls, 1)
+			return true
+		})
+		assert.False(t, duplicate)
+	}
+	assert.EqualValues(t, 3, calls)
+}
+
+func TestStoreKey(t *testing.T) {
+	req := func(body string) *pb.StoreRequest {
+		return &pb.StoreRequest{
+			Os:   "linux",
+			Arch: "amd64",
+			Hash: []byte("1234"),
+			Artifacts: []*pb.Artifact{{
+				Package: "src/core",
+				Target:  "core",
+				File:    "core.a",
+				Body:    []byte(body),
+			}},
+		}
+	}
+	assert.Equal(t, storeKey(req("abc")), storeKey(req("abc")))
+	assert.NotEqual(t, storeKey(req("abc")), storeKey(req("abd")), "Different contents aren't duplicates")
+	for name, change := range map[string]func(*pb.StoreRequest){
+		"expiry":       func(r *pb.StoreRequest) { r.Expiry = 1000 },
+		"TTL":          func(r *pb.StoreRequest) { r.TtlSeconds = 60 },
+		"build key":    func(r *pb.StoreRequest) { r.BuildKey = "toolchain" },
+		"rebuild cost": func(r *pb.StoreRequest) { r.RebuildCost = 2.5 },
+	} {
+		changed := req("abc")
+		change(changed)
+		assert.NotEqual(t, storeKey(req("abc")), storeKey(changed), "Stores with a different %s aren't duplicates", name)
+	}
+}
+
+func TestReadTLSMaterial(t *testing.T) {
+	fromFile, err := ReadTLSMaterial(testCert, "")
+	assert.NoError(t, err)
+	os.Setenv("PLZ_TEST_CERT_PEM", string(fromFile))
+	fromEnv, err := ReadTLSMaterial("", "PLZ_TEST_CERT_PEM")
+	assert.NoError(t, err)
+	assert.Equal(t, fromFile, fromEnv)
+	_, err = ReadTLSMaterial(testCert, "PLZ_TEST_CERT_PEM")
+	assert.Error(t, err, "Fails because only one source is allowed")
+	_, err = ReadTLSMaterial("", "PLZ_TEST_NONEXISTENT_PEM")
+	assert.Error(t, err, "Fails because the variable isn't set")
+	none, err := ReadTLSMaterial("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+}
+
+func TestSetTLSOptions(t *testing.T) {
+	defer SetTLSOptions("", nil)
+	key, _ := ioutil.ReadFile(testKey)
+	cert, _ := ioutil.ReadFile(testCert)
+	assert.NoError(t, SetTLSOptions("1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}))
+	config, err := TLSConfig(key, cert, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, tls.VersionTLS12, config.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, config.CipherSuites)
+
+	assert.NoError(t, SetTLSOptions("1.3", nil))
+	assert.Error(t, SetTLSOptions("1.3", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}), "1.3 suites aren't configurable")
+	assert.Error(t, SetTLSOptions("", []string{"TLS_AES_128_GCM_SHA256"}), "Only used by TLS 1.3")
+	assert.Error(t, SetTLSOptions("1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256_NOPE"}), "Unknown suite")
+	assert.Error(t, SetTLSOptions("2.0", nil), "Unknown version")
+
+	assert.NoError(t, SetTLSOptions("", nil))
+	config, err = TLSConfig(key, cert, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, config.MinVersion, "Go's defaults are used by default")
+	assert.Nil(t, config.CipherSuites)
+}
+
+func TestMaintenance(t *testing.T) {
+	cache := newCache("test_maintenance")
+	r := &RPCCacheServer{cache: cache}
+	h := &healthServer{Server: health.NewServer(), cache: cache}
+	h.SetServingStatus(healthService, healthpb.HealthCheckResponse_SERVING)
+	ctx, cancel := ctx()
+	defer cancel()
+	resp, err := h.Check(ctx, &healthpb.HealthCheckRequest{Service: healthService})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	_, err = r.Store(ctx, &pb.StoreRequest{})
+	assert.NoError(t, err)
+
+	cache.SetMaintenance(true)
+	resp, err = h.Check(ctx, &healthpb.HealthCheckRequest{Service: healthService})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+	_, err = r.Store(ctx, &pb.StoreRequest{})
+	assert.Error(t, err)
+	_, err = r.Retrieve(ctx, &pb.RetrieveRequest{})
+	assert.Error(t, err)
+
+	cache.SetMaintenance(false)
+	resp, err = h.Check(ctx, &healthpb.HealthCheckRequest{Service: healthService})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func TestStoreReadOnly(t *testing.T) {
+	c := newCache("test_store_read_only")
+	r := &RPCCacheServer{cache: c}
+	ctx, cancel := ctx()
+	defer cancel()
+	assertReadOnly := func(reason string) {
+		_, err := r.Store(ctx, &pb.StoreRequest{})
+		assert.Equal(t, codes.FailedPrecondition, grpc.Code(err))
+		assert.Equal(t, "cache read-only: "+reason, grpc.ErrorDesc(err))
+		s, _ := status.FromError(err)
+		details := s.Details()
+		if assert.Equal(t, 1, len(details)) {
+			if detail, ok := details[0].(*pb.StoreError); assert.True(t, ok) {
+				assert.Equal(t, pb.StoreError_READ_ONLY, detail.Reason)
+				assert.Equal(t, reason, detail.Detail)
+			}
+		}
+	}
+	c.SetReadOnly("configured read-only")
+	assertReadOnly("configured read-only")
+	c.SetReadOnly("")
+	_, err := r.Store(ctx, &pb.StoreRequest{})
+	assert.NoError(t, err)
+
+	c.SetMaintenance(true)
+	assertReadOnly("maintenance mode")
+	c.SetMaintenance(false)
+
+	r.cluster = cluster.NewCluster(5990, 6990, "read-only", "127.0.0.1", "", "")
+	r.cluster.Init(3)
+	r.cluster.SetReadOnlyOnPartition(true)
+	assertReadOnly("cluster is partitioned, can only see 1 of 3 nodes")
+	// Reads are unaffected.
+	_, err = r.Retrieve(ctx, &pb.RetrieveRequest{})
+	assert.NoError(t, err)
+}
+
+func TestServerIdentity(t *testing.T) {
+	s := startServerWithOptions(7685, false, "", "", ServerOptions{Node: "node-1", Version: "5.5.0"})
+	defer s.Stop()
+	c := buildClient(t, 7685, false)
+	ctx, cancel := ctx()
+	defer cancel()
+	var header metadata.MD
+	_, err := c.Store(ctx, &pb.StoreRequest{}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node-1"}, header[nodeHeader])
+	assert.Equal(t, []string{"5.5.0"}, header[versionHeader])
+	assert.Equal(t, 0, len(header[zoneHeader]), "Empty values are left out")
+	header = nil
+	c.Retrieve(ctx, &pb.RetrieveRequest{Hash: []byte("missing")}, grpc.Header(&header))
+	assert.Equal(t, []string{"node-1"}, header[nodeHeader], "It's sent on misses too")
+}
+
+func TestRetrieveNotFound(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_retrieve_not_found")}
+	ctx, cancel := ctx()
+	defer cancel()
+	req := &pb.RetrieveRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("nope"),
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "target", File: "file"}},
+	}
+	// Older clients get an unsuccessful response for a miss.
+	resp, err := r.Retrieve(ctx, req)
+	assert.NoError(t, err)
+	assert.False(t, resp.Success)
+	// Newer ones get a NotFound error with a detail explaining it.
+	req.StructuredErrors = true
+	_, err = r.Retrieve(ctx, req)
+	assert.Error(t, err)
+	assert.Equal(t, codes.NotFound, grpc.Code(err))
+	s, _ := status.FromError(err)
+	details := s.Details()
+	assert.Equal(t, 1, len(details))
+	if detail, ok := details[0].(*pb.RetrieveError); assert.True(t, ok) {
+		assert.Equal(t, pb.RetrieveError_NOT_FOUND, detail.Reason)
+		assert.Equal(t, "linux_amd64/pkg/target/bm9wZQ/file", detail.Artifact)
+	}
+}
+
+func TestRetrieveEmpty(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_retrieve_empty")}
+	ctx, cancel := ctx()
+	defer cancel()
+	artifacts := []*pb.Artifact{{Package: "pkg", Target: "target", File: "file"}}
+	assert.True(t, storeArtifact(r.cache, "linux", "amd64", []byte("hash"), artifacts, "", "", "", 0, "", 0))
+	resp, err := r.Retrieve(ctx, &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts, StructuredErrors: true})
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	if assert.Equal(t, 1, len(resp.Artifacts)) {
+		assert.Equal(t, "file", resp.Artifacts[0].File)
+		assert.Equal(t, 0, len(resp.Artifacts[0].Body))
+	}
+}
+
+func TestExists(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_exists")}
+	ctx, cancel := ctx()
+	defer cancel()
+	artifacts := []*pb.Artifact{{Package: "pkg", Target: "target", File: "file", Body: []byte("test")}}
+	req := &pb.ExistsRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts, CheckPeers: true}
+	resp, err := r.Exists(ctx, req)
+	assert.NoError(t, err)
+	assert.False(t, resp.Exists)
+	assert.True(t, storeArtifact(r.cache, req.Os, req.Arch, req.Hash, artifacts, "", "", "", 0, "", 0))
+	resp, err = r.Exists(ctx, req)
+	assert.NoError(t, err)
+	assert.True(t, resp.Exists)
+	if assert.Equal(t, 1, len(resp.Artifacts)) {
+		assert.Equal(t, "file", resp.Artifacts[0].File)
+		assert.EqualValues(t, 4, resp.Artifacts[0].Size)
+		assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", resp.Artifacts[0].Sha256)
+	}
+	// Checking for the whole target works too.
+	req.Artifacts = []*pb.Artifact{{Package: "pkg", Target: "target"}}
+	resp, err = r.Exists(ctx, req)
+	assert.NoError(t, err)
+	assert.True(t, resp.Exists)
+}
+
+func TestInvalidateByBuildKey(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_invalidate_by_build_key")}
+	ctx, cancel := ctx()
+	defer cancel()
+	store := func(target, buildKey string) *pb.StoreRequest {
+		req := &pb.StoreRequest{
+			Os:        "linux",
+			Arch:      "amd64",
+			Hash:      []byte("hash"),
+			Artifacts: []*pb.Artifact{{Package: "pkg", Target: target, File: "file", Body: []byte("test")}},
+			BuildKey:  buildKey,
+		}
+		resp, err := r.Store(ctx, req)
+		assert.NoError(t, err)
+		assert.True(t, resp.Success)
+		return req
+	}
+	bad := store("target1", "toolchain1")
+	good := store("target2", "toolchain2")
+	resp, err := r.InvalidateByBuildKey(ctx, &pb.InvalidateRequest{BuildKey: "toolchain1"})
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.EqualValues(t, 1, resp.Artifacts)
+	_, err = r.retrieve(&pb.RetrieveRequest{Os: bad.Os, Arch: bad.Arch, Hash: bad.Hash, Artifacts: bad.Artifacts})
+	assert.Equal(t, codes.NotFound, grpc.Code(err))
+	_, err = r.retrieve(&pb.RetrieveRequest{Os: good.Os, Arch: good.Arch, Hash: good.Hash, Artifacts: good.Artifacts})
+	assert.NoError(t, err)
+	_, err = r.InvalidateByBuildKey(ctx, &pb.InvalidateRequest{})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+}
+
+func TestAlias(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_alias")}
+	ctx, cancel := ctx()
+	defer cancel()
+	assert.True(t, storeArtifact(r.cache, "linux", "amd64", []byte("hash"), []*pb.Artifact{
+		{Package: "pkg", Target: "old_name", File: "file", Body: []byte("test")},
+	}, "", "", "", 0, "", 0))
+	req := &pb.RetrieveRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash"),
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "new_name", File: "file"}},
+	}
+	resp, err := r.Retrieve(ctx, req)
+	assert.NoError(t, err)
+	assert.False(t, resp.Success)
+
+	_, err = r.Alias(ctx, &pb.AliasRequest{
+		Os:   "linux",
+		Arch: "amd64",
+		Aliases: []*pb.ArtifactAlias{{
+			Package:      "pkg",
+			Target:       "new_name",
+			Hash:         []byte("hash"),
+			AliasPackage: "pkg",
+			AliasTarget:  "old_name",
+			AliasHash:    []byte("hash"),
+		}},
+	})
+	assert.NoError(t, err)
+	resp, err = r.Retrieve(ctx, req)
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	if assert.Equal(t, 1, len(resp.Artifacts)) {
+		// It comes back under the name that was asked for.
+		assert.Equal(t, "new_name", resp.Artifacts[0].Target)
+		assert.Equal(t, "file", resp.Artifacts[0].File)
+		assert.Equal(t, []byte("test"), resp.Artifacts[0].Body)
+	}
+
+	// Aliases work the other way too, for artifacts stored under the new name.
+	_, err = r.Store(ctx, &pb.StoreRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash2"),
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "new_name", File: "file2", Body: []byte("test2")}},
+		Aliases: []*pb.ArtifactAlias{{
+			Package:      "pkg",
+			Target:       "new_name",
+			Hash:         []byte("hash2"),
+			AliasPackage: "pkg",
+			AliasTarget:  "old_name",
+			AliasHash:    []byte("hash2"),
+		}},
+	})
+	assert.NoError(t, err)
+	resp, err = r.Retrieve(ctx, &pb.RetrieveRequest{
+		Os:        "linux",
+		Arch:      "amd64",
+		Hash:      []byte("hash2"),
+		Artifacts: []*pb.Artifact{{Package: "pkg", Target: "old_name", File: "file2"}},
+	})
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+}
+
+func TestClusterStats(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_cluster_stats")}
+	ctx, cancel := ctx()
+	defer cancel()
+	artifacts := []*pb.Artifact{{Package: "pkg", Target: "target", File: "file", Body: []byte("test")}}
+	assert.True(t, storeArtifact(r.cache, "linux", "amd64", []byte("hash"), artifacts, "", "", "", 0, "", 0))
+	req := &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts}
+	_, err := r.Retrieve(ctx, req)
+	assert.NoError(t, err)
+	req.Hash = []byte("nope")
+	_, err = r.Retrieve(ctx, req)
+	assert.NoError(t, err)
+
+	resp, err := r.ClusterStats(ctx, &pb.ClusterStatsRequest{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, resp.TotalSize)
+	assert.EqualValues(t, 1, resp.NumFiles)
+	assert.Equal(t, 0.5, resp.HitRatio)
+	assert.Equal(t, 1, len(resp.Nodes))
+	assert.Equal(t, 0, len(resp.Unreachable))
+}
+
+func TestAggregateStats(t *testing.T) {
+	resp := aggregateStats([]*pb.NodeStats{
+		{Name: "node1", TotalSize: 1000, NumFiles: 10, Hits: 3, Misses: 1, ReplicationFailures: 2},
+		{Name: "node2", TotalSize: 500, NumFiles: 5, Hits: 5, Misses: 3, ReplicationsInflight: 1},
+	}, []string{"node3"})
+	assert.EqualValues(t, 1500, resp.TotalSize)
+	assert.EqualValues(t, 15, resp.NumFiles)
+	assert.Equal(t, 8.0/12.0, resp.HitRatio)
+	assert.EqualValues(t, 1, resp.ReplicationsInflight)
+	assert.EqualValues(t, 2, resp.ReplicationFailures)
+	assert.Equal(t, []string{"node3"}, resp.Unreachable)
+}
+
+func TestReloadKeys(t *testing.T) {
+	const dir = "test_reload_keys"
+	assert.NoError(t, os.MkdirAll(dir, os.ModeDir|0775))
+	cert, err := ioutil.ReadFile(testCert)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(dir+"/cert1.pem", cert, 0644))
+	r := &RPCCacheServer{}
+	assert.NoError(t, r.loadAllKeys(dir, testCert2))
+	assert.Equal(t, 1, len(r.readonlyKeys))
+	assert.Equal(t, 1, len(r.writableKeys))
+	before := keyFingerprint(dir)
+
+	// A partially written file fails to load and leaves the existing keys in place.
+	assert.NoError(t, ioutil.WriteFile(dir+"/cert2.pem", cert[:len(cert)/2], 0644))
+	assert.NotEqual(t, before, keyFingerprint(dir))
+	assert.Error(t, r.loadAllKeys(dir, testCert2))
+	assert.Equal(t, 1, len(r.readonlyKeys))
+
+	// Nor will it accept a change that would leave the cache open to anyone.
+	assert.NoError(t, os.RemoveAll(dir))
+	assert.NoError(t, os.MkdirAll(dir, os.ModeDir|0775))
+	assert.Error(t, r.loadAllKeys(dir, testCert2))
+	assert.Equal(t, 1, len(r.readonlyKeys))
+}
+
+func TestCompression(t *testing.T) {
+	s := startServer(7683, false, "", "")
+	defer s.Stop()
+	c := buildClient(t, 7683, false)
+	req := &pb.StoreRequest{
+		Os:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Hash:      bytes.Repeat([]byte{'b'}, 28),
+		Artifacts: []*pb.Artifact{{Package: "src/cache/server", Target: "compression_test", File: "file", Body: []byte("test")}},
+	}
+	ctx, cancel := ctx()
+	defer cancel()
+	_, err := c.Store(ctx, req)
+	assert.NoError(t, err, "Uncompressed calls are always fine")
+	_, err = c.Store(ctx, req, grpc.UseCompressor("gzip"))
+	assert.Error(t, err, "Fails because compression hasn't been allowed")
+	s2 := startServerWithOptions(7686, false, "", "", ServerOptions{AllowCompression: true})
+	defer s2.Stop()
+	c = buildClient(t, 7686, false)
+	_, err = c.Store(ctx, req, grpc.UseCompressor("gzip"))
+	assert.NoError(t, err)
+	resp, err := c.Retrieve(ctx, &pb.RetrieveRequest{Os: req.Os, Arch: req.Arch, Hash: req.Hash, Artifacts: req.Artifacts}, grpc.UseCompressor("gzip"))
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+}
+
+func TestSeparateRegistries(t *testing.T) {
+	// Each server gets its own registry, so we can build several without duplicate registrations.
+	cache := NewCache(testDir, 20*time.Hour, 100, 1000000, 1000000, ServerOptions{})
+	for i := 0; i < 2; i++ {
+		registry := NewRegistry()
+		s, lis := BuildGrpcServer(0, cache, nil, registry, nil, nil, nil, "", "", ServerOptions{})
+		s.Stop()
+		lis.Close()
+		families, err := registry.Gather()
+		assert.NoError(t, err)
+		names := map[string]bool{}
+		for _, family := range families {
+			names[family.GetName()] = true
+		}
+		assert.True(t, names["plz_cache_connections"])
+		assert.True(t, names["grpc_server_started_total"])
+	}
+}
+
+func TestChecksumAndSample(t *testing.T) {
+	cache := newCache("test_checksum")
+	r := &RPCServer{cache: cache}
+	ctx, cancel := ctx()
+	defer cancel()
+	assert.True(t, storeArtifact(cache, "linux", "amd64", []byte("hash"), []*pb.Artifact{
+		{Package: "pkg", Target: "target", File: "file", Body: []byte("test")},
+	}, "", "", "", 0, "", 0))
+	sample, err := r.Sample(ctx, &pb.SampleRequest{Count: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linux_amd64/pkg/target/aGFzaA/file"}, sample.Paths)
+	resp, err := r.Checksum(ctx, &pb.ChecksumRequest{Paths: append(sample.Paths, "linux_amd64/pkg/target/bm9wZQ/file")})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(resp.Files), "Files that don't exist are omitted") {
+		assert.Equal(t, "linux_amd64/pkg/target/aGFzaA/file", resp.Files[0].Path)
+		assert.EqualValues(t, 4, resp.Files[0].Size)
+		assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", resp.Files[0].Sha256)
+	}
+}
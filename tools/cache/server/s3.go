@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// s3DefaultRegion is the region we sign requests for if none is given.
+const s3DefaultRegion = "us-east-1"
+
+// s3DefaultAttempts is the number of times we try each request to S3 by default.
+const s3DefaultAttempts = 3
+
+// s3DefaultBackoff is the delay before the first retry of a failed request to S3 by default.
+// It doubles for each subsequent one.
+const s3DefaultBackoff = 100 * time.Millisecond
+
+// emptySHA256 is the hex-encoded sha256 checksum of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// An S3Config configures a Storage in an S3 bucket (see NewS3Storage).
+type S3Config struct {
+	// Bucket is the name of the bucket the artifacts are kept in.
+	Bucket string
+	// Endpoint is the URL of the S3 service, e.g. for S3-compatible stores like MinIO.
+	// Defaults to AWS's endpoint for the region.
+	Endpoint string
+	// Region is the region the bucket is in. Defaults to us-east-1.
+	Region string
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials to sign requests with.
+	// They default to $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Attempts is the number of times each request is tried before giving up. Defaults to 3.
+	Attempts int
+	// Backoff is the delay before the first retry, doubling for each one after. Defaults to 100ms.
+	Backoff time.Duration
+	// Backend, if set, names the backend in its metrics, to tell it apart from others (see StorageRoute).
+	Backend string
+}
+
+// An s3Storage is a Storage in an S3 bucket. It speaks the REST API directly, signing requests
+// with AWS Signature Version 4, and addresses the bucket by path so it also works against
+// S3-compatible stores that don't support virtual hosts.
+type s3Storage struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+	retries  prometheus.Counter
+}
+
+// NewS3Storage returns a Storage that keeps artifacts in an S3 bucket, keyed by their paths.
+// Requests that fail with a network error, a server error or throttling are retried with
+// exponential backoff.
+func NewS3Storage(config S3Config) (Storage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket given")
+	}
+	if config.Region == "" {
+		config.Region = s3DefaultRegion
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	if config.AccessKeyID == "" {
+		config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no S3 credentials given")
+	}
+	if config.Attempts <= 0 {
+		config.Attempts = s3DefaultAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = s3DefaultBackoff
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %s", config.Endpoint, err)
+	} else if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: must be http or https", config.Endpoint)
+	}
+	var labels prometheus.Labels
+	if config.Backend != "" {
+		labels = prometheus.Labels{"backend": config.Backend}
+	}
+	return &s3Storage{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Minute},
+		now:      time.Now,
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   "plz_cache",
+			Name:        "storage_retries_total",
+			Help:        "Number of requests to the storage backend that were retried after failing.",
+			ConstLabels: labels,
+		}),
+	}, nil
+}
+
+func (s *s3Storage) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3Storage) Put(key string, contents []byte) error {
+	resp, err := s.do("PUT", key, nil, contents)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil)
+	if os.IsNotExist(err) {
+		return nil // Real S3 doesn't do this, but some compatible stores do.
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3ListResult is the response to a ListObjectsV2 request.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Storage) List(prefix string) ([]StorageEntry, error) {
+	ret := []StorageEntry{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid response listing S3 bucket: %s", err)
+		}
+		for _, obj := range result.Contents {
+			ret = append(ret, StorageEntry{Key: obj.Key, Size: obj.Size, Modified: obj.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return ret, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) Size() (int64, error) {
+	entries, err := s.List("")
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	return size, err
+}
+
+// Describe implements the prometheus.Collector interface.
+func (s *s3Storage) Describe(ch chan<- *prometheus.Desc) {
+	s.retries.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (s *s3Storage) Collect(ch chan<- prometheus.Metric) {
+	s.retries.Collect(ch)
+}
+
+// do makes a request for the given key, retrying it as needed. It returns an error satisfying
+// os.IsNotExist for a 404, and any other error for anything else that isn't a success; the
+// caller must close the body of the response if there isn't one.
+func (s *s3Storage) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	backoff := s.config.Backoff
+	for i := 1; ; i++ {
+		resp, err := s.try(method, key, query, body)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		} else if err == nil {
+			err = s3Error(method, key, resp)
+			if !retryableStatus(resp.StatusCode) {
+				return nil, err
+			}
+		}
+		if i >= s.config.Attempts {
+			return nil, err
+		}
+		log.Debug("S3 %s %s failed, retrying in %s: %s", method, key, backoff, err)
+		s.retries.Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// try makes a single signed request for the given key.
+func (s *s3Storage) try(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.config.Bucket + "/" + key
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	s.sign(req, body)
+	return s.client.Do(req)
+}
+
+// s3Error returns an error describing an unsuccessful response, and closes its body.
+func s3Error(method, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 %s %s failed: %s %s", method, key, resp.Status, bytes.TrimSpace(msg))
+}
+
+// retryableStatus returns true if a request that failed with the given status is worth retrying.
+func retryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// sign signs the given request, which has the given body, with AWS Signature Version 4.
+// See https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html.
+func (s *s3Storage) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	date := now.Format("20060102T150405Z")
+	day := date[:8]
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+	headers, signedHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), day)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalHeaders returns the canonical headers of a request for signing it, and the list of
+// their names. The host is always signed, as is every header already set on it.
+func canonicalHeaders(req *http.Request) (string, string) {
+	values := map[string]string{"host": req.URL.Host}
+	for name, v := range req.Header {
+		values[strings.ToLower(name)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name + ":" + values[name] + "\n")
+	}
+	return buf.String(), strings.Join(names, ";")
+}
+
+// canonicalQuery returns the given query string in canonical form, i.e. sorted and escaped as AWS requires.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{}
+	for _, name := range names {
+		for _, v := range query[name] {
+			parts = append(parts, awsEscape(name, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything in the given string other than unreserved characters
+// (and slashes, unless escapeSlash is true), as AWS requires for signing.
+func awsEscape(s string, escapeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the given data with the given key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// minLatencySamples is the number of operations a window must contain before we'll decide the disk
+// is saturated from it, so a handful of slow ones on an idle server don't trigger shedding.
+const minLatencySamples = 10
+
+// A latencyMonitor tracks the latency of disk operations in consecutive windows, and decides
+// from each whether the disk is saturated until the next one ends.
+// It's also a Prometheus collector reporting the latency and whether it's considered saturated.
+// A nil monitor never considers it saturated.
+type latencyMonitor struct {
+	threshold, window time.Duration
+	maxCost           float64
+	mutex             sync.Mutex
+	// start is when the current window started; total and count describe the operations in it.
+	start     time.Time
+	total     time.Duration
+	count     int
+	saturated bool
+	// mean is the mean latency over the last complete window.
+	mean time.Duration
+	// latencyGauge and sheddingGauge report mean and saturated.
+	latencyGauge, sheddingGauge prometheus.Gauge
+}
+
+// newLatencyMonitor returns a new latencyMonitor that considers the disk saturated while the
+// mean latency of the operations it observes over each window is above the given threshold.
+// While it is, stores with a rebuild cost above maxCost are still accepted, since they're the
+// most valuable to keep; zero means all stores are shed.
+// It returns nil if the threshold or window are zero, i.e. load shedding is disabled.
+func newLatencyMonitor(threshold, window time.Duration, maxCost float64) *latencyMonitor {
+	if threshold <= 0 || window <= 0 {
+		return nil
+	}
+	return &latencyMonitor{
+		threshold: threshold,
+		window:    window,
+		maxCost:   maxCost,
+		latencyGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "disk_latency_seconds",
+			Help:      "Mean time taken to store & retrieve artifacts on disk over the last load shedding window.",
+		}),
+		sheddingGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "plz_cache",
+			Name:      "load_shedding",
+			Help:      "1 if stores are currently being shed because disk latency is over the threshold, 0 otherwise.",
+		}),
+	}
+}
+
+// observe records an operation that took the given time.
+func (m *latencyMonitor) observe(d time.Duration, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.roll(now)
+	m.total += d
+	m.count++
+}
+
+// shed returns true if a store of artifacts with the given rebuild cost should be rejected.
+func (m *latencyMonitor) shed(cost float64, now time.Time) bool {
+	if m == nil {
+		return false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.roll(now)
+	return m.saturated && (m.maxCost <= 0 || cost <= m.maxCost)
+}
+
+// roll starts a new window if the current one is over, and decides from it whether the disk is saturated.
+// If it ended a whole window ago nothing has happened since, so we can't still be saturated.
+func (m *latencyMonitor) roll(now time.Time) {
+	elapsed := now.Sub(m.start)
+	if elapsed < m.window {
+		return
+	}
+	m.mean = 0
+	if m.count > 0 {
+		m.mean = m.total / time.Duration(m.count)
+	}
+	saturated := m.count >= minLatencySamples && elapsed < 2*m.window && m.mean > m.threshold
+	if saturated && !m.saturated {
+		log.Warning("Disk latency over the last %s was %s, above the threshold of %s; shedding stores", m.window, m.mean, m.threshold)
+		m.sheddingGauge.Set(1)
+	} else if !saturated && m.saturated {
+		log.Notice("Disk latency over the last %s was %s, no longer shedding stores", m.window, m.mean)
+		m.sheddingGauge.Set(0)
+	}
+	m.latencyGauge.Set(m.mean.Seconds())
+	m.saturated = saturated
+	m.start = now
+	m.total = 0
+	m.count = 0
+}
+
+// latency returns the mean latency over the last complete window.
+func (m *latencyMonitor) latency() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mean
+}
+
+// Describe implements the prometheus.Collector interface.
+func (m *latencyMonitor) Describe(ch chan<- *prometheus.Desc) {
+	m.latencyGauge.Describe(ch)
+	m.sheddingGauge.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (m *latencyMonitor) Collect(ch chan<- prometheus.Metric) {
+	m.latencyGauge.Collect(ch)
+	m.sheddingGauge.Collect(ch)
+}
+
+// observeLatency records the latency of a store or retrieve that started at the given time.
+func (r *RPCCacheServer) observeLatency(start time.Time) {
+	now := time.Now()
+	r.shedder.observe(now.Sub(start), now)
+}
+
+// checkLoad returns a ResourceExhausted error if a store of artifacts with the given rebuild cost
+// should be shed because the disk is saturated.
+func (r *RPCCacheServer) checkLoad(cost float64) error {
+	if !r.shedder.shed(cost, time.Now()) {
+		return nil
+	}
+	r.cache.metrics.shedStores.Inc()
+	detail := fmt.Sprintf("disk latency %s is above %s", r.shedder.latency(), r.shedder.threshold)
+	log.Debug("Shedding store: %s", detail)
+	s := status.New(codes.ResourceExhausted, "Server is overloaded: "+detail)
+	if detailed, err := s.WithDetails(&pb.StoreError{Reason: pb.StoreError_OVERLOADED, Detail: detail}); err == nil {
+		return detailed.Err()
+	}
+	return s.Err()
+}
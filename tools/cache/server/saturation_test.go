@@ -0,0 +1,96 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestShedsWhileSaturated(t *testing.T) {
+	m := newLatencyMonitor(100*time.Millisecond, time.Minute, 0)
+	now := time.Now()
+	assert.False(t, m.shed(0, now))
+	observeN(m, minLatencySamples, 200*time.Millisecond, now)
+	assert.False(t, m.shed(0, now.Add(time.Second)), "Nothing's decided until the window is over")
+	assert.True(t, m.shed(0, now.Add(time.Minute)))
+	assert.Equal(t, 200*time.Millisecond, m.latency())
+	// It stays saturated for the whole of the next window, then recovers if latency drops.
+	observeN(m, minLatencySamples, 10*time.Millisecond, now.Add(time.Minute))
+	assert.True(t, m.shed(0, now.Add(90*time.Second)))
+	assert.False(t, m.shed(0, now.Add(2*time.Minute)))
+}
+
+func TestShedNeedsEnoughSamples(t *testing.T) {
+	m := newLatencyMonitor(100*time.Millisecond, time.Minute, 0)
+	now := time.Now()
+	m.shed(0, now)
+	observeN(m, minLatencySamples-1, time.Second, now)
+	assert.False(t, m.shed(0, now.Add(time.Minute)), "A few slow operations on an idle server shouldn't trigger it")
+}
+
+func TestShedRecoversWhenIdle(t *testing.T) {
+	m := newLatencyMonitor(100*time.Millisecond, time.Minute, 0)
+	now := time.Now()
+	m.shed(0, now)
+	observeN(m, minLatencySamples, time.Second, now)
+	assert.True(t, m.shed(0, now.Add(time.Minute)))
+	// Nothing's happened for a whole window since then, so we can't know it's still saturated.
+	assert.False(t, m.shed(0, now.Add(3*time.Minute)))
+}
+
+func TestShedKeepsExpensiveStores(t *testing.T) {
+	m := newLatencyMonitor(100*time.Millisecond, time.Minute, 60)
+	now := time.Now()
+	m.shed(0, now)
+	observeN(m, minLatencySamples, time.Second, now)
+	assert.True(t, m.shed(10, now.Add(time.Minute)))
+	assert.False(t, m.shed(600, now.Add(time.Minute)))
+}
+
+func TestShedDisabled(t *testing.T) {
+	var m *latencyMonitor
+	m.observe(time.Hour, time.Now())
+	assert.False(t, m.shed(0, time.Now()))
+}
+
+func TestStoreShed(t *testing.T) {
+	m := newLatencyMonitor(time.Millisecond, time.Minute, 0)
+	r := &RPCCacheServer{cache: newCache("test_store_shed"), shedder: m}
+	start := time.Now().Add(-time.Minute)
+	m.shed(0, start)
+	observeN(m, minLatencySamples, time.Second, start)
+	req := &pb.StoreRequest{
+		Os:   "linux",
+		Arch: "amd64",
+		Hash: []byte("1234"),
+		Artifacts: []*pb.Artifact{{
+			Package: "pkg",
+			Target:  "target",
+			File:    "file",
+			Body:    []byte("contents"),
+		}},
+	}
+	_, err := r.Store(context.Background(), req)
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err))
+	s, _ := status.FromError(err)
+	if assert.Len(t, s.Details(), 1) {
+		assert.Equal(t, pb.StoreError_OVERLOADED, s.Details()[0].(*pb.StoreError).Reason)
+	}
+	assert.False(t, r.cache.Contains("linux_amd64/pkg/target/MTIzNA/file"))
+	_, err = r.Retrieve(context.Background(), &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("1234"), Artifacts: req.Artifacts})
+	assert.NoError(t, err, "Retrieves aren't shed")
+}
+
+// observeN records n operations of the given latency at the given time.
+func observeN(m *latencyMonitor, n int, d time.Duration, now time.Time) {
+	for i := 0; i < n; i++ {
+		m.observe(d, now)
+	}
+}
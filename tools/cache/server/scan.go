@@ -0,0 +1,196 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"core"
+)
+
+// defaultScanParallelism is the number of directories we read at once while scanning the cache,
+// unless ServerOptions.ScanParallelism says otherwise.
+const defaultScanParallelism = 8
+
+// scanProgressInterval is how often we log how far the scan has got.
+const scanProgressInterval = 10 * time.Second
+
+// A scanProgress counts what the scan has found so far. It's updated by several goroutines at once.
+type scanProgress struct {
+	files, bytes int64
+	start        time.Time
+	// duration is how long the scan took, once it's finished.
+	duration int64
+}
+
+// add records a file of the given size.
+func (p *scanProgress) add(size int64) {
+	atomic.AddInt64(&p.files, 1)
+	atomic.AddInt64(&p.bytes, size)
+}
+
+// finish records that the scan has finished.
+func (p *scanProgress) finish() {
+	atomic.StoreInt64(&p.duration, int64(time.Since(p.start)))
+}
+
+// elapsed returns how long the scan has been running, or took if it's finished.
+func (p *scanProgress) elapsed() time.Duration {
+	if d := atomic.LoadInt64(&p.duration); d != 0 {
+		return time.Duration(d)
+	}
+	return time.Since(p.start)
+}
+
+// report logs the progress periodically until the given channel is closed.
+func (p *scanProgress) report(done <-chan struct{}) {
+	ticker := time.NewTicker(scanProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			log.Info("Scanned %d files (%s) in %s so far...", atomic.LoadInt64(&p.files),
+				humanize.Bytes(uint64(atomic.LoadInt64(&p.bytes))), p.elapsed().Round(time.Second))
+		}
+	}
+}
+
+// A ScanReport is how far the scan of the cache directory that builds the index has got.
+type ScanReport struct {
+	// Scanning is true while the scan is still running in the background (see
+	// ServerOptions.BackgroundScan). Until it's finished, files it hasn't found yet are looked up on disk.
+	Scanning bool `json:"scanning"`
+	// Files is the number of artifacts found so far, and Bytes their total size.
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Seconds is how long the scan has been running for, or took if it's finished.
+	Seconds float64 `json:"seconds"`
+}
+
+// ScanProgress returns how far the scan of the cache directory has got.
+func (cache *Cache) ScanProgress() ScanReport {
+	return ScanReport{
+		Scanning: cache.scanningInBackground(),
+		Files:    atomic.LoadInt64(&cache.progress.files),
+		Bytes:    atomic.LoadInt64(&cache.progress.bytes),
+		Seconds:  cache.progress.elapsed().Seconds(),
+	}
+}
+
+// scanInBackground builds the index in the background, while the cache is in use.
+func (cache *Cache) scanInBackground() {
+	cache.beginBackgroundScan()
+	go func() {
+		cache.scan()
+		cache.finishBackgroundScan()
+	}()
+}
+
+// beginBackgroundScan marks the cache as being scanned in the background, so that any file that
+// isn't in the index yet is looked up on disk.
+func (cache *Cache) beginBackgroundScan() {
+	cache.scanned = make(chan struct{})
+	atomic.StoreInt32(&cache.scanning, 1)
+}
+
+// finishBackgroundScan switches the cache over to using its index once the background scan is done.
+func (cache *Cache) finishBackgroundScan() {
+	cache.scanMutex.Lock()
+	atomic.StoreInt32(&cache.scanning, 0)
+	cache.scanMutex.Unlock()
+	defer close(cache.scanned)
+	log.Notice("Scan finished in the background after %s, now serving from the index", cache.progress.elapsed().Round(time.Second))
+	if max := cache.maxIndexEntries; max > 0 && int64(cache.cachedFiles.Count()) > max && atomic.CompareAndSwapInt32(&cache.spilling, 0, 1) {
+		// The limit isn't applied until now; see indexed.
+		defer atomic.StoreInt32(&cache.spilling, 0)
+		cache.spill(max - max/10)
+	}
+}
+
+// scanningInBackground returns true while the cache is being scanned in the background.
+func (cache *Cache) scanningInBackground() bool {
+	return atomic.LoadInt32(&cache.scanning) != 0
+}
+
+// waitForScan waits for the background scan to finish, if there is one; until then the cleaner
+// can't tell what's in the cache.
+func (cache *Cache) waitForScan() {
+	if cache.scanningInBackground() {
+		log.Info("Waiting for the cache directory to be scanned before cleaning...")
+		<-cache.scanned
+	}
+}
+
+// indexScanned adds a file found by the background scan to the index, and returns true if it did.
+// It doesn't if the file has been looked up or stored since the scan started, since that's
+// accounted for it already, or if it's been deleted since the scan found it.
+func (cache *Cache) indexScanned(name string, file *cachedFile) bool {
+	file.Lock()
+	defer file.Unlock()
+	if !cache.cachedFiles.SetIfAbsent(name, file) {
+		return false
+	} else if !core.PathExists(path.Join(cache.rootPath, name)) {
+		// As in admitFile, anyone deleting it from here on would have had to go through us.
+		file.deleted = true
+		cache.cachedFiles.Remove(name)
+		return false
+	}
+	atomic.AddInt64(&cache.totalSize, file.size)
+	return true
+}
+
+// A parallelWalker walks a directory tree, reading several directories at once.
+type parallelWalker struct {
+	dirs chan string
+	wg   sync.WaitGroup
+	f    func(name string, info os.FileInfo)
+}
+
+// walkParallel calls f for every file (but not directory) under root, with its path relative to root.
+// Up to the given number of directories are read at once, so f must be safe to call concurrently;
+// files are visited in no particular order. It dies if it can't read any directory.
+func walkParallel(root string, parallelism int, f func(name string, info os.FileInfo)) {
+	w := &parallelWalker{dirs: make(chan string, 100*parallelism), f: f}
+	for i := 0; i < parallelism; i++ {
+		go func() {
+			for dir := range w.dirs {
+				w.walk(root, dir)
+				w.wg.Done()
+			}
+		}()
+	}
+	w.wg.Add(1)
+	w.dirs <- ""
+	w.wg.Wait()
+	close(w.dirs)
+}
+
+// walk reads one directory, handing its subdirectories to other workers if any are free.
+func (w *parallelWalker) walk(root, dir string) {
+	infos, err := ioutil.ReadDir(path.Join(root, dir))
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if !info.IsDir() {
+			w.f(name, info)
+			continue
+		}
+		w.wg.Add(1)
+		select {
+		case w.dirs <- name:
+		default:
+			// Everyone's busy and the queue is full, so do it ourselves rather than blocking.
+			w.wg.Done()
+			w.walk(root, name)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeScanTestTree writes n artifacts of different sizes, spread across several packages, and
+// returns their total size.
+func writeScanTestTree(t *testing.T, dir string, n int) int64 {
+	require.NoError(t, os.RemoveAll(dir))
+	total := int64(0)
+	for i := 0; i < n; i++ {
+		contents := make([]byte, i+1)
+		p := fmt.Sprintf("linux_amd64/pkg%d/target%d/hash/file%d", i%7, i%13, i)
+		require.NoError(t, writeArtifact(path.Join(dir, p), contents, defaultChecksumAlgorithm))
+		total += int64(len(contents))
+	}
+	return total
+}
+
+func TestParallelScan(t *testing.T) {
+	const dir = "test_parallel_scan"
+	total := writeScanTestTree(t, dir, 200)
+	defer os.RemoveAll(dir)
+	for _, parallelism := range []int{0, 1, 4, 32} {
+		t.Run(fmt.Sprint(parallelism), func(t *testing.T) {
+			c := NewCache(dir, time.Hour, time.Hour, 0, 0, ServerOptions{ScanParallelism: parallelism})
+			assert.Equal(t, 200, c.NumFiles())
+			assert.Equal(t, total, c.TotalSize())
+			for i := 0; i < 200; i += 37 {
+				assert.True(t, c.Contains(fmt.Sprintf("linux_amd64/pkg%d/target%d/hash/file%d", i%7, i%13, i)))
+			}
+		})
+	}
+}
+
+func TestParallelScanIndexLimit(t *testing.T) {
+	const dir = "test_parallel_scan_index_limit"
+	total := writeScanTestTree(t, dir, 200)
+	defer os.RemoveAll(dir)
+	c := NewCache(dir, time.Hour, time.Hour, 0, 0, ServerOptions{ScanParallelism: 16, MaxIndexEntries: 50})
+	assert.Equal(t, 50, c.cachedFiles.Count())
+	assert.Equal(t, 200, c.NumFiles())
+	assert.Equal(t, total, c.TotalSize())
+}
+
+func TestBackgroundScan(t *testing.T) {
+	const dir = "test_background_scan"
+	total := writeScanTestTree(t, dir, 20)
+	defer os.RemoveAll(dir)
+	// Don't run the scan yet, so everything's served as if the index had been lost.
+	c := newUnscannedCache(dir, 0)
+	c.beginBackgroundScan()
+	assert.True(t, c.ScanProgress().Scanning)
+
+	const key = "linux_amd64/pkg0/target0/hash/file0"
+	assert.True(t, c.Contains(key))
+	arts, err := c.RetrieveArtifact(key)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{key: {0}}, arts)
+	arts, err = c.RetrieveArtifact("linux_amd64/pkg1/target1/hash")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"linux_amd64/pkg1/target1/hash/file1": {0, 0}}, arts)
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg2/target2/hash/file2", []byte("test")))
+	require.NoError(t, c.DeleteArtifact("linux_amd64/pkg3/target3/hash"))
+	assert.False(t, c.Contains("linux_amd64/pkg3/target3/hash/file3"))
+
+	cleaned := make(chan struct{})
+	go func() {
+		c.cleanOnce(false, time.Hour, total*2, total*2)
+		close(cleaned)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-cleaned:
+		assert.Fail(t, "The cleaner should wait for the scan")
+	default:
+	}
+
+	c.scan()
+	c.finishBackgroundScan()
+	<-cleaned
+	report := c.ScanProgress()
+	assert.False(t, report.Scanning)
+	assert.EqualValues(t, 19, report.Files)
+	assert.Equal(t, 19, c.cachedFiles.Count(), "Everything's in the index now")
+	assert.Equal(t, 19, c.NumFiles())
+	assert.Equal(t, total+1-4, c.TotalSize(), "What was stored and deleted during the scan is only counted once")
+	assert.True(t, c.Contains(key))
+	assert.False(t, c.Contains("linux_amd64/pkg3/target3/hash/file3"))
+}
+
+func TestBackgroundScanIndexLimit(t *testing.T) {
+	const dir = "test_background_scan_index_limit"
+	total := writeScanTestTree(t, dir, 200)
+	defer os.RemoveAll(dir)
+	c := newUnscannedCache(dir, 50)
+	c.scanInBackground()
+	c.waitForScan()
+	assert.True(t, c.cachedFiles.Count() <= 50, "The limit is applied once it's finished")
+	assert.Equal(t, 200, c.NumFiles())
+	assert.Equal(t, total, c.TotalSize())
+}
+
+func TestWalkParallel(t *testing.T) {
+	const dir = "test_walk_parallel"
+	writeScanTestTree(t, dir, 100)
+	defer os.RemoveAll(dir)
+	var mutex sync.Mutex
+	seen := map[string]int{}
+	walkParallel(dir, 3, func(name string, info os.FileInfo) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[name]++
+	})
+	// It should see exactly what filepath.Walk does, including the files stored alongside artifacts.
+	expected := map[string]int{}
+	require.NoError(t, filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			expected[name[len(dir)+1:]] = 1
+		}
+		return err
+	}))
+	assert.Equal(t, expected, seen)
+	assert.Equal(t, 1, seen["linux_amd64/pkg1/target8/hash/file99"])
+}
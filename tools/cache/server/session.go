@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/base64"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// A sessionIndex holds the build sessions protecting artifacts from being cleaned.
+// Sessions are only held in memory, so they're lost if the server restarts.
+type sessionIndex struct {
+	sessions map[string]*session
+	mutex    sync.Mutex
+}
+
+// A session is a single build session.
+type session struct {
+	expiry time.Time
+	// paths are the paths of the artifacts it protects; anything within them is protected too.
+	paths map[string]struct{}
+}
+
+// start starts or renews the given session, adding the given paths to it.
+// It returns the number of paths the session now protects.
+func (idx *sessionIndex) start(id string, paths []string, expiry, now time.Time) int {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if idx.sessions == nil {
+		idx.sessions = map[string]*session{}
+	}
+	s, present := idx.sessions[id]
+	if !present || s.expiry.Before(now) {
+		s = &session{paths: map[string]struct{}{}}
+		idx.sessions[id] = s
+	}
+	s.expiry = expiry
+	for _, p := range paths {
+		s.paths[p] = struct{}{}
+	}
+	return len(s.paths)
+}
+
+// end ends the given session. It returns false if there was no such session (or it had expired).
+func (idx *sessionIndex) end(id string, now time.Time) bool {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	s, present := idx.sessions[id]
+	delete(idx.sessions, id)
+	return present && !s.expiry.Before(now)
+}
+
+// protects returns true if any live session protects the given path, i.e. it or any directory
+// containing it was given to the session. Expired sessions are removed along the way.
+func (idx *sessionIndex) protects(p string, now time.Time) bool {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	for id, s := range idx.sessions {
+		if s.expiry.Before(now) {
+			log.Info("Build session %s has expired", id)
+			delete(idx.sessions, id)
+			continue
+		}
+		for dir := p; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, present := s.paths[dir]; present {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetMaxSessionTTL caps the time a build session can last without being renewed.
+// Zero means there's no cap.
+func (cache *Cache) SetMaxSessionTTL(ttl time.Duration) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.maxSessionTTL = ttl
+}
+
+// StartSession starts or renews the build session with the given ID, which protects the given
+// artifact paths (and anything within them) from being cleaned until it ends or expires.
+// The paths are added to any it already protects; it lasts for the given TTL, capped by the
+// maximum session TTL, from now. Protected artifacts can still be deleted explicitly.
+// It returns the time the session expires and the number of paths it now protects.
+func (cache *Cache) StartSession(id string, paths []string, ttl time.Duration) (time.Time, int) {
+	cache.scheduleMutex.Lock()
+	if cache.maxSessionTTL > 0 && ttl > cache.maxSessionTTL {
+		ttl = cache.maxSessionTTL
+	}
+	cache.scheduleMutex.Unlock()
+	for i, p := range paths {
+		paths[i] = cache.normalize(p)
+	}
+	now := cache.now()
+	expiry := now.Add(ttl)
+	return expiry, cache.sessions.start(id, paths, expiry, now)
+}
+
+// EndSession ends the build session with the given ID. It returns false if there wasn't one.
+func (cache *Cache) EndSession(id string) bool {
+	return cache.sessions.end(id, cache.now())
+}
+
+// protected returns true if the given file is protected from being cleaned by a build session.
+func (cache *Cache) protected(p string) bool {
+	return cache.sessions.protects(p, cache.now())
+}
+
+// StartSession implements the StartSession RPC to protect artifacts for the duration of a build.
+func (r *RPCCacheServer) StartSession(ctx context.Context, req *pb.SessionRequest) (*pb.SessionResponse, error) {
+	if err := r.authenticateClient(ctx, readonly); err != nil {
+		return nil, err
+	} else if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "Must pass a session id")
+	} else if req.TtlSeconds <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Must pass a positive TTL")
+	}
+	paths := []string{}
+	layout := r.cache.Layout()
+	for _, artifacts := range req.Artifacts {
+		hash := base64.RawURLEncoding.EncodeToString(artifacts.Hash)
+		for _, artifact := range artifacts.Artifacts {
+			paths = append(paths, path.Join(layout.ArtifactDir(artifacts.Os, artifacts.Arch, artifact.Package, artifact.Target, hash), artifact.File))
+		}
+	}
+	expiry, n := r.cache.StartSession(req.Id, paths, time.Duration(req.TtlSeconds)*time.Second)
+	return &pb.SessionResponse{Expiry: expiry.Unix(), NumProtected: int32(n)}, nil
+}
+
+// EndSession implements the EndSession RPC to end a build session.
+func (r *RPCCacheServer) EndSession(ctx context.Context, req *pb.EndSessionRequest) (*pb.EndSessionResponse, error) {
+	if err := r.authenticateClient(ctx, readonly); err != nil {
+		return nil, err
+	}
+	return &pb.EndSessionResponse{Success: r.cache.EndSession(req.Id)}, nil
+}
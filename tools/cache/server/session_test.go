@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestSessionProtectsFromCleaning(t *testing.T) {
+	c := newCache("test_session_protects")
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/out/file", []byte("0123456789")))
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/other/hash/file", []byte("0123456789")))
+	_, n := c.StartSession("build", []string{"linux_amd64/pkg/target/hash/out"}, time.Hour)
+	assert.Equal(t, 1, n)
+
+	assert.True(t, c.singleClean(0, 5))
+	assert.True(t, c.Contains("linux_amd64/pkg/target/hash/out/file"), "Protected by the session")
+	assert.False(t, c.Contains("linux_amd64/pkg/other/hash/file"))
+	assert.False(t, c.cleanOldFiles(0), "The only file left is protected")
+	assert.True(t, c.Contains("linux_amd64/pkg/target/hash/out/file"), "Protected from every kind of cleaning")
+
+	assert.True(t, c.EndSession("build"))
+	assert.True(t, c.singleClean(0, 5))
+	assert.False(t, c.Contains("linux_amd64/pkg/target/hash/out/file"))
+	assert.False(t, c.EndSession("build"), "It's already ended")
+}
+
+func TestSessionExpires(t *testing.T) {
+	c := newCache("test_session_expires")
+	clock := newFakeClock(time.Now())
+	c.SetClock(clock)
+	require.NoError(t, c.StoreArtifact("linux_amd64/pkg/target/hash/file", []byte("0123456789")))
+	c.StartSession("build", []string{"linux_amd64/pkg/target/hash"}, time.Minute)
+	clock.Advance(59 * time.Second)
+	assert.True(t, c.protected("linux_amd64/pkg/target/hash/file"))
+	// Nobody renews it, so it expires.
+	clock.Advance(2 * time.Second)
+	assert.False(t, c.protected("linux_amd64/pkg/target/hash/file"))
+	assert.True(t, c.singleClean(0, 5))
+	assert.False(t, c.Contains("linux_amd64/pkg/target/hash/file"))
+	assert.False(t, c.EndSession("build"))
+}
+
+func TestSessionRenewal(t *testing.T) {
+	c := newCache("test_session_renewal")
+	c.SetMaxSessionTTL(time.Minute)
+	expiry, n := c.StartSession("build", []string{"linux_amd64/pkg/a/hash"}, time.Hour)
+	assert.Equal(t, 1, n)
+	assert.True(t, expiry.Before(time.Now().Add(2*time.Minute)), "The TTL is capped")
+	// Renewing it adds to what it protects.
+	_, n = c.StartSession("build", []string{"linux_amd64/pkg/b/hash"}, time.Minute)
+	assert.Equal(t, 2, n)
+	assert.True(t, c.protected("linux_amd64/pkg/a/hash/file"))
+	assert.True(t, c.protected("linux_amd64/pkg/b/hash/file"))
+	assert.False(t, c.protected("linux_amd64/pkg/c/hash/file"))
+	assert.False(t, c.protected("linux_amd64/pkg/a/hash2/file"), "Only things within the given paths are protected")
+}
+
+func TestStartSessionRPC(t *testing.T) {
+	r := &RPCCacheServer{cache: newCache("test_start_session_rpc")}
+	_, err := r.StartSession(context.Background(), &pb.SessionRequest{TtlSeconds: 60})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err), "Needs an id")
+	_, err = r.StartSession(context.Background(), &pb.SessionRequest{Id: "build"})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err), "Needs a TTL, so it can't pin artifacts forever")
+
+	resp, err := r.StartSession(context.Background(), &pb.SessionRequest{
+		Id: "build",
+		Artifacts: []*pb.RetrieveRequest{{
+			Os:        "linux",
+			Arch:      "amd64",
+			Hash:      []byte("hash"),
+			Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a"}},
+		}},
+		TtlSeconds: 60,
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, resp.NumProtected)
+	assert.True(t, resp.Expiry > time.Now().Unix())
+	assert.True(t, r.cache.protected("linux_amd64/src/core/core/aGFzaA/core.a"))
+
+	end, err := r.EndSession(context.Background(), &pb.EndSessionRequest{Id: "build"})
+	require.NoError(t, err)
+	assert.True(t, end.Success)
+	assert.False(t, r.cache.protected("linux_amd64/src/core/core/aGFzaA/core.a"))
+}
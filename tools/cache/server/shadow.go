@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path"
+	"sync"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// shadowKeyFileName is the filename we store the shadow key of an artifact in, if it has one.
+//
+// Shadow keys let clients evaluate a change to how they compute hashes before making it.
+// Stores can give the hash the artifacts would have under the new scheme, and retrieves the hash
+// they'd look them up by; we count whether each of those would have been found, alongside
+// whether it was under the real hash. Nothing is ever served by its shadow key.
+const shadowKeyFileName = ".plz_shadow_key"
+
+// A shadowKeyIndex maps shadow keys (i.e. os_arch/package/target/shadow hash) to the
+// directories of the artifacts stored with them.
+// It's rebuilt from the shadow key files when the cache is scanned.
+type shadowKeyIndex struct {
+	dirs  map[string]string
+	mutex sync.Mutex
+}
+
+// add records that the artifact in the given directory has the given shadow key.
+func (idx *shadowKeyIndex) add(shadowKey, dir string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if idx.dirs == nil {
+		idx.dirs = map[string]string{}
+	}
+	idx.dirs[shadowKey] = dir
+}
+
+// get returns the directory of the artifact with the given shadow key.
+func (idx *shadowKeyIndex) get(shadowKey string) (string, bool) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	dir, present := idx.dirs[shadowKey]
+	return dir, present
+}
+
+// remove removes the given shadow key from the index.
+func (idx *shadowKeyIndex) remove(shadowKey string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	delete(idx.dirs, shadowKey)
+}
+
+// reset removes everything from the index.
+func (idx *shadowKeyIndex) reset() {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.dirs = nil
+}
+
+// StoreShadowKey records the shadow key of the artifact in the given directory
+// (i.e. os_arch/package/target/hash). The key has the same form, with the shadow hash in place of the real one.
+func (cache *Cache) StoreShadowKey(artPath, shadowKey string) error {
+	artPath, shadowKey = cache.normalize(artPath), cache.normalize(shadowKey)
+	lock := cache.lockFile(artPath, true, 0)
+	defer lock.Unlock()
+	fullPath := path.Join(cache.rootPath, artPath, shadowKeyFileName)
+	if err := ioutil.WriteFile(fullPath, []byte(shadowKey), 0644); err != nil {
+		log.Error("Could not write shadow key file: %s", err)
+		return err
+	}
+	cache.shadowKeys.add(shadowKey, artPath)
+	return nil
+}
+
+// readShadowKey returns the shadow key stored in the given directory, or the empty string if there isn't one.
+func (cache *Cache) readShadowKey(artPath string) string {
+	b, _ := ioutil.ReadFile(path.Join(cache.rootPath, artPath, shadowKeyFileName))
+	return string(b)
+}
+
+// ContainsShadow returns true if the cache has the given files of the artifact with the given
+// shadow key, i.e. if retrieving them by it would have been a hit. Like Contains it doesn't read them.
+func (cache *Cache) ContainsShadow(shadowKey string, files []string) bool {
+	shadowKey = cache.normalize(shadowKey)
+	dir, present := cache.shadowKeys.get(shadowKey)
+	if !present {
+		return false
+	} else if cache.readShadowKey(dir) != shadowKey {
+		// It's gone, or been stored again with a different one.
+		cache.shadowKeys.remove(shadowKey)
+		return false
+	}
+	for _, file := range files {
+		if !cache.Contains(path.Join(dir, file)) {
+			return false
+		}
+	}
+	return true
+}
+
+// storeShadowKeys records the shadow hash given with a set of artifacts, if there is one.
+func storeShadowKeys(cache *Cache, os, arch string, hash, shadowHash []byte, artifacts []*pb.Artifact) {
+	if len(shadowHash) == 0 {
+		return
+	}
+	layout := cache.Layout()
+	hashStr := base64.RawURLEncoding.EncodeToString(hash)
+	shadowStr := base64.RawURLEncoding.EncodeToString(shadowHash)
+	stored := map[string]bool{}
+	for _, artifact := range artifacts {
+		if dir := layout.ArtifactDir(os, arch, artifact.Package, artifact.Target, hashStr); !stored[dir] {
+			stored[dir] = true
+			cache.StoreShadowKey(dir, layout.ArtifactDir(os, arch, artifact.Package, artifact.Target, shadowStr))
+		}
+	}
+}
+
+// recordShadow counts whether a retrieve carrying a shadow hash would have been a hit under it,
+// along with whether it was a hit under its real hash.
+func (r *RPCCacheServer) recordShadow(req *pb.RetrieveRequest, hit bool) {
+	if len(req.ShadowHash) == 0 {
+		return
+	}
+	r.cache.metrics.shadowRetrieves.Inc()
+	if hit {
+		r.cache.metrics.shadowHits.WithLabelValues("real").Inc()
+	}
+	layout := r.cache.Layout()
+	shadowStr := base64.RawURLEncoding.EncodeToString(req.ShadowHash)
+	for _, artifact := range req.Artifacts {
+		if !r.cache.ContainsShadow(layout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, shadowStr), []string{artifact.File}) {
+			return
+		}
+	}
+	r.cache.metrics.shadowHits.WithLabelValues("shadow").Inc()
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestShadowKeys(t *testing.T) {
+	const dir = "test_shadow_keys"
+	c := newCache(dir)
+	artifacts := []*pb.Artifact{
+		{Package: "pkg", Target: "target", File: "file1", Body: []byte("test")},
+		{Package: "pkg", Target: "target", File: "file2", Body: []byte("test")},
+	}
+	assert.True(t, storeArtifact(c, "linux", "amd64", []byte("hash"), artifacts, "", "", "", 0, "", 0))
+	storeShadowKeys(c, "linux", "amd64", []byte("hash"), []byte("shadow"), artifacts)
+	const shadowKey = "linux_amd64/pkg/target/c2hhZG93"
+	assert.True(t, c.ContainsShadow(shadowKey, []string{"file1", "file2"}))
+	assert.False(t, c.ContainsShadow(shadowKey, []string{"file3"}))
+	assert.False(t, c.ContainsShadow("linux_amd64/pkg/target/b3RoZXI", []string{"file1"}))
+
+	// The index is rebuilt when the cache restarts.
+	c = newCache(dir)
+	assert.EqualValues(t, 2*4, c.TotalSize(), "Shadow key files aren't counted")
+	assert.True(t, c.ContainsShadow(shadowKey, []string{"file1"}))
+
+	// It stops counting once the artifacts are gone.
+	assert.NoError(t, c.DeleteArtifact("linux_amd64/pkg/target/aGFzaA/file1"))
+	assert.False(t, c.ContainsShadow(shadowKey, []string{"file1"}))
+	assert.True(t, c.ContainsShadow(shadowKey, []string{"file2"}))
+}
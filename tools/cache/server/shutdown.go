@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tools/cache/cluster"
+)
+
+// flushPollInterval is how often Flush checks whether the pending writes have finished.
+const flushPollInterval = 10 * time.Millisecond
+
+// defaultLeaveTimeout is how long we wait to leave the cluster if the context given to Shutdown has no deadline.
+const defaultLeaveTimeout = 5 * time.Second
+
+// A ServerGroup is a set of servers built by BuildGrpcServer that are shut down together. Servers
+// are added to it by giving it to BuildGrpcServer in their options.
+type ServerGroup struct {
+	servers []builtServer
+	mutex   sync.Mutex
+}
+
+// NewServerGroup returns a new, empty ServerGroup.
+func NewServerGroup() *ServerGroup {
+	return &ServerGroup{}
+}
+
+// A builtServer is a server built by BuildGrpcServer, which ServerGroup.Shutdown stops.
+type builtServer struct {
+	server  *grpc.Server
+	drainer *drainer
+	cache   *Cache
+	cluster *cluster.Cluster
+}
+
+// add records a server built by BuildGrpcServer so Shutdown can stop it.
+func (g *ServerGroup) add(s builtServer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.servers = append(g.servers, s)
+}
+
+// A drainer counts the RPCs a server is handling, so ServerGroup.Shutdown can wait for them to finish before
+// stopping it. We can't leave that to GracefulStop, since the version of grpc we use can close the
+// connection before sending the response to the last RPC in progress on it.
+// Once it's draining it refuses new RPCs, as if the server had already stopped.
+type drainer struct {
+	active   int64
+	draining int32
+}
+
+// start counts the start of an RPC, returning an Unavailable error if we're draining.
+func (d *drainer) start() error {
+	atomic.AddInt64(&d.active, 1)
+	if atomic.LoadInt32(&d.draining) != 0 {
+		atomic.AddInt64(&d.active, -1)
+		return status.Error(codes.Unavailable, "Server is shutting down")
+	}
+	return nil
+}
+
+// finish counts the end of an RPC.
+func (d *drainer) finish() {
+	atomic.AddInt64(&d.active, -1)
+}
+
+// unary returns a unary interceptor that counts RPCs and then calls the given one.
+func (d *drainer) unary(next grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := d.start(); err != nil {
+			return nil, err
+		}
+		defer d.finish()
+		return next(ctx, req, info, handler)
+	}
+}
+
+// stream returns a stream interceptor that counts RPCs and then calls the given one.
+func (d *drainer) stream(next grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := d.start(); err != nil {
+			return err
+		}
+		defer d.finish()
+		return next(srv, ss, info, handler)
+	}
+}
+
+// drain refuses any new RPCs, then waits for those in progress to finish. It returns false if
+// the context is done first.
+func (d *drainer) drain(ctx context.Context) bool {
+	atomic.StoreInt32(&d.draining, 1)
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&d.active) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Shutdown gracefully shuts down every server in the group. Each stops accepting new RPCs and
+// waits for those in progress to finish, then its cache finishes any pending writes and writes
+// back its files' last read times (see PersistAccessTimes), and it leaves its cluster. If the
+// context is done first, any RPCs still in progress are cancelled and it returns an error;
+// artifacts they were partway through writing are removed the next time the cache is scanned, so
+// they're never served. Servers in other groups, or none, are left alone.
+func (g *ServerGroup) Shutdown(ctx context.Context) error {
+	g.mutex.Lock()
+	servers := g.servers
+	g.servers = nil
+	g.mutex.Unlock()
+	var err error
+	for _, s := range servers {
+		if e := s.shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// shutdown shuts down a single server.
+func (s builtServer) shutdown(ctx context.Context) error {
+	var err error
+	if s.drainer.drain(ctx) {
+		log.Notice("All in-flight RPCs have finished")
+		s.server.GracefulStop()
+	} else {
+		s.server.Stop()
+		err = fmt.Errorf("timed out waiting for in-flight RPCs to finish")
+	}
+	if e := s.cache.Flush(ctx); e != nil && err == nil {
+		err = e
+	}
+	if n := s.cache.persistAccessTimes(); n > 0 {
+		log.Notice("Wrote access times of %d files", n)
+	}
+	if s.cluster != nil {
+		timeout := defaultLeaveTimeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		if e := s.cluster.Leave(timeout); e != nil && err == nil {
+			err = fmt.Errorf("failed to leave cluster: %s", e)
+		}
+	}
+	return err
+}
+
+// Flush waits for any artifacts that are being written to finish, including those being copied
+// to the mirror (see SetMirror). It returns an error if the context is done first.
+func (cache *Cache) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for {
+		if atomic.LoadInt64(&cache.writes) == 0 && cache.currentMirror().idle() {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %d pending writes", atomic.LoadInt64(&cache.writes))
+		}
+	}
+}
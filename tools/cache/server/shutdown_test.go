@@ -0,0 +1,97 @@
+package server
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestShutdownDrainsRPCs(t *testing.T) {
+	cache := newCache("test_shutdown_drains")
+	defer os.RemoveAll(cache.rootPath)
+	resp, err := storeDuringShutdown(t, cache, 500*time.Millisecond, 5*time.Second, assert.NoError)
+	require.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.True(t, cache.Contains("linux_amd64/src/core/core/aGFzaA/core.a"), "The store finished before it shut down")
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	cache := newCache("test_shutdown_timeout")
+	defer os.RemoveAll(cache.rootPath)
+	_, err := storeDuringShutdown(t, cache, 5*time.Second, 100*time.Millisecond, assert.Error)
+	assert.Error(t, err, "The store was cut off")
+}
+
+// storeDuringShutdown starts a server, makes a store to it that takes the given time, and shuts
+// it down with the given timeout while the store is in progress. It checks the result of Shutdown
+// with the given function and returns the result of the store.
+func storeDuringShutdown(t *testing.T, cache *Cache, storeTime, timeout time.Duration, check func(assert.TestingT, error, ...interface{}) bool) (*pb.StoreResponse, error) {
+	faults := NewFaultInjector()
+	faults.set(faultConfig{Latency: storeTime})
+	group := NewServerGroup()
+	s, lis := BuildGrpcServer(0, cache, nil, nil, nil, nil, nil, "", "", ServerOptions{Faults: faults, Servers: group})
+	go ServeGrpcForever(s, lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	type result struct {
+		resp *pb.StoreResponse
+		err  error
+	}
+	ch := make(chan result)
+	go func() {
+		resp, err := pb.NewRpcCacheClient(conn).Store(context.Background(), &pb.StoreRequest{
+			Os:        "linux",
+			Arch:      "amd64",
+			Hash:      []byte("hash"),
+			Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a", Body: []byte("archive")}},
+		})
+		ch <- result{resp: resp, err: err}
+	}()
+	time.Sleep(100 * time.Millisecond) // Give it time to start.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	check(t, group.Shutdown(ctx))
+	r := <-ch
+	return r.resp, r.err
+}
+
+func TestShutdownOnlyStopsGroup(t *testing.T) {
+	cache := newCache("test_shutdown_group")
+	defer os.RemoveAll(cache.rootPath)
+	group := NewServerGroup()
+	s1, lis1 := BuildGrpcServer(0, cache, nil, nil, nil, nil, nil, "", "", ServerOptions{Servers: group})
+	go ServeGrpcForever(s1, lis1)
+	s2, lis2 := BuildGrpcServer(0, cache, nil, nil, nil, nil, nil, "", "", ServerOptions{})
+	go ServeGrpcForever(s2, lis2)
+	defer s2.Stop()
+	require.True(t, CheckHealth(lis1.Addr().String(), false, 5*time.Second))
+	require.True(t, CheckHealth(lis2.Addr().String(), false, 5*time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, group.Shutdown(ctx))
+	assert.False(t, CheckHealth(lis1.Addr().String(), false, 100*time.Millisecond))
+	assert.True(t, CheckHealth(lis2.Addr().String(), false, 5*time.Second), "The server outside the group is still serving")
+}
+
+func TestFlush(t *testing.T) {
+	cache := newCache("test_flush")
+	defer os.RemoveAll(cache.rootPath)
+	atomic.AddInt64(&cache.writes, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, cache.Flush(ctx), "There's a write that never finishes")
+
+	atomic.AddInt64(&cache.writes, -1)
+	assert.NoError(t, cache.Flush(context.Background()))
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/djherbis/atime"
+
+	"core"
+)
+
+// snapshotManifestName is the name of the manifest entry at the start of a snapshot archive.
+const snapshotManifestName = "MANIFEST"
+
+// snapshotVersion is the current version of the snapshot format.
+const snapshotVersion = 1
+
+// A snapshotManifest describes the contents of a snapshot.
+type snapshotManifest struct {
+	Version int                      `json:"version"`
+	Created time.Time                `json:"created"`
+	Files   map[string]*snapshotFile `json:"files"`
+}
+
+// A snapshotFile is the metadata we record for each file in a snapshot.
+// Note that access control is configured per server (via certificates) rather than per artifact,
+// so there's nothing to record for it here.
+type snapshotFile struct {
+	Size int64  `json:"size"`
+	Hash string `json:"sha256"`
+	// Last time the file was read; this is what determines when the cleaner expires it.
+	LastRead time.Time   `json:"last_read"`
+	Mode     os.FileMode `json:"mode"`
+}
+
+// ExportSnapshot writes a snapshot of the cache directory at the given path to the given writer,
+// as a tar archive. The cache should not be in use by a server while this is running.
+// It returns the number of files exported.
+func ExportSnapshot(dir string, w io.Writer) (int, error) {
+	dir = path.Clean(dir)
+	manifest := snapshotManifest{Version: snapshotVersion, Created: time.Now(), Files: map[string]*snapshotFile{}}
+	names := []string{}
+	if err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return nil
+		}
+		hash, err := hashFile(name)
+		if err != nil {
+			return err
+		}
+		name = name[len(dir)+1:]
+		names = append(names, name)
+		manifest.Files[name] = &snapshotFile{
+			Size:     info.Size(),
+			Hash:     hash,
+			LastRead: atime.Get(info),
+			Mode:     info.Mode(),
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	b, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    snapshotManifestName,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: manifest.Created,
+	}); err != nil {
+		return 0, err
+	} else if _, err := tw.Write(b); err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if err := exportFile(tw, dir, name, manifest.Files[name]); err != nil {
+			return 0, err
+		}
+	}
+	return len(names), tw.Close()
+}
+
+// exportFile writes a single file to the given tar writer.
+func exportFile(tw *tar.Writer, dir, name string, file *snapshotFile) error {
+	f, err := os.Open(path.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(file.Mode.Perm()),
+		Size:    file.Size,
+		ModTime: file.LastRead,
+	}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, file.Size)
+	return err
+}
+
+// ImportSnapshot restores a snapshot previously written by ExportSnapshot into the given directory.
+// Any files whose contents don't match the checksum recorded in the manifest are skipped.
+// It returns the number of files imported and skipped.
+func ImportSnapshot(dir string, r io.Reader) (int, int, error) {
+	_, imported, skipped, err := ImportPartialSnapshot(dir, r, nil)
+	return imported, skipped, err
+}
+
+// ImportPartialSnapshot is like ImportSnapshot but only restores the files matching at least one
+// of the given patterns, e.g. to restore a single architecture or package without extracting
+// everything. Patterns are as path.Match and match a file if they match its path or any of its
+// parent directories, so a plain path also matches everything under it. Files that don't match
+// are skipped over in the archive without being extracted, and aren't counted as skipped.
+// An empty list of patterns matches everything.
+// It returns the number of files in the snapshot that matched and how many were imported and skipped.
+func ImportPartialSnapshot(dir string, r io.Reader, patterns []string) (int, int, int, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return 0, 0, 0, fmt.Errorf("Invalid pattern %s: %s", pattern, err)
+		}
+	}
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Failed to read snapshot manifest: %s", err)
+	} else if hdr.Name != snapshotManifestName {
+		return 0, 0, 0, fmt.Errorf("Snapshot doesn't begin with a manifest (found %s)", hdr.Name)
+	}
+	manifest := snapshotManifest{}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return 0, 0, 0, fmt.Errorf("Failed to decode snapshot manifest: %s", err)
+	} else if manifest.Version != snapshotVersion {
+		return 0, 0, 0, fmt.Errorf("Unsupported snapshot version %d", manifest.Version)
+	}
+	// The manifest tells us up front how many files match.
+	matched := 0
+	for name := range manifest.Files {
+		if matchesSnapshotPatterns(name, patterns) {
+			matched++
+		}
+	}
+	imported := 0
+	skipped := 0
+	seen := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return matched, imported, skipped, err
+		} else if !matchesSnapshotPatterns(hdr.Name, patterns) {
+			continue
+		}
+		file, present := manifest.Files[hdr.Name]
+		if !present {
+			log.Warning("Skipping %s, it isn't in the snapshot manifest", hdr.Name)
+			skipped++
+			continue
+		}
+		seen++
+		if !isValidSnapshotPath(hdr.Name) {
+			log.Warning("Skipping %s, invalid path", hdr.Name)
+			skipped++
+		} else if err := importFile(tr, dir, hdr.Name, file); err != nil {
+			log.Warning("Skipping %s: %s", hdr.Name, err)
+			skipped++
+		} else {
+			imported++
+		}
+	}
+	if missing := matched - seen; missing > 0 {
+		log.Warning("%d files in the snapshot manifest were missing from the archive", missing)
+		skipped += missing
+	}
+	return matched, imported, skipped, nil
+}
+
+// matchesSnapshotPatterns returns true if the given path in a snapshot, or any of its parent
+// directories, matches any of the given patterns. It's always true if there are no patterns.
+func matchesSnapshotPatterns(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for dir := name; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(strings.TrimSuffix(pattern, "/"), dir); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// importFile extracts a single file from the snapshot. It's written to a temporary location first
+// and only moved into place once its checksum has been verified.
+func importFile(r io.Reader, dir, name string, file *snapshotFile) error {
+	dest := path.Join(dir, name)
+	if err := os.MkdirAll(path.Dir(dest), core.DirPermissions); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Dir(dest), ".plz_import")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Harmless if we've already renamed it.
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	f.Close()
+	if err != nil {
+		return err
+	} else if hash := hex.EncodeToString(h.Sum(nil)); hash != file.Hash {
+		return fmt.Errorf("checksum mismatch; expected %s, got %s", file.Hash, hash)
+	} else if err := os.Chmod(f.Name(), file.Mode.Perm()); err != nil {
+		return err
+	} else if err := os.Chtimes(f.Name(), file.LastRead, file.LastRead); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+// isValidSnapshotPath returns true if the given path is acceptable to extract from a snapshot.
+func isValidSnapshotPath(name string) bool {
+	return name != "" && !path.IsAbs(name) && path.Clean(name) == name && name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// hashFile returns the hex-encoded sha256 hash of the given file.
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
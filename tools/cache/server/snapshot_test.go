@@ -0,0 +1,152 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportAndImportSnapshot(t *testing.T) {
+	src := writeSnapshotFiles(t, "snapshot_src", map[string]string{
+		"linux_amd64/pkg/name/label_name/abcd/file1": "hello",
+		"linux_amd64/pkg/name/label_name/abcd/file2": "world",
+	})
+	var buf bytes.Buffer
+	n, err := ExportSnapshot(src, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	dest := "snapshot_dest"
+	imported, skipped, err := ImportSnapshot(dest, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, imported)
+	assert.Equal(t, 0, skipped)
+	b, err := ioutil.ReadFile(path.Join(dest, "linux_amd64/pkg/name/label_name/abcd/file2"))
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+}
+
+func TestImportSnapshotSkipsCorruptFiles(t *testing.T) {
+	src := writeSnapshotFiles(t, "snapshot_corrupt", map[string]string{
+		"linux_amd64/pkg/name/label_name/abcd/file1": "hello",
+		"linux_amd64/pkg/name/label_name/abcd/file2": "world",
+	})
+	var buf bytes.Buffer
+	_, err := ExportSnapshot(src, &buf)
+	require.NoError(t, err)
+
+	// Rewrite the archive, changing the contents of one file but not its checksum.
+	var corrupt bytes.Buffer
+	tr := tar.NewReader(&buf)
+	tw := tar.NewWriter(&corrupt)
+	for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+		b, _ := ioutil.ReadAll(tr)
+		if path.Base(hdr.Name) == "file1" {
+			b = []byte("jello")
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		tw.Write(b)
+	}
+	tw.Close()
+
+	dest := "snapshot_corrupt_dest"
+	imported, skipped, err := ImportSnapshot(dest, &corrupt)
+	require.NoError(t, err)
+	assert.Equal(t, 1, imported)
+	assert.Equal(t, 1, skipped)
+	_, err = os.Stat(path.Join(dest, "linux_amd64/pkg/name/label_name/abcd/file1"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestImportPartialSnapshot(t *testing.T) {
+	src := writeSnapshotFiles(t, "snapshot_partial", map[string]string{
+		"linux_amd64/src/core/core/abcd/core.a":        "core",
+		"linux_amd64/src/core/core_test/abcd/core.a":   "core_test",
+		"linux_amd64/src/cache/cache/abcd/cache.a":     "cache",
+		"darwin_amd64/src/core/core/abcd/core.a":       "darwin core",
+		"darwin_amd64/third_party/go/grpc/abcd/grpc.a": "grpc",
+	})
+	var buf bytes.Buffer
+	_, err := ExportSnapshot(src, &buf)
+	require.NoError(t, err)
+	b := buf.Bytes()
+
+	for _, test := range []struct {
+		patterns []string
+		expected int
+	}{
+		{nil, 5},
+		{[]string{"linux_amd64"}, 3},
+		{[]string{"linux_amd64/src/core/"}, 2},
+		{[]string{"linux_amd64/src/core/core"}, 1},
+		{[]string{"*/src/core"}, 3},
+		{[]string{"linux_amd64/src/cache", "darwin_amd64/third_party"}, 2},
+		{[]string{"linux_amd64/src/co"}, 0}, // Plain paths only match whole directories.
+		{[]string{"linux_amd64/src/co*"}, 2},
+		{[]string{"windows_amd64"}, 0},
+	} {
+		dest := "snapshot_partial_dest"
+		os.RemoveAll(dest)
+		matched, imported, skipped, err := ImportPartialSnapshot(dest, bytes.NewReader(b), test.patterns)
+		require.NoError(t, err, "%s", test.patterns)
+		assert.Equal(t, test.expected, matched, "%s", test.patterns)
+		assert.Equal(t, test.expected, imported, "%s", test.patterns)
+		assert.Equal(t, 0, skipped, "%s", test.patterns)
+		assert.Equal(t, test.expected, countSnapshotFiles(t, dest), "%s", test.patterns)
+	}
+}
+
+func TestImportPartialSnapshotInvalidPattern(t *testing.T) {
+	src := writeSnapshotFiles(t, "snapshot_partial_invalid", map[string]string{
+		"linux_amd64/pkg/name/label_name/abcd/file1": "hello",
+	})
+	var buf bytes.Buffer
+	_, err := ExportSnapshot(src, &buf)
+	require.NoError(t, err)
+	_, _, _, err = ImportPartialSnapshot("snapshot_partial_invalid_dest", &buf, []string{"linux_amd64/["})
+	assert.Error(t, err)
+}
+
+func TestImportSnapshotRequiresManifest(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "linux_amd64/file", Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	_, _, err := ImportSnapshot("snapshot_no_manifest", &buf)
+	assert.Error(t, err)
+}
+
+func TestIsValidSnapshotPath(t *testing.T) {
+	assert.True(t, isValidSnapshotPath("linux_amd64/pkg/name/file"))
+	assert.False(t, isValidSnapshotPath("/etc/passwd"))
+	assert.False(t, isValidSnapshotPath("../file"))
+	assert.False(t, isValidSnapshotPath("linux_amd64/../../file"))
+}
+
+func writeSnapshotFiles(t *testing.T, dir string, files map[string]string) string {
+	for name, contents := range files {
+		filename := path.Join(dir, name)
+		require.NoError(t, os.MkdirAll(path.Dir(filename), os.ModeDir|0775))
+		require.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+	}
+	return dir
+}
+
+func countSnapshotFiles(t *testing.T, dir string) int {
+	n := 0
+	filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStatsSnapshots is the most stats snapshots we keep at once; the oldest is dropped to make room for more.
+const maxStatsSnapshots = 50
+
+// statsSnapshotExpiry is how long we keep stats snapshots for.
+const statsSnapshotExpiry = 24 * time.Hour
+
+// cacheStats are cumulative counts of what the cache has done since it started.
+type cacheStats struct {
+	Stores         int64 `json:"stores"`
+	StoredBytes    int64 `json:"stored_bytes"`
+	Retrieves      int64 `json:"retrieves"`
+	RetrievedBytes int64 `json:"retrieved_bytes"`
+	Evictions      int64 `json:"evictions"`
+	EvictedBytes   int64 `json:"evicted_bytes"`
+	// GhostHits counts misses for files we'd evicted to make space (see SetGhostCacheSize).
+	GhostHits     int64 `json:"ghost_hits"`
+	GhostHitBytes int64 `json:"ghost_hit_bytes"`
+}
+
+// sub returns the difference between these stats and an earlier set.
+func (s cacheStats) sub(earlier cacheStats) cacheStats {
+	return cacheStats{
+		Stores:         s.Stores - earlier.Stores,
+		StoredBytes:    s.StoredBytes - earlier.StoredBytes,
+		Retrieves:      s.Retrieves - earlier.Retrieves,
+		RetrievedBytes: s.RetrievedBytes - earlier.RetrievedBytes,
+		Evictions:      s.Evictions - earlier.Evictions,
+		EvictedBytes:   s.EvictedBytes - earlier.EvictedBytes,
+		GhostHits:      s.GhostHits - earlier.GhostHits,
+		GhostHitBytes:  s.GhostHitBytes - earlier.GhostHitBytes,
+	}
+}
+
+// A statsSnapshot is the stats at a point in time, in total and for each namespace.
+// A namespace is the OS / architecture and top-level package directory of an artifact,
+// e.g. linux_amd64/src for linux_amd64/src/core/core/<hash>/core.a.
+type statsSnapshot struct {
+	Name       string                `json:"name,omitempty"`
+	Time       time.Time             `json:"time"`
+	Total      cacheStats            `json:"total"`
+	Namespaces map[string]cacheStats `json:"namespaces"`
+}
+
+// A statsDiff is the difference between two snapshots.
+type statsDiff struct {
+	From       string                `json:"from"`
+	To         string                `json:"to"`
+	Seconds    float64               `json:"seconds"`
+	Total      cacheStats            `json:"total"`
+	Namespaces map[string]cacheStats `json:"namespaces"`
+}
+
+// A statsRecorder keeps the cache's stats, and named snapshots of them so they can be compared later.
+type statsRecorder struct {
+	total      cacheStats
+	namespaces map[string]*cacheStats
+	snapshots  map[string]*statsSnapshot
+	mutex      sync.Mutex
+}
+
+// namespace returns the namespace of the given artifact path.
+func namespace(artPath string) string {
+	if parts := strings.SplitN(artPath, "/", 3); len(parts) == 3 {
+		return parts[0] + "/" + parts[1]
+	}
+	return artPath
+}
+
+// record updates the stats for the given artifact path with the given function.
+func (r *statsRecorder) record(artPath string, f func(s *cacheStats)) {
+	ns := namespace(artPath)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.namespaces == nil {
+		r.namespaces = map[string]*cacheStats{}
+	}
+	s, present := r.namespaces[ns]
+	if !present {
+		s = &cacheStats{}
+		r.namespaces[ns] = s
+	}
+	f(s)
+	f(&r.total)
+}
+
+// totals returns the cumulative stats across all namespaces.
+func (r *statsRecorder) totals() cacheStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.total
+}
+
+// current returns a snapshot of the stats as they are now.
+// The caller must hold the mutex.
+func (r *statsRecorder) current(name string) *statsSnapshot {
+	snapshot := &statsSnapshot{Name: name, Time: time.Now(), Total: r.total, Namespaces: make(map[string]cacheStats, len(r.namespaces))}
+	for ns, s := range r.namespaces {
+		snapshot.Namespaces[ns] = *s
+	}
+	return snapshot
+}
+
+// Snapshot captures the current stats under the given name, replacing any existing snapshot with it.
+func (r *statsRecorder) Snapshot(name string) *statsSnapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire()
+	if r.snapshots == nil {
+		r.snapshots = map[string]*statsSnapshot{}
+	}
+	if _, present := r.snapshots[name]; !present && len(r.snapshots) >= maxStatsSnapshots {
+		oldest := ""
+		for n, s := range r.snapshots {
+			if oldest == "" || s.Time.Before(r.snapshots[oldest].Time) {
+				oldest = n
+			}
+		}
+		delete(r.snapshots, oldest)
+	}
+	snapshot := r.current(name)
+	r.snapshots[name] = snapshot
+	return snapshot
+}
+
+// Snapshots returns all the current snapshots, oldest first.
+// They only have their totals, not the individual namespaces.
+func (r *statsRecorder) Snapshots() []*statsSnapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire()
+	ret := make([]*statsSnapshot, 0, len(r.snapshots))
+	for _, s := range r.snapshots {
+		ret = append(ret, &statsSnapshot{Name: s.Name, Time: s.Time, Total: s.Total})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret
+}
+
+// Diff returns the difference between two snapshots. If to is empty it compares the first to the current stats.
+func (r *statsRecorder) Diff(from, to string) (*statsDiff, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire()
+	earlier, present := r.snapshots[from]
+	if !present {
+		return nil, fmt.Errorf("Unknown snapshot %s", from)
+	}
+	later := r.current("")
+	if to != "" {
+		if later, present = r.snapshots[to]; !present {
+			return nil, fmt.Errorf("Unknown snapshot %s", to)
+		}
+	}
+	diff := &statsDiff{
+		From:       from,
+		To:         to,
+		Seconds:    later.Time.Sub(earlier.Time).Seconds(),
+		Total:      later.Total.sub(earlier.Total),
+		Namespaces: map[string]cacheStats{},
+	}
+	for ns, s := range later.Namespaces {
+		if d := s.sub(earlier.Namespaces[ns]); d != (cacheStats{}) {
+			diff.Namespaces[ns] = d
+		}
+	}
+	return diff, nil
+}
+
+// expire removes any snapshots that have expired.
+// The caller must hold the mutex.
+func (r *statsRecorder) expire() {
+	for name, s := range r.snapshots {
+		if time.Since(s.Time) > statsSnapshotExpiry {
+			delete(r.snapshots, name)
+		}
+	}
+}
+
+// StatsHandler returns an HTTP handler for capturing snapshots of the cache's stats and comparing them.
+// POST /stats/snapshot?name=<name> captures one, GET /stats/snapshots lists them, and
+// GET /stats/diff?from=<name>&to=<name> returns the difference between two (or between one and
+// now, if to isn't given), in total and per namespace. All responses are JSON.
+// Snapshots expire after a day, and only the most recent 50 are kept.
+// GET /stats/targets?pattern=<pattern>&n=<n>&min_retrieves=<min> reports the hits & misses of the
+// targets matching a build label pattern (by default all of them) and the n with the worst hit
+// ratios, of those retrieved at least min times; it's only populated if SetTargetStatsSize was called.
+// GET /stats/mode reports whether the cache is in maintenance mode or read-only, and why.
+// GET /stats/migration reports the progress of moving artifacts to a new layout with MigrateLayout.
+// GET /stats/scan reports the progress of scanning the cache directory to build the index.
+func (cache *Cache) StatsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "Must pass a name for the snapshot", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, cache.stats.Snapshot(name))
+	})
+	mux.HandleFunc("/stats/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, cache.stats.Snapshots())
+	})
+	mux.HandleFunc("/stats/diff", func(w http.ResponseWriter, r *http.Request) {
+		diff, err := cache.stats.Diff(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, diff)
+	})
+	mux.HandleFunc("/stats/targets", cache.targetsHandler)
+	mux.HandleFunc("/stats/mode", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, cache.mode())
+	})
+	mux.HandleFunc("/stats/migration", func(w http.ResponseWriter, r *http.Request) {
+		if report := cache.LayoutMigration(); report != nil {
+			writeJSON(w, report)
+		} else {
+			http.Error(w, "No layout migration has been run", http.StatusNotFound)
+		}
+	})
+	mux.HandleFunc("/stats/scan", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, cache.ScanProgress())
+	})
+	return mux
+}
+
+// writeJSON writes the given value to an HTTP response as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warning("Failed to write response: %s", err)
+	}
+}
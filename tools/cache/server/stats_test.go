@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsDiff(t *testing.T) {
+	c := newCache("test_stats_diff")
+	s := httptest.NewServer(c.StatsHandler())
+	defer s.Close()
+
+	require.NoError(t, c.StoreArtifact("linux_amd64/src/core/hash/core.a", []byte("test")))
+	resp, err := http.Post(s.URL+"/stats/snapshot?name=a", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, c.StoreArtifact("linux_amd64/src/core/hash2/core.a", []byte("hello")))
+	require.NoError(t, c.StoreArtifact("linux_amd64/tools/cache/hash/cache", []byte("world!")))
+	_, err = c.RetrieveArtifact("linux_amd64/src/core/hash2/core.a")
+	require.NoError(t, err)
+	resp, err = http.Post(s.URL+"/stats/snapshot?name=b", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(s.URL + "/stats/diff?from=a&to=b")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var diff statsDiff
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&diff))
+	assert.EqualValues(t, 2, diff.Total.Stores)
+	assert.EqualValues(t, 11, diff.Total.StoredBytes)
+	assert.EqualValues(t, 1, diff.Total.Retrieves)
+	assert.EqualValues(t, 5, diff.Total.RetrievedBytes)
+	assert.EqualValues(t, 1, diff.Namespaces["linux_amd64/src"].Retrieves)
+	assert.EqualValues(t, 1, diff.Namespaces["linux_amd64/tools"].Stores)
+	assert.Equal(t, 2, len(diff.Namespaces))
+
+	resp, err = http.Get(s.URL + "/stats/snapshots")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var snapshots []statsSnapshot
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&snapshots))
+	require.Equal(t, 2, len(snapshots))
+	assert.Equal(t, "a", snapshots[0].Name)
+	assert.Equal(t, "b", snapshots[1].Name)
+}
+
+func TestStatsDiffErrors(t *testing.T) {
+	s := httptest.NewServer(newCache("test_stats_diff_errors").StatsHandler())
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/stats/diff?from=nope")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, err = http.Get(s.URL + "/stats/snapshot?name=a")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, err = http.Post(s.URL+"/stats/snapshot", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestStatsSnapshotLimit(t *testing.T) {
+	var r statsRecorder
+	for i := 0; i <= maxStatsSnapshots; i++ {
+		r.Snapshot(string(rune('A' + i)))
+	}
+	snapshots := r.Snapshots()
+	assert.Equal(t, maxStatsSnapshots, len(snapshots))
+	assert.Equal(t, "B", snapshots[0].Name, "The oldest should have been dropped")
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Storage is a backend that artifacts are kept in durably, beyond the local cache directory
+// (see SetStorage). Keys are artifact paths relative to the cache directory.
+type Storage interface {
+	// Get returns the contents of the given artifact, or an error satisfying os.IsNotExist if it doesn't exist.
+	Get(key string) ([]byte, error)
+	// Put stores the given artifact, replacing it if it already exists.
+	Put(key string, contents []byte) error
+	// Delete deletes the given artifact. It isn't an error if it doesn't exist.
+	Delete(key string) error
+	// List returns all the artifacts whose keys start with the given prefix.
+	List(prefix string) ([]StorageEntry, error)
+	// Size returns the total size of all the artifacts.
+	Size() (int64, error)
+}
+
+// A StorageEntry describes a single artifact in a Storage.
+type StorageEntry struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// SetStorage sets a backend that every artifact stored is also written to, in the background.
+// Artifacts that aren't in the cache directory are looked for there before they're treated as
+// missing, and copied back into it if they're found, so the cache survives losing its directory
+// (e.g. on a redeploy with ephemeral disks). They're deleted from it when they're explicitly
+// deleted, invalidated or expire, but not when they're evicted to make space locally; instead
+// each clean also brings the backend under the water marks, removing the least recently stored first.
+// Only artifacts are kept in the backend, not their metadata, build keys, expiries or aliases.
+func (cache *Cache) SetStorage(storage Storage) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.storage = storage
+}
+
+// currentStorage returns the storage backend, or nil if there isn't one.
+func (cache *Cache) currentStorage() Storage {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.storage
+}
+
+// persist writes the given artifact, as it's stored on disk, to the storage backend in the
+// background. Flush waits for it to finish.
+func (cache *Cache) persist(artPath string, contents []byte) {
+	s := cache.currentStorage()
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&cache.writes, 1)
+	go func() {
+		defer atomic.AddInt64(&cache.writes, -1)
+		if err := s.Put(artPath, contents); err != nil {
+			log.Warning("Failed to write %s to storage: %s", artPath, err)
+			cache.metrics.storageRequests.WithLabelValues("put", "error").Inc()
+			return
+		}
+		cache.metrics.storageRequests.WithLabelValues("put", "success").Inc()
+	}()
+}
+
+// restore copies the given artifact from the storage backend into the cache directory if it's there.
+// It returns true if it was.
+func (cache *Cache) restore(artPath string) bool {
+	s := cache.currentStorage()
+	if s == nil || cache.expiries.expired(artPath, cache.now()) {
+		return false
+	}
+	contents, err := s.Get(artPath)
+	if os.IsNotExist(err) {
+		cache.metrics.storageRequests.WithLabelValues("get", "miss").Inc()
+		return false
+	} else if err != nil {
+		log.Warning("Failed to read %s from storage: %s", artPath, err)
+		cache.metrics.storageRequests.WithLabelValues("get", "error").Inc()
+		return false
+	}
+	cache.metrics.storageRequests.WithLabelValues("get", "hit").Inc()
+	body, err := cache.unseal(artPath, contents)
+	if err != nil {
+		log.Warning("Failed to restore %s from storage: %s", artPath, err)
+		return false
+	} else if err := cache.store(artPath, body, true); err != nil {
+		log.Warning("Failed to restore %s from storage: %s", artPath, err)
+		return false
+	}
+	log.Debug("Restored %s from storage", artPath)
+	return true
+}
+
+// unpersist deletes all the artifacts with the given prefix from the storage backend.
+func (cache *Cache) unpersist(prefix string) error {
+	s := cache.currentStorage()
+	if s == nil {
+		return nil
+	}
+	entries, err := s.List(prefix)
+	if err != nil {
+		cache.metrics.storageRequests.WithLabelValues("list", "error").Inc()
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.Delete(entry.Key); err != nil {
+			cache.metrics.storageRequests.WithLabelValues("delete", "error").Inc()
+			return err
+		}
+		cache.metrics.storageRequests.WithLabelValues("delete", "success").Inc()
+	}
+	return nil
+}
+
+// cleanStorage deletes the least recently stored artifacts from the storage backend until it's
+// under the low water mark, if it's over the high one. Each of the backends of a routed storage
+// is cleaned separately, to its own route's water marks if it has them.
+func (cache *Cache) cleanStorage(lowWaterMark, highWaterMark int64) {
+	s := cache.currentStorage()
+	if s == nil {
+		return
+	} else if routed, ok := s.(*routedStorage); ok {
+		for _, route := range routed.backends() {
+			low, high := route.waterMarks(lowWaterMark, highWaterMark)
+			cache.cleanBackend(route.Name, route.Storage, low, high)
+		}
+		return
+	}
+	cache.cleanBackend(defaultBackend, s, lowWaterMark, highWaterMark)
+}
+
+// defaultBackend is the name of the storage backend in metrics unless it's routed.
+const defaultBackend = "default"
+
+// cleanBackend deletes the least recently stored artifacts from the given backend, which has the
+// given name, until it's under the low water mark, if it's over the high one.
+func (cache *Cache) cleanBackend(name string, s Storage, lowWaterMark, highWaterMark int64) {
+	size, err := s.Size()
+	if err != nil {
+		log.Warning("Failed to get size of %s storage: %s", name, err)
+		return
+	}
+	cache.metrics.storageSize.WithLabelValues(name).Set(float64(size))
+	if size <= highWaterMark {
+		return
+	}
+	entries, err := s.List("")
+	if err != nil {
+		log.Warning("Failed to list %s storage: %s", name, err)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Modified.Before(entries[j].Modified) })
+	deleted := 0
+	for _, entry := range entries {
+		if size <= lowWaterMark {
+			break
+		} else if err := s.Delete(entry.Key); err != nil {
+			log.Warning("Failed to delete %s from storage: %s", entry.Key, err)
+			continue
+		}
+		size -= entry.Size
+		deleted++
+	}
+	cache.metrics.storageSize.WithLabelValues(name).Set(float64(size))
+	log.Notice("Removed %d artifacts from %s storage, new size: %d", deleted, name, size)
+}
+
+// A diskStorage is a Storage in a directory, e.g. on a persistent volume or network mount.
+type diskStorage struct {
+	root string
+}
+
+// NewDiskStorage returns a Storage that keeps artifacts in the given directory, with the same
+// layout as the cache directory.
+func NewDiskStorage(dir string) Storage {
+	return &diskStorage{root: path.Clean(dir)}
+}
+
+func (d *diskStorage) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(d.root, key))
+}
+
+func (d *diskStorage) Put(key string, contents []byte) error {
+	return writeFileAtomically(path.Join(d.root, key), contents)
+}
+
+func (d *diskStorage) Delete(key string) error {
+	if err := os.Remove(path.Join(d.root, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *diskStorage) List(prefix string) ([]StorageEntry, error) {
+	ret := []StorageEntry{}
+	err := filepath.Walk(d.root, func(name string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if info.IsDir() || isPartial(name) {
+			return nil
+		} else if key := name[len(d.root)+1:]; strings.HasPrefix(key, prefix) {
+			ret = append(ret, StorageEntry{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (d *diskStorage) Size() (int64, error) {
+	entries, err := d.List("")
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	return size, err
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+const storageKey = "linux_amd64/pkg/target/hash/file"
+
+func TestDiskStorage(t *testing.T) {
+	dir := "test_disk_storage"
+	defer os.RemoveAll(dir)
+	s := NewDiskStorage(dir)
+	_, err := s.Get("a/b")
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, s.Put("a/b", []byte("ab")))
+	require.NoError(t, s.Put("a/c", []byte("abc")))
+	require.NoError(t, s.Put("d", []byte("d")))
+	b, err := s.Get("a/b")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ab"), b)
+
+	entries, err := s.List("a/")
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "a/b", entries[0].Key)
+	assert.EqualValues(t, 2, entries[0].Size)
+	size, err := s.Size()
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, size)
+
+	require.NoError(t, s.Delete("a/b"))
+	require.NoError(t, s.Delete("a/b"), "Deleting something that isn't there is fine")
+	_, err = s.Get("a/b")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreWritesThrough(t *testing.T) {
+	cache, s := newStorageCache("test_store_writes_through")
+	defer os.RemoveAll(cache.rootPath)
+	defer os.RemoveAll(s.(*diskStorage).root)
+	require.NoError(t, cache.StoreArtifact(storageKey, []byte("contents")))
+	require.NoError(t, cache.Flush(context.Background()))
+	b, err := s.Get(storageKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("contents"), b)
+	_, err = s.Get(storageKey + checksumSuffix)
+	assert.True(t, os.IsNotExist(err), "Only the artifact itself is stored")
+}
+
+func TestRetrieveReadsThrough(t *testing.T) {
+	cache, s := newStorageCache("test_retrieve_reads_through")
+	defer os.RemoveAll(cache.rootPath)
+	defer os.RemoveAll(s.(*diskStorage).root)
+	require.NoError(t, cache.StoreArtifact(storageKey, []byte("contents")))
+	require.NoError(t, cache.Flush(context.Background()))
+
+	// Simulate losing the cache directory.
+	cache2 := newCache(cache.rootPath + "_2")
+	defer os.RemoveAll(cache2.rootPath)
+	cache2.SetStorage(s)
+	arts, err := cache2.RetrieveArtifact(storageKey)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{storageKey: []byte("contents")}, arts)
+	assert.True(t, cache2.Contains(storageKey), "It's been copied back into the cache")
+	assert.EqualValues(t, 8, cache2.TotalSize())
+
+	_, err = cache2.RetrieveArtifact("linux_amd64/pkg/target/hash/missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreDoesNotWriteBack(t *testing.T) {
+	cache, s := newStorageCache("test_restore_does_not_write_back")
+	defer os.RemoveAll(cache.rootPath)
+	defer os.RemoveAll(s.(*diskStorage).root)
+	require.NoError(t, s.Put(storageKey, []byte("contents")))
+
+	counting := &countingStorage{Storage: s}
+	cache.SetStorage(counting)
+	arts, err := cache.RetrieveArtifact(storageKey)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{storageKey: []byte("contents")}, arts)
+	require.NoError(t, cache.Flush(context.Background()))
+	assert.EqualValues(t, 0, atomic.LoadInt64(&counting.puts), "Restored artifacts aren't written back to the backend")
+}
+
+func TestOpenArtifactReadsThrough(t *testing.T) {
+	cache, s := newStorageCache("test_open_reads_through")
+	defer os.RemoveAll(cache.rootPath)
+	defer os.RemoveAll(s.(*diskStorage).root)
+	require.NoError(t, s.Put(storageKey, []byte("contents")))
+	f, done, err := cache.OpenArtifact(storageKey)
+	require.NoError(t, err)
+	defer done()
+	b, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("contents"), b)
+}
+
+func TestDeleteDeletesThrough(t *testing.T) {
+	cache, s := newStorageCache("test_delete_deletes_through")
+	defer os.RemoveAll(cache.rootPath)
+	defer os.RemoveAll(s.(*diskStorage).root)
+	require.NoError(t, cache.StoreArtifact(storageKey, []byte("contents")))
+	require.NoError(t, cache.StoreArtifact(storageKey+"2", []byte("contents")))
+	require.NoError(t, s.Put("linux_amd64/pkg/other/hash/file", []byte("other")))
+	require.NoError(t, cache.Flush(context.Background()))
+
+	require.NoError(t, cache.DeleteEntry(storageKey))
+	_, err := s.Get(storageKey)
+	assert.True(t, os.IsNotExist(err))
+	_, err = s.Get(storageKey + "2")
+	assert.NoError(t, err, "Only the exact key is deleted")
+
+	require.NoError(t, cache.DeleteEntry("linux_amd64/pkg/other/hash/file"), "It's not missing if it's only in storage")
+	assert.True(t, os.IsNotExist(cache.DeleteEntry("linux_amd64/pkg/other/hash/file")))
+
+	require.NoError(t, cache.DeleteArtifact("linux_amd64/pkg/target"))
+	_, err = s.Get(storageKey + "2")
+	assert.True(t, os.IsNotExist(err))
+	_, err = cache.RetrieveArtifact(storageKey + "2")
+	assert.True(t, os.IsNotExist(err), "It isn't restored after being deleted")
+}
+
+func TestEvictionDoesNotDeleteThrough(t *testing.T) {
+	cache, s := newStorageCache("test_eviction_keeps_storage")
+	defer os.RemoveAll(cache.rootPath)
+	defer os.RemoveAll(s.(*diskStorage).root)
+	require.NoError(t, cache.StoreArtifact(storageKey, []byte("contents")))
+	require.NoError(t, cache.Flush(context.Background()))
+	cache.singleClean(0, 1)
+	assert.False(t, cache.Contains(storageKey))
+	_, err := s.Get(storageKey)
+	assert.NoError(t, err, "It's only evicted locally")
+}
+
+func TestCleanStorage(t *testing.T) {
+	cache, s := newStorageCache("test_clean_storage")
+	defer os.RemoveAll(cache.rootPath)
+	defer os.RemoveAll(s.(*diskStorage).root)
+	now := time.Now()
+	for i, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, s.Put(key, []byte("1234")))
+		// Give them distinct modification times, in order.
+		modified := now.Add(time.Duration(i-10) * time.Minute)
+		require.NoError(t, os.Chtimes(path.Join(s.(*diskStorage).root, key), modified, modified))
+	}
+	cache.cleanStorage(8, 20)
+	size, err := s.Size()
+	require.NoError(t, err)
+	assert.EqualValues(t, 16, size, "It's under the high water mark")
+
+	cache.cleanStorage(8, 12)
+	entries, err := s.List("")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, "c", entries[0].Key, "The least recently stored are deleted first")
+	assert.Equal(t, "d", entries[1].Key)
+}
+
+// A countingStorage wraps a Storage and counts the calls to Put.
+type countingStorage struct {
+	Storage
+	puts int64
+}
+
+func (s *countingStorage) Put(key string, contents []byte) error {
+	atomic.AddInt64(&s.puts, 1)
+	return s.Storage.Put(key, contents)
+}
+
+// newStorageCache returns a new cache with the given directory, backed by a disk storage in another.
+func newStorageCache(dir string) (*Cache, Storage) {
+	s := NewDiskStorage(dir + "_storage")
+	cache := newCache(dir)
+	cache.SetStorage(s)
+	return cache, s
+}
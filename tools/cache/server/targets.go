@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "cache/proto/rpc_cache"
+)
+
+// defaultWorstTargets is the number of targets reported by /stats/targets unless asked for a different number.
+const defaultWorstTargets = 20
+
+// A targetTracker counts the hits & misses of retrieves for the most frequently retrieved targets,
+// so we can report which have the worst hit ratios. It uses the Space-Saving algorithm to keep
+// its memory bounded: once it's tracking as many targets as it's allowed, a retrieve of a new one
+// replaces the least retrieved, which it inherits the retrieve count of as its error. Any target
+// retrieved more often than that many times in total is guaranteed to be tracked.
+// Its methods are all safe to call on a nil targetTracker, which tracks nothing.
+type targetTracker struct {
+	max     int
+	targets map[string]*targetStats
+	mutex   sync.Mutex
+}
+
+// targetStats are the stats for a single target.
+type targetStats struct {
+	Target string `json:"target"`
+	// Retrieves is an overestimate of the number of retrieves of this target, by at most Error.
+	Retrieves int64 `json:"retrieves"`
+	// Error is the number of retrieves that might have been of other targets, from before this one was tracked.
+	// Hits and Misses only count the retrieves since then.
+	Error    int64   `json:"error"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// A targetReport is the stats for the targets matching a pattern, with those with the worst hit ratios.
+type targetReport struct {
+	Pattern string         `json:"pattern,omitempty"`
+	Hits    int64          `json:"hits"`
+	Misses  int64          `json:"misses"`
+	Worst   []*targetStats `json:"worst"`
+}
+
+// newTargetTracker returns a new tracker of up to the given number of targets.
+func newTargetTracker(max int) *targetTracker {
+	return &targetTracker{max: max, targets: map[string]*targetStats{}}
+}
+
+// targetLabel returns the label of a target, e.g. //src/core:core.
+func targetLabel(pkg, target string) string {
+	return "//" + pkg + ":" + target
+}
+
+// record records a retrieve of the given target.
+func (t *targetTracker) record(label string, hit bool) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s, present := t.targets[label]
+	if !present {
+		s = &targetStats{Target: label}
+		if len(t.targets) >= t.max {
+			var min *targetStats
+			for _, s := range t.targets {
+				if min == nil || s.Retrieves < min.Retrieves {
+					min = s
+				}
+			}
+			delete(t.targets, min.Target)
+			s.Retrieves = min.Retrieves
+			s.Error = min.Retrieves
+		}
+		t.targets[label] = s
+	}
+	s.Retrieves++
+	if hit {
+		s.Hits++
+	} else {
+		s.Misses++
+	}
+}
+
+// report returns the stats for the tracked targets matching the given pattern, with up to n of
+// those retrieved at least minRetrieves times that have the worst hit ratios.
+func (t *targetTracker) report(pattern string, n int, minRetrieves int64) *targetReport {
+	r := &targetReport{Pattern: pattern, Worst: []*targetStats{}}
+	if t == nil {
+		return r
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, s := range t.targets {
+		if !matchesTargetPattern(s.Target, pattern) {
+			continue
+		}
+		r.Hits += s.Hits
+		r.Misses += s.Misses
+		if s.Hits+s.Misses >= minRetrieves && s.Hits+s.Misses > 0 {
+			c := *s
+			c.HitRatio = float64(c.Hits) / float64(c.Hits+c.Misses)
+			r.Worst = append(r.Worst, &c)
+		}
+	}
+	sort.Slice(r.Worst, func(i, j int) bool {
+		if r.Worst[i].HitRatio != r.Worst[j].HitRatio {
+			return r.Worst[i].HitRatio < r.Worst[j].HitRatio
+		} else if r.Worst[i].Misses != r.Worst[j].Misses {
+			return r.Worst[i].Misses > r.Worst[j].Misses
+		}
+		return r.Worst[i].Target < r.Worst[j].Target
+	})
+	if len(r.Worst) > n {
+		r.Worst = r.Worst[:n]
+	}
+	return r
+}
+
+// matchesTargetPattern returns true if the given label matches a build label pattern, which can
+// be a single target (//src/core:core), all the targets in a package (//src/core:all or //src/core)
+// or everything beneath it (//src/...). An empty pattern matches everything.
+func matchesTargetPattern(label, pattern string) bool {
+	pkg := label[2:strings.IndexByte(label, ':')]
+	if pattern == "" || pattern == "//..." {
+		return true
+	} else if strings.HasSuffix(pattern, "/...") {
+		prefix := strings.TrimPrefix(strings.TrimSuffix(pattern, "/..."), "//")
+		return pkg == prefix || strings.HasPrefix(pkg, prefix+"/")
+	} else if strings.HasSuffix(pattern, ":all") {
+		return "//"+pkg == strings.TrimSuffix(pattern, ":all")
+	} else if !strings.Contains(pattern, ":") {
+		return "//"+pkg == pattern
+	}
+	return label == pattern
+}
+
+// SetTargetStatsSize enables tracking the hit ratios of up to the given number of the most
+// frequently retrieved targets, which are reported at /stats/targets (see StatsHandler).
+// Zero disables it, which is the default.
+func (cache *Cache) SetTargetStatsSize(size int) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	if size <= 0 {
+		cache.targets = nil
+	} else {
+		cache.targets = newTargetTracker(size)
+	}
+}
+
+// currentTargets returns the current target tracker, which is nil if there isn't one.
+func (cache *Cache) currentTargets() *targetTracker {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.targets
+}
+
+// recordTargetRetrieve records a hit or miss for each of the targets whose artifacts were requested.
+func (cache *Cache) recordTargetRetrieve(artifacts []*pb.Artifact, hit bool) {
+	targets := cache.currentTargets()
+	if targets == nil {
+		return
+	}
+	seen := map[string]bool{}
+	for _, artifact := range artifacts {
+		if label := targetLabel(artifact.Package, artifact.Target); !seen[label] {
+			seen[label] = true
+			targets.record(label, hit)
+		}
+	}
+}
+
+// targetsHandler serves the report of the targets with the worst hit ratios.
+func (cache *Cache) targetsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n := defaultWorstTargets
+	if s := q.Get("n"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i <= 0 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		n = i
+	}
+	var minRetrieves int64
+	if s := q.Get("min_retrieves"); s != "" {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || i < 0 {
+			http.Error(w, "min_retrieves must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		minRetrieves = i
+	}
+	pattern := q.Get("pattern")
+	if pattern != "" && !strings.HasPrefix(pattern, "//") {
+		http.Error(w, "pattern must be a build label, e.g. //src/core:core, //src/core:all or //src/...", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, cache.currentTargets().report(pattern, n, minRetrieves))
+}
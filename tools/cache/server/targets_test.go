@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	pb "cache/proto/rpc_cache"
+)
+
+func TestTargetTrackerReportsWorstFirst(t *testing.T) {
+	tracker := newTargetTracker(10)
+	for i := 0; i < 10; i++ {
+		tracker.record("//src/core:core", true)
+		tracker.record("//src/core:flaky", i%2 == 0)
+		tracker.record("//src/cache:nondeterministic", false)
+	}
+	tracker.record("//src/once:once", false)
+
+	r := tracker.report("", 10, 2)
+	assert.EqualValues(t, 15, r.Hits)
+	assert.EqualValues(t, 16, r.Misses)
+	require.Equal(t, 3, len(r.Worst), "//src/once:once hasn't been retrieved enough to report")
+	assert.Equal(t, "//src/cache:nondeterministic", r.Worst[0].Target)
+	assert.Equal(t, 0.0, r.Worst[0].HitRatio)
+	assert.Equal(t, "//src/core:flaky", r.Worst[1].Target)
+	assert.Equal(t, 0.5, r.Worst[1].HitRatio)
+	assert.Equal(t, "//src/core:core", r.Worst[2].Target)
+	assert.Equal(t, 1.0, r.Worst[2].HitRatio)
+
+	assert.Equal(t, 1, len(tracker.report("", 1, 0).Worst))
+	r = tracker.report("//src/core:all", 10, 0)
+	assert.EqualValues(t, 15, r.Hits)
+	assert.EqualValues(t, 5, r.Misses)
+	assert.Equal(t, 2, len(r.Worst))
+}
+
+func TestTargetTrackerIsBounded(t *testing.T) {
+	tracker := newTargetTracker(3)
+	for i := 0; i < 100; i++ {
+		tracker.record("//src/core:popular", false)
+	}
+	for i := 0; i < 50; i++ {
+		tracker.record(fmt.Sprintf("//src/rare:rare%d", i), true)
+	}
+	assert.Equal(t, 3, len(tracker.targets))
+	popular := tracker.targets["//src/core:popular"]
+	require.NotNil(t, popular, "Anything retrieved often enough is always tracked")
+	assert.EqualValues(t, 100, popular.Misses)
+	assert.EqualValues(t, 0, popular.Error)
+	// Each new one takes over the count of the one it replaced.
+	rare := tracker.targets["//src/rare:rare49"]
+	require.NotNil(t, rare)
+	assert.True(t, rare.Error > 0)
+	assert.Equal(t, rare.Error+1, rare.Retrieves)
+	assert.EqualValues(t, 1, rare.Hits)
+}
+
+func TestNilTargetTracker(t *testing.T) {
+	var tracker *targetTracker
+	tracker.record("//src/core:core", true)
+	r := tracker.report("", 10, 0)
+	assert.EqualValues(t, 0, r.Hits)
+	assert.Equal(t, 0, len(r.Worst))
+}
+
+func TestMatchesTargetPattern(t *testing.T) {
+	assert.True(t, matchesTargetPattern("//src/core:core", ""))
+	assert.True(t, matchesTargetPattern("//src/core:core", "//..."))
+	assert.True(t, matchesTargetPattern("//src/core:core", "//src/..."))
+	assert.True(t, matchesTargetPattern("//src/core:core", "//src/core/..."))
+	assert.True(t, matchesTargetPattern("//src/core:core", "//src/core:all"))
+	assert.True(t, matchesTargetPattern("//src/core:core", "//src/core"))
+	assert.True(t, matchesTargetPattern("//src/core:core", "//src/core:core"))
+	assert.True(t, matchesTargetPattern("//:root", "//..."))
+	assert.False(t, matchesTargetPattern("//src/core:core", "//src/core:other"))
+	assert.False(t, matchesTargetPattern("//src/core:core", "//src:all"))
+	assert.False(t, matchesTargetPattern("//src/corelib:core", "//src/core/..."))
+	assert.False(t, matchesTargetPattern("//src/core/sub:core", "//src/core:all"))
+}
+
+func TestTargetStatsFromRetrieves(t *testing.T) {
+	ctx := context.Background()
+	c := newCache("test_target_stats")
+	c.SetTargetStatsSize(100)
+	r := &RPCCacheServer{cache: c}
+	artifacts := []*pb.Artifact{
+		{Package: "src/core", Target: "core", File: "core.a", Body: []byte("archive")},
+		{Package: "src/core", Target: "core", File: "core.h", Body: []byte("header")},
+	}
+	_, err := r.Store(ctx, &pb.StoreRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+	require.NoError(t, err)
+	_, err = r.Retrieve(ctx, &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: artifacts})
+	require.NoError(t, err)
+	_, err = r.Retrieve(ctx, &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("other"), Artifacts: artifacts})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	c.StatsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/targets?pattern=//src/...", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	report := targetReport{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.EqualValues(t, 1, report.Hits, "Both artifacts count as a single retrieve of the target")
+	assert.EqualValues(t, 1, report.Misses)
+	require.Equal(t, 1, len(report.Worst))
+	assert.Equal(t, "//src/core:core", report.Worst[0].Target)
+	assert.Equal(t, 0.5, report.Worst[0].HitRatio)
+
+	for _, url := range []string{"/stats/targets?n=0", "/stats/targets?min_retrieves=x", "/stats/targets?pattern=src/core"} {
+		w := httptest.NewRecorder()
+		c.StatsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/djherbis/atime"
+
+	"tools/cache/audit"
+)
+
+// SetSlidingTTL gives artifacts a time to live that's extended each time they're retrieved, so
+// artifacts that are in use are kept while idle ones expire ttl after they were last retrieved.
+// maxLifetime caps how long any artifact is kept after being stored, however often it's retrieved.
+// Either can be zero to disable it, but a sliding TTL must be capped by a maximum lifetime.
+// Expired artifacts are treated as missing straight away, and removed the next time the cache is cleaned.
+//
+// Unlike the maximum artifact age this doesn't rely on the filesystem recording access times;
+// each retrieve updates the artifact's access time itself, which is only a metadata change.
+func (cache *Cache) SetSlidingTTL(ttl, maxLifetime time.Duration) error {
+	if err := CheckSlidingTTL(ttl, maxLifetime); err != nil {
+		return err
+	}
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.slidingTTL = ttl
+	cache.maxLifetime = maxLifetime
+	return nil
+}
+
+// CheckSlidingTTL returns an error if the given sliding TTL and maximum lifetime can't be used
+// together (see SetSlidingTTL).
+func CheckSlidingTTL(ttl, maxLifetime time.Duration) error {
+	if ttl > 0 && maxLifetime <= 0 {
+		return fmt.Errorf("a sliding TTL must have a maximum lifetime")
+	} else if ttl > maxLifetime && maxLifetime > 0 {
+		return fmt.Errorf("the sliding TTL (%s) can't be longer than the maximum lifetime (%s)", ttl, maxLifetime)
+	}
+	return nil
+}
+
+// ttl returns the current sliding TTL and maximum lifetime.
+func (cache *Cache) ttl() (time.Duration, time.Duration) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.slidingTTL, cache.maxLifetime
+}
+
+// expired returns true if a file last read and stored at the given times has outlived its
+// sliding TTL or maximum lifetime, either of which may be zero if they're not in use.
+func expired(lastRead, stored, now time.Time, ttl, maxLifetime time.Duration) bool {
+	return (ttl > 0 && accessAge(lastRead, now) > ttl) || (maxLifetime > 0 && now.Sub(stored) > maxLifetime)
+}
+
+// checkTTL is called when the given file is about to be read. It returns false if it's expired,
+// in which case it should be treated as missing; otherwise it extends its sliding TTL, if there is one.
+// The new access time is written to disk so it survives restarts. The caller must hold a lock on the file.
+func (cache *Cache) checkTTL(p string, file *cachedFile) bool {
+	ttl, maxLifetime := cache.ttl()
+	if ttl <= 0 && maxLifetime <= 0 {
+		return true
+	} else if expired(file.lastReadTime, file.storedTime, cache.now(), ttl, maxLifetime) {
+		return false
+	} else if ttl > 0 {
+		cache.writeAccessTime(p, cache.now())
+	}
+	return true
+}
+
+// cleanExpiredFiles removes any files that have outlived their sliding TTL or maximum lifetime.
+// It returns the number of files removed.
+func (cache *Cache) cleanExpiredFiles() int {
+	ttl, maxLifetime := cache.ttl()
+	if ttl <= 0 && maxLifetime <= 0 {
+		return 0
+	}
+	now := cache.now()
+	cleaned := 0
+	for _, file := range cache.expiredFiles(now, ttl, maxLifetime) {
+		if cache.evictFile(file.path, file.file, file.storedTime, audit.TTL) {
+			cleaned++
+		}
+	}
+	if cache.hasUnindexed() {
+		cleaned += cache.cleanUnindexedWhere(func(info os.FileInfo) bool {
+			return expired(atime.Get(info), info.ModTime(), now, ttl, maxLifetime)
+		}, 0, audit.TTL)
+	}
+	log.Notice("Removed %d expired files, new size: %d, %d files", cleaned, cache.totalSize, cache.cachedFiles.Count())
+	return cleaned
+}
+
+// expiredFiles returns the files that have outlived the given sliding TTL or maximum lifetime by the given time.
+func (cache *Cache) expiredFiles(now time.Time, ttl, maxLifetime time.Duration) cachedFilePaths {
+	ret := cachedFilePaths{}
+	if ttl <= 0 && maxLifetime <= 0 {
+		return ret
+	}
+	for t := range cache.cachedFiles.IterBuffered() {
+		if f := t.Val.(*cachedFile); expired(f.lastReadTime, f.storedTime, now, ttl, maxLifetime) {
+			ret = append(ret, cachedFilePath{file: f, path: t.Key, storedTime: f.storedTime})
+		}
+	}
+	return ret
+}
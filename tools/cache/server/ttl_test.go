@@ -0,0 +1,78 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	assert.False(t, expired(now.Add(-time.Minute), now.Add(-time.Hour), now, 0, 0))
+	assert.False(t, expired(now.Add(-time.Minute), now.Add(-time.Hour), now, 5*time.Minute, 2*time.Hour))
+	assert.True(t, expired(now.Add(-10*time.Minute), now.Add(-time.Hour), now, 5*time.Minute, 2*time.Hour), "Idle for longer than the TTL")
+	assert.True(t, expired(now.Add(-time.Minute), now.Add(-3*time.Hour), now, 5*time.Minute, 2*time.Hour), "Recently read, but past its maximum lifetime")
+	assert.True(t, expired(now, now.Add(-3*time.Hour), now, 0, 2*time.Hour), "The maximum lifetime applies on its own")
+}
+
+func TestSetSlidingTTL(t *testing.T) {
+	c := newCache("test_set_sliding_ttl")
+	assert.Error(t, c.SetSlidingTTL(time.Minute, 0), "A sliding TTL must be capped")
+	assert.Error(t, c.SetSlidingTTL(time.Hour, time.Minute))
+	assert.NoError(t, c.SetSlidingTTL(time.Minute, time.Hour))
+	assert.NoError(t, c.SetSlidingTTL(0, time.Hour))
+	assert.NoError(t, c.SetSlidingTTL(0, 0))
+}
+
+func TestSlidingTTLRefreshedOnRetrieve(t *testing.T) {
+	const key = "linux_amd64/pkg/target/hash/file"
+	c := newCache("test_sliding_ttl_refresh")
+	clock := newFakeClock(time.Now())
+	c.SetClock(clock)
+	require.NoError(t, c.StoreArtifact(key, []byte("test")))
+	require.NoError(t, c.SetSlidingTTL(time.Minute, time.Hour))
+	clock.Advance(50 * time.Second)
+
+	// Retrieving it brings its expiry forward, so it's not cleaned once the original TTL would have passed.
+	_, err := c.RetrieveArtifact(key)
+	require.NoError(t, err)
+	assert.Equal(t, clock.Now(), getFile(c, key).lastReadTime)
+	clock.Advance(50 * time.Second)
+	assert.Equal(t, 0, c.cleanExpiredFiles())
+	assert.True(t, c.Contains(key))
+
+	// Once it's idle for longer than the TTL, it's gone.
+	clock.Advance(11 * time.Second)
+	_, err = c.RetrieveArtifact(key)
+	assert.Error(t, err, "Expired artifacts should be treated as missing")
+	assert.Equal(t, 1, c.cleanExpiredFiles())
+	assert.False(t, c.Contains(key))
+}
+
+func TestMaxLifetimeOverridesSlidingTTL(t *testing.T) {
+	const key = "linux_amd64/pkg/target/hash/file"
+	c := newCache("test_max_lifetime")
+	require.NoError(t, c.StoreArtifact(key, []byte("test")))
+	require.NoError(t, c.SetSlidingTTL(time.Minute, time.Hour))
+	// It's been retrieved constantly, but was stored too long ago.
+	setTimes(c, key, time.Now().Add(-time.Second), time.Now().Add(-2*time.Hour))
+	_, err := c.RetrieveArtifact(key)
+	assert.Error(t, err, "Retrieving it shouldn't extend it past its maximum lifetime")
+	assert.Equal(t, 1, c.cleanExpiredFiles())
+	assert.False(t, c.Contains(key))
+}
+
+// getFile returns the index entry for the given file.
+func getFile(c *Cache, key string) *cachedFile {
+	filei, _ := c.cachedFiles.Get(key)
+	return filei.(*cachedFile)
+}
+
+// setTimes sets the last read and stored times of the given file.
+func setTimes(c *Cache, key string, lastRead, stored time.Time) {
+	file := getFile(c, key)
+	file.lastReadTime = lastRead
+	file.storedTime = stored
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+// canReadAfterUnlink is true on Unix, where an open file remains readable after it's been unlinked.
+const canReadAfterUnlink = true
@@ -0,0 +1,5 @@
+package server
+
+// canReadAfterUnlink is false on Windows, which doesn't allow deleting a file while it's open,
+// so readers must hold their lock until they're done and the cleaner waits for them.
+const canReadAfterUnlink = false
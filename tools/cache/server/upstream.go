@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "cache/proto/rpc_cache"
+	"tools/cache/dial"
+)
+
+// An Upstream is another cache that artifacts missing from this one are retrieved from, and
+// optionally that stores to this one are forwarded to, e.g. for the lower tiers of a multi-tier setup.
+// Its methods are all safe to call on a nil Upstream, which never has anything.
+type Upstream struct {
+	addr     string
+	client   upstreamClient
+	readonly bool
+	timeout  time.Duration
+	// freshness is how long artifacts are served locally before they're retrieved from the
+	// upstream again (see SetFreshness); zero means they never are.
+	freshness time.Duration
+	// serveStale is true if artifacts past their freshness are still served when the upstream fails.
+	serveStale bool
+}
+
+// An upstreamClient is the client for a particular kind of upstream cache.
+type upstreamClient interface {
+	// Retrieve retrieves the requested artifacts. It returns nil, nil if the upstream doesn't have them.
+	Retrieve(ctx context.Context, req *pb.RetrieveRequest) (*pb.RetrieveResponse, error)
+	// Store stores some artifacts.
+	Store(ctx context.Context, req *pb.StoreRequest) error
+}
+
+// NewUpstream returns a new Upstream for the cache at the given address. That's either the
+// host:port of another RPC cache server, or the URL of an HTTP cache (starting http:// or https://).
+// If readonly is true stores aren't forwarded to it. No request to it takes longer than the
+// given timeout, so local retrieves that miss are held up by at most that much if it's down.
+// It's connected to over TLS if any of tlsFlags are given, and insecurely otherwise.
+func NewUpstream(addr string, readonly bool, timeout time.Duration, tlsFlags dial.TLSFlags) (*Upstream, error) {
+	u := &Upstream{addr: addr, readonly: readonly, timeout: timeout}
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		client := &http.Client{Timeout: timeout}
+		if tlsFlags != (dial.TLSFlags{}) {
+			config, err := dial.TLSConfig(tlsFlags)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %s: %s", addr, err)
+			}
+			client.Transport = &http.Transport{TLSClientConfig: config}
+		}
+		u.client = &httpUpstream{url: strings.TrimSuffix(addr, "/"), client: client}
+		return u, nil
+	}
+	// This doesn't block, so it's fine if the upstream isn't up yet.
+	conn, err := dial.Dial(addr, timeout, maxMsgSize, tlsFlags)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %s", addr, err)
+	}
+	u.client = &rpcUpstream{client: pb.NewRpcCacheClient(conn)}
+	return u, nil
+}
+
+// SetFreshness makes local copies of artifacts that were stored longer ago than the given window
+// be revalidated against the upstream when they're retrieved: they're retrieved from it again and
+// replace the local copy, so changes to it are picked up. If the upstream doesn't have them they're
+// served as they are. If it fails (e.g. it's down) they're treated as missing, unless serveStale is
+// true, in which case they're served anyway rather than forcing clients to rebuild them.
+// This should be called before the upstream is passed to SetUpstream.
+func (u *Upstream) SetFreshness(window time.Duration, serveStale bool) {
+	u.freshness = window
+	u.serveStale = serveStale
+}
+
+// SetUpstream sets an upstream cache to retrieve artifacts that aren't in this one from.
+func (cache *Cache) SetUpstream(upstream *Upstream) {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	cache.upstream = upstream
+}
+
+// currentUpstream returns the current upstream, which may be nil.
+func (cache *Cache) currentUpstream() *Upstream {
+	cache.scheduleMutex.Lock()
+	defer cache.scheduleMutex.Unlock()
+	return cache.upstream
+}
+
+// retrieve retrieves the artifacts for a request that missed locally from the upstream, and stores
+// them in the given cache so it has them next time. If the upstream doesn't have them either, or
+// fails, it returns the given error from the local miss.
+func (u *Upstream) retrieve(cache *Cache, req *pb.RetrieveRequest, miss error) (*pb.RetrieveResponse, error) {
+	if u == nil {
+		return nil, miss
+	}
+	resp, err := u.fetch(cache, req, "retrieve")
+	if err != nil || resp == nil {
+		return nil, miss
+	}
+	return resp, nil
+}
+
+// revalidate returns the response to a request that hit locally, given the local one. If any of
+// the artifacts were stored longer ago than the upstream's freshness window they're retrieved
+// from the upstream again (see SetFreshness).
+func (u *Upstream) revalidate(cache *Cache, req *pb.RetrieveRequest, local *pb.RetrieveResponse) (*pb.RetrieveResponse, error) {
+	if u == nil || u.freshness == 0 || !cache.storedBefore(req, cache.now().Add(-u.freshness)) {
+		return local, nil
+	}
+	resp, err := u.fetch(cache, req, "revalidate")
+	if err == nil {
+		if resp == nil {
+			return local, nil
+		}
+		return resp, nil
+	} else if u.serveStale {
+		log.Warning("Serving stale artifacts for %s since upstream %s is unavailable", requestKey(req.Os, req.Arch, req.Hash), u.addr)
+		return local, nil
+	}
+	return nil, retrieveError(codes.NotFound, pb.RetrieveError_NOT_FOUND, "", "Artifacts are stale and the upstream is unavailable")
+}
+
+// storedBefore returns true if any of the artifacts requested were stored before the given time.
+func (cache *Cache) storedBefore(req *pb.RetrieveRequest, t time.Time) bool {
+	layout := cache.Layout()
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	for _, artifact := range req.Artifacts {
+		key := cache.normalize(path.Join(layout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash), artifact.File))
+		if filei, present := cache.cachedFiles.Get(key); present {
+			file := filei.(*cachedFile)
+			file.RLock()
+			stored := file.storedTime
+			file.RUnlock()
+			if stored.Before(t) {
+				return true
+			}
+		} else if info, err := os.Stat(path.Join(cache.rootPath, key)); err == nil && info.ModTime().Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch retrieves the artifacts for a request from the upstream, and stores them in the given
+// cache so it has them next time (see populate). It returns nil, nil if the upstream doesn't have them.
+// The method is what the request is counted as in the upstream metrics.
+func (u *Upstream) fetch(cache *Cache, req *pb.RetrieveRequest, method string) (*pb.RetrieveResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+	resp, err := u.client.Retrieve(ctx, req)
+	if err != nil {
+		log.Warning("Failed to retrieve artifacts from upstream %s: %s", u.addr, err)
+		cache.metrics.upstreamRequests.WithLabelValues(method, "error").Inc()
+		return nil, err
+	} else if resp == nil {
+		cache.metrics.upstreamRequests.WithLabelValues(method, "miss").Inc()
+		return nil, nil
+	}
+	cache.metrics.upstreamRequests.WithLabelValues(method, "hit").Inc()
+	u.populate(cache, req, resp)
+	return resp, nil
+}
+
+// populate stores the artifacts retrieved from the upstream for a request in the given cache.
+// It does so in the background, so they're sent to the client without waiting for them to be
+// written; if storing them fails the client still has them, so it's only logged.
+// Flush waits for it to finish.
+func (u *Upstream) populate(cache *Cache, req *pb.RetrieveRequest, resp *pb.RetrieveResponse) {
+	atomic.AddInt64(&cache.writes, 1)
+	go func() {
+		defer atomic.AddInt64(&cache.writes, -1)
+		if !storeArtifact(cache, req.Os, req.Arch, req.Hash, resp.Artifacts, "", u.addr, "", 0, "", resp.Expiry) {
+			log.Warning("Failed to store artifacts for %s retrieved from upstream %s", requestKey(req.Os, req.Arch, req.Hash), u.addr)
+		}
+	}()
+}
+
+// forward forwards a store to the given cache to the upstream in the background, unless it's read-only.
+func (u *Upstream) forward(cache *Cache, req *pb.StoreRequest) {
+	if u == nil || u.readonly {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+		defer cancel()
+		if err := u.client.Store(ctx, req); err != nil {
+			log.Warning("Failed to forward store to upstream %s: %s", u.addr, err)
+			cache.metrics.upstreamRequests.WithLabelValues("store", "error").Inc()
+			return
+		}
+		cache.metrics.upstreamRequests.WithLabelValues("store", "success").Inc()
+	}()
+}
+
+// An rpcUpstream is the client for an upstream RPC cache server.
+type rpcUpstream struct {
+	client pb.RpcCacheClient
+}
+
+func (u *rpcUpstream) Retrieve(ctx context.Context, req *pb.RetrieveRequest) (*pb.RetrieveResponse, error) {
+	resp, err := u.client.Retrieve(ctx, &pb.RetrieveRequest{
+		Artifacts:        req.Artifacts,
+		Os:               req.Os,
+		Arch:             req.Arch,
+		Hash:             req.Hash,
+		StructuredErrors: true, // So we can tell misses apart from failures.
+	})
+	if grpc.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if !resp.Success {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func (u *rpcUpstream) Store(ctx context.Context, req *pb.StoreRequest) error {
+	resp, err := u.client.Store(ctx, req)
+	if err != nil {
+		return err
+	} else if !resp.Success {
+		return fmt.Errorf("store was unsuccessful")
+	}
+	return nil
+}
+
+// An httpUpstream is the client for an upstream HTTP cache, i.e. one served by http_cache_server.
+// It always uses the default layout, so artifacts are addressed by their path within that.
+type httpUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpUpstream) Retrieve(ctx context.Context, req *pb.RetrieveRequest) (*pb.RetrieveResponse, error) {
+	resp := &pb.RetrieveResponse{Success: true}
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	for _, artifact := range req.Artifacts {
+		dir := defaultLayout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash)
+		files, err := u.get(ctx, path.Join(dir, artifact.File))
+		if err != nil || files == nil {
+			return nil, err
+		}
+		for name, body := range files {
+			if !strings.HasPrefix(name, dir+"/") {
+				return nil, fmt.Errorf("unexpected file %s in response for %s", name, dir)
+			}
+			resp.Artifacts = append(resp.Artifacts, &pb.Artifact{
+				Package: artifact.Package,
+				Target:  artifact.Target,
+				File:    name[len(dir)+1:],
+				Body:    body,
+			})
+		}
+	}
+	return resp, nil
+}
+
+// get retrieves the files for a single artifact, keyed by their paths. It returns nil if it doesn't exist.
+func (u *httpUpstream) get(ctx context.Context, key string) (map[string][]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u.url+"/artifact/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s retrieving %s", resp.Status, key)
+	}
+	// Responses are multipart form data, one file per part (see httpServer.getHandler).
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response for %s: %s", key, err)
+	}
+	files := map[string][]byte{}
+	r := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read response for %s: %s", key, err)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response for %s: %s", key, err)
+		}
+		// The form name is the whole path; the file name may only be its base name.
+		files[part.FormName()] = body
+	}
+}
+
+func (u *httpUpstream) Store(ctx context.Context, req *pb.StoreRequest) error {
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	for _, artifact := range req.Artifacts {
+		key := path.Join(defaultLayout.ArtifactDir(req.Os, req.Arch, artifact.Package, artifact.Target, hash), artifact.File)
+		r, err := http.NewRequest(http.MethodPost, u.url+"/artifact/"+key, bytes.NewReader(artifact.Body))
+		if err != nil {
+			return err
+		}
+		resp, err := u.client.Do(r.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected response %s storing %s", resp.Status, key)
+		}
+	}
+	return nil
+}
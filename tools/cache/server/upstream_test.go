@@ -0,0 +1,220 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	pb "cache/proto/rpc_cache"
+	"tools/cache/dial"
+)
+
+const upstreamKey = "linux_amd64/src/core/core/aGFzaA/core.a"
+
+var upstreamArtifacts = []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a"}}
+
+func TestRetrieveFromRPCUpstream(t *testing.T) {
+	remote := newCache("test_rpc_upstream_remote")
+	defer os.RemoveAll(remote.rootPath)
+	require.NoError(t, remote.StoreArtifact(upstreamKey, []byte("archive")))
+	s, lis := BuildGrpcServer(0, remote, nil, nil, nil, nil, nil, "", "", ServerOptions{})
+	go s.Serve(lis)
+	defer s.Stop()
+	upstream, err := NewUpstream(lis.Addr().String(), false, 5*time.Second, dial.TLSFlags{})
+	require.NoError(t, err)
+	local := newCache("test_rpc_upstream_local")
+	defer os.RemoveAll(local.rootPath)
+	testRetrieveFromUpstream(t, local, upstream)
+}
+
+func TestRetrieveFromHTTPUpstream(t *testing.T) {
+	remote := newCache("test_http_upstream_remote")
+	defer os.RemoveAll(remote.rootPath)
+	require.NoError(t, remote.StoreArtifact(upstreamKey, []byte("archive")))
+	s := httptest.NewServer(BuildRouter(remote, ServerOptions{}))
+	defer s.Close()
+	upstream, err := NewUpstream(s.URL, false, 5*time.Second, dial.TLSFlags{})
+	require.NoError(t, err)
+	local := newCache("test_http_upstream_local")
+	defer os.RemoveAll(local.rootPath)
+	testRetrieveFromUpstream(t, local, upstream)
+}
+
+func TestUpstreamTLSFlags(t *testing.T) {
+	flags := dial.TLSFlags{CACertFile: "src/cache/test_data/ca.pem"}
+	_, err := NewUpstream("127.0.0.1:1", false, time.Second, flags)
+	assert.NoError(t, err, "It doesn't connect until it's used")
+	_, err = NewUpstream("https://127.0.0.1:1", false, time.Second, flags)
+	assert.NoError(t, err)
+	flags = dial.TLSFlags{CACertFile: "src/cache/test_data/key.pem"}
+	_, err = NewUpstream("127.0.0.1:1", false, time.Second, flags)
+	assert.Error(t, err, "Not a certificate")
+	_, err = NewUpstream("https://127.0.0.1:1", false, time.Second, flags)
+	assert.Error(t, err, "Not a certificate")
+	_, err = NewUpstream("127.0.0.1:1", false, time.Second, dial.TLSFlags{CertFile: "src/cache/test_data/cert_signed.pem"})
+	assert.Error(t, err, "No key for the certificate")
+}
+
+// testRetrieveFromUpstream tests retrieving an artifact from the given upstream, which has it.
+func testRetrieveFromUpstream(t *testing.T, cache *Cache, upstream *Upstream) {
+	r := &RPCCacheServer{cache: cache}
+	req := &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: upstreamArtifacts, StructuredErrors: true}
+	_, err := r.Retrieve(context.Background(), req)
+	assert.Equal(t, codes.NotFound, grpc.Code(err), "There's no upstream yet")
+
+	cache.SetUpstream(upstream)
+	resp, err := r.Retrieve(context.Background(), req)
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+	require.Equal(t, 1, len(resp.Artifacts))
+	assert.Equal(t, "core.a", resp.Artifacts[0].File)
+	assert.Equal(t, []byte("archive"), resp.Artifacts[0].Body)
+	require.NoError(t, cache.Flush(context.Background()))
+	assert.True(t, cache.Contains(upstreamKey), "It's stored locally once retrieved")
+
+	req.Hash = []byte("nope")
+	_, err = r.Retrieve(context.Background(), req)
+	assert.Equal(t, codes.NotFound, grpc.Code(err), "The upstream doesn't have this one either")
+}
+
+func TestUpstreamUnavailable(t *testing.T) {
+	// Nothing's listening on this port.
+	upstream, err := NewUpstream("127.0.0.1:1", false, 200*time.Millisecond, dial.TLSFlags{})
+	require.NoError(t, err)
+	cache := newCache("test_upstream_unavailable")
+	defer os.RemoveAll(cache.rootPath)
+	cache.SetUpstream(upstream)
+	r := &RPCCacheServer{cache: cache}
+	start := time.Now()
+	_, err = r.Retrieve(context.Background(), &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: upstreamArtifacts, StructuredErrors: true})
+	assert.Equal(t, codes.NotFound, grpc.Code(err), "A failing upstream is treated as a miss")
+	assert.True(t, time.Since(start) < 5*time.Second, "It doesn't wait longer than the timeout")
+}
+
+func TestServeFromUpstreamIfStoringFails(t *testing.T) {
+	remote := newCache("test_upstream_populate_remote")
+	defer os.RemoveAll(remote.rootPath)
+	require.NoError(t, remote.StoreArtifact(upstreamKey, []byte("archive")))
+	s := httptest.NewServer(BuildRouter(remote, ServerOptions{}))
+	defer s.Close()
+	upstream, err := NewUpstream(s.URL, true, 5*time.Second, dial.TLSFlags{})
+	require.NoError(t, err)
+	cache := newCache("test_upstream_populate_local")
+	defer os.RemoveAll(cache.rootPath)
+	cache.SetUpstream(upstream)
+	// Nothing can be written under the cache directory once it's a file.
+	require.NoError(t, os.RemoveAll(cache.rootPath))
+	require.NoError(t, ioutil.WriteFile(cache.rootPath, nil, 0644))
+
+	r := &RPCCacheServer{cache: cache}
+	resp, err := r.Retrieve(context.Background(), &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: upstreamArtifacts, StructuredErrors: true})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("archive"), resp.Artifacts[0].Body, "The client still gets the artifacts")
+	require.NoError(t, cache.Flush(context.Background()))
+	assert.False(t, cache.Contains(upstreamKey))
+}
+
+func TestRevalidateAgainstUpstream(t *testing.T) {
+	remote := newCache("test_revalidate_upstream_remote")
+	defer os.RemoveAll(remote.rootPath)
+	require.NoError(t, remote.StoreArtifact(upstreamKey, []byte("new archive")))
+	s := httptest.NewServer(BuildRouter(remote, ServerOptions{}))
+	defer s.Close()
+	upstream, err := NewUpstream(s.URL, true, 5*time.Second, dial.TLSFlags{})
+	require.NoError(t, err)
+	upstream.SetFreshness(time.Hour, false)
+	cache := newCache("test_revalidate_upstream_local")
+	defer os.RemoveAll(cache.rootPath)
+	clock := newFakeClock(time.Now())
+	cache.SetClock(clock)
+	require.NoError(t, cache.StoreArtifact(upstreamKey, []byte("old archive")))
+	cache.SetUpstream(upstream)
+	r := &RPCCacheServer{cache: cache}
+	req := &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: upstreamArtifacts, StructuredErrors: true}
+
+	resp, err := r.Retrieve(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old archive"), resp.Artifacts[0].Body, "It's still fresh")
+
+	clock.Advance(2 * time.Hour)
+	resp, err = r.Retrieve(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new archive"), resp.Artifacts[0].Body, "It's revalidated once it's stale")
+	require.NoError(t, cache.Flush(context.Background()))
+	resp, err = r.Retrieve(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new archive"), resp.Artifacts[0].Body, "The local copy is replaced")
+}
+
+func TestServeStaleOnUpstreamError(t *testing.T) {
+	for _, serveStale := range []bool{false, true} {
+		// Nothing's listening on this port.
+		upstream, err := NewUpstream("127.0.0.1:1", true, 200*time.Millisecond, dial.TLSFlags{})
+		require.NoError(t, err)
+		upstream.SetFreshness(time.Hour, serveStale)
+		cache := newCache("test_serve_stale")
+		defer os.RemoveAll(cache.rootPath)
+		clock := newFakeClock(time.Now())
+		cache.SetClock(clock)
+		require.NoError(t, cache.StoreArtifact(upstreamKey, []byte("archive")))
+		cache.SetUpstream(upstream)
+		r := &RPCCacheServer{cache: cache}
+		req := &pb.RetrieveRequest{Os: "linux", Arch: "amd64", Hash: []byte("hash"), Artifacts: upstreamArtifacts, StructuredErrors: true}
+		_, err = r.Retrieve(context.Background(), req)
+		assert.NoError(t, err, "Fresh artifacts are served without asking the upstream")
+
+		clock.Advance(2 * time.Hour)
+		resp, err := r.Retrieve(context.Background(), req)
+		if serveStale {
+			require.NoError(t, err)
+			assert.Equal(t, []byte("archive"), resp.Artifacts[0].Body)
+		} else {
+			assert.Equal(t, codes.NotFound, grpc.Code(err), "Stale artifacts aren't served if the upstream fails")
+		}
+	}
+}
+
+func TestForwardStoreToUpstream(t *testing.T) {
+	remote := newCache("test_forward_upstream_remote")
+	defer os.RemoveAll(remote.rootPath)
+	s := httptest.NewServer(BuildRouter(remote, ServerOptions{}))
+	defer s.Close()
+	forwarded := func() bool {
+		_, err := os.Stat(path.Join(remote.rootPath, upstreamKey))
+		return err == nil
+	}
+	for _, readonly := range []bool{true, false} {
+		upstream, err := NewUpstream(s.URL, readonly, 5*time.Second, dial.TLSFlags{})
+		require.NoError(t, err)
+		cache := newCache("test_forward_upstream_local")
+		defer os.RemoveAll(cache.rootPath)
+		cache.SetUpstream(upstream)
+		r := &RPCCacheServer{cache: cache}
+		resp, err := r.Store(context.Background(), &pb.StoreRequest{
+			Os:        "linux",
+			Arch:      "amd64",
+			Hash:      []byte("hash"),
+			Artifacts: []*pb.Artifact{{Package: "src/core", Target: "core", File: "core.a", Body: []byte("archive")}},
+		})
+		require.NoError(t, err)
+		assert.True(t, resp.Success)
+		if readonly {
+			time.Sleep(100 * time.Millisecond)
+			assert.False(t, forwarded(), "Stores aren't forwarded to a read-only upstream")
+			continue
+		}
+		for i := 0; i < 100 && !forwarded(); i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		assert.True(t, forwarded())
+	}
+}